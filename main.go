@@ -4,32 +4,56 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/epsniff/expodb/pkg/archive"
 	"github.com/epsniff/expodb/pkg/config"
+	"github.com/epsniff/expodb/pkg/copytable"
+	"github.com/epsniff/expodb/pkg/doctor"
+	"github.com/epsniff/expodb/pkg/loggingutils"
 	"github.com/epsniff/expodb/pkg/server"
+	"github.com/epsniff/expodb/pkg/snapshot"
 	"github.com/hashicorp/serf/serf"
 	"go.uber.org/zap"
 )
 
 func main() {
-
-	var cfg = zap.NewProductionConfig()
-	cfg.Level = zap.NewAtomicLevelAt(zap.DebugLevel)
-	logger, err := cfg.Build()
-	if err != nil {
-		panic(err)
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Exit(doctor.Main(os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "snapshot" {
+		os.Exit(snapshot.Main(os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "archive" {
+		os.Exit(archive.Main(os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "copy-table" {
+		os.Exit(copytable.Main(os.Args[2:], os.Stdout))
 	}
-	defer logger.Sync()
 
 	config, err := config.LoadConfig()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Configuration errors - %s\n", err)
 		os.Exit(1)
 	}
+
+	// the core logs every level, levels filters by module.
+	levels := loggingutils.NewLevels(config.LogLevel)
+	for module, lvl := range config.LogLevels {
+		levels.SetLevel(module, lvl)
+	}
+	levels.SetSampling(config.LogSampling)
+	var cfg = zap.NewProductionConfig()
+	cfg.Level = zap.NewAtomicLevelAt(zap.DebugLevel)
+	cfg.Sampling = nil
+	logger, err := cfg.Build(zap.WrapCore(levels.Wrap))
+	if err != nil {
+		panic(err)
+	}
+	defer logger.Sync()
 	logger = logger.Named(config.ID())
 
 	serf.DefaultConfig()
 
-	srv, err := server.New(config, logger)
+	srv, err := server.New(config, server.WithLogger(logger), server.WithLogLevels(levels))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error configuring node: %s", err)
 		os.Exit(1)
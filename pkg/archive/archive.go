@@ -0,0 +1,366 @@
+// Package archive restores a cluster's data from the archive its leader
+// ships the raft log and snapshots to, see the --archive-url flag.  It needs
+// nothing but the object store: not a single node has to survive.
+//
+// An archive holds
+//
+//	snapshots/snapshot-<index>/<files>  exported snapshots, snapshot.metadata last
+//	log/<first>-<last>.seg              the entries applied, see multiraft.WriteArchiveSegment
+//
+// A restore loads the newest snapshot at or before the point wanted then
+// applies the segments after it.
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/objstore"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	machines "github.com/epsniff/expodb/pkg/server/state-machines"
+	"github.com/epsniff/expodb/pkg/server/state-machines/apikeys"
+	"github.com/epsniff/expodb/pkg/server/state-machines/counters"
+	"github.com/epsniff/expodb/pkg/server/state-machines/cron"
+	"github.com/epsniff/expodb/pkg/server/state-machines/featureflags"
+	"github.com/epsniff/expodb/pkg/server/state-machines/sources"
+	"github.com/epsniff/expodb/pkg/server/triggers"
+	flag "github.com/ogier/pflag"
+)
+
+const (
+	// SnapshotsPrefix and SegmentsPrefix prefix the snapshots and the log
+	// segments of an archive.
+	SnapshotsPrefix = "snapshots/"
+	SegmentsPrefix  = "log/"
+)
+
+// StateMachines are the named state machines every cluster hosts, see
+// server.New.
+var StateMachines = []machines.Registration{counters.Registration, apikeys.Registration, featureflags.Registration, sources.Registration, cron.Registration}
+
+// ErrNothingToRestore is returned when the archive holds no snapshot the
+// point wanted can be restored from.
+var ErrNothingToRestore = errors.New("no archived snapshot to restore from")
+
+// Snapshot is an archived snapshot.  Taken is when its upload completed.
+type Snapshot struct {
+	Dir   string    `json:"dir"`
+	Index uint64    `json:"index"`
+	Taken time.Time `json:"taken"`
+	Size  int64     `json:"size"`
+}
+
+// Segment is an archived log segment, holding entries First to Last.
+type Segment struct {
+	Key      string    `json:"key"`
+	First    uint64    `json:"first"`
+	Last     uint64    `json:"last"`
+	Uploaded time.Time `json:"uploaded"`
+}
+
+// SegmentKey is the key of the segment holding the entries first to last.
+func SegmentKey(first, last uint64) string {
+	return fmt.Sprintf("%s%016x-%016x.seg", SegmentsPrefix, first, last)
+}
+
+// SnapshotKey is the key of a file of the exported snapshot at index.
+func SnapshotKey(index uint64, file string) string {
+	return fmt.Sprintf("%ssnapshot-%016X/%s", SnapshotsPrefix, index, file)
+}
+
+// Catalog is what an archive holds, by index.  Snapshots whose upload
+// didn't complete are left out, they are in Incomplete.
+type Catalog struct {
+	Snapshots  []Snapshot `json:"snapshots"`
+	Segments   []Segment  `json:"segments"`
+	Incomplete []Snapshot `json:"incomplete,omitempty"`
+}
+
+// List lists what the archive holds.
+func List(ctx context.Context, store objstore.Store) (*Catalog, error) {
+	cat := &Catalog{}
+	objects, err := store.List(ctx, SnapshotsPrefix)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := map[string]*Snapshot{}
+	complete := map[string]bool{}
+	for _, obj := range objects {
+		dir, file := path.Split(strings.TrimPrefix(obj.Key, SnapshotsPrefix))
+		dir = strings.TrimSuffix(dir, "/")
+		var index uint64
+		if _, err := fmt.Sscanf(dir, "snapshot-%X", &index); err != nil {
+			continue
+		}
+		s, ok := snapshots[dir]
+		if !ok {
+			s = &Snapshot{Dir: dir, Index: index}
+			snapshots[dir] = s
+		}
+		s.Size += obj.Size
+		if file == multiraft.SnapshotMetadataFile {
+			complete[dir] = true
+			s.Taken = obj.Modified
+		}
+	}
+	for dir, s := range snapshots {
+		if complete[dir] {
+			cat.Snapshots = append(cat.Snapshots, *s)
+		} else {
+			cat.Incomplete = append(cat.Incomplete, *s)
+		}
+	}
+	sort.Slice(cat.Snapshots, func(i, j int) bool { return cat.Snapshots[i].Index < cat.Snapshots[j].Index })
+	sort.Slice(cat.Incomplete, func(i, j int) bool { return cat.Incomplete[i].Index < cat.Incomplete[j].Index })
+
+	objects, err = store.List(ctx, SegmentsPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range objects {
+		seg := Segment{Key: obj.Key, Uploaded: obj.Modified}
+		if _, err := fmt.Sscanf(strings.TrimPrefix(obj.Key, SegmentsPrefix), "%016x-%016x.seg", &seg.First, &seg.Last); err != nil {
+			continue
+		}
+		cat.Segments = append(cat.Segments, seg)
+	}
+	sort.Slice(cat.Segments, func(i, j int) bool { return cat.Segments[i].First < cat.Segments[j].First })
+	return cat, nil
+}
+
+// Expired returns what the retention policy drops from the archive: the
+// snapshots completed before cutoff but the newest, the incomplete ones
+// before the oldest snapshot kept, and the segments only the dropped
+// snapshots need.
+func (cat *Catalog) Expired(cutoff time.Time) ([]Snapshot, []Segment) {
+	var snapshots []Snapshot
+	var segments []Segment
+	if len(cat.Snapshots) == 0 {
+		return nil, nil
+	}
+	oldest := cat.Snapshots[len(cat.Snapshots)-1]
+	for _, s := range cat.Snapshots[:len(cat.Snapshots)-1] {
+		if s.Taken.Before(cutoff) {
+			snapshots = append(snapshots, s)
+		} else if s.Index < oldest.Index {
+			oldest = s
+		}
+	}
+	for _, s := range cat.Incomplete {
+		if s.Index < oldest.Index {
+			snapshots = append(snapshots, s)
+		}
+	}
+	for _, seg := range cat.Segments {
+		if seg.Last <= oldest.Index {
+			segments = append(segments, seg)
+		}
+	}
+	return snapshots, segments
+}
+
+// Target is the point a restore goes back to: the entry Index, or the last
+// segment uploaded at or before Time.  The zero Target is the newest point
+// archived.
+type Target struct {
+	Index uint64
+	Time  time.Time
+}
+
+// plan picks the snapshot to restore from and the index to restore to.
+func (cat *Catalog) plan(target Target) (Snapshot, uint64, error) {
+	toIndex := uint64(math.MaxUint64)
+	if target.Index != 0 {
+		toIndex = target.Index
+	}
+	if !target.Time.IsZero() {
+		toIndex = 0
+		for _, seg := range cat.Segments {
+			if !seg.Uploaded.After(target.Time) && seg.Last > toIndex {
+				toIndex = seg.Last
+			}
+		}
+		for _, s := range cat.Snapshots {
+			if !s.Taken.After(target.Time) && s.Index > toIndex {
+				toIndex = s.Index
+			}
+		}
+	}
+	for i := len(cat.Snapshots) - 1; i >= 0; i-- {
+		if cat.Snapshots[i].Index <= toIndex {
+			return cat.Snapshots[i], toIndex, nil
+		}
+	}
+	return Snapshot{}, 0, ErrNothingToRestore
+}
+
+// Restore rebuilds the data the archive held at target into an exported
+// snapshot directory under dir, that a new cluster is started from.  sms are
+// the named state machines of the cluster archived, nil for the built in
+// ones.  The log is replayed with the built in triggers only.  It returns the snapshot directory and the index it was restored to.
+func Restore(ctx context.Context, store objstore.Store, target Target, dir string, sms []machines.Registration) (string, uint64, error) {
+	cat, err := List(ctx, store)
+	if err != nil {
+		return "", 0, err
+	}
+	snap, toIndex, err := cat.plan(target)
+	if err != nil {
+		return "", 0, err
+	}
+	download, err := os.MkdirTemp(dir, "download-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.RemoveAll(download)
+	objects, err := store.List(ctx, SnapshotsPrefix+snap.Dir+"/")
+	if err != nil {
+		return "", 0, err
+	}
+	for _, obj := range objects {
+		if err := fetch(ctx, store, obj.Key, filepath.Join(download, path.Base(obj.Key))); err != nil {
+			return "", 0, err
+		}
+	}
+
+	if sms == nil {
+		sms = StateMachines
+	}
+	// segments shipped twice, by a leader that failed before recording
+	// the upload, overlap: entries are only applied once.
+	var last uint64
+	entries := func(fn func(multiraft.ArchivedEntry) error) error {
+		for _, seg := range cat.Segments {
+			if seg.Last <= snap.Index || seg.Last <= last {
+				continue
+			}
+			if seg.First > toIndex {
+				return nil
+			}
+			r, err := store.Get(ctx, seg.Key)
+			if err != nil {
+				return err
+			}
+			err = multiraft.ReadArchiveSegment(r, func(e multiraft.ArchivedEntry) error {
+				if e.Index <= last {
+					return nil
+				}
+				last = e.Index
+				return fn(e)
+			})
+			r.Close()
+			if err != nil {
+				return fmt.Errorf("segment %s: %w", seg.Key, err)
+			}
+		}
+		return nil
+	}
+	return multiraft.RestoreArchive(dir, download, multiraft.Config{StateMachines: sms, Triggers: triggers.Builtin}, entries, toIndex)
+}
+
+func fetch(ctx context.Context, store objstore.Store, key, path string) error {
+	r, err := store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("fetching %s: %w", key, err)
+	}
+	return f.Close()
+}
+
+const usage = `usage: expodb archive <command> --url=<archive url> [flags]
+
+commands:
+  list     list the archived snapshots and log segments
+  restore  rebuild the data at --to-index or --to-time, the newest archived
+           otherwise, into a snapshot directory under --out
+`
+
+// Main runs the archive subcommand with its command line arguments,
+// printing to w, and returns the process' exit code: 0 on success, 1 when
+// the archive can't be read or restored, 2 for bad arguments.
+func Main(args []string, w io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(w, usage)
+		return 2
+	}
+	cmd := args[0]
+	fs := flag.NewFlagSet("archive "+cmd, flag.ContinueOnError)
+	fs.SetOutput(w)
+	url := fs.String("url", "", "Archive to read, as given to --archive-url")
+	toIndex := fs.Uint64("to-index", 0, "Raft index to restore to")
+	toTime := fs.String("to-time", "", "RFC 3339 time to restore to, as of the last log segment archived by then")
+	out := fs.String("out", ".", "Directory to write the restored snapshot under")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if *url == "" || fs.NArg() != 0 {
+		fmt.Fprint(w, usage)
+		return 2
+	}
+	store, err := objstore.Open(*url)
+	if err != nil {
+		fmt.Fprintf(w, "opening archive: %v\n", err)
+		return 2
+	}
+	ctx := context.Background()
+
+	switch cmd {
+	case "list":
+		var cat *Catalog
+		if cat, err = List(ctx, store); err == nil {
+			tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+			fmt.Fprintf(tw, "SNAPSHOT\tINDEX\tTAKEN\tSIZE\n")
+			for _, s := range cat.Snapshots {
+				fmt.Fprintf(tw, "%s\t%d\t%s\t%d\n", s.Dir, s.Index, s.Taken.UTC().Format(time.RFC3339), s.Size)
+			}
+			for _, s := range cat.Incomplete {
+				fmt.Fprintf(tw, "%s\t%d\tincomplete\t%d\n", s.Dir, s.Index, s.Size)
+			}
+			tw.Flush()
+			if n := len(cat.Segments); n > 0 {
+				fmt.Fprintf(w, "%d log segments, entries %d to %d, last uploaded %s\n", n,
+					cat.Segments[0].First, cat.Segments[n-1].Last, cat.Segments[n-1].Uploaded.UTC().Format(time.RFC3339))
+			} else {
+				fmt.Fprintln(w, "no log segments")
+			}
+		}
+	case "restore":
+		target := Target{Index: *toIndex}
+		if *toTime != "" {
+			if target.Time, err = time.Parse(time.RFC3339, *toTime); err != nil {
+				fmt.Fprintf(w, "--to-time: %v\n", err)
+				return 2
+			}
+		}
+		var dir string
+		var index uint64
+		if dir, index, err = Restore(ctx, store, target, *out, nil); err == nil {
+			fmt.Fprintf(w, "restored index %d to %s\n", index, dir)
+		}
+	default:
+		fmt.Fprint(w, usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s: %v\n", cmd, err)
+		return 1
+	}
+	return 0
+}
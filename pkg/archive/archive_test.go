@@ -0,0 +1,90 @@
+package archive
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/objstore"
+)
+
+func TestCatalog(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := objstore.Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	put := func(key string, age time.Duration) {
+		t.Helper()
+		if err := store.Put(ctx, key, strings.NewReader("x"), 1); err != nil {
+			t.Fatal(err)
+		}
+		at := now.Add(-age)
+		if err := os.Chtimes(filepath.Join(dir, key), at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(SnapshotKey(10, "snapshot-000000000000000A.gbsnap"), 50*time.Hour)
+	put(SnapshotKey(10, "snapshot.metadata"), 50*time.Hour)
+	put(SegmentKey(11, 20), 40*time.Hour)
+	put(SnapshotKey(20, "snapshot.metadata"), 30*time.Hour)
+	put(SegmentKey(21, 30), 20*time.Hour)
+	put(SegmentKey(25, 40), 10*time.Hour) // shipped again, with more
+	put(SnapshotKey(40, "snapshot.metadata"), 5*time.Hour)
+	put(SnapshotKey(50, "snapshot-0000000000000032.gbsnap"), time.Hour) // still uploading
+	put(SegmentKey(41, 60), time.Hour)
+
+	cat, err := List(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cat.Snapshots) != 3 || cat.Snapshots[0].Index != 10 || cat.Snapshots[0].Size != 2 || cat.Snapshots[2].Index != 40 {
+		t.Errorf("snapshots = %+v", cat.Snapshots)
+	}
+	if len(cat.Incomplete) != 1 || cat.Incomplete[0].Index != 50 {
+		t.Errorf("incomplete = %+v", cat.Incomplete)
+	}
+	if len(cat.Segments) != 4 || cat.Segments[1].First != 21 || cat.Segments[1].Last != 30 {
+		t.Errorf("segments = %+v", cat.Segments)
+	}
+
+	for _, tc := range []struct {
+		target   Target
+		snapshot uint64
+		toIndex  uint64
+	}{
+		{Target{}, 40, 1<<64 - 1},
+		{Target{Index: 35}, 20, 35},
+		{Target{Index: 10}, 10, 10},
+		{Target{Time: now.Add(-15 * time.Hour)}, 20, 30},
+		{Target{Time: now.Add(-45 * time.Hour)}, 10, 10},
+	} {
+		snap, toIndex, err := cat.plan(tc.target)
+		if err != nil || snap.Index != tc.snapshot || toIndex != tc.toIndex {
+			t.Errorf("plan(%+v) = %d, %d, %v, want %d, %d", tc.target, snap.Index, toIndex, err, tc.snapshot, tc.toIndex)
+		}
+	}
+	if _, _, err := cat.plan(Target{Time: now.Add(-60 * time.Hour)}); err != ErrNothingToRestore {
+		t.Errorf("plan() before the first snapshot error = %v, want ErrNothingToRestore", err)
+	}
+
+	// a day of retention keeps the snapshot at 40 only, and the segments
+	// after it.
+	snapshots, segments := cat.Expired(now.Add(-24 * time.Hour))
+	if len(snapshots) != 2 || snapshots[0].Index != 10 || snapshots[1].Index != 20 {
+		t.Errorf("expired snapshots = %+v, want 10 and 20", snapshots)
+	}
+	if len(segments) != 3 || segments[2].Last != 40 {
+		t.Errorf("expired segments = %+v, want those up to 40", segments)
+	}
+	// the newest snapshot is kept whatever its age, and the one still
+	// uploading after it.
+	if snapshots, _ := cat.Expired(now); len(snapshots) != 2 {
+		t.Errorf("expired snapshots = %+v, want 10 and 20", snapshots)
+	}
+}
@@ -0,0 +1,450 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/epsniff/expodb/pkg/errdefs"
+	"github.com/epsniff/expodb/pkg/tracing"
+)
+
+const (
+	// routingHeader mirrors the server's routing hint header.
+	routingHeader = "X-Expodb-Route"
+	// sessionHeader mirrors the server's session header, "<node id>:<index>".
+	sessionHeader = "X-Expodb-Session"
+	// clientIDHeader and sequenceHeader mirror the server's write dedup
+	// headers, a write retried with the same pair is applied only once.
+	clientIDHeader = "X-Expodb-Client-Id"
+	sequenceHeader = "X-Expodb-Sequence"
+	// requestIDHeader mirrors the server's request ID header, the ID is
+	// taken from the context with tracing.RequestID.
+	requestIDHeader = "X-Expodb-Request-Id"
+	// writeAttempts bounds how often a write is sent when the connection
+	// fails before an answer.
+	writeAttempts = 3
+)
+
+var (
+	ErrKeyNotFound     = errdefs.New(errdefs.ErrNotFound, "key not found")
+	ErrVersionMismatch = errdefs.New(errdefs.ErrConflict, "row was modified since the expected version")
+)
+
+// Client talks to an expodb cluster over HTTP.  It caches the cluster's shard
+// map and sends each request directly to the node owning the key's partition,
+// falling back to the seed addresses when no route is known.
+type Client struct {
+	httpClient *http.Client
+	seeds      []string
+	token      string // bearer token, see SetToken
+	clientID   string // random, identifies our writes for deduplication
+	seq        atomic.Uint64
+
+	mu             sync.RWMutex
+	partitionCount int
+	routes         map[int]string // partition -> http address
+	sessionNode    string         // the coordinating node the cluster bound us to
+	sessionIndex   uint64         // the highest raft index seen
+}
+
+// New creates a client using the given http addresses (host:port) as seeds.
+func New(addrs ...string) *Client {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &Client{
+		httpClient: http.DefaultClient,
+		seeds:      addrs,
+		clientID:   hex.EncodeToString(id),
+		routes:     map[int]string{},
+	}
+}
+
+// SetToken makes the client authenticate its requests with a bearer token,
+// for clusters started with an auth policy.
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+type shardMap struct {
+	PartitionCount int `json:"partition_count"`
+	Partitions     []struct {
+		Partition int    `json:"partition"`
+		HTTPAddr  string `json:"http_addr"`
+	} `json:"partitions"`
+}
+
+// Refresh fetches the shard map from the first seed that answers.
+func (c *Client) Refresh(ctx context.Context) error {
+	var lastErr error
+	for _, addr := range c.seeds {
+		sm := &shardMap{}
+		if err := c.do(ctx, http.MethodGet, addr, "/v1/cluster/shards", nil, sm); err != nil {
+			lastErr = err
+			continue
+		}
+		routes := map[int]string{}
+		for _, p := range sm.Partitions {
+			routes[p.Partition] = p.HTTPAddr
+		}
+		c.mu.Lock()
+		c.partitionCount = sm.PartitionCount
+		c.routes = routes
+		c.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("refreshing shard map: %w", lastErr)
+}
+
+// Set sets a single column of a row and returns the raft index it was
+// applied at.
+func (c *Client) Set(ctx context.Context, table, key, column, value string) (uint64, error) {
+	req := map[string]string{"table": table, "key": key, "column": column, "value": value}
+	resp := struct {
+		Index uint64 `json:"index"`
+	}{}
+	if err := c.write(ctx, c.addrFor(table, key), "/v1/key/_update", req, &resp); err != nil {
+		return 0, err
+	}
+	c.observeIndex(resp.Index)
+	return resp.Index, nil
+}
+
+// PutIfAbsent sets a column of a row only if it doesn't exist yet and
+// reports whether it did, e.g. to claim a key: of concurrent puts exactly one
+// creates it.
+func (c *Client) PutIfAbsent(ctx context.Context, table, key, column, value string) (bool, error) {
+	req := map[string]interface{}{"table": table, "key": key, "column": column, "value": value, "if_absent": true}
+	resp := struct {
+		Index   uint64 `json:"index"`
+		Created bool   `json:"created"`
+	}{}
+	if err := c.write(ctx, c.addrFor(table, key), "/v1/key/_update", req, &resp); err != nil {
+		return false, err
+	}
+	if resp.Created {
+		c.observeIndex(resp.Index)
+	}
+	return resp.Created, nil
+}
+
+// SetRow sets several columns of a row atomically, readers see either all of
+// them or none.  With replace the row's other columns are deleted.
+func (c *Client) SetRow(ctx context.Context, table, key string, columns map[string]string, replace bool) (uint64, error) {
+	return c.setRow(ctx, table, key, columns, replace, nil)
+}
+
+// SetRowIfMatch is SetRow that only applies if the row's version, as returned
+// by GetRow, is still version.  It fails with ErrVersionMismatch otherwise.
+// A version of 0 only applies if the row was never written.
+func (c *Client) SetRowIfMatch(ctx context.Context, table, key string, columns map[string]string, version uint64) (uint64, error) {
+	return c.setRow(ctx, table, key, columns, false, &version)
+}
+
+func (c *Client) setRow(ctx context.Context, table, key string, columns map[string]string, replace bool, ifMatch *uint64) (uint64, error) {
+	req := struct {
+		Table   string            `json:"table"`
+		Key     string            `json:"key"`
+		Columns map[string]string `json:"columns"`
+		Replace bool              `json:"replace,omitempty"`
+		IfMatch *uint64           `json:"if_match,omitempty"`
+	}{table, key, columns, replace, ifMatch}
+	resp := struct {
+		Index uint64 `json:"index"`
+	}{}
+	if err := c.write(ctx, c.addrFor(table, key), "/v1/key/_update_row", req, &resp); err != nil {
+		return 0, err
+	}
+	c.observeIndex(resp.Index)
+	return resp.Index, nil
+}
+
+// Delete deletes a column of a row, or the whole row when column is empty,
+// and returns the raft index it was applied at.
+func (c *Client) Delete(ctx context.Context, table, key, column string) (uint64, error) {
+	req := map[string]string{"table": table, "key": key, "column": column}
+	resp := struct {
+		Index uint64 `json:"index"`
+	}{}
+	if err := c.write(ctx, c.addrFor(table, key), "/v1/key/_delete", req, &resp); err != nil {
+		return 0, err
+	}
+	c.observeIndex(resp.Index)
+	return resp.Index, nil
+}
+
+// GetRow fetches all columns of a row and its version, the raft index it was
+// last modified at, using a linearizable read.
+func (c *Client) GetRow(ctx context.Context, table, key string) (map[string]string, uint64, error) {
+	req := map[string]string{"table": table, "key": key}
+	resp := struct {
+		Result  map[string]string `json:"result"`
+		Version uint64            `json:"version"`
+	}{}
+	if err := c.do(ctx, http.MethodPost, c.addrFor(table, key), "/v1/key/_fetch", req, &resp); err != nil {
+		return nil, 0, err
+	}
+	return resp.Result, resp.Version, nil
+}
+
+// Get fetches the given columns of a row, or all of them when none are
+// given, using a linearizable read.
+func (c *Client) Get(ctx context.Context, table, key string, columns ...string) (map[string]string, error) {
+	row, _, err := c.fetch(ctx, table, key, 0, columns)
+	return row, err
+}
+
+// GetAtIndex fetches all columns of a row from a replica that has applied at
+// least minIndex.  Passing the largest index seen so far gives monotonic reads
+// without going through the leader.  A minIndex of zero does a linearizable
+// read.  The returned index can be fed back into the next call.
+func (c *Client) GetAtIndex(ctx context.Context, table, key string, minIndex uint64) (map[string]string, uint64, error) {
+	return c.fetch(ctx, table, key, minIndex, nil)
+}
+
+// GetMonotonic fetches all columns of a row from any replica that has caught
+// up with everything this client has seen, so reads never go back in time
+// even when they land on different nodes.  Before anything was seen it does a
+// linearizable read.
+func (c *Client) GetMonotonic(ctx context.Context, table, key string) (map[string]string, error) {
+	row, _, err := c.fetch(ctx, table, key, c.SessionIndex(), nil)
+	return row, err
+}
+
+// SessionIndex returns the highest raft index this client has seen.
+func (c *Client) SessionIndex() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sessionIndex
+}
+
+// observeIndex folds an index returned by the cluster into the session.
+func (c *Client) observeIndex(index uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if index > c.sessionIndex {
+		c.sessionIndex = index
+	}
+}
+
+func (c *Client) fetch(ctx context.Context, table, key string, minIndex uint64, columns []string) (map[string]string, uint64, error) {
+	req := struct {
+		Table    string   `json:"table"`
+		Key      string   `json:"key"`
+		MinIndex uint64   `json:"min_index,omitempty"`
+		Columns  []string `json:"columns,omitempty"`
+	}{table, key, minIndex, columns}
+	resp := struct {
+		Result map[string]string `json:"result"`
+		Index  uint64            `json:"index"`
+	}{}
+	if err := c.do(ctx, http.MethodPost, c.addrFor(table, key), "/v1/key/_fetch", req, &resp); err != nil {
+		return nil, 0, err
+	}
+	c.observeIndex(resp.Index)
+	return resp.Result, resp.Index, nil
+}
+
+// Row is a row of a table, with its version.
+type Row struct {
+	Key     string            `json:"key"`
+	Columns map[string]string `json:"columns"`
+	Version uint64            `json:"version,omitempty"`
+}
+
+// ErrExportCutShort is returned by ExportTable when the stream ended before
+// the cluster said it was complete.
+var ErrExportCutShort = errors.New("table export cut short")
+
+// ExportTable calls fn with every row of a user table after the row key
+// after, from the start when empty, in key order.  The rows are consistent
+// with the raft index returned: they all come from one snapshot of the
+// seed's replica, taken once it had applied every write acked before.  It
+// needs an admin token.  When fn or the export fails, a call after the last
+// row fn took resumes it, from a newer snapshot.
+func (c *Client) ExportTable(ctx context.Context, table, after string, fn func(Row) error) (uint64, error) {
+	req := map[string]string{"table": table, "after": after}
+	resp, err := c.send(ctx, http.MethodPost, c.seeds[0], "/v1/admin/_export_table", nil, req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		line := struct {
+			Row   *Row   `json:"row"`
+			Done  bool   `json:"done"`
+			Index uint64 `json:"index"`
+			Error string `json:"error"`
+		}{}
+		if err := dec.Decode(&line); err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, ErrExportCutShort
+		} else if err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrExportCutShort, err)
+		}
+		switch {
+		case line.Row != nil:
+			if err := fn(*line.Row); err != nil {
+				return 0, err
+			}
+		case line.Done:
+			c.observeIndex(line.Index)
+			return line.Index, nil
+		case line.Error != "":
+			return 0, fmt.Errorf("expodb: exporting %s: %s", table, line.Error)
+		}
+	}
+}
+
+// addrFor picks the node owning the key's partition, or the first seed.
+func (c *Client) addrFor(table, key string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.partitionCount > 0 {
+		if addr, ok := c.routes[partitionID(table, key, c.partitionCount)]; ok {
+			return addr
+		}
+	}
+	return c.seeds[0]
+}
+
+// partitionID must match the server's consistent hashing of routing keys.
+func partitionID(table, key string, partitionCount int) int {
+	f := fnv.New64a()
+	f.Write([]byte(table + ":" + key))
+	return int(f.Sum64() % uint64(partitionCount))
+}
+
+// write POSTs a write, resending it when the connection fails before an
+// answer.  Every attempt carries the same sequence, so the cluster applies it
+// once however many of them got through.
+func (c *Client) write(ctx context.Context, addr, path string, body, out interface{}) error {
+	header := http.Header{}
+	header.Set(clientIDHeader, c.clientID)
+	header.Set(sequenceHeader, strconv.FormatUint(c.seq.Add(1), 10))
+	var err error
+	for attempt := 0; attempt < writeAttempts; attempt++ {
+		err = c.doHeader(ctx, http.MethodPost, addr, path, header, body, out)
+		var uerr *url.Error
+		if !errors.As(err, &uerr) || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+type dryRunKey struct{}
+
+// WithDryRun makes the requests made with ctx dry runs: the cluster checks
+// writes (schemas, unique indexes, locks, ACLs) without applying them, they
+// report index 0 when they'd be accepted.
+func WithDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+func (c *Client) do(ctx context.Context, method, addr, path string, body, out interface{}) error {
+	return c.doHeader(ctx, method, addr, path, nil, body, out)
+}
+
+func (c *Client) doHeader(ctx context.Context, method, addr, path string, header http.Header, body, out interface{}) error {
+	resp, err := c.send(ctx, method, addr, path, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// send makes a request and returns the response if it is a 200, which the
+// caller must close, or the error the cluster answered with.
+func (c *Client) send(ctx context.Context, method, addr, path string, header http.Header, body interface{}) (*http.Response, error) {
+	var reqBody io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(buf)
+	}
+	if dry, _ := ctx.Value(dryRunKey{}).(bool); dry {
+		path += "?dry_run=true"
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+addr+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if id := tracing.RequestID(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	c.mu.RLock()
+	if c.sessionNode != "" {
+		req.Header.Set(sessionHeader, c.sessionNode+":"+strconv.FormatUint(c.sessionIndex, 10))
+	}
+	c.mu.RUnlock()
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	c.updateSession(resp.Header.Get(sessionHeader))
+
+	if hint := resp.Header.Get(routingHeader); hint != "" && hint != addr {
+		// our route was stale, the next refresh will pick up the new owner.
+		go c.Refresh(context.Background())
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, ErrKeyNotFound
+	case http.StatusPreconditionFailed:
+		return nil, ErrVersionMismatch
+	}
+	msg, _ := io.ReadAll(resp.Body)
+	err = fmt.Errorf("expodb: %s %s: %s: %s", method, path, resp.Status, msg)
+	// errors.Is(err, errdefs.ErrConflict) and the like work on the kind
+	// the server reported.
+	return nil, errdefs.Wrap(errdefs.FromCode(resp.Header.Get(errdefs.Header)), err)
+}
+
+// updateSession keeps the session node returned by the cluster and advances
+// the session's index.
+func (c *Client) updateSession(session string) {
+	i := strings.LastIndex(session, ":")
+	if i <= 0 {
+		return
+	}
+	index, err := strconv.ParseUint(session[i+1:], 10, 64)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sessionNode = session[:i]
+	if index > c.sessionIndex {
+		c.sessionIndex = index
+	}
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClient_Routing(t *testing.T) {
+	const partitions = 4
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/cluster/shards" {
+			http.NotFound(w, r)
+			return
+		}
+		// partition 3 has no route, its owner is down.
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"partition_count": partitions,
+			"hash":            "fnv64a",
+			"partitions": []map[string]interface{}{
+				{"partition": 0, "owner": "node-1", "http_addr": "node-1:8000"},
+				{"partition": 1, "owner": "node-2", "http_addr": "node-2:8000"},
+				{"partition": 2, "owner": "node-1", "http_addr": "node-1:8000"},
+			},
+		})
+	}))
+	defer srv.Close()
+	seed := strings.TrimPrefix(srv.URL, "http://")
+
+	c := New(seed)
+	if got := c.addrFor("t", "k"); got != seed {
+		t.Errorf("addrFor() before Refresh = %s, want the seed %s", got, seed)
+	}
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	want := map[int]string{0: "node-1:8000", 1: "node-2:8000", 2: "node-1:8000", 3: seed}
+	tests := []struct {
+		table, key string
+	}{
+		{"users", "alice"},
+		{"users", "bob"},
+		{"users", "carol"},
+		{"orders", "o1"},
+		{"orders", "o2"},
+		{"", ""},
+	}
+	seen := map[int]bool{}
+	for _, tt := range tests {
+		part := partitionID(tt.table, tt.key, partitions)
+		seen[part] = true
+		if got := c.addrFor(tt.table, tt.key); got != want[part] {
+			t.Errorf("addrFor(%q, %q) of partition %d = %s, want %s", tt.table, tt.key, part, got, want[part])
+		}
+	}
+	if len(seen) < 2 {
+		t.Errorf("keys only hash to partitions %v, want them spread", seen)
+	}
+
+	if err := New("127.0.0.1:1").Refresh(context.Background()); err == nil {
+		t.Error("Refresh() with no seed answering succeeded")
+	}
+}
+
+func TestPartitionID(t *testing.T) {
+	tests := []struct {
+		table, key string
+		count      int
+		want       int
+	}{
+		// fnv64a("t:k") = 0x564bcf1943d15fb0
+		{"t", "k", 1, 0},
+		{"t", "k", 16, 0},
+		{"t", "k", 271, 60},
+		{"t", "k", 1000, 0x564bcf1943d15fb0 % 1000},
+	}
+	for _, tt := range tests {
+		if got := partitionID(tt.table, tt.key, tt.count); got != tt.want {
+			t.Errorf("partitionID(%q, %q, %d) = %d, want %d", tt.table, tt.key, tt.count, got, tt.want)
+		}
+	}
+}
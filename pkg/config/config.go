@@ -6,10 +6,38 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/epsniff/expodb/pkg/fieldcrypt"
+	"github.com/epsniff/expodb/pkg/objstore"
 	multierror "github.com/hashicorp/go-multierror"
 	template "github.com/hashicorp/go-sockaddr/template"
 	flag "github.com/ogier/pflag"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// FSyncAlways fsyncs the FSM on every applied batch.
+	FSyncAlways = "always"
+	// FSyncPeriodic lets dragonboat decide when to sync the FSM, relying on
+	// the raft log to replay anything lost in a crash.
+	FSyncPeriodic = "periodic"
+
+	// WriteAckApplied acks writes once applied to the local FSM.
+	WriteAckApplied = "applied"
+	// WriteAckCommitted acks writes once committed by a raft quorum.
+	WriteAckCommitted = "committed"
+
+	// NodeRoleVoter nodes hold a full replica of the data and vote in raft.
+	NodeRoleVoter = "voter"
+	// NodeRoleWitness nodes vote in raft but store no user data, they are
+	// cheap tiebreakers for two-datacenter deployments.
+	NodeRoleWitness = "witness"
+
+	// CompressionZstd compresses raft traffic to peers advertising support.
+	CompressionZstd = "zstd"
+	// CompressionNone never compresses it.
+	CompressionNone = "none"
 )
 
 type args struct {
@@ -26,6 +54,60 @@ type args struct {
 	Bootstrap            bool
 	IsSeed               bool
 	NodeName             string
+	LegacyDataDir        string
+	RestoreFrom          string
+	FSyncPolicy          string
+	WriteAck             string
+	JoinToken            string
+	ClusterID            string
+	Zone                 string
+	NodeRole             string
+	Standby              bool
+	ReplicateTo          string
+	ReplicationToken     string
+	ReplicationInterval  time.Duration
+	ReplicationTimeout   time.Duration
+	ArchiveURL           string
+	ArchiveSnapshots     time.Duration
+	ArchiveSegments      time.Duration
+	ArchiveRetention     time.Duration
+	RESPPort             int
+	RESPTable            string
+	MemcachePort         int
+	MemcacheTable        string
+	StatsdAddr           string
+	StatsdPrefix         string
+	StatsdInterval       time.Duration
+	Dogstatsd            bool
+	LogLevel             string
+	LogLevels            string
+	LogSampling          bool
+	LogUnredacted        string
+	ShutdownGracePeriod  time.Duration
+	LeaveRemovesReplica  bool
+	AuthPolicyFile       string
+	OIDCIssuer           string
+	OIDCAudience         string
+	OIDCPolicyClaim      string
+	ColumnKeys           string
+	DiskMinFreePercent   float64
+	DiskCheckInterval    time.Duration
+	DiskEmergencyCompact bool
+	SinglePort           bool
+	RPCCompression       string
+	AutopilotDemoteLag   time.Duration
+	AutopilotDemoteAfter time.Duration
+	NoAutopilotDemote    bool
+	SerfCoalescePeriod   time.Duration
+	SerfQuiescentPeriod  time.Duration
+	SerfEventQueueDepth  int
+	SerfMaxQueueDepth    int
+	SerfReapInterval     time.Duration
+	SerfReconnectTimeout time.Duration
+	SerfTombstoneTimeout time.Duration
+	QueryTimeout         time.Duration
+	QueryMaxRows         int
+	QueryMaxBytes        int
 }
 
 type Config struct {
@@ -46,14 +128,233 @@ type Config struct {
 	RaftBindPort    int
 	RaftDataDir     string
 	Bootstrap       bool
+	// SinglePort carries raft traffic on the HTTP port, RaftBindPort is then
+	// the HTTP port.  Every node of a cluster has to agree on it.
+	SinglePort bool
+	// RPCCompression is CompressionZstd or CompressionNone, it only applies
+	// to raft traffic on the HTTP port, see SinglePort.  dragonboat's own
+	// transport on RaftBindPort is internal to it and can't be wrapped.
+	RPCCompression string
+
+	// FSyncPolicy is one of FSyncAlways or FSyncPeriodic.
+	FSyncPolicy string
+	// WriteAck is one of WriteAckApplied or WriteAckCommitted.
+	WriteAck string
 
 	NodeName string
+
+	// LegacyDataDir points at a data directory written by the old single-raft
+	// simplestore.  When set, the leader imports its rows on startup.
+	LegacyDataDir string
+	// RestoreFrom is an exported snapshot directory the bootstrap node
+	// seeds a new cluster with, under its own IDs and addresses.
+	RestoreFrom string
+
+	// JoinToken is presented when joining the raft group.  When set on the
+	// leader, only nodes presenting it (or a one-time join token) are added.
+	JoinToken string
+
+	// ClusterID pins the ID of the cluster, recorded in the raft data dir.
+	// Empty lets the bootstrap node generate one and the others adopt it.
+	ClusterID string
+
+	// Zone is the availability zone or rack of the node, voters are spread
+	// across zones.
+	Zone string
+
+	// NodeRole is one of NodeRoleVoter or NodeRoleWitness.
+	NodeRole string
+
+	// Standby runs the cluster as the standby of another cluster: client
+	// writes are rejected and data is shipped in from the primary until the
+	// standby is promoted.
+	Standby bool
+	// ReplicateTo is the address of a standby cluster node the leader ships
+	// snapshots to every ReplicationInterval: host:port for http, or an
+	// http:// or https:// URL.  A shipment taking over ReplicationTimeout
+	// is abandoned.
+	ReplicateTo         string
+	ReplicationInterval time.Duration
+	ReplicationTimeout  time.Duration
+	// ReplicationToken authenticates the primary to the standby, both
+	// clusters must be started with the same one.
+	ReplicationToken string
+
+	// ArchiveURL is the object store the leader ships the raft log and
+	// snapshots to, see objstore.Open.  Empty disables archiving.
+	ArchiveURL string
+	// ArchiveSnapshots is how often a snapshot is archived, ArchiveSegments
+	// how often the log applied since the last segment is.
+	ArchiveSnapshots time.Duration
+	ArchiveSegments  time.Duration
+	// ArchiveRetention is how long archived snapshots are kept, the newest
+	// one always is.  Segments are kept as long as a snapshot they follow.
+	ArchiveRetention time.Duration
+
+	// RESPBindPort is the port of the Redis protocol listener, 0 disables it.
+	RESPBindPort int
+	// RESPTable is the table plain Redis keys are stored in.
+	RESPTable string
+
+	// MemcacheBindPort is the port of the memcached text protocol listener, 0
+	// disables it.
+	MemcacheBindPort int
+	// MemcacheTable is the table memcached items are stored in.
+	MemcacheTable string
+
+	// StatsdAddr is the host:port of a statsd server internal metrics are
+	// pushed to every StatsdInterval, empty disables the push.
+	StatsdAddr     string
+	StatsdPrefix   string
+	StatsdInterval time.Duration
+	// Dogstatsd tags metrics with the node and zone, the way DogStatsD
+	// accepts them, rather than only prefixing them.
+	Dogstatsd bool
+
+	// LogLevel is the level of the loggers LogLevels sets none for, by the
+	// name of their module (serf-agent, raft-agent, http, ...).  LogSampling
+	// samples repeated log entries.  All three can be changed at runtime.
+	LogLevel    zapcore.Level
+	LogLevels   map[string]zapcore.Level
+	LogSampling bool
+	// LogUnredacted are the tables whose row keys and values appear in
+	// logs, traces and error messages as they are, "*" for all of them.
+	// Others are redacted, see loggingutils.Redact.
+	LogUnredacted []string
+
+	// ShutdownGracePeriod bounds draining the node on SIGINT or SIGTERM
+	// before its agents are shut down.
+	ShutdownGracePeriod time.Duration
+	// LeaveRemovesReplica has the leader remove the node's replica from the
+	// shard when it shuts down cleanly.  The node can't rejoin under its
+	// name afterwards, dragonboat never takes a removed replica ID back.
+	LeaveRemovesReplica bool
+
+	// AuthPolicyFile holds the bearer tokens and access policies of client
+	// requests, when empty every request is allowed.
+	AuthPolicyFile string
+	// OIDCIssuer, when set, also accepts JWTs from that issuer for
+	// OIDCAudience, their OIDCPolicyClaim values are mapped to policies.
+	OIDCIssuer      string
+	OIDCAudience    string
+	OIDCPolicyClaim string
+	// ColumnKeys seal the values of encrypted columns, the first one the
+	// new values, see fieldcrypt.
+	ColumnKeys []fieldcrypt.Key
+
+	// DiskMinFreePercent is the free space, in percent of the disk, below
+	// which the node stops accepting writes, 0 disables the check.  Data
+	// dirs are checked every DiskCheckInterval.
+	DiskMinFreePercent float64
+	DiskCheckInterval  time.Duration
+	// DiskEmergencyCompact snapshots raft (truncating its log) and compacts
+	// the store when free space runs low.
+	DiskEmergencyCompact bool
+
+	// AutopilotDemoteLag, when set, has the leader demote voters whose
+	// replication lag stays above it for AutopilotDemoteAfter to non-voters.
+	AutopilotDemoteLag   time.Duration
+	AutopilotDemoteAfter time.Duration
+	// NoAutopilotDemote exempts this node from being demoted.
+	NoAutopilotDemote bool
+
+	// SerfCoalescePeriod and SerfQuiescentPeriod bound how long serf holds
+	// member events back to coalesce them: until none came for the
+	// quiescent period, at most the coalesce period.
+	SerfCoalescePeriod  time.Duration
+	SerfQuiescentPeriod time.Duration
+	// SerfEventQueueDepth is how many serf events wait for the handlers,
+	// those queued together are batched, see the serf agent's eventLoop.
+	SerfEventQueueDepth int
+	// SerfMaxQueueDepth is how many gossip broadcasts serf queues before it
+	// drops the oldest.
+	SerfMaxQueueDepth int
+	// SerfReapInterval is how often failed and left members are reaped:
+	// failed ones after SerfReconnectTimeout, left ones after
+	// SerfTombstoneTimeout.
+	SerfReapInterval     time.Duration
+	SerfReconnectTimeout time.Duration
+	SerfTombstoneTimeout time.Duration
+
+	// QueryTimeout bounds the time a query page reads for, QueryMaxRows and
+	// QueryMaxBytes its rows and their bytes.  A page past one comes back
+	// short with a cursor to go on, requests can only lower them.
+	QueryTimeout  time.Duration
+	QueryMaxRows  int
+	QueryMaxBytes int
+}
+
+// parseColumnKeys parses id=key pairs, as given to --column-keys.  Keys are
+// hex, or env:, file: or vault: references to it.
+func parseColumnKeys(s string) ([]fieldcrypt.Key, error) {
+	var keys []fieldcrypt.Key
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		id, ref, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("want id=key, got:%q", pair)
+		}
+		secret, err := ResolveSecret(ref)
+		if err != nil {
+			return nil, fmt.Errorf("column key %s: %w", id, err)
+		}
+		key, err := fieldcrypt.ParseKey(id + "=" + secret)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// parseLogLevels parses module=level pairs, as given to --log-levels.
+func parseLogLevels(s string) (map[string]zapcore.Level, error) {
+	levels := map[string]zapcore.Level{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		module, level, ok := strings.Cut(pair, "=")
+		if !ok || module == "" {
+			return nil, fmt.Errorf("want module=level, got:%q", pair)
+		}
+		lvl, err := zapcore.ParseLevel(level)
+		if err != nil {
+			return nil, err
+		}
+		levels[module] = lvl
+	}
+	return levels, nil
 }
 
 func (c *Config) ID() string {
 	return c.NodeName
 }
 
+// IsWitness reports whether the node only votes and stores no user data.
+func (c *Config) IsWitness() bool {
+	return c.NodeRole == NodeRoleWitness
+}
+
+// SyncWrites reports whether every applied batch should be fsynced.
+func (c *Config) SyncWrites() bool {
+	return c.FSyncPolicy == FSyncAlways
+}
+
+// CompressRPC reports whether raft traffic to peers advertising support for
+// it is compressed, which takes SinglePort.
+func (c *Config) CompressRPC() bool {
+	return c.SinglePort && c.RPCCompression == CompressionZstd
+}
+
+// AckOnCommit reports whether writes are acknowledged once committed rather
+// than once applied.
+func (c *Config) AckOnCommit() bool {
+	return c.WriteAck == WriteAckCommitted
+}
+
 type ConfigError struct {
 	ConfigurationPoint string
 	Err                error
@@ -176,6 +477,354 @@ func LoadConfig() (*Config, error) {
 		errors = multierror.Append(errors, configErr)
 	}
 
+	// Durability
+	if args.FSyncPolicy != FSyncAlways && args.FSyncPolicy != FSyncPeriodic {
+		configErr := &ConfigError{
+			ConfigurationPoint: "fsync-policy",
+			Err:                fmt.Errorf("must be %q or %q, got:%q", FSyncAlways, FSyncPeriodic, args.FSyncPolicy),
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+	if args.WriteAck != WriteAckApplied && args.WriteAck != WriteAckCommitted {
+		configErr := &ConfigError{
+			ConfigurationPoint: "write-ack",
+			Err:                fmt.Errorf("must be %q or %q, got:%q", WriteAckApplied, WriteAckCommitted, args.WriteAck),
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+
+	// Node role
+	if args.NodeRole != NodeRoleVoter && args.NodeRole != NodeRoleWitness {
+		configErr := &ConfigError{
+			ConfigurationPoint: "node-role",
+			Err:                fmt.Errorf("must be %q or %q, got:%q", NodeRoleVoter, NodeRoleWitness, args.NodeRole),
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+	if args.NodeRole == NodeRoleWitness && args.Bootstrap {
+		configErr := &ConfigError{
+			ConfigurationPoint: "node-role",
+			Err:                fmt.Errorf("a witness cannot bootstrap the cluster"),
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+
+	// Secrets given as env:, file: or vault: references
+	for name, secret := range map[string]*string{"join-token": &args.JoinToken, "replication-token": &args.ReplicationToken} {
+		resolved, err := ResolveSecret(*secret)
+		if err != nil {
+			configErr := &ConfigError{
+				ConfigurationPoint: name,
+				Err:                err,
+			}
+			errors = multierror.Append(errors, configErr)
+		}
+		*secret = resolved
+	}
+
+	// Async replication
+	if (args.Standby || args.ReplicateTo != "") && args.ReplicationToken == "" {
+		configErr := &ConfigError{
+			ConfigurationPoint: "replication-token",
+			Err:                fmt.Errorf("required with --standby or --replicate-to"),
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+	if args.ReplicateTo != "" && args.ReplicationInterval <= 0 {
+		configErr := &ConfigError{
+			ConfigurationPoint: "replication-interval",
+			Err:                fmt.Errorf("must be positive, got:%v", args.ReplicationInterval),
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+	if args.ReplicateTo != "" && args.ReplicationTimeout <= 0 {
+		configErr := &ConfigError{
+			ConfigurationPoint: "replication-timeout",
+			Err:                fmt.Errorf("must be positive, got:%v", args.ReplicationTimeout),
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+	if scheme, _, ok := strings.Cut(args.ReplicateTo, "://"); ok && scheme != "http" && scheme != "https" {
+		configErr := &ConfigError{
+			ConfigurationPoint: "replicate-to",
+			Err:                fmt.Errorf("must be host:port or an http:// or https:// URL, got:%s", args.ReplicateTo),
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+
+	// Log archiving
+	if args.ArchiveURL != "" {
+		if _, err := objstore.Open(args.ArchiveURL); err != nil {
+			configErr := &ConfigError{
+				ConfigurationPoint: "archive-url",
+				Err:                err,
+			}
+			errors = multierror.Append(errors, configErr)
+		}
+		for name, d := range map[string]time.Duration{
+			"archive-snapshot-interval": args.ArchiveSnapshots,
+			"archive-segment-interval":  args.ArchiveSegments,
+			"archive-retention":         args.ArchiveRetention,
+		} {
+			if d <= 0 {
+				configErr := &ConfigError{
+					ConfigurationPoint: name,
+					Err:                fmt.Errorf("must be positive, got:%v", d),
+				}
+				errors = multierror.Append(errors, configErr)
+			}
+		}
+	}
+
+	// Redis protocol listener
+	if args.RESPPort != 0 && (args.RESPTable == "" || strings.HasPrefix(args.RESPTable, "_")) {
+		configErr := &ConfigError{
+			ConfigurationPoint: "resp-table",
+			Err:                fmt.Errorf("must be set and not a system table, got:%q", args.RESPTable),
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+
+	// Memcached protocol listener
+	if args.MemcachePort != 0 && (args.MemcacheTable == "" || strings.HasPrefix(args.MemcacheTable, "_")) {
+		configErr := &ConfigError{
+			ConfigurationPoint: "memcache-table",
+			Err:                fmt.Errorf("must be set and not a system table, got:%q", args.MemcacheTable),
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+	if args.MemcachePort != 0 && (args.AuthPolicyFile != "" || args.OIDCIssuer != "") {
+		configErr := &ConfigError{
+			ConfigurationPoint: "memcache-port",
+			Err:                fmt.Errorf("the memcached protocol has no authentication, it can't be served with --auth-policy-file or --oidc-issuer"),
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+
+	// Statsd sink
+	if args.StatsdAddr != "" {
+		if _, _, err := net.SplitHostPort(args.StatsdAddr); err != nil {
+			configErr := &ConfigError{
+				ConfigurationPoint: "statsd-addr",
+				Err:                err,
+			}
+			errors = multierror.Append(errors, configErr)
+		}
+		if args.StatsdInterval <= 0 {
+			configErr := &ConfigError{
+				ConfigurationPoint: "statsd-interval",
+				Err:                fmt.Errorf("must be positive, got:%v", args.StatsdInterval),
+			}
+			errors = multierror.Append(errors, configErr)
+		}
+	}
+
+	// Logging
+	logLevel, err := zapcore.ParseLevel(args.LogLevel)
+	if err != nil {
+		configErr := &ConfigError{
+			ConfigurationPoint: "log-level",
+			Err:                err,
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+	logLevels, err := parseLogLevels(args.LogLevels)
+	if err != nil {
+		configErr := &ConfigError{
+			ConfigurationPoint: "log-levels",
+			Err:                err,
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+
+	var logUnredacted []string
+	for _, table := range strings.Split(args.LogUnredacted, ",") {
+		if table = strings.TrimSpace(table); table != "" {
+			logUnredacted = append(logUnredacted, table)
+		}
+	}
+
+	// Shutdown
+	if args.ShutdownGracePeriod < 0 {
+		configErr := &ConfigError{
+			ConfigurationPoint: "shutdown-grace-period",
+			Err:                fmt.Errorf("must not be negative, got:%v", args.ShutdownGracePeriod),
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+
+	// Disk space watchdog
+	if args.DiskMinFreePercent < 0 || args.DiskMinFreePercent >= 100 {
+		configErr := &ConfigError{
+			ConfigurationPoint: "disk-min-free-percent",
+			Err:                fmt.Errorf("must be between 0 and 100, got:%v", args.DiskMinFreePercent),
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+	if args.DiskMinFreePercent > 0 && args.DiskCheckInterval <= 0 {
+		configErr := &ConfigError{
+			ConfigurationPoint: "disk-check-interval",
+			Err:                fmt.Errorf("must be positive, got:%v", args.DiskCheckInterval),
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+
+	if args.AutopilotDemoteLag < 0 {
+		configErr := &ConfigError{
+			ConfigurationPoint: "autopilot-demote-lag",
+			Err:                fmt.Errorf("must not be negative, got:%v", args.AutopilotDemoteLag),
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+	if args.AutopilotDemoteLag > 0 && args.AutopilotDemoteAfter <= 0 {
+		configErr := &ConfigError{
+			ConfigurationPoint: "autopilot-demote-after",
+			Err:                fmt.Errorf("must be positive, got:%v", args.AutopilotDemoteAfter),
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+
+	// Serf tuning
+	for _, d := range []struct {
+		point string
+		d     time.Duration
+	}{
+		{"serf-coalesce-period", args.SerfCoalescePeriod},
+		{"serf-quiescent-period", args.SerfQuiescentPeriod},
+		{"serf-reap-interval", args.SerfReapInterval},
+		{"serf-reconnect-timeout", args.SerfReconnectTimeout},
+		{"serf-tombstone-timeout", args.SerfTombstoneTimeout},
+	} {
+		if d.d <= 0 {
+			configErr := &ConfigError{
+				ConfigurationPoint: d.point,
+				Err:                fmt.Errorf("must be positive, got:%v", d.d),
+			}
+			errors = multierror.Append(errors, configErr)
+		}
+	}
+	if args.SerfQuiescentPeriod > args.SerfCoalescePeriod {
+		configErr := &ConfigError{
+			ConfigurationPoint: "serf-quiescent-period",
+			Err:                fmt.Errorf("must not be longer than --serf-coalesce-period, got:%v", args.SerfQuiescentPeriod),
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+	for _, d := range []struct {
+		point string
+		depth int
+	}{
+		{"serf-event-queue-depth", args.SerfEventQueueDepth},
+		{"serf-max-queue-depth", args.SerfMaxQueueDepth},
+	} {
+		if d.depth <= 0 {
+			configErr := &ConfigError{
+				ConfigurationPoint: d.point,
+				Err:                fmt.Errorf("must be positive, got:%v", d.depth),
+			}
+			errors = multierror.Append(errors, configErr)
+		}
+	}
+
+	// Query bounds
+	if args.QueryTimeout <= 0 {
+		configErr := &ConfigError{
+			ConfigurationPoint: "query-timeout",
+			Err:                fmt.Errorf("must be positive, got:%v", args.QueryTimeout),
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+	for _, d := range []struct {
+		point string
+		max   int
+	}{
+		{"query-max-rows", args.QueryMaxRows},
+		{"query-max-bytes", args.QueryMaxBytes},
+	} {
+		if d.max <= 0 {
+			configErr := &ConfigError{
+				ConfigurationPoint: d.point,
+				Err:                fmt.Errorf("must be positive, got:%v", d.max),
+			}
+			errors = multierror.Append(errors, configErr)
+		}
+	}
+
+	if args.RPCCompression != CompressionZstd && args.RPCCompression != CompressionNone {
+		configErr := &ConfigError{
+			ConfigurationPoint: "rpc-compression",
+			Err:                fmt.Errorf("must be %q or %q, got:%q", CompressionZstd, CompressionNone, args.RPCCompression),
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+	raftPort := args.RaftPort
+	if args.SinglePort {
+		raftPort = args.HTTPPort
+	}
+
+	// Auth policy
+	var authPolicyFile string
+	if args.AuthPolicyFile != "" {
+		authPolicyFile, err = filepath.Abs(args.AuthPolicyFile)
+		if err != nil {
+			configErr := &ConfigError{
+				ConfigurationPoint: "auth-policy-file",
+				Err:                err,
+			}
+			errors = multierror.Append(errors, configErr)
+		}
+	}
+
+	if args.OIDCIssuer != "" && (args.OIDCAudience == "" || args.AuthPolicyFile == "" || args.OIDCPolicyClaim == "") {
+		configErr := &ConfigError{
+			ConfigurationPoint: "oidc-issuer",
+			Err:                fmt.Errorf("requires --oidc-audience, --oidc-policy-claim and --auth-policy-file"),
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+
+	columnKeys, err := parseColumnKeys(args.ColumnKeys)
+	if err != nil {
+		configErr := &ConfigError{
+			ConfigurationPoint: "column-keys",
+			Err:                err,
+		}
+		errors = multierror.Append(errors, configErr)
+	}
+
+	// Legacy data directory
+	var legacyDataDir string
+	if args.LegacyDataDir != "" {
+		legacyDataDir, err = filepath.Abs(args.LegacyDataDir)
+		if err != nil {
+			configErr := &ConfigError{
+				ConfigurationPoint: "legacy-data-dir",
+				Err:                err,
+			}
+			errors = multierror.Append(errors, configErr)
+		}
+	}
+
+	// Restore to a new cluster
+	var restoreFrom string
+	if args.RestoreFrom != "" {
+		if !args.Bootstrap {
+			configErr := &ConfigError{
+				ConfigurationPoint: "restore-from",
+				Err:                fmt.Errorf("only the node bootstrapping the cluster restores, the others join it"),
+			}
+			errors = multierror.Append(errors, configErr)
+		}
+		restoreFrom, err = filepath.Abs(args.RestoreFrom)
+		if err != nil {
+			configErr := &ConfigError{
+				ConfigurationPoint: "restore-from",
+				Err:                err,
+			}
+			errors = multierror.Append(errors, configErr)
+		}
+	}
+
 	if !args.IsSeed && len(args.SerfJoinAddrs) == 0 {
 		configErr := &ConfigError{
 			ConfigurationPoint: "serf-join",
@@ -189,21 +838,75 @@ func LoadConfig() (*Config, error) {
 	}
 
 	return &Config{
-		NodeName:          args.NodeName,
-		RaftDataDir:       raftDataDir,
-		JoinAddress:       args.JoinAddress, //TODO - validate this looks address-like
-		IsSerfSeed:        args.IsSeed,
-		SerfDataDir:       serfDataDir,
-		SerfBindAddress:   bindAddr.String(),
-		SerfBindPort:      args.SerfPort,
-		SerfAdvertiseAddr: serfAdvertiseAddress,
-		SerfAdvertisePort: serfAdvertisePort,
-		SerfJoinAddrs:     args.SerfJoinAddrs,
-		RaftBindAddress:   bindAddr.String(),
-		RaftBindPort:      args.RaftPort,
-		HTTPBindAddress:   bindAddr.String(),
-		HTTPBindPort:      args.HTTPPort,
-		Bootstrap:         args.Bootstrap,
+		NodeName:             args.NodeName,
+		RaftDataDir:          raftDataDir,
+		JoinAddress:          args.JoinAddress, //TODO - validate this looks address-like
+		IsSerfSeed:           args.IsSeed,
+		SerfDataDir:          serfDataDir,
+		SerfBindAddress:      bindAddr.String(),
+		SerfBindPort:         args.SerfPort,
+		SerfAdvertiseAddr:    serfAdvertiseAddress,
+		SerfAdvertisePort:    serfAdvertisePort,
+		SerfJoinAddrs:        args.SerfJoinAddrs,
+		RaftBindAddress:      bindAddr.String(),
+		RaftBindPort:         raftPort,
+		SinglePort:           args.SinglePort,
+		RPCCompression:       args.RPCCompression,
+		HTTPBindAddress:      bindAddr.String(),
+		HTTPBindPort:         args.HTTPPort,
+		Bootstrap:            args.Bootstrap,
+		LegacyDataDir:        legacyDataDir,
+		RestoreFrom:          restoreFrom,
+		FSyncPolicy:          args.FSyncPolicy,
+		WriteAck:             args.WriteAck,
+		JoinToken:            args.JoinToken,
+		ClusterID:            args.ClusterID,
+		Zone:                 args.Zone,
+		NodeRole:             args.NodeRole,
+		Standby:              args.Standby,
+		ReplicateTo:          args.ReplicateTo,
+		ReplicationToken:     args.ReplicationToken,
+		ReplicationInterval:  args.ReplicationInterval,
+		ReplicationTimeout:   args.ReplicationTimeout,
+		ArchiveURL:           args.ArchiveURL,
+		ArchiveSnapshots:     args.ArchiveSnapshots,
+		ArchiveSegments:      args.ArchiveSegments,
+		ArchiveRetention:     args.ArchiveRetention,
+		RESPBindPort:         args.RESPPort,
+		RESPTable:            args.RESPTable,
+		MemcacheBindPort:     args.MemcachePort,
+		MemcacheTable:        args.MemcacheTable,
+		StatsdAddr:           args.StatsdAddr,
+		StatsdPrefix:         args.StatsdPrefix,
+		StatsdInterval:       args.StatsdInterval,
+		Dogstatsd:            args.Dogstatsd,
+		LogLevel:             logLevel,
+		LogLevels:            logLevels,
+		LogSampling:          args.LogSampling,
+		LogUnredacted:        logUnredacted,
+		ShutdownGracePeriod:  args.ShutdownGracePeriod,
+		LeaveRemovesReplica:  args.LeaveRemovesReplica,
+		AuthPolicyFile:       authPolicyFile,
+		OIDCIssuer:           args.OIDCIssuer,
+		OIDCAudience:         args.OIDCAudience,
+		OIDCPolicyClaim:      args.OIDCPolicyClaim,
+		ColumnKeys:           columnKeys,
+		DiskMinFreePercent:   args.DiskMinFreePercent,
+		DiskCheckInterval:    args.DiskCheckInterval,
+		DiskEmergencyCompact: args.DiskEmergencyCompact,
+		AutopilotDemoteLag:   args.AutopilotDemoteLag,
+		AutopilotDemoteAfter: args.AutopilotDemoteAfter,
+		NoAutopilotDemote:    args.NoAutopilotDemote,
+		SerfCoalescePeriod:   args.SerfCoalescePeriod,
+		SerfQuiescentPeriod:  args.SerfQuiescentPeriod,
+		SerfEventQueueDepth:  args.SerfEventQueueDepth,
+		SerfMaxQueueDepth:    args.SerfMaxQueueDepth,
+		SerfReapInterval:     args.SerfReapInterval,
+		SerfReconnectTimeout: args.SerfReconnectTimeout,
+		SerfTombstoneTimeout: args.SerfTombstoneTimeout,
+		QueryTimeout:         args.QueryTimeout,
+		QueryMaxRows:         args.QueryMaxRows,
+		QueryMaxBytes:        args.QueryMaxBytes,
 	}, nil
 }
 
@@ -254,6 +957,168 @@ func getArgs() *args {
 	flag.BoolVar(&parsedArgs.IsSeed, "is-seed",
 		false, "configure as the first node in the cluster, no serf join addresses required.")
 
+	flag.StringVar(&parsedArgs.LegacyDataDir, "legacy-data-dir",
+		"", "Path to a legacy single-raft simplestore data directory to import into the multiraft store on startup")
+
+	flag.StringVar(&parsedArgs.RestoreFrom, "restore-from",
+		"", "Exported snapshot directory to seed a new cluster with, on its bootstrap node, e.g. one written by expodb archive restore")
+
+	flag.StringVar(&parsedArgs.FSyncPolicy, "fsync-policy",
+		FSyncAlways, "When to fsync the state machine: always (every applied batch) or periodic (let raft replay anything lost)")
+
+	flag.StringVar(&parsedArgs.WriteAck, "write-ack",
+		WriteAckApplied, "When to acknowledge writes: applied (by the local state machine) or committed (by a raft quorum)")
+
+	flag.StringVar(&parsedArgs.JoinToken, "join-token",
+		"", "Shared token nodes must present to be added to the raft group, or a one-time join token minted by the leader; may be an env:, file: or vault: reference")
+
+	flag.StringVar(&parsedArgs.ClusterID, "cluster-id",
+		"", "ID of the cluster, generated when bootstrapping if empty; the leader doesn't add nodes of other clusters to the raft group")
+
+	flag.StringVar(&parsedArgs.Zone, "zone",
+		"", "Availability zone or rack of this node, shard voters are spread across zones")
+
+	flag.StringVar(&parsedArgs.NodeRole, "node-role",
+		NodeRoleVoter, "Role of this node: voter (full replica) or witness (votes in raft but stores no user data)")
+
+	flag.BoolVar(&parsedArgs.Standby, "standby",
+		false, "Run as the standby of another cluster: reject client writes and accept snapshots shipped by the primary until promoted")
+
+	flag.StringVar(&parsedArgs.ReplicateTo, "replicate-to",
+		"", "Address of a standby cluster node to ship snapshots of the data to: host:port for http, or an http:// or https:// URL")
+
+	flag.StringVar(&parsedArgs.ReplicationToken, "replication-token",
+		"", "Shared token authenticating the primary cluster to its standby; may be an env:, file: or vault: reference")
+
+	flag.DurationVar(&parsedArgs.ReplicationInterval, "replication-interval",
+		time.Minute, "How often the primary ships a snapshot to the standby")
+
+	flag.DurationVar(&parsedArgs.ReplicationTimeout, "replication-timeout",
+		10*time.Minute, "How long a snapshot shipment to the standby may take before it is abandoned")
+
+	flag.StringVar(&parsedArgs.ArchiveURL, "archive-url",
+		"", "Object store to continuously archive the raft log and snapshots to: file:///dir, s3://bucket/prefix or gs://bucket/prefix")
+
+	flag.DurationVar(&parsedArgs.ArchiveSnapshots, "archive-snapshot-interval",
+		time.Hour, "How often the leader archives a snapshot")
+
+	flag.DurationVar(&parsedArgs.ArchiveSegments, "archive-segment-interval",
+		10*time.Second, "How often the leader archives the raft log applied since the last segment, the most writes a restore from the archive can lose")
+
+	flag.DurationVar(&parsedArgs.ArchiveRetention, "archive-retention",
+		7*24*time.Hour, "How long archived snapshots, and the log segments following them, are kept")
+
+	flag.IntVar(&parsedArgs.RESPPort, "resp-port",
+		0, "Port on which to serve a subset of the Redis protocol, 0 disables it")
+
+	flag.StringVar(&parsedArgs.RESPTable, "resp-table",
+		"redis", "Table Redis keys are stored in, keys of the form table:key map to that table instead")
+
+	flag.IntVar(&parsedArgs.MemcachePort, "memcache-port",
+		0, "Port on which to serve the memcached text protocol (get/set/delete), 0 disables it")
+
+	flag.StringVar(&parsedArgs.MemcacheTable, "memcache-table",
+		"memcache", "Table memcached items are stored in")
+
+	flag.StringVar(&parsedArgs.StatsdAddr, "statsd-addr",
+		"", "host:port of a statsd or DogStatsD server to push internal metrics to over UDP, empty disables it")
+
+	flag.StringVar(&parsedArgs.StatsdPrefix, "statsd-prefix",
+		"expodb.", "Prefix of the metric names pushed to statsd")
+
+	flag.DurationVar(&parsedArgs.StatsdInterval, "statsd-interval",
+		10*time.Second, "How often internal metrics are pushed to statsd")
+
+	flag.BoolVar(&parsedArgs.Dogstatsd, "dogstatsd",
+		false, "Tag the metrics pushed to statsd with the node and zone, DogStatsD style")
+
+	flag.StringVar(&parsedArgs.AuthPolicyFile, "auth-policy-file",
+		"", "JSON file of the bearer tokens and per table access policies of client requests, empty allows every request")
+
+	flag.StringVar(&parsedArgs.OIDCIssuer, "oidc-issuer",
+		"", "URL of an OIDC issuer whose JWTs are accepted as bearer tokens, its keys are found through its discovery document")
+
+	flag.StringVar(&parsedArgs.OIDCAudience, "oidc-audience",
+		"", "Audience JWTs must be issued for")
+
+	flag.StringVar(&parsedArgs.OIDCPolicyClaim, "oidc-policy-claim",
+		"groups", "JWT claim whose values are mapped to access policies by the auth policy file's claims")
+
+	flag.StringVar(&parsedArgs.ColumnKeys, "column-keys",
+		"", "Comma separated id=key pairs of the AES-256 keys, hex or env:, file: or vault: references, sealing the values of encrypted columns; the first one seals new values, the others only open old ones")
+
+	flag.Float64Var(&parsedArgs.DiskMinFreePercent, "disk-min-free-percent",
+		5, "Free disk space, in percent, below which the node rejects writes with a 507 until space is freed, 0 disables the check")
+
+	flag.DurationVar(&parsedArgs.DiskCheckInterval, "disk-check-interval",
+		10*time.Second, "How often free space on the data dirs is checked")
+
+	flag.BoolVar(&parsedArgs.DiskEmergencyCompact, "disk-emergency-compact",
+		false, "Snapshot raft and compact the store when free disk space runs low, to reclaim the space of the log and deleted rows")
+
+	flag.BoolVar(&parsedArgs.SinglePort, "single-port",
+		false, "Carry raft messages and snapshots on the HTTP port instead of --raft-port, every node of the cluster has to set it")
+
+	flag.StringVar(&parsedArgs.RPCCompression, "rpc-compression",
+		CompressionZstd, "Only applies with --single-port, raft traffic on --raft-port is never compressed: zstd compresses raft messages and snapshots sent over the HTTP port to peers advertising support, none never does")
+
+	flag.DurationVar(&parsedArgs.AutopilotDemoteLag, "autopilot-demote-lag",
+		0, "Replication lag above which the leader demotes a voter to a non-voter once it has lasted --autopilot-demote-after, 0 never demotes")
+
+	flag.DurationVar(&parsedArgs.AutopilotDemoteAfter, "autopilot-demote-after",
+		2*time.Minute, "How long a voter's lag has to stay above --autopilot-demote-lag before it is demoted")
+
+	flag.BoolVar(&parsedArgs.NoAutopilotDemote, "no-autopilot-demote",
+		false, "Never demote this node, whatever its replication lag")
+
+	flag.DurationVar(&parsedArgs.SerfCoalescePeriod, "serf-coalesce-period",
+		3*time.Second, "Longest serf holds member events back to coalesce them")
+
+	flag.DurationVar(&parsedArgs.SerfQuiescentPeriod, "serf-quiescent-period",
+		time.Second, "Member events are delivered once none came for this long, or --serf-coalesce-period passed")
+
+	flag.IntVar(&parsedArgs.SerfEventQueueDepth, "serf-event-queue-depth",
+		64, "Serf events queued for the node's handlers, the member events queued together are handled as one batch")
+
+	flag.IntVar(&parsedArgs.SerfMaxQueueDepth, "serf-max-queue-depth",
+		4096, "Gossip broadcasts serf queues before dropping the oldest")
+
+	flag.DurationVar(&parsedArgs.SerfReapInterval, "serf-reap-interval",
+		15*time.Second, "How often serf reaps the failed and left members past their timeouts")
+
+	flag.DurationVar(&parsedArgs.SerfReconnectTimeout, "serf-reconnect-timeout",
+		24*time.Hour, "How long serf tries to reconnect to a failed member before reaping it")
+
+	flag.DurationVar(&parsedArgs.SerfTombstoneTimeout, "serf-tombstone-timeout",
+		24*time.Hour, "How long serf remembers members that left before reaping them")
+
+	flag.DurationVar(&parsedArgs.QueryTimeout, "query-timeout",
+		10*time.Second, "Longest a query page reads before it is answered short, with a cursor to go on")
+
+	flag.IntVar(&parsedArgs.QueryMaxRows, "query-max-rows",
+		1000, "Most rows a query page returns, larger limits are lowered to it")
+
+	flag.IntVar(&parsedArgs.QueryMaxBytes, "query-max-bytes",
+		4<<20, "Bytes of keys and values past which a query page is answered short, with a cursor to go on")
+
+	flag.StringVar(&parsedArgs.LogLevel, "log-level",
+		"debug", "Level of the modules --log-levels sets none for: debug, info, warn or error")
+
+	flag.StringVar(&parsedArgs.LogLevels, "log-levels",
+		"", "Comma separated module=level pairs setting the level of named loggers, e.g. serf-agent=warn,raft-agent=info,http=debug")
+
+	flag.BoolVar(&parsedArgs.LogSampling, "log-sampling",
+		true, "Sample repeated log entries: past 100 a second with the same message only every 100th is logged")
+
+	flag.StringVar(&parsedArgs.LogUnredacted, "log-unredacted",
+		"", "Comma separated tables whose row keys and values appear in logs, traces and error messages as they are, * for all, for debugging; others are replaced by a hash")
+
+	flag.DurationVar(&parsedArgs.ShutdownGracePeriod, "shutdown-grace-period",
+		30*time.Second, "On SIGINT or SIGTERM, how long the node gets to hand off leadership, finish the requests in flight and leave the gossip before it shuts down")
+
+	flag.BoolVar(&parsedArgs.LeaveRemovesReplica, "leave-removes-replica",
+		false, "On clean shutdown, have the leader decommission this node and remove it from raft right away; for nodes that don't come back, it can't rejoin under the same name")
+
 	flag.Parse()
 
 	parsedArgs.SerfJoinAddrs = strings.Split(serfJoinAddrsStr, ",")
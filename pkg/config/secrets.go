@@ -0,0 +1,107 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// vaultTimeout bounds fetching a secret from Vault at startup.
+const vaultTimeout = 10 * time.Second
+
+// ResolveSecret resolves a secret setting that references where the secret
+// lives rather than holding it, so it never has to be written in a config
+// file or command line:
+//
+//	env:NAME                 the environment variable NAME
+//	file:/path               the file's contents, without trailing newlines
+//	vault:secret/path#field  a field of a Vault KV secret, v1 or v2 mounts,
+//	                         read with VAULT_ADDR and VAULT_TOKEN
+//
+// Other values are returned unchanged.
+func ResolveSecret(value string) (string, error) {
+	kind, ref, ok := strings.Cut(value, ":")
+	if !ok {
+		return value, nil
+	}
+	switch kind {
+	case "env":
+		secret, ok := os.LookupEnv(ref)
+		if !ok || secret == "" {
+			return "", fmt.Errorf("environment variable %s is not set", ref)
+		}
+		return secret, nil
+	case "file":
+		buf, err := os.ReadFile(ref)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(buf), "\r\n"), nil
+	case "vault":
+		return readVaultSecret(ref)
+	}
+	return value, nil
+}
+
+// readVaultSecret reads "path#field".  A KV v2 mount is read through its
+// data/ path when the path given doesn't include it.
+func readVaultSecret(ref string) (string, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || path == "" || field == "" {
+		return "", fmt.Errorf("vault reference %q must be path#field", ref)
+	}
+	addr, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return "", fmt.Errorf("reading vault:%s requires VAULT_ADDR and VAULT_TOKEN", ref)
+	}
+	client := &http.Client{Timeout: vaultTimeout}
+	data, status, err := getVaultSecret(client, addr, token, path)
+	if err == nil && status == http.StatusNotFound {
+		if mount, rest, ok := strings.Cut(path, "/"); ok && !strings.HasPrefix(rest, "data/") {
+			data, status, err = getVaultSecret(client, addr, token, mount+"/data/"+rest)
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("reading vault:%s: %w", path, err)
+	}
+	if status != http.StatusOK {
+		return "", fmt.Errorf("reading vault:%s: vault answered %d", path, status)
+	}
+	// KV v2 nests the secret's fields under data.data.
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, isV2 := data["metadata"]; isV2 {
+			data = nested
+		}
+	}
+	secret, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no field %s", path, field)
+	}
+	return secret, nil
+}
+
+func getVaultSecret(client *http.Client, addr, token, path string) (map[string]interface{}, int, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, nil
+	}
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, 0, err
+	}
+	return body.Data, resp.StatusCode, nil
+}
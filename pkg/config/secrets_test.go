@@ -0,0 +1,45 @@
+package config
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" || r.URL.Path != "/v1/secret/data/expodb" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"data":{"data":{"api_token":"from-vault"},"metadata":{"version":1}}}`))
+	}))
+	defer vault.Close()
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "root")
+	t.Setenv("EXPODB_TEST_TOKEN", "from-env")
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"plain":                              "plain",
+		"env:EXPODB_TEST_TOKEN":              "from-env",
+		"file:" + path:                       "from-file",
+		"vault:secret/expodb#api_token":      "from-vault",
+		"vault:secret/data/expodb#api_token": "from-vault",
+	}
+	for value, want := range tests {
+		if got, err := ResolveSecret(value); err != nil || got != want {
+			t.Errorf("ResolveSecret(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"env:EXPODB_TEST_UNSET", "vault:secret/expodb#missing", "vault:secret/expodb"} {
+		if _, err := ResolveSecret(value); err == nil {
+			t.Errorf("ResolveSecret(%q) succeeded", value)
+		}
+	}
+}
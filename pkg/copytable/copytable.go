@@ -0,0 +1,226 @@
+// Package copytable copies a table from one cluster to another, for
+// selective migrations without a full backup: the rows are streamed from a
+// consistent export of the source and written to the destination at a
+// bounded rate, and an interrupted copy resumes where it stopped.
+package copytable
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/client"
+	flag "github.com/ogier/pflag"
+)
+
+// saveInterval is how often the progress of a copy is saved.
+const saveInterval = time.Second
+
+// Options are what Copy copies and how.
+type Options struct {
+	// From and To are the http addresses (host:port) of nodes of the source
+	// and destination clusters.
+	From []string
+	To   []string
+	// FromToken is the bearer token of an admin of the source, ToToken of a
+	// principal allowed to write Table on the destination.
+	FromToken string
+	ToToken   string
+	Table     string
+	// Rate bounds the rows written a second, 0 for no bound.
+	Rate int
+	// State is the file the progress is saved to while copying, and the
+	// copy resumed from when it exists.
+	State string
+}
+
+// State is the progress of a copy.
+type State struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Table string `json:"table"`
+	// After is the key of the last row copied.
+	After  string `json:"after"`
+	Copied uint64 `json:"copied"`
+}
+
+// Result is the outcome of a copy that completed.  Index is the source's raft
+// index the rows copied by the last run are consistent with.
+type Result struct {
+	Copied  uint64
+	Index   uint64
+	Resumed bool
+}
+
+// Copy copies the rows of opts.Table, every column of them, replacing the
+// rows of the same keys on the destination.  It saves its progress to
+// opts.State, removed once the copy completes.  A resumed copy goes on from
+// a newer export: rows copied before it are not copied again, even if they
+// changed since.
+func Copy(ctx context.Context, opts Options) (*Result, error) {
+	st := &State{From: strings.Join(opts.From, ","), To: strings.Join(opts.To, ","), Table: opts.Table}
+	resumed, err := loadState(opts.State, st)
+	if err != nil {
+		return nil, err
+	}
+	src := client.New(opts.From...)
+	if opts.FromToken != "" {
+		src.SetToken(opts.FromToken)
+	}
+	dst := client.New(opts.To...)
+	if opts.ToToken != "" {
+		dst.SetToken(opts.ToToken)
+	}
+	if err := dst.Refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	p := &pacer{}
+	if opts.Rate > 0 {
+		p.interval = time.Second / time.Duration(opts.Rate)
+	}
+	saved := time.Now()
+	index, err := src.ExportTable(ctx, opts.Table, st.After, func(row client.Row) error {
+		if err := p.wait(ctx); err != nil {
+			return err
+		}
+		if _, err := dst.SetRow(ctx, opts.Table, row.Key, row.Columns, true); err != nil {
+			return fmt.Errorf("writing row %q: %w", row.Key, err)
+		}
+		st.After = row.Key
+		st.Copied++
+		if time.Since(saved) < saveInterval {
+			return nil
+		}
+		saved = time.Now()
+		return saveState(opts.State, st)
+	})
+	if err != nil {
+		if serr := saveState(opts.State, st); serr != nil {
+			return nil, fmt.Errorf("%w, and saving the progress: %v", err, serr)
+		}
+		return nil, fmt.Errorf("%w (%d rows copied, the same command resumes the copy)", err, st.Copied)
+	}
+	if err := os.Remove(opts.State); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return &Result{Copied: st.Copied, Index: index, Resumed: resumed}, nil
+}
+
+// loadState loads the progress saved to path into st, and reports whether
+// there was one.  It must be the progress of the same copy.
+func loadState(path string, st *State) (bool, error) {
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	saved := &State{}
+	if err := json.Unmarshal(buf, saved); err != nil {
+		return false, fmt.Errorf("%s: %w", path, err)
+	}
+	if saved.From != st.From || saved.To != st.To || saved.Table != st.Table {
+		return false, fmt.Errorf("%s holds the progress of copying %s from %s to %s, remove it to start another copy", path, saved.Table, saved.From, saved.To)
+	}
+	*st = *saved
+	return true, nil
+}
+
+// saveState replaces the progress saved to path, so that an interrupted save
+// leaves the previous one.
+func saveState(path string, st *State) error {
+	buf, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// pacer spaces calls to wait interval apart, without bound when zero.
+type pacer struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func (p *pacer) wait(ctx context.Context) error {
+	if p.interval == 0 {
+		return nil
+	}
+	now := time.Now()
+	if d := p.next.Sub(now); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	} else {
+		p.next = now
+	}
+	p.next = p.next.Add(p.interval)
+	return nil
+}
+
+// Main runs the copy-table subcommand with its command line arguments,
+// writing its outcome to w, and returns the process' exit code: 0 when the
+// copy completed, 1 when it failed, 2 for bad arguments.  An interrupt stops
+// the copy with its progress saved.
+func Main(args []string, w io.Writer) int {
+	fs := flag.NewFlagSet("copy-table", flag.ContinueOnError)
+	fs.SetOutput(w)
+	from := fs.String("from", "", "Comma separated http addresses of nodes of the source cluster")
+	to := fs.String("to", "", "Comma separated http addresses of nodes of the destination cluster")
+	table := fs.String("table", "", "Table to copy")
+	fromToken := fs.String("from-token", "", "Bearer token of an admin of the source cluster")
+	toToken := fs.String("to-token", "", "Bearer token to write the table on the destination cluster with")
+	rate := fs.Int("rate", 0, "Rows written a second at most, 0 for no bound")
+	state := fs.String("state", "", "File the progress is saved to and resumed from (default copy-<table>.json)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	opts := Options{FromToken: *fromToken, ToToken: *toToken, Table: *table, Rate: *rate, State: *state}
+	opts.From, opts.To = splitAddrs(*from), splitAddrs(*to)
+	if len(opts.From) == 0 || len(opts.To) == 0 || opts.Table == "" || strings.HasPrefix(opts.Table, "_") || opts.Rate < 0 {
+		fmt.Fprintln(w, "copy-table needs --from, --to and a --table that isn't a system table")
+		return 2
+	}
+	if opts.State == "" {
+		opts.State = "copy-" + opts.Table + ".json"
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	res, err := Copy(ctx, opts)
+	if err != nil {
+		fmt.Fprintf(w, "copy-table: %v\n", err)
+		return 1
+	}
+	how := "copied"
+	if res.Resumed {
+		how = "resumed and copied"
+	}
+	fmt.Fprintf(w, "%s %d rows of %s, consistent with index %d of the source\n", how, res.Copied, opts.Table, res.Index)
+	return 0
+}
+
+func splitAddrs(s string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(s, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,141 @@
+package copytable
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSource exports the rows of table t, cutting the stream short after
+// cut rows when cut is positive.
+func fakeSource(t *testing.T, rows map[string]string, cut *int) string {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/admin/_export_table", func(w http.ResponseWriter, r *http.Request) {
+		req := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req["table"] != "t" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var keys []string
+		for k := range rows {
+			if k > req["after"] {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		enc := json.NewEncoder(w)
+		for i, k := range keys {
+			if *cut > 0 && i == *cut {
+				return
+			}
+			enc.Encode(map[string]interface{}{"row": map[string]interface{}{"key": k, "columns": map[string]string{"c": rows[k]}}})
+		}
+		enc.Encode(map[string]interface{}{"done": true, "index": 42})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// fakeDestination records the rows written to it.
+func fakeDestination(t *testing.T) (string, func() map[string]string) {
+	var mu sync.Mutex
+	rows := map[string]string{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/cluster/shards", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"partition_count": 0})
+	})
+	mux.HandleFunc("/v1/key/_update_row", func(w http.ResponseWriter, r *http.Request) {
+		req := struct {
+			Table   string            `json:"table"`
+			Key     string            `json:"key"`
+			Columns map[string]string `json:"columns"`
+			Replace bool              `json:"replace"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Table != "t" || !req.Replace {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		rows[req.Key] = req.Columns["c"]
+		mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]uint64{"index": 7})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://"), func() map[string]string {
+		mu.Lock()
+		defer mu.Unlock()
+		copied := map[string]string{}
+		for k, v := range rows {
+			copied[k] = v
+		}
+		return copied
+	}
+}
+
+func TestCopy(t *testing.T) {
+	rows := map[string]string{"a": "1", "b": "2", "c": "3", "d": "4", "e": "5"}
+	cut := 2
+	dst, written := fakeDestination(t)
+	opts := Options{From: []string{fakeSource(t, rows, &cut)}, To: []string{dst}, Table: "t", State: filepath.Join(t.TempDir(), "state.json")}
+
+	// a stream cut short saves the progress.
+	if _, err := Copy(context.Background(), opts); err == nil {
+		t.Fatal("Copy() of a stream cut short succeeded")
+	}
+	st := &State{From: opts.From[0], To: dst, Table: "t"}
+	if ok, err := loadState(opts.State, st); !ok || err != nil || st.After != "b" || st.Copied != 2 {
+		t.Fatalf("saved state = %+v, %v, %v, want 2 rows copied up to b", st, ok, err)
+	}
+	other := opts
+	other.Table = "u"
+	if _, err := Copy(context.Background(), other); err == nil || !strings.Contains(err.Error(), "remove it") {
+		t.Errorf("Copy() of another table with the state saved = %v, want refused", err)
+	}
+
+	// the same copy resumes after b.
+	cut = 0
+	res, err := Copy(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Copy() resumed error = %v", err)
+	}
+	if !res.Resumed || res.Copied != 5 || res.Index != 42 {
+		t.Errorf("Copy() resumed = %+v, want 5 rows at index 42", res)
+	}
+	if got := written(); len(got) != 5 || got["e"] != "5" {
+		t.Errorf("destination rows = %v, want all 5", got)
+	}
+	if _, err := os.Stat(opts.State); !os.IsNotExist(err) {
+		t.Errorf("state file left after the copy completed: %v", err)
+	}
+}
+
+func TestPacer(t *testing.T) {
+	p := &pacer{interval: 10 * time.Millisecond}
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := p.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if took := time.Since(start); took < 40*time.Millisecond {
+		t.Errorf("5 paced calls took %s, want at least 40ms", took)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.next = time.Now().Add(time.Hour)
+	if err := p.wait(ctx); err == nil {
+		t.Error("wait() with the context canceled succeeded")
+	}
+}
@@ -0,0 +1,279 @@
+// Package doctor checks a running cluster end to end, to verify a
+// deployment: that a node answers, that there is a leader, that the voters
+// keep up with it and that a write can be read back and deleted.
+package doctor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/client"
+	flag "github.com/ogier/pflag"
+)
+
+// Options are what Run checks and how.
+type Options struct {
+	// Addrs are the http addresses (host:port) of the nodes to start from.
+	Addrs []string
+	// Token is the bearer token of a principal allowed to write Table.
+	Token string
+	// Table is the scratch table the round trip writes a row to, and
+	// deletes it from.
+	Table string
+	// MaxLag is the replication lag past which a peer fails the check.
+	MaxLag time.Duration
+	// Timeout bounds each check.
+	Timeout time.Duration
+}
+
+// Check is the outcome of one check.
+type Check struct {
+	Name   string
+	OK     bool
+	Detail string
+	Took   time.Duration
+}
+
+// Report is the outcome of every check, in the order they were made.
+type Report struct {
+	Checks []Check
+}
+
+// OK reports whether every check passed.
+func (r *Report) OK() bool {
+	for _, c := range r.Checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// Print writes the report as a table, one check a line.
+func (r *Report) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, c := range r.Checks {
+		result := "PASS"
+		if !c.OK {
+			result = "FAIL"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", result, c.Name, c.Took.Round(time.Millisecond), c.Detail)
+	}
+	tw.Flush()
+	if r.OK() {
+		fmt.Fprintln(w, "all checks passed")
+	} else {
+		fmt.Fprintln(w, "some checks failed")
+	}
+}
+
+// status is the part of a node's /status the checks look at.
+type status struct {
+	ID     string `json:"id"`
+	Leader *struct {
+		ID       string `json:"id"`
+		HTTPAddr string `json:"http_addr"`
+	} `json:"leader"`
+	Peers []struct {
+		ID         string `json:"id"`
+		Voter      bool   `json:"voter"`
+		LagEntries uint64 `json:"lag_entries"`
+		LagMs      uint64 `json:"lag_ms"`
+	} `json:"peers"`
+}
+
+type doctor struct {
+	opts   Options
+	http   *http.Client
+	report *Report
+}
+
+// Run makes the checks and reports them.  A check that can't be made because
+// an earlier one failed fails too, saying so.
+func Run(ctx context.Context, opts Options) *Report {
+	d := &doctor{opts: opts, http: &http.Client{}, report: &Report{}}
+
+	var seed string
+	d.check(ctx, "reachable", func(ctx context.Context) (string, error) {
+		var lastErr error
+		for _, addr := range opts.Addrs {
+			v := struct {
+				Version string `json:"version"`
+				Mixed   bool   `json:"mixed"`
+			}{}
+			if err := d.get(ctx, addr, "/version", &v); err != nil {
+				lastErr = err
+				continue
+			}
+			seed = addr
+			if v.Mixed {
+				return fmt.Sprintf("%s runs %s, members run other releases", addr, v.Version), nil
+			}
+			return fmt.Sprintf("%s runs %s", addr, v.Version), nil
+		}
+		return "", fmt.Errorf("no node answered: %w", lastErr)
+	})
+
+	var leaderAddr string
+	d.check(ctx, "leader", func(ctx context.Context) (string, error) {
+		if seed == "" {
+			return "", errors.New("no node to ask")
+		}
+		st := &status{}
+		if err := d.get(ctx, seed, "/status", st); err != nil {
+			return "", err
+		}
+		if st.Leader == nil {
+			return "", fmt.Errorf("%s knows of no leader", seed)
+		}
+		if err := d.get(ctx, st.Leader.HTTPAddr, "/readyz", nil); err != nil {
+			return "", fmt.Errorf("leader %s isn't ready: %w", st.Leader.ID, err)
+		}
+		leaderAddr = st.Leader.HTTPAddr
+		return fmt.Sprintf("%s at %s", st.Leader.ID, leaderAddr), nil
+	})
+
+	d.check(ctx, "replication", func(ctx context.Context) (string, error) {
+		if leaderAddr == "" {
+			return "", errors.New("no leader to ask")
+		}
+		st := &status{}
+		if err := d.get(ctx, leaderAddr, "/status", st); err != nil {
+			return "", err
+		}
+		var lagging []string
+		var maxLag time.Duration
+		for _, p := range st.Peers {
+			lag := time.Duration(p.LagMs) * time.Millisecond
+			if lag > maxLag {
+				maxLag = lag
+			}
+			if lag > opts.MaxLag {
+				lagging = append(lagging, fmt.Sprintf("%s by %s (%d entries)", p.ID, lag, p.LagEntries))
+			}
+		}
+		if len(lagging) > 0 {
+			return "", fmt.Errorf("lagging past %s: %s", opts.MaxLag, strings.Join(lagging, ", "))
+		}
+		return fmt.Sprintf("%d peers, lagging by %s at most", len(st.Peers), maxLag), nil
+	})
+
+	c := client.New(opts.Addrs...)
+	if opts.Token != "" {
+		c.SetToken(opts.Token)
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	key, want := "doctor-"+hex.EncodeToString(id), time.Now().UTC().Format(time.RFC3339Nano)
+	written := false
+	d.check(ctx, "write", func(ctx context.Context) (string, error) {
+		index, err := c.Set(ctx, opts.Table, key, "check", want)
+		if err != nil {
+			return "", err
+		}
+		written = true
+		return fmt.Sprintf("%s/%s at index %d", opts.Table, key, index), nil
+	})
+	d.check(ctx, "read", func(ctx context.Context) (string, error) {
+		if !written {
+			return "", errors.New("nothing written to read")
+		}
+		row, err := c.Get(ctx, opts.Table, key)
+		if err != nil {
+			return "", err
+		}
+		if row["check"] != want {
+			return "", fmt.Errorf("read %q, wrote %q", row["check"], want)
+		}
+		return "read back what was written", nil
+	})
+	d.check(ctx, "delete", func(ctx context.Context) (string, error) {
+		if !written {
+			return "", errors.New("nothing written to delete")
+		}
+		if _, err := c.Delete(ctx, opts.Table, key, ""); err != nil {
+			return "", err
+		}
+		if _, err := c.Get(ctx, opts.Table, key); !errors.Is(err, client.ErrKeyNotFound) {
+			return "", fmt.Errorf("row still read after its delete: %v", err)
+		}
+		return "row gone", nil
+	})
+	return d.report
+}
+
+func (d *doctor) check(ctx context.Context, name string, fn func(ctx context.Context) (string, error)) {
+	ctx, cancel := context.WithTimeout(ctx, d.opts.Timeout)
+	defer cancel()
+	start := time.Now()
+	detail, err := fn(ctx)
+	if err != nil {
+		detail = err.Error()
+	}
+	d.report.Checks = append(d.report.Checks, Check{Name: name, OK: err == nil, Detail: detail, Took: time.Since(start)})
+}
+
+// get GETs an unversioned endpoint, decoding the answer into out.
+func (d *doctor) get(ctx context.Context, addr, path string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+path, nil)
+	if err != nil {
+		return err
+	}
+	if d.opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+d.opts.Token)
+	}
+	resp, err := d.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("GET %s: %s: %s", path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Main runs the doctor subcommand with its command line arguments, printing
+// the report to w, and returns the process' exit code: 0 when every check
+// passed, 1 when one failed, 2 for bad arguments.
+func Main(args []string, w io.Writer) int {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	fs.SetOutput(w)
+	addrs := fs.String("addrs", "127.0.0.1:8000", "Comma separated http addresses of the nodes to check from")
+	token := fs.String("token", "", "Bearer token to authenticate with, allowed to write the scratch table")
+	table := fs.String("table", "doctor_scratch", "Scratch table the round trip writes a row to and deletes")
+	maxLag := fs.Duration("max-lag", 5*time.Second, "Replication lag past which a peer fails the check")
+	timeout := fs.Duration("timeout", 10*time.Second, "Time each check may take")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	opts := Options{Token: *token, Table: *table, MaxLag: *maxLag, Timeout: *timeout}
+	for _, addr := range strings.Split(*addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			opts.Addrs = append(opts.Addrs, addr)
+		}
+	}
+	if len(opts.Addrs) == 0 || opts.Table == "" || strings.HasPrefix(opts.Table, "_") {
+		fmt.Fprintln(w, "doctor needs --addrs and a --table that isn't a system table")
+		return 2
+	}
+	report := Run(context.Background(), opts)
+	report.Print(w)
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
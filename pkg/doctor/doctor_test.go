@@ -0,0 +1,96 @@
+package doctor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNode answers the endpoints the checks use, as the leader of a one
+// table cluster.
+func fakeNode(t *testing.T, lagMs uint64) *httptest.Server {
+	var mu sync.Mutex
+	rows := map[string]map[string]string{}
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"version": "0.1.0", "mixed": false})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		addr := strings.TrimPrefix(srv.URL, "http://")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":     "node-1",
+			"leader": map[string]string{"id": "node-1", "http_addr": addr},
+			"peers":  []map[string]interface{}{{"id": "node-2", "voter": true, "lag_ms": lagMs, "lag_entries": 3}},
+		})
+	})
+	key := func(r *http.Request) (map[string]string, string) {
+		req := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&req)
+		return req, req["table"] + "/" + req["key"]
+	}
+	mux.HandleFunc("/v1/key/_update", func(w http.ResponseWriter, r *http.Request) {
+		req, k := key(r)
+		mu.Lock()
+		rows[k] = map[string]string{req["column"]: req["value"]}
+		mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]uint64{"index": 7})
+	})
+	mux.HandleFunc("/v1/key/_fetch", func(w http.ResponseWriter, r *http.Request) {
+		_, k := key(r)
+		mu.Lock()
+		row, ok := rows[k]
+		mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": row, "index": 8})
+	})
+	mux.HandleFunc("/v1/key/_delete", func(w http.ResponseWriter, r *http.Request) {
+		_, k := key(r)
+		mu.Lock()
+		delete(rows, k)
+		mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]uint64{"index": 9})
+	})
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRun(t *testing.T) {
+	srv := fakeNode(t, 10)
+	opts := Options{Addrs: []string{strings.TrimPrefix(srv.URL, "http://")}, Table: "scratch", MaxLag: time.Second, Timeout: time.Second}
+	report := Run(context.Background(), opts)
+	if !report.OK() || len(report.Checks) != 6 {
+		t.Fatalf("report = %+v, want six passing checks", report.Checks)
+	}
+	buf := &bytes.Buffer{}
+	report.Print(buf)
+	if !strings.Contains(buf.String(), "PASS  replication") || !strings.HasSuffix(buf.String(), "all checks passed\n") {
+		t.Errorf("printed report:\n%s", buf)
+	}
+
+	lagging := fakeNode(t, 5000)
+	opts.Addrs = []string{strings.TrimPrefix(lagging.URL, "http://")}
+	report = Run(context.Background(), opts)
+	if report.OK() || report.Checks[2].OK || !strings.Contains(report.Checks[2].Detail, "node-2") {
+		t.Errorf("report = %+v, want the replication check failed on node-2", report.Checks)
+	}
+
+	opts.Addrs = []string{"127.0.0.1:1"}
+	report = Run(context.Background(), opts)
+	for _, c := range report.Checks {
+		if c.OK {
+			t.Errorf("check %s passed without a cluster", c.Name)
+		}
+	}
+}
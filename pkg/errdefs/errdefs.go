@@ -0,0 +1,114 @@
+// Package errdefs defines the kinds of errors the server and client APIs
+// return, so embedders can branch on them with errors.Is whatever the
+// specific error is:
+//
+//	if errors.Is(err, errdefs.ErrConflict) {
+//		// re-read and retry
+//	}
+//
+// Over HTTP the kind is sent in the Header response header, see HTTPStatus.
+package errdefs
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Header names the kind of error a response reports, by Code.
+const Header = "X-Expodb-Error"
+
+var (
+	// ErrNotLeader is returned by requests only another node serves, the
+	// node an interactive transaction was begun on.
+	ErrNotLeader = errors.New("not the leader")
+	// ErrNotFound is returned for keys, transactions and the like that don't
+	// exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a write lost against another one: a row
+	// version that changed, a locked row, an aborted transaction.  Retrying
+	// after re-reading may succeed.
+	ErrConflict = errors.New("conflict")
+	// ErrInvalid is returned for writes that don't fit the data they are
+	// written to, a value not of its column's type.  Retrying won't help.
+	ErrInvalid = errors.New("invalid")
+	// ErrTimeout is returned when a request ran out of time.  A write that
+	// timed out may still be applied.
+	ErrTimeout = errors.New("timed out")
+	// ErrQuorumLost is returned when the shard has no leader, because of an
+	// election or because too few replicas are up to elect one.
+	ErrQuorumLost = errors.New("quorum lost")
+)
+
+var kinds = []struct {
+	err    error
+	code   string
+	status int
+}{
+	{ErrNotLeader, "not_leader", http.StatusMisdirectedRequest},
+	{ErrNotFound, "not_found", http.StatusNotFound},
+	{ErrConflict, "conflict", http.StatusConflict},
+	{ErrInvalid, "invalid", http.StatusBadRequest},
+	{ErrTimeout, "timeout", http.StatusGatewayTimeout},
+	{ErrQuorumLost, "quorum_lost", http.StatusServiceUnavailable},
+}
+
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (e *kindError) Error() string { return e.msg }
+func (e *kindError) Unwrap() error { return e.kind }
+
+// New returns an error with the message msg that is of kind.
+func New(kind error, msg string) error {
+	return &kindError{kind: kind, msg: msg}
+}
+
+type wrapError struct {
+	kind error
+	err  error
+}
+
+func (e *wrapError) Error() string   { return e.err.Error() }
+func (e *wrapError) Unwrap() []error { return []error{e.kind, e.err} }
+
+// Wrap makes err of kind, keeping its message and what it wraps.  A nil
+// kind leaves err as it is.
+func Wrap(kind, err error) error {
+	if err == nil || kind == nil || errors.Is(err, kind) {
+		return err
+	}
+	return &wrapError{kind: kind, err: err}
+}
+
+// Code returns the name of err's kind, "" when it has none.
+func Code(err error) string {
+	for _, k := range kinds {
+		if errors.Is(err, k.err) {
+			return k.code
+		}
+	}
+	return ""
+}
+
+// HTTPStatus returns the status err's kind is answered with, 500 when it has
+// none.
+func HTTPStatus(err error) int {
+	for _, k := range kinds {
+		if errors.Is(err, k.err) {
+			return k.status
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// FromCode returns the kind named code, nil when there is none.
+func FromCode(code string) error {
+	for _, k := range kinds {
+		if k.code == code {
+			return k.err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package errdefs
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestKinds(t *testing.T) {
+	mismatch := New(ErrConflict, "row was modified since the expected version")
+	wrapped := fmt.Errorf("setting row: %w", mismatch)
+	if !errors.Is(wrapped, ErrConflict) || !errors.Is(wrapped, mismatch) {
+		t.Errorf("wrapped error lost its kind or identity")
+	}
+	if got := HTTPStatus(wrapped); got != http.StatusConflict {
+		t.Errorf("HTTPStatus() = %d, want %d", got, http.StatusConflict)
+	}
+	if FromCode(Code(wrapped)) != ErrConflict {
+		t.Errorf("code %q doesn't round trip", Code(wrapped))
+	}
+
+	cause := errors.New("request dropped as the shard is not ready")
+	err := Wrap(ErrQuorumLost, cause)
+	if err.Error() != cause.Error() || !errors.Is(err, cause) || !errors.Is(err, ErrQuorumLost) {
+		t.Errorf("Wrap() = %v, want the cause's message, identity and the kind", err)
+	}
+	if got := HTTPStatus(errors.New("boom")); got != http.StatusInternalServerError || Code(errors.New("boom")) != "" {
+		t.Errorf("error of no kind = %d, want 500 and no code", got)
+	}
+}
@@ -0,0 +1,152 @@
+// Package fieldcrypt encrypts the values of the columns a table's schema
+// marks encrypted.  A value is sealed with AES-256-GCM under a named key and
+// stored as
+//
+//	enc:<key id>:<base64url, unpadded, of nonce || ciphertext || tag>
+//
+// with a 12 byte random nonce and "<table>\x00<column>" as additional data,
+// so a value can't be copied to another column and read there.  Clients
+// holding the keys can seal values themselves, the server stores them as is.
+package fieldcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Prefix starts every encrypted value.
+const Prefix = "enc:"
+
+var (
+	ErrUnknownKey = errors.New("unknown column key")
+	ErrMalformed  = errors.New("malformed encrypted value")
+)
+
+// Key is a column key, 32 bytes.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// ParseKey parses "<id>=<hex secret>".
+func ParseKey(s string) (Key, error) {
+	id, secret, ok := strings.Cut(s, "=")
+	if !ok || !validID(id) {
+		return Key{}, fmt.Errorf("column key must be <id>=<hex key>, the id letters, digits, '_' and '-'")
+	}
+	buf, err := hex.DecodeString(secret)
+	if err != nil || len(buf) != 32 {
+		return Key{}, fmt.Errorf("column key %s must be 32 hex encoded bytes", id)
+	}
+	return Key{ID: id, Secret: buf}, nil
+}
+
+func validID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Keyring seals values with its first key and opens them with any of its
+// keys, so keys can be rotated by putting a new one first.
+type Keyring struct {
+	active string
+	aeads  map[string]cipher.AEAD
+}
+
+// NewKeyring returns a keyring of keys, the first one active.
+func NewKeyring(keys []Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("keyring needs a key")
+	}
+	k := &Keyring{active: keys[0].ID, aeads: map[string]cipher.AEAD{}}
+	for _, key := range keys {
+		if _, ok := k.aeads[key.ID]; ok {
+			return nil, fmt.Errorf("column key %s given twice", key.ID)
+		}
+		block, err := aes.NewCipher(key.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("column key %s: %w", key.ID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.aeads[key.ID] = aead
+	}
+	return k, nil
+}
+
+// IsEncrypted reports whether val has the form of an encrypted value, it
+// doesn't tell whether it opens.
+func IsEncrypted(val string) bool {
+	_, _, err := split(val)
+	return err == nil
+}
+
+// KeyID returns the ID of the key val was sealed with.
+func KeyID(val string) (string, error) {
+	id, _, err := split(val)
+	return id, err
+}
+
+func split(val string) (string, []byte, error) {
+	rest, ok := strings.CutPrefix(val, Prefix)
+	if !ok {
+		return "", nil, ErrMalformed
+	}
+	id, sealed, ok := strings.Cut(rest, ":")
+	if !ok || !validID(id) {
+		return "", nil, ErrMalformed
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(buf) < 12+16 {
+		return "", nil, ErrMalformed
+	}
+	return id, buf, nil
+}
+
+func additionalData(table, column string) []byte {
+	return []byte(table + "\x00" + column)
+}
+
+// Encrypt seals the value of a column with the active key.
+func (k *Keyring) Encrypt(table, column, plaintext string) (string, error) {
+	aead := k.aeads[k.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), additionalData(table, column))
+	return Prefix + k.active + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value of a column sealed with any of the keyring's keys.
+func (k *Keyring) Decrypt(table, column, val string) (string, error) {
+	id, buf, err := split(val)
+	if err != nil {
+		return "", err
+	}
+	aead, ok := k.aeads[id]
+	if !ok {
+		return "", fmt.Errorf("%w %s", ErrUnknownKey, id)
+	}
+	size := aead.NonceSize()
+	plaintext, err := aead.Open(nil, buf[:size], buf[size:], additionalData(table, column))
+	if err != nil {
+		return "", fmt.Errorf("opening value of %s.%s: %w", table, column, err)
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,55 @@
+package fieldcrypt
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestKeyring(t *testing.T) {
+	old, err := ParseKey("k1=" + strings.Repeat("01", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := ParseKey("k2=" + strings.Repeat("02", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseKey("k3=abcd"); err == nil {
+		t.Errorf("ParseKey() of a short key succeeded")
+	}
+
+	before, _ := NewKeyring([]Key{old})
+	sealedOld, err := before.Encrypt("users", "ssn", "123-45-6789")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := NewKeyring([]Key{current, old})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := k.Encrypt("users", "ssn", "123-45-6789")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(sealed) || strings.Contains(sealed, "6789") {
+		t.Fatalf("Encrypt() = %q", sealed)
+	}
+	if id, _ := KeyID(sealed); id != "k2" {
+		t.Errorf("KeyID() = %q, want the active key k2", id)
+	}
+	for _, val := range []string{sealed, sealedOld} {
+		if got, err := k.Decrypt("users", "ssn", val); err != nil || got != "123-45-6789" {
+			t.Errorf("Decrypt(%q) = %q, %v", val, got, err)
+		}
+	}
+	if _, err := k.Decrypt("users", "email", sealed); err == nil {
+		t.Errorf("Decrypt() of a value moved to another column succeeded")
+	}
+	if _, err := before.Decrypt("users", "ssn", sealed); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Decrypt() without the key = %v, want %v", err, ErrUnknownKey)
+	}
+	if IsEncrypted("123-45-6789") || IsEncrypted("enc:k1:short") {
+		t.Errorf("IsEncrypted() of a plaintext value = true")
+	}
+}
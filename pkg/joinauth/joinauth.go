@@ -0,0 +1,80 @@
+// Package joinauth lets a node prove it holds a cluster join token without
+// gossiping the token itself.  Serf tags are visible to every member, so
+// nodes publish the token's ID and an HMAC over their identity instead.
+package joinauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// TokenID identifies a token without revealing it.
+func TokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Proof binds the token to a node's ID and raft address, so a proof seen in
+// gossip can't be replayed by a node with another identity.
+func Proof(token, nodeID, raftAddr string) string {
+	h := hmac.New(sha256.New, []byte(token))
+	h.Write([]byte(nodeID + "|" + raftAddr))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Verify checks a proof made with Proof.
+func Verify(token, nodeID, raftAddr, proof string) bool {
+	want, err := hex.DecodeString(proof)
+	if err != nil {
+		return false
+	}
+	got, _ := hex.DecodeString(Proof(token, nodeID, raftAddr))
+	return hmac.Equal(got, want)
+}
+
+// One-time tokens are stored by the cluster under their TokenID, valued
+// "<expiry>|<token>", see Mint and Check.
+const (
+	tokenBytes    = 16
+	expiryLayout  = time.RFC3339
+	valueSplitter = "|"
+)
+
+var (
+	ErrUnknownToken = errors.New("unknown join token")
+	ErrExpired      = errors.New("expired join token")
+	ErrInvalidProof = errors.New("invalid join proof")
+)
+
+// Mint creates a one-time token expiring ttl after now.  It returns the
+// token, for the operator, and the value to store under its TokenID.
+func Mint(ttl time.Duration, now time.Time) (token, value string, err error) {
+	buf := make([]byte, tokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(buf)
+	return token, now.Add(ttl).UTC().Format(expiryLayout) + valueSplitter + token, nil
+}
+
+// Check verifies a proof against the stored value of a one-time token, as
+// of now.  An empty value is a token never minted, or already consumed.
+func Check(value, nodeID, raftAddr, proof string, now time.Time) error {
+	if value == "" {
+		return ErrUnknownToken
+	}
+	expiry, token, _ := strings.Cut(value, valueSplitter)
+	expires, err := time.Parse(expiryLayout, expiry)
+	if err != nil || now.After(expires) {
+		return ErrExpired
+	}
+	if !Verify(token, nodeID, raftAddr, proof) {
+		return ErrInvalidProof
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package joinauth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMint(t *testing.T) {
+	now := time.Unix(1000, 0)
+	a, value, err := Mint(time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _, err := Mint(time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != 2*tokenBytes || a == b {
+		t.Errorf("Mint() tokens %q and %q, want distinct %d digit tokens", a, b, 2*tokenBytes)
+	}
+	if want := "1970-01-01T01:16:40Z|" + a; value != want {
+		t.Errorf("Mint() value = %q, want %q", value, want)
+	}
+	if TokenID(a) == TokenID(b) || TokenID(a) != TokenID(a) || len(TokenID(a)) != 16 {
+		t.Errorf("TokenID() = %q, %q", TokenID(a), TokenID(b))
+	}
+}
+
+func TestCheck(t *testing.T) {
+	now := time.Unix(1000, 0)
+	token, value, err := Mint(time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof := Proof(token, "node-2", "10.0.0.2:7000")
+
+	for _, tt := range []struct {
+		name     string
+		value    string
+		nodeID   string
+		raftAddr string
+		proof    string
+		now      time.Time
+		want     error
+	}{
+		{"valid", value, "node-2", "10.0.0.2:7000", proof, now, nil},
+		{"valid until it expires", value, "node-2", "10.0.0.2:7000", proof, now.Add(time.Hour), nil},
+		{"expired", value, "node-2", "10.0.0.2:7000", proof, now.Add(time.Hour + time.Second), ErrExpired},
+		{"consumed", "", "node-2", "10.0.0.2:7000", proof, now, ErrUnknownToken},
+		{"malformed value", "soon|" + token, "node-2", "10.0.0.2:7000", proof, now, ErrExpired},
+		{"replayed by another node", value, "node-3", "10.0.0.2:7000", proof, now, ErrInvalidProof},
+		{"replayed from another address", value, "node-2", "10.0.0.3:7000", proof, now, ErrInvalidProof},
+		{"proof of another token", value, "node-2", "10.0.0.2:7000", Proof("other", "node-2", "10.0.0.2:7000"), now, ErrInvalidProof},
+		{"proof not hex", value, "node-2", "10.0.0.2:7000", "zz", now, ErrInvalidProof},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Check(tt.value, tt.nodeID, tt.raftAddr, tt.proof, tt.now); !errors.Is(err, tt.want) {
+				t.Errorf("Check() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
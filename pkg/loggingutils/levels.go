@@ -0,0 +1,127 @@
+package loggingutils
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Levels holds the log level of every module, a named logger such as
+// serf-agent or http, and whether logs are sampled.  Both can be changed at
+// runtime, see Wrap.
+type Levels struct {
+	mu      sync.RWMutex
+	def     zapcore.Level
+	modules map[string]zapcore.Level
+	// min is the lowest of the levels, entries below it are dropped early.
+	min      zapcore.Level
+	sampling atomic.Bool
+}
+
+// NewLevels logs modules without a level of their own at def.
+func NewLevels(def zapcore.Level) *Levels {
+	return &Levels{def: def, min: def, modules: map[string]zapcore.Level{}}
+}
+
+// SetLevel sets the level of a module, the default one when module is empty.
+func (l *Levels) SetLevel(module string, level zapcore.Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if module == "" {
+		l.def = level
+	} else {
+		l.modules[module] = level
+	}
+	l.min = l.def
+	for _, lvl := range l.modules {
+		if lvl < l.min {
+			l.min = lvl
+		}
+	}
+}
+
+// Levels returns the default level, under "", and the modules'.
+func (l *Levels) Levels() map[string]string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	levels := map[string]string{"": l.def.String()}
+	for module, lvl := range l.modules {
+		levels[module] = lvl.String()
+	}
+	return levels
+}
+
+// SetSampling turns sampling on or off.  Sampled, the first 100 entries with
+// the same message and level every second are logged, then every 100th.
+func (l *Levels) SetSampling(on bool) {
+	l.sampling.Store(on)
+}
+
+func (l *Levels) Sampling() bool {
+	return l.sampling.Load()
+}
+
+// enabled reports whether the logger named name logs at lvl.  Logger names
+// are dot separated, the module closest to the end of the name counts:
+// node-1.serf-agent.serf logs at serf's level if set, else serf-agent's.
+func (l *Levels) enabled(name string, lvl zapcore.Level) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if lvl < l.min {
+		return false
+	}
+	parts := strings.Split(name, ".")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if level, ok := l.modules[parts[i]]; ok {
+			return lvl >= level
+		}
+	}
+	return lvl >= l.def
+}
+
+// Wrap filters the entries logged to core by l.  core itself should log
+// every level.
+func (l *Levels) Wrap(core zapcore.Core) zapcore.Core {
+	return &levelsCore{
+		levels:  l,
+		core:    core,
+		sampled: zapcore.NewSamplerWithOptions(core, time.Second, 100, 100),
+	}
+}
+
+type levelsCore struct {
+	levels  *Levels
+	core    zapcore.Core
+	sampled zapcore.Core
+}
+
+func (c *levelsCore) Enabled(lvl zapcore.Level) bool {
+	c.levels.mu.RLock()
+	defer c.levels.mu.RUnlock()
+	return lvl >= c.levels.min
+}
+
+func (c *levelsCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelsCore{levels: c.levels, core: c.core.With(fields), sampled: c.sampled.With(fields)}
+}
+
+func (c *levelsCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.levels.enabled(e.LoggerName, e.Level) {
+		return ce
+	}
+	if c.levels.Sampling() {
+		return c.sampled.Check(e, ce)
+	}
+	return c.core.Check(e, ce)
+}
+
+func (c *levelsCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	return c.core.Write(e, fields)
+}
+
+func (c *levelsCore) Sync() error {
+	return c.core.Sync()
+}
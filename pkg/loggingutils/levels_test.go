@@ -0,0 +1,45 @@
+package loggingutils
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLevels(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	levels := NewLevels(zapcore.InfoLevel)
+	levels.SetLevel("serf-agent", zapcore.WarnLevel)
+	levels.SetLevel("memberlist", zapcore.DebugLevel)
+	logger := zap.New(levels.Wrap(core)).Named("node-1")
+
+	logger.Debug("dropped")
+	logger.Info("kept")
+	logger.Named("serf-agent").Info("dropped")
+	logger.Named("serf-agent").Warn("kept")
+	logger.Named("serf-agent").Named("memberlist").Debug("kept")
+	levels.SetLevel("", zapcore.DebugLevel)
+	logger.Named("http").Debug("kept")
+
+	for _, e := range logs.All() {
+		if e.Message != "kept" {
+			t.Errorf("logged %s %q by %s", e.Level, e.Message, e.LoggerName)
+		}
+	}
+	if n := logs.Len(); n != 4 {
+		t.Errorf("logged %d entries, want 4", n)
+	}
+	if got := levels.Levels(); got[""] != "debug" || got["serf-agent"] != "warn" {
+		t.Errorf("Levels() = %v", got)
+	}
+
+	levels.SetSampling(true)
+	for i := 0; i < 300; i++ {
+		logger.Info("repeated")
+	}
+	if n := logs.FilterMessage("repeated").Len(); n != 102 {
+		t.Errorf("sampled %d of 300 entries, want 102", n)
+	}
+}
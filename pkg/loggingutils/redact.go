@@ -0,0 +1,53 @@
+package loggingutils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// unredacted holds the tables whose row keys and values Redact lets
+// through, "*" for every table.
+var unredacted atomic.Pointer[map[string]bool]
+
+// SetUnredactedTables sets the tables whose row keys and values appear in
+// logs, traces and error messages as they are, for debugging.  "*" lets
+// every table's through, none by default.
+func SetUnredactedTables(tables []string) {
+	allow := map[string]bool{}
+	for _, table := range tables {
+		if table = strings.TrimSpace(table); table != "" {
+			allow[table] = true
+		}
+	}
+	unredacted.Store(&allow)
+}
+
+// UnredactedTables returns the tables set with SetUnredactedTables, sorted.
+func UnredactedTables() []string {
+	tables := []string{}
+	if allow := unredacted.Load(); allow != nil {
+		for table := range *allow {
+			tables = append(tables, table)
+		}
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// Redact returns s, a row key or value of table, as it should appear in a
+// log, trace or error message: as is for the system tables ("_" prefixed)
+// and the unredacted ones, else as "redacted:" and a short hash of it, so
+// the same key can still be followed through the logs without showing it.
+func Redact(table, s string) string {
+	if s == "" || strings.HasPrefix(table, "_") {
+		return s
+	}
+	if allow := unredacted.Load(); allow != nil && ((*allow)["*"] || (*allow)[table]) {
+		return s
+	}
+	sum := sha256.Sum256([]byte(s))
+	return "redacted:" + hex.EncodeToString(sum[:4])
+}
@@ -0,0 +1,36 @@
+package loggingutils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	defer SetUnredactedTables(nil)
+	SetUnredactedTables(nil)
+	got := Redact("users", "alice")
+	if !strings.HasPrefix(got, "redacted:") || strings.Contains(got, "alice") {
+		t.Errorf("Redact() = %q, want it redacted", got)
+	}
+	if again := Redact("users", "alice"); again != got {
+		t.Errorf("Redact() = %q then %q, want the same hash", got, again)
+	}
+	if got := Redact("_txns", "t1"); got != "t1" {
+		t.Errorf("Redact() of a system table = %q, want it as is", got)
+	}
+
+	SetUnredactedTables([]string{"users", " "})
+	if got := Redact("users", "alice"); got != "alice" {
+		t.Errorf("Redact() of an unredacted table = %q", got)
+	}
+	if got := Redact("orders", "1"); got == "1" {
+		t.Errorf("Redact() of another table = %q, want it redacted", got)
+	}
+	if got := UnredactedTables(); len(got) != 1 || got[0] != "users" {
+		t.Errorf("UnredactedTables() = %v", got)
+	}
+	SetUnredactedTables([]string{"*"})
+	if got := Redact("orders", "1"); got != "1" {
+		t.Errorf("Redact() with * = %q", got)
+	}
+}
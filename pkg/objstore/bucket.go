@@ -0,0 +1,258 @@
+package objstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// emptyPayloadHash is the SHA-256 of no bytes, the payload hash of
+	// requests without a body.
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	// unsignedPayload leaves the body of uploads out of the signature, so
+	// they can be streamed.
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+type credentials struct {
+	accessKey, secretKey, token string
+}
+
+// bucket is an S3 compatible bucket, addressed path style at endpoint.
+type bucket struct {
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	region   string
+	creds    credentials
+	client   *http.Client
+	now      func() time.Time
+}
+
+func newBucket(u *url.URL, endpoint, region string, creds credentials) (*bucket, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s: no bucket", u.Redacted())
+	}
+	if creds.accessKey == "" || creds.secretKey == "" {
+		return nil, fmt.Errorf("%s: no credentials in the environment", u.Redacted())
+	}
+	ep, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &bucket{
+		endpoint: ep,
+		bucket:   u.Host,
+		prefix:   prefix,
+		region:   region,
+		creds:    creds,
+		client:   &http.Client{},
+		now:      time.Now,
+	}, nil
+}
+
+// request builds a signed request for the object key, or the bucket itself
+// for the empty key.
+func (b *bucket) request(ctx context.Context, method, key string, query url.Values, body io.Reader, payloadHash string) (*http.Request, error) {
+	u := *b.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.bucket
+	if key != "" {
+		u.Path += "/" + b.prefix + key
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	sign(req, b.creds, b.region, payloadHash, b.now())
+	return req, nil
+}
+
+func (b *bucket) do(req *http.Request, ok ...int) (*http.Response, error) {
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode == http.StatusNotFound && req.Method == http.MethodGet {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, req.URL.Path)
+	}
+	return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+func (b *bucket) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	req, err := b.request(ctx, http.MethodPut, key, nil, r, unsignedPayload)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := b.do(req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b *bucket) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := b.request(ctx, http.MethodGet, key, nil, nil, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// listResult is the ListObjectsV2 response.
+type listResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (b *bucket) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	query := url.Values{"list-type": {"2"}, "prefix": {b.prefix + prefix}}
+	for {
+		req, err := b.request(ctx, http.MethodGet, "", query, nil, emptyPayloadHash)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := b.do(req, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+		page := listResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding the listing of %s: %w", b.bucket, err)
+		}
+		for _, c := range page.Contents {
+			objects = append(objects, Object{Key: strings.TrimPrefix(c.Key, b.prefix), Size: c.Size, Modified: c.LastModified})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return objects, nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+func (b *bucket) Delete(ctx context.Context, key string) error {
+	req, err := b.request(ctx, http.MethodDelete, key, nil, nil, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(req, http.StatusOK, http.StatusNoContent, http.StatusNotFound)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// sign signs req with AWS signature version 4, every header of req and its
+// host included.
+func sign(req *http.Request, creds credentials, region, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, vals := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(vals, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := &strings.Builder{}
+	for _, name := range names {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.secretKey), amzDate[:8])
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func canonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for name, vals := range query {
+		for _, val := range vals {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(val, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent encodes s the way SigV4 wants it: everything but the
+// unreserved characters, and "/" too when encodeSlash.
+func uriEncode(s string, encodeSlash bool) string {
+	out := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			out.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			out.WriteByte(c)
+		default:
+			fmt.Fprintf(out, "%%%02X", c)
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,173 @@
+// Package objstore stores objects in a directory or an S3 compatible bucket,
+// for the archives shipped out of the cluster.  Buckets are spoken to over
+// plain http with SigV4 signatures, which S3, GCS (with HMAC keys) and MinIO
+// all accept.
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by Get for objects that don't exist.
+var ErrNotFound = errors.New("object not found")
+
+// Object is an object of a Store, as listed by List.
+type Object struct {
+	Key      string
+	Size     int64
+	Modified time.Time
+}
+
+// Store is a flat namespace of objects, keyed by "/" separated names.
+type Store interface {
+	// Put writes the size bytes of r as the object key, replacing it.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get opens the object key.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// List lists the objects whose key starts with prefix, by key.
+	List(ctx context.Context, prefix string) ([]Object, error)
+	// Delete removes the object key, deleting one that doesn't exist isn't
+	// an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// Open opens the store at rawURL:
+//
+//	file:///var/backups/expodb          a directory
+//	s3://bucket/prefix?region=eu-west-1  an S3 bucket
+//	s3://bucket/prefix?endpoint=http://minio:9000
+//	gs://bucket/prefix                   a GCS bucket
+//
+// S3 credentials come from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN, the region from AWS_REGION when not in the URL.  GCS
+// takes HMAC keys from GOOGLE_HMAC_ACCESS_ID and GOOGLE_HMAC_SECRET.
+func Open(rawURL string) (Store, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file", "":
+		if u.Path == "" {
+			return nil, fmt.Errorf("%s: no directory", rawURL)
+		}
+		return &dirStore{dir: u.Path}, nil
+	case "s3":
+		region := u.Query().Get("region")
+		if region == "" {
+			region = os.Getenv("AWS_REGION")
+		}
+		if region == "" {
+			region = "us-east-1"
+		}
+		endpoint := u.Query().Get("endpoint")
+		if endpoint == "" {
+			endpoint = "https://s3." + region + ".amazonaws.com"
+		}
+		return newBucket(u, endpoint, region, credentials{
+			accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			token:     os.Getenv("AWS_SESSION_TOKEN"),
+		})
+	case "gs":
+		endpoint := u.Query().Get("endpoint")
+		if endpoint == "" {
+			endpoint = "https://storage.googleapis.com"
+		}
+		return newBucket(u, endpoint, "auto", credentials{
+			accessKey: os.Getenv("GOOGLE_HMAC_ACCESS_ID"),
+			secretKey: os.Getenv("GOOGLE_HMAC_SECRET"),
+		})
+	}
+	return nil, fmt.Errorf("%s: unsupported scheme %q, want file, s3 or gs", rawURL, u.Scheme)
+}
+
+// dirStore keeps the objects as files under dir.
+type dirStore struct {
+	dir string
+}
+
+func (s *dirStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s *dirStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// written aside then renamed, so an object is never seen half written.
+	f, err := os.CreateTemp(filepath.Dir(path), ".put-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	n, err := io.Copy(f, r)
+	if err == nil && n != size {
+		err = fmt.Errorf("put %s: wrote %d bytes, want %d", key, n, size)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (s *dirStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return f, err
+}
+
+func (s *dirStore) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && path == s.dir {
+			return filepath.SkipDir
+		}
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".put-") {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, Object{Key: key, Size: info.Size(), Modified: info.ModTime()})
+		return nil
+	})
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, err
+}
+
+func (s *dirStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
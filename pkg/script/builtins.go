@@ -0,0 +1,513 @@
+package script
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// openLibs sets the globals of a run: the base functions and the db, string,
+// table and math libraries.
+func (in *interp) openLibs() {
+	lib := func(fns map[string]func(*interp, []value) ([]value, error), prefix string) *table {
+		t := in.newTable()
+		for _, name := range sortedNames(fns) {
+			t.set(name, &builtin{id: in.nextID(), name: prefix + name, fn: fns[name]})
+		}
+		return t
+	}
+	base := lib(baseLib, "")
+	for _, k := range base.sortedKeys() {
+		in.globals[k.(string)] = base.get(k)
+	}
+	in.globals["db"] = lib(dbLib, "db.")
+	in.globals["string"] = lib(stringLib, "string.")
+	in.globals["table"] = lib(tableLib, "table.")
+	in.globals["math"] = lib(mathLib, "math.")
+}
+
+func sortedNames(fns map[string]func(*interp, []value) ([]value, error)) []string {
+	names := make([]string, 0, len(fns))
+	for name := range fns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func arg(args []value, i int) value {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+func argError(i int, name, want string, got value) error {
+	return fmt.Errorf("bad argument #%d to '%s' (%s expected, got %s)", i+1, name, want, typeName(got))
+}
+
+// argString returns a string argument, numbers are converted.
+func argString(args []value, i int, name string) (string, error) {
+	s, ok := concatString(arg(args, i))
+	if !ok {
+		return "", argError(i, name, "string", arg(args, i))
+	}
+	return s, nil
+}
+
+func argNumber(args []value, i int, name string) (float64, error) {
+	n, ok := toNumber(arg(args, i))
+	if !ok {
+		return 0, argError(i, name, "number", arg(args, i))
+	}
+	return n, nil
+}
+
+// argInt returns an integer argument, or def when it is absent.
+func argInt(args []value, i int, name string, def int) (int, error) {
+	if arg(args, i) == nil {
+		return def, nil
+	}
+	n, err := argNumber(args, i, name)
+	if err != nil {
+		return 0, err
+	}
+	if n != math.Trunc(n) || math.Abs(n) > 1<<53 {
+		return 0, fmt.Errorf("bad argument #%d to '%s' (number has no integer representation)", i+1, name)
+	}
+	return int(n), nil
+}
+
+func argTable(args []value, i int, name string) (*table, error) {
+	t, ok := arg(args, i).(*table)
+	if !ok {
+		return nil, argError(i, name, "table", arg(args, i))
+	}
+	return t, nil
+}
+
+var baseLib = map[string]func(*interp, []value) ([]value, error){
+	"tostring": func(in *interp, args []value) ([]value, error) {
+		return []value{tostring(arg(args, 0))}, nil
+	},
+	"tonumber": func(in *interp, args []value) ([]value, error) {
+		if arg(args, 1) == nil {
+			if n, ok := toNumber(arg(args, 0)); ok {
+				return []value{n}, nil
+			}
+			return []value{nil}, nil
+		}
+		s, err := argString(args, 0, "tonumber")
+		if err != nil {
+			return nil, err
+		}
+		base, err := argInt(args, 1, "tonumber", 10)
+		if err != nil {
+			return nil, err
+		}
+		if base < 2 || base > 36 {
+			return nil, fmt.Errorf("bad argument #2 to 'tonumber' (base out of range)")
+		}
+		n, err := strconv.ParseInt(strings.ToLower(strings.TrimSpace(s)), base, 64)
+		if err != nil {
+			return []value{nil}, nil
+		}
+		return []value{float64(n)}, nil
+	},
+	"type": func(in *interp, args []value) ([]value, error) {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("bad argument #1 to 'type' (value expected)")
+		}
+		return []value{typeName(args[0])}, nil
+	},
+	"error": func(in *interp, args []value) ([]value, error) {
+		return nil, fmt.Errorf("%s", tostring(arg(args, 0)))
+	},
+	"assert": func(in *interp, args []value) ([]value, error) {
+		if truthy(arg(args, 0)) {
+			return args, nil
+		}
+		if msg := arg(args, 1); msg != nil {
+			return nil, fmt.Errorf("%s", tostring(msg))
+		}
+		return nil, fmt.Errorf("assertion failed!")
+	},
+	"pairs": func(in *interp, args []value) ([]value, error) {
+		t, err := argTable(args, 0, "pairs")
+		if err != nil {
+			return nil, err
+		}
+		// fields are visited in the order of sortedKeys, as they were
+		// when the loop started, skipping those deleted since.
+		keys, i := t.sortedKeys(), 0
+		next := func(in *interp, _ []value) ([]value, error) {
+			for ; i < len(keys); i++ {
+				if v := t.get(keys[i]); v != nil {
+					i++
+					return []value{keys[i-1], v}, nil
+				}
+			}
+			return []value{nil}, nil
+		}
+		return []value{&builtin{id: in.nextID(), name: "next", fn: next}, t, nil}, nil
+	},
+	"ipairs": func(in *interp, args []value) ([]value, error) {
+		t, err := argTable(args, 0, "ipairs")
+		if err != nil {
+			return nil, err
+		}
+		next := func(in *interp, args []value) ([]value, error) {
+			i, _ := toNumber(arg(args, 1))
+			v := t.get(i + 1)
+			if v == nil {
+				return []value{nil}, nil
+			}
+			return []value{i + 1, v}, nil
+		}
+		return []value{&builtin{id: in.nextID(), name: "inext", fn: next}, t, float64(0)}, nil
+	},
+}
+
+// dbLib reads and writes rows through the host of the run.
+var dbLib = map[string]func(*interp, []value) ([]value, error){
+	"get": func(in *interp, args []value) ([]value, error) {
+		table, key, err := rowArgs(args, "get")
+		if err != nil {
+			return nil, err
+		}
+		column, err := argString(args, 2, "get")
+		if err != nil {
+			return nil, err
+		}
+		v, ok, err := in.host.Get(table, key, column)
+		if err != nil {
+			return nil, &hostError{err: err}
+		}
+		if !ok {
+			return []value{nil}, nil
+		}
+		return []value{v}, nil
+	},
+	"row": func(in *interp, args []value) ([]value, error) {
+		table, key, err := rowArgs(args, "row")
+		if err != nil {
+			return nil, err
+		}
+		cols, err := in.host.Row(table, key)
+		if err != nil {
+			return nil, &hostError{err: err}
+		}
+		if len(cols) == 0 {
+			return []value{nil}, nil
+		}
+		t := in.newTable()
+		for k, v := range cols {
+			t.set(k, v)
+		}
+		return []value{t}, nil
+	},
+	"set": func(in *interp, args []value) ([]value, error) {
+		table, key, err := rowArgs(args, "set")
+		if err != nil {
+			return nil, err
+		}
+		column, err := argString(args, 2, "set")
+		if err != nil {
+			return nil, err
+		}
+		v, err := argString(args, 3, "set")
+		if err != nil {
+			return nil, err
+		}
+		if err := in.host.Set(table, key, column, v); err != nil {
+			return nil, &hostError{err: err}
+		}
+		return nil, nil
+	},
+	"del": func(in *interp, args []value) ([]value, error) {
+		table, key, err := rowArgs(args, "del")
+		if err != nil {
+			return nil, err
+		}
+		column := ""
+		if arg(args, 2) != nil {
+			if column, err = argString(args, 2, "del"); err != nil {
+				return nil, err
+			}
+		}
+		if err := in.host.Delete(table, key, column); err != nil {
+			return nil, &hostError{err: err}
+		}
+		return nil, nil
+	},
+}
+
+func rowArgs(args []value, name string) (string, string, error) {
+	table, err := argString(args, 0, name)
+	if err != nil {
+		return "", "", err
+	}
+	key, err := argString(args, 1, name)
+	if err != nil {
+		return "", "", err
+	}
+	return table, key, nil
+}
+
+// newString accounts for a string built by a builtin.
+func (in *interp) newString(s string) ([]value, error) {
+	if len(s) > MaxStringLen {
+		return nil, fmt.Errorf("string longer than %d bytes", MaxStringLen)
+	}
+	if err := in.allocate(len(s)); err != nil {
+		return nil, err
+	}
+	return []value{s}, nil
+}
+
+var stringLib = map[string]func(*interp, []value) ([]value, error){
+	"len": func(in *interp, args []value) ([]value, error) {
+		s, err := argString(args, 0, "len")
+		if err != nil {
+			return nil, err
+		}
+		return []value{float64(len(s))}, nil
+	},
+	// sub takes Lua's 1-based, inclusive and negative from the end indexes.
+	"sub": func(in *interp, args []value) ([]value, error) {
+		s, err := argString(args, 0, "sub")
+		if err != nil {
+			return nil, err
+		}
+		i, err := argInt(args, 1, "sub", 1)
+		if err != nil {
+			return nil, err
+		}
+		j, err := argInt(args, 2, "sub", -1)
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 {
+			i = len(s) + i + 1
+		}
+		if j < 0 {
+			j = len(s) + j + 1
+		}
+		if i < 1 {
+			i = 1
+		}
+		if j > len(s) {
+			j = len(s)
+		}
+		if i > j {
+			return []value{""}, nil
+		}
+		return []value{s[i-1 : j]}, nil
+	},
+	"upper": func(in *interp, args []value) ([]value, error) {
+		s, err := argString(args, 0, "upper")
+		if err != nil {
+			return nil, err
+		}
+		return in.newString(strings.ToUpper(s))
+	},
+	"lower": func(in *interp, args []value) ([]value, error) {
+		s, err := argString(args, 0, "lower")
+		if err != nil {
+			return nil, err
+		}
+		return in.newString(strings.ToLower(s))
+	},
+	"rep": func(in *interp, args []value) ([]value, error) {
+		s, err := argString(args, 0, "rep")
+		if err != nil {
+			return nil, err
+		}
+		n, err := argInt(args, 1, "rep", 0)
+		if err != nil {
+			return nil, err
+		}
+		sep := ""
+		if arg(args, 2) != nil {
+			if sep, err = argString(args, 2, "rep"); err != nil {
+				return nil, err
+			}
+		}
+		if n <= 0 || s+sep == "" {
+			return []value{""}, nil
+		}
+		if n > (MaxStringLen+len(sep))/(len(s)+len(sep)) {
+			return nil, fmt.Errorf("string longer than %d bytes", MaxStringLen)
+		}
+		return in.newString(strings.Repeat(s+sep, n-1) + s)
+	},
+	// find only finds plain substrings, there are no patterns.  It starts
+	// at init, negative from the end.
+	"find": func(in *interp, args []value) ([]value, error) {
+		s, err := argString(args, 0, "find")
+		if err != nil {
+			return nil, err
+		}
+		sub, err := argString(args, 1, "find")
+		if err != nil {
+			return nil, err
+		}
+		init, err := argInt(args, 2, "find", 1)
+		if err != nil {
+			return nil, err
+		}
+		if init < 0 {
+			init = len(s) + init + 1
+		}
+		if init < 1 {
+			init = 1
+		}
+		if init > len(s)+1 {
+			return []value{nil}, nil
+		}
+		i := strings.Index(s[init-1:], sub)
+		if i < 0 {
+			return []value{nil}, nil
+		}
+		i += init - 1
+		return []value{float64(i + 1), float64(i + len(sub))}, nil
+	},
+}
+
+var tableLib = map[string]func(*interp, []value) ([]value, error){
+	"insert": func(in *interp, args []value) ([]value, error) {
+		t, err := argTable(args, 0, "insert")
+		if err != nil {
+			return nil, err
+		}
+		if err := in.allocate(32); err != nil {
+			return nil, err
+		}
+		n := t.length()
+		if len(args) < 3 {
+			t.set(float64(n+1), arg(args, 1))
+			return nil, nil
+		}
+		pos, err := argInt(args, 1, "insert", 0)
+		if err != nil {
+			return nil, err
+		}
+		if pos < 1 || pos > n+1 {
+			return nil, fmt.Errorf("bad argument #2 to 'insert' (position out of bounds)")
+		}
+		for i := n; i >= pos; i-- {
+			t.set(float64(i+1), t.get(float64(i)))
+		}
+		t.set(float64(pos), args[2])
+		return nil, nil
+	},
+	"remove": func(in *interp, args []value) ([]value, error) {
+		t, err := argTable(args, 0, "remove")
+		if err != nil {
+			return nil, err
+		}
+		n := t.length()
+		pos, err := argInt(args, 1, "remove", n)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 && len(args) < 2 {
+			return []value{nil}, nil
+		}
+		if pos < 1 || pos > n+1 {
+			return nil, fmt.Errorf("bad argument #2 to 'remove' (position out of bounds)")
+		}
+		v := t.get(float64(pos))
+		for i := pos; i < n; i++ {
+			t.set(float64(i), t.get(float64(i+1)))
+		}
+		if pos <= n {
+			t.set(float64(n), nil)
+		}
+		return []value{v}, nil
+	},
+	"concat": func(in *interp, args []value) ([]value, error) {
+		t, err := argTable(args, 0, "concat")
+		if err != nil {
+			return nil, err
+		}
+		sep := ""
+		if arg(args, 1) != nil {
+			if sep, err = argString(args, 1, "concat"); err != nil {
+				return nil, err
+			}
+		}
+		first, err := argInt(args, 2, "concat", 1)
+		if err != nil {
+			return nil, err
+		}
+		last, err := argInt(args, 3, "concat", t.length())
+		if err != nil {
+			return nil, err
+		}
+		var b strings.Builder
+		for i := first; i <= last; i++ {
+			s, ok := concatString(t.get(float64(i)))
+			if !ok {
+				return nil, fmt.Errorf("invalid value (at index %d) in table for 'concat'", i)
+			}
+			if i > first {
+				b.WriteString(sep)
+			}
+			b.WriteString(s)
+			if b.Len() > MaxStringLen {
+				return nil, fmt.Errorf("string longer than %d bytes", MaxStringLen)
+			}
+		}
+		return in.newString(b.String())
+	},
+}
+
+var mathLib = map[string]func(*interp, []value) ([]value, error){
+	"floor": func(in *interp, args []value) ([]value, error) {
+		n, err := argNumber(args, 0, "floor")
+		if err != nil {
+			return nil, err
+		}
+		return []value{math.Floor(n)}, nil
+	},
+	"ceil": func(in *interp, args []value) ([]value, error) {
+		n, err := argNumber(args, 0, "ceil")
+		if err != nil {
+			return nil, err
+		}
+		return []value{math.Ceil(n)}, nil
+	},
+	"abs": func(in *interp, args []value) ([]value, error) {
+		n, err := argNumber(args, 0, "abs")
+		if err != nil {
+			return nil, err
+		}
+		return []value{math.Abs(n)}, nil
+	},
+	"max": func(in *interp, args []value) ([]value, error) {
+		return extreme(args, "max", func(a, b float64) bool { return a > b })
+	},
+	"min": func(in *interp, args []value) ([]value, error) {
+		return extreme(args, "min", func(a, b float64) bool { return a < b })
+	},
+}
+
+func extreme(args []value, name string, better func(a, b float64) bool) ([]value, error) {
+	best, err := argNumber(args, 0, name)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(args); i++ {
+		n, err := argNumber(args, i, name)
+		if err != nil {
+			return nil, err
+		}
+		if better(n, best) {
+			best = n
+		}
+	}
+	return []value{best}, nil
+}
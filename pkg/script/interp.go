@@ -0,0 +1,855 @@
+package script
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// value is a script value: nil, bool, float64, string, *table, *closure or
+// *builtin.
+type value interface{}
+
+// table is a Lua table.  seq is a border of the table, a length: its fields
+// 1 to seq are set and seq+1 isn't.
+type table struct {
+	id   int
+	hash map[value]value
+	seq  int
+}
+
+func (t *table) get(k value) value {
+	return t.hash[normKey(k)]
+}
+
+// set sets a field, a nil value deletes it.
+func (t *table) set(k, v value) {
+	k = normKey(k)
+	if v == nil {
+		delete(t.hash, k)
+		if n, ok := k.(float64); ok && n >= 1 && n <= float64(t.seq) && n == math.Trunc(n) {
+			t.seq = int(n) - 1
+		}
+		return
+	}
+	t.hash[k] = v
+	if n, ok := k.(float64); ok && n == float64(t.seq+1) {
+		for t.hash[float64(t.seq+1)] != nil {
+			t.seq++
+		}
+	}
+}
+
+func (t *table) length() int { return t.seq }
+
+// sortedKeys returns the keys of a table in a deterministic order: numbers,
+// strings, booleans, then tables and functions by creation.
+func (t *table) sortedKeys() []value {
+	keys := make([]value, 0, len(t.hash))
+	for k := range t.hash {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keyLess(keys[i], keys[j]) })
+	return keys
+}
+
+func keyRank(k value) int {
+	switch k.(type) {
+	case float64:
+		return 0
+	case string:
+		return 1
+	case bool:
+		return 2
+	}
+	return 3
+}
+
+func keyLess(a, b value) bool {
+	if ra, rb := keyRank(a), keyRank(b); ra != rb {
+		return ra < rb
+	}
+	switch a := a.(type) {
+	case float64:
+		return a < b.(float64)
+	case string:
+		return a < b.(string)
+	case bool:
+		return !a && b.(bool)
+	}
+	return objectID(a) < objectID(b)
+}
+
+func objectID(v value) int {
+	switch v := v.(type) {
+	case *table:
+		return v.id
+	case *closure:
+		return v.id
+	case *builtin:
+		// builtins are created before anything else, in a fixed order.
+		return v.id
+	}
+	return 0
+}
+
+// normKey folds -0 into 0, so both index the same field.
+func normKey(k value) value {
+	if n, ok := k.(float64); ok && n == 0 {
+		return float64(0)
+	}
+	return k
+}
+
+type closure struct {
+	id    int
+	fn    *funcExpr
+	scope *scope
+}
+
+type builtin struct {
+	id   int
+	name string
+	fn   func(in *interp, args []value) ([]value, error)
+}
+
+type cell struct {
+	v value
+}
+
+// scope holds the locals of a local statement, or the parameters of a
+// call.
+type scope struct {
+	vars   map[string]*cell
+	parent *scope
+}
+
+func newScope(parent *scope) *scope {
+	return &scope{vars: map[string]*cell{}, parent: parent}
+}
+
+func (s *scope) lookup(name string) *cell {
+	for ; s != nil; s = s.parent {
+		if c, ok := s.vars[name]; ok {
+			return c
+		}
+	}
+	return nil
+}
+
+func (s *scope) declare(name string, v value) {
+	s.vars[name] = &cell{v: v}
+}
+
+// flow is how a block ended.
+type flow int
+
+const (
+	flowNormal flow = iota
+	flowBreak
+	flowReturn
+)
+
+// interp is the state of a run.
+type interp struct {
+	host    Host
+	globals map[string]value
+	ids     int
+	steps   int
+	depth   int
+	alloc   int
+}
+
+func newInterp(host Host) *interp {
+	in := &interp{host: host, globals: map[string]value{}}
+	in.openLibs()
+	return in
+}
+
+func (in *interp) nextID() int {
+	in.ids++
+	return in.ids
+}
+
+func (in *interp) newTable() *table {
+	return &table{id: in.nextID(), hash: map[value]value{}}
+}
+
+func (in *interp) sequence(vals []string) *table {
+	t := in.newTable()
+	for i, v := range vals {
+		t.set(float64(i+1), v)
+	}
+	return t
+}
+
+var errMemory = errors.New("script exceeded its memory budget")
+
+// allocate accounts for n bytes built by the run.
+func (in *interp) allocate(n int) error {
+	in.alloc += n
+	if in.alloc > maxAlloc {
+		return errMemory
+	}
+	return nil
+}
+
+func (in *interp) step(line int) error {
+	in.steps++
+	if in.steps > MaxSteps {
+		return &Error{Line: line, Msg: fmt.Sprintf("script exceeded its budget of %d steps", MaxSteps)}
+	}
+	return nil
+}
+
+// setField sets a field of a table, accounting for the fields it adds.
+func (in *interp) setField(t *table, k, v value, line int) error {
+	switch k := k.(type) {
+	case nil:
+		return &Error{Line: line, Msg: "table index is nil"}
+	case float64:
+		if math.IsNaN(k) {
+			return &Error{Line: line, Msg: "table index is NaN"}
+		}
+	}
+	if v != nil && t.get(k) == nil {
+		if err := in.allocate(32); err != nil {
+			return &Error{Line: line, Msg: err.Error()}
+		}
+	}
+	t.set(k, v)
+	return nil
+}
+
+func (in *interp) call(c *closure, args []value, line int) ([]value, error) {
+	if in.depth >= MaxDepth {
+		return nil, &Error{Line: line, Msg: "stack overflow"}
+	}
+	if err := in.step(line); err != nil {
+		return nil, err
+	}
+	in.depth++
+	defer func() { in.depth-- }()
+	sc := newScope(c.scope)
+	for i, p := range c.fn.params {
+		var v value
+		if i < len(args) {
+			v = args[i]
+		}
+		sc.declare(p, v)
+	}
+	fl, rets, err := in.execStmts(c.fn.body, sc)
+	if err != nil {
+		return nil, err
+	}
+	if fl == flowBreak {
+		return nil, &Error{Line: c.fn.line, Msg: "break outside a loop"}
+	}
+	return rets, nil
+}
+
+// callValue calls a function value.  Errors of builtins other than script and
+// host ones are reported at the line of the call.
+func (in *interp) callValue(fn value, args []value, line int) ([]value, error) {
+	switch fn := fn.(type) {
+	case *closure:
+		return in.call(fn, args, line)
+	case *builtin:
+		if err := in.step(line); err != nil {
+			return nil, err
+		}
+		rets, err := fn.fn(in, args)
+		if err != nil {
+			var se *Error
+			var he *hostError
+			if errors.As(err, &se) || errors.As(err, &he) {
+				return nil, err
+			}
+			return nil, &Error{Line: line, Msg: err.Error()}
+		}
+		return rets, nil
+	}
+	return nil, &Error{Line: line, Msg: fmt.Sprintf("attempt to call a %s value", typeName(fn))}
+}
+
+func (in *interp) execBlock(b *block, parent *scope) (flow, []value, error) {
+	return in.execStmts(b, newScope(parent))
+}
+
+func (in *interp) execStmts(b *block, sc *scope) (flow, []value, error) {
+	fl, rets, _, err := in.execScoped(b, sc)
+	return fl, rets, err
+}
+
+// execScoped runs the statements of a block, returning the scope of the
+// locals declared last.  Every local statement opens a scope, so closures
+// don't see the locals declared after them and a local declared again
+// doesn't rebind the closures of the one it shadows.
+func (in *interp) execScoped(b *block, sc *scope) (flow, []value, *scope, error) {
+	for _, s := range b.stmts {
+		if err := in.step(s.stmtLine()); err != nil {
+			return flowNormal, nil, sc, err
+		}
+		switch s.(type) {
+		case *localStmt, *localFuncStmt:
+			sc = newScope(sc)
+		}
+		fl, rets, err := in.exec(s, sc)
+		if err != nil || fl != flowNormal {
+			return fl, rets, sc, err
+		}
+	}
+	return flowNormal, nil, sc, nil
+}
+
+func (in *interp) exec(s stmt, sc *scope) (flow, []value, error) {
+	switch s := s.(type) {
+	case *localStmt:
+		vals, err := in.evalList(s.exprs, sc, len(s.names))
+		if err != nil {
+			return flowNormal, nil, err
+		}
+		for i, name := range s.names {
+			sc.declare(name, vals[i])
+		}
+	case *localFuncStmt:
+		sc.declare(s.fn.name, nil)
+		sc.vars[s.fn.name].v = &closure{id: in.nextID(), fn: s.fn, scope: sc}
+	case *assignStmt:
+		vals, err := in.evalList(s.exprs, sc, len(s.targets))
+		if err != nil {
+			return flowNormal, nil, err
+		}
+		for i, target := range s.targets {
+			if err := in.assign(target, vals[i], sc); err != nil {
+				return flowNormal, nil, err
+			}
+		}
+	case *callStmt:
+		if _, err := in.evalMulti(s.call, sc); err != nil {
+			return flowNormal, nil, err
+		}
+	case *doStmt:
+		return in.execBlock(s.body, sc)
+	case *whileStmt:
+		for {
+			cond, err := in.eval(s.cond, sc)
+			if err != nil {
+				return flowNormal, nil, err
+			}
+			if !truthy(cond) {
+				return flowNormal, nil, nil
+			}
+			if err := in.step(s.line); err != nil {
+				return flowNormal, nil, err
+			}
+			fl, rets, err := in.execBlock(s.body, sc)
+			if err != nil || fl == flowReturn {
+				return fl, rets, err
+			}
+			if fl == flowBreak {
+				return flowNormal, nil, nil
+			}
+		}
+	case *repeatStmt:
+		for {
+			if err := in.step(s.line); err != nil {
+				return flowNormal, nil, err
+			}
+			// the condition sees the locals of the body.
+			fl, rets, body, err := in.execScoped(s.body, newScope(sc))
+			if err != nil || fl == flowReturn {
+				return fl, rets, err
+			}
+			if fl == flowBreak {
+				return flowNormal, nil, nil
+			}
+			cond, err := in.eval(s.cond, body)
+			if err != nil {
+				return flowNormal, nil, err
+			}
+			if truthy(cond) {
+				return flowNormal, nil, nil
+			}
+		}
+	case *ifStmt:
+		for i, c := range s.conds {
+			cond, err := in.eval(c, sc)
+			if err != nil {
+				return flowNormal, nil, err
+			}
+			if truthy(cond) {
+				return in.execBlock(s.blocks[i], sc)
+			}
+		}
+		if s.els != nil {
+			return in.execBlock(s.els, sc)
+		}
+	case *numForStmt:
+		return in.execNumFor(s, sc)
+	case *genForStmt:
+		return in.execGenFor(s, sc)
+	case *returnStmt:
+		// a returned call is expanded, not a tail call.
+		rets, err := in.evalList(s.exprs, sc, -1)
+		if err != nil {
+			return flowNormal, nil, err
+		}
+		return flowReturn, rets, nil
+	case *breakStmt:
+		return flowBreak, nil, nil
+	default:
+		return flowNormal, nil, &Error{Line: s.stmtLine(), Msg: fmt.Sprintf("unknown statement %T", s)}
+	}
+	return flowNormal, nil, nil
+}
+
+func (in *interp) execNumFor(s *numForStmt, sc *scope) (flow, []value, error) {
+	var bounds [3]float64
+	bounds[2] = 1
+	for i, e := range []expr{s.start, s.stop, s.step} {
+		if e == nil {
+			continue
+		}
+		v, err := in.eval(e, sc)
+		if err != nil {
+			return flowNormal, nil, err
+		}
+		n, ok := toNumber(v)
+		if !ok {
+			return flowNormal, nil, &Error{Line: s.line, Msg: fmt.Sprintf("'for' %s must be a number", []string{"initial value", "limit", "step"}[i])}
+		}
+		bounds[i] = n
+	}
+	start, stop, step := bounds[0], bounds[1], bounds[2]
+	if step == 0 {
+		return flowNormal, nil, &Error{Line: s.line, Msg: "'for' step is zero"}
+	}
+	for v := start; (step > 0 && v <= stop) || (step < 0 && v >= stop); v += step {
+		if err := in.step(s.line); err != nil {
+			return flowNormal, nil, err
+		}
+		body := newScope(sc)
+		body.declare(s.name, v)
+		fl, rets, err := in.execStmts(s.body, body)
+		if err != nil || fl == flowReturn {
+			return fl, rets, err
+		}
+		if fl == flowBreak {
+			break
+		}
+	}
+	return flowNormal, nil, nil
+}
+
+func (in *interp) execGenFor(s *genForStmt, sc *scope) (flow, []value, error) {
+	vals, err := in.evalList(s.exprs, sc, 3)
+	if err != nil {
+		return flowNormal, nil, err
+	}
+	fn, state, control := vals[0], vals[1], vals[2]
+	for {
+		rets, err := in.callValue(fn, []value{state, control}, s.line)
+		if err != nil {
+			return flowNormal, nil, err
+		}
+		if len(rets) == 0 || rets[0] == nil {
+			return flowNormal, nil, nil
+		}
+		control = rets[0]
+		body := newScope(sc)
+		for i, name := range s.names {
+			var v value
+			if i < len(rets) {
+				v = rets[i]
+			}
+			body.declare(name, v)
+		}
+		fl, rets, err := in.execStmts(s.body, body)
+		if err != nil || fl == flowReturn {
+			return fl, rets, err
+		}
+		if fl == flowBreak {
+			return flowNormal, nil, nil
+		}
+	}
+}
+
+func (in *interp) assign(target expr, v value, sc *scope) error {
+	switch target := target.(type) {
+	case *nameExpr:
+		if c := sc.lookup(target.name); c != nil {
+			c.v = v
+		} else {
+			in.globals[target.name] = v
+		}
+		return nil
+	case *indexExpr:
+		obj, err := in.eval(target.obj, sc)
+		if err != nil {
+			return err
+		}
+		key, err := in.eval(target.key, sc)
+		if err != nil {
+			return err
+		}
+		t, ok := obj.(*table)
+		if !ok {
+			return &Error{Line: target.line, Msg: fmt.Sprintf("attempt to index a %s value", typeName(obj))}
+		}
+		return in.setField(t, key, v, target.line)
+	}
+	return &Error{Line: target.exprLine(), Msg: "cannot assign to this expression"}
+}
+
+// evalList evaluates a list of expressions, expanding the results of a last
+// call, and adjusts them to n values unless n is negative.
+func (in *interp) evalList(exprs []expr, sc *scope, n int) ([]value, error) {
+	var vals []value
+	for i, e := range exprs {
+		if i == len(exprs)-1 {
+			rets, err := in.evalMulti(e, sc)
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, rets...)
+			break
+		}
+		v, err := in.eval(e, sc)
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+	}
+	if n < 0 {
+		return vals, nil
+	}
+	for len(vals) < n {
+		vals = append(vals, nil)
+	}
+	return vals[:n], nil
+}
+
+// evalMulti evaluates an expression to all the values of a call, or to its
+// one value.
+func (in *interp) evalMulti(e expr, sc *scope) ([]value, error) {
+	switch e := e.(type) {
+	case *callExpr:
+		fn, err := in.eval(e.fn, sc)
+		if err != nil {
+			return nil, err
+		}
+		args, err := in.evalList(e.args, sc, -1)
+		if err != nil {
+			return nil, err
+		}
+		return in.callValue(fn, args, e.line)
+	case *methodExpr:
+		obj, err := in.eval(e.obj, sc)
+		if err != nil {
+			return nil, err
+		}
+		fn, err := in.index(obj, e.name, e.line)
+		if err != nil {
+			return nil, err
+		}
+		args, err := in.evalList(e.args, sc, -1)
+		if err != nil {
+			return nil, err
+		}
+		return in.callValue(fn, append([]value{obj}, args...), e.line)
+	}
+	v, err := in.eval(e, sc)
+	if err != nil {
+		return nil, err
+	}
+	return []value{v}, nil
+}
+
+// index reads a field of a table, or a function of the string library
+// from a string.
+func (in *interp) index(obj, key value, line int) (value, error) {
+	switch obj := obj.(type) {
+	case *table:
+		return obj.get(key), nil
+	case string:
+		return in.globals["string"].(*table).get(key), nil
+	}
+	return nil, &Error{Line: line, Msg: fmt.Sprintf("attempt to index a %s value", typeName(obj))}
+}
+
+func (in *interp) eval(e expr, sc *scope) (value, error) {
+	switch e := e.(type) {
+	case *constExpr:
+		return e.val, nil
+	case *nameExpr:
+		if c := sc.lookup(e.name); c != nil {
+			return c.v, nil
+		}
+		return in.globals[e.name], nil
+	case *indexExpr:
+		obj, err := in.eval(e.obj, sc)
+		if err != nil {
+			return nil, err
+		}
+		key, err := in.eval(e.key, sc)
+		if err != nil {
+			return nil, err
+		}
+		return in.index(obj, key, e.line)
+	case *callExpr, *methodExpr:
+		rets, err := in.evalMulti(e, sc)
+		if err != nil || len(rets) == 0 {
+			return nil, err
+		}
+		return rets[0], nil
+	case *funcExpr:
+		return &closure{id: in.nextID(), fn: e, scope: sc}, nil
+	case *tableExpr:
+		return in.evalTable(e, sc)
+	case *unExpr:
+		v, err := in.eval(e.e, sc)
+		if err != nil {
+			return nil, err
+		}
+		return in.unary(e.op, v, e.line)
+	case *binExpr:
+		switch e.op {
+		case "()":
+			return in.eval(e.l, sc)
+		case "and", "or":
+			l, err := in.eval(e.l, sc)
+			if err != nil {
+				return nil, err
+			}
+			if truthy(l) == (e.op == "or") {
+				return l, nil
+			}
+			return in.eval(e.r, sc)
+		}
+		l, err := in.eval(e.l, sc)
+		if err != nil {
+			return nil, err
+		}
+		r, err := in.eval(e.r, sc)
+		if err != nil {
+			return nil, err
+		}
+		return in.binary(e.op, l, r, e.line)
+	}
+	return nil, &Error{Line: e.exprLine(), Msg: fmt.Sprintf("unknown expression %T", e)}
+}
+
+func (in *interp) evalTable(e *tableExpr, sc *scope) (value, error) {
+	t := in.newTable()
+	n := 0
+	for i, item := range e.items {
+		if item.key != nil {
+			k, err := in.eval(item.key, sc)
+			if err != nil {
+				return nil, err
+			}
+			v, err := in.eval(item.val, sc)
+			if err != nil {
+				return nil, err
+			}
+			if err := in.setField(t, k, v, e.line); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		vals := []value{nil}
+		var err error
+		if i == len(e.items)-1 {
+			vals, err = in.evalMulti(item.val, sc)
+		} else {
+			vals[0], err = in.eval(item.val, sc)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range vals {
+			n++
+			if err := in.setField(t, float64(n), v, e.line); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return t, nil
+}
+
+func (in *interp) unary(op string, v value, line int) (value, error) {
+	switch op {
+	case "not":
+		return !truthy(v), nil
+	case "-":
+		n, ok := toNumber(v)
+		if !ok {
+			return nil, &Error{Line: line, Msg: fmt.Sprintf("attempt to perform arithmetic on a %s value", typeName(v))}
+		}
+		return -n, nil
+	case "#":
+		switch v := v.(type) {
+		case string:
+			return float64(len(v)), nil
+		case *table:
+			return float64(v.length()), nil
+		}
+		return nil, &Error{Line: line, Msg: fmt.Sprintf("attempt to get length of a %s value", typeName(v))}
+	}
+	return nil, &Error{Line: line, Msg: fmt.Sprintf("unknown operator %s", op)}
+}
+
+func (in *interp) binary(op string, l, r value, line int) (value, error) {
+	switch op {
+	case "==":
+		return l == r, nil
+	case "~=":
+		return l != r, nil
+	case "<", "<=", ">", ">=":
+		if op == ">" || op == ">=" {
+			l, r = r, l
+		}
+		switch a := l.(type) {
+		case float64:
+			if b, ok := r.(float64); ok {
+				return a < b || (op[len(op)-1] == '=' && a == b), nil
+			}
+		case string:
+			if b, ok := r.(string); ok {
+				return a < b || (op[len(op)-1] == '=' && a == b), nil
+			}
+		}
+		return nil, &Error{Line: line, Msg: fmt.Sprintf("attempt to compare %s with %s", typeName(l), typeName(r))}
+	case "..":
+		a, aok := concatString(l)
+		b, bok := concatString(r)
+		if !aok || !bok {
+			bad := l
+			if aok {
+				bad = r
+			}
+			return nil, &Error{Line: line, Msg: fmt.Sprintf("attempt to concatenate a %s value", typeName(bad))}
+		}
+		if len(a)+len(b) > MaxStringLen {
+			return nil, &Error{Line: line, Msg: fmt.Sprintf("string longer than %d bytes", MaxStringLen)}
+		}
+		if err := in.allocate(len(a) + len(b)); err != nil {
+			return nil, &Error{Line: line, Msg: err.Error()}
+		}
+		return a + b, nil
+	}
+	a, aok := toNumber(l)
+	b, bok := toNumber(r)
+	if !aok || !bok {
+		bad := l
+		if aok {
+			bad = r
+		}
+		return nil, &Error{Line: line, Msg: fmt.Sprintf("attempt to perform arithmetic on a %s value", typeName(bad))}
+	}
+	switch op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		return a / b, nil
+	case "//":
+		return math.Floor(a / b), nil
+	case "%":
+		if math.IsInf(b, 0) && !math.IsInf(a, 0) && !math.IsNaN(a) {
+			if (a >= 0) == (b > 0) {
+				return a, nil
+			}
+			return b, nil
+		}
+		return a - math.Floor(a/b)*b, nil
+	case "^":
+		return math.Pow(a, b), nil
+	}
+	return nil, &Error{Line: line, Msg: fmt.Sprintf("unknown operator %s", op)}
+}
+
+func truthy(v value) bool {
+	return v != nil && v != false
+}
+
+// toNumber converts a number, or a string holding one.
+func toNumber(v value) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		return parseNumber(v)
+	}
+	return 0, false
+}
+
+// concatString converts a string, or a number, to concatenate it.
+func concatString(v value) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return formatNumber(v), true
+	}
+	return "", false
+}
+
+func typeName(v value) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *table:
+		return "table"
+	case *closure, *builtin:
+		return "function"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// formatNumber formats numbers as Lua does, integers without a fraction.
+func formatNumber(n float64) string {
+	switch {
+	case math.IsNaN(n):
+		return "nan"
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	case n == math.Trunc(n) && math.Abs(n) < 1e15:
+		return strconv.FormatInt(int64(n), 10)
+	}
+	return strconv.FormatFloat(n, 'g', 14, 64)
+}
+
+func tostring(v value) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return formatNumber(v)
+	case string:
+		return v
+	case *table:
+		return fmt.Sprintf("table: %d", v.id)
+	case *closure:
+		return fmt.Sprintf("function: %d", v.id)
+	case *builtin:
+		return "builtin: " + v.name
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,246 @@
+package script
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func run(src string) (interface{}, error) {
+	s, err := Compile(src)
+	if err != nil {
+		return nil, err
+	}
+	return s.Run(memHost{}, []string{"k1", "k2"}, []string{"a1"})
+}
+
+func TestRun_Semantics(t *testing.T) {
+	type arr = []interface{}
+	type obj = map[string]interface{}
+	tests := []struct {
+		name string
+		src  string
+		want interface{}
+	}{
+		// scoping
+		{"local shadows global", `x = 1 local x = 2 return x`, float64(2)},
+		{"local sees the outer local", `local x = 1 local x = x + 1 return x`, float64(2)},
+		{"block scope", `local x = 1 do local x = 2 end return x`, float64(1)},
+		{"closure doesn't see later locals", `
+			local function f() return y end
+			local y = 5
+			return f()`, nil},
+		{"redeclared local keeps closures", `
+			local x = 1
+			local f = function() return x end
+			local x = 2
+			return {f(), x}`, arr{float64(1), float64(2)}},
+		{"closure shares its local", `
+			local n = 0
+			local function inc() n = n + 1 end
+			inc() inc()
+			return n`, float64(2)},
+		{"closures per iteration", `
+			local fs = {}
+			for i = 1, 3 do fs[i] = function() return i end end
+			return {fs[1](), fs[2](), fs[3]()}`, arr{float64(1), float64(2), float64(3)}},
+		{"closures per while iteration", `
+			local fs, i = {}, 0
+			while i < 2 do i = i + 1 local j = i fs[i] = function() return j end end
+			return {fs[1](), fs[2]()}`, arr{float64(1), float64(2)}},
+		{"until sees the body's locals", `
+			local n = 0
+			repeat local done = n >= 2 n = n + 1 until done
+			return n`, float64(3)},
+		{"loop variable is a copy", `local n = 0 for i = 1, 3 do i = i * 10 n = n + i end return n`, float64(60)},
+		{"parameters", `local function f(a, b, c) return {a, b, c == nil} end return f(1, 2, 3, 4)[3]`, false},
+		{"missing arguments", `local function f(a, b) return b end return f(1) == nil`, true},
+		{"assignment evaluates before assigning", `local a, b = 1, 2 a, b = b, a return {a, b}`, arr{float64(2), float64(1)}},
+		{"global function", `function g() return "g" end return g()`, "g"},
+		{"method definition", `
+			local acc = {n = 10}
+			function acc:add(x) self.n = self.n + x return self end
+			return acc:add(1):add(2).n`, float64(13)},
+		{"nested field function", `local t = {a = {}} function t.a.f(x) return x * 2 end return t.a.f(4)`, float64(8)},
+
+		// calls and multiple values
+		{"extra values dropped", `local function f() return 1, 2, 3 end local a, b = f() return {a, b}`, arr{float64(1), float64(2)}},
+		{"call in the middle truncated", `local function f() return 1, 2 end return {f(), f(), 10}`, arr{float64(1), float64(1), float64(10)}},
+		{"parentheses truncate", `local function f() return 1, 2 end return {(f())}`, arr{float64(1)}},
+		{"returned call expands", `local function f() return 1, 2 end local function g() return f() end return {g()}`, arr{float64(1), float64(2)}},
+		{"no values", `local function f() end return {f()}`, arr{}},
+		{"string methods", `local s = "abc" return s:upper() .. ("x"):rep(2)`, "ABCxx"},
+		{"string call argument", `return tostring"x" .. type{}`, "xtable"},
+
+		// control flow
+		{"break leaves the innermost loop", `
+			local n = 0
+			for i = 1, 3 do
+				for j = 1, 10 do if j > 2 then break end n = n + 1 end
+			end
+			return n`, float64(6)},
+		{"return from a loop", `local function f() for i = 1, 10 do if i == 4 then return i end end end return f()`, float64(4)},
+		{"return from nested blocks", `local function f() do while true do if true then return "out" end end end end return f()`, "out"},
+		{"elseif", `local function f(x) if x < 0 then return "neg" elseif x == 0 then return "zero" else return "pos" end end return {f(-1), f(0), f(1)}`, arr{"neg", "zero", "pos"}},
+		{"for with step", `local t = {} for i = 10, 1, -3 do t[#t+1] = i end return t`, arr{float64(10), float64(7), float64(4), float64(1)}},
+		{"for not entered", `local n = 0 for i = 1, 0 do n = n + 1 end for i = 0, 1, -1 do n = n + 1 end return n`, float64(0)},
+		{"for with fractions", `local n = 0 for i = 0, 1, 0.25 do n = n + 1 end return n`, float64(5)},
+		{"for with strings", `local n = 0 for i = "1", "3" do n = n + i end return n`, float64(6)},
+		{"generic for with a closure", `
+			local function range(n)
+				local i = 0
+				return function() i = i + 1 if i <= n then return i end end
+			end
+			local s = 0
+			for i in range(4) do s = s + i end
+			return s`, float64(10)},
+		{"generic for with state", `
+			local function iter(t, i) i = i + 1 if t[i] then return i, t[i] end end
+			local s = ""
+			for i, v in iter, {"a", "b"}, 0 do s = s .. i .. v end
+			return s`, "1a2b"},
+
+		// values and operators
+		{"floor division and modulo", `return {7 // 2, -7 // 2, 7 % 3, -7 % 3, 7 % -3, 5.5 % 2}`, arr{float64(3), float64(-4), float64(1), float64(2), float64(-2), 1.5}},
+		{"power", `return {2 ^ 10, 2 ^ 3 ^ 2, -2 ^ 2}`, arr{float64(1024), float64(512), float64(-4)}},
+		{"division is float", `return 7 / 2`, 3.5},
+		{"string arithmetic", `return {"10" + 1, "0x10" * 1, " 2 " ^ 2, -"3"}`, arr{float64(11), float64(16), float64(4), float64(-3)}},
+		{"comparisons", `return {1 < 2, 2 <= 2, "a" < "b", "10" < "9", 3 > 2, 2 >= 3}`, arr{true, true, true, true, true, false}},
+		{"equality", `local t = {} return {1 == 1.0, "1" == 1, t == t, {} == {}, nil == false, 0 == -0}`, arr{true, false, true, false, false, true}},
+		{"not equal", `return {1 ~= 2, "a" ~= "a"}`, arr{true, false}},
+		{"truthiness", `return {not nil, not false, not 0, not "", 0 and "zero", nil or false}`, arr{true, true, false, false, "zero", false}},
+		{"short circuit", `local n = 0 local function f() n = n + 1 return true end local _ = false and f() local _ = true or f() return n`, float64(0)},
+		{"length", `return {#"abc", #{1, 2, 3}, #{}, #{n = 1}}`, arr{float64(3), float64(3), float64(0), float64(0)}},
+		{"length after removing the last", `local t = {1, 2, 3} t[3] = nil return #t`, float64(2)},
+		{"length after filling a hole", `local t = {} t[3] = 3 t[1] = 1 t[2] = 2 return #t`, float64(3)},
+		{"concat numbers", `return 1 .. "" .. 2.5 .. -3 .. 1e20`, "12.5-31e+20"},
+		{"integer keys", `local t = {} t[1] = "a" t[1.0] = "b" t["1"] = "c" return {t[1], t["1"]}`, arr{"b", "c"}},
+		{"zero keys", `local t = {} t[0] = "z" return t[-0]`, "z"},
+		{"table constructor order", `return {[1] = "a", "b"}`, arr{"b"}},
+
+		// builtins
+		{"tostring", `return {tostring(nil), tostring(true), tostring(1), tostring(1.5), tostring("s")}`, arr{"nil", "true", "1", "1.5", "s"}},
+		{"tonumber", `return {tonumber("12"), tonumber(" 0x1F "), tonumber("1e2"), tonumber("z") == nil, tonumber(nil) == nil}`, arr{float64(12), float64(31), float64(100), true, true}},
+		{"tonumber in a base", `return {tonumber("ff", 16), tonumber("-101", 2), tonumber("zz", 36), tonumber("9", 8) == nil, tonumber(17, 10)}`, arr{float64(255), float64(-5), float64(1295), true, float64(17)}},
+		{"type", `return {type(nil), type(1), type("s"), type({}), type(print), type(type), type(true)}`, arr{"nil", "number", "string", "table", "nil", "function", "boolean"}},
+		{"assert passes its arguments", `local a, b = assert(1, "m") return {a, b}`, arr{float64(1), "m"}},
+		{"string.sub", `local s = "hello" return {s:sub(2), s:sub(-3), s:sub(2, -2), s:sub(0), s:sub(10), s:sub(3, 2), s:sub(-10, 2)}`, arr{"ello", "llo", "ell", "hello", "", "", "he"}},
+		{"string.find", `local s = "a.b.c" return {s:find("."), s:find(".", 3), s:find(".", -2), s:find("x") == nil, s:find("", 10) == nil}`, arr{float64(2), float64(4), float64(4), true, true}},
+		{"string.rep", `return {("ab"):rep(3), ("ab"):rep(3, ","), ("x"):rep(0), ("x"):rep(-1), (""):rep(5, "-")}`, arr{"ababab", "ab,ab,ab", "", "", "----"}},
+		{"string.len lower upper", `return string.len("abc") .. string.lower("AbC") .. string.upper("x")`, "3abcX"},
+		{"table.insert", `local t = {} table.insert(t, "b") table.insert(t, 1, "a") table.insert(t, 3, "c") return t`, arr{"a", "b", "c"}},
+		{"table.remove", `local t = {1, 2, 3, 4} local a = table.remove(t) local b = table.remove(t, 1) return {a, b, t[1], t[2], #t}`, arr{float64(4), float64(1), float64(2), float64(3), float64(2)}},
+		{"table.remove of empty", `local t = {} return table.remove(t) == nil and #t == 0`, true},
+		{"table.concat", `local t = {1, "b", 3} return {table.concat(t), table.concat(t, "-"), table.concat(t, ",", 2), table.concat(t, ",", 2, 2), table.concat(t, ",", 3, 2)}`, arr{"1b3", "1-b-3", "b,3", "b", ""}},
+		{"math", `return {math.floor(-1.5), math.ceil(1.2), math.abs(-3), math.max(1, 5, 3), math.min(4, -2, 8)}`, arr{float64(-2), float64(2), float64(3), float64(5), float64(-2)}},
+		{"pairs skips deleted fields", `
+			local t = {a = 1, b = 2, c = 3}
+			local seen = {}
+			for k in pairs(t) do seen[#seen+1] = k t.b = nil end
+			return table.concat(seen)`, "ac"},
+		{"pairs sees updated fields", `local t = {a = 1, b = 2} for k, v in pairs(t) do t.b = 20 end local s = 0 for _, v in pairs(t) do s = s + v end return s`, float64(21)},
+		{"KEYS and ARGV", `return {KEYS[1], KEYS[2], #KEYS, ARGV[1], #ARGV}`, arr{"k1", "k2", float64(2), "a1", float64(1)}},
+
+		// results
+		{"nested result", `return {a = {1, {b = true}}, c = "x"}`, obj{"a": arr{float64(1), obj{"b": true}}, "c": "x"}},
+		{"mixed keys are an object", `return {1, 2, x = 3}`, obj{"1": float64(1), "2": float64(2), "x": float64(3)}},
+		{"sparse array is an object", `return {[1] = 1, [3] = 3}`, obj{"1": float64(1), "3": float64(3)}},
+		{"boolean keys", `return {[true] = 1}`, obj{"true": float64(1)}},
+		{"only the first result", `return 1, 2`, float64(1)},
+		{"no result", `local x = 1`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := run(tt.src)
+			if err != nil {
+				t.Fatalf("Run() = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Run() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRun_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"break outside a loop", "break", "break outside a loop"},
+		{"break in a function", "local function f()\n break\nend\nfor i = 1, 2 do f() end", "line 1: break outside a loop"},
+		{"call of a number", "local x = 1\nx()", "line 2: attempt to call a number value"},
+		{"index of a boolean", "return (true).x", "line 1: attempt to index a boolean value"},
+		{"assign to a field of nil", "local t\nt.x = 1", "line 2: attempt to index a nil value"},
+		{"method of a number", "return (5):m()", "line 1: attempt to index a number value"},
+		{"nil table index", "local t = {} t[nil] = 1", "line 1: table index is nil"},
+		{"NaN table index", "local t = {} t[0/0] = 1", "line 1: table index is NaN"},
+		{"nil key in a constructor", "return {[nil] = 1}", "line 1: table index is nil"},
+		{"arithmetic on a table", "return {} + 1", "line 1: attempt to perform arithmetic on a table value"},
+		{"arithmetic on a bad string", "return 1 + 'x'", "line 1: attempt to perform arithmetic on a string value"},
+		{"negate a boolean", "return -true", "line 1: attempt to perform arithmetic on a boolean value"},
+		{"length of a number", "return #5", "line 1: attempt to get length of a number value"},
+		{"concat a table", "return 'a' .. {}", "line 1: attempt to concatenate a table value"},
+		{"concat nil", "return nil .. 'a'", "line 1: attempt to concatenate a nil value"},
+		{"compare mixed", "return {} < {}", "line 1: attempt to compare table with table"},
+		{"compare number with nil", "return 1 >= nil", "line 1: attempt to compare nil with number"},
+		{"for without numbers", "for i = 'a', 2 do end", "line 1: 'for' initial value must be a number"},
+		{"for limit", "for i = 1, {} do end", "line 1: 'for' limit must be a number"},
+		{"for zero step", "for i = 1, 2, 0 do end", "line 1: 'for' step is zero"},
+		{"generic for over nil", "for k in nil do end", "line 1: attempt to call a nil value"},
+		{"pairs of nil", "for k in pairs(nil) do end", "line 1: bad argument #1 to 'pairs' (table expected, got nil)"},
+		{"error message", "\n\nerror('boom')", "line 3: boom"},
+		{"error with a number", "error(42)", "line 1: 42"},
+		{"assert", "assert(false)", "line 1: assertion failed!"},
+		{"assert message", "assert(nil, 'need x')", "line 1: need x"},
+		{"type without a value", "type()", "line 1: bad argument #1 to 'type' (value expected)"},
+		{"tonumber base", "tonumber('1', 99)", "line 1: bad argument #2 to 'tonumber' (base out of range)"},
+		{"fractional argument", "string.sub('abc', 1.5)", "line 1: bad argument #2 to 'sub' (number has no integer representation)"},
+		{"insert out of bounds", "table.insert({}, 5, 1)", "line 1: bad argument #2 to 'insert' (position out of bounds)"},
+		{"remove out of bounds", "table.remove({1}, 5)", "line 1: bad argument #2 to 'remove' (position out of bounds)"},
+		{"concat of a table", "table.concat({{}})", "line 1: invalid value (at index 1) in table for 'concat'"},
+		{"db.set without a value", "db.set('t', 'k', 'c')", "line 1: bad argument #4 to 'set' (string expected, got nil)"},
+		{"db.get of a table key", "db.get('t', {}, 'c')", "line 1: bad argument #2 to 'get' (string expected, got table)"},
+		{"missing library function", "string.format('%d', 1)", "line 1: attempt to call a nil value"},
+		{"no os library", "return os.time()", "line 1: attempt to index a nil value"},
+		{"steps in a recursion", "local function f(n) return f(n + 1) end return f(1)", "line 1: stack overflow"},
+		{"steps in a loop", "local n = 0 repeat n = n + 1 until false", "line 1: script exceeded its budget of 1000000 steps"},
+		{"rep with a separator too long", "return ('x'):rep(600000, 'y')", "line 1: string longer than 1048576 bytes"},
+		{"cyclic result", "local t = {} t.t = t return t", "result nests tables deeper than 32"},
+		{"function key", "return {[print or type] = 1}", "result has a function key, which isn't a JSON object key"},
+		{"NaN result", "return 0/0", "result holds nan, which isn't a JSON number"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := run(tt.src)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("Run() = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestRun_Deterministic runs scripts whose results would depend on map
+// iteration or on addresses if they weren't ordered.
+func TestRun_Deterministic(t *testing.T) {
+	src := `
+		local t = {}
+		for i = 1, 50 do t["k" .. i] = i t[i * 1.5] = i t[{}] = i end
+		local out = {}
+		for k, v in pairs(t) do out[#out+1] = tostring(k) .. "=" .. v end
+		return table.concat(out, ",")`
+	first, err := run(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(first.(string), "1.5=1,3=2,") {
+		t.Errorf("pairs order starts %.20s, want numbers first in order", first)
+	}
+	for i := 0; i < 20; i++ {
+		got, err := run(src)
+		if err != nil || got != first {
+			t.Fatalf("run %d = %.40v, %v, want %.40v", i, got, err, first)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package script
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// tokKind is the kind of a token.
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokName
+	tokNumber
+	tokString
+	tokKeyword
+	tokOp
+)
+
+// token is a lexed token, val holds names, keywords, operators and string
+// values, num numbers.
+type token struct {
+	kind tokKind
+	val  string
+	num  float64
+	line int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of script"
+	case tokNumber:
+		return formatNumber(t.num)
+	case tokString:
+		return strconv.Quote(t.val)
+	}
+	return "'" + t.val + "'"
+}
+
+var keywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "if": true,
+	"in": true, "local": true, "nil": true, "not": true, "or": true,
+	"repeat": true, "return": true, "then": true, "true": true, "until": true,
+	"while": true,
+}
+
+// operators are the operator tokens, longest first.
+var operators = []string{
+	"...", "..", "==", "~=", "<=", ">=", "//",
+	"+", "-", "*", "/", "%", "^", "#", "<", ">", "=",
+	"(", ")", "{", "}", "[", "]", ";", ":", ",", ".",
+}
+
+// lex splits a script into tokens, ending with a tokEOF one.
+func lex(src string) ([]token, error) {
+	var toks []token
+	line := 1
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case strings.HasPrefix(src[i:], "--"):
+			if level, ok := longBracket(src[i+2:]); ok {
+				end, lines, err := closeLongBracket(src, i+2, level, line)
+				if err != nil {
+					return nil, err
+				}
+				i, line = end, line+lines
+				continue
+			}
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case isLetter(c):
+			j := i
+			for j < len(src) && (isLetter(src[j]) || isDigit(src[j])) {
+				j++
+			}
+			kind := tokName
+			if keywords[src[i:j]] {
+				kind = tokKeyword
+			}
+			toks = append(toks, token{kind: kind, val: src[i:j], line: line})
+			i = j
+		case isDigit(c) || (c == '.' && i+1 < len(src) && isDigit(src[i+1])):
+			j := i
+			for j < len(src) && (isLetter(src[j]) || isDigit(src[j]) || src[j] == '.' ||
+				((src[j] == '+' || src[j] == '-') && (src[j-1] == 'e' || src[j-1] == 'E') && !strings.HasPrefix(src[i:], "0x"))) {
+				j++
+			}
+			n, ok := parseNumber(src[i:j])
+			if !ok {
+				return nil, &Error{Line: line, Msg: fmt.Sprintf("malformed number %q", src[i:j])}
+			}
+			toks = append(toks, token{kind: tokNumber, num: n, line: line})
+			i = j
+		case c == '"' || c == '\'':
+			s, end, err := lexString(src, i, line)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{kind: tokString, val: s, line: line})
+			i = end
+		case c == '[':
+			if level, ok := longBracket(src[i:]); ok {
+				start := i + level + 2
+				end, lines, err := closeLongBracket(src, i, level, line)
+				if err != nil {
+					return nil, err
+				}
+				s := src[start : end-level-2]
+				// a newline right after the opening bracket is skipped.
+				s = strings.TrimPrefix(strings.TrimPrefix(s, "\r"), "\n")
+				toks = append(toks, token{kind: tokString, val: s, line: line})
+				i, line = end, line+lines
+				continue
+			}
+			toks = append(toks, token{kind: tokOp, val: "[", line: line})
+			i++
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, &Error{Line: line, Msg: fmt.Sprintf("unexpected character %q", c)}
+			}
+			toks = append(toks, token{kind: tokOp, val: op, line: line})
+			i += len(op)
+		}
+	}
+	return append(toks, token{kind: tokEOF, line: line}), nil
+}
+
+func isLetter(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// longBracket reports whether s opens a long bracket, [[ or [=*[, and its
+// level.
+func longBracket(s string) (int, bool) {
+	if !strings.HasPrefix(s, "[") {
+		return 0, false
+	}
+	level := 1
+	for level < len(s) && s[level] == '=' {
+		level++
+	}
+	if level < len(s) && s[level] == '[' {
+		return level - 1, true
+	}
+	return 0, false
+}
+
+// closeLongBracket returns the end of the long bracket of level opening at
+// src[start], and the newlines it spans.
+func closeLongBracket(src string, start, level, line int) (int, int, error) {
+	closing := "]" + strings.Repeat("=", level) + "]"
+	body := start + level + 2
+	j := strings.Index(src[body:], closing)
+	if j < 0 {
+		return 0, 0, &Error{Line: line, Msg: "unfinished long string or comment"}
+	}
+	end := body + j + len(closing)
+	return end, strings.Count(src[start:end], "\n"), nil
+}
+
+func lexString(src string, i, line int) (string, int, error) {
+	quote := src[i]
+	var b strings.Builder
+	for j := i + 1; j < len(src); j++ {
+		c := src[j]
+		switch {
+		case c == quote:
+			return b.String(), j + 1, nil
+		case c == '\n':
+			return "", 0, &Error{Line: line, Msg: "unfinished string"}
+		case c == '\\' && j+1 < len(src):
+			j++
+			switch e := src[j]; e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '0':
+				b.WriteByte(0)
+			case '\\', '"', '\'':
+				b.WriteByte(e)
+			default:
+				return "", 0, &Error{Line: line, Msg: fmt.Sprintf("invalid escape \\%c", e)}
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, &Error{Line: line, Msg: "unfinished string"}
+}
+
+// parseNumber parses a decimal or hexadecimal number literal, or a string
+// converted to a number.
+func parseNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		n, err := strconv.ParseUint(s[2:], 16, 64)
+		return float64(n), err == nil
+	}
+	if s == "" || strings.ContainsAny(s, "xXpP_") {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	// inf and nan aren't numbers, neither are literals overflowing.
+	return n, err == nil && !math.IsInf(n, 0) && !math.IsNaN(n)
+}
@@ -0,0 +1,774 @@
+package script
+
+import "fmt"
+
+// The syntax tree.  Expressions and statements keep the line they start on
+// for errors.
+type (
+	expr interface{ exprLine() int }
+	stmt interface{ stmtLine() int }
+
+	block struct {
+		stmts []stmt
+	}
+
+	constExpr struct {
+		val  value
+		line int
+	}
+	nameExpr struct {
+		name string
+		line int
+	}
+	indexExpr struct {
+		obj, key expr
+		line     int
+	}
+	callExpr struct {
+		fn   expr
+		args []expr
+		line int
+	}
+	// methodExpr is obj:name(args), obj.name(obj, args) evaluating obj once.
+	methodExpr struct {
+		obj  expr
+		name string
+		args []expr
+		line int
+	}
+	funcExpr struct {
+		name   string
+		params []string
+		body   *block
+		line   int
+	}
+	binExpr struct {
+		op   string
+		l, r expr
+		line int
+	}
+	unExpr struct {
+		op   string
+		e    expr
+		line int
+	}
+	tableExpr struct {
+		items []tableItem
+		line  int
+	}
+	// tableItem is a field of a table constructor, key is nil for
+	// positional ones.
+	tableItem struct {
+		key, val expr
+	}
+
+	localStmt struct {
+		names []string
+		exprs []expr
+		line  int
+	}
+	localFuncStmt struct {
+		fn   *funcExpr
+		line int
+	}
+	assignStmt struct {
+		targets []expr
+		exprs   []expr
+		line    int
+	}
+	callStmt struct {
+		call expr
+		line int
+	}
+	doStmt struct {
+		body *block
+		line int
+	}
+	whileStmt struct {
+		cond expr
+		body *block
+		line int
+	}
+	repeatStmt struct {
+		body *block
+		cond expr
+		line int
+	}
+	ifStmt struct {
+		conds  []expr
+		blocks []*block
+		els    *block
+		line   int
+	}
+	numForStmt struct {
+		name              string
+		start, stop, step expr
+		body              *block
+		line              int
+	}
+	genForStmt struct {
+		names []string
+		exprs []expr
+		body  *block
+		line  int
+	}
+	returnStmt struct {
+		exprs []expr
+		line  int
+	}
+	breakStmt struct {
+		line int
+	}
+)
+
+func (e *constExpr) exprLine() int  { return e.line }
+func (e *nameExpr) exprLine() int   { return e.line }
+func (e *indexExpr) exprLine() int  { return e.line }
+func (e *callExpr) exprLine() int   { return e.line }
+func (e *methodExpr) exprLine() int { return e.line }
+func (e *funcExpr) exprLine() int   { return e.line }
+func (e *binExpr) exprLine() int    { return e.line }
+func (e *unExpr) exprLine() int     { return e.line }
+func (e *tableExpr) exprLine() int  { return e.line }
+
+func (s *localStmt) stmtLine() int     { return s.line }
+func (s *localFuncStmt) stmtLine() int { return s.line }
+func (s *assignStmt) stmtLine() int    { return s.line }
+func (s *callStmt) stmtLine() int      { return s.line }
+func (s *doStmt) stmtLine() int        { return s.line }
+func (s *whileStmt) stmtLine() int     { return s.line }
+func (s *repeatStmt) stmtLine() int    { return s.line }
+func (s *ifStmt) stmtLine() int        { return s.line }
+func (s *numForStmt) stmtLine() int    { return s.line }
+func (s *genForStmt) stmtLine() int    { return s.line }
+func (s *returnStmt) stmtLine() int    { return s.line }
+func (s *breakStmt) stmtLine() int     { return s.line }
+
+// binaryPriority are the left and right priorities of the binary operators,
+// a right one lower than the left makes the operator right associative.
+var binaryPriority = map[string][2]int{
+	"or":  {1, 1},
+	"and": {2, 2},
+	"<":   {3, 3},
+	">":   {3, 3},
+	"<=":  {3, 3},
+	">=":  {3, 3},
+	"~=":  {3, 3},
+	"==":  {3, 3},
+	"..":  {5, 4},
+	"+":   {6, 6},
+	"-":   {6, 6},
+	"*":   {7, 7},
+	"/":   {7, 7},
+	"//":  {7, 7},
+	"%":   {7, 7},
+	"^":   {10, 9},
+}
+
+// unaryPriority binds tighter than every binary operator but ^.
+const unaryPriority = 8
+
+// maxNesting bounds the nesting of blocks and expressions, counting every
+// operator and suffix of an expression, so neither the parser nor a run
+// recurses without bounds.
+const maxNesting = 200
+
+type parser struct {
+	toks  []token
+	pos   int
+	level int
+}
+
+// parse parses a script into the block of its main chunk.
+func parse(src string) (*block, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	b, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+	return b, nil
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// is reports whether the next token is the keyword or operator s.
+func (p *parser) is(s string) bool {
+	t := p.peek()
+	return (t.kind == tokKeyword || t.kind == tokOp) && t.val == s
+}
+
+// accept consumes the next token when it is the keyword or operator s.
+func (p *parser) accept(s string) bool {
+	if p.is(s) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(s string) error {
+	if t := p.peek(); !p.accept(s) {
+		return p.errorf(t, "'%s' expected near %s", s, t)
+	}
+	return nil
+}
+
+func (p *parser) name() (string, error) {
+	t := p.next()
+	if t.kind != tokName {
+		return "", p.errorf(t, "name expected near %s", t)
+	}
+	return t.val, nil
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return &Error{Line: t.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// enter enters a level of nesting, at t.
+func (p *parser) enter(t token) error {
+	p.level++
+	if p.level > maxNesting {
+		return p.errorf(t, "script nests more than %d levels deep", maxNesting)
+	}
+	return nil
+}
+
+// blockEnd reports whether the next token ends a block.
+func (p *parser) blockEnd() bool {
+	return p.peek().kind == tokEOF || p.is("end") || p.is("else") || p.is("elseif") || p.is("until")
+}
+
+func (p *parser) block() (*block, error) {
+	if err := p.enter(p.peek()); err != nil {
+		return nil, err
+	}
+	defer func() { p.level-- }()
+	b := &block{}
+	for !p.blockEnd() {
+		if p.accept(";") {
+			continue
+		}
+		if p.is("return") {
+			s, err := p.returnStmt()
+			if err != nil {
+				return nil, err
+			}
+			b.stmts = append(b.stmts, s)
+			p.accept(";")
+			if !p.blockEnd() {
+				t := p.peek()
+				return nil, p.errorf(t, "'end' expected after return near %s", t)
+			}
+			break
+		}
+		s, err := p.stmt()
+		if err != nil {
+			return nil, err
+		}
+		b.stmts = append(b.stmts, s)
+	}
+	return b, nil
+}
+
+func (p *parser) returnStmt() (stmt, error) {
+	t := p.next()
+	s := &returnStmt{line: t.line}
+	if p.blockEnd() || p.is(";") {
+		return s, nil
+	}
+	exprs, err := p.exprList()
+	if err != nil {
+		return nil, err
+	}
+	s.exprs = exprs
+	return s, nil
+}
+
+func (p *parser) stmt() (stmt, error) {
+	t := p.peek()
+	switch {
+	case p.accept("local"):
+		if p.accept("function") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			fn, err := p.funcBody(name, t.line)
+			if err != nil {
+				return nil, err
+			}
+			return &localFuncStmt{fn: fn, line: t.line}, nil
+		}
+		names, err := p.nameList()
+		if err != nil {
+			return nil, err
+		}
+		s := &localStmt{names: names, line: t.line}
+		if p.accept("=") {
+			if s.exprs, err = p.exprList(); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	case p.accept("function"):
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		var target expr = &nameExpr{name: name, line: t.line}
+		for p.accept(".") {
+			field, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			target = &indexExpr{obj: target, key: &constExpr{val: field, line: t.line}, line: t.line}
+			name += "." + field
+		}
+		// function a:m() is function a.m(self).
+		method := p.accept(":")
+		if method {
+			field, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			target = &indexExpr{obj: target, key: &constExpr{val: field, line: t.line}, line: t.line}
+			name += ":" + field
+		}
+		fn, err := p.funcBody(name, t.line)
+		if err != nil {
+			return nil, err
+		}
+		if method {
+			fn.params = append([]string{"self"}, fn.params...)
+		}
+		return &assignStmt{targets: []expr{target}, exprs: []expr{fn}, line: t.line}, nil
+	case p.accept("do"):
+		body, err := p.blockUntil("end")
+		if err != nil {
+			return nil, err
+		}
+		return &doStmt{body: body, line: t.line}, nil
+	case p.accept("while"):
+		cond, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("do"); err != nil {
+			return nil, err
+		}
+		body, err := p.blockUntil("end")
+		if err != nil {
+			return nil, err
+		}
+		return &whileStmt{cond: cond, body: body, line: t.line}, nil
+	case p.accept("repeat"):
+		body, err := p.blockUntil("until")
+		if err != nil {
+			return nil, err
+		}
+		cond, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+		return &repeatStmt{body: body, cond: cond, line: t.line}, nil
+	case p.accept("if"):
+		return p.ifStmt(t.line)
+	case p.accept("for"):
+		return p.forStmt(t.line)
+	case p.accept("break"):
+		return &breakStmt{line: t.line}, nil
+	}
+	return p.exprStmt()
+}
+
+// blockUntil parses a block closed by the keyword end.
+func (p *parser) blockUntil(end string) (*block, error) {
+	b, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	return b, p.expect(end)
+}
+
+func (p *parser) ifStmt(line int) (stmt, error) {
+	s := &ifStmt{line: line}
+	for {
+		cond, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("then"); err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		s.conds, s.blocks = append(s.conds, cond), append(s.blocks, body)
+		if p.accept("elseif") {
+			continue
+		}
+		if p.accept("else") {
+			if s.els, err = p.block(); err != nil {
+				return nil, err
+			}
+		}
+		return s, p.expect("end")
+	}
+}
+
+func (p *parser) forStmt(line int) (stmt, error) {
+	names, err := p.nameList()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 1 && p.accept("=") {
+		s := &numForStmt{name: names[0], line: line}
+		if s.start, err = p.expr(0); err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		if s.stop, err = p.expr(0); err != nil {
+			return nil, err
+		}
+		if p.accept(",") {
+			if s.step, err = p.expr(0); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.expect("do"); err != nil {
+			return nil, err
+		}
+		if s.body, err = p.blockUntil("end"); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	if err := p.expect("in"); err != nil {
+		return nil, err
+	}
+	s := &genForStmt{names: names, line: line}
+	if s.exprs, err = p.exprList(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("do"); err != nil {
+		return nil, err
+	}
+	if s.body, err = p.blockUntil("end"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// exprStmt parses an assignment or a function call.
+func (p *parser) exprStmt() (stmt, error) {
+	t := p.peek()
+	e, err := p.suffixedExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.is("=") || p.is(",") {
+		targets := []expr{e}
+		for p.accept(",") {
+			target, err := p.suffixedExpr()
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, target)
+		}
+		for _, target := range targets {
+			switch target.(type) {
+			case *nameExpr, *indexExpr:
+			default:
+				return nil, p.errorf(t, "cannot assign to this expression")
+			}
+		}
+		if err := p.expect("="); err != nil {
+			return nil, err
+		}
+		exprs, err := p.exprList()
+		if err != nil {
+			return nil, err
+		}
+		return &assignStmt{targets: targets, exprs: exprs, line: t.line}, nil
+	}
+	switch e.(type) {
+	case *callExpr, *methodExpr:
+		return &callStmt{call: e, line: t.line}, nil
+	}
+	return nil, p.errorf(t, "syntax error near %s", p.peek())
+}
+
+func (p *parser) nameList() ([]string, error) {
+	var names []string
+	for {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.accept(",") {
+			return names, nil
+		}
+	}
+}
+
+func (p *parser) exprList() ([]expr, error) {
+	var exprs []expr
+	for {
+		e, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+		if !p.accept(",") {
+			return exprs, nil
+		}
+	}
+}
+
+// expr parses an expression of binary operators whose left priority is
+// above limit.
+func (p *parser) expr(limit int) (expr, error) {
+	levels := 0
+	defer func() { p.level -= levels }()
+	var left expr
+	t := p.peek()
+	levels++
+	if err := p.enter(t); err != nil {
+		return nil, err
+	}
+	if (t.kind == tokKeyword && t.val == "not") || (t.kind == tokOp && (t.val == "-" || t.val == "#")) {
+		p.next()
+		e, err := p.expr(unaryPriority)
+		if err != nil {
+			return nil, err
+		}
+		left = &unExpr{op: t.val, e: e, line: t.line}
+	} else {
+		var err error
+		if left, err = p.simpleExpr(); err != nil {
+			return nil, err
+		}
+	}
+	for {
+		t := p.peek()
+		prio, ok := binaryPriority[t.val]
+		if !ok || (t.kind != tokOp && t.kind != tokKeyword) || prio[0] <= limit {
+			return left, nil
+		}
+		p.next()
+		levels++
+		if err := p.enter(t); err != nil {
+			return nil, err
+		}
+		right, err := p.expr(prio[1])
+		if err != nil {
+			return nil, err
+		}
+		left = &binExpr{op: t.val, l: left, r: right, line: t.line}
+	}
+}
+
+func (p *parser) simpleExpr() (expr, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokNumber:
+		p.next()
+		return &constExpr{val: t.num, line: t.line}, nil
+	case t.kind == tokString:
+		p.next()
+		return &constExpr{val: t.val, line: t.line}, nil
+	case p.accept("nil"):
+		return &constExpr{line: t.line}, nil
+	case p.accept("true"):
+		return &constExpr{val: true, line: t.line}, nil
+	case p.accept("false"):
+		return &constExpr{val: false, line: t.line}, nil
+	case p.accept("function"):
+		return p.funcBody("", t.line)
+	case p.is("{"):
+		return p.tableConstructor()
+	case p.is("..."):
+		return nil, p.errorf(t, "varargs aren't supported")
+	}
+	return p.suffixedExpr()
+}
+
+// suffixedExpr parses a name or parenthesized expression followed by field
+// accesses and calls.
+func (p *parser) suffixedExpr() (expr, error) {
+	levels := 0
+	defer func() { p.level -= levels }()
+	t := p.peek()
+	var e expr
+	switch {
+	case t.kind == tokName:
+		p.next()
+		e = &nameExpr{name: t.val, line: t.line}
+	case p.accept("("):
+		inner, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		// parentheses truncate a call's results to one, see callExpr.
+		e = &binExpr{op: "()", l: inner, line: t.line}
+	default:
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+	for {
+		t := p.peek()
+		if p.is(".") || p.is("[") || p.is(":") || p.is("(") || p.is("{") || t.kind == tokString {
+			levels++
+			if err := p.enter(t); err != nil {
+				return nil, err
+			}
+		}
+		switch {
+		case p.accept("."):
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			e = &indexExpr{obj: e, key: &constExpr{val: name, line: t.line}, line: t.line}
+		case p.accept("["):
+			key, err := p.expr(0)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			e = &indexExpr{obj: e, key: key, line: t.line}
+		case p.accept(":"):
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			args, err := p.callArgs()
+			if err != nil {
+				return nil, err
+			}
+			e = &methodExpr{obj: e, name: name, args: args, line: t.line}
+		case p.is("(") || p.is("{") || t.kind == tokString:
+			args, err := p.callArgs()
+			if err != nil {
+				return nil, err
+			}
+			e = &callExpr{fn: e, args: args, line: t.line}
+		default:
+			return e, nil
+		}
+	}
+}
+
+// callArgs parses the arguments of a call: a parenthesized list, a table
+// constructor or a string.
+func (p *parser) callArgs() ([]expr, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokString:
+		p.next()
+		return []expr{&constExpr{val: t.val, line: t.line}}, nil
+	case p.is("{"):
+		e, err := p.tableConstructor()
+		if err != nil {
+			return nil, err
+		}
+		return []expr{e}, nil
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	if p.accept(")") {
+		return nil, nil
+	}
+	args, err := p.exprList()
+	if err != nil {
+		return nil, err
+	}
+	return args, p.expect(")")
+}
+
+func (p *parser) funcBody(name string, line int) (*funcExpr, error) {
+	fn := &funcExpr{name: name, line: line}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	if !p.accept(")") {
+		params, err := p.nameList()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		fn.params = params
+	}
+	body, err := p.blockUntil("end")
+	if err != nil {
+		return nil, err
+	}
+	fn.body = body
+	return fn, nil
+}
+
+func (p *parser) tableConstructor() (expr, error) {
+	t := p.next() // {
+	e := &tableExpr{line: t.line}
+	for !p.accept("}") {
+		var item tableItem
+		switch {
+		case p.accept("["):
+			key, err := p.expr(0)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			if err := p.expect("="); err != nil {
+				return nil, err
+			}
+			item.key = key
+		case p.peek().kind == tokName && p.toks[p.pos+1].kind == tokOp && p.toks[p.pos+1].val == "=":
+			name := p.next()
+			p.next()
+			item.key = &constExpr{val: name.val, line: name.line}
+		}
+		val, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+		item.val = val
+		e.items = append(e.items, item)
+		if !p.accept(",") && !p.accept(";") {
+			if err := p.expect("}"); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return e, nil
+}
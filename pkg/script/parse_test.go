@@ -0,0 +1,314 @@
+package script
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLex(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"x = 1", "x '=' 1"},
+		{"local_1 and_ andx", "local_1 and_ andx"},
+		{"3 3.0 3.1416 314.16e-2 0.31416E1 .5 0xff 0XA 1e2", "3 3 3.1416 3.1416 3.1416 0.5 255 10 100"},
+		{`'a\n\t\\"' "it's" "\0"`, `"a\n\t\\\"" "it's" "\x00"`},
+		{"[[\nline]] [==[a]]b]==]", `"line" "a]]b"`},
+		{"a..b...c//d", "a '..' b '...' c '//' d"},
+		{"a ~= b <= c >= d == e", "a '~=' b '<=' c '>=' d '==' e"},
+		{"-- comment\nx --[[ long\ncomment ]] y --[==[ ]] ]==] z", "x y z"},
+		{"a.b:c[d]", "a '.' b ':' c '[' d ']'"},
+	}
+	for _, tt := range tests {
+		toks, err := lex(tt.src)
+		if err != nil {
+			t.Errorf("lex(%q) = %v", tt.src, err)
+			continue
+		}
+		var got []string
+		for _, tok := range toks[:len(toks)-1] {
+			got = append(got, strings.Trim(tok.String(), "'"))
+			if tok.kind == tokOp {
+				got[len(got)-1] = tok.String()
+			}
+		}
+		if s := strings.Join(got, " "); s != tt.want {
+			t.Errorf("lex(%q) = %s, want %s", tt.src, s, tt.want)
+		}
+	}
+}
+
+func TestLex_Lines(t *testing.T) {
+	toks, err := lex("a\n[[x\ny]] b --[[\n\n]] c\r\nd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []int
+	for _, tok := range toks {
+		lines = append(lines, tok.line)
+	}
+	if got := fmt.Sprint(lines); got != "[1 2 3 5 6 6]" {
+		t.Errorf("token lines = %s, want [1 2 3 5 6 6]", got)
+	}
+}
+
+func TestLex_Errors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"x = 1.2.3", "line 1: malformed number \"1.2.3\""},
+		{"x = 3x", "line 1: malformed number \"3x\""},
+		{"x = 0xg", "line 1: malformed number \"0xg\""},
+		{"x = 1e999", "line 1: malformed number \"1e999\""},
+		{"\nx = 'a\nb'", "line 2: unfinished string"},
+		{`x = "\q"`, `line 1: invalid escape \q`},
+		{"x = [[abc", "line 1: unfinished long string or comment"},
+		{"--[==[ x ]]", "line 1: unfinished long string or comment"},
+		{"x = @", "line 1: unexpected character '@'"},
+		{"x = a ! b", "line 1: unexpected character '!'"},
+	}
+	for _, tt := range tests {
+		_, err := lex(tt.src)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("lex(%q) = %v, want %s", tt.src, err, tt.want)
+		}
+	}
+}
+
+func TestParseNumber(t *testing.T) {
+	tests := []struct {
+		s    string
+		want float64
+		ok   bool
+	}{
+		{"10", 10, true},
+		{" 10 ", 10, true},
+		{"-2.5", -2.5, true},
+		{"0x10", 16, true},
+		{"1e3", 1000, true},
+		{"", 0, false},
+		{"abc", 0, false},
+		{"1_000", 0, false},
+		{"inf", 0, false},
+		{"nan", 0, false},
+		{"0x", 0, false},
+		{"1p3", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseNumber(tt.s)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("parseNumber(%q) = %v, %v, want %v, %v", tt.s, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// dump prints a syntax tree as s-expressions.
+func dump(n interface{}) string {
+	list := func(prefix string, items ...string) string {
+		return "(" + strings.Join(append([]string{prefix}, items...), " ") + ")"
+	}
+	exprs := func(es []expr) []string {
+		var out []string
+		for _, e := range es {
+			out = append(out, dump(e))
+		}
+		return out
+	}
+	switch n := n.(type) {
+	case nil:
+		return "-"
+	case *block:
+		var out []string
+		for _, s := range n.stmts {
+			out = append(out, dump(s))
+		}
+		return "[" + strings.Join(out, " ") + "]"
+	case *constExpr:
+		if s, ok := n.val.(string); ok {
+			return strconv.Quote(s)
+		}
+		return tostring(n.val)
+	case *nameExpr:
+		return n.name
+	case *indexExpr:
+		return list("index", dump(n.obj), dump(n.key))
+	case *callExpr:
+		return list("call", append([]string{dump(n.fn)}, exprs(n.args)...)...)
+	case *methodExpr:
+		return list("method", append([]string{dump(n.obj), n.name}, exprs(n.args)...)...)
+	case *funcExpr:
+		return list("function", n.name, "("+strings.Join(n.params, " ")+")", dump(n.body))
+	case *binExpr:
+		if n.op == "()" {
+			return list("paren", dump(n.l))
+		}
+		return list(n.op, dump(n.l), dump(n.r))
+	case *unExpr:
+		return list(n.op, dump(n.e))
+	case *tableExpr:
+		var out []string
+		for _, item := range n.items {
+			if item.key != nil {
+				out = append(out, dump(item.key)+"="+dump(item.val))
+			} else {
+				out = append(out, dump(item.val))
+			}
+		}
+		return "{" + strings.Join(out, " ") + "}"
+	case *localStmt:
+		return list("local", append([]string{"(" + strings.Join(n.names, " ") + ")"}, exprs(n.exprs)...)...)
+	case *localFuncStmt:
+		return list("local", dump(n.fn))
+	case *assignStmt:
+		return list("set", "("+strings.Join(exprs(n.targets), " ")+")", strings.Join(exprs(n.exprs), " "))
+	case *callStmt:
+		return dump(n.call)
+	case *doStmt:
+		return list("do", dump(n.body))
+	case *whileStmt:
+		return list("while", dump(n.cond), dump(n.body))
+	case *repeatStmt:
+		return list("repeat", dump(n.body), dump(n.cond))
+	case *ifStmt:
+		var out []string
+		for i := range n.conds {
+			out = append(out, dump(n.conds[i]), dump(n.blocks[i]))
+		}
+		if n.els != nil {
+			out = append(out, "else", dump(n.els))
+		}
+		return list("if", out...)
+	case *numForStmt:
+		return list("for", n.name, dump(n.start), dump(n.stop), dump(n.step), dump(n.body))
+	case *genForStmt:
+		return list("for", "("+strings.Join(n.names, " ")+")", "in", strings.Join(exprs(n.exprs), " "), dump(n.body))
+	case *returnStmt:
+		return list("return", exprs(n.exprs)...)
+	case *breakStmt:
+		return "break"
+	}
+	return fmt.Sprintf("?%T", n)
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"precedence", "return 1 + 2 * 3 - 4 / 5", "[(return (- (+ 1 (* 2 3)) (/ 4 5)))]"},
+		{"left associative", "return 1 - 2 - 3, 8 // 4 % 3", "[(return (- (- 1 2) 3) (% (// 8 4) 3))]"},
+		{"power right associative", "return 2 ^ 3 ^ 2", "[(return (^ 2 (^ 3 2)))]"},
+		{"concat right associative", "return a .. b .. c", "[(return (.. a (.. b c)))]"},
+		{"concat below arithmetic", "return a .. b + 1", "[(return (.. a (+ b 1)))]"},
+		{"unary", "return -x ^ 2, not a == b, #t + 1, - -x", "[(return (- (^ x 2)) (== (not a) b) (+ (# t) 1) (- (- x)))]"},
+		{"power of unary", "return 2 ^ -3", "[(return (^ 2 (- 3)))]"},
+		{"logic", "return a or b and c == d", "[(return (or a (and b (== c d))))]"},
+		{"comparisons", "return a < b == (c >= d)", "[(return (== (< a b) (paren (>= c d))))]"},
+		{"suffixes", `f(1)(2).x[y]:m "s" {3}`, `[(call (method (index (index (call (call f 1) 2) "x") y) m "s") {3})]`},
+		{"call styles", `f() f"s" f{} f(a, g())`, `[(call f) (call f "s") (call f {}) (call f a (call g))]`},
+		{"parenthesized call", "return (f())", "[(return (paren (call f)))]"},
+		{"table constructor", `return {1, x = 2; ["y"] = 3, f(), }`, `[(return {1 "x"=2 "y"=3 (call f)})]`},
+		{"nested tables", "return {{}, {a = {}}}", `[(return {{} {"a"={}}})]`},
+		{"locals", "local a, b = 1 local c", "[(local (a b) 1) (local (c))]"},
+		{"multiple assignment", "a, t[i], t.x = 1, 2", `[(set (a (index t i) (index t "x")) 1 2)]`},
+		{"function statements", "function f(a, b) end function t.a.b() end", `[(set (f) (function f (a b) [])) (set ((index (index t "a") "b")) (function t.a.b () []))]`},
+		{"method definition", "function t:m(x) return self end", `[(set ((index t "m")) (function t:m (self x) [(return self)]))]`},
+		{"local function", "local function f() return f end", "[(local (function f () [(return f)]))]"},
+		{"anonymous function", "return function(x) end", "[(return (function  (x) []))]"},
+		{"if chain", "if a then b() elseif c then elseif d then else e() end", "[(if a [(call b)] c [] d [] else [(call e)])]"},
+		{"loops", "while a do break end repeat local x until x do end", "[(while a [break]) (repeat [(local (x))] x) (do [])]"},
+		{"numeric for", "for i = 1, n do end for i = 10, 1, -1 do end", "[(for i 1 n - []) (for i 10 1 (- 1) [])]"},
+		{"generic for", "for k, v in pairs(t) do end", "[(for (k v) in (call pairs t) [])]"},
+		{"return", "do return end return;", "[(do [(return)]) (return)]"},
+		{"semicolons", ";;a = 1;;", "[(set (a) 1)]"},
+		{"constants", `return nil, true, false, 'x', 0x10`, `[(return nil true false "x" 16)]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := parse(tt.src)
+			if err != nil {
+				t.Fatalf("parse() = %v", err)
+			}
+			if got := dump(b); got != tt.want {
+				t.Errorf("parse() = %s\nwant       %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"x", "line 1: syntax error near end of script"},
+		{"x y", "line 1: syntax error near 'y'"},
+		{"f() = 1", "line 1: cannot assign to this expression"},
+		{"(a) = 1", "line 1: cannot assign to this expression"},
+		{"a, f() = 1, 2", "line 1: cannot assign to this expression"},
+		{"local 1 = 2", "line 1: name expected near 1"},
+		{"return 1 x = 2", "line 1: 'end' expected after return near 'x'"},
+		{"if a b end", "line 1: 'then' expected near 'b'"},
+		{"while a end", "line 1: 'do' expected near 'end'"},
+		{"repeat x = 1", "line 1: 'until' expected near end of script"},
+		{"for i = 1 do end", "line 1: ',' expected near 'do'"},
+		{"for a, b = 1, 2 do end", "line 1: 'in' expected near '='"},
+		{"for 1 in x do end", "line 1: name expected near 1"},
+		{"function f(1) end", "line 1: name expected near 1"},
+		{"function f(a b) end", "line 1: ')' expected near 'b'"},
+		{"function t:m:n() end", "line 1: '(' expected near ':'"},
+		{"x = {1 2}", "line 1: '}' expected near 2"},
+		{"x = {[1] 2}", "line 1: '=' expected near 2"},
+		{"x = t[1", "line 1: ']' expected near end of script"},
+		{"x = (1", "line 1: ')' expected near end of script"},
+		{"x = f(1,)", "line 1: unexpected ')'"},
+		{"x = ...", "line 1: varargs aren't supported"},
+		{"end", "line 1: unexpected 'end'"},
+		{"goto done", "line 1: syntax error near 'done'"},
+		{"::done::", "line 1: unexpected ':'"},
+		{"do\n\nx = = 1\nend", "line 3: unexpected '='"},
+		{"local function\nf(", "line 2: name expected near end of script"},
+	}
+	for _, tt := range tests {
+		_, err := parse(tt.src)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("parse(%q) = %v, want %s", tt.src, err, tt.want)
+		}
+	}
+}
+
+func TestParse_Nesting(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		ok   bool
+	}{
+		{"parentheses", "return " + strings.Repeat("(", 60) + "1" + strings.Repeat(")", 60), true},
+		{"deep parentheses", "return " + strings.Repeat("(", 250) + "1" + strings.Repeat(")", 250), false},
+		{"unary operators", "return " + strings.Repeat("- ", 250) + "1", false},
+		{"operator chain", "return 1" + strings.Repeat(" + 1", 250), false},
+		{"concat chain", "return 'a'" + strings.Repeat(" .. 'a'", 250), false},
+		{"suffix chain", "return t" + strings.Repeat(".x", 250), false},
+		{"call chain", "f" + strings.Repeat("()", 250), false},
+		{"blocks", strings.Repeat("do ", 250) + strings.Repeat("end ", 250), false},
+		{"tables", "return " + strings.Repeat("{", 250) + strings.Repeat("}", 250), false},
+		{"functions", strings.Repeat("function f() ", 250) + strings.Repeat("end ", 250), false},
+		{"long flat script", strings.Repeat("x = x + 1\n", 10000), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parse(tt.src)
+			if tt.ok && err != nil {
+				t.Errorf("parse() = %v", err)
+			}
+			if !tt.ok && (err == nil || !strings.Contains(err.Error(), "script nests more than 200 levels deep")) {
+				t.Errorf("parse() = %v, want it nesting too deep", err)
+			}
+		})
+	}
+}
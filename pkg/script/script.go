@@ -0,0 +1,155 @@
+// Package script runs the scripts of multi-key procedures: a subset of Lua,
+// without coroutines, metatables, varargs, goto or any library touching the
+// clock, randomness or I/O, so a script run on the same rows always does the
+// same thing.  Rows are read and written through a Host, see Script.Run, and
+// a run is bounded in steps, call depth, nesting and memory.
+//
+// It is an interpreter of its own rather than gopher-lua or goja as scripts
+// run on the leader, against its budget: those can only cancel a run by its
+// context, neither counts the steps of a run nor the memory it builds, and
+// their iteration orders and libraries would have to be pruned to keep runs
+// deterministic.  Numbers are float64s, integers exactly up to 2^53.
+package script
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	// MaxSteps bounds the statements, loop iterations and calls of a run.
+	MaxSteps = 1000000
+	// MaxDepth bounds the call depth of a run.
+	MaxDepth = 200
+	// MaxStringLen bounds the length of a string built by a run.
+	MaxStringLen = 1 << 20
+	// maxAlloc bounds the bytes of strings and table fields a run builds.
+	maxAlloc = 64 << 20
+	// maxResultDepth bounds the nesting of the tables a run returns.
+	maxResultDepth = 32
+)
+
+// Error is a script failing to compile or to run, at a line of its source,
+// or 0 when the value it returns can't be converted.
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.Line == 0 {
+		return e.Msg
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// Host reads and writes the rows of a run, as the db.get, db.row, db.set and
+// db.del functions.  A row of no columns doesn't exist.
+type Host interface {
+	// Get returns the value of a column, and whether it is set.
+	Get(table, key, column string) (string, bool, error)
+	// Row returns the columns of a row.
+	Row(table, key string) (map[string]string, error)
+	// Set sets the value of a column.
+	Set(table, key, column, value string) error
+	// Delete deletes a column, or the whole row when column is empty.
+	Delete(table, key, column string) error
+}
+
+// hostError is an error of the host, returned by Run as it is.
+type hostError struct {
+	err error
+}
+
+func (e *hostError) Error() string { return e.err.Error() }
+
+// Script is a compiled script, safe to run concurrently.
+type Script struct {
+	chunk *block
+}
+
+// Compile parses the source of a script.
+func Compile(src string) (*Script, error) {
+	chunk, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return &Script{chunk: chunk}, nil
+}
+
+// Run runs a script against host, with the KEYS and ARGV globals set to the
+// sequences of keys and args.  It returns the first value the script returns
+// as a JSON value: tables are arrays when they are sequences, objects
+// otherwise.  Errors of the script are *Error, those of the host are returned
+// as they are.
+func (s *Script) Run(host Host, keys, args []string) (interface{}, error) {
+	in := newInterp(host)
+	in.globals["KEYS"] = in.sequence(keys)
+	in.globals["ARGV"] = in.sequence(args)
+	rets, err := in.call(&closure{fn: &funcExpr{name: "main", body: s.chunk}, scope: nil}, nil, 0)
+	if err != nil {
+		var he *hostError
+		if errors.As(err, &he) {
+			return nil, he.err
+		}
+		return nil, err
+	}
+	if len(rets) == 0 {
+		return nil, nil
+	}
+	res, err := toJSON(rets[0], 0)
+	if err != nil {
+		return nil, &Error{Msg: err.Error()}
+	}
+	return res, nil
+}
+
+// toJSON converts a value returned by a script.
+func toJSON(v value, depth int) (interface{}, error) {
+	if depth > maxResultDepth {
+		return nil, fmt.Errorf("result nests tables deeper than %d", maxResultDepth)
+	}
+	switch v := v.(type) {
+	case nil, bool, string:
+		return v, nil
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return nil, fmt.Errorf("result holds %s, which isn't a JSON number", formatNumber(v))
+		}
+		return v, nil
+	case *table:
+		if n := v.length(); n == len(v.hash) {
+			arr := make([]interface{}, n)
+			for i := range arr {
+				elem, err := toJSON(v.hash[float64(i+1)], depth+1)
+				if err != nil {
+					return nil, err
+				}
+				arr[i] = elem
+			}
+			return arr, nil
+		}
+		obj := make(map[string]interface{}, len(v.hash))
+		for _, k := range v.sortedKeys() {
+			var name string
+			switch k := k.(type) {
+			case string:
+				name = k
+			case float64:
+				name = formatNumber(k)
+			case bool:
+				name = fmt.Sprint(k)
+			default:
+				return nil, fmt.Errorf("result has a %s key, which isn't a JSON object key", typeName(k))
+			}
+			elem, err := toJSON(v.hash[k], depth+1)
+			if err != nil {
+				return nil, err
+			}
+			obj[name] = elem
+		}
+		return obj, nil
+	}
+	return nil, fmt.Errorf("result holds a %s, which isn't a JSON value", typeName(v))
+}
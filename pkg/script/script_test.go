@@ -0,0 +1,168 @@
+package script
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// memHost is a Host over rows in memory, keyed by table/key.
+type memHost map[string]map[string]string
+
+func (h memHost) Get(table, key, column string) (string, bool, error) {
+	v, ok := h[table+"/"+key][column]
+	return v, ok, nil
+}
+
+func (h memHost) Row(table, key string) (map[string]string, error) {
+	if table == "broken" {
+		return nil, errHost
+	}
+	return h[table+"/"+key], nil
+}
+
+func (h memHost) Set(table, key, column, value string) error {
+	row := h[table+"/"+key]
+	if row == nil {
+		row = map[string]string{}
+		h[table+"/"+key] = row
+	}
+	row[column] = value
+	return nil
+}
+
+func (h memHost) Delete(table, key, column string) error {
+	if column == "" {
+		delete(h, table+"/"+key)
+		return nil
+	}
+	delete(h[table+"/"+key], column)
+	return nil
+}
+
+var errHost = errors.New("host failed")
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want interface{}
+	}{
+		{"arithmetic", `return 1 + 2 * 3 ^ 2 // 4 - -7 % 3`, float64(1 + 2*9/4 - 2)},
+		{"concat", `return "a" .. 1 .. "b" .. 2.5`, "a1b2.5"},
+		{"coercion", `return "10" + 5, "x"`, float64(15)},
+		{"logic", `return nil or false and 1 or "d"`, "d"},
+		{"sequence", `local t = {} for i = 1, 3 do t[#t+1] = i * i end return t`, []interface{}{float64(1), float64(4), float64(9)}},
+		{"object", `return {a = 1, [2] = "b"}`, map[string]interface{}{"a": float64(1), "2": "b"}},
+		{"empty", `return {}`, []interface{}{}},
+		{"closures", `
+			local function counter()
+				local n = 0
+				return function() n = n + 1 return n end
+			end
+			local c = counter()
+			c() c()
+			return c()`, float64(3)},
+		{"recursion", `function fib(n) if n < 2 then return n end return fib(n-1) + fib(n-2) end return fib(15)`, float64(610)},
+		{"pairs in order", `
+			local out = {}
+			for k, v in pairs({c = 3, a = 1, [2] = "x", b = 2}) do out[#out+1] = tostring(k) .. "=" .. tostring(v) end
+			return table.concat(out, ",")`, "2=x,a=1,b=2,c=3"},
+		{"ipairs stops at nil", `local n = 0 for i, v in ipairs({1, 2, nil, 4}) do n = n + v end return n`, float64(3)},
+		{"while and repeat", `
+			local i, j = 0, 0
+			while true do i = i + 1 if i == 5 then break end end
+			repeat local k = j j = j + 1 until k >= 2
+			return {i, j}`, []interface{}{float64(5), float64(3)}},
+		{"strings", `local s = "Hello" return s:upper() .. s:sub(2, -2) .. #s .. string.rep("-", 2) .. tostring(s:find("ll"))`, "HELLOell5--3"},
+		{"multiple returns", `local function two() return 1, 2 end local t = {two(), two()} return #t`, float64(3)},
+		{"table library", `local t = {"b"} table.insert(t, 1, "a") table.insert(t, "c") local r = table.remove(t, 2) return r .. table.concat(t)`, "bac"},
+		{"long strings", "return [==[a]]\n]==]", "a]]\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Compile(tt.src)
+			if err != nil {
+				t.Fatalf("Compile() = %v", err)
+			}
+			got, err := s.Run(memHost{}, nil, nil)
+			if err != nil {
+				t.Fatalf("Run() = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Run() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunHost(t *testing.T) {
+	host := memHost{"accounts/a": {"balance": "10"}, "accounts/b": {"balance": "5"}}
+	s, err := Compile(`
+		local amount = tonumber(ARGV[1])
+		local from = tonumber(db.get("accounts", KEYS[1], "balance"))
+		if from < amount then error("insufficient funds") end
+		db.set("accounts", KEYS[1], "balance", from - amount)
+		local to = db.row("accounts", KEYS[2])
+		db.set("accounts", KEYS[2], "balance", to.balance + amount)
+		db.del("accounts", KEYS[1], "frozen")
+		return db.row("accounts", "missing") == nil`)
+	if err != nil {
+		t.Fatalf("Compile() = %v", err)
+	}
+	got, err := s.Run(host, []string{"a", "b"}, []string{"3"})
+	if err != nil || got != true {
+		t.Fatalf("Run() = %v, %v", got, err)
+	}
+	if host["accounts/a"]["balance"] != "7" || host["accounts/b"]["balance"] != "8" {
+		t.Errorf("rows after Run() = %v", host)
+	}
+	_, err = s.Run(host, []string{"a", "b"}, []string{"30"})
+	var se *Error
+	if !errors.As(err, &se) || se.Line != 4 || se.Msg != "insufficient funds" {
+		t.Errorf("Run() of too much = %v, want insufficient funds at line 4", err)
+	}
+
+	s, err = Compile(`return db.row("broken", "x")`)
+	if err != nil {
+		t.Fatalf("Compile() = %v", err)
+	}
+	if _, err := s.Run(host, nil, nil); err != errHost {
+		t.Errorf("Run() with a failing host = %v, want its error", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"x = ", "line 1: unexpected end of script"},
+		{"local s = 'abc", "line 1: unfinished string"},
+		{"if x then\n y = 1", "line 2: 'end' expected near end of script"},
+		{"return 1 +\n nil", "line 1: attempt to perform arithmetic on a nil value"},
+		{"\nlocal t = nil\nreturn t.x", "line 3: attempt to index a nil value"},
+		{"return 1 < 'a'", "line 1: attempt to compare number with string"},
+		{"undefined()", "line 1: attempt to call a nil value"},
+		{"string.sub()", "line 1: bad argument #1 to 'sub' (string expected, got nil)"},
+		{"while true do end", "line 1: script exceeded its budget of 1000000 steps"},
+		{"local function f() return f() end return f()", "line 1: stack overflow"},
+		{"return string.rep('x', 2000000)", "line 1: string longer than 1048576 bytes"},
+		{"local s = string.rep('x', 1000000) local t = {} for i = 1, 100 do t[i] = s .. i end", "line 1: script exceeded its memory budget"},
+		{"return function() end", "result holds a function, which isn't a JSON value"},
+		{"return 1/0", "result holds inf, which isn't a JSON number"},
+	}
+	for _, tt := range tests {
+		s, err := Compile(tt.src)
+		if err == nil {
+			_, err = s.Run(memHost{}, nil, nil)
+		}
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%q = %v, want %s", tt.src, err, tt.want)
+		}
+	}
+	if _, err := Compile("x = ...."); err == nil || !strings.Contains(err.Error(), "varargs") {
+		t.Errorf("Compile() of varargs = %v", err)
+	}
+}
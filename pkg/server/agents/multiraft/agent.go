@@ -1,17 +1,85 @@
 package multiraft
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
+	"github.com/epsniff/expodb/pkg/errdefs"
 	machines "github.com/epsniff/expodb/pkg/server/state-machines"
+	"github.com/epsniff/expodb/pkg/tracing"
 
 	"github.com/lni/dragonboat/v4"
 	"github.com/lni/dragonboat/v4/client"
 	dgConfig "github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/raftio"
+	"go.uber.org/zap"
 )
 
+const (
+	// readIndexWaitTimeout bounds how long a read waits for the local replica
+	// to catch up to a client supplied minimum index.
+	readIndexWaitTimeout = 2 * time.Second
+	readIndexPollPeriod  = 10 * time.Millisecond
+
+	// CompactionOverhead is the number of entries dragonboat keeps in the
+	// raft log below a snapshot when it truncates the log.
+	CompactionOverhead = 5
+)
+
+var (
+	ErrIndexNotReached = errdefs.New(errdefs.ErrTimeout, "replica has not applied the requested index yet")
+	ErrWritesFrozen    = errors.New("writes are frozen cluster-wide")
+	ErrVersionMismatch = errdefs.New(errdefs.ErrConflict, "row was modified since the expected version")
+	ErrTxnConflict     = errdefs.New(errdefs.ErrConflict, "row is locked by a prepared transaction")
+	ErrKeyExists       = errdefs.New(errdefs.ErrConflict, "key already exists")
+)
+
+// Config holds the durability knobs and hosted state machines of a raft agent.
+type Config struct {
+	// SyncWrites fsyncs the FSM on every applied batch.  When false the FSM
+	// is only synced when dragonboat asks for it (around snapshots), and
+	// entries lost on a crash are replayed from the raft log.
+	SyncWrites bool
+	// AckOnCommit acknowledges proposals as soon as a quorum has committed
+	// them instead of waiting for the local FSM to apply them.  Requires
+	// NotifyCommit on the NodeHost.  Writes acked this way report index 0.
+	AckOnCommit bool
+	// Witness starts the replica as a raft witness: it votes and stores log
+	// metadata but never applies entries, so it holds no user data.
+	Witness bool
+	// NonVoting starts the replica as a non-voter: it replicates and serves
+	// reads but neither votes nor counts towards commits.
+	NonVoting bool
+	// StateMachines are hosted next to the KV store, each gets the entries
+	// tagged with its fsm type.
+	StateMachines []machines.Registration
+	// Logger, when set, logs the KV entries applied and rejected, see
+	// KVData.RequestID.
+	Logger *zap.Logger
+	// OnApply, when set, is called with every KV entry once its batch is
+	// persisted, rejected entries aside.  It runs on the apply path so it
+	// has to be quick, and entries replayed after a restart are passed again.
+	OnApply func(index uint64, kv KVData)
+	// Triggers are the triggers TableTriggers attach to tables, by name.
+	// Every replica of the shard has to have the same ones.
+	Triggers map[string]TriggerFunc
+}
+
+// LeaderInfo describes the shard's leader after a leadership change.
+// ReplicaID is 0 and Address empty while no leader is known.
+type LeaderInfo struct {
+	ReplicaID uint64
+	Term      uint64
+	// Address is the leader's raft address.
+	Address string
+}
+
 // Agent starts and manages a raft server and the primary FSM.
 type Agent struct {
 	ctx       context.Context
@@ -19,14 +87,31 @@ type Agent struct {
 	shardID   uint64
 	nh        *dragonboat.NodeHost
 	cs        *client.Session
+	config    Config
+
+	leaderMu sync.RWMutex
+	leader   LeaderInfo
+	leaderCh chan LeaderInfo
+
+	replay    *replayState
+	snapshots *snapshotStats
 }
 
-func New(nh *dragonboat.NodeHost, replicaID, shardID uint64, initialMembers map[uint64]string) (*Agent, error) {
+func New(nh *dragonboat.NodeHost, replicaID, shardID uint64, initialMembers map[uint64]string, config Config) (*Agent, error) {
 	a := &Agent{
 		ctx:       context.Background(),
 		nh:        nh,
 		replicaID: replicaID,
 		shardID:   shardID,
+		config:    config,
+		leaderCh:  make(chan LeaderInfo, 8),
+		replay:    &replayState{},
+		snapshots: &snapshotStats{},
+	}
+	for _, reg := range config.StateMachines {
+		if err := reg.Validate(); err != nil {
+			return nil, err
+		}
 	}
 	// config for raft
 	rc := dgConfig.Config{
@@ -35,13 +120,20 @@ func New(nh *dragonboat.NodeHost, replicaID, shardID uint64, initialMembers map[
 		HeartbeatRTT:       1,
 		CheckQuorum:        true,
 		SnapshotEntries:    10,
-		CompactionOverhead: 5,
+		CompactionOverhead: CompactionOverhead,
 		ShardID:            shardID,
 	}
+	if config.Witness {
+		// witnesses can't take snapshots, they have no state to snapshot.
+		rc.IsWitness = true
+		rc.SnapshotEntries = 0
+	}
+	rc.IsNonVoting = config.NonVoting
 
-	if err := nh.StartOnDiskReplica(initialMembers, len(initialMembers) == 0, NewDiskKV, rc); err != nil {
+	if err := nh.StartOnDiskReplica(initialMembers, len(initialMembers) == 0, newDiskKVFactory(config, a.replay, a.snapshots), rc); err != nil {
 		return nil, fmt.Errorf("failed to add cluster, %w", err)
 	}
+	a.recordReplayTarget()
 	a.nh = nh
 	a.replicaID = replicaID
 	return a, nil
@@ -55,38 +147,420 @@ func (a *Agent) AddVoter(replicaID uint64, peerAddress string) error {
 	return a.nh.SyncRequestAddReplica(ctx, a.shardID, replicaID, peerAddress, 0)
 }
 
+// AddWitness adds a witness peer, it votes in elections but stores no data.
+// Can only be called on the leader.
+func (a *Agent) AddWitness(replicaID uint64, peerAddress string) error {
+	ctx, cancel := context.WithTimeout(a.ctx, 5*time.Second)
+	defer cancel()
+	return a.nh.SyncRequestAddWitness(ctx, a.shardID, replicaID, peerAddress, 0)
+}
+
+// AddNonVoter adds a non-voting peer, it replicates the shard without being
+// part of its quorum.  Can only be called on the leader.
+func (a *Agent) AddNonVoter(replicaID uint64, peerAddress string) error {
+	ctx, cancel := context.WithTimeout(a.ctx, 5*time.Second)
+	defer cancel()
+	return a.nh.SyncRequestAddNonVoting(ctx, a.shardID, replicaID, peerAddress, 0)
+}
+
+// RemoveReplica removes a replica from the shard, its ID can't be used again.
+// Can only be called on the leader.
+func (a *Agent) RemoveReplica(replicaID uint64) error {
+	ctx, cancel := context.WithTimeout(a.ctx, 5*time.Second)
+	defer cancel()
+	return a.nh.SyncRequestDeleteReplica(ctx, a.shardID, replicaID, 0)
+}
+
 // Apply is used to apply a command to the FSM in a highly consistent
-// manner.  This call blocks until the log is conserted commited or
-// until 5 seconds is reached.
-func (a *Agent) Apply(val machines.RaftEntry) error {
+// manner.  This call blocks until the log is conserted commited or until
+// the context deadline (5 seconds if unset) is reached.  Proposals dropped
+// because the shard is between leaders are retried until the deadline.
+// It returns the raft index of the entry.
+func (a *Agent) Apply(ctx context.Context, val machines.RaftEntry) (uint64, error) {
+	if kv, ok := val.(KVData); ok && kv.RequestID == "" {
+		kv.RequestID = tracing.RequestID(ctx)
+		val = kv
+	}
+	if IsDryRun(ctx) {
+		kv, ok := val.(KVData)
+		if !ok {
+			return 0, ErrDryRunUnsupported
+		}
+		return 0, a.dryRun(ctx, kv)
+	}
 	// TODO: reuse the session?
 	a.cs = a.nh.GetNoOPSession(a.shardID)
 	data, err := val.Marshal()
 	if err != nil {
-		return fmt.Errorf("failed to marshal raft entry: %w", err)
+		return 0, fmt.Errorf("failed to marshal raft entry: %w", err)
 	}
-	ctx, cancel := context.WithTimeout(a.ctx, 5*time.Second)
+	ctx, cancel := withRequestDeadline(ctx)
 	defer cancel()
-	_, err = a.nh.SyncPropose(ctx, a.cs, data)
-	return err
+	tr := tracing.FromContext(ctx)
+	a.traceLeader(tr)
+	// conditional writes, prepares, index and schema changes and writes to
+	// tables with unique indexes or schemas must wait for the apply to learn
+	// if they were accepted.
+	ackOnCommit := a.config.AckOnCommit
+	if kv, ok := val.(KVData); ok && (kv.IfMatch != nil || kv.IfAbsent || len(kv.Reads) > 0 || checkedOnApply(kv.Op)) {
+		ackOnCommit = false
+	} else if ok && ackOnCommit {
+		// a table we can't tell about counts as having one.
+		constrained, err := a.ReadLocal(constrainedQuery{tables: writtenTables(&kv)})
+		ackOnCommit = err == nil && constrained == false
+	}
+	var index uint64
+	err = retry(ctx, func(ctx context.Context) error {
+		tr.Step("propose", fmt.Sprintf("%d bytes", len(data)))
+		if ackOnCommit {
+			err := a.proposeCommitted(ctx, data)
+			if err == nil {
+				tr.Step("committed", "")
+			}
+			return err
+		}
+		res, err := a.nh.SyncPropose(ctx, a.cs, data)
+		if err != nil {
+			return err
+		}
+		index = res.Value
+		return resultError(res.Data)
+	})
+	if err != nil {
+		tr.Step("propose failed", err.Error())
+		return 0, err
+	}
+	if !ackOnCommit {
+		tr.Step("applied", fmt.Sprintf("index %d", index))
+	}
+	return index, nil
 }
 
-func (a *Agent) Read(query interface{}) (interface{}, error) {
-	ctx, cancel := context.WithTimeout(a.ctx, 5*time.Second)
+// resultError returns the error of an entry rejected with the result data,
+// nil when it was applied.
+func resultError(data []byte) error {
+	switch {
+	case len(data) == 0:
+		return nil
+	case bytes.Equal(data, resultWritesFrozen):
+		return ErrWritesFrozen
+	case bytes.Equal(data, resultPreconditionFailed):
+		return ErrVersionMismatch
+	case bytes.Equal(data, resultKeyExists):
+		return ErrKeyExists
+	}
+	if conflict, ok := parseConflictResult(data); ok {
+		return conflict
+	}
+	if violation, ok := parseViolationResult(data); ok {
+		return violation
+	}
+	if violation, ok := parseSchemaResult(data); ok {
+		return violation
+	}
+	if rejected, ok := parseTriggerResult(data); ok {
+		return rejected
+	}
+	return nil
+}
+
+// checkedOnApply reports whether entries of op may be rejected by the apply.
+func checkedOnApply(op string) bool {
+	switch op {
+	case OpTxnPrepare, OpCreateIndex, OpSetSchema, OpChangeSchema:
+		return true
+	}
+	return false
+}
+
+// proposeCommitted proposes data and returns once a quorum has committed it,
+// without waiting for it to be applied.
+func (a *Agent) proposeCommitted(ctx context.Context, data []byte) error {
+	deadline, _ := ctx.Deadline()
+	rs, err := a.nh.Propose(a.cs, data, time.Until(deadline))
+	if err != nil {
+		return err
+	}
+	select {
+	case r := <-rs.ResultC():
+		switch {
+		case r.Committed():
+			return nil
+		case r.Dropped():
+			return dragonboat.ErrShardNotReady
+		case r.Timeout():
+			return dragonboat.ErrTimeout
+		case r.Terminated():
+			return dragonboat.ErrShardClosed
+		case r.Rejected():
+			return dragonboat.ErrRejected
+		default:
+			return dragonboat.ErrAborted
+		}
+	case <-ctx.Done():
+		return dragonboat.ErrTimeout
+	}
+}
+
+// Read does a linearizable read of the FSM, retrying while the shard has no
+// leader until the context deadline (5 seconds if unset).
+func (a *Agent) Read(ctx context.Context, query interface{}) (interface{}, error) {
+	ctx, cancel := withRequestDeadline(ctx)
 	defer cancel()
-	res, err := a.nh.SyncRead(ctx, a.shardID, query)
+	tr := tracing.FromContext(ctx)
+	a.traceLeader(tr)
+	var res interface{}
+	err := retry(ctx, func(ctx context.Context) error {
+		tr.Step("read index", "")
+		var err error
+		res, err = a.nh.SyncRead(ctx, a.shardID, query)
+		return err
+	})
 	if err != nil {
+		tr.Step("read failed", err.Error())
 		return nil, fmt.Errorf("failed to read: %w", err)
 	}
+	tr.Step("lookup done", "")
 	return res, err
 }
 
+// ReadIndex returns a raft index the local replica has applied that is at
+// least the shard's commit index at the time of the call, as confirmed by the
+// leader.  Reads at that index or later observe every write acked before.
+func (a *Agent) ReadIndex(ctx context.Context) (uint64, error) {
+	res, err := a.Read(ctx, appliedIndexQuery{})
+	if err != nil {
+		return 0, err
+	}
+	return res.(uint64), nil
+}
+
+// AppliedIndex returns the last raft index applied by the local replica.
+func (a *Agent) AppliedIndex() (uint64, error) {
+	res, err := a.nh.StaleRead(a.shardID, appliedIndexQuery{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read applied index: %w", err)
+	}
+	return res.(uint64), nil
+}
+
+// ReadLocal serves the query from the local replica without checking it is
+// up to date.
+func (a *Agent) ReadLocal(query interface{}) (interface{}, error) {
+	res, err := a.nh.StaleRead(a.shardID, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read: %w", err)
+	}
+	return res, nil
+}
+
+// ReadAtIndex serves the query from the local replica once it has applied at
+// least minIndex, without a round trip to the leader.  Waiting is bounded by
+// readIndexWaitTimeout, or the context deadline if sooner, after which
+// ErrIndexNotReached is returned.
+func (a *Agent) ReadAtIndex(ctx context.Context, query interface{}, minIndex uint64) (interface{}, error) {
+	deadline := time.Now().Add(readIndexWaitTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	tr := tracing.FromContext(ctx)
+	tr.Step("wait for index", fmt.Sprintf("min index %d", minIndex))
+	for {
+		applied, err := a.AppliedIndex()
+		if err != nil {
+			return nil, err
+		}
+		if applied >= minIndex {
+			tr.Step("index reached", fmt.Sprintf("applied index %d", applied))
+			break
+		}
+		if time.Now().After(deadline) {
+			tr.Step("index not reached", fmt.Sprintf("applied index %d", applied))
+			return nil, ErrIndexNotReached
+		}
+		time.Sleep(readIndexPollPeriod)
+	}
+	res, err := a.nh.StaleRead(a.shardID, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read: %w", err)
+	}
+	tr.Step("local lookup done", "")
+	return res, nil
+}
+
+// Members returns the replica IDs and raft addresses of every replica that
+// stores data (voters and non-voters).
+func (a *Agent) Members(ctx context.Context) (map[uint64]string, error) {
+	ctx, cancel := withRequestDeadline(ctx)
+	defer cancel()
+	m, err := a.nh.SyncGetShardMembership(ctx, a.shardID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get shard membership: %w", err)
+	}
+	members := map[uint64]string{}
+	for id, addr := range m.Nodes {
+		members[id] = addr
+	}
+	for id, addr := range m.NonVotings {
+		members[id] = addr
+	}
+	return members, nil
+}
+
+// Witnesses returns the replica IDs and raft addresses of the shard's
+// witnesses.
+func (a *Agent) Witnesses(ctx context.Context) (map[uint64]string, error) {
+	ctx, cancel := withRequestDeadline(ctx)
+	defer cancel()
+	m, err := a.nh.SyncGetShardMembership(ctx, a.shardID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get shard membership: %w", err)
+	}
+	witnesses := map[uint64]string{}
+	for id, addr := range m.Witnesses {
+		witnesses[id] = addr
+	}
+	return witnesses, nil
+}
+
+// NonVoters returns the replica IDs and raft addresses of the shard's
+// non-voters.
+func (a *Agent) NonVoters(ctx context.Context) (map[uint64]string, error) {
+	ctx, cancel := withRequestDeadline(ctx)
+	defer cancel()
+	m, err := a.nh.SyncGetShardMembership(ctx, a.shardID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get shard membership: %w", err)
+	}
+	nonVoters := map[uint64]string{}
+	for id, addr := range m.NonVotings {
+		nonVoters[id] = addr
+	}
+	return nonVoters, nil
+}
+
+// traceLeader records whether the request is served by the leader or will
+// be forwarded to it by dragonboat.
+func (a *Agent) traceLeader(tr *tracing.Trace) {
+	if tr == nil {
+		return
+	}
+	leaderID, term, ok, err := a.nh.GetLeaderID(a.shardID)
+	switch {
+	case err != nil || !ok:
+		tr.Step("no leader known", "")
+	case leaderID == a.replicaID:
+		tr.Step("local replica is leader", fmt.Sprintf("term %d", term))
+	default:
+		tr.Step("forwarding to leader", fmt.Sprintf("replica %d, term %d", leaderID, term))
+	}
+}
+
+// LeaderUpdated must be called with the NodeHost's leader notifications for
+// this shard.  It resolves the leader's address and publishes the change on
+// LeaderChanges without blocking the caller.
+func (a *Agent) LeaderUpdated(info raftio.LeaderInfo) {
+	go func() {
+		li := LeaderInfo{ReplicaID: info.LeaderID, Term: info.Term}
+		if info.LeaderID != 0 {
+			members, err := a.Members(a.ctx)
+			if err == nil {
+				li.Address = members[info.LeaderID]
+			}
+		}
+
+		a.leaderMu.Lock()
+		if li.Term < a.leader.Term {
+			a.leaderMu.Unlock()
+			return // raced with a newer notification
+		}
+		a.leader = li
+		a.leaderMu.Unlock()
+
+		// drop the oldest notification rather than block when nobody listens.
+		for {
+			select {
+			case a.leaderCh <- li:
+				return
+			default:
+			}
+			select {
+			case <-a.leaderCh:
+			default:
+			}
+		}
+	}()
+}
+
+// ReplayLeader publishes the shard's current leader as LeaderUpdated does,
+// for the notifications dragonboat sent before the agent was registered to
+// get them.  An older term than the one published already is ignored.
+func (a *Agent) ReplayLeader() {
+	leaderID, term, ok, err := a.nh.GetLeaderID(a.shardID)
+	if err != nil || !ok {
+		return
+	}
+	a.LeaderUpdated(raftio.LeaderInfo{ShardID: a.shardID, ReplicaID: a.replicaID, LeaderID: leaderID, Term: term})
+}
+
+// LeaderAddress returns the raft address of the shard's current leader, or
+// an empty string when no leader is known.
+func (a *Agent) LeaderAddress() string {
+	a.leaderMu.RLock()
+	defer a.leaderMu.RUnlock()
+	return a.leader.Address
+}
+
+// LeaderChanges returns a channel receiving every leadership change.  Slow
+// readers miss intermediate changes but always see the latest one.
+func (a *Agent) LeaderChanges() <-chan LeaderInfo {
+	return a.leaderCh
+}
+
+// TransferLeadership asks the shard to hand leadership to the given replica.
+// Can only be called on the leader, the transfer completes asynchronously.
+func (a *Agent) TransferLeadership(replicaID uint64) error {
+	return a.nh.RequestLeaderTransfer(a.shardID, replicaID)
+}
+
+// RequestSnapshot snapshots the local replica, which lets dragonboat
+// truncate the raft log up to the snapshot.  It returns the snapshot index.
+func (a *Agent) RequestSnapshot(ctx context.Context) (uint64, error) {
+	return a.nh.SyncRequestSnapshot(ctx, a.shardID, dragonboat.SnapshotOption{})
+}
+
+// ExportSnapshot writes a snapshot of the local replica holding all of its
+// data to a new directory under dir, for backups and ReadSnapshotFile.  The
+// snapshots RequestSnapshot takes only record where the pebble store is.  It
+// returns the directory written.
+func (a *Agent) ExportSnapshot(ctx context.Context, dir string) (string, error) {
+	index, err := a.nh.SyncRequestSnapshot(ctx, a.shardID, dragonboat.SnapshotOption{Exported: true, ExportPath: dir})
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, fmt.Sprintf("snapshot-%016X", index)), nil
+}
+
 // IsLeader returns true if this agent is the leader.
 func (a *Agent) IsLeader() (bool, error) {
 	leaderID, _, ok, err := a.nh.GetLeaderID(a.shardID)
 	return ok && a.replicaID == leaderID, err
 }
 
+// Leave stops the local replica and removes its data, once it has been
+// removed from the shard.  The node host keeps running.
+func (a *Agent) Leave() error {
+	if err := a.nh.StopReplica(a.shardID, a.replicaID); err != nil {
+		return fmt.Errorf("stopping replica: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(a.ctx, 30*time.Second)
+	defer cancel()
+	if err := a.nh.SyncRemoveData(ctx, a.shardID, a.replicaID); err != nil {
+		return fmt.Errorf("removing replica data: %w", err)
+	}
+	return os.RemoveAll(getNodeDBDirName(a.shardID, a.replicaID))
+}
+
 // Shutdown stops the raft server.
 func (a *Agent) Shutdown() error {
 	a.nh.Close()
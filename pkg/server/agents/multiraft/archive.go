@@ -0,0 +1,374 @@
+package multiraft
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/golang/snappy"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+const (
+	// archiveStateKey holds the ArchiveState while the log is archived.
+	archiveStateKey string = "\x00archive"
+	// archiveLogPrefix keys the entries applied while the log is archived,
+	// by index, big endian so they sort by index.  The value is the index
+	// of the entry archived before, little endian, then the command.
+	archiveLogPrefix string = "\x00archive_log:"
+	// SnapshotMetadataFile is the file of an exported snapshot directory
+	// describing it to dragonboat, next to the snapshot file.
+	SnapshotMetadataFile = "snapshot.metadata"
+	// archiveRestoreBatch is how many archived entries a restore applies at
+	// once.
+	archiveRestoreBatch = 256
+)
+
+// ArchiveState is the archive the raft log is shipped to.  The commands of
+// the entries applied after Offset, the index of the last one shipped, are
+// kept until the leader acknowledges them.  Since is the index the archive
+// was set at, the log before it was never recorded, Last the index of the
+// last entry recorded.
+type ArchiveState struct {
+	URL    string `json:"url"`
+	Since  uint64 `json:"since"`
+	Offset uint64 `json:"offset"`
+	Last   uint64 `json:"last"`
+}
+
+// ArchivedEntry is the command of an entry applied at Index, as proposed.
+// Not every index is archived: raft's own entries never reach the state
+// machine, nor are the archive's acknowledgements recorded.  Prev, the
+// index of the entry archived before, chains them so a restore can tell a
+// missing entry from an index that never was one.
+type ArchivedEntry struct {
+	Index uint64
+	Prev  uint64
+	Cmd   []byte
+}
+
+// ArchiveQuery asks for the ArchiveState, nil when the log isn't archived.
+type ArchiveQuery struct{}
+
+// ArchiveLogQuery asks for up to Limit archived entries after the index
+// After.
+type ArchiveLogQuery struct {
+	After uint64
+	Limit int
+}
+
+func archiveLogKey(index uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte(archiveLogPrefix), index)
+}
+
+func readArchive(rd pebble.Reader) (*ArchiveState, error) {
+	val, closer, err := rd.Get([]byte(archiveStateKey))
+	if err == pebble.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	state := &ArchiveState{}
+	if err := json.Unmarshal(val, state); err != nil {
+		return nil, fmt.Errorf("decoding archive state: %w", err)
+	}
+	return state, nil
+}
+
+func putArchive(db *pebbledb, wb *pebble.Batch, state *ArchiveState) error {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	wb.Set([]byte(archiveStateKey), buf, db.wo)
+	return nil
+}
+
+// recordArchive records the entry e for the archive state, chaining it to
+// the entry recorded before.
+func recordArchive(db *pebbledb, wb *pebble.Batch, state *ArchiveState, e sm.Entry) error {
+	val := binary.LittleEndian.AppendUint64(make([]byte, 0, 8+len(e.Cmd)), state.Last)
+	wb.Set(archiveLogKey(e.Index), append(val, e.Cmd...), db.wo)
+	state.Last = e.Index
+	return putArchive(db, wb, state)
+}
+
+// setArchive starts archiving to url the log after index.  Setting the
+// archive it already ships to keeps its offset, another one starts over.
+func setArchive(db *pebbledb, wb *pebble.Batch, url string, index uint64) error {
+	old, err := readArchive(wb)
+	if err != nil {
+		return err
+	}
+	if old != nil && old.URL == url {
+		return nil
+	}
+	if err := dropArchive(db, wb); err != nil {
+		return err
+	}
+	// chained to the set: a restore from a snapshot before it can't miss
+	// the log in between.
+	return putArchive(db, wb, &ArchiveState{URL: url, Since: index, Offset: index, Last: index})
+}
+
+// dropArchive stops archiving the log, dropping what wasn't shipped.
+func dropArchive(db *pebbledb, wb *pebble.Batch) error {
+	wb.Delete([]byte(archiveStateKey), db.wo)
+	prefix := []byte(archiveLogPrefix)
+	return wb.DeleteRange(prefix, prefixUpperBound(prefix), db.wo)
+}
+
+// ackArchive moves the offset forward to index, never backward, dropping
+// the entries shipped.
+func ackArchive(db *pebbledb, wb *pebble.Batch, index uint64) error {
+	state, err := readArchive(wb)
+	if err != nil || state == nil || index <= state.Offset {
+		return err
+	}
+	state.Offset = index
+	if err := putArchive(db, wb, state); err != nil {
+		return err
+	}
+	return wb.DeleteRange([]byte(archiveLogPrefix), archiveLogKey(index+1), db.wo)
+}
+
+func (r *pebbledb) archive() (*ArchiveState, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil, errors.New("db already closed")
+	}
+	return readArchive(r.db)
+}
+
+func (r *pebbledb) archiveLog(query ArchiveLogQuery) ([]ArchivedEntry, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil, errors.New("db already closed")
+	}
+	iter := r.db.NewIter(&pebble.IterOptions{
+		LowerBound: archiveLogKey(query.After + 1),
+		UpperBound: prefixUpperBound([]byte(archiveLogPrefix)),
+	})
+	var entries []ArchivedEntry
+	for iter.First(); iter.Valid() && len(entries) < query.Limit; iter.Next() {
+		val := iter.Value()
+		if len(val) < 8 {
+			iter.Close()
+			return nil, fmt.Errorf("archived entry %q of %d bytes", iter.Key(), len(val))
+		}
+		entries = append(entries, ArchivedEntry{
+			Index: binary.BigEndian.Uint64(iter.Key()[len(archiveLogPrefix):]),
+			Prev:  binary.LittleEndian.Uint64(val),
+			Cmd:   append([]byte(nil), val[8:]...),
+		})
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// WriteArchiveSegment writes archived entries as a segment of the archived
+// log: a snappy stream of the index, the previous index and the length
+// prefixed command of every entry, terminated by an index of snapshotEnd.
+func WriteArchiveSegment(w io.Writer, entries []ArchivedEntry) error {
+	sw := snappy.NewBufferedWriter(w)
+	index := make([]byte, 8)
+	for _, e := range entries {
+		binary.LittleEndian.PutUint64(index, e.Index)
+		if _, err := sw.Write(index); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(index, e.Prev)
+		if _, err := sw.Write(index); err != nil {
+			return err
+		}
+		if err := writeRecord(sw, e.Cmd); err != nil {
+			return err
+		}
+	}
+	binary.LittleEndian.PutUint64(index, snapshotEnd)
+	if _, err := sw.Write(index); err != nil {
+		return err
+	}
+	return sw.Close()
+}
+
+// ReadArchiveSegment decodes a segment written by WriteArchiveSegment,
+// calling fn for every entry.
+func ReadArchiveSegment(r io.Reader, fn func(ArchivedEntry) error) error {
+	br := bufio.NewReader(snappy.NewReader(r))
+	sz := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(br, sz); err != nil {
+			return fmt.Errorf("reading archived entry: %w", err)
+		}
+		index := binary.LittleEndian.Uint64(sz)
+		if index == snapshotEnd {
+			return nil
+		}
+		if _, err := io.ReadFull(br, sz); err != nil {
+			return fmt.Errorf("reading archived entry %d: %w", index, err)
+		}
+		prev := binary.LittleEndian.Uint64(sz)
+		if _, err := io.ReadFull(br, sz); err != nil {
+			return fmt.Errorf("reading archived entry %d: %w", index, err)
+		}
+		cmd := make([]byte, binary.LittleEndian.Uint64(sz))
+		if _, err := io.ReadFull(br, cmd); err != nil {
+			return fmt.Errorf("reading archived entry %d: %w", index, err)
+		}
+		if err := fn(ArchivedEntry{Index: index, Prev: prev, Cmd: cmd}); err != nil {
+			return err
+		}
+	}
+}
+
+// RestoreArchive rebuilds the store an archived snapshot and the archived
+// log after it add up to, up to the entry toIndex, and writes it out as an
+// exported snapshot in a new directory under dir.  snapshot is the exported
+// snapshot directory, entries calls its argument with the archived entries
+// in index order and must stop when it returns ErrStopRestore.  toIndex is
+// math.MaxUint64 to restore the whole log.  config has to host the same
+// state machines as the cluster's.  It returns the new snapshot directory
+// and its index.
+func RestoreArchive(dir, snapshot string, config Config, entries func(func(ArchivedEntry) error) error, toIndex uint64) (string, uint64, error) {
+	meta, err := readSnapshotMetadata(snapshot)
+	if err != nil {
+		return "", 0, err
+	}
+	storeDir, err := os.MkdirTemp(dir, "restore-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.RemoveAll(storeDir)
+	db, err := createDB(storeDir)
+	if err != nil {
+		return "", 0, err
+	}
+	defer db.close()
+
+	// load the snapshot, without the log it was archiving: the restored
+	// cluster starts without an archive.
+	info, err := loadExportedSnapshot(db, snapshot, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	wb := db.db.NewBatch()
+	if err := dropArchive(db, wb); err != nil {
+		return "", 0, err
+	}
+	if err := db.db.Apply(wb, db.wo); err != nil {
+		return "", 0, err
+	}
+
+	d := newDiskKVFactory(config, nil, &snapshotStats{})(meta.ShardID, 0).(*DiskKV)
+	d.db = unsafe.Pointer(db)
+	d.lastApplied = info.AppliedIndex
+	if err := d.restoreMachines(db); err != nil {
+		return "", 0, err
+	}
+	var batch []sm.Entry
+	apply := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := d.Update(batch)
+		batch = nil
+		return err
+	}
+	// the entry archived last, only known once past the snapshot.
+	var last uint64
+	err = entries(func(e ArchivedEntry) error {
+		if e.Index <= info.AppliedIndex {
+			return nil // in the snapshot already
+		}
+		if (last == 0 && e.Prev > info.AppliedIndex) || (last != 0 && e.Prev != last) {
+			return fmt.Errorf("archived log is missing entry %d, archived before %d", e.Prev, e.Index)
+		}
+		if e.Index > toIndex {
+			return ErrStopRestore
+		}
+		batch = append(batch, sm.Entry{Index: e.Index, Cmd: e.Cmd})
+		last = e.Index
+		if len(batch) < archiveRestoreBatch {
+			return nil
+		}
+		return apply()
+	})
+	stopped := errors.Is(err, ErrStopRestore)
+	if err != nil && !stopped {
+		return "", 0, err
+	}
+	if err := apply(); err != nil {
+		return "", 0, err
+	}
+	// toIndex itself may not be archived, an entry past it shows none is
+	// missing.
+	index := d.lastApplied
+	if !stopped && index < toIndex && toIndex != math.MaxUint64 {
+		return "", 0, fmt.Errorf("archived log ends at %d, before %d", index, toIndex)
+	}
+	// the log replayed set the archive again.
+	wb = db.db.NewBatch()
+	if err := dropArchive(db, wb); err != nil {
+		return "", 0, err
+	}
+	if err := db.db.Apply(wb, db.syncwo); err != nil {
+		return "", 0, err
+	}
+
+	meta.Index = index
+	out, err := writeExportedSnapshot(db, dir, meta, info.SessionTable)
+	if err != nil {
+		return "", 0, err
+	}
+	return out, index, nil
+}
+
+// ErrStopRestore is returned by the fn RestoreArchive passes to entries once
+// it reached the index wanted, entries should stop and return it.
+var ErrStopRestore = errors.New("restored up to the index wanted")
+
+// readSnapshotMetadata reads the metadata of an exported snapshot, a flag
+// file: 8 bytes of the MD5 of the protobuf, then the protobuf.
+func readSnapshotMetadata(dir string) (pb.Snapshot, error) {
+	meta := pb.Snapshot{}
+	data, err := os.ReadFile(filepath.Join(dir, SnapshotMetadataFile))
+	if err != nil {
+		return meta, err
+	}
+	if len(data) < 8 {
+		return meta, fmt.Errorf("%w: metadata of %d bytes", ErrSnapshotCorrupt, len(data))
+	}
+	sum := md5.Sum(data[8:])
+	if string(sum[8:]) != string(data[:8]) {
+		return meta, fmt.Errorf("%w: metadata checksum mismatch", ErrSnapshotCorrupt)
+	}
+	if err := meta.Unmarshal(data[8:]); err != nil {
+		return meta, fmt.Errorf("%w: decoding metadata: %v", ErrSnapshotCorrupt, err)
+	}
+	return meta, nil
+}
+
+func writeSnapshotMetadata(dir string, meta pb.Snapshot) error {
+	data, err := meta.Marshal()
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(data)
+	return os.WriteFile(filepath.Join(dir, SnapshotMetadataFile), append(sum[8:], data...), 0o644)
+}
@@ -0,0 +1,154 @@
+package multiraft
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func TestArchive(t *testing.T) {
+	db := openTestDB(t, "archive")
+	d := &DiskKV{db: unsafe.Pointer(db)}
+	index := uint64(0)
+	apply := func(kv KVData) {
+		t.Helper()
+		cmd, err := kv.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		index++
+		if _, err := d.Update([]sm.Entry{{Index: index, Cmd: cmd}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archived := func() []ArchivedEntry {
+		t.Helper()
+		entries, err := db.archiveLog(ArchiveLogQuery{Limit: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+	// snapshot exports the store as it is, like ExportSnapshot.
+	snapshot := func() string {
+		t.Helper()
+		dir := filepath.Join(t.TempDir(), "snapshot")
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		ss := db.db.NewSnapshot()
+		defer ss.Close()
+		path := filepath.Join(dir, "snapshot.gbsnap")
+		checksum, size, err := createSnapshotFile(path, func(w io.Writer) error {
+			w.Write(make([]byte, 16))
+			return writeSnapshot(db, ss, w)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta := pb.Snapshot{ShardID: 1, Index: index, Term: 2, Filepath: path, FileSize: uint64(size), Checksum: checksum}
+		if err := writeSnapshotMetadata(dir, meta); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+
+	// ship writes the archived log as a segment and acknowledges it.
+	var segments [][]byte
+	ship := func() {
+		t.Helper()
+		entries := archived()
+		buf := &bytes.Buffer{}
+		if err := WriteArchiveSegment(buf, entries); err != nil {
+			t.Fatal(err)
+		}
+		segments = append(segments, buf.Bytes())
+		apply(KVData{Op: OpAckArchive, Index: entries[len(entries)-1].Index})
+	}
+
+	apply(KVData{Table: "t", Row: "r", Column: "c", Val: "before"}) // 1
+	if got := archived(); len(got) != 0 {
+		t.Fatalf("archived without an archive = %v, want empty", got)
+	}
+	apply(KVData{Op: OpSetArchive, Val: "file:///a"}) // 2
+	base := snapshot()
+	apply(KVData{Table: "t", Row: "r", Column: "c", Val: "1"}) // 3
+	apply(KVData{Table: "t", Row: "s", Column: "c", Val: "1"}) // 4
+	if got := archived(); len(got) != 2 || got[0].Index != 3 || got[1].Index != 4 {
+		t.Fatalf("archived = %+v, want entries 3 and 4", got)
+	}
+
+	// acknowledgements trim the log without being archived themselves, and
+	// setting the same archive again keeps the offset.
+	ship()                                               // 5
+	apply(KVData{Op: OpSetArchive, Val: "file:///a"})    // 6
+	apply(KVData{Op: OpDeleteRow, Table: "t", Row: "s"}) // 7
+	if got := archived(); len(got) != 2 || got[0].Index != 6 || got[1].Index != 7 {
+		t.Fatalf("archived = %+v, want entries 6 and 7", got)
+	}
+	state, err := db.archive()
+	if err != nil || state == nil || state.Since != 2 || state.Offset != 4 {
+		t.Errorf("archive = %+v, %v, want since 2 offset 4", state, err)
+	}
+	ship() // 8
+
+	replay := func(segments [][]byte) func(func(ArchivedEntry) error) error {
+		return func(fn func(ArchivedEntry) error) error {
+			for _, seg := range segments {
+				if err := ReadArchiveSegment(bytes.NewReader(seg), fn); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	restore := func(toIndex uint64) (uint64, map[string]string) {
+		t.Helper()
+		out, restored, err := RestoreArchive(t.TempDir(), base, Config{}, replay(segments), toIndex)
+		if err != nil {
+			t.Fatalf("RestoreArchive(%d) error = %v", toIndex, err)
+		}
+		meta, err := readSnapshotMetadata(out)
+		if err != nil || meta.Index != restored || meta.Term != 2 {
+			t.Errorf("restored metadata = %+v, %v", meta, err)
+		}
+		rows := map[string]string{}
+		info, err := ReadSnapshotFile(out, func(e SnapshotEntry) error {
+			if bytes.HasPrefix(e.Key, []byte(archiveStateKey)) {
+				t.Errorf("restored snapshot holds archive key %q", e.Key)
+			}
+			if !e.System && !e.Version {
+				rows[e.Row] = string(e.Val)
+			}
+			return nil
+		})
+		if err != nil || info.AppliedIndex != restored {
+			t.Fatalf("restored snapshot = %+v, %v", info, err)
+		}
+		return restored, rows
+	}
+
+	if index, rows := restore(4); index != 4 || rows["r"] != "1" || rows["s"] != "1" {
+		t.Errorf("restored to %d rows %v, want index 4 with r and s", index, rows)
+	}
+	// 5 is an acknowledgement, never archived: 6 shows nothing is missing.
+	if index, _ := restore(5); index != 4 {
+		t.Errorf("restored to %d, want 4", index)
+	}
+	if index, rows := restore(math.MaxUint64); index != 7 || rows["r"] != "1" || len(rows) != 1 {
+		t.Errorf("restored to %d rows %v, want index 7 without s", index, rows)
+	}
+	if _, _, err := RestoreArchive(t.TempDir(), base, Config{}, replay(segments[1:]), math.MaxUint64); err == nil {
+		t.Error("RestoreArchive() without the first segment succeeded, want a gap")
+	}
+	if _, _, err := RestoreArchive(t.TempDir(), base, Config{}, replay(segments), 20); err == nil {
+		t.Error("RestoreArchive() past the archived log succeeded")
+	}
+}
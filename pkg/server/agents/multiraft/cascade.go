@@ -0,0 +1,114 @@
+package multiraft
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+)
+
+const (
+	// cascadePrefix keys the cascade rules, by table and name.
+	cascadePrefix string = "\x00cascade:"
+	// maxCascadeDepth bounds how far deletes cascade from table to table, so
+	// rules deleting each other's rows end.
+	maxCascadeDepth = 8
+)
+
+// CascadeRule deletes, with every row of Table deleted as a whole, the rows
+// of Target whose key starts with the deleted row's key followed by
+// Separator: a rule from "users" to "orders" with separator "/" deletes
+// "alice/..." orders along with user "alice".  Rows deleted by a cascade
+// cascade in turn, up to maxCascadeDepth tables away.  Deleting a single
+// column never cascades.
+type CascadeRule struct {
+	Table     string `json:"table"`
+	Name      string `json:"name"`
+	Target    string `json:"target"`
+	Separator string `json:"separator,omitempty"`
+}
+
+// CascadesQuery asks for the cascade rules of every table, by table and
+// name.
+type CascadesQuery struct{}
+
+// Validate checks a rule before it is proposed.
+func (rule *CascadeRule) Validate() error {
+	if rule.Table == "" || rule.Target == "" {
+		return fmt.Errorf("cascade rule needs a table and a target")
+	}
+	if !validIndexName(rule.Name) {
+		return fmt.Errorf("cascade rule name %q isn't letters, digits, '_' and '-'", rule.Name)
+	}
+	if rule.Table == rule.Target && rule.Separator == "" {
+		// every row's key starts with itself.
+		return fmt.Errorf("a rule within a table needs a separator")
+	}
+	return nil
+}
+
+func cascadeKey(table, name string) []byte {
+	return appendEscaped(appendComponent([]byte(cascadePrefix), table), name)
+}
+
+func setCascade(db *pebbledb, wb *pebble.Batch, rule *CascadeRule) error {
+	buf, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+	wb.Set(cascadeKey(rule.Table, rule.Name), buf, db.wo)
+	return nil
+}
+
+func readCascades(rd pebble.Reader, prefix []byte) ([]CascadeRule, error) {
+	iter := rd.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	var rules []CascadeRule
+	for iter.First(); iter.Valid(); iter.Next() {
+		rule := CascadeRule{}
+		if err := json.Unmarshal(iter.Value(), &rule); err != nil {
+			iter.Close()
+			return nil, fmt.Errorf("decoding cascade rule %q: %w", iter.Key(), err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (r *pebbledb) cascades() ([]CascadeRule, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil, fmt.Errorf("db already closed")
+	}
+	return readCascades(r.db, []byte(cascadePrefix))
+}
+
+// cascadeDeletes applies the rules of a table to rows deleted from it, in
+// the entry deleting them.  Rules apply in name order and rows in key order,
+// so every replica deletes the same rows.
+func cascadeDeletes(db *pebbledb, wb *pebble.Batch, table string, rows []string, index uint64, depth int) error {
+	if len(rows) == 0 || depth == maxCascadeDepth {
+		return nil
+	}
+	rules, err := readCascades(wb, appendComponent([]byte(cascadePrefix), table))
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		var deleted []string
+		for _, row := range rows {
+			rows, err := deleteRowsWhere(db, wb, rule.Target, row+rule.Separator, nil, index)
+			if err != nil {
+				return err
+			}
+			deleted = append(deleted, rows...)
+		}
+		if err := cascadeDeletes(db, wb, rule.Target, deleted, index, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package multiraft
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func tableRows(t *testing.T, db *pebbledb, table string) []string {
+	t.Helper()
+	var rows []string
+	if err := eachRow(db.db, table, func(row string, _ map[string]string) { rows = append(rows, row) }); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(rows)
+	return rows
+}
+
+func TestCascadeDeletes(t *testing.T) {
+	db := openTestDB(t, "cascade")
+	applyTestKV(t, db,
+		&KVData{Op: OpSetCascade, Cascade: &CascadeRule{Table: "users", Name: "orders", Target: "orders", Separator: "/"}},
+		&KVData{Op: OpSetCascade, Cascade: &CascadeRule{Table: "orders", Name: "items", Target: "items", Separator: "/"}},
+		&KVData{Table: "users", Row: "al", Column: "name", Val: "Al"},
+		&KVData{Table: "users", Row: "alice", Column: "name", Val: "Alice"},
+		&KVData{Table: "orders", Row: "al/1", Column: "total", Val: "3"},
+		&KVData{Table: "orders", Row: "alice/1", Column: "total", Val: "5"},
+		&KVData{Table: "items", Row: "alice/1/a", Column: "qty", Val: "1"},
+		&KVData{Table: "items", Row: "alice/10/a", Column: "qty", Val: "1"},
+	)
+
+	// a column delete doesn't cascade.
+	applyTestKV(t, db, &KVData{Op: OpDelete, Table: "users", Row: "alice", Column: "name"})
+	if got := tableRows(t, db, "orders"); len(got) != 2 {
+		t.Fatalf("orders after a column delete = %v", got)
+	}
+
+	applyTestKV(t, db, &KVData{Op: OpDeleteRow, Table: "users", Row: "alice"})
+	for table, want := range map[string][]string{
+		"orders": {"al/1"},
+		"items":  {"alice/10/a"}, // not an item of order alice/1
+	} {
+		if got := tableRows(t, db, table); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s after deleting alice = %v, want %v", table, got, want)
+		}
+	}
+
+	applyTestKV(t, db, &KVData{Op: OpDeletePrefix, Table: "users", Row: "a"})
+	if got := tableRows(t, db, "orders"); len(got) != 0 {
+		t.Errorf("orders after deleting the users = %v", got)
+	}
+
+	applyTestKV(t, db, &KVData{Op: OpDropCascade, Table: "users", Row: "orders"})
+	if rules, _ := db.cascades(); len(rules) != 1 || rules[0].Name != "items" {
+		t.Errorf("cascades() after drop = %v", rules)
+	}
+}
+
+func TestCascadeDeletes_Cycle(t *testing.T) {
+	db := openTestDB(t, "cascade-cycle")
+	applyTestKV(t, db,
+		&KVData{Op: OpSetCascade, Cascade: &CascadeRule{Table: "a", Name: "b", Target: "b"}},
+		&KVData{Op: OpSetCascade, Cascade: &CascadeRule{Table: "b", Name: "a", Target: "a"}},
+		&KVData{Table: "a", Row: "x", Column: "c", Val: "1"},
+		&KVData{Table: "b", Row: "x", Column: "c", Val: "1"},
+		&KVData{Op: OpDeleteRow, Table: "a", Row: "x"},
+	)
+	if got := append(tableRows(t, db, "a"), tableRows(t, db, "b")...); len(got) != 0 {
+		t.Errorf("rows left = %v", got)
+	}
+}
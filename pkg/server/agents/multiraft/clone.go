@@ -0,0 +1,114 @@
+package multiraft
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// CloneSnapshot writes a copy of an exported snapshot for a new cluster to
+// be started from, in a new directory under dir: without its membership, so
+// the new cluster's replicas can take any ID and address, and without what
+// ties it to the cluster it was taken on: the archive, the sinks with their
+// outbox, the standby state and the keys drop returns true for.  It returns
+// the new snapshot directory.
+func CloneSnapshot(dir, snapshot string, drop func(SnapshotEntry) bool) (string, error) {
+	meta, err := readSnapshotMetadata(snapshot)
+	if err != nil {
+		return "", err
+	}
+	storeDir, err := os.MkdirTemp(dir, "clone-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(storeDir)
+	db, err := createDB(storeDir)
+	if err != nil {
+		return "", err
+	}
+	defer db.close()
+	info, err := loadExportedSnapshot(db, snapshot, drop)
+	if err != nil {
+		return "", err
+	}
+	wb := db.db.NewBatch()
+	if err := dropArchive(db, wb); err != nil {
+		return "", err
+	}
+	for _, prefix := range []string{sinkPrefix, outboxPrefix, replicaStagePrefix} {
+		if err := wb.DeleteRange([]byte(prefix), prefixUpperBound([]byte(prefix)), db.wo); err != nil {
+			return "", err
+		}
+	}
+	wb.Delete([]byte(replicaSourceIndexKey), db.wo)
+	wb.Delete([]byte(replicaPromotedKey), db.wo)
+	if err := db.db.Apply(wb, db.syncwo); err != nil {
+		return "", err
+	}
+	meta.Membership = pb.Membership{}
+	return writeExportedSnapshot(db, dir, meta, info.SessionTable)
+}
+
+// loadExportedSnapshot loads the keys of an exported snapshot into db, but
+// those drop, which may be nil, returns true for.
+func loadExportedSnapshot(db *pebbledb, snapshot string, drop func(SnapshotEntry) bool) (*SnapshotFileInfo, error) {
+	wb := db.db.NewBatch()
+	info, err := ReadSnapshotFile(snapshot, func(e SnapshotEntry) error {
+		if drop != nil && drop(e) {
+			return nil
+		}
+		wb.Set(e.Key, e.Val, db.wo)
+		if wb.Len() < snapshotBlockSize {
+			return nil
+		}
+		if err := db.db.Apply(wb, db.wo); err != nil {
+			return err
+		}
+		wb = db.db.NewBatch()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if info.Dummy {
+		return nil, fmt.Errorf("%s holds no data, export one with /admin/_export_snapshot", snapshot)
+	}
+	return info, db.db.Apply(wb, db.wo)
+}
+
+// writeExportedSnapshot writes db out as the exported snapshot meta.Index in
+// a new directory under dir, the way dragonboat exports them, and returns
+// the directory.  The rest of meta is kept but for where the file is.  The
+// snapshot holds no client sessions, in a table of sessionTable, the size
+// the replica recovering it expects.
+func writeExportedSnapshot(db *pebbledb, dir string, meta pb.Snapshot, sessionTable uint64) (string, error) {
+	out := filepath.Join(dir, fmt.Sprintf("snapshot-%016X", meta.Index))
+	if err := os.Mkdir(out, 0o755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(out, fmt.Sprintf("snapshot-%016X.gbsnap", meta.Index))
+	ss := db.db.NewSnapshot()
+	defer ss.Close()
+	checksum, size, err := createSnapshotFile(path, func(w io.Writer) error {
+		sessions := make([]byte, 16)
+		binary.LittleEndian.PutUint64(sessions, sessionTable)
+		if _, err := w.Write(sessions); err != nil {
+			return err
+		}
+		return writeSnapshot(db, ss, w)
+	})
+	if err != nil {
+		return "", err
+	}
+	meta.OnDiskIndex = meta.Index
+	meta.Filepath, meta.FileSize, meta.Checksum = path, uint64(size), checksum
+	meta.Dummy, meta.Imported = false, false
+	if err := writeSnapshotMetadata(out, meta); err != nil {
+		return "", err
+	}
+	return out, nil
+}
@@ -0,0 +1,99 @@
+package multiraft
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unsafe"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func TestCloneSnapshot(t *testing.T) {
+	db := openTestDB(t, "clone")
+	d := &DiskKV{db: unsafe.Pointer(db)}
+	index := uint64(0)
+	apply := func(kv KVData) {
+		t.Helper()
+		cmd, err := kv.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		index++
+		if _, err := d.Update([]sm.Entry{{Index: index, Cmd: cmd}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	apply(KVData{Table: "t", Row: "r", Column: "c", Val: "1"})
+	apply(KVData{Table: "nodes", Row: "n1", Column: "addr", Val: "10.0.0.1"})
+	apply(KVData{Op: OpSetArchive, Val: "file:///a"})
+	for _, key := range []string{sinkPrefix + "s1", outboxPrefix + "1", replicaStagePrefix + "x", replicaSourceIndexKey, replicaPromotedKey} {
+		if err := db.db.Set([]byte(key), []byte("v"), db.syncwo); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// export the store, taken on a cluster of two replicas.
+	dir := filepath.Join(t.TempDir(), "snapshot")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	ss := db.db.NewSnapshot()
+	path := filepath.Join(dir, "snapshot.gbsnap")
+	checksum, size, err := createSnapshotFile(path, func(w io.Writer) error {
+		sessions := make([]byte, 16)
+		binary.LittleEndian.PutUint64(sessions, 4096)
+		w.Write(sessions)
+		return writeSnapshot(db, ss, w)
+	})
+	ss.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := pb.Snapshot{
+		ShardID: 1, Index: index, Term: 2, Filepath: path, FileSize: uint64(size), Checksum: checksum,
+		Membership: pb.Membership{Addresses: map[uint64]string{1: "10.0.0.1:7000", 2: "10.0.0.2:7000"}},
+	}
+	if err := writeSnapshotMetadata(dir, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := CloneSnapshot(t.TempDir(), dir, func(e SnapshotEntry) bool {
+		return !e.System && e.Table == "nodes"
+	})
+	if err != nil {
+		t.Fatalf("CloneSnapshot() error = %v", err)
+	}
+	cloned, err := readSnapshotMetadata(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cloned.Index != index || cloned.Term != 2 || len(cloned.Membership.Addresses) != 0 {
+		t.Errorf("cloned metadata = %+v, want index %d term 2 without members", cloned, index)
+	}
+	tables := map[string]bool{}
+	info, err := ReadSnapshotFile(out, func(e SnapshotEntry) error {
+		for _, prefix := range []string{archiveStateKey, archiveLogPrefix, sinkPrefix, outboxPrefix, replicaStagePrefix, replicaSourceIndexKey, replicaPromotedKey} {
+			if strings.HasPrefix(string(e.Key), prefix) {
+				t.Errorf("cloned snapshot holds key %q", e.Key)
+			}
+		}
+		if !e.System {
+			tables[e.Table] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReadSnapshotFile() error = %v", err)
+	}
+	if info.SessionTable != 4096 || info.AppliedIndex != index {
+		t.Errorf("cloned snapshot = %+v, want a session table of 4096 at %d", info, index)
+	}
+	if !tables["t"] || tables["nodes"] {
+		t.Errorf("cloned tables = %v, want t without nodes", tables)
+	}
+}
@@ -0,0 +1,240 @@
+package multiraft
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/cockroachdb/pebble/vfs"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+const (
+	// crashPointEnv names the crash point TestCrashHelper kills itself at,
+	// crashSyncEnv whether it syncs every Update.
+	crashPointEnv = "EXPODB_CRASH_POINT"
+	crashSyncEnv  = "EXPODB_CRASH_SYNC"
+	crashEntries  = 10
+	// crashAfter is how many times the crash point is passed before the
+	// process is killed.
+	crashAfter = 5
+	// recoverBase is how many entries the replica recovering from a
+	// snapshot had applied.
+	recoverBase = 3
+)
+
+// TestCrashRecovery kills a process applying entries, or recovering from a
+// snapshot, at each crash point and checks the state machine reopens with
+// its data matching its applied index.  The page cache survives a SIGKILL,
+// so this covers process crashes only, TestSyncBarriers the fsyncs.
+func TestCrashRecovery(t *testing.T) {
+	tests := []struct {
+		point string
+		sync  bool
+		// minApplied is what must have survived the crash.
+		minApplied uint64
+	}{
+		{"update-before-apply", true, crashAfter - 1},
+		{"update-applied", true, crashAfter},
+		{"update-before-apply", false, 0},
+		{"update-applied", false, 0},
+		{"recover-restored", true, recoverBase},
+		{"recover-switched", true, crashEntries},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/sync=%v", tt.point, tt.sync), func(t *testing.T) {
+			dir := t.TempDir()
+			cmd := exec.Command(os.Args[0], "-test.run=^TestCrashHelper$")
+			cmd.Dir = dir
+			cmd.Env = append(os.Environ(), crashPointEnv+"="+tt.point, crashSyncEnv+"="+strconv.FormatBool(tt.sync))
+			out, err := cmd.CombinedOutput()
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) || exitErr.Sys().(syscall.WaitStatus).Signal() != syscall.SIGKILL {
+				t.Fatalf("helper wasn't killed: %v\n%s", err, out)
+			}
+
+			t.Chdir(dir)
+			replicaID := uint64(1)
+			if tt.point == "recover-restored" || tt.point == "recover-switched" {
+				replicaID = 2
+			}
+			d := NewDiskKV(1, replicaID).(*DiskKV)
+			applied, err := d.Open(nil)
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			defer d.Close()
+			if applied < tt.minApplied {
+				t.Errorf("applied index %d after the crash, want at least %d", applied, tt.minApplied)
+			}
+			if tt.point == "recover-restored" && applied != recoverBase {
+				t.Errorf("applied index %d, want the replica's own %d until the snapshot is switched in", applied, recoverBase)
+			}
+			for i := uint64(1); i <= crashEntries; i++ {
+				row, err := d.lookupRow("t", crashRow(i), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if has := len(row.Columns) > 0; has != (i <= applied) {
+					t.Errorf("row %d present = %v at applied index %d", i, has, applied)
+				}
+			}
+		})
+	}
+}
+
+// TestCrashHelper is run by TestCrashRecovery in a process of its own.
+func TestCrashHelper(t *testing.T) {
+	point := os.Getenv(crashPointEnv)
+	if point == "" {
+		t.Skip("only run by TestCrashRecovery")
+	}
+	syncWrites := os.Getenv(crashSyncEnv) == "true"
+	passed := 0
+	crash := func(name string) {
+		if name != point {
+			return
+		}
+		if passed++; passed == crashAfter || point == "recover-restored" || point == "recover-switched" {
+			syscall.Kill(os.Getpid(), syscall.SIGKILL)
+			select {}
+		}
+	}
+
+	if point == "update-before-apply" || point == "update-applied" {
+		crashPoint = crash
+		d := openCrashKV(t, 1, syncWrites)
+		applyCrashEntries(t, d, crashEntries)
+		t.Fatal("crash point never reached")
+	}
+
+	source := openCrashKV(t, 1, true)
+	applyCrashEntries(t, source, crashEntries)
+	ctx, err := source.PrepareSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot bytes.Buffer
+	if err := source.SaveSnapshot(ctx, &snapshot, nil); err != nil {
+		t.Fatal(err)
+	}
+	target := openCrashKV(t, 2, true)
+	applyCrashEntries(t, target, recoverBase)
+	crashPoint = crash
+	if err := target.RecoverFromSnapshot(&snapshot, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Fatal("crash point never reached")
+}
+
+func openCrashKV(t *testing.T, replicaID uint64, syncWrites bool) *DiskKV {
+	d := NewDiskKV(1, replicaID).(*DiskKV)
+	d.syncWrites = syncWrites
+	if _, err := d.Open(nil); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// applyCrashEntries applies an entry a batch, entry i writing crashRow(i).
+func applyCrashEntries(t *testing.T, d *DiskKV, count uint64) {
+	for i := uint64(1); i <= count; i++ {
+		cmd, err := KVData{Table: "t", Row: crashRow(i), Column: "v", Val: "x"}.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Update([]sm.Entry{{Index: i, Cmd: cmd}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func crashRow(i uint64) string {
+	return "k" + strconv.FormatUint(i, 10)
+}
+
+// TestSyncBarriers applies entries, or restores a snapshot, on a filesystem
+// dropping whatever wasn't synced when the db is reopened, as a power loss
+// would, and checks the synced state is consistent and complete.
+func TestSyncBarriers(t *testing.T) {
+	tests := []struct {
+		name       string
+		syncWrites bool
+		snapshot   bool
+		// minApplied is what must have survived losing the unsynced writes.
+		minApplied uint64
+	}{
+		{"update synced", true, false, crashEntries},
+		{"update unsynced", false, false, 0},
+		{"restored snapshot", false, true, crashEntries},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := vfs.NewStrictMem()
+			db, err := createDBOn(fs, "/db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the node dir is synced once the db is current, see
+			// saveCurrentDBDirName.
+			root, err := fs.OpenDir("/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := root.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			root.Close()
+			if tt.snapshot {
+				src := &DiskKV{db: unsafe.Pointer(openTestDB(t, "src")), syncWrites: true}
+				applyCrashEntries(t, src, crashEntries)
+				srcDB := (*pebbledb)(src.db)
+				ss := srcDB.db.NewSnapshot()
+				var buf bytes.Buffer
+				err := writeSnapshot(srcDB, ss, &buf)
+				ss.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := restoreSnapshot(db, &buf, make(chan struct{})); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				applyCrashEntries(t, &DiskKV{db: unsafe.Pointer(db), syncWrites: tt.syncWrites}, crashEntries)
+			}
+			fs.SetIgnoreSyncs(true)
+			db.close()
+			fs.ResetToSyncedState()
+			fs.SetIgnoreSyncs(false)
+
+			db, err = createDBOn(fs, "/db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.close()
+			d := &DiskKV{db: unsafe.Pointer(db)}
+			applied, err := d.queryAppliedIndex(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if applied < tt.minApplied {
+				t.Errorf("applied index %d after losing the unsynced writes, want at least %d", applied, tt.minApplied)
+			}
+			for i := uint64(1); i <= crashEntries; i++ {
+				row, err := d.lookupRow("t", crashRow(i), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if has := len(row.Columns) > 0; has != (i <= applied) {
+					t.Errorf("row %d present = %v at applied index %d", i, has, applied)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package multiraft
+
+import (
+	"encoding/binary"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// dedupPrefix keys the (client, sequence) pairs of the writes applied for
+// retrying clients, see KVData.Client.  The value is the index the write was
+// applied at followed by the unix nanoseconds it was proposed at.
+const dedupPrefix string = "\x00dedup:"
+
+func dedupKey(client string, seq uint64) []byte {
+	key := appendComponent([]byte(dedupPrefix), client)
+	return binary.BigEndian.AppendUint64(key, seq)
+}
+
+// dedupedIndex returns the index a client's write was applied at when it
+// already was, a retry is answered with it instead of being applied again.
+func dedupedIndex(wb *pebble.Batch, client string, seq uint64) (uint64, bool, error) {
+	val, closer, err := wb.Get(dedupKey(client, seq))
+	if err == pebble.ErrNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer closer.Close()
+	return binary.LittleEndian.Uint64(val), true, nil
+}
+
+func recordDedup(db *pebbledb, wb *pebble.Batch, kv *KVData, index uint64) {
+	val := binary.LittleEndian.AppendUint64(nil, index)
+	val = binary.LittleEndian.AppendUint64(val, uint64(kv.ProposedAt))
+	wb.Set(dedupKey(kv.Client, kv.Seq), val, db.wo)
+}
+
+// pruneDedup forgets the writes proposed before cutoff (unix nanoseconds),
+// retries of those are applied again.
+func pruneDedup(db *pebbledb, wb *pebble.Batch, cutoff uint64) error {
+	prefix := []byte(dedupPrefix)
+	iter := wb.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	for iter.First(); iter.Valid(); iter.Next() {
+		if val := iter.Value(); len(val) == 16 && binary.LittleEndian.Uint64(val[8:]) < cutoff {
+			wb.Delete(append([]byte(nil), iter.Key()...), db.wo)
+		}
+	}
+	return iter.Close()
+}
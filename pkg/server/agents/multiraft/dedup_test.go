@@ -0,0 +1,46 @@
+package multiraft
+
+import (
+	"testing"
+	"unsafe"
+
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func TestDedup_RetryAppliedOnce(t *testing.T) {
+	db := openTestDB(t, "dedup")
+	d := &DiskKV{db: unsafe.Pointer(db)}
+	entry := func(index uint64, kv KVData) []sm.Entry {
+		cmd, err := kv.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []sm.Entry{{Index: index, Cmd: cmd}}
+	}
+	write := KVData{Table: "t", Row: "r", Column: "c", Val: "1", Client: "c1", Seq: 7, ProposedAt: 100}
+	if _, err := d.Update(entry(1, write)); err != nil {
+		t.Fatal(err)
+	}
+	retry := write
+	retry.Val = "2" // would show if applied again
+	ents, err := d.Update(entry(2, retry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ents[0].Result.Value != 1 {
+		t.Errorf("retry result = %d, want the first index 1", ents[0].Result.Value)
+	}
+	val, closer, err := db.db.Get(encodeKey("t", "r", "c"))
+	if err != nil || string(val) != "1" {
+		t.Fatalf("value after retry = %q, %v, want 1", val, err)
+	}
+	closer.Close()
+
+	// once pruned the sequence is forgotten.
+	if _, err := d.Update(entry(3, KVData{Op: OpPruneDedup, Index: 101})); err != nil {
+		t.Fatal(err)
+	}
+	if ents, err = d.Update(entry(4, retry)); err != nil || ents[0].Result.Value != 4 {
+		t.Errorf("retry after pruning = %d, %v, want applied at 4", ents[0].Result.Value, err)
+	}
+}
@@ -17,13 +17,21 @@ import (
 	"unsafe"
 
 	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	machines "github.com/epsniff/expodb/pkg/server/state-machines"
 	"github.com/epsniff/expodb/pkg/server/state-machines/simplestore"
 
 	sm "github.com/lni/dragonboat/v4/statemachine"
+	"go.uber.org/zap"
 )
 
 const (
-	appliedIndexKey    string = "disk_kv_applied_index"
+	appliedIndexKey string = "disk_kv_applied_index"
+	tombstonePrefix string = "\x00tombstone:"
+	// machineStatePrefix keys the persisted state of named state machines.
+	machineStatePrefix string = "\x00sm:"
+	// writeFreezeKey holds the deadline of a cluster-wide write freeze.
+	writeFreezeKey     string = "\x00write_freeze"
 	testDBDirName      string = "example-data"
 	currentDBFilename  string = "current"
 	updatingDBFilename string = "current.updating"
@@ -52,9 +60,225 @@ func syncDir(dir string) (err error) {
 	return df.Sync()
 }
 
+// appliedIndexQuery asks the state machine for its last applied raft index.
+type appliedIndexQuery struct{}
+
+// WriteFreezeQuery asks the state machine for the deadline of the current
+// write freeze, the zero time when writes aren't frozen.
+type WriteFreezeQuery struct{}
+
+// RowQuery asks for a row's columns together with its version.  When
+// Columns is set only those columns are read.
+type RowQuery struct {
+	Table   string
+	Row     string
+	Columns []string
+}
+
+// Row is the result of a RowQuery.  Version is the raft index the row was
+// last modified at, 0 if it never was.
+type Row struct {
+	Columns map[string]string
+	Version uint64
+}
+
+// ScanPageQuery asks for up to Limit rows of Table, in key order, starting
+// after the row key After (from the start when empty).  Reverse scans in
+// descending order, from the end, After then being the row key to go below.
+type ScanPageQuery struct {
+	Table   string
+	After   string
+	Limit   int
+	Reverse bool
+}
+
+// TablesQuery asks for the names of the tables holding data, in order.
+type TablesQuery struct{}
+
+// ScanPage is the result of a ScanPageQuery, More is set when rows past the
+// last one returned exist.
+type ScanPage struct {
+	Rows []ScanRow
+	More bool
+}
+
+type ScanRow struct {
+	Key     string            `json:"key"`
+	Columns map[string]string `json:"columns"`
+	Version uint64            `json:"version,omitempty"`
+}
+
+var (
+	// resultWritesFrozen is returned as the result data of entries rejected
+	// because writes are frozen.
+	resultWritesFrozen = []byte("writes_frozen")
+	// resultPreconditionFailed is returned as the result data of entries
+	// whose IfMatch didn't match the row's version.
+	resultPreconditionFailed = []byte("precondition_failed")
+	// resultKeyExists is returned as the result data of IfAbsent entries
+	// whose column already existed.
+	resultKeyExists = []byte("key_exists")
+	// resultTxnConflict starts the result data of entries touching a row
+	// locked by a prepared transaction, see conflictResult.
+	resultTxnConflict = []byte("txn_conflict")
+)
+
+const (
+	// OpSet writes Val at Key, it is the zero value so older entries without
+	// an Op still decode as sets.
+	OpSet = ""
+	// OpDelete removes Key and leaves a tombstone behind.
+	OpDelete = "delete"
+	// OpDeleteRow removes every column stored under the row prefix Key.
+	OpDeleteRow = "delete_row"
+	// OpGCTombstones drops tombstones written at or before Index.  The
+	// leader only proposes it once every replica has applied past Index.
+	OpGCTombstones = "gc_tombstones"
+	// OpFreezeWrites rejects every following client write until it is
+	// proposed again with an empty Val.  Val is the RFC3339 deadline after
+	// which the leader lifts the freeze on its own.
+	OpFreezeWrites = "freeze_writes"
+	// OpSetRow writes every column in Columns to the row in one entry, so
+	// readers never see the row half written.
+	OpSetRow = "set_row"
+	// OpReplaceRow is OpSetRow but first deletes the columns of the row not
+	// in Columns.
+	OpReplaceRow = "replace_row"
+	// OpDeletePrefix deletes every row of Table whose key starts with Row.
+	OpDeletePrefix = "delete_prefix"
+	// OpDeleteWhere is OpDeletePrefix limited to the rows matching Filter.
+	OpDeleteWhere = "delete_where"
+	// OpDeleteRange deletes every row of Table whose key sorts at or after
+	// Row and before Val, an empty Val leaves the range open.
+	OpDeleteRange = "delete_range"
+	// OpResetReplica drops a partly staged standby snapshot, it starts every
+	// shipment from the primary.
+	OpResetReplica = "reset_replica"
+	// OpStageReplica stages Pairs of a standby snapshot.
+	OpStageReplica = "stage_replica"
+	// OpCommitReplica replaces the user data with the staged snapshot, Index
+	// is the primary's applied index the snapshot came from.
+	OpCommitReplica = "commit_replica"
+	// OpPromoteStandby turns a standby into a primary, snapshots staged
+	// before or after it are never committed.
+	OpPromoteStandby = "promote_standby"
+	// OpTxnPrepare locks the rows of Writes for transaction Txn and stages
+	// the writes, it is rejected when another transaction holds one of the
+	// rows.  Plain writes to locked rows are rejected too.
+	OpTxnPrepare = "txn_prepare"
+	// OpTxnCommit applies the staged writes of Txn and releases its locks.
+	OpTxnCommit = "txn_commit"
+	// OpTxnAbort drops the staged writes of Txn and releases its locks.
+	OpTxnAbort = "txn_abort"
+	// OpBatch applies Writes as plain writes in a single entry, e.g. the
+	// samples of a metrics push.  It isn't a transaction: it is rejected as a
+	// whole when one of the rows is locked, but doesn't lock any itself.
+	OpBatch = "batch"
+	// OpPruneDedup forgets the client writes proposed before Index, in unix
+	// nanoseconds, see KVData.Client.
+	OpPruneDedup = "prune_dedup"
+	// OpCreateIndex creates the index IndexDef and indexes the table's rows,
+	// OpDropIndex drops the index Row of Table.
+	OpCreateIndex = "create_index"
+	OpDropIndex   = "drop_index"
+	// OpBackfillIndex indexes the next rows of the index Row of Table, when
+	// it was backfilled up to the row Val.  The leader proposes them.
+	OpBackfillIndex = "backfill_index"
+	// OpSetCascade adds or replaces the cascade rule Cascade, OpDropCascade
+	// drops the rule Row of Table.
+	OpSetCascade  = "set_cascade"
+	OpDropCascade = "drop_cascade"
+	// OpSetTrigger attaches the trigger Trigger to its table or changes its
+	// args, OpDropTrigger detaches the trigger Row from Table.
+	OpSetTrigger  = "set_trigger"
+	OpDropTrigger = "drop_trigger"
+	// OpSetSchema gives a table without one the schema Schema, OpDropSchema
+	// drops the schema of Table, abandoning a change in flight.
+	OpSetSchema  = "set_schema"
+	OpDropSchema = "drop_schema"
+	// OpChangeSchema puts SchemaChange in flight on Table, OpSchemaStep
+	// moves it forward when it is at step Index.  The leader proposes the
+	// steps.
+	OpChangeSchema = "change_schema"
+	OpSchemaStep   = "schema_step"
+	// OpSetSink registers the sink Sink or changes it, OpDropSink drops the
+	// sink Row.  OpAckSink moves the offset of the sink Row to Index once
+	// the leader delivered the outbox entries up to it.
+	OpSetSink  = "set_sink"
+	OpDropSink = "drop_sink"
+	OpAckSink  = "ack_sink"
+	// OpPurge removes every trace of the row Row of Table from the store,
+	// leaving no tombstone, and records the purge, see purgeRow.
+	OpPurge = "purge"
+	// OpSetArchive ships the raft log to the archive at Val, OpDropArchive
+	// stops shipping it.  OpAckArchive moves the archive's offset to Index
+	// once the leader shipped the entries up to it.
+	OpSetArchive  = "set_archive"
+	OpDropArchive = "drop_archive"
+	OpAckArchive  = "ack_archive"
+)
+
+// KVData is a KV store raft entry.  Table, Row and Column address the data,
+// an empty Column with OpDeleteRow addresses the whole row.  Key is only set
+// by entries written before the key layout change, as "table:row:column".
 type KVData struct {
-	Key string
-	Val string
+	Op     string `json:",omitempty"`
+	Key    string `json:",omitempty"`
+	Table  string `json:",omitempty"`
+	Row    string `json:",omitempty"`
+	Column string `json:",omitempty"`
+	Val    string
+	// Columns holds the column values of OpSetRow and OpReplaceRow.
+	Columns map[string]string `json:",omitempty"`
+	Index   uint64            `json:",omitempty"`
+	// IfMatch, when set, only applies the entry if the row's version is
+	// still IfMatch.  0 means the row must never have been written.
+	IfMatch *uint64 `json:",omitempty"`
+	// IfAbsent only applies an OpSet if Column doesn't exist yet.
+	IfAbsent bool `json:",omitempty"`
+	// Filter selects the rows deleted by OpDeleteWhere.
+	Filter *RowFilter `json:",omitempty"`
+	// Pairs holds the raw keys and values of OpStageReplica.
+	Pairs []KVPair `json:",omitempty"`
+	// Txn is the transaction ID of the OpTxn ops, Writes the writes prepared
+	// (or applied by OpBatch).
+	Txn    string     `json:",omitempty"`
+	Writes []TxnWrite `json:",omitempty"`
+	// Reads, when set, only applies an OpBatch if none of the rows it read
+	// were modified since, see RowRead.
+	Reads []RowRead `json:",omitempty"`
+	// IndexDef is the index OpCreateIndex creates.
+	IndexDef *IndexDef `json:",omitempty"`
+	// Cascade is the rule OpSetCascade sets.
+	Cascade *CascadeRule `json:",omitempty"`
+	// Trigger is the trigger OpSetTrigger attaches.
+	Trigger *TableTrigger `json:",omitempty"`
+	// Schema and SchemaChange are those of OpSetSchema and OpChangeSchema.
+	Schema       *TableSchema  `json:",omitempty"`
+	SchemaChange *SchemaChange `json:",omitempty"`
+	// Sink is the sink OpSetSink registers.
+	Sink *Sink `json:",omitempty"`
+	// Stats are the statistics OpSetStats records.
+	Stats *TableStats `json:",omitempty"`
+	// RequestID is the ID of the client request proposing the entry, so its
+	// apply can be found in the logs of every replica.
+	RequestID string `json:",omitempty"`
+	// Client and Seq identify a client write, so a retried one is answered
+	// with the index it was first applied at instead of being applied again.
+	// ProposedAt, in unix nanoseconds, is when the proposer first saw it.
+	Client     string `json:",omitempty"`
+	Seq        uint64 `json:",omitempty"`
+	ProposedAt int64  `json:",omitempty"`
+}
+
+// upgradeLegacyKey fills in Table, Row and Column of entries written with
+// the old "table:row:column" Key.
+func (k *KVData) upgradeLegacyKey() {
+	if k.Key == "" {
+		return
+	}
+	k.Table, k.Row, k.Column = splitLegacyKey(k.Key)
+	k.Key = ""
 }
 
 func (k KVData) Marshal() ([]byte, error) {
@@ -75,24 +299,45 @@ type pebbledb struct {
 	wo     *pebble.WriteOptions
 	syncwo *pebble.WriteOptions
 	closed bool
+	// refs counts the compactions running outside mu, close waits for them.
+	refs sync.WaitGroup
+	// stalls counts write stalls, see StorageStats.
+	stalls *atomic.Uint64
 }
 
-func (r *pebbledb) lookup(query []byte) (map[string]string, error) {
+func (r *pebbledb) lookup(table, row string, columns []string) (*Row, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 	if r.closed {
 		return nil, errors.New("db already closed")
 	}
-	iter := r.db.NewIter(&pebble.IterOptions{LowerBound: query, UpperBound: append(query, 0xff)})
-	resp := map[string]string{}
-	prefix := append(query, ':')
-	for iter.First(); iter.Valid(); iter.Next() {
-		if bytes.Contains(iter.Key(), prefix) {
-			key := make([]byte, len(iter.Key())-len(prefix))
-			copy(key, iter.Key()[len(prefix):])
-			val := make([]byte, len(iter.Value()))
-			copy(val, iter.Value())
-			resp[string(key)] = string(val)
+	prefix := encodeRowPrefix(table, row)
+	versionKey := rowVersionKey(table, row)
+	iter := r.db.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	resp := &Row{Columns: map[string]string{}}
+	if len(columns) > 0 {
+		// seek straight to the wanted columns, the iterator gives them and
+		// the version a consistent view of the row.
+		if iter.SeekGE(versionKey) && bytes.Equal(iter.Key(), versionKey) {
+			resp.Version = binary.LittleEndian.Uint64(iter.Value())
+		}
+		for _, column := range columns {
+			key := encodeKey(table, row, column)
+			if iter.SeekGE(key) && bytes.Equal(iter.Key(), key) {
+				resp.Columns[column] = string(iter.Value())
+			}
+		}
+	} else {
+		for iter.First(); iter.Valid(); iter.Next() {
+			if bytes.Equal(iter.Key(), versionKey) {
+				resp.Version = binary.LittleEndian.Uint64(iter.Value())
+				continue
+			}
+			column, ok := decodeColumn(iter.Key(), prefix)
+			if !ok {
+				continue
+			}
+			resp.Columns[column] = string(iter.Value())
 		}
 	}
 	if err := iter.Error(); err != nil {
@@ -101,13 +346,131 @@ func (r *pebbledb) lookup(query []byte) (map[string]string, error) {
 	if err := iter.Close(); err != nil {
 		return nil, err
 	}
-	if len(resp) == 0 {
-		return nil, pebble.ErrNotFound
+	if len(resp.Columns) == 0 {
+		return resp, pebble.ErrNotFound
 	}
 
 	return resp, nil
 }
 
+// scan returns every row stored under the table prefix, keyed by row key
+// and then column.
+func (r *pebbledb) scan(table string) (map[string]map[string]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil, errors.New("db already closed")
+	}
+	prefix := encodeTablePrefix(table)
+	iter := r.db.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	rows := map[string]map[string]string{}
+	for iter.First(); iter.Valid(); iter.Next() {
+		_, rowkey, column, ok := decodeKey(iter.Key())
+		if !ok {
+			continue
+		}
+		row, ok := rows[rowkey]
+		if !ok {
+			row = map[string]string{}
+			rows[rowkey] = row
+		}
+		row[column] = string(iter.Value())
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// scanPage returns up to limit rows of table with a key greater than after.
+func (r *pebbledb) scanPage(table, after string, limit int, reverse bool) (*ScanPage, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil, errors.New("db already closed")
+	}
+	prefix := encodeTablePrefix(table)
+	opts := &pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)}
+	if after != "" && reverse {
+		opts.UpperBound = encodeRowPrefix(table, after)
+	} else if after != "" {
+		opts.LowerBound = prefixUpperBound(encodeRowPrefix(table, after))
+	}
+	iter := r.db.NewIter(opts)
+	first, next := iter.First, iter.Next
+	if reverse {
+		first, next = iter.Last, iter.Prev
+	}
+	page := &ScanPage{}
+	// the row version sorts before every column but the empty one, it is
+	// held until the row's first column shows the row isn't deleted.  In
+	// reverse it comes after all of them but the empty one, so the same
+	// holds.
+	var versionRow string
+	var version uint64
+	for first(); iter.Valid(); next() {
+		_, rowkey, column, ok := decodeKey(iter.Key())
+		if !ok {
+			if row, ok := decodeRowVersionKey(iter.Key()); ok && len(iter.Value()) == 8 {
+				versionRow, version = row, binary.LittleEndian.Uint64(iter.Value())
+				if n := len(page.Rows); n > 0 && page.Rows[n-1].Key == row {
+					page.Rows[n-1].Version = version
+				}
+			}
+			continue
+		}
+		if n := len(page.Rows); n == 0 || page.Rows[n-1].Key != rowkey {
+			if n == limit {
+				page.More = true
+				break
+			}
+			page.Rows = append(page.Rows, ScanRow{Key: rowkey, Columns: map[string]string{}})
+			if versionRow == rowkey {
+				page.Rows[n].Version = version
+			}
+		}
+		page.Rows[len(page.Rows)-1].Columns[column] = string(iter.Value())
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// tables seeks from table to table rather than reading every key.  Tables
+// left with only the versions of deleted rows aren't listed.
+func (r *pebbledb) tables() ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil, errors.New("db already closed")
+	}
+	iter := r.db.NewIter(&pebble.IterOptions{LowerBound: []byte{dataKeyPrefix}, UpperBound: []byte{dataKeyPrefix + 1}})
+	var tables []string
+	for iter.First(); iter.Valid(); {
+		table, ok := decodeTable(iter.Key())
+		if _, _, _, isColumn := decodeKey(iter.Key()); !ok || !isColumn {
+			iter.Next()
+			continue
+		}
+		tables = append(tables, table)
+		iter.SeekGE(prefixUpperBound(encodeTablePrefix(table)))
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return tables, nil
+}
+
 // Example using simple Get
 // func (r *pebbledb) lookup(query []byte) ([]byte, error) {
 // 	r.mu.RLock()
@@ -130,8 +493,13 @@ func (r *pebbledb) lookup(query []byte) (map[string]string, error) {
 
 func (r *pebbledb) close() {
 	r.mu.Lock()
-	defer r.mu.Unlock()
+	closed := r.closed
 	r.closed = true
+	r.mu.Unlock()
+	if closed {
+		return
+	}
+	r.refs.Wait()
 	if r.db != nil {
 		r.db.Close()
 	}
@@ -139,14 +507,23 @@ func (r *pebbledb) close() {
 
 // createDB creates a PebbleDB DB in the specified directory.
 func createDB(dbdir string) (*pebbledb, error) {
+	return createDBOn(vfs.Default, dbdir)
+}
+
+// createDBOn is createDB on fs, the sync tests use one dropping the writes
+// never synced.
+func createDBOn(fs vfs.FS, dbdir string) (*pebbledb, error) {
 	ro := &pebble.IterOptions{}
 	wo := &pebble.WriteOptions{Sync: false}
 	syncwo := &pebble.WriteOptions{Sync: true}
 	cache := pebble.NewCache(0)
+	stalls := &atomic.Uint64{}
 	opts := &pebble.Options{
 		MaxManifestFileSize: 1024 * 32,
 		MemTableSize:        1024 * 32,
 		Cache:               cache,
+		EventListener:       stallCounter(stalls),
+		FS:                  fs,
 		//Merger: &pebble.Merger{
 		//	Name: "custommerger",
 		//	Merge: func(key, value []byte) (pebble.ValueMerger, error) {
@@ -154,7 +531,7 @@ func createDB(dbdir string) (*pebbledb, error) {
 		//	},
 		//},
 	}
-	if err := os.MkdirAll(dbdir, 0755); err != nil {
+	if err := fs.MkdirAll(dbdir, 0755); err != nil {
 		return nil, err
 	}
 	db, err := pebble.Open(dbdir, opts)
@@ -167,6 +544,7 @@ func createDB(dbdir string) (*pebbledb, error) {
 		ro:     ro,
 		wo:     wo,
 		syncwo: syncwo,
+		stalls: stalls,
 	}, nil
 }
 
@@ -306,17 +684,98 @@ type DiskKV struct {
 	db          unsafe.Pointer
 	closed      bool
 	aborted     bool
+	// syncWrites fsyncs every Update batch.  When false, writes are only
+	// made durable when dragonboat calls Sync().
+	syncWrites bool
+	// machines are the named state machines hosted next to the KV store,
+	// keyed by fsm type and by name.
+	machines       map[uint16]*namedMachine
+	machinesByName map[string]*namedMachine
+	// replay is told the index the FSM opened at, may be nil.
+	replay *replayState
+	// snapshots records how long snapshots take, may be nil.
+	snapshots *snapshotStats
+	// triggers are Config.Triggers, by name.
+	triggers map[string]TriggerFunc
+	// onApply is Config.OnApply, may be nil.
+	onApply func(index uint64, kv KVData)
+	// logger is Config.Logger, may be nil.
+	logger *zap.Logger
+	// recording is set while sinks are registered, Update then collects the
+	// changes of each entry into changes for the outbox.
+	recording bool
+	changes   []Change
+	// archive is set while the log is archived, Update then records the
+	// command of each entry for it.
+	archive *ArchiveState
 }
 
-// NewDiskKV creates a new disk kv test state machine.
+// namedMachine is an in-memory state machine whose whole state is persisted
+// into pebble, next to the KV data, every time an update batch touches it.
+type namedMachine struct {
+	reg machines.Registration
+	sm  machines.StateMachine
+}
+
+func (m *namedMachine) stateKey() []byte {
+	return []byte(machineStatePrefix + m.reg.Name)
+}
+
+// NewDiskKV creates a new disk kv test state machine that fsyncs every update.
 func NewDiskKV(clusterID uint64, nodeID uint64) sm.IOnDiskStateMachine {
 	d := &DiskKV{
-		clusterID: clusterID,
-		nodeID:    nodeID,
+		clusterID:  clusterID,
+		nodeID:     nodeID,
+		syncWrites: true,
 	}
 	return d
 }
 
+// newDiskKVFactory returns a DiskKV constructor using the agent's fsync
+// policy and hosting its registered state machines.
+func newDiskKVFactory(config Config, replay *replayState, snapshots *snapshotStats) sm.CreateOnDiskStateMachineFunc {
+	return func(clusterID uint64, nodeID uint64) sm.IOnDiskStateMachine {
+		d := &DiskKV{
+			clusterID:      clusterID,
+			nodeID:         nodeID,
+			syncWrites:     config.SyncWrites,
+			machines:       map[uint16]*namedMachine{},
+			machinesByName: map[string]*namedMachine{},
+			replay:         replay,
+			snapshots:      snapshots,
+			triggers:       config.Triggers,
+			onApply:        config.OnApply,
+			logger:         config.Logger,
+		}
+		for _, reg := range config.StateMachines {
+			m := &namedMachine{reg: reg, sm: reg.New()}
+			d.machines[reg.Key] = m
+			d.machinesByName[reg.Name] = m
+		}
+		return d
+	}
+}
+
+// restoreMachines loads the persisted state of every named state machine
+// from db, machines with nothing persisted start empty.
+func (d *DiskKV) restoreMachines(db *pebbledb) error {
+	for _, m := range d.machines {
+		val, closer, err := db.db.Get(m.stateKey())
+		if err == pebble.ErrNotFound {
+			m.sm = m.reg.New()
+			continue
+		} else if err != nil {
+			return err
+		}
+		err = m.sm.Restore(val)
+		closer.Close()
+		if err != nil {
+			return fmt.Errorf("restoring state machine %s: %w", m.reg.Name, err)
+		}
+	}
+	return nil
+}
+
 func (d *DiskKV) queryAppliedIndex(db *pebbledb) (uint64, error) {
 	val, closer, err := db.db.Get([]byte(appliedIndexKey))
 	if err != nil && err != pebble.ErrNotFound {
@@ -369,24 +828,238 @@ func (d *DiskKV) Open(stopc <-chan struct{}) (uint64, error) {
 		return 0, err
 	}
 	atomic.SwapPointer(&d.db, unsafe.Pointer(db))
+	if err := migrateKeyLayout(db); err != nil {
+		return 0, err
+	}
+	if err := d.restoreMachines(db); err != nil {
+		return 0, err
+	}
 	appliedIndex, err := d.queryAppliedIndex(db)
 	if err != nil {
 		panic(err)
 	}
-	d.lastApplied = appliedIndex
+	atomic.StoreUint64(&d.lastApplied, appliedIndex)
+	if d.replay != nil {
+		d.replay.opened.Store(appliedIndex)
+	}
 	return appliedIndex, nil
 }
 
 // Lookup queries the state machine.
 func (d *DiskKV) Lookup(e interface{}) (interface{}, error) {
+	if _, ok := e.(appliedIndexQuery); ok {
+		return atomic.LoadUint64(&d.lastApplied), nil
+	}
+	if named, ok := e.(machines.NamedQuery); ok {
+		m, ok := d.machinesByName[named.Machine]
+		if !ok {
+			return nil, fmt.Errorf("unknown state machine %q", named.Machine)
+		}
+		return m.sm.Lookup(named.Query)
+	}
+	if _, ok := e.(WriteFreezeQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.writeFreeze()
+	}
+	if export, ok := e.(ExportQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.export(export.W)
+	}
+	if export, ok := e.(TableExportQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.exportTable(export)
+	}
+	if _, ok := e.(TxnIntentsQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.txnIntents()
+	}
+	if _, ok := e.(StandbyQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.standbyState()
+	}
+	if _, ok := e.(IndexesQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.indexes()
+	}
+	if query, ok := e.(constrainedQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.hasConstraints(query.tables)
+	}
+	if _, ok := e.(CascadesQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.cascades()
+	}
+	if _, ok := e.(TriggersQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.triggers()
+	}
+	if query, ok := e.(validateQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.validate(query.kv, d.triggers)
+	}
+	if _, ok := e.(SchemasQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.schemas()
+	}
+	if query, ok := e.(SelectQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.selectRows(query)
+	}
+	if query, ok := e.(AnalyzeQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.analyze(query.Table)
+	}
+	if _, ok := e.(StatsQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.stats()
+	}
+	if query, ok := e.(ExplainQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.explainSelect(query.Select)
+	}
+	if _, ok := e.(StorageStatsQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.storageStats()
+	}
+	if compact, ok := e.(CompactQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.compact(compact.Table)
+	}
+	if _, ok := e.(PurgesQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.purges()
+	}
+	if _, ok := e.(SinksQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.sinks()
+	}
+	if _, ok := e.(ArchiveQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.archive()
+	}
+	if query, ok := e.(ArchiveLogQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.archiveLog(query)
+	}
+	if query, ok := e.(OutboxQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.outbox(query)
+	}
+	if _, ok := e.(TablesQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.tables()
+	}
+	if scan, ok := e.(ScanPageQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.scanPage(scan.Table, scan.After, scan.Limit, scan.Reverse)
+	}
+	if list, ok := e.(ListKeysQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.listKeys(list)
+	}
+	if scan, ok := e.(simplestore.ScanQuery); ok {
+		db := (*pebbledb)(atomic.LoadPointer(&d.db))
+		if db == nil {
+			return nil, errors.New("db closed")
+		}
+		return db.scan(scan.Table)
+	}
+	if query, ok := e.(RowQuery); ok {
+		return d.lookupRow(query.Table, query.Row, query.Columns)
+	}
 	query, ok := e.(simplestore.Query)
 	if !ok {
-		return nil, fmt.Errorf("invalid query %#v", e)
+		return nil, fmt.Errorf("invalid query %T", e)
+	}
+	row, err := d.lookupRow(query.Table, query.RowKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(row.Columns) == 0 {
+		return map[string]string(nil), nil
 	}
-	key := query.Table + ":" + query.RowKey
+	return row.Columns, nil
+}
+
+func (d *DiskKV) lookupRow(table, row string, columns []string) (*Row, error) {
 	db := (*pebbledb)(atomic.LoadPointer(&d.db))
 	if db != nil {
-		v, err := db.lookup([]byte(key))
+		v, err := db.lookup(table, row, columns)
 		if err == nil && d.closed {
 			panic("lookup returned valid result when DiskKV is already closed")
 		}
@@ -398,12 +1071,18 @@ func (d *DiskKV) Lookup(e interface{}) (interface{}, error) {
 	return nil, errors.New("db closed")
 }
 
+// crashPoint is called where Update and RecoverFromSnapshot must survive the
+// process dying, the crash tests kill it there.
+var crashPoint = func(name string) {}
+
 // Update updates the state machine. In this example, all updates are put into
 // a PebbleDB write batch and then atomically written to the DB together with
-// the index of the last Raft Log entry. For simplicity, we always Sync the
-// writes (db.wo.Sync=True). To get higher throughput, you can implement the
-// Sync() method below and choose not to synchronize for every Update(). Sync()
-// will periodically called by Dragonboat to synchronize the state.
+// the index of the last Raft Log entry. By default we Sync the writes
+// (db.wo.Sync=True). When syncWrites is off we skip that fsync for higher
+// throughput and rely on Sync() below, which Dragonboat calls periodically, to
+// synchronize the state.  Either way the applied index is never persisted
+// ahead of the data it covers, or behind it: a crash loses whole batches from
+// the end of the WAL at most, which raft replays.
 func (d *DiskKV) Update(ents []sm.Entry) ([]sm.Entry, error) {
 	if d.aborted {
 		panic("update() called after abort set to true")
@@ -412,37 +1091,658 @@ func (d *DiskKV) Update(ents []sm.Entry) ([]sm.Entry, error) {
 		panic("update called after Close()")
 	}
 	db := (*pebbledb)(atomic.LoadPointer(&d.db))
-	wb := db.db.NewBatch()
+	// indexed so deletes by prefix also see writes earlier in the batch.
+	wb := db.db.NewIndexedBatch()
 	defer wb.Close()
+	touched := map[*namedMachine]struct{}{}
+	// the entries passed to onApply once the batch is persisted.
+	var applied []uint64
+	var appliedKVs []KVData
+	frozen, err := isFrozen(wb)
+	if err != nil {
+		return nil, err
+	}
+	if d.recording, err = hasSinks(wb); err != nil {
+		return nil, err
+	}
+	if d.archive, err = readArchive(wb); err != nil {
+		return nil, err
+	}
 	for idx, e := range ents {
+		if key, payload, ok := machines.DecodeEntry(e.Cmd); ok {
+			if d.archive != nil {
+				if err := recordArchive(db, wb, d.archive, e); err != nil {
+					return nil, err
+				}
+			}
+			if frozen {
+				ents[idx].Result = sm.Result{Data: resultWritesFrozen}
+				continue
+			}
+			m, ok := d.machines[key]
+			if !ok {
+				panic(fmt.Sprintf("Raft log entry for unregistered state machine type %d. This is a bug.", key))
+			}
+			if _, err := m.sm.Apply(payload); err != nil {
+				return nil, fmt.Errorf("applying to state machine %s: %w", m.reg.Name, err)
+			}
+			touched[m] = struct{}{}
+			ents[idx].Result = sm.Result{Value: e.Index}
+			continue
+		}
 		dataKV := &KVData{}
 		if err := json.Unmarshal(e.Cmd, dataKV); err != nil {
 			panic(err)
 		}
-		wb.Set([]byte(dataKV.Key), []byte(dataKV.Val), db.wo)
-		ents[idx].Result = sm.Result{Value: uint64(len(ents[idx].Cmd))}
+		dataKV.upgradeLegacyKey()
+		// every entry is archived, rejected or not, so a restore replays
+		// the log as it was applied.  Not the acknowledgements: shipping
+		// them would need another one.
+		if d.archive != nil && dataKV.Op != OpAckArchive {
+			if err := recordArchive(db, wb, d.archive, e); err != nil {
+				return nil, err
+			}
+		}
+		// a retry of a write already applied gets the same answer.
+		if dataKV.Client != "" {
+			index, applied, err := dedupedIndex(wb, dataKV.Client, dataKV.Seq)
+			if err != nil {
+				return nil, err
+			}
+			if applied {
+				ents[idx].Result = sm.Result{Value: index}
+				continue
+			}
+		}
+		if rejected, err := rejection(wb, dataKV, frozen, d.triggers); err != nil {
+			return nil, err
+		} else if rejected != nil {
+			d.logEntry(e.Index, dataKV, rejected)
+			ents[idx].Result = sm.Result{Data: rejected}
+			continue
+		}
+		d.changes = d.changes[:0]
+		if dataKV.Op == OpTxnPrepare {
+			conflict, err := prepareTxn(db, wb, dataKV)
+			if err != nil {
+				return nil, err
+			}
+			if conflict != nil {
+				ents[idx].Result = sm.Result{Data: conflictResult(conflict)}
+				continue
+			}
+		} else if err := d.applyKV(db, wb, dataKV, e.Index); err != nil {
+			return nil, err
+		}
+		if dataKV.Op == OpFreezeWrites {
+			frozen = dataKV.Val != ""
+		}
+		if d.recording {
+			if err := recordOutbox(db, wb, e.Index, d.changes); err != nil {
+				return nil, err
+			}
+		}
+		if dataKV.Op == OpSetSink || dataKV.Op == OpDropSink {
+			if d.recording, err = hasSinks(wb); err != nil {
+				return nil, err
+			}
+		}
+		if dataKV.Op == OpSetArchive || dataKV.Op == OpDropArchive {
+			if d.archive, err = readArchive(wb); err != nil {
+				return nil, err
+			}
+		}
+		if dataKV.Client != "" {
+			recordDedup(db, wb, dataKV, e.Index)
+		}
+		d.logEntry(e.Index, dataKV, nil)
+		if d.onApply != nil {
+			applied = append(applied, e.Index)
+			appliedKVs = append(appliedKVs, *dataKV)
+		}
+		// the entry's index is handed back to the proposer so clients can
+		// ask followers for reads at least this fresh.
+		ents[idx].Result = sm.Result{Value: e.Index}
+	}
+	// persist the named state machines alongside the KV data, so they move
+	// forward atomically with the applied index.
+	for m := range touched {
+		state, err := m.sm.Persist()
+		if err != nil {
+			return nil, err
+		}
+		wb.Set(m.stateKey(), state, db.wo)
 	}
 	// save the applied index to the DB.
 	appliedIndex := make([]byte, 8)
 	binary.LittleEndian.PutUint64(appliedIndex, ents[len(ents)-1].Index)
 	wb.Set([]byte(appliedIndexKey), appliedIndex, db.wo)
-	if err := db.db.Apply(wb, db.syncwo); err != nil {
+	writeOpts := db.wo
+	if d.syncWrites {
+		writeOpts = db.syncwo
+	}
+	crashPoint("update-before-apply")
+	if err := db.db.Apply(wb, writeOpts); err != nil {
 		return nil, err
 	}
-	if d.lastApplied >= ents[len(ents)-1].Index {
+	crashPoint("update-applied")
+	if atomic.LoadUint64(&d.lastApplied) >= ents[len(ents)-1].Index {
 		panic("lastApplied not moving forward")
 	}
-	d.lastApplied = ents[len(ents)-1].Index
+	atomic.StoreUint64(&d.lastApplied, ents[len(ents)-1].Index)
+	for i, index := range applied {
+		d.onApply(index, appliedKVs[i])
+	}
 	return ents, nil
 }
 
-// Sync synchronizes all in-core state of the state machine. Since the Update
-// method in this example already does that every time when it is invoked, the
-// Sync method here is a NoOP.
-func (d *DiskKV) Sync() error {
+// logEntry logs an applied or rejected entry at debug level, with the
+// request ID it carries.
+func (d *DiskKV) logEntry(index uint64, kv *KVData, rejected []byte) {
+	if d.logger == nil {
+		return
+	}
+	msg := "applied entry"
+	if rejected != nil {
+		msg = "rejected entry"
+	}
+	ce := d.logger.Check(zap.DebugLevel, msg)
+	if ce == nil {
+		return
+	}
+	op := kv.Op
+	if op == OpSet {
+		op = "set"
+	}
+	fields := []zap.Field{
+		zap.Uint64("shard", d.clusterID),
+		zap.Uint64("replica", d.nodeID),
+		zap.Uint64("index", index),
+		zap.String("op", op),
+		zap.String("table", kv.Table),
+		zap.String("request_id", kv.RequestID),
+	}
+	if rejected != nil {
+		if err := resultError(rejected); err != nil {
+			fields = append(fields, zap.Error(err))
+		}
+	}
+	ce.Write(fields...)
+}
+
+// rejection returns the result data of an entry rejected before anything of
+// it is applied, nil when it is accepted.  It first runs the triggers, which
+// may rewrite the entry, so the checks see the columns they compute.
+func rejection(wb *pebble.Batch, kv *KVData, frozen bool, triggers map[string]TriggerFunc) ([]byte, error) {
+	if frozen && !exemptFromFreeze(kv) {
+		return resultWritesFrozen, nil
+	}
+	if kv.IfMatch != nil {
+		version, err := rowVersion(wb, kv.Table, kv.Row)
+		if err != nil {
+			return nil, err
+		}
+		if version != *kv.IfMatch {
+			return resultPreconditionFailed, nil
+		}
+	}
+	for _, read := range kv.Reads {
+		version, err := rowVersion(wb, read.Table, read.Row)
+		if err != nil {
+			return nil, err
+		}
+		if version != read.Version {
+			return resultPreconditionFailed, nil
+		}
+	}
+	if kv.IfAbsent {
+		if _, closer, err := wb.Get(encodeKey(kv.Table, kv.Row, kv.Column)); err == nil {
+			closer.Close()
+			return resultKeyExists, nil
+		} else if err != pebble.ErrNotFound {
+			return nil, err
+		}
+	}
+	if rejected, err := runTriggers(wb, kv, triggers); err != nil || rejected != nil {
+		if rejected != nil {
+			return triggerResult(rejected), nil
+		}
+		return nil, err
+	}
+	if conflict, err := checkTxnLocks(wb, kv); err != nil || conflict != nil {
+		if conflict != nil {
+			return conflictResult(conflict), nil
+		}
+		return nil, err
+	}
+	if violation, conflict, err := checkUnique(wb, kv); err != nil {
+		return nil, err
+	} else if violation != nil {
+		return violationResult(violation), nil
+	} else if conflict != nil {
+		return conflictResult(conflict), nil
+	}
+	if violation, err := checkSchema(wb, kv); err != nil || violation != nil {
+		if violation != nil {
+			return schemaResult(violation), nil
+		}
+		return nil, err
+	}
+	return nil, nil
+}
+
+// applyKV adds the effects of a single entry to the write batch.
+func (d *DiskKV) applyKV(db *pebbledb, wb *pebble.Batch, kv *KVData, index uint64) (err error) {
+	if d.recording {
+		if c, ok := kv.change(); ok {
+			d.changes = append(d.changes, c)
+		}
+	}
+	switch kv.Op {
+	case OpSet, OpDelete, OpDeleteRow, OpSetRow, OpReplaceRow:
+		version := make([]byte, 8)
+		binary.LittleEndian.PutUint64(version, index)
+		wb.Set(rowVersionKey(kv.Table, kv.Row), version, db.wo)
+		// the row's index entries follow its columns once they are written.
+		ix, ierr := indexRow(wb, kv.Table, kv.Row)
+		if ierr != nil {
+			return ierr
+		}
+		defer func() {
+			if err == nil {
+				err = ix.update(db, wb)
+			}
+		}()
+	}
+	switch kv.Op {
+	case OpSet:
+		key := encodeKey(kv.Table, kv.Row, kv.Column)
+		wb.Set(key, []byte(kv.Val), db.wo)
+		// the key is live again, its old tombstone is meaningless.
+		wb.Delete(tombstoneKey(key), db.wo)
+	case OpDelete:
+		deleteWithTombstone(db, wb, encodeKey(kv.Table, kv.Row, kv.Column), index)
+		return dropEmptyRowVersion(db, wb, kv.Table, kv.Row)
+	case OpDeleteRow:
+		if err := deleteRow(db, wb, kv.Table, kv.Row, nil, index); err != nil {
+			return err
+		}
+		wb.Delete(rowVersionKey(kv.Table, kv.Row), db.wo)
+		return cascadeDeletes(db, wb, kv.Table, []string{kv.Row}, index, 0)
+	case OpDeletePrefix, OpDeleteWhere:
+		if kv.Op == OpDeleteWhere && kv.Filter == nil {
+			return nil // never proposed, Validate requires a filter
+		}
+		rows, err := deleteRowsWhere(db, wb, kv.Table, kv.Row, kv.Filter, index)
+		if err != nil {
+			return err
+		}
+		return cascadeDeletes(db, wb, kv.Table, rows, index, 0)
+	case OpDeleteRange:
+		lower, upper := rowRange(kv.Table, kv.Row, kv.Val)
+		rows, err := deleteRowRange(db, wb, kv.Table, lower, upper, nil, index)
+		if err != nil {
+			return err
+		}
+		return cascadeDeletes(db, wb, kv.Table, rows, index, 0)
+	case OpSetCascade:
+		if kv.Cascade == nil {
+			return nil // never proposed, SetCascade requires a rule
+		}
+		return setCascade(db, wb, kv.Cascade)
+	case OpDropCascade:
+		wb.Delete(cascadeKey(kv.Table, kv.Row), db.wo)
+	case OpSetTrigger:
+		if kv.Trigger == nil {
+			return nil // never proposed, SetTrigger requires a trigger
+		}
+		return setTrigger(db, wb, kv.Trigger)
+	case OpDropTrigger:
+		wb.Delete(triggerKey(kv.Table, kv.Row), db.wo)
+	case OpSetSchema:
+		if kv.Schema == nil {
+			return nil // never proposed, SetSchema requires a schema
+		}
+		return putSchema(db, wb, kv.Schema)
+	case OpDropSchema:
+		wb.Delete(schemaKey(kv.Table), db.wo)
+	case OpChangeSchema:
+		if kv.SchemaChange == nil {
+			return nil // never proposed, ChangeSchema requires a change
+		}
+		return changeSchema(db, wb, kv.Table, kv.SchemaChange)
+	case OpSchemaStep:
+		return schemaStep(db, wb, kv.Table, kv.Index, index)
+	case OpSetRow, OpReplaceRow:
+		if kv.Op == OpReplaceRow {
+			if err := deleteRow(db, wb, kv.Table, kv.Row, kv.Columns, index); err != nil {
+				return err
+			}
+		}
+		for column, val := range kv.Columns {
+			key := encodeKey(kv.Table, kv.Row, column)
+			wb.Set(key, []byte(val), db.wo)
+			wb.Delete(tombstoneKey(key), db.wo)
+		}
+	case OpGCTombstones:
+		prefix := []byte(tombstonePrefix)
+		iter := wb.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+		type tableRow struct{ table, row string }
+		var rows []tableRow
+		for iter.First(); iter.Valid(); iter.Next() {
+			if binary.LittleEndian.Uint64(iter.Value()) <= kv.Index {
+				wb.Delete(append([]byte(nil), iter.Key()...), db.wo)
+				table, row, _, ok := decodeKey(iter.Key()[len(prefix):])
+				if ok && (len(rows) == 0 || rows[len(rows)-1] != tableRow{table, row}) {
+					rows = append(rows, tableRow{table, row})
+				}
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+		// rows deleted before versions went with them left theirs behind.
+		for _, r := range rows {
+			if err := dropEmptyRowVersion(db, wb, r.table, r.row); err != nil {
+				return err
+			}
+		}
+	case OpPruneDedup:
+		return pruneDedup(db, wb, kv.Index)
+	case OpPurge:
+		return purgeRow(db, wb, kv.Table, kv.Row, index)
+	case OpSetSink:
+		if kv.Sink == nil {
+			return nil // never proposed, SetSink requires a sink
+		}
+		return setSink(db, wb, kv.Sink, index)
+	case OpDropSink:
+		return dropSink(db, wb, kv.Row)
+	case OpAckSink:
+		return ackSink(db, wb, kv.Row, kv.Index)
+	case OpSetStats:
+		if kv.Stats == nil {
+			return nil // never proposed, AnalyzeTable always sets them
+		}
+		return setStats(db, wb, kv.Stats, index)
+	case OpSetArchive:
+		return setArchive(db, wb, kv.Val, index)
+	case OpDropArchive:
+		return dropArchive(db, wb)
+	case OpAckArchive:
+		return ackArchive(db, wb, kv.Index)
+	case OpCreateIndex:
+		if kv.IndexDef == nil {
+			return nil // never proposed, CreateIndex requires a definition
+		}
+		return createIndex(db, wb, kv.IndexDef)
+	case OpDropIndex:
+		return dropIndex(db, wb, kv.Table, kv.Row)
+	case OpBackfillIndex:
+		return backfillStep(db, wb, kv.Table, kv.Row, kv.Val)
+	case OpResetReplica, OpStageReplica, OpCommitReplica, OpPromoteStandby:
+		return applyReplicaOp(db, wb, kv)
+	case OpTxnCommit, OpTxnAbort:
+		return finishTxn(d, db, wb, kv, index, kv.Op == OpTxnAbort)
+	case OpBatch:
+		for _, w := range kv.Writes {
+			if err := d.applyKV(db, wb, w.kvData(), index); err != nil {
+				return err
+			}
+		}
+	case OpFreezeWrites:
+		if kv.Val == "" {
+			wb.Delete([]byte(writeFreezeKey), db.wo)
+		} else {
+			wb.Set([]byte(writeFreezeKey), []byte(kv.Val), db.wo)
+		}
+	default:
+		panic(fmt.Sprintf("Unrecognized KVData op in Raft log entry: %v. This is a bug.", kv.Op))
+	}
 	return nil
 }
 
+// migrateKeyLayout rewrites data and tombstones stored with the old
+// "table:row:column" keys into the current layout.  It only depends on the
+// data, so every replica migrates to the same state.
+func migrateKeyLayout(db *pebbledb) error {
+	val, closer, err := db.db.Get([]byte(keyLayoutKey))
+	if err == nil {
+		layout := string(val)
+		closer.Close()
+		if layout == currentKeyLayout {
+			return nil
+		}
+	} else if err != pebble.ErrNotFound {
+		return err
+	}
+	wb := db.db.NewBatch()
+	defer wb.Close()
+	iter := db.db.NewIter(db.ro)
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		var newKey []byte
+		switch {
+		case isLegacyDataKey(key):
+			newKey = encodeKey(splitLegacyKey(string(key)))
+		case bytes.HasPrefix(key, []byte(tombstonePrefix)) && isLegacyDataKey(key[len(tombstonePrefix):]):
+			newKey = tombstoneKey(encodeKey(splitLegacyKey(string(key[len(tombstonePrefix):]))))
+		default:
+			continue
+		}
+		wb.Set(newKey, append([]byte(nil), iter.Value()...), db.wo)
+		wb.Delete(append([]byte(nil), key...), db.wo)
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	wb.Set([]byte(keyLayoutKey), []byte(currentKeyLayout), db.wo)
+	return db.db.Apply(wb, db.syncwo)
+}
+
+// isFrozen reports whether a write freeze is in place.  Whether an entry is
+// rejected only depends on the log, never on the local clock, the deadline
+// is enforced by the leader proposing the thaw.
+func isFrozen(wb *pebble.Batch) (bool, error) {
+	_, closer, err := wb.Get([]byte(writeFreezeKey))
+	if err == pebble.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	closer.Close()
+	return true, nil
+}
+
+// FreezeExemptTables are the system tables the cluster's own bookkeeping
+// writes to: the node catalog, the event log, the cluster settings, the
+// transaction records, the dead letters and the purge confirmations.
+// Writes to them go through a write freeze, writes to any other table,
+// system ones included, are frozen.
+var FreezeExemptTables = map[string]bool{
+	"_nodes":        true,
+	"_events":       true,
+	"_cluster":      true,
+	"_txns":         true,
+	"_dead_letters": true,
+	"_purges":       true,
+}
+
+// exemptFromFreeze lets the freeze itself, tombstone gc, standby promotion,
+// the outcome of prepared transactions, index backfills, sink and archive
+// acknowledgements and writes to FreezeExemptTables through a write freeze.
+func exemptFromFreeze(kv *KVData) bool {
+	switch kv.Op {
+	case OpFreezeWrites, OpGCTombstones, OpPruneDedup, OpPromoteStandby, OpTxnCommit, OpTxnAbort, OpBackfillIndex, OpAckSink, OpAckArchive, OpSetStats:
+		return true
+	}
+	return FreezeExemptTables[kv.Table]
+}
+
+func (r *pebbledb) writeFreeze() (time.Time, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return time.Time{}, errors.New("db already closed")
+	}
+	val, closer, err := r.db.Get([]byte(writeFreezeKey))
+	if err == pebble.ErrNotFound {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	defer closer.Close()
+	return time.Parse(time.RFC3339Nano, string(val))
+}
+
+// deleteRowsWhere deletes every row of a table whose key starts with
+// rowPrefix and that matches filter, a nil filter matches every row, and
+// returns the rows deleted.  Rows are visited in key order, so the same entry
+// deletes the same rows on every replica.
+func deleteRowsWhere(db *pebbledb, wb *pebble.Batch, table, rowPrefix string, filter *RowFilter, index uint64) ([]string, error) {
+	prefix := encodeRowKeyPrefix(table, rowPrefix)
+	return deleteRowRange(db, wb, table, prefix, prefixUpperBound(prefix), filter, index)
+}
+
+// rowRange returns the key range of the rows of table from the row key from
+// up to the row key to, the rest of the table when to is empty.  Row keys
+// encode in order, so the range holds exactly those rows.
+func rowRange(table, from, to string) ([]byte, []byte) {
+	if to == "" {
+		return encodeRowKeyPrefix(table, from), prefixUpperBound(encodeTablePrefix(table))
+	}
+	return encodeRowKeyPrefix(table, from), encodeRowKeyPrefix(table, to)
+}
+
+// deleteRowRange is deleteRowsWhere over the rows with keys in [lower,
+// upper).
+func deleteRowRange(db *pebbledb, wb *pebble.Batch, table string, lower, upper []byte, filter *RowFilter, index uint64) ([]string, error) {
+	defs, err := tableIndexes(wb, table)
+	if err != nil {
+		return nil, err
+	}
+	iter := wb.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: upper})
+	var row string
+	var keys [][]byte
+	var deleted []string
+	columns := map[string]string{}
+	flush := func() {
+		if len(keys) > 0 && filter.Match(columns) {
+			for _, key := range keys {
+				deleteWithTombstone(db, wb, key, index)
+			}
+			unindexRow(db, wb, defs, row, columns)
+			deleted = append(deleted, row)
+			wb.Delete(rowVersionKey(table, row), db.wo)
+		}
+		keys = nil
+		columns = map[string]string{}
+	}
+	for iter.First(); iter.Valid(); iter.Next() {
+		_, r, column, ok := decodeKey(iter.Key())
+		if !ok {
+			continue // row versions
+		}
+		if r != row {
+			flush()
+			row = r
+		}
+		keys = append(keys, append([]byte(nil), iter.Key()...))
+		columns[column] = string(iter.Value())
+	}
+	flush()
+	return deleted, iter.Close()
+}
+
+// rowVersion returns the raft index the row was last modified at.  An
+// absent row, never written or deleted, has no version key and is at 0: a
+// precondition read it absent holds as long as it is absent, see RowRead.
+func rowVersion(wb *pebble.Batch, table, row string) (uint64, error) {
+	val, closer, err := wb.Get(rowVersionKey(table, row))
+	if err == pebble.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer closer.Close()
+	return binary.LittleEndian.Uint64(val), nil
+}
+
+// deleteRow deletes every column of a row except those in keep.
+func deleteRow(db *pebbledb, wb *pebble.Batch, table, row string, keep map[string]string, index uint64) error {
+	prefix := encodeRowPrefix(table, row)
+	iter := wb.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	for iter.First(); iter.Valid(); iter.Next() {
+		column, ok := decodeColumn(iter.Key(), prefix)
+		if !ok {
+			continue // the row version
+		}
+		if _, ok := keep[column]; ok {
+			continue
+		}
+		deleteWithTombstone(db, wb, append([]byte(nil), iter.Key()...), index)
+	}
+	return iter.Close()
+}
+
+// dropEmptyRowVersion deletes the version key of a row left without
+// columns, deleted rows don't keep one.
+func dropEmptyRowVersion(db *pebbledb, wb *pebble.Batch, table, row string) error {
+	prefix := encodeRowPrefix(table, row)
+	iter := wb.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	empty := true
+	for iter.First(); iter.Valid(); iter.Next() {
+		if _, ok := decodeColumn(iter.Key(), prefix); ok {
+			empty = false
+			break
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	if empty {
+		wb.Delete(rowVersionKey(table, row), db.wo)
+	}
+	return nil
+}
+
+// deleteWithTombstone removes key and records the raft index it was deleted
+// at, so the delete survives until every replica has seen it.
+func deleteWithTombstone(db *pebbledb, wb *pebble.Batch, key []byte, index uint64) {
+	wb.Delete(key, db.wo)
+	at := make([]byte, 8)
+	binary.LittleEndian.PutUint64(at, index)
+	wb.Set(tombstoneKey(key), at, db.wo)
+}
+
+func tombstoneKey(key []byte) []byte {
+	return append([]byte(tombstonePrefix), key...)
+}
+
+// prefixUpperBound returns the smallest key greater than every key starting
+// with prefix.
+func prefixUpperBound(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil // prefix is all 0xff, no upper bound
+}
+
+// Sync synchronizes all in-core state of the state machine. When syncWrites
+// is on the Update method already does that every time it is invoked, and
+// the Sync method here is a NoOP.  Otherwise it fsyncs pebble's WAL.
+func (d *DiskKV) Sync() error {
+	if d.syncWrites {
+		return nil
+	}
+	db := (*pebbledb)(atomic.LoadPointer(&d.db))
+	return db.db.LogData(nil, db.syncwo)
+}
+
 type diskKVCtx struct {
 	db       *pebbledb
 	snapshot *pebble.Snapshot
@@ -459,47 +1759,16 @@ func (d *DiskKV) PrepareSnapshot() (interface{}, error) {
 	if d.aborted {
 		panic("prepare snapshot called after abort")
 	}
+	start := time.Now()
 	db := (*pebbledb)(atomic.LoadPointer(&d.db))
-	return &diskKVCtx{
+	ctx := &diskKVCtx{
 		db:       db,
 		snapshot: db.db.NewSnapshot(),
-	}, nil
-}
-
-// saveToWriter saves all existing key-value pairs to the provided writer.
-// As an example, we use the most straight forward way to implement this.
-func (d *DiskKV) saveToWriter(db *pebbledb,
-	ss *pebble.Snapshot, w io.Writer) error {
-	iter := ss.NewIter(db.ro)
-	defer iter.Close()
-	values := make([]*KVData, 0)
-	for iter.First(); iter.Valid(); iter.Next() {
-		kv := &KVData{
-			Key: string(iter.Key()),
-			Val: string(iter.Value()),
-		}
-		values = append(values, kv)
 	}
-	count := uint64(len(values))
-	sz := make([]byte, 8)
-	binary.LittleEndian.PutUint64(sz, count)
-	if _, err := w.Write(sz); err != nil {
-		return err
+	if d.snapshots != nil {
+		d.snapshots.prepared(time.Since(start))
 	}
-	for _, dataKv := range values {
-		data, err := json.Marshal(dataKv)
-		if err != nil {
-			panic(err)
-		}
-		binary.LittleEndian.PutUint64(sz, uint64(len(data)))
-		if _, err := w.Write(sz); err != nil {
-			return err
-		}
-		if _, err := w.Write(data); err != nil {
-			return err
-		}
-	}
-	return nil
+	return ctx, nil
 }
 
 // SaveSnapshot saves the state machine state identified by the state
@@ -519,7 +1788,13 @@ func (d *DiskKV) SaveSnapshot(ctx interface{},
 	defer db.mu.RUnlock()
 	ss := ctxdata.snapshot
 	defer ss.Close()
-	return d.saveToWriter(db, ss, w)
+	start := time.Now()
+	cw := &countingWriter{w: w}
+	err := writeSnapshot(db, ss, cw)
+	if d.snapshots != nil {
+		d.snapshots.saved(time.Since(start), cw.count, err)
+	}
+	return err
 }
 
 // RecoverFromSnapshot recovers the state machine state from snapshot. The
@@ -540,37 +1815,28 @@ func (d *DiskKV) RecoverFromSnapshot(r io.Reader,
 	if err != nil {
 		return err
 	}
-	sz := make([]byte, 8)
-	if _, err := io.ReadFull(r, sz); err != nil {
+	if err := restoreSnapshot(db, r, done); err != nil {
+		db.close()
+		os.RemoveAll(dbdir)
 		return err
 	}
-	total := binary.LittleEndian.Uint64(sz)
-	wb := db.db.NewBatch()
-	defer wb.Close()
-	for i := uint64(0); i < total; i++ {
-		if _, err := io.ReadFull(r, sz); err != nil {
-			return err
-		}
-		toRead := binary.LittleEndian.Uint64(sz)
-		data := make([]byte, toRead)
-		if _, err := io.ReadFull(r, data); err != nil {
-			return err
-		}
-		dataKv := &KVData{}
-		if err := json.Unmarshal(data, dataKv); err != nil {
-			panic(err)
-		}
-		wb.Set([]byte(dataKv.Key), []byte(dataKv.Val), db.wo)
-	}
-	if err := db.db.Apply(wb, db.syncwo); err != nil {
+	// snapshots sent by replicas not upgraded yet use the old layout.
+	if err := migrateKeyLayout(db); err != nil {
+		db.close()
+		os.RemoveAll(dbdir)
 		return err
 	}
+	// restoreSnapshot syncs the WAL once every chunk is written, the applied
+	// index among them, and migrateKeyLayout commits synced: the restored db
+	// is durable before it becomes the current one.
+	crashPoint("recover-restored")
 	if err := saveCurrentDBDirName(dir, dbdir); err != nil {
 		return err
 	}
 	if err := replaceCurrentDBFile(dir); err != nil {
 		return err
 	}
+	crashPoint("recover-switched")
 	newLastApplied, err := d.queryAppliedIndex(db)
 	if err != nil {
 		panic(err)
@@ -579,10 +1845,13 @@ func (d *DiskKV) RecoverFromSnapshot(r io.Reader,
 	// dummy entries or membership change entries as part of the new snapshot
 	// that never reached the SM and thus never moved the last applied index
 	// in the SM snapshot.
-	if d.lastApplied > newLastApplied {
+	if atomic.LoadUint64(&d.lastApplied) > newLastApplied {
 		panic("last applied not moving forward")
 	}
-	d.lastApplied = newLastApplied
+	atomic.StoreUint64(&d.lastApplied, newLastApplied)
+	if err := d.restoreMachines(db); err != nil {
+		return err
+	}
 	old := (*pebbledb)(atomic.SwapPointer(&d.db, unsafe.Pointer(db)))
 	if old != nil {
 		old.close()
@@ -0,0 +1,435 @@
+package multiraft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/cockroachdb/pebble"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestUpdate_IfAbsent(t *testing.T) {
+	db := openTestDB(t, "if-absent")
+	d := &DiskKV{db: unsafe.Pointer(db)}
+	put := func(index uint64, val string) sm.Result {
+		cmd, err := KVData{Table: "jobs", Row: "j1", Column: "owner", Val: val, IfAbsent: true}.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ents, err := d.Update([]sm.Entry{{Index: index, Cmd: cmd}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ents[0].Result
+	}
+	if res := put(1, "worker-1"); res.Value != 1 || res.Data != nil {
+		t.Errorf("first put = %+v, want applied at 1", res)
+	}
+	if res := put(2, "worker-2"); !bytes.Equal(res.Data, resultKeyExists) {
+		t.Errorf("second put = %+v, want rejected as existing", res)
+	}
+	val, closer, err := db.db.Get(encodeKey("jobs", "j1", "owner"))
+	if err != nil || string(val) != "worker-1" {
+		t.Fatalf("owner = %q, %v, want worker-1", val, err)
+	}
+	closer.Close()
+}
+
+func TestUpdate_Reads(t *testing.T) {
+	db := openTestDB(t, "reads")
+	d := &DiskKV{db: unsafe.Pointer(db)}
+	update := func(index uint64, kv KVData) sm.Result {
+		cmd, err := kv.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ents, err := d.Update([]sm.Entry{{Index: index, Cmd: cmd}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ents[0].Result
+	}
+	update(1, KVData{Table: "accounts", Row: "a", Column: "balance", Val: "10"})
+	move := KVData{Op: OpBatch, Writes: []TxnWrite{
+		{Table: "accounts", Row: "a", Column: "balance", Val: "7"},
+		{Table: "accounts", Row: "b", Column: "balance", Val: "3"},
+	}, Reads: []RowRead{{Table: "accounts", Row: "a", Version: 1}, {Table: "accounts", Row: "b"}}}
+	if res := update(2, move); res.Value != 2 || res.Data != nil {
+		t.Errorf("batch of unchanged reads = %+v, want applied at 2", res)
+	}
+	if res := update(3, move); !bytes.Equal(res.Data, resultPreconditionFailed) {
+		t.Errorf("batch of modified reads = %+v, want rejected", res)
+	}
+	val, closer, err := db.db.Get(encodeKey("accounts", "b", "balance"))
+	if err != nil || string(val) != "3" {
+		t.Fatalf("balance of b = %q, %v, want 3", val, err)
+	}
+	closer.Close()
+}
+
+func TestUpdate_RowVersionDeleted(t *testing.T) {
+	db := openTestDB(t, "row-version")
+	d := &DiskKV{db: unsafe.Pointer(db)}
+	index := uint64(0)
+	update := func(kv KVData) sm.Result {
+		cmd, err := kv.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		index++
+		ents, err := d.Update([]sm.Entry{{Index: index, Cmd: cmd}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ents[0].Result
+	}
+	hasVersion := func(row string) bool {
+		_, closer, err := db.db.Get(rowVersionKey("t", row))
+		if err == nil {
+			closer.Close()
+		}
+		return err == nil
+	}
+
+	update(KVData{Op: OpSetRow, Table: "t", Row: "a", Columns: map[string]string{"x": "1", "y": "2"}})
+	update(KVData{Op: OpDelete, Table: "t", Row: "a", Column: "x"})
+	if !hasVersion("a") {
+		t.Errorf("row a lost its version with a column left")
+	}
+	update(KVData{Op: OpDelete, Table: "t", Row: "a", Column: "y"})
+	if hasVersion("a") {
+		t.Errorf("row a kept its version after its last column was deleted")
+	}
+
+	update(KVData{Table: "t", Row: "b", Column: "x", Val: "1"})
+	update(KVData{Op: OpDeleteRow, Table: "t", Row: "b"})
+	update(KVData{Table: "t", Row: "c", Column: "x", Val: "1"})
+	update(KVData{Op: OpDeletePrefix, Table: "t", Row: "c"})
+	if hasVersion("b") || hasVersion("c") {
+		t.Errorf("deleted rows kept their versions: b %v, c %v", hasVersion("b"), hasVersion("c"))
+	}
+
+	// a deleted row reads as never written: a batch that read it absent
+	// applies while it stays absent, and not once it is written again.
+	absent := KVData{Op: OpBatch, Writes: []TxnWrite{{Table: "t", Row: "d", Column: "x", Val: "1"}},
+		Reads: []RowRead{{Table: "t", Row: "b"}}}
+	if res := update(absent); res.Data != nil {
+		t.Errorf("batch reading deleted row b absent = %+v, want applied", res)
+	}
+	update(KVData{Table: "t", Row: "b", Column: "x", Val: "2"})
+	if res := update(absent); !bytes.Equal(res.Data, resultPreconditionFailed) {
+		t.Errorf("batch reading row b absent once rewritten = %+v, want rejected", res)
+	}
+
+	// versions left behind by deletes before they went with the row are
+	// dropped with the tombstones.
+	update(KVData{Table: "t", Row: "e", Column: "x", Val: "1"})
+	update(KVData{Op: OpDeleteRow, Table: "t", Row: "e"})
+	version := make([]byte, 8)
+	binary.LittleEndian.PutUint64(version, index)
+	if err := db.db.Set(rowVersionKey("t", "e"), version, nil); err != nil {
+		t.Fatal(err)
+	}
+	update(KVData{Op: OpGCTombstones, Index: index})
+	if hasVersion("e") || !hasVersion("b") {
+		t.Errorf("after gc: version of e %v, want dropped; of b %v, want kept", hasVersion("e"), hasVersion("b"))
+	}
+}
+
+func TestUpdate_DeleteRange(t *testing.T) {
+	db := openTestDB(t, "delete-range")
+	d := &DiskKV{db: unsafe.Pointer(db)}
+	index := uint64(0)
+	update := func(kv KVData) {
+		cmd, err := kv.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		index++
+		if _, err := d.Update([]sm.Entry{{Index: index, Cmd: cmd}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows := []string{"a", "a\x00", "b", "b\x00", "ba", "c", "cc"}
+	for _, row := range rows {
+		update(KVData{Table: "t", Row: row, Column: "x", Val: "1"})
+	}
+	update(KVData{Table: "u", Row: "b", Column: "x", Val: "1"})
+	exists := func(table, row string) bool {
+		_, closer, err := db.db.Get(encodeKey(table, row, "x"))
+		if err == nil {
+			closer.Close()
+		}
+		return err == nil
+	}
+
+	update(KVData{Op: OpDeleteRange, Table: "t", Row: "a\x00", Val: "c"})
+	for _, row := range rows {
+		if want := row < "a\x00" || row >= "c"; exists("t", row) != want {
+			t.Errorf("after deleting [a\\x00, c): row %q exists %v, want %v", row, !want, want)
+		}
+	}
+	if !exists("u", "b") {
+		t.Errorf("deleting a range of t deleted row b of u")
+	}
+	update(KVData{Op: OpDeleteRange, Table: "t", Row: "c"})
+	if exists("t", "c") || exists("t", "cc") || !exists("t", "a") {
+		t.Errorf("after deleting [c, end): c %v, cc %v, a %v", exists("t", "c"), exists("t", "cc"), exists("t", "a"))
+	}
+}
+
+func TestUpdate_WriteFreeze(t *testing.T) {
+	db := openTestDB(t, "write-freeze")
+	d := &DiskKV{db: unsafe.Pointer(db)}
+	index := uint64(0)
+	update := func(kv KVData) sm.Result {
+		cmd, err := kv.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		index++
+		ents, err := d.Update([]sm.Entry{{Index: index, Cmd: cmd}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ents[0].Result
+	}
+	update(KVData{Op: OpFreezeWrites, Val: time.Now().UTC().Format(time.RFC3339Nano)})
+
+	for _, tt := range []struct {
+		table  string
+		frozen bool
+	}{
+		{"users", true},
+		{"_counters", true},
+		{"_schemas", true},
+		{"_nodes", false},
+		{"_events", false},
+		{"_cluster", false},
+		{"_txns", false},
+		{"_dead_letters", false},
+		{"_purges", false},
+	} {
+		res := update(KVData{Table: tt.table, Row: "r", Column: "c", Val: "v"})
+		if frozen := bytes.Equal(res.Data, resultWritesFrozen); frozen != tt.frozen {
+			t.Errorf("write to %s during a freeze = %+v, want frozen %v", tt.table, res, tt.frozen)
+		}
+	}
+
+	update(KVData{Op: OpFreezeWrites})
+	if res := update(KVData{Table: "users", Row: "r", Column: "c", Val: "v"}); res.Data != nil {
+		t.Errorf("write after the thaw = %+v, want applied", res)
+	}
+}
+
+func TestUpdate_LogsRequestID(t *testing.T) {
+	db := openTestDB(t, "request-id")
+	core, logs := observer.New(zap.DebugLevel)
+	d := &DiskKV{db: unsafe.Pointer(db), logger: zap.New(core)}
+	cmd, err := KVData{Table: "jobs", Row: "j1", Column: "owner", Val: "worker-1", RequestID: "req-1"}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Update([]sm.Entry{{Index: 1, Cmd: cmd}}); err != nil {
+		t.Fatal(err)
+	}
+	entries := logs.FilterField(zap.String("request_id", "req-1")).All()
+	if len(entries) != 1 || entries[0].Message != "applied entry" {
+		t.Errorf("logged %v, want the applied entry with its request ID", logs.All())
+	}
+}
+
+func TestUpdate_SyncWrites(t *testing.T) {
+	for _, syncWrites := range []bool{true, false} {
+		db := openTestDB(t, "sync")
+		d := &DiskKV{db: unsafe.Pointer(db), syncWrites: syncWrites}
+		for i, val := range []string{"1", "2", "3"} {
+			cmd, err := KVData{Table: "t", Row: "r", Column: "c", Val: val}.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := d.Update([]sm.Entry{{Index: uint64(i + 1), Cmd: cmd}}); err != nil {
+				t.Fatalf("syncWrites=%v: Update() error = %v", syncWrites, err)
+			}
+		}
+		if err := d.Sync(); err != nil {
+			t.Errorf("syncWrites=%v: Sync() error = %v", syncWrites, err)
+		}
+		if applied, err := d.queryAppliedIndex(db); err != nil || applied != 3 {
+			t.Errorf("syncWrites=%v: applied index = %d, %v, want 3", syncWrites, applied, err)
+		}
+		val, closer, err := db.db.Get(encodeKey("t", "r", "c"))
+		if err != nil || string(val) != "3" {
+			t.Fatalf("syncWrites=%v: value = %q, %v, want 3", syncWrites, val, err)
+		}
+		closer.Close()
+	}
+}
+
+func TestUpdate_Tombstones(t *testing.T) {
+	writes := []*KVData{
+		{Table: "t", Row: "a", Column: "x", Val: "1"},     // 1
+		{Table: "t", Row: "a", Column: "y", Val: "1"},     // 2
+		{Table: "t", Row: "b", Column: "x", Val: "1"},     // 3
+		{Op: OpDelete, Table: "t", Row: "a", Column: "x"}, // 4
+		{Op: OpDeleteRow, Table: "t", Row: "b"},           // 5
+		{Table: "t", Row: "a", Column: "x", Val: "2"},     // 6, its tombstone goes
+		{Op: OpDelete, Table: "t", Row: "a", Column: "y"}, // 7
+	}
+	tests := []struct {
+		gcIndex uint64
+		want    map[string]uint64
+	}{
+		{0, map[string]uint64{"t/b/x": 5, "t/a/y": 7}},
+		{4, map[string]uint64{"t/b/x": 5, "t/a/y": 7}},
+		{5, map[string]uint64{"t/a/y": 7}},
+		{6, map[string]uint64{"t/a/y": 7}},
+		{7, map[string]uint64{}},
+		{100, map[string]uint64{}},
+	}
+	for _, tt := range tests {
+		db := openTestDB(t, "tombstones")
+		applyTestKV(t, db, writes...)
+		if tt.gcIndex != 0 {
+			applyTestKV(t, db, &KVData{Op: OpGCTombstones, Index: tt.gcIndex})
+		}
+		got := map[string]uint64{}
+		prefix := []byte(tombstonePrefix)
+		iter := db.db.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+		for iter.First(); iter.Valid(); iter.Next() {
+			table, row, column, ok := decodeKey(iter.Key()[len(prefix):])
+			if !ok {
+				t.Fatalf("undecodable tombstone %q", iter.Key())
+			}
+			got[table+"/"+row+"/"+column] = binary.LittleEndian.Uint64(iter.Value())
+		}
+		iter.Close()
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tombstones after gc at %d = %v, want %v", tt.gcIndex, got, tt.want)
+		}
+		// collecting tombstones never brings the deleted columns back.
+		if _, closer, err := db.db.Get(encodeKey("t", "a", "y")); err != pebble.ErrNotFound {
+			if err == nil {
+				closer.Close()
+			}
+			t.Errorf("t/a/y after gc at %d: %v, want deleted", tt.gcIndex, err)
+		}
+	}
+}
+
+func TestUpdate_SetRow(t *testing.T) {
+	current, stale := uint64(1), uint64(0)
+	tests := []struct {
+		name    string
+		write   KVData
+		want    map[string]string
+		applied bool
+	}{
+		{"set merges", KVData{Op: OpSetRow, Columns: map[string]string{"b": "2", "c": "3"}}, map[string]string{"a": "1", "b": "2", "c": "3"}, true},
+		{"replace drops the others", KVData{Op: OpReplaceRow, Columns: map[string]string{"b": "2", "c": "3"}}, map[string]string{"b": "2", "c": "3"}, true},
+		{"replace keeping a column", KVData{Op: OpReplaceRow, Columns: map[string]string{"a": "9"}}, map[string]string{"a": "9"}, true},
+		{"replace at the current version", KVData{Op: OpReplaceRow, Columns: map[string]string{"a": "2"}, IfMatch: &current}, map[string]string{"a": "2"}, true},
+		{"replace at a stale version", KVData{Op: OpReplaceRow, Columns: map[string]string{"a": "2"}, IfMatch: &stale}, map[string]string{"a": "1"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, "set-row")
+			d := &DiskKV{db: unsafe.Pointer(db)}
+			update := func(index uint64, kv KVData) sm.Result {
+				cmd, err := kv.Marshal()
+				if err != nil {
+					t.Fatal(err)
+				}
+				ents, err := d.Update([]sm.Entry{{Index: index, Cmd: cmd}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return ents[0].Result
+			}
+			update(1, KVData{Op: OpSetRow, Table: "t", Row: "r", Columns: map[string]string{"a": "1"}})
+			tt.write.Table, tt.write.Row = "t", "r"
+			res := update(2, tt.write)
+			if applied := res.Data == nil; applied != tt.applied {
+				t.Errorf("%s = %+v, want applied %v", tt.write.Op, res, tt.applied)
+			}
+			got, err := d.Lookup(RowQuery{Table: "t", Row: "r"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			row := got.(*Row)
+			if !reflect.DeepEqual(row.Columns, tt.want) {
+				t.Errorf("row after %s = %v, want %v", tt.write.Op, row.Columns, tt.want)
+			}
+			want := uint64(1)
+			if tt.applied {
+				want = 2
+			}
+			if row.Version != want {
+				t.Errorf("row version = %d, want %d", row.Version, want)
+			}
+		})
+	}
+}
+
+func TestUpdate_DeleteWhere(t *testing.T) {
+	rows := map[string]map[string]string{
+		"a1": {"status": "active"},
+		"a2": {"status": "closed"},
+		"a3": {"status": "closed", "note": "x"},
+		"b1": {"status": "closed"},
+	}
+	tests := []struct {
+		name  string
+		write KVData
+		want  []string
+	}{
+		{"prefix", KVData{Op: OpDeletePrefix, Row: "a"}, []string{"b1"}},
+		{"prefix of no rows", KVData{Op: OpDeletePrefix, Row: "c"}, []string{"a1", "a2", "a3", "b1"}},
+		{"empty prefix", KVData{Op: OpDeletePrefix}, nil},
+		{"where equals", KVData{Op: OpDeleteWhere, Row: "a", Filter: &RowFilter{Column: "status", Op: FilterEquals, Value: "closed"}}, []string{"a1", "b1"}},
+		{"where exists", KVData{Op: OpDeleteWhere, Filter: &RowFilter{Column: "note", Op: FilterExists}}, []string{"a1", "a2", "b1"}},
+		{"where matching none", KVData{Op: OpDeleteWhere, Filter: &RowFilter{Column: "status", Op: FilterEquals, Value: "gone"}}, []string{"a1", "a2", "a3", "b1"}},
+		{"where without a filter", KVData{Op: OpDeleteWhere, Row: "a"}, []string{"a1", "a2", "a3", "b1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, "delete-where")
+			d := &DiskKV{db: unsafe.Pointer(db)}
+			update := func(index uint64, kv KVData) {
+				cmd, err := kv.Marshal()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := d.Update([]sm.Entry{{Index: index, Cmd: cmd}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			index := uint64(1)
+			for row, columns := range rows {
+				update(index, KVData{Op: OpSetRow, Table: "t", Row: row, Columns: columns})
+				index++
+			}
+			tt.write.Table = "t"
+			update(index, tt.write)
+			var got []string
+			for _, row := range []string{"a1", "a2", "a3", "b1"} {
+				res, err := d.Lookup(RowQuery{Table: "t", Row: row})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(res.(*Row).Columns) > 0 {
+					got = append(got, row)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rows after %s = %v, want %v", tt.write.Op, got, tt.want)
+			}
+		})
+	}
+}
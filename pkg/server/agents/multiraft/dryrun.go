@@ -0,0 +1,61 @@
+package multiraft
+
+import (
+	"context"
+	"errors"
+
+	"github.com/epsniff/expodb/pkg/errdefs"
+)
+
+// ErrDryRunUnsupported is returned by Apply for dry runs of entries that
+// aren't KV entries, there is nothing to check them against.
+var ErrDryRunUnsupported = errdefs.New(errdefs.ErrInvalid, "request can't be dry run")
+
+type dryRunKey struct{}
+
+// WithDryRun makes the writes proposed with ctx dry runs: Apply checks them
+// against the shard's state like the apply would, without proposing them,
+// and returns index 0 when they would be accepted.  Entries applied together
+// aren't checked against each other.
+func WithDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+// IsDryRun reports whether ctx is that of a dry run, see WithDryRun.
+func IsDryRun(ctx context.Context) bool {
+	dry, _ := ctx.Value(dryRunKey{}).(bool)
+	return dry
+}
+
+// validateQuery asks whether an entry would be rejected, its result is the
+// rejection's data, nil when it would be accepted.
+type validateQuery struct {
+	kv KVData
+}
+
+func (r *pebbledb) validate(kv KVData, triggers map[string]TriggerFunc) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil, errors.New("db already closed")
+	}
+	// the checks read through a batch, it is never applied.
+	wb := r.db.NewIndexedBatch()
+	defer wb.Close()
+	frozen, err := isFrozen(wb)
+	if err != nil {
+		return nil, err
+	}
+	kv.upgradeLegacyKey()
+	return rejection(wb, &kv, frozen, triggers)
+}
+
+// dryRun checks an entry with a linearizable read, see WithDryRun.
+func (a *Agent) dryRun(ctx context.Context, kv KVData) error {
+	res, err := a.Read(ctx, validateQuery{kv: kv})
+	if err != nil {
+		return err
+	}
+	rejected, _ := res.([]byte)
+	return resultError(rejected)
+}
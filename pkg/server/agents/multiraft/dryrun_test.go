@@ -0,0 +1,42 @@
+package multiraft
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	db := openTestDB(t, "dry-run")
+	applyTestKV(t, db,
+		&KVData{Op: OpSetSchema, Schema: &TableSchema{Table: "users", Columns: []Column{{Name: "age", Type: ColumnInt}}}},
+		&KVData{Table: "users", Row: "a", Column: "age", Val: "41"},
+	)
+	before := dumpDB(t, db)
+
+	tests := []struct {
+		name string
+		kv   KVData
+		want error
+	}{
+		{"accepted", KVData{Table: "users", Row: "b", Column: "age", Val: "7"}, nil},
+		{"schema", KVData{Table: "users", Row: "b", Column: "age", Val: "seven"}, ErrSchemaViolation},
+		{"if absent", KVData{Table: "users", Row: "a", Column: "age", Val: "7", IfAbsent: true}, ErrKeyExists},
+	}
+	for _, tt := range tests {
+		rejected, err := db.validate(tt.kv, nil)
+		if err != nil {
+			t.Fatalf("%s: validate() error = %v", tt.name, err)
+		}
+		if got := resultError(rejected); !errors.Is(got, tt.want) || (got == nil) != (tt.want == nil) {
+			t.Errorf("%s: validate() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	for k, v := range dumpDB(t, db) {
+		if before[k] != v {
+			t.Errorf("dry run wrote %q", k)
+		}
+	}
+	if len(dumpDB(t, db)) != len(before) {
+		t.Errorf("dry run changed the keys")
+	}
+}
@@ -0,0 +1,126 @@
+package multiraft
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// maxExplainCount bounds the rows or index entries an ExplainQuery counts.
+const maxExplainCount = 100000
+
+// ExplainQuery asks how a replica reads the first page of Select, and how
+// much of the table the read examines, without reading the rows.
+type ExplainQuery struct {
+	Select SelectQuery
+}
+
+// SelectPlan is how a replica reads a SelectQuery.  Index is the index read,
+// empty when the table is scanned, Matched the columns of the query's where
+// the read is narrowed to, in the index's order, and Filtered the others,
+// compared against each row read.  Examined is the index entries, or the
+// rows of a scan, the read goes through, counted up to maxExplainCount:
+// Capped is set when there are more.  Estimated is what the table's
+// statistics, when it has been analyzed, made the planner expect.  A page
+// stops after examining ExaminedPerPage of them.
+type SelectPlan struct {
+	Index           string   `json:"index,omitempty"`
+	IndexColumns    []string `json:"index_columns,omitempty"`
+	Matched         []string `json:"matched_columns,omitempty"`
+	Filtered        []string `json:"filtered_columns,omitempty"`
+	Examined        uint64   `json:"examined"`
+	Capped          bool     `json:"capped,omitempty"`
+	Estimated       *uint64  `json:"estimated,omitempty"`
+	ExaminedPerPage int      `json:"examined_per_page"`
+}
+
+func (r *pebbledb) explainSelect(q SelectQuery) (*SelectPlan, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil, errors.New("db already closed")
+	}
+	ss := r.db.NewSnapshot()
+	defer ss.Close()
+	def, err := selectIndexDef(ss, q)
+	if err != nil {
+		return nil, err
+	}
+	plan := &SelectPlan{ExaminedPerPage: maxSelectExamined}
+	matched := map[string]bool{}
+	var prefix []byte
+	if def != nil {
+		plan.Index, plan.IndexColumns = def.Name, def.Columns
+		values := matchedValues(def, q.Where)
+		plan.Matched = def.Columns[:len(values)]
+		for _, c := range plan.Matched {
+			matched[c] = true
+		}
+		prefix = indexValuesPrefix(def.Table, def.Name, values)
+	}
+	for c := range q.Where {
+		if !matched[c] {
+			plan.Filtered = append(plan.Filtered, c)
+		}
+	}
+	sort.Strings(plan.Filtered)
+	if def != nil {
+		plan.Examined, plan.Capped, err = countKeys(ss, prefix)
+	} else {
+		plan.Examined, plan.Capped, err = countRows(ss, q.Table)
+	}
+	if err != nil {
+		return nil, err
+	}
+	stats, err := readStats(ss, q.Table)
+	if err != nil {
+		return nil, err
+	}
+	if stats != nil {
+		est := stats.Rows
+		if def != nil {
+			est = uint64(math.Round(stats.estimateIndexRead(def, len(plan.Matched))))
+		}
+		plan.Estimated = &est
+	}
+	return plan, nil
+}
+
+// countKeys counts the keys under prefix, up to maxExplainCount.
+func countKeys(ss *pebble.Snapshot, prefix []byte) (uint64, bool, error) {
+	iter := ss.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	var n uint64
+	capped := false
+	for iter.First(); iter.Valid(); iter.Next() {
+		if n == maxExplainCount {
+			capped = true
+			break
+		}
+		n++
+	}
+	return n, capped, iter.Close()
+}
+
+// countRows counts the rows of a table, up to maxExplainCount.
+func countRows(ss *pebble.Snapshot, table string) (uint64, bool, error) {
+	prefix := encodeTablePrefix(table)
+	iter := ss.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	var n uint64
+	capped := false
+	last := ""
+	for iter.First(); iter.Valid(); iter.Next() {
+		_, row, _, ok := decodeKey(iter.Key())
+		if !ok || (n > 0 && row == last) {
+			continue
+		}
+		if n == maxExplainCount {
+			capped = true
+			break
+		}
+		n++
+		last = row
+	}
+	return n, capped, iter.Close()
+}
@@ -0,0 +1,83 @@
+package multiraft
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// TableExportQuery streams the rows of Table after the row key After (from
+// the start when empty), in key order, to Fn, all from one pebble snapshot
+// of the local replica.  Its result is the applied index the rows are
+// consistent with.  Fn returning an error stops the export with it.
+type TableExportQuery struct {
+	Table string
+	After string
+	Fn    func(ScanRow) error
+}
+
+// exportTable reads the rows the way scanPage does, holding the snapshot
+// rather than the page until Fn has taken each row.
+func (r *pebbledb) exportTable(q TableExportQuery) (uint64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return 0, errors.New("db already closed")
+	}
+	ss := r.db.NewSnapshot()
+	defer ss.Close()
+
+	var index uint64
+	val, closer, err := ss.Get([]byte(appliedIndexKey))
+	if err == nil {
+		index = binary.LittleEndian.Uint64(val)
+		closer.Close()
+	} else if err != pebble.ErrNotFound {
+		return 0, err
+	}
+
+	prefix := encodeTablePrefix(q.Table)
+	opts := &pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)}
+	if q.After != "" {
+		opts.LowerBound = prefixUpperBound(encodeRowPrefix(q.Table, q.After))
+	}
+	iter := ss.NewIter(opts)
+	defer iter.Close()
+	var row *ScanRow
+	var versionRow string
+	var version uint64
+	for iter.First(); iter.Valid(); iter.Next() {
+		_, rowkey, column, ok := decodeKey(iter.Key())
+		if !ok {
+			if key, ok := decodeRowVersionKey(iter.Key()); ok && len(iter.Value()) == 8 {
+				versionRow, version = key, binary.LittleEndian.Uint64(iter.Value())
+				if row != nil && row.Key == key {
+					row.Version = version
+				}
+			}
+			continue
+		}
+		if row == nil || row.Key != rowkey {
+			if row != nil {
+				if err := q.Fn(*row); err != nil {
+					return 0, err
+				}
+			}
+			row = &ScanRow{Key: rowkey, Columns: map[string]string{}}
+			if versionRow == rowkey {
+				row.Version = version
+			}
+		}
+		row.Columns[column] = string(iter.Value())
+	}
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	if row != nil {
+		if err := q.Fn(*row); err != nil {
+			return 0, err
+		}
+	}
+	return index, nil
+}
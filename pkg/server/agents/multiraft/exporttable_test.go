@@ -0,0 +1,50 @@
+package multiraft
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestExportTable(t *testing.T) {
+	db := openTestDB(t, "export-table")
+	applyTestKV(t, db,
+		&KVData{Table: "t", Row: "a", Column: "", Val: "empty column"},
+		&KVData{Table: "t", Row: "b", Column: "x", Val: "1"},
+		&KVData{Table: "t", Row: "b", Column: "y", Val: "2"},
+		&KVData{Table: "t", Row: "c", Column: "x", Val: "1"},
+		&KVData{Op: OpDeleteRow, Table: "t", Row: "c"},
+		&KVData{Table: "u", Row: "a", Column: "x", Val: "other table"},
+	)
+	export := func(after string) []ScanRow {
+		t.Helper()
+		var rows []ScanRow
+		if _, err := db.exportTable(TableExportQuery{Table: "t", After: after, Fn: func(row ScanRow) error {
+			rows = append(rows, row)
+			return nil
+		}}); err != nil {
+			t.Fatalf("exportTable(%q) error = %v", after, err)
+		}
+		return rows
+	}
+
+	rows := export("")
+	if len(rows) != 2 || rows[0].Key != "a" || rows[0].Version != 1 || rows[0].Columns[""] != "empty column" {
+		t.Fatalf("exportTable() = %+v, want rows a and b, deleted c skipped", rows)
+	}
+	if rows[1].Key != "b" || rows[1].Version != 3 || len(rows[1].Columns) != 2 {
+		t.Errorf("exported row b = %+v, want both columns at version 3", rows[1])
+	}
+	if rows := export("a"); len(rows) != 1 || rows[0].Key != "b" {
+		t.Errorf("exportTable() after a = %+v, want row b only", rows)
+	}
+
+	stop := errors.New("stop")
+	seen := 0
+	_, err := db.exportTable(TableExportQuery{Table: "t", Fn: func(ScanRow) error {
+		seen++
+		return stop
+	}})
+	if !errors.Is(err, stop) || seen != 1 {
+		t.Errorf("exportTable() = %v after %d rows, want the error of the first", err, seen)
+	}
+}
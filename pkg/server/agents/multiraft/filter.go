@@ -0,0 +1,72 @@
+package multiraft
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Row filter operators.
+const (
+	FilterEquals    = "eq"
+	FilterNotEquals = "ne"
+	FilterPrefix    = "prefix"
+	FilterExists    = "exists"
+	FilterMissing   = "missing"
+)
+
+// RowFilter matches rows on the value of one of their columns.  It's part of
+// raft entries, so matching must only depend on the row.
+type RowFilter struct {
+	Column string `json:"column"`
+	Op     string `json:"op"`
+	Value  string `json:"value,omitempty"`
+}
+
+// Validate checks the filter before it is proposed, the FSM treats unknown
+// operators as matching nothing.
+func (f *RowFilter) Validate() error {
+	switch f.Op {
+	case FilterEquals, FilterNotEquals, FilterPrefix, FilterExists, FilterMissing:
+	default:
+		return fmt.Errorf("unknown filter op %q", f.Op)
+	}
+	if f.Column == "" {
+		return fmt.Errorf("filter has no column")
+	}
+	return nil
+}
+
+// Match reports whether a row with the given columns matches the filter.  A
+// nil filter matches every row.
+func (f *RowFilter) Match(columns map[string]string) bool {
+	if f == nil {
+		return true
+	}
+	val, ok := columns[f.Column]
+	switch f.Op {
+	case FilterEquals:
+		return ok && val == f.Value
+	case FilterNotEquals:
+		return ok && val != f.Value
+	case FilterPrefix:
+		return ok && strings.HasPrefix(val, f.Value)
+	case FilterExists:
+		return ok
+	case FilterMissing:
+		return !ok
+	}
+	return false
+}
+
+// Resolve returns the filter with the "${name}" references in its value
+// replaced by attrs[name], false when one of them is missing.
+func (f RowFilter) Resolve(attrs map[string]string) (RowFilter, bool) {
+	ok := true
+	f.Value = os.Expand(f.Value, func(name string) string {
+		val, found := attrs[name]
+		ok = ok && found
+		return val
+	})
+	return f, ok
+}
@@ -0,0 +1,77 @@
+package multiraft
+
+import "testing"
+
+func TestRowFilter_Match(t *testing.T) {
+	row := map[string]string{"status": "active", "plan": "pro-annual", "note": ""}
+	tests := []struct {
+		filter *RowFilter
+		want   bool
+	}{
+		{nil, true},
+		{&RowFilter{Column: "status", Op: FilterEquals, Value: "active"}, true},
+		{&RowFilter{Column: "status", Op: FilterEquals, Value: "closed"}, false},
+		{&RowFilter{Column: "missing", Op: FilterEquals, Value: ""}, false},
+		{&RowFilter{Column: "note", Op: FilterEquals, Value: ""}, true},
+		{&RowFilter{Column: "status", Op: FilterNotEquals, Value: "closed"}, true},
+		{&RowFilter{Column: "status", Op: FilterNotEquals, Value: "active"}, false},
+		{&RowFilter{Column: "missing", Op: FilterNotEquals, Value: "active"}, false},
+		{&RowFilter{Column: "plan", Op: FilterPrefix, Value: "pro-"}, true},
+		{&RowFilter{Column: "plan", Op: FilterPrefix, Value: "free-"}, false},
+		{&RowFilter{Column: "plan", Op: FilterPrefix, Value: ""}, true},
+		{&RowFilter{Column: "missing", Op: FilterPrefix, Value: ""}, false},
+		{&RowFilter{Column: "note", Op: FilterExists}, true},
+		{&RowFilter{Column: "missing", Op: FilterExists}, false},
+		{&RowFilter{Column: "missing", Op: FilterMissing}, true},
+		{&RowFilter{Column: "status", Op: FilterMissing}, false},
+		{&RowFilter{Column: "status", Op: "gt", Value: "a"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.Match(row); got != tt.want {
+			t.Errorf("%+v.Match() = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestRowFilter_Validate(t *testing.T) {
+	tests := []struct {
+		filter  RowFilter
+		wantErr bool
+	}{
+		{RowFilter{Column: "status", Op: FilterEquals, Value: "active"}, false},
+		{RowFilter{Column: "status", Op: FilterNotEquals}, false},
+		{RowFilter{Column: "status", Op: FilterPrefix}, false},
+		{RowFilter{Column: "status", Op: FilterExists}, false},
+		{RowFilter{Column: "status", Op: FilterMissing}, false},
+		{RowFilter{Column: "status", Op: "gt"}, true},
+		{RowFilter{Column: "status"}, true},
+		{RowFilter{Op: FilterEquals, Value: "active"}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.filter.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%+v.Validate() error = %v, wantErr %v", tt.filter, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRowFilter_Resolve(t *testing.T) {
+	attrs := map[string]string{"tenant": "acme", "region": "eu"}
+	tests := []struct {
+		value, want string
+		ok          bool
+	}{
+		{"${tenant}", "acme", true},
+		{"${tenant}/${region}", "acme/eu", true},
+		{"$tenant-x", "acme-x", true},
+		{"static", "static", true},
+		{"${user}", "", false},
+		{"${tenant}/${user}", "acme/", false},
+	}
+	for _, tt := range tests {
+		f := RowFilter{Column: "tenant_id", Op: FilterEquals, Value: tt.value}
+		got, ok := f.Resolve(attrs)
+		if got.Value != tt.want || ok != tt.ok || got.Column != f.Column || got.Op != f.Op {
+			t.Errorf("Resolve(%q) = %+v, %v, want value %q, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package multiraft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/epsniff/expodb/pkg/errdefs"
+)
+
+// Secondary index entries map the values of one or more columns of a row to
+// its key, they are laid out as
+//
+//	0x02 | esc(table) 0x00 0x01 | esc(index) 0x00 0x01 | esc(value) 0x00 0x01 ... | esc(row)
+//
+// with a value per indexed column, in the index's order, so the rows with
+// given values of the leading columns are a key range.  Only rows holding
+// every indexed column are indexed.  Entries are written in the batch of the
+// write they follow, so a replica's indexes are always those of its data.
+const (
+	indexKeyPrefix byte = 0x02
+	// indexDefPrefix keys the definitions of the indexes, by table and name.
+	indexDefPrefix string = "\x00index:"
+	// maxIndexColumns bounds the columns of an index.
+	maxIndexColumns = 8
+)
+
+var (
+	ErrIndexNotFound = errdefs.New(errdefs.ErrNotFound, "no such index")
+	ErrIndexBuilding = errors.New("index is still being backfilled")
+)
+
+// backfillBatchRows is how many rows an OpBackfillIndex entry indexes.
+var backfillBatchRows = 1000
+
+// IndexDef defines an index over Columns of Table, in that order: a query
+// can use it when it filters on its first columns.  A Unique index holds each
+// value for one row at most, see checkUnique.
+//
+// An index created over a table's existing rows is Building until the leader
+// has backfilled them, Backfilled rows at a time in key order up to Cursor,
+// and queries don't read it meanwhile.  Unique indexes are built by the entry
+// creating them, they have to be complete to be enforced.
+type IndexDef struct {
+	Table    string   `json:"table"`
+	Name     string   `json:"name"`
+	Columns  []string `json:"columns"`
+	Unique   bool     `json:"unique,omitempty"`
+	Building bool     `json:"building,omitempty"`
+	// Cursor is the last row backfilled, Backfilled the rows indexed so far.
+	Cursor     string `json:"cursor,omitempty"`
+	Backfilled uint64 `json:"backfilled,omitempty"`
+}
+
+// IndexesQuery asks for the indexes of every table, by table and name.
+type IndexesQuery struct{}
+
+// Validate checks a definition before it is proposed.
+func (def *IndexDef) Validate() error {
+	if def.Table == "" {
+		return fmt.Errorf("index has no table")
+	}
+	if !validIndexName(def.Name) {
+		return fmt.Errorf("index name %q isn't letters, digits, '_' and '-'", def.Name)
+	}
+	if len(def.Columns) == 0 || len(def.Columns) > maxIndexColumns {
+		return fmt.Errorf("an index has 1 to %d columns, not %d", maxIndexColumns, len(def.Columns))
+	}
+	seen := map[string]bool{}
+	for _, c := range def.Columns {
+		if seen[c] {
+			return fmt.Errorf("column %q is indexed twice", c)
+		}
+		seen[c] = true
+	}
+	return nil
+}
+
+func validIndexName(name string) bool {
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+func indexDefKey(table, name string) []byte {
+	return appendEscaped(appendComponent([]byte(indexDefPrefix), table), name)
+}
+
+func indexPrefix(table, name string) []byte {
+	return appendComponent(appendComponent([]byte{indexKeyPrefix}, table), name)
+}
+
+// indexValuesPrefix returns the prefix of the entries of the rows whose
+// leading indexed columns hold values.
+func indexValuesPrefix(table, name string, values []string) []byte {
+	key := indexPrefix(table, name)
+	for _, v := range values {
+		key = appendComponent(key, v)
+	}
+	return key
+}
+
+// indexKey returns the entry of a row in the index, nil when the row doesn't
+// hold every indexed column.
+func (def *IndexDef) indexKey(row string, columns map[string]string) []byte {
+	prefix := def.valuesPrefix(columns)
+	if prefix == nil {
+		return nil
+	}
+	return appendEscaped(prefix, row)
+}
+
+// valuesPrefix returns the prefix of the entries of the rows holding the
+// values of columns, nil when they don't hold every indexed column.
+func (def *IndexDef) valuesPrefix(columns map[string]string) []byte {
+	values := make([]string, len(def.Columns))
+	for i, c := range def.Columns {
+		v, ok := columns[c]
+		if !ok {
+			return nil
+		}
+		values[i] = v
+	}
+	return indexValuesPrefix(def.Table, def.Name, values)
+}
+
+// decodeIndexRow returns the row key of an index entry of an index over n
+// columns.
+func decodeIndexRow(key []byte, n int) (string, bool) {
+	if len(key) == 0 || key[0] != indexKeyPrefix {
+		return "", false
+	}
+	// skip the table, the name and the values.
+	skip := n + 2
+	i := 1
+	for ; i < len(key) && skip > 0; i++ {
+		if key[i] == escapeByte && i+1 < len(key) {
+			i++
+			if key[i] == terminator {
+				skip--
+			}
+		}
+	}
+	if skip > 0 {
+		return "", false
+	}
+	var row []byte
+	for ; i < len(key); i++ {
+		if key[i] != escapeByte {
+			row = append(row, key[i])
+			continue
+		}
+		if i+1 == len(key) || key[i+1] != escapedZero {
+			return "", false
+		}
+		i++
+		row = append(row, escapeByte)
+	}
+	return string(row), true
+}
+
+// tableIndexes returns the definitions of a table's indexes, by name.
+func tableIndexes(rd pebble.Reader, table string) ([]IndexDef, error) {
+	return readIndexDefs(rd, appendComponent([]byte(indexDefPrefix), table))
+}
+
+// allIndexes returns the definitions of every index, by table and name.
+func allIndexes(rd pebble.Reader) ([]IndexDef, error) {
+	return readIndexDefs(rd, []byte(indexDefPrefix))
+}
+
+func readIndexDefs(rd pebble.Reader, prefix []byte) ([]IndexDef, error) {
+	iter := rd.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	var defs []IndexDef
+	for iter.First(); iter.Valid(); iter.Next() {
+		def := IndexDef{}
+		if err := json.Unmarshal(iter.Value(), &def); err != nil {
+			iter.Close()
+			return nil, fmt.Errorf("decoding index definition %q: %w", iter.Key(), err)
+		}
+		defs = append(defs, def)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return defs, nil
+}
+
+func (r *pebbledb) indexes() ([]IndexDef, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil, fmt.Errorf("db already closed")
+	}
+	return allIndexes(r.db)
+}
+
+// rowIndex is the index entries of a row before a write, update moves them to
+// the row's columns after it.
+type rowIndex struct {
+	table, row string
+	defs       []IndexDef
+	before     [][]byte
+}
+
+// indexRow returns nil when the table has no indexes.
+func indexRow(wb *pebble.Batch, table, row string) (*rowIndex, error) {
+	defs, err := tableIndexes(wb, table)
+	if err != nil || len(defs) == 0 {
+		return nil, err
+	}
+	ix := &rowIndex{table: table, row: row, defs: defs}
+	columns, err := indexedColumns(wb, table, row, defs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range defs {
+		ix.before = append(ix.before, defs[i].indexKey(row, columns))
+	}
+	return ix, nil
+}
+
+func (ix *rowIndex) update(db *pebbledb, wb *pebble.Batch) error {
+	if ix == nil {
+		return nil
+	}
+	columns, err := indexedColumns(wb, ix.table, ix.row, ix.defs)
+	if err != nil {
+		return err
+	}
+	for i := range ix.defs {
+		after := ix.defs[i].indexKey(ix.row, columns)
+		if bytes.Equal(ix.before[i], after) {
+			continue
+		}
+		if ix.before[i] != nil {
+			wb.Delete(ix.before[i], db.wo)
+		}
+		if after != nil {
+			wb.Set(after, nil, db.wo)
+		}
+	}
+	return nil
+}
+
+// indexedColumns reads the columns of a row the indexes are over.
+func indexedColumns(wb *pebble.Batch, table, row string, defs []IndexDef) (map[string]string, error) {
+	columns := map[string]string{}
+	for _, def := range defs {
+		for _, c := range def.Columns {
+			if _, ok := columns[c]; ok {
+				continue
+			}
+			val, closer, err := wb.Get(encodeKey(table, row, c))
+			if err == pebble.ErrNotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			columns[c] = string(val)
+			closer.Close()
+		}
+	}
+	return columns, nil
+}
+
+// unindexRow deletes the entries of a row being deleted as a whole.
+func unindexRow(db *pebbledb, wb *pebble.Batch, defs []IndexDef, row string, columns map[string]string) {
+	for i := range defs {
+		if key := defs[i].indexKey(row, columns); key != nil {
+			wb.Delete(key, db.wo)
+		}
+	}
+}
+
+// createIndex records the definition and drops the entries of an index of
+// the same name, recreating an index rebuilds it.  Unique indexes are built
+// right away, the others are left Building for the leader to backfill.
+func createIndex(db *pebbledb, wb *pebble.Batch, def *IndexDef) error {
+	if err := deleteKeyRange(db, wb, indexPrefix(def.Table, def.Name)); err != nil {
+		return err
+	}
+	built := *def
+	built.Building, built.Cursor, built.Backfilled = !def.Unique, "", 0
+	if def.Unique {
+		if err := backfillIndex(db, wb, &built); err != nil {
+			return err
+		}
+	}
+	return putIndexDef(db, wb, &built)
+}
+
+func putIndexDef(db *pebbledb, wb *pebble.Batch, def *IndexDef) error {
+	buf, err := json.Marshal(def)
+	if err != nil {
+		return err
+	}
+	wb.Set(indexDefKey(def.Table, def.Name), buf, db.wo)
+	return nil
+}
+
+// backfillStep indexes the next backfillBatchRows rows of a Building index.
+// A step from a cursor the index moved past, a retried proposal, is a no-op.
+func backfillStep(db *pebbledb, wb *pebble.Batch, table, name, from string) error {
+	defs, err := readIndexDefs(wb, indexDefKey(table, name))
+	if err != nil || len(defs) == 0 {
+		return err
+	}
+	def := &defs[0]
+	if !def.Building || def.Cursor != from {
+		return nil
+	}
+	last, more, err := eachRowAfter(wb, table, def.Cursor, backfillBatchRows, func(row string, columns map[string]string) {
+		if key := def.indexKey(row, columns); key != nil {
+			wb.Set(key, nil, db.wo)
+		}
+		def.Backfilled++
+	})
+	if err != nil {
+		return err
+	}
+	if more {
+		def.Cursor = last
+	} else {
+		def.Building, def.Cursor = false, ""
+	}
+	return putIndexDef(db, wb, def)
+}
+
+func dropIndex(db *pebbledb, wb *pebble.Batch, table, name string) error {
+	wb.Delete(indexDefKey(table, name), db.wo)
+	return deleteKeyRange(db, wb, indexPrefix(table, name))
+}
+
+// rebuildIndexes rebuilds every index after the data was replaced, in the
+// entry replacing it.
+func rebuildIndexes(db *pebbledb, wb *pebble.Batch) error {
+	defs, err := allIndexes(wb)
+	if err != nil {
+		return err
+	}
+	for i := range defs {
+		def := &defs[i]
+		if err := deleteKeyRange(db, wb, indexPrefix(def.Table, def.Name)); err != nil {
+			return err
+		}
+		if err := backfillIndex(db, wb, def); err != nil {
+			return err
+		}
+		def.Building, def.Cursor, def.Backfilled = false, "", 0
+		if err := putIndexDef(db, wb, def); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func backfillIndex(db *pebbledb, wb *pebble.Batch, def *IndexDef) error {
+	return eachRow(wb, def.Table, func(row string, columns map[string]string) {
+		if key := def.indexKey(row, columns); key != nil {
+			wb.Set(key, nil, db.wo)
+		}
+	})
+}
+
+// eachRow calls fn with the columns of every row of a table, in key order.
+func eachRow(rd pebble.Reader, table string, fn func(row string, columns map[string]string)) error {
+	_, _, err := eachRowAfter(rd, table, "", 0, fn)
+	return err
+}
+
+// eachRowAfter is eachRow starting after the row after, for up to limit rows
+// when limit isn't 0.  It returns the last row visited and whether more
+// follow.
+func eachRowAfter(rd pebble.Reader, table, after string, limit int, fn func(row string, columns map[string]string)) (string, bool, error) {
+	prefix := encodeTablePrefix(table)
+	lower := prefix
+	if after != "" {
+		lower = prefixUpperBound(encodeRowPrefix(table, after))
+	}
+	iter := rd.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: prefixUpperBound(prefix)})
+	var row, last string
+	visited := 0
+	more := false
+	columns := map[string]string{}
+	flush := func() {
+		if len(columns) > 0 {
+			fn(row, columns)
+			last = row
+			visited++
+		}
+		columns = map[string]string{}
+	}
+	for iter.First(); iter.Valid(); iter.Next() {
+		_, r, column, ok := decodeKey(iter.Key())
+		if !ok {
+			continue // row versions
+		}
+		if r != row {
+			flush()
+			if limit > 0 && visited == limit {
+				more = true
+				break
+			}
+			row = r
+		}
+		columns[column] = string(iter.Value())
+	}
+	if !more {
+		flush()
+	}
+	return last, more, iter.Close()
+}
+
+// deleteKeyRange deletes every key starting with prefix.
+func deleteKeyRange(db *pebbledb, wb *pebble.Batch, prefix []byte) error {
+	iter := wb.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	for iter.First(); iter.Valid(); iter.Next() {
+		wb.Delete(append([]byte(nil), iter.Key()...), db.wo)
+	}
+	return iter.Close()
+}
+
+// readRow reads a row's columns and version, nil columns when it has none.
+func readRow(rd pebble.Reader, table, row string) (map[string]string, uint64, error) {
+	prefix := encodeRowPrefix(table, row)
+	versionKey := rowVersionKey(table, row)
+	iter := rd.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	var columns map[string]string
+	var version uint64
+	for iter.First(); iter.Valid(); iter.Next() {
+		if bytes.Equal(iter.Key(), versionKey) {
+			version = binary.LittleEndian.Uint64(iter.Value())
+			continue
+		}
+		if column, ok := decodeColumn(iter.Key(), prefix); ok {
+			if columns == nil {
+				columns = map[string]string{}
+			}
+			columns[column] = string(iter.Value())
+		}
+	}
+	return columns, version, iter.Close()
+}
@@ -0,0 +1,314 @@
+package multiraft
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func selectKeys(page *SelectPage) []string {
+	var keys []string
+	for _, row := range page.Rows {
+		keys = append(keys, row.Key)
+	}
+	return keys
+}
+
+func TestSelect_Index(t *testing.T) {
+	db := openTestDB(t, "select")
+	applyTestKV(t, db,
+		&KVData{Op: OpSetRow, Table: "users", Row: "a", Columns: map[string]string{"city": "oslo", "team": "x"}},
+		&KVData{Op: OpSetRow, Table: "users", Row: "b", Columns: map[string]string{"city": "rome", "team": "x"}},
+		// created after rows exist, they are backfilled.
+		&KVData{Op: OpCreateIndex, IndexDef: &IndexDef{Table: "users", Name: "by_city_team", Columns: []string{"city", "team"}}},
+		&KVData{Op: OpBackfillIndex, Table: "users", Row: "by_city_team"},
+		&KVData{Op: OpSetRow, Table: "users", Row: "c", Columns: map[string]string{"city": "oslo", "team": "y"}},
+		&KVData{Op: OpSetRow, Table: "users", Row: "d", Columns: map[string]string{"city": "oslo", "team": "x"}},
+		// moved out of oslo, and deleted.
+		&KVData{Table: "users", Row: "a", Column: "city", Val: "rome"},
+		&KVData{Op: OpSetRow, Table: "users", Row: "e", Columns: map[string]string{"city": "oslo", "team": "x"}},
+		&KVData{Op: OpDeleteRow, Table: "users", Row: "e"},
+	)
+
+	tests := []struct {
+		name  string
+		query SelectQuery
+		index string
+		want  []string
+	}{
+		{"leading column", SelectQuery{Where: map[string]string{"city": "oslo"}}, "by_city_team", []string{"d", "c"}},
+		{"both columns", SelectQuery{Where: map[string]string{"city": "rome", "team": "x"}}, "by_city_team", []string{"a", "b"}},
+		{"filtered after the index", SelectQuery{Where: map[string]string{"city": "rome", "team": "x", "age": "3"}}, "by_city_team", nil},
+		{"not indexed", SelectQuery{Where: map[string]string{"team": "x"}}, "", []string{"a", "b", "d"}},
+		{"scan forced", SelectQuery{Where: map[string]string{"city": "oslo"}, Scan: true}, "", []string{"c", "d"}},
+	}
+	for _, tt := range tests {
+		tt.query.Table, tt.query.Limit = "users", 10
+		page, err := db.selectRows(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Index != tt.index || !reflect.DeepEqual(selectKeys(page), tt.want) {
+			t.Errorf("%s: selectRows() = %s %v, want %s %v", tt.name, page.Index, selectKeys(page), tt.index, tt.want)
+		}
+	}
+
+	// paging resumes after the last position, rows come in index order.
+	query := SelectQuery{Table: "users", Where: map[string]string{"city": "oslo"}, Limit: 1}
+	var got []string
+	for {
+		page, err := db.selectRows(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, selectKeys(page)...)
+		if !page.More {
+			break
+		}
+		query.After = page.Last
+	}
+	if want := []string{"d", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("paged rows = %v, want %v", got, want)
+	}
+
+	applyTestKV(t, db, &KVData{Op: OpDropIndex, Table: "users", Row: "by_city_team"})
+	if defs, _ := db.indexes(); len(defs) != 0 {
+		t.Errorf("indexes() after drop = %v", defs)
+	}
+	for key := range dumpDB(t, db) {
+		if key[0] == indexKeyPrefix {
+			t.Errorf("entry %q left after drop", key)
+		}
+	}
+}
+
+func TestBackfillIndex(t *testing.T) {
+	defer func(n int) { backfillBatchRows = n }(backfillBatchRows)
+	backfillBatchRows = 2
+
+	db := openTestDB(t, "backfill")
+	for _, row := range []string{"a", "b", "c", "d", "e"} {
+		applyTestKV(t, db, &KVData{Table: "t", Row: row, Column: "x", Val: "1"})
+	}
+	applyTestKV(t, db, &KVData{Op: OpCreateIndex, IndexDef: &IndexDef{Table: "t", Name: "by_x", Columns: []string{"x"}}})
+	query := SelectQuery{Table: "t", Where: map[string]string{"x": "1"}, Index: "by_x", Limit: 10}
+	if _, err := db.selectRows(query); err != ErrIndexBuilding {
+		t.Errorf("selectRows() of a building index error = %v, want ErrIndexBuilding", err)
+	}
+	// a write while building is indexed by its own entry.
+	applyTestKV(t, db, &KVData{Table: "t", Row: "z", Column: "x", Val: "1"})
+
+	steps := 0
+	for {
+		defs, err := db.indexes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !defs[0].Building {
+			if defs[0].Backfilled != 6 {
+				t.Errorf("backfilled %d rows, want 6", defs[0].Backfilled)
+			}
+			break
+		}
+		steps++
+		from := defs[0].Cursor
+		applyTestKV(t, db, &KVData{Op: OpBackfillIndex, Table: "t", Row: "by_x", Val: from})
+		// a retried step is a no-op.
+		applyTestKV(t, db, &KVData{Op: OpBackfillIndex, Table: "t", Row: "by_x", Val: from})
+	}
+	if steps != 3 {
+		t.Errorf("backfilled in %d steps, want 3", steps)
+	}
+	page, err := db.selectRows(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := selectKeys(page), []string{"a", "b", "c", "d", "e", "z"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rows read through the index = %v, want %v", got, want)
+	}
+}
+
+func TestSelect_Bounds(t *testing.T) {
+	db := openTestDB(t, "bounds")
+	applyTestKV(t, db, &KVData{Op: OpCreateIndex, IndexDef: &IndexDef{Table: "t", Name: "by_x", Columns: []string{"x"}}})
+	applyTestKV(t, db, &KVData{Op: OpBackfillIndex, Table: "t", Row: "by_x"})
+	var want []string
+	for i := 0; i < 200; i++ {
+		row := fmt.Sprintf("r%03d", i)
+		applyTestKV(t, db, &KVData{Table: "t", Row: row, Column: "x", Val: "1"})
+		want = append(want, row)
+	}
+	canceled := make(chan struct{})
+	close(canceled)
+
+	for _, scan := range []bool{false, true} {
+		// pages of 6 byte rows stop once they hold 20 bytes, and resume.
+		query := SelectQuery{Table: "t", Where: map[string]string{"x": "1"}, Scan: scan, Limit: 1000, MaxBytes: 20}
+		var got []string
+		for {
+			page, err := db.selectRows(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, selectKeys(page)...)
+			if !page.More {
+				break
+			}
+			if len(page.Rows) != 4 || page.Partial != PartialBytes {
+				t.Fatalf("scan %v: page of %d rows partial %q, want 4 %q", scan, len(page.Rows), page.Partial, PartialBytes)
+			}
+			query.After = page.Last
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("scan %v: paged rows = %v, want %v", scan, got, want)
+		}
+
+		query = SelectQuery{Table: "t", Where: map[string]string{"x": "1"}, Scan: scan, Limit: 1000, Deadline: time.Now().Add(-time.Second)}
+		page, err := db.selectRows(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Rows) != readCheckEvery || !page.More || page.Partial != PartialTimeout {
+			t.Errorf("scan %v: past its deadline, page of %d rows more %v partial %q", scan, len(page.Rows), page.More, page.Partial)
+		}
+
+		query = SelectQuery{Table: "t", Where: map[string]string{"x": "1"}, Scan: scan, Limit: 1000, Done: canceled}
+		if _, err := db.selectRows(query); err != ErrQueryCanceled {
+			t.Errorf("scan %v: canceled selectRows() error = %v, want ErrQueryCanceled", scan, err)
+		}
+	}
+}
+
+func TestPlanSelect(t *testing.T) {
+	defs := []IndexDef{
+		{Name: "a", Columns: []string{"x"}},
+		{Name: "b", Columns: []string{"x", "y", "z"}},
+		{Name: "c", Columns: []string{"x", "y"}},
+	}
+	for _, tt := range []struct {
+		where []string
+		want  string
+	}{
+		{[]string{"x"}, "a"},
+		{[]string{"x", "y"}, "c"},
+		{[]string{"x", "y", "z"}, "b"},
+		{[]string{"y"}, ""},
+	} {
+		where := map[string]string{}
+		for _, c := range tt.where {
+			where[c] = "v"
+		}
+		got := ""
+		if def := PlanSelect(defs, nil, where); def != nil {
+			got = def.Name
+		}
+		if got != tt.want {
+			t.Errorf("PlanSelect(%v) = %q, want %q", tt.where, got, tt.want)
+		}
+	}
+
+	// with statistics the most selective read wins over the longest run.
+	defs = []IndexDef{
+		{Name: "by_country_city", Columns: []string{"country", "city"}},
+		{Name: "by_email", Columns: []string{"email"}},
+		{Name: "by_team", Columns: []string{"team"}},
+	}
+	stats := &TableStats{Rows: 1000, Columns: map[string]ColumnStats{
+		"country": {Rows: 1000, Distinct: 2},
+		"city":    {Rows: 1000, Distinct: 10},
+		"email":   {Rows: 1000, Distinct: 1000},
+		"team":    {Rows: 10, Distinct: 1},
+	}}
+	for _, tt := range []struct {
+		where []string
+		want  string
+	}{
+		{[]string{"country", "city", "email"}, "by_email"},
+		{[]string{"country", "city"}, "by_country_city"},
+		// few rows hold a team, its index is small.
+		{[]string{"country", "city", "team"}, "by_team"},
+		// not analyzed, no better than the table.
+		{[]string{"country", "unknown"}, "by_country_city"},
+	} {
+		where := map[string]string{}
+		for _, c := range tt.where {
+			where[c] = "v"
+		}
+		got := ""
+		if def := PlanSelect(defs, stats, where); def != nil {
+			got = def.Name
+		}
+		if got != tt.want {
+			t.Errorf("PlanSelect(%v) with stats = %q, want %q", tt.where, got, tt.want)
+		}
+	}
+}
+
+func TestExplainSelect(t *testing.T) {
+	db := openTestDB(t, "explain")
+	applyTestKV(t, db,
+		&KVData{Op: OpSetRow, Table: "users", Row: "a", Columns: map[string]string{"city": "oslo", "team": "x"}},
+		&KVData{Op: OpSetRow, Table: "users", Row: "b", Columns: map[string]string{"city": "rome", "team": "x"}},
+		&KVData{Op: OpSetRow, Table: "users", Row: "c", Columns: map[string]string{"city": "oslo", "team": "y"}},
+		&KVData{Op: OpCreateIndex, IndexDef: &IndexDef{Table: "users", Name: "by_city_team", Columns: []string{"city", "team"}}},
+		&KVData{Op: OpBackfillIndex, Table: "users", Row: "by_city_team"},
+	)
+	tests := []struct {
+		name  string
+		query SelectQuery
+		want  SelectPlan
+	}{
+		{"leading column", SelectQuery{Where: map[string]string{"city": "oslo", "age": "3"}},
+			SelectPlan{Index: "by_city_team", IndexColumns: []string{"city", "team"}, Matched: []string{"city"}, Filtered: []string{"age"}, Examined: 2}},
+		{"both columns", SelectQuery{Where: map[string]string{"city": "oslo", "team": "y"}},
+			SelectPlan{Index: "by_city_team", IndexColumns: []string{"city", "team"}, Matched: []string{"city", "team"}, Examined: 1}},
+		{"not indexed", SelectQuery{Where: map[string]string{"team": "x"}}, SelectPlan{Filtered: []string{"team"}, Examined: 3}},
+		{"scan forced", SelectQuery{Where: map[string]string{"city": "oslo"}, Scan: true}, SelectPlan{Filtered: []string{"city"}, Examined: 3}},
+	}
+	for _, tt := range tests {
+		tt.query.Table = "users"
+		tt.want.ExaminedPerPage = maxSelectExamined
+		plan, err := db.explainSelect(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*plan, tt.want) {
+			t.Errorf("%s: explainSelect() = %+v, want %+v", tt.name, *plan, tt.want)
+		}
+	}
+	if _, err := db.explainSelect(SelectQuery{Table: "users", Index: "missing"}); err != ErrIndexNotFound {
+		t.Errorf("explainSelect() of a missing index error = %v, want ErrIndexNotFound", err)
+	}
+}
+
+func TestMergeSelectPages(t *testing.T) {
+	page := func(more bool, positions ...string) *SelectPage {
+		p := &SelectPage{More: more, Positions: positions}
+		for _, pos := range positions {
+			p.Rows = append(p.Rows, ScanRow{Key: pos})
+			p.Last = pos
+		}
+		return p
+	}
+	// the second shard stopped at c, its next rows may come before e.
+	got := MergeSelectPages([]*SelectPage{page(false, "b", "e"), page(true, "a", "c")}, 10)
+	if keys := selectKeys(got); !reflect.DeepEqual(keys, []string{"a", "b", "c"}) || !got.More || got.Last != "c" {
+		t.Errorf("merged = %v more %v last %q", keys, got.More, got.Last)
+	}
+	got = MergeSelectPages([]*SelectPage{page(false, "b", "e"), page(false, "a", "c")}, 3)
+	if keys := selectKeys(got); !reflect.DeepEqual(keys, []string{"a", "b", "c"}) || !got.More || got.Last != "c" {
+		t.Errorf("limited = %v more %v last %q", keys, got.More, got.Last)
+	}
+	// the page cut short tells why.
+	short := page(true, "a", "c")
+	short.Partial = PartialTimeout
+	got = MergeSelectPages([]*SelectPage{page(true, "b", "e"), short}, 10)
+	if got.Partial != PartialTimeout {
+		t.Errorf("merged partial = %q, want %q", got.Partial, PartialTimeout)
+	}
+	got = MergeSelectPages([]*SelectPage{page(false, "b", "e"), short}, 1)
+	if got.Partial != "" {
+		t.Errorf("limited partial = %q, want none", got.Partial)
+	}
+}
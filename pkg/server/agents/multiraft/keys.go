@@ -0,0 +1,164 @@
+package multiraft
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Data keys are laid out as
+//
+//	0x01 | esc(table) 0x00 0x01 | esc(row) 0x00 0x01 | esc(column)
+//
+// where esc replaces every 0x00 with 0x00 0xff.  Tables, rows and columns can
+// hold any byte, the terminator sorts before any escaped byte so rows of a
+// table (and columns of a row) stay contiguous and in order, and encoding a
+// prefix of the components gives a prefix of the key.  The leading 0x01 keeps
+// data keys apart from system keys (0x00) and from the keys of the old
+// "table:row:column" layout.
+const (
+	dataKeyPrefix byte = 0x01
+	escapeByte    byte = 0x00
+	escapedZero   byte = 0xff
+	terminator    byte = 0x01
+
+	// keyLayoutKey records the key layout the data in pebble uses.
+	keyLayoutKey     string = "\x00key_layout"
+	currentKeyLayout string = "2"
+)
+
+func appendEscaped(buf []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if s[i] == escapeByte {
+			buf = append(buf, escapeByte, escapedZero)
+			continue
+		}
+		buf = append(buf, s[i])
+	}
+	return buf
+}
+
+func appendComponent(buf []byte, s string) []byte {
+	return append(appendEscaped(buf, s), escapeByte, terminator)
+}
+
+// encodeKey returns the storage key of a single column.
+func encodeKey(table, row, column string) []byte {
+	return appendEscaped(encodeRowPrefix(table, row), column)
+}
+
+// encodeRowPrefix returns the prefix shared by every column of a row.
+func encodeRowPrefix(table, row string) []byte {
+	return appendComponent(encodeTablePrefix(table), row)
+}
+
+// encodeRowKeyPrefix returns the prefix shared by every row of a table whose
+// row key starts with rowPrefix.
+func encodeRowKeyPrefix(table, rowPrefix string) []byte {
+	return appendEscaped(encodeTablePrefix(table), rowPrefix)
+}
+
+// encodeTablePrefix returns the prefix shared by every row of a table.
+func encodeTablePrefix(table string) []byte {
+	return appendComponent([]byte{dataKeyPrefix}, table)
+}
+
+// rowVersionKey holds the raft index a row was last modified at.  It sits in
+// the row's key range, so it is read atomically with the columns, but 0x00
+// 0x02 is never produced by escaping so it can't be mistaken for a column.
+func rowVersionKey(table, row string) []byte {
+	return append(encodeRowPrefix(table, row), escapeByte, 0x02)
+}
+
+// decodeRowVersionKey returns the row of a key written by rowVersionKey.
+func decodeRowVersionKey(key []byte) (string, bool) {
+	prefix, ok := bytes.CutSuffix(key, []byte{escapeByte, 0x02})
+	if !ok {
+		return "", false
+	}
+	_, row, column, ok := decodeKey(prefix)
+	return row, ok && column == ""
+}
+
+// decodeKey splits a data key into its components.
+// decodeTable returns the table of a data key.
+func decodeTable(key []byte) (string, bool) {
+	if len(key) == 0 || key[0] != dataKeyPrefix {
+		return "", false
+	}
+	var table []byte
+	for i := 1; i+1 < len(key); i++ {
+		if key[i] != escapeByte {
+			table = append(table, key[i])
+			continue
+		}
+		i++
+		switch key[i] {
+		case escapedZero:
+			table = append(table, escapeByte)
+		case terminator:
+			return string(table), true
+		default:
+			return "", false
+		}
+	}
+	return "", false
+}
+
+func decodeKey(key []byte) (table, row, column string, ok bool) {
+	if len(key) == 0 || key[0] != dataKeyPrefix {
+		return "", "", "", false
+	}
+	var parts []string
+	var cur []byte
+	for i := 1; i < len(key); i++ {
+		if key[i] != escapeByte {
+			cur = append(cur, key[i])
+			continue
+		}
+		if i+1 == len(key) {
+			return "", "", "", false
+		}
+		i++
+		switch key[i] {
+		case escapedZero:
+			cur = append(cur, escapeByte)
+		case terminator:
+			parts = append(parts, string(cur))
+			cur = nil
+		default:
+			return "", "", "", false
+		}
+	}
+	if len(parts) != 2 {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], string(cur), true
+}
+
+// decodeColumn returns the column of a data key starting with rowPrefix.
+func decodeColumn(key, rowPrefix []byte) (string, bool) {
+	if !bytes.HasPrefix(key, rowPrefix) {
+		return "", false
+	}
+	_, _, column, ok := decodeKey(key)
+	return column, ok
+}
+
+// splitLegacyKey splits a key of the old "table:row:column" layout.  Rows
+// and columns couldn't hold colons there, anything after the second colon
+// is part of the column.
+func splitLegacyKey(key string) (table, row, column string) {
+	parts := strings.SplitN(key, ":", 3)
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+	return parts[0], parts[1], parts[2]
+}
+
+// isLegacyDataKey reports whether a raw pebble key belongs to the old layout.
+func isLegacyDataKey(key []byte) bool {
+	if len(key) == 0 || key[0] == escapeByte || key[0] == dataKeyPrefix {
+		return false
+	}
+	return string(key) != appliedIndexKey
+}
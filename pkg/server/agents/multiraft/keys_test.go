@@ -0,0 +1,112 @@
+package multiraft
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestKeys_RoundTrip(t *testing.T) {
+	tests := []struct{ table, row, column string }{
+		{"users", "42", "name"},
+		{"a:b", "c:d", "e:f"},
+		{"t\x00", "\x00\x01", "\xff\x00"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		key := encodeKey(tt.table, tt.row, tt.column)
+		table, row, column, ok := decodeKey(key)
+		if !ok || table != tt.table || row != tt.row || column != tt.column {
+			t.Errorf("decodeKey(encodeKey(%q, %q, %q)) = %q, %q, %q, %v",
+				tt.table, tt.row, tt.column, table, row, column, ok)
+		}
+		if !bytes.HasPrefix(key, encodeRowPrefix(tt.table, tt.row)) {
+			t.Errorf("row prefix of %q is not a prefix of its key", tt)
+		}
+	}
+}
+
+func TestKeys_RowsDoNotCollide(t *testing.T) {
+	// with the old layout both of these were "t:a:b:c".
+	a := encodeKey("t", "a:b", "c")
+	b := encodeKey("t", "a", "b:c")
+	if bytes.Equal(a, b) {
+		t.Fatalf("keys collide: %q", a)
+	}
+	if bytes.HasPrefix(b, encodeRowPrefix("t", "a:b")) {
+		t.Errorf("column of row %q found under row %q", "a", "a:b")
+	}
+	// "a" must not be a row prefix of "ab" or "a\x00".
+	for _, other := range []string{"ab", "a\x00"} {
+		if bytes.HasPrefix(encodeKey("t", other, "c"), encodeRowPrefix("t", "a")) {
+			t.Errorf("row %q found under row prefix of %q", other, "a")
+		}
+	}
+}
+
+func TestKeys_Ordering(t *testing.T) {
+	rows := []string{"b", "a\x00", "a", "ab", "\x00"}
+	keys := make([][]byte, len(rows))
+	for i, r := range rows {
+		keys[i] = encodeKey("t", r, "c")
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	want := []string{"\x00", "a", "a\x00", "ab", "b"}
+	for i, k := range keys {
+		if _, row, _, _ := decodeKey(k); row != want[i] {
+			t.Errorf("key %d is row %q, want %q", i, row, want[i])
+		}
+	}
+}
+
+func TestKeys_ScanPageVersions(t *testing.T) {
+	db := openTestDB(t, "scan-versions")
+	applyTestKV(t, db,
+		&KVData{Table: "t", Row: "a", Column: "", Val: "empty column"},
+		&KVData{Table: "t", Row: "b", Column: "x", Val: "1"},
+		&KVData{Table: "t", Row: "c", Column: "x", Val: "1"},
+		&KVData{Op: OpDeleteRow, Table: "t", Row: "c"},
+	)
+	page, err := db.scanPage("t", "", 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Rows) != 2 || page.Rows[0].Version != 1 || page.Rows[1].Version != 2 {
+		t.Errorf("scanPage() = %+v, want rows a and b at versions 1 and 2, deleted c skipped", page.Rows)
+	}
+
+	page, err = db.scanPage("t", "", 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Rows) != 2 || page.Rows[0].Key != "b" || page.Rows[0].Version != 2 || page.Rows[1].Version != 1 || page.Rows[1].Columns[""] != "empty column" {
+		t.Errorf("reverse scanPage() = %+v, want rows b and a at versions 2 and 1", page.Rows)
+	}
+	page, err = db.scanPage("t", "b", 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Rows) != 1 || page.Rows[0].Key != "a" || page.More {
+		t.Errorf("reverse scanPage() below b = %+v, want row a only", page)
+	}
+}
+
+func TestKeys_Tables(t *testing.T) {
+	db := openTestDB(t, "tables")
+	applyTestKV(t, db,
+		&KVData{Table: "users", Row: "a", Column: "x", Val: "1"},
+		&KVData{Table: "users", Row: "b", Column: "x", Val: "1"},
+		&KVData{Table: "a\x00b", Row: "a", Column: "x", Val: "1"},
+		&KVData{Table: "_nodes", Row: "n1", Column: "state", Val: "alive"},
+		&KVData{Table: "gone", Row: "a", Column: "x", Val: "1"},
+		&KVData{Op: OpDeleteRow, Table: "gone", Row: "a"},
+	)
+	tables, err := db.tables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"_nodes", "a\x00b", "users"}; !reflect.DeepEqual(tables, want) {
+		t.Errorf("tables() = %q, want %q", tables, want)
+	}
+}
@@ -0,0 +1,93 @@
+package multiraft
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// ListKeysQuery asks for up to Limit row keys of Table starting with Prefix,
+// in order, after the key or common prefix After.  With a Delimiter the keys
+// holding it past Prefix are rolled up into common prefixes, everything up
+// to and including its first occurrence, like S3's delimited listings.
+type ListKeysQuery struct {
+	Table     string
+	Prefix    string
+	Delimiter string
+	After     string
+	Limit     int
+}
+
+// KeyListing is the result of a ListKeysQuery.  Limit bounds the keys and
+// common prefixes together, More is set when there are further ones.
+type KeyListing struct {
+	Keys           []string `json:"keys"`
+	CommonPrefixes []string `json:"common_prefixes"`
+	More           bool     `json:"-"`
+}
+
+// Last returns the last key or common prefix listed, a listing resumes after
+// it.
+func (l *KeyListing) Last() string {
+	var last string
+	if n := len(l.Keys); n > 0 {
+		last = l.Keys[n-1]
+	}
+	if n := len(l.CommonPrefixes); n > 0 && l.CommonPrefixes[n-1] > last {
+		last = l.CommonPrefixes[n-1]
+	}
+	return last
+}
+
+// listKeys seeks past every row once it is listed, and past every key of a
+// common prefix once the prefix is, so browsing a level of a hierarchy
+// doesn't read the levels below.
+func (r *pebbledb) listKeys(q ListKeysQuery) (*KeyListing, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil, errors.New("db already closed")
+	}
+	lower := encodeRowKeyPrefix(q.Table, q.Prefix)
+	if q.After != "" {
+		after := prefixUpperBound(encodeRowPrefix(q.Table, q.After))
+		if q.Delimiter != "" && strings.HasPrefix(q.After, q.Prefix) && strings.Contains(q.After[len(q.Prefix):], q.Delimiter) {
+			// listed keys never hold the delimiter, After is a common prefix.
+			after = prefixUpperBound(encodeRowKeyPrefix(q.Table, q.After))
+		}
+		if string(after) > string(lower) {
+			lower = after
+		}
+	}
+	iter := r.db.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: prefixUpperBound(encodeRowKeyPrefix(q.Table, q.Prefix))})
+	listing := &KeyListing{}
+	for iter.First(); iter.Valid(); {
+		_, row, _, ok := decodeKey(iter.Key())
+		if !ok {
+			// the versions of rows, deleted ones have nothing else.
+			iter.Next()
+			continue
+		}
+		if len(listing.Keys)+len(listing.CommonPrefixes) == q.Limit {
+			listing.More = true
+			break
+		}
+		rest := row[len(q.Prefix):]
+		if i := strings.Index(rest, q.Delimiter); q.Delimiter != "" && i >= 0 {
+			common := q.Prefix + rest[:i+len(q.Delimiter)]
+			listing.CommonPrefixes = append(listing.CommonPrefixes, common)
+			iter.SeekGE(prefixUpperBound(encodeRowKeyPrefix(q.Table, common)))
+			continue
+		}
+		listing.Keys = append(listing.Keys, row)
+		iter.SeekGE(prefixUpperBound(encodeRowPrefix(q.Table, row)))
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return listing, nil
+}
@@ -0,0 +1,43 @@
+package multiraft
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestListKeys(t *testing.T) {
+	db := openTestDB(t, "list-keys")
+	for _, row := range []string{"a/1", "a/2", "a/b/1", "b", "c/1", "c/2", "d/1"} {
+		applyTestKV(t, db, &KVData{Table: "t", Row: row, Column: "x", Val: "1"})
+	}
+	applyTestKV(t, db, &KVData{Op: OpDeleteRow, Table: "t", Row: "d/1"})
+
+	tests := []struct {
+		name  string
+		query ListKeysQuery
+		want  KeyListing
+	}{
+		{"all", ListKeysQuery{Limit: 10},
+			KeyListing{Keys: []string{"a/1", "a/2", "a/b/1", "b", "c/1", "c/2"}}},
+		{"top level", ListKeysQuery{Delimiter: "/", Limit: 10},
+			KeyListing{Keys: []string{"b"}, CommonPrefixes: []string{"a/", "c/"}}},
+		{"one level down", ListKeysQuery{Prefix: "a/", Delimiter: "/", Limit: 10},
+			KeyListing{Keys: []string{"a/1", "a/2"}, CommonPrefixes: []string{"a/b/"}}},
+		{"limited", ListKeysQuery{Delimiter: "/", Limit: 2},
+			KeyListing{Keys: []string{"b"}, CommonPrefixes: []string{"a/"}, More: true}},
+		{"after a common prefix", ListKeysQuery{Delimiter: "/", After: "a/", Limit: 10},
+			KeyListing{Keys: []string{"b"}, CommonPrefixes: []string{"c/"}}},
+		{"after a key", ListKeysQuery{Prefix: "a/", After: "a/1", Limit: 10},
+			KeyListing{Keys: []string{"a/2", "a/b/1"}}},
+	}
+	for _, tt := range tests {
+		tt.query.Table = "t"
+		got, err := db.listKeys(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("%s: listKeys() = %+v, want %+v", tt.name, *got, tt.want)
+		}
+	}
+}
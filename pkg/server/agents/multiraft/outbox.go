@@ -0,0 +1,272 @@
+package multiraft
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/cockroachdb/pebble"
+)
+
+const (
+	// sinkPrefix keys the sinks, by name.
+	sinkPrefix string = "\x00sink:"
+	// outboxPrefix keys the changes of the entries applied while sinks are
+	// registered, by the entry's index, big endian so they sort by index.
+	outboxPrefix string = "\x00outbox:"
+)
+
+// Sink is a webhook the changes to the user tables are delivered to, in
+// index order.  Offset is the index of the last entry it acknowledged, the
+// outbox keeps the changes of the entries after the lowest Offset so a new
+// leader resumes delivery where the old one was acknowledged.
+type Sink struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Tables limits the changes delivered to those tables, all of them when
+	// empty.
+	Tables []string `json:"tables,omitempty"`
+	Offset uint64   `json:"offset"`
+}
+
+// Change is a write to a user table, as delivered to the sinks.
+type Change struct {
+	Op      string            `json:"op"`
+	Table   string            `json:"table"`
+	Row     string            `json:"row"`
+	Column  string            `json:"column,omitempty"`
+	Val     string            `json:"val,omitempty"`
+	Columns map[string]string `json:"columns,omitempty"`
+}
+
+// OutboxEntry holds the changes made by the entry applied at Index.
+type OutboxEntry struct {
+	Index   uint64   `json:"index"`
+	Changes []Change `json:"changes"`
+}
+
+// SinksQuery asks for the sinks, by name.
+type SinksQuery struct{}
+
+// OutboxQuery asks for up to Limit outbox entries after the index After.
+type OutboxQuery struct {
+	After uint64
+	Limit int
+}
+
+// Validate checks a sink before it is proposed.
+func (s *Sink) Validate() error {
+	if !validIndexName(s.Name) {
+		return fmt.Errorf("sink name %q isn't letters, digits, '_' and '-'", s.Name)
+	}
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("sink url %q isn't an http(s) url", s.URL)
+	}
+	return nil
+}
+
+// Delivers reports whether changes to table go to the sink.
+func (s *Sink) Delivers(table string) bool {
+	if len(s.Tables) == 0 {
+		return true
+	}
+	for _, t := range s.Tables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
+
+func sinkKey(name string) []byte {
+	return append([]byte(sinkPrefix), name...)
+}
+
+func outboxKey(index uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte(outboxPrefix), index)
+}
+
+func readSinks(rd pebble.Reader) ([]Sink, error) {
+	prefix := []byte(sinkPrefix)
+	iter := rd.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	var sinks []Sink
+	for iter.First(); iter.Valid(); iter.Next() {
+		sink := Sink{}
+		if err := json.Unmarshal(iter.Value(), &sink); err != nil {
+			iter.Close()
+			return nil, fmt.Errorf("decoding sink %q: %w", iter.Key(), err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return sinks, nil
+}
+
+func readSink(rd pebble.Reader, name string) (*Sink, error) {
+	val, closer, err := rd.Get(sinkKey(name))
+	if err == pebble.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	sink := &Sink{}
+	if err := json.Unmarshal(val, sink); err != nil {
+		return nil, fmt.Errorf("decoding sink %q: %w", name, err)
+	}
+	return sink, nil
+}
+
+func putSink(db *pebbledb, wb *pebble.Batch, sink *Sink) error {
+	buf, err := json.Marshal(sink)
+	if err != nil {
+		return err
+	}
+	wb.Set(sinkKey(sink.Name), buf, db.wo)
+	return nil
+}
+
+// hasSinks reports whether changes are recorded in the outbox.  Like the
+// write freeze it only depends on the log, every replica records the same.
+func hasSinks(wb *pebble.Batch) (bool, error) {
+	prefix := []byte(sinkPrefix)
+	iter := wb.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	found := iter.First()
+	return found, iter.Close()
+}
+
+// setSink registers a sink, delivering the entries applied after index, or
+// changes the url and tables of an existing one, keeping its offset.
+func setSink(db *pebbledb, wb *pebble.Batch, sink *Sink, index uint64) error {
+	old, err := readSink(wb, sink.Name)
+	if err != nil {
+		return err
+	}
+	updated := *sink
+	updated.Offset = index
+	if old != nil {
+		updated.Offset = old.Offset
+	}
+	return putSink(db, wb, &updated)
+}
+
+// dropSink unregisters a sink, the outbox entries only it was waiting for
+// are dropped with it.
+func dropSink(db *pebbledb, wb *pebble.Batch, name string) error {
+	wb.Delete(sinkKey(name), db.wo)
+	return trimOutbox(db, wb)
+}
+
+// ackSink moves the offset of a sink forward to index, never backward, so
+// the acknowledgement of a deposed leader can't redeliver what its successor
+// already delivered.
+func ackSink(db *pebbledb, wb *pebble.Batch, name string, index uint64) error {
+	sink, err := readSink(wb, name)
+	if err != nil || sink == nil || index <= sink.Offset {
+		return err
+	}
+	sink.Offset = index
+	if err := putSink(db, wb, sink); err != nil {
+		return err
+	}
+	return trimOutbox(db, wb)
+}
+
+// trimOutbox drops the outbox entries every sink acknowledged, all of them
+// once there is no sink left.
+func trimOutbox(db *pebbledb, wb *pebble.Batch) error {
+	sinks, err := readSinks(wb)
+	if err != nil {
+		return err
+	}
+	end := prefixUpperBound([]byte(outboxPrefix))
+	if len(sinks) > 0 {
+		acked := sinks[0].Offset
+		for _, sink := range sinks[1:] {
+			if sink.Offset < acked {
+				acked = sink.Offset
+			}
+		}
+		end = outboxKey(acked + 1)
+	}
+	return wb.DeleteRange([]byte(outboxPrefix), end, db.wo)
+}
+
+// recordOutbox records the changes an entry made, when sinks are registered.
+func recordOutbox(db *pebbledb, wb *pebble.Batch, index uint64, changes []Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	buf, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	wb.Set(outboxKey(index), buf, db.wo)
+	return nil
+}
+
+// change returns the change a write to a user table makes, false for the
+// other entries.
+func (kv *KVData) change() (Change, bool) {
+	if strings.HasPrefix(kv.Table, "_") {
+		return Change{}, false
+	}
+	c := Change{Op: kv.Op, Table: kv.Table, Row: kv.Row}
+	switch kv.Op {
+	case OpSet:
+		c.Op, c.Column, c.Val = "set", kv.Column, kv.Val
+	case OpDelete:
+		c.Column = kv.Column
+	case OpSetRow, OpReplaceRow:
+		c.Columns = kv.Columns
+	case OpDeleteRow, OpPurge:
+	case OpDeletePrefix, OpDeleteWhere:
+		// Row is the prefix, the rows matching the filter aren't listed.
+	case OpDeleteRange:
+		// the rows from Row up to Val, which aren't listed either.
+		c.Val = kv.Val
+	default:
+		return Change{}, false
+	}
+	return c, true
+}
+
+func (r *pebbledb) sinks() ([]Sink, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil, errors.New("db already closed")
+	}
+	return readSinks(r.db)
+}
+
+func (r *pebbledb) outbox(query OutboxQuery) ([]OutboxEntry, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil, errors.New("db already closed")
+	}
+	iter := r.db.NewIter(&pebble.IterOptions{
+		LowerBound: outboxKey(query.After + 1),
+		UpperBound: prefixUpperBound([]byte(outboxPrefix)),
+	})
+	var entries []OutboxEntry
+	for iter.First(); iter.Valid() && len(entries) < query.Limit; iter.Next() {
+		entry := OutboxEntry{Index: binary.BigEndian.Uint64(iter.Key()[len(outboxPrefix):])}
+		if err := json.Unmarshal(iter.Value(), &entry.Changes); err != nil {
+			iter.Close()
+			return nil, fmt.Errorf("decoding outbox entry %d: %w", entry.Index, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,83 @@
+package multiraft
+
+import (
+	"testing"
+	"unsafe"
+
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func TestOutbox(t *testing.T) {
+	db := openTestDB(t, "outbox")
+	d := &DiskKV{db: unsafe.Pointer(db)}
+	index := uint64(0)
+	apply := func(kv KVData) {
+		t.Helper()
+		cmd, err := kv.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		index++
+		if _, err := d.Update([]sm.Entry{{Index: index, Cmd: cmd}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outbox := func() []uint64 {
+		t.Helper()
+		entries, err := db.outbox(OutboxQuery{Limit: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var indexes []uint64
+		for _, e := range entries {
+			indexes = append(indexes, e.Index)
+		}
+		return indexes
+	}
+
+	apply(KVData{Table: "t", Row: "r", Column: "c", Val: "before"}) // 1
+	if got := outbox(); len(got) != 0 {
+		t.Fatalf("outbox without sinks = %v, want empty", got)
+	}
+	apply(KVData{Op: OpSetSink, Sink: &Sink{Name: "a", URL: "http://a"}}) // 2
+	apply(KVData{Op: OpSetSink, Sink: &Sink{Name: "b", URL: "http://b"}}) // 3
+	apply(KVData{Table: "t", Row: "r", Column: "c", Val: "1"})            // 4
+	apply(KVData{Table: "_events", Row: "e", Column: "c", Val: "x"})      // 5, system tables aren't delivered
+	apply(KVData{Op: OpBatch, Writes: []TxnWrite{                         // 6
+		{Table: "t", Row: "r", Column: "c", Val: "2"},
+		{Table: "u", Row: "s", Column: "c", Delete: true},
+	}})
+	if got := outbox(); len(got) != 2 || got[0] != 4 || got[1] != 6 {
+		t.Fatalf("outbox = %v, want [4 6]", got)
+	}
+	entries, err := db.outbox(OutboxQuery{After: 4, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || len(entries[0].Changes) != 2 || entries[0].Changes[1].Op != OpDelete || entries[0].Changes[1].Table != "u" {
+		t.Errorf("outbox after 4 = %+v, want the batch's two changes", entries)
+	}
+
+	// entries are kept until every sink acknowledged them, offsets never go back.
+	apply(KVData{Op: OpAckSink, Row: "a", Index: 6}) // 7
+	if got := outbox(); len(got) != 2 {
+		t.Errorf("outbox acknowledged by one sink = %v, want both entries", got)
+	}
+	apply(KVData{Op: OpAckSink, Row: "b", Index: 4}) // 8
+	apply(KVData{Op: OpAckSink, Row: "a", Index: 5}) // 9
+	if got := outbox(); len(got) != 1 || got[0] != 6 {
+		t.Errorf("outbox = %v, want [6]", got)
+	}
+	sinks, err := db.sinks()
+	if err != nil || len(sinks) != 2 || sinks[0].Offset != 6 || sinks[1].Offset != 4 {
+		t.Errorf("sinks = %+v, %v, want offsets 6 and 4", sinks, err)
+	}
+
+	// dropping the last sink stops recording.
+	apply(KVData{Op: OpDropSink, Row: "a"}) // 10
+	apply(KVData{Op: OpDropSink, Row: "b"}) // 11
+	apply(KVData{Table: "t", Row: "r", Column: "c", Val: "3"})
+	if got := outbox(); len(got) != 0 {
+		t.Errorf("outbox without sinks = %v, want empty", got)
+	}
+}
@@ -0,0 +1,122 @@
+package multiraft
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// purgePrefix keys the purges applied, by PurgeID.  They don't hold the row
+// key, only its hash.
+const purgePrefix string = "\x00purge:"
+
+// Purge records a row purged by OpPurge at Index.  Every replica verifies on
+// its own that the row is gone from its store and from the raft log it
+// keeps, see server.runPurges.
+type Purge struct {
+	ID    string `json:"id"`
+	Table string `json:"table"`
+	Index uint64 `json:"index"`
+}
+
+// PurgesQuery asks for the purges applied, by ID.
+type PurgesQuery struct{}
+
+// PurgeID identifies the purge of a row without naming it.
+func PurgeID(table, row string) string {
+	sum := sha256.Sum256([]byte(table + "\x00" + row))
+	return hex.EncodeToString(sum[:16])
+}
+
+func purgeKey(id string) []byte {
+	return []byte(purgePrefix + id)
+}
+
+// purgeRow removes every trace of a row the store keeps: its columns, their
+// tombstones, its version and index entries, and its changes waiting in the
+// outbox.  Nothing is left to tell the row ever existed but the purge record.
+func purgeRow(db *pebbledb, wb *pebble.Batch, table, row string, index uint64) error {
+	ix, err := indexRow(wb, table, row)
+	if err != nil {
+		return err
+	}
+	prefix := encodeRowPrefix(table, row)
+	wb.DeleteRange(prefix, prefixUpperBound(prefix), db.wo)
+	tombstones := tombstoneKey(prefix)
+	wb.DeleteRange(tombstones, prefixUpperBound(tombstones), db.wo)
+	if err := ix.update(db, wb); err != nil {
+		return err
+	}
+	if err := scrubOutbox(db, wb, table, row); err != nil {
+		return err
+	}
+	buf, err := json.Marshal(Purge{ID: PurgeID(table, row), Table: table, Index: index})
+	if err != nil {
+		return err
+	}
+	wb.Set(purgeKey(PurgeID(table, row)), buf, db.wo)
+	return nil
+}
+
+// scrubOutbox drops the changes to a row from the outbox entries not
+// delivered yet, and the entries left empty.
+func scrubOutbox(db *pebbledb, wb *pebble.Batch, table, row string) error {
+	prefix := []byte(outboxPrefix)
+	iter := wb.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	for iter.First(); iter.Valid(); iter.Next() {
+		var changes []Change
+		if err := json.Unmarshal(iter.Value(), &changes); err != nil {
+			iter.Close()
+			return fmt.Errorf("decoding outbox entry %q: %w", iter.Key(), err)
+		}
+		kept := changes[:0]
+		for _, c := range changes {
+			prefixed := c.Op == OpDeletePrefix || c.Op == OpDeleteWhere || c.Op == OpDeleteRange
+			if c.Table != table || c.Row != row || prefixed {
+				kept = append(kept, c)
+			}
+		}
+		if len(kept) == len(changes) {
+			continue
+		}
+		key := append([]byte(nil), iter.Key()...)
+		if len(kept) == 0 {
+			wb.Delete(key, db.wo)
+			continue
+		}
+		buf, err := json.Marshal(kept)
+		if err != nil {
+			iter.Close()
+			return err
+		}
+		wb.Set(key, buf, db.wo)
+	}
+	return iter.Close()
+}
+
+func (r *pebbledb) purges() ([]Purge, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil, errors.New("db already closed")
+	}
+	prefix := []byte(purgePrefix)
+	iter := r.db.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	var purges []Purge
+	for iter.First(); iter.Valid(); iter.Next() {
+		p := Purge{}
+		if err := json.Unmarshal(iter.Value(), &p); err != nil {
+			iter.Close()
+			return nil, fmt.Errorf("decoding purge %q: %w", iter.Key(), err)
+		}
+		purges = append(purges, p)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return purges, nil
+}
@@ -0,0 +1,59 @@
+package multiraft
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"unsafe"
+
+	"github.com/cockroachdb/pebble"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+func TestPurge(t *testing.T) {
+	db := openTestDB(t, "purge")
+	d := &DiskKV{db: unsafe.Pointer(db)}
+	index := uint64(0)
+	apply := func(kv KVData) {
+		t.Helper()
+		cmd, err := kv.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		index++
+		if _, err := d.Update([]sm.Entry{{Index: index, Cmd: cmd}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	apply(KVData{Op: OpCreateIndex, IndexDef: &IndexDef{Table: "users", Name: "by_email", Columns: []string{"email"}}})
+	apply(KVData{Op: OpBackfillIndex, Table: "users", Row: "by_email"})
+	apply(KVData{Op: OpSetSink, Sink: &Sink{Name: "audit", URL: "http://audit"}})
+	apply(KVData{Op: OpSetRow, Table: "users", Row: "alice", Columns: map[string]string{"email": "alice@example.com", "plan": "pro"}})
+	apply(KVData{Op: OpSetRow, Table: "users", Row: "bob", Columns: map[string]string{"email": "bob@example.com"}})
+	apply(KVData{Op: OpDelete, Table: "users", Row: "alice", Column: "plan"})
+	apply(KVData{Op: OpPurge, Table: "users", Row: "alice"})
+
+	iter := db.db.NewIter(&pebble.IterOptions{})
+	for iter.First(); iter.Valid(); iter.Next() {
+		if !bytes.Contains(iter.Key(), []byte("alice")) && !bytes.Contains(iter.Value(), []byte("alice")) {
+			continue
+		}
+		// only the purge's own change is left for the sinks, so they purge too.
+		var changes []Change
+		if bytes.HasPrefix(iter.Key(), []byte(outboxPrefix)) && json.Unmarshal(iter.Value(), &changes) == nil &&
+			len(changes) == 1 && changes[0].Op == OpPurge {
+			continue
+		}
+		t.Errorf("key %q = %q still holds the purged row", iter.Key(), iter.Value())
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if row, err := db.lookup("users", "bob", nil); err != nil || row.Columns["email"] != "bob@example.com" {
+		t.Errorf("other row = %+v, %v, want it kept", row, err)
+	}
+	purges, err := db.purges()
+	if err != nil || len(purges) != 1 || purges[0].ID != PurgeID("users", "alice") || purges[0].Index != index {
+		t.Errorf("purges = %+v, %v, want the purge at %d", purges, err, index)
+	}
+}
@@ -0,0 +1,67 @@
+package multiraft
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// ReplayProgress describes how far the local replica got replaying its raft
+// log after a restart.
+type ReplayProgress struct {
+	// StartIndex is the applied index the FSM was opened at.
+	StartIndex uint64
+	// TargetIndex is the last entry of the local raft log at startup.
+	TargetIndex uint64
+	// AppliedIndex is the last index applied so far.
+	AppliedIndex uint64
+	// CaughtUp is set once the replica has applied everything the leader had
+	// committed, it stays set from then on.
+	CaughtUp bool
+}
+
+// replayState is shared between the agent and the DiskKV it starts.
+type replayState struct {
+	opened   atomic.Uint64
+	target   atomic.Uint64
+	caughtUp atomic.Bool
+}
+
+// ReplayProgress reports the raft log replay of the local replica.  Once the
+// local log has been replayed it does a linearizable read, bounded by ctx, to
+// confirm the replica has caught up with the leader.
+func (a *Agent) ReplayProgress(ctx context.Context) (ReplayProgress, error) {
+	p := ReplayProgress{
+		StartIndex:  a.replay.opened.Load(),
+		TargetIndex: a.replay.target.Load(),
+		CaughtUp:    a.replay.caughtUp.Load(),
+	}
+	if a.config.Witness {
+		// witnesses never apply entries, there is nothing to replay.
+		p.CaughtUp = true
+		return p, nil
+	}
+	applied, err := a.AppliedIndex()
+	if err != nil {
+		return p, err
+	}
+	p.AppliedIndex = applied
+	if p.CaughtUp || applied < p.TargetIndex {
+		return p, nil
+	}
+	if _, err := a.nh.SyncRead(ctx, a.shardID, appliedIndexQuery{}); err != nil {
+		return p, nil // no leader yet, or it's ahead of us
+	}
+	a.replay.caughtUp.Store(true)
+	p.CaughtUp = true
+	return p, nil
+}
+
+// recordReplayTarget remembers how far the local raft log goes at startup.
+func (a *Agent) recordReplayTarget() {
+	lr, err := a.nh.GetLogReader(a.shardID)
+	if err != nil {
+		return
+	}
+	_, last := lr.GetRange()
+	a.replay.target.Store(last)
+}
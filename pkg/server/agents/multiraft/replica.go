@@ -0,0 +1,210 @@
+package multiraft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/golang/snappy"
+)
+
+const (
+	// replicaStagePrefix holds the data of a standby snapshot while it is
+	// being shipped, OpCommitReplica swaps it in.
+	replicaStagePrefix string = "\x00replica_stage:"
+	// replicaSourceIndexKey is the primary's applied index of the last
+	// standby snapshot committed.
+	replicaSourceIndexKey string = "\x00replica_source_index"
+	// replicaPromotedKey is set once the standby has been promoted, staged
+	// snapshots are never committed after it.
+	replicaPromotedKey string = "\x00replica_promoted"
+)
+
+// ExportQuery streams the user data of the local replica to W, to be loaded
+// into a standby cluster with ReadExport.  System tables aren't exported, the
+// standby has its own node catalog and secrets.
+type ExportQuery struct {
+	W io.Writer
+}
+
+// StandbyQuery asks a standby for its StandbyState.
+type StandbyQuery struct{}
+
+// StandbyState is the result of a StandbyQuery.  SourceIndex is the
+// primary's applied index of the last snapshot committed, 0 if none was.
+type StandbyState struct {
+	SourceIndex uint64
+	Promoted    bool
+}
+
+// KVPair is a raw pebble key and value of an exported snapshot.
+type KVPair struct {
+	Key []byte
+	Val []byte
+}
+
+// isReplicatedKey reports whether a raw key holds user data, that is a data
+// key (or row version) of a table not prefixed with "_".
+func isReplicatedKey(key []byte) bool {
+	return len(key) > 0 && key[0] == dataKeyPrefix && (len(key) == 1 || key[1] != '_')
+}
+
+// export writes the applied index followed by every user data key and value
+// of a pebble snapshot, in the record format of snapshotFormatV3.  It returns
+// the applied index the export is consistent with.
+func (r *pebbledb) export(w io.Writer) (uint64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return 0, errors.New("db already closed")
+	}
+	ss := r.db.NewSnapshot()
+	defer ss.Close()
+
+	var index uint64
+	val, closer, err := ss.Get([]byte(appliedIndexKey))
+	if err == nil {
+		index = binary.LittleEndian.Uint64(val)
+		closer.Close()
+	} else if err != pebble.ErrNotFound {
+		return 0, err
+	}
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint64(header, index)
+	if _, err := w.Write(header); err != nil {
+		return 0, err
+	}
+
+	sw := snappy.NewBufferedWriter(w)
+	iter := ss.NewIter(&pebble.IterOptions{LowerBound: []byte{dataKeyPrefix}, UpperBound: []byte{dataKeyPrefix + 1}})
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		if !isReplicatedKey(iter.Key()) {
+			continue
+		}
+		if err := writeRecord(sw, iter.Key()); err != nil {
+			return 0, err
+		}
+		if err := writeRecord(sw, iter.Value()); err != nil {
+			return 0, err
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	end := make([]byte, 8)
+	binary.LittleEndian.PutUint64(end, snapshotEnd)
+	if _, err := sw.Write(end); err != nil {
+		return 0, err
+	}
+	return index, sw.Close()
+}
+
+// ReadExport decodes a stream written for an ExportQuery, calling fn for
+// every pair.  It returns the primary's applied index the export came from.
+func ReadExport(r io.Reader, fn func(KVPair) error) (uint64, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, fmt.Errorf("reading export header: %w", err)
+	}
+	next := rawEntryReader(bufio.NewReader(snappy.NewReader(r)))
+	for {
+		kv, err := next()
+		if err != nil {
+			return 0, err
+		}
+		if kv == nil {
+			return binary.LittleEndian.Uint64(header), nil
+		}
+		if !isReplicatedKey([]byte(kv.Key)) {
+			return 0, fmt.Errorf("export holds a non replicated key %q", kv.Key)
+		}
+		if err := fn(KVPair{Key: []byte(kv.Key), Val: []byte(kv.Val)}); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// applyReplicaOp adds the effects of the standby snapshot ops to the batch.
+// A snapshot is staged by OpResetReplica and any number of OpStageReplica
+// entries, and only becomes visible with OpCommitReplica, so a shipment cut
+// short leaves the previous snapshot in place.
+func applyReplicaOp(db *pebbledb, wb *pebble.Batch, kv *KVData) error {
+	stage := []byte(replicaStagePrefix)
+	switch kv.Op {
+	case OpResetReplica:
+		return wb.DeleteRange(stage, prefixUpperBound(stage), db.wo)
+	case OpStageReplica:
+		for _, pair := range kv.Pairs {
+			if !isReplicatedKey(pair.Key) {
+				return nil // never proposed, ReadExport checks the keys
+			}
+			wb.Set(append([]byte(replicaStagePrefix), pair.Key...), pair.Val, db.wo)
+		}
+		return nil
+	case OpPromoteStandby:
+		wb.Set([]byte(replicaPromotedKey), nil, db.wo)
+		return wb.DeleteRange(stage, prefixUpperBound(stage), db.wo)
+	case OpCommitReplica:
+		if _, closer, err := wb.Get([]byte(replicaPromotedKey)); err == nil {
+			closer.Close()
+			return nil // the old primary lost the race with the promotion
+		} else if err != pebble.ErrNotFound {
+			return err
+		}
+		iter := wb.NewIter(&pebble.IterOptions{LowerBound: []byte{dataKeyPrefix}, UpperBound: []byte{dataKeyPrefix + 1}})
+		for iter.First(); iter.Valid(); iter.Next() {
+			if isReplicatedKey(iter.Key()) {
+				wb.Delete(append([]byte(nil), iter.Key()...), db.wo)
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+		iter = wb.NewIter(&pebble.IterOptions{LowerBound: stage, UpperBound: prefixUpperBound(stage)})
+		for iter.First(); iter.Valid(); iter.Next() {
+			key := append([]byte(nil), iter.Key()[len(stage):]...)
+			wb.Set(key, append([]byte(nil), iter.Value()...), db.wo)
+			wb.Delete(tombstoneKey(key), db.wo)
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+		if err := wb.DeleteRange(stage, prefixUpperBound(stage), db.wo); err != nil {
+			return err
+		}
+		index := make([]byte, 8)
+		binary.LittleEndian.PutUint64(index, kv.Index)
+		wb.Set([]byte(replicaSourceIndexKey), index, db.wo)
+		// the standby's indexes are its own, rebuilt over the new data.
+		return rebuildIndexes(db, wb)
+	}
+	return fmt.Errorf("not a replica op: %q", kv.Op)
+}
+
+func (r *pebbledb) standbyState() (*StandbyState, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil, errors.New("db already closed")
+	}
+	state := &StandbyState{}
+	val, closer, err := r.db.Get([]byte(replicaSourceIndexKey))
+	if err == nil {
+		state.SourceIndex = binary.LittleEndian.Uint64(val)
+		closer.Close()
+	} else if err != pebble.ErrNotFound {
+		return nil, err
+	}
+	_, closer, err = r.db.Get([]byte(replicaPromotedKey))
+	if err == nil {
+		state.Promoted = true
+		closer.Close()
+	} else if err != pebble.ErrNotFound {
+		return nil, err
+	}
+	return state, nil
+}
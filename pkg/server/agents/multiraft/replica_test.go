@@ -0,0 +1,90 @@
+package multiraft
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+)
+
+func applyTestKV(t *testing.T, db *pebbledb, kvs ...*KVData) {
+	t.Helper()
+	d := &DiskKV{}
+	// a single indexed batch, like Update does for entries applied together.
+	wb := db.db.NewIndexedBatch()
+	defer wb.Close()
+	for i, kv := range kvs {
+		if err := d.applyKV(db, wb, kv, uint64(i+1)); err != nil {
+			t.Fatalf("applyKV(%s) error = %v", kv.Op, err)
+		}
+	}
+	if err := db.db.Apply(wb, db.wo); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplica_ExportStageCommit(t *testing.T) {
+	primary := openTestDB(t, "primary")
+	applyTestKV(t, primary,
+		&KVData{Table: "users", Row: "a", Column: "name", Val: "alice"},
+		&KVData{Table: "_nodes", Row: "node-1", Column: "zone", Val: "z1"},
+	)
+	buf := &bytes.Buffer{}
+	if _, err := primary.export(buf); err != nil {
+		t.Fatalf("export() error = %v", err)
+	}
+
+	standby := openTestDB(t, "standby")
+	applyTestKV(t, standby,
+		&KVData{Table: "users", Row: "stale", Column: "name", Val: "bob"},
+		&KVData{Table: "_nodes", Row: "node-9", Column: "zone", Val: "z9"},
+	)
+	var pairs []KVPair
+	if _, err := ReadExport(buf, func(p KVPair) error {
+		pairs = append(pairs, p)
+		return nil
+	}); err != nil {
+		t.Fatalf("ReadExport() error = %v", err)
+	}
+	applyTestKV(t, standby,
+		&KVData{Op: OpResetReplica},
+		&KVData{Op: OpStageReplica, Pairs: pairs},
+		&KVData{Op: OpCommitReplica, Index: 7},
+	)
+
+	for key, want := range map[string]string{
+		string(encodeKey("users", "a", "name")):       "alice",
+		string(encodeKey("users", "stale", "name")):   "",
+		string(encodeKey("_nodes", "node-1", "zone")): "",
+		string(encodeKey("_nodes", "node-9", "zone")): "z9",
+	} {
+		val, closer, err := standby.db.Get([]byte(key))
+		if err == pebble.ErrNotFound {
+			val = nil
+		} else if err != nil {
+			t.Fatal(err)
+		} else {
+			defer closer.Close()
+		}
+		if string(val) != want {
+			t.Errorf("key %q = %q, want %q", key, val, want)
+		}
+	}
+	state, err := standby.standbyState()
+	if err != nil || state.SourceIndex != 7 || state.Promoted {
+		t.Fatalf("standbyState() = %+v, %v, want source index 7", state, err)
+	}
+
+	// after the promotion staged snapshots are never committed.
+	applyTestKV(t, standby,
+		&KVData{Op: OpPromoteStandby},
+		&KVData{Op: OpStageReplica, Pairs: []KVPair{{Key: encodeKey("users", "b", "name"), Val: []byte("x")}}},
+		&KVData{Op: OpCommitReplica, Index: 9},
+	)
+	if _, _, err := standby.db.Get(encodeKey("users", "b", "name")); err != pebble.ErrNotFound {
+		t.Errorf("snapshot committed after promotion, err = %v", err)
+	}
+	if state, err := standby.standbyState(); err != nil || !state.Promoted || state.SourceIndex != 7 {
+		t.Errorf("standbyState() = %+v, %v, want promoted at source index 7", state, err)
+	}
+}
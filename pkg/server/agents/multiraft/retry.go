@@ -0,0 +1,74 @@
+package multiraft
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/errdefs"
+	"github.com/lni/dragonboat/v4"
+)
+
+const (
+	// defaultRequestTimeout is used when the caller's context has no deadline.
+	defaultRequestTimeout = 5 * time.Second
+
+	retryMinBackoff = 50 * time.Millisecond
+	retryMaxBackoff = time.Second
+)
+
+// withRequestDeadline makes sure ctx carries a deadline, dragonboat refuses
+// requests without one.
+func withRequestDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, defaultRequestTimeout)
+}
+
+// isRetryable reports whether err is a transient failure seen while the shard
+// has no leader (e.g. mid-election).  Requests failing this way were never
+// proposed, so retrying them can't apply an entry twice.  ErrTimeout is
+// deliberately not retried: the entry may still commit.
+func isRetryable(err error) bool {
+	return errors.Is(err, dragonboat.ErrShardNotReady) ||
+		errors.Is(err, dragonboat.ErrSystemBusy) ||
+		errors.Is(err, dragonboat.ErrShardNotInitialized)
+}
+
+// withKind makes dragonboat's errors of the errdefs kind they amount to: a
+// shard still without a leader by the deadline has lost its quorum, as far as
+// the caller can tell.
+func withKind(err error) error {
+	switch {
+	case isRetryable(err):
+		return errdefs.Wrap(errdefs.ErrQuorumLost, err)
+	case errors.Is(err, dragonboat.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return errdefs.Wrap(errdefs.ErrTimeout, err)
+	}
+	return err
+}
+
+// retry runs fn until it succeeds, returns a non retryable error, or the
+// context deadline is reached, backing off between attempts.  The last error
+// from fn is returned when the deadline expires.
+func retry(ctx context.Context, fn func(ctx context.Context) error) error {
+	backoff := retryMinBackoff
+	for {
+		err := fn(ctx)
+		if err == nil || !isRetryable(err) {
+			return withKind(err)
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return withKind(err)
+		case <-timer.C:
+		}
+		backoff *= 2
+		if backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+}
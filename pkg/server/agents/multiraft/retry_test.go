@@ -0,0 +1,98 @@
+package multiraft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/errdefs"
+	"github.com/lni/dragonboat/v4"
+)
+
+func TestRetry(t *testing.T) {
+	other := errors.New("bad entry")
+	tests := []struct {
+		name string
+		// errs are what the attempts return, the last one repeating.
+		errs    []error
+		timeout time.Duration
+		// attempts is how many attempts are made, at least when the
+		// deadline cuts the retries short.
+		attempts int
+		want     error
+		kind     error
+	}{
+		{"success", []error{nil}, time.Second, 1, nil, nil},
+		{"not retried", []error{other}, time.Second, 1, other, nil},
+		{"retried until elected", []error{dragonboat.ErrShardNotReady, dragonboat.ErrSystemBusy, nil}, time.Second, 3, nil, nil},
+		{"timeout not retried", []error{dragonboat.ErrTimeout}, time.Second, 1, dragonboat.ErrTimeout, errdefs.ErrTimeout},
+		{"no leader by the deadline", []error{dragonboat.ErrShardNotInitialized}, 200 * time.Millisecond, 3, dragonboat.ErrShardNotInitialized, errdefs.ErrQuorumLost},
+		{"other error after retries", []error{dragonboat.ErrShardNotReady, other}, time.Second, 2, other, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			attempts := 0
+			err := retry(ctx, func(context.Context) error {
+				err := tt.errs[len(tt.errs)-1]
+				if attempts < len(tt.errs) {
+					err = tt.errs[attempts]
+				}
+				attempts++
+				return err
+			})
+			if !errors.Is(err, tt.want) || (err == nil) != (tt.want == nil) {
+				t.Errorf("retry() error = %v, want %v", err, tt.want)
+			}
+			if tt.kind != nil && !errors.Is(err, tt.kind) {
+				t.Errorf("retry() error = %v, want of kind %v", err, tt.kind)
+			}
+			untilDeadline := isRetryable(tt.errs[len(tt.errs)-1])
+			if attempts < tt.attempts || attempts > tt.attempts && !untilDeadline {
+				t.Errorf("retry() made %d attempts, want %d", attempts, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestWithKind(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind error
+	}{
+		{dragonboat.ErrShardNotReady, errdefs.ErrQuorumLost},
+		{fmt.Errorf("proposing: %w", dragonboat.ErrSystemBusy), errdefs.ErrQuorumLost},
+		{dragonboat.ErrTimeout, errdefs.ErrTimeout},
+		{context.DeadlineExceeded, errdefs.ErrTimeout},
+		{errors.New("bad entry"), nil},
+		{nil, nil},
+	}
+	for _, tt := range tests {
+		got := withKind(tt.err)
+		if !errors.Is(got, tt.err) {
+			t.Errorf("withKind(%v) = %v, lost the error", tt.err, got)
+		}
+		if tt.kind == nil && got != tt.err || tt.kind != nil && !errors.Is(got, tt.kind) {
+			t.Errorf("withKind(%v) = %v, want of kind %v", tt.err, got, tt.kind)
+		}
+	}
+}
+
+func TestWithRequestDeadline(t *testing.T) {
+	ctx, cancel := withRequestDeadline(context.Background())
+	defer cancel()
+	if d, ok := ctx.Deadline(); !ok || time.Until(d) > defaultRequestTimeout {
+		t.Errorf("withRequestDeadline() without a deadline = %v, %v, want within %v", d, ok, defaultRequestTimeout)
+	}
+	parent, cancelParent := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelParent()
+	ctx, cancel = withRequestDeadline(parent)
+	defer cancel()
+	want, _ := parent.Deadline()
+	if d, _ := ctx.Deadline(); !d.Equal(want) {
+		t.Errorf("withRequestDeadline() replaced the caller's deadline %v with %v", want, d)
+	}
+}
@@ -0,0 +1,496 @@
+package multiraft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/epsniff/expodb/pkg/errdefs"
+	"github.com/epsniff/expodb/pkg/fieldcrypt"
+	"github.com/epsniff/expodb/pkg/loggingutils"
+)
+
+// A table's schema declares its columns and their types.  Tables without one
+// take any column, writes to those with one are rejected before anything of
+// them is applied when they set an undeclared column or a value that doesn't
+// parse as its column's type.  Values are still stored as strings.
+//
+// The values of an encrypted column are stored sealed, see fieldcrypt: the
+// FSM only takes values of that form for it, their type is checked by the
+// server before it seals them.
+//
+// A schema is changed a column at a time, by a SchemaChange going through
+// three phases:
+//
+//	prepare   the entry proposing the change: from it on every replica
+//	          validates writes against the old and the new column
+//	backfill  the leader rewrites the table's rows, backfillBatchRows at a
+//	          time, see schemaStep
+//	active    the last backfill step makes the new column the schema's
+//
+// so neither the table nor its clients stop while it happens.
+const (
+	// schemaPrefix keys the schemas, by table.
+	schemaPrefix string = "\x00schema:"
+	// The column types.
+	ColumnString = "string"
+	ColumnInt    = "int"
+	ColumnFloat  = "float"
+	ColumnBool   = "bool"
+	// The kinds of schema change.
+	SchemaAddColumn  = "add_column"
+	SchemaDropColumn = "drop_column"
+	SchemaAlterType  = "alter_type"
+	// The phases of a schema change, it is gone from the schema once active.
+	SchemaPrepare  = "prepare"
+	SchemaBackfill = "backfill"
+)
+
+var (
+	ErrSchemaViolation = errdefs.New(errdefs.ErrInvalid, "write doesn't fit the table's schema")
+	// resultSchemaViolation starts the result data of entries a schema
+	// rejects, see schemaResult.
+	resultSchemaViolation = []byte("schema_violation")
+)
+
+// Column is a column of a TableSchema.  Default is what a column added to the
+// schema is backfilled with in the rows lacking it, none when empty.
+// Encrypted columns have no default.
+type Column struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Default   string `json:"default,omitempty"`
+	Encrypted bool   `json:"encrypted,omitempty"`
+}
+
+// TableSchema is the schema of Table.  Version counts the changes activated,
+// Failed is why the last one was abandoned.
+type TableSchema struct {
+	Table   string        `json:"table"`
+	Columns []Column      `json:"columns"`
+	Version uint64        `json:"version,omitempty"`
+	Change  *SchemaChange `json:"change,omitempty"`
+	Failed  string        `json:"failed,omitempty"`
+}
+
+// SchemaChange adds Column, of Type with Default or Encrypted, drops it or
+// changes its type to Type.  A table has one change in flight at most.  Step counts the
+// leader's steps, so a retried one is a no-op, Cursor is the last row
+// backfilled and Backfilled the rows so far.
+type SchemaChange struct {
+	Kind       string `json:"kind"`
+	Column     string `json:"column"`
+	Type       string `json:"type,omitempty"`
+	Default    string `json:"default,omitempty"`
+	Encrypted  bool   `json:"encrypted,omitempty"`
+	Phase      string `json:"phase,omitempty"`
+	Step       uint64 `json:"step,omitempty"`
+	Cursor     string `json:"cursor,omitempty"`
+	Backfilled uint64 `json:"backfilled,omitempty"`
+}
+
+// SchemasQuery asks for the schemas of every table, by table.
+type SchemasQuery struct{}
+
+// SchemaError is returned for entries a table's schema rejects, Row and
+// Column are those of the offending write when it is one.  It matches
+// ErrSchemaViolation with errors.Is.
+type SchemaError struct {
+	Table  string
+	Row    string
+	Column string
+	Reason string
+}
+
+func (e *SchemaError) Error() string {
+	if e.Row != "" {
+		return fmt.Sprintf("column %s of row %s/%s: %s", e.Column, e.Table, loggingutils.Redact(e.Table, e.Row), e.Reason)
+	}
+	return fmt.Sprintf("schema of %s: %s", e.Table, e.Reason)
+}
+
+func (e *SchemaError) Unwrap() error { return ErrSchemaViolation }
+
+func schemaResult(v *SchemaError) []byte {
+	return bytes.Join([][]byte{resultSchemaViolation, []byte(v.Table), []byte(v.Row), []byte(v.Column), []byte(v.Reason)}, []byte{0})
+}
+
+func parseSchemaResult(data []byte) (*SchemaError, bool) {
+	parts := bytes.SplitN(data, []byte{0}, 5)
+	if len(parts) != 5 || !bytes.Equal(parts[0], resultSchemaViolation) {
+		return nil, false
+	}
+	return &SchemaError{Table: string(parts[1]), Row: string(parts[2]), Column: string(parts[3]), Reason: string(parts[4])}, true
+}
+
+// Validate checks a schema before it is proposed.
+func (s *TableSchema) Validate() error {
+	if s.Table == "" {
+		return fmt.Errorf("schema needs a table")
+	}
+	seen := map[string]bool{}
+	for _, c := range s.Columns {
+		if err := c.validate(); err != nil {
+			return err
+		}
+		if seen[c.Name] {
+			return fmt.Errorf("column %s declared twice", c.Name)
+		}
+		seen[c.Name] = true
+	}
+	return nil
+}
+
+// Validate checks a change before it is proposed, whether it applies to the
+// schema is checked by the entry.
+func (c *SchemaChange) Validate() error {
+	switch c.Kind {
+	case SchemaAddColumn:
+		return (&Column{Name: c.Column, Type: c.Type, Default: c.Default, Encrypted: c.Encrypted}).validate()
+	case SchemaAlterType:
+		return (&Column{Name: c.Column, Type: c.Type}).validate()
+	case SchemaDropColumn:
+		if c.Column == "" {
+			return fmt.Errorf("schema change needs a column")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown schema change %q", c.Kind)
+}
+
+func (c *Column) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("column needs a name")
+	}
+	if !validColumnType(c.Type) {
+		return fmt.Errorf("column %s: unknown type %q", c.Name, c.Type)
+	}
+	if c.Default != "" && !validValue(c.Type, c.Default) {
+		return fmt.Errorf("column %s: default %q isn't %s", c.Name, c.Default, c.Type)
+	}
+	if c.Default != "" && c.Encrypted {
+		return fmt.Errorf("column %s: encrypted columns can't have a default", c.Name)
+	}
+	return nil
+}
+
+func validColumnType(typ string) bool {
+	switch typ {
+	case ColumnString, ColumnInt, ColumnFloat, ColumnBool:
+		return true
+	}
+	return false
+}
+
+// validValue reports whether val parses as typ.
+func validValue(typ, val string) bool {
+	var err error
+	switch typ {
+	case ColumnInt:
+		_, err = strconv.ParseInt(val, 10, 64)
+	case ColumnFloat:
+		_, err = strconv.ParseFloat(val, 64)
+	case ColumnBool:
+		_, err = strconv.ParseBool(val)
+	}
+	return err == nil
+}
+
+func (s *TableSchema) column(name string) *Column {
+	for i := range s.Columns {
+		if s.Columns[i].Name == name {
+			return &s.Columns[i]
+		}
+	}
+	return nil
+}
+
+// Encrypted reports whether the values of column are stored sealed, it is
+// from the moment an encrypted column starts being added.
+func (s *TableSchema) Encrypted(column string) bool {
+	if c := s.Change; c != nil && c.Column == column && c.Kind == SchemaAddColumn {
+		return c.Encrypted
+	}
+	col := s.column(column)
+	return col != nil && col.Encrypted
+}
+
+// CheckPlaintext is checkValue for the value of an encrypted column before
+// it is sealed, for the others it is checkValue.
+func (s *TableSchema) CheckPlaintext(column, val string) string {
+	return s.check(column, val, false)
+}
+
+// checkValue returns why a column can't hold val, "" when it can.  While a
+// change of the column is in flight the value has to fit both its old and
+// new definition.
+func (s *TableSchema) checkValue(column, val string) string {
+	return s.check(column, val, s.Encrypted(column))
+}
+
+func (s *TableSchema) check(column, val string, sealed bool) string {
+	col := s.column(column)
+	if c := s.Change; c != nil && c.Column == column {
+		switch c.Kind {
+		case SchemaAddColumn:
+			col = &Column{Name: column, Type: c.Type}
+		case SchemaDropColumn:
+			return "column is being dropped"
+		case SchemaAlterType:
+			if !validValue(c.Type, val) {
+				return fmt.Sprintf("%q isn't %s, the type the column is changing to", loggingutils.Redact(s.Table, val), c.Type)
+			}
+		}
+	}
+	if col == nil {
+		return "no such column"
+	}
+	if sealed {
+		if !fieldcrypt.IsEncrypted(val) {
+			return "column is encrypted, the value isn't"
+		}
+		return ""
+	}
+	if !validValue(col.Type, val) {
+		return fmt.Sprintf("%q isn't %s", loggingutils.Redact(s.Table, val), col.Type)
+	}
+	return ""
+}
+
+func schemaKey(table string) []byte {
+	return appendEscaped([]byte(schemaPrefix), table)
+}
+
+// readSchema returns nil when the table has no schema.
+func readSchema(rd pebble.Reader, table string) (*TableSchema, error) {
+	val, closer, err := rd.Get(schemaKey(table))
+	if err == pebble.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	s := &TableSchema{}
+	if err := json.Unmarshal(val, s); err != nil {
+		return nil, fmt.Errorf("decoding schema of %s: %w", table, err)
+	}
+	return s, nil
+}
+
+func putSchema(db *pebbledb, wb *pebble.Batch, s *TableSchema) error {
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	wb.Set(schemaKey(s.Table), buf, db.wo)
+	return nil
+}
+
+func (r *pebbledb) schemas() ([]TableSchema, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil, fmt.Errorf("db already closed")
+	}
+	prefix := []byte(schemaPrefix)
+	iter := r.db.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	var schemas []TableSchema
+	for iter.First(); iter.Valid(); iter.Next() {
+		s := TableSchema{}
+		if err := json.Unmarshal(iter.Value(), &s); err != nil {
+			iter.Close()
+			return nil, fmt.Errorf("decoding schema %q: %w", iter.Key(), err)
+		}
+		schemas = append(schemas, s)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return schemas, nil
+}
+
+// checkSchema returns why a table's schema rejects an entry: a write not
+// fitting it, a schema set over rows that don't or a change that doesn't
+// apply to it.  Deletes always fit.
+func checkSchema(wb *pebble.Batch, kv *KVData) (*SchemaError, error) {
+	switch kv.Op {
+	case OpSetSchema:
+		if kv.Schema == nil {
+			return nil, nil
+		}
+		if s, err := readSchema(wb, kv.Schema.Table); err != nil || s != nil {
+			if s != nil {
+				return &SchemaError{Table: s.Table, Reason: "table already has a schema, change it a column at a time"}, nil
+			}
+			return nil, err
+		}
+		return nonconformingRow(wb, kv.Schema)
+	case OpChangeSchema:
+		if kv.SchemaChange == nil {
+			return nil, nil
+		}
+		s, err := readSchema(wb, kv.Table)
+		if err != nil {
+			return nil, err
+		}
+		if reason := changeConflict(s, kv.SchemaChange); reason != "" {
+			return &SchemaError{Table: kv.Table, Reason: reason}, nil
+		}
+		return nil, nil
+	}
+	schemas := map[string]*TableSchema{}
+	for _, w := range entryWrites(kv) {
+		s, ok := schemas[w.Table]
+		if !ok {
+			var err error
+			if s, err = readSchema(wb, w.Table); err != nil {
+				return nil, err
+			}
+			schemas[w.Table] = s
+		}
+		if s == nil || w.Delete {
+			continue
+		}
+		if reason := s.checkValue(w.Column, w.Val); reason != "" {
+			return &SchemaError{Table: w.Table, Row: w.Row, Column: w.Column, Reason: reason}, nil
+		}
+	}
+	return nil, nil
+}
+
+// changeConflict returns why a change doesn't apply to a schema, "" when it
+// does.
+func changeConflict(s *TableSchema, c *SchemaChange) string {
+	switch {
+	case s == nil:
+		return "table has no schema"
+	case s.Change != nil:
+		return fmt.Sprintf("a change of column %s is in flight", s.Change.Column)
+	case c.Kind == SchemaAddColumn && s.column(c.Column) != nil:
+		return fmt.Sprintf("column %s already exists", c.Column)
+	case c.Kind != SchemaAddColumn && s.column(c.Column) == nil:
+		return fmt.Sprintf("no column %s", c.Column)
+	case c.Kind == SchemaAlterType && s.column(c.Column).Encrypted:
+		return fmt.Sprintf("column %s is encrypted, its type can't be changed", c.Column)
+	}
+	return ""
+}
+
+// nonconformingRow returns the violation of the first row of a table not
+// fitting a schema being set.
+func nonconformingRow(wb *pebble.Batch, s *TableSchema) (*SchemaError, error) {
+	var violation *SchemaError
+	err := eachRow(wb, s.Table, func(row string, columns map[string]string) {
+		for column, val := range columns {
+			if reason := s.checkValue(column, val); reason != "" && violation == nil {
+				violation = &SchemaError{Table: s.Table, Row: row, Column: column, Reason: reason}
+			}
+		}
+	})
+	return violation, err
+}
+
+// changeSchema puts a change checked by checkSchema in flight.
+func changeSchema(db *pebbledb, wb *pebble.Batch, table string, c *SchemaChange) error {
+	s, err := readSchema(wb, table)
+	if err != nil || s == nil {
+		return err
+	}
+	change := *c
+	change.Phase, change.Step, change.Cursor, change.Backfilled = SchemaPrepare, 0, "", 0
+	s.Change = &change
+	return putSchema(db, wb, s)
+}
+
+// schemaStep moves the change in flight on a table forward a step, when it
+// is at step.  The first step starts the backfill, each later one rewrites
+// the next backfillBatchRows rows, and the one finding no rows left
+// activates the change.  A type change over a value not of the new type is
+// abandoned, the values it checked before are left as they were.
+func schemaStep(db *pebbledb, wb *pebble.Batch, table string, step, index uint64) error {
+	s, err := readSchema(wb, table)
+	if err != nil || s == nil || s.Change == nil || s.Change.Step != step {
+		return err
+	}
+	c := s.Change
+	c.Step++
+	if c.Phase == SchemaPrepare {
+		c.Phase = SchemaBackfill
+		return putSchema(db, wb, s)
+	}
+	// the rows are rewritten once they are read, not while.
+	type rewrite struct {
+		row string
+		val *string // nil deletes the column
+	}
+	var rewrites []rewrite
+	var failed string
+	last, more, err := eachRowAfter(wb, table, c.Cursor, backfillBatchRows, func(row string, columns map[string]string) {
+		c.Backfilled++
+		val, ok := columns[c.Column]
+		switch c.Kind {
+		case SchemaAddColumn:
+			if !ok && c.Default != "" {
+				rewrites = append(rewrites, rewrite{row: row, val: &c.Default})
+			}
+		case SchemaDropColumn:
+			if ok {
+				rewrites = append(rewrites, rewrite{row: row})
+			}
+		case SchemaAlterType:
+			if ok && !validValue(c.Type, val) && failed == "" {
+				failed = fmt.Sprintf("changing column %s to %s: row %s holds %q", c.Column, c.Type, loggingutils.Redact(table, row), loggingutils.Redact(table, val))
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if failed != "" {
+		s.Change, s.Failed = nil, failed
+		return putSchema(db, wb, s)
+	}
+	version := make([]byte, 8)
+	binary.LittleEndian.PutUint64(version, index)
+	for _, rw := range rewrites {
+		ix, err := indexRow(wb, table, rw.row)
+		if err != nil {
+			return err
+		}
+		key := encodeKey(table, rw.row, c.Column)
+		if rw.val == nil {
+			deleteWithTombstone(db, wb, key, index)
+		} else {
+			wb.Set(key, []byte(*rw.val), db.wo)
+			wb.Delete(tombstoneKey(key), db.wo)
+		}
+		wb.Set(rowVersionKey(table, rw.row), version, db.wo)
+		if err := ix.update(db, wb); err != nil {
+			return err
+		}
+	}
+	if more {
+		c.Cursor = last
+		return putSchema(db, wb, s)
+	}
+	switch c.Kind {
+	case SchemaAddColumn:
+		s.Columns = append(s.Columns, Column{Name: c.Column, Type: c.Type, Default: c.Default, Encrypted: c.Encrypted})
+	case SchemaDropColumn:
+		columns := s.Columns[:0]
+		for _, col := range s.Columns {
+			if col.Name != c.Column {
+				columns = append(columns, col)
+			}
+		}
+		s.Columns = columns
+	case SchemaAlterType:
+		s.column(c.Column).Type = c.Type
+	}
+	s.Change, s.Failed = nil, ""
+	s.Version++
+	return putSchema(db, wb, s)
+}
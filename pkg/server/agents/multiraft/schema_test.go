@@ -0,0 +1,120 @@
+package multiraft
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckSchema(t *testing.T) {
+	db := openTestDB(t, "schema")
+	applyTestKV(t, db, &KVData{Op: OpSetSchema, Schema: &TableSchema{Table: "users", Columns: []Column{
+		{Name: "name", Type: ColumnString},
+		{Name: "age", Type: ColumnInt},
+		{Name: "ssn", Type: ColumnString, Encrypted: true},
+	}}})
+	wb := db.db.NewIndexedBatch()
+	defer wb.Close()
+
+	tests := []struct {
+		name   string
+		kv     *KVData
+		reject bool
+	}{
+		{"fits", &KVData{Table: "users", Row: "a", Column: "age", Val: "41"}, false},
+		{"wrong type", &KVData{Table: "users", Row: "a", Column: "age", Val: "old"}, true},
+		{"undeclared", &KVData{Op: OpSetRow, Table: "users", Row: "a", Columns: map[string]string{"name": "ann", "email": "a@x"}}, true},
+		{"delete", &KVData{Op: OpDelete, Table: "users", Row: "a", Column: "email"}, false},
+		{"plaintext in encrypted column", &KVData{Table: "users", Row: "a", Column: "ssn", Val: "123-45-6789"}, true},
+		{"sealed", &KVData{Table: "users", Row: "a", Column: "ssn", Val: "enc:k1:" + strings.Repeat("A", 40)}, false},
+		{"alter encrypted", &KVData{Op: OpChangeSchema, Table: "users", SchemaChange: &SchemaChange{Kind: SchemaAlterType, Column: "ssn", Type: ColumnInt}}, true},
+		{"schemaless table", &KVData{Table: "logs", Row: "a", Column: "anything", Val: "goes"}, false},
+		{"in a batch", &KVData{Op: OpBatch, Writes: []TxnWrite{
+			{Table: "logs", Row: "a", Column: "age", Val: "x"},
+			{Table: "users", Row: "a", Column: "age", Val: "x"},
+		}}, true},
+		{"set again", &KVData{Op: OpSetSchema, Schema: &TableSchema{Table: "users"}}, true},
+		{"add existing", &KVData{Op: OpChangeSchema, Table: "users", SchemaChange: &SchemaChange{Kind: SchemaAddColumn, Column: "age", Type: ColumnInt}}, true},
+		{"drop missing", &KVData{Op: OpChangeSchema, Table: "users", SchemaChange: &SchemaChange{Kind: SchemaDropColumn, Column: "email"}}, true},
+	}
+	for _, tt := range tests {
+		violation, err := checkSchema(wb, tt.kv)
+		if err != nil {
+			t.Fatalf("%s: checkSchema() error = %v", tt.name, err)
+		}
+		if (violation != nil) != tt.reject {
+			t.Errorf("%s: checkSchema() = %v, want rejected %v", tt.name, violation, tt.reject)
+		}
+	}
+
+	applyTestKV(t, db, &KVData{Table: "logs", Row: "a", Column: "level", Val: "warn"})
+	if violation, _ := checkSchema(wb, &KVData{Op: OpSetSchema, Schema: &TableSchema{Table: "logs", Columns: []Column{{Name: "level", Type: ColumnInt}}}}); violation == nil {
+		t.Errorf("schema set over rows not fitting it")
+	}
+	if got, ok := parseSchemaResult(schemaResult(&SchemaError{Table: "t", Row: "r", Column: "c", Reason: "why"})); !ok || got.Reason != "why" {
+		t.Errorf("schema result round trip = %+v", got)
+	}
+}
+
+func TestSchemaChange(t *testing.T) {
+	defer func(n int) { backfillBatchRows = n }(backfillBatchRows)
+	backfillBatchRows = 2
+	db := openTestDB(t, "schema-change")
+	applyTestKV(t, db,
+		&KVData{Op: OpSetSchema, Schema: &TableSchema{Table: "t", Columns: []Column{{Name: "x", Type: ColumnString}}}},
+		&KVData{Op: OpCreateIndex, IndexDef: &IndexDef{Table: "t", Name: "by_y", Columns: []string{"y"}}},
+		&KVData{Op: OpBackfillIndex, Table: "t", Row: "by_y"},
+	)
+	for _, row := range []string{"a", "b", "c"} {
+		applyTestKV(t, db, &KVData{Table: "t", Row: row, Column: "x", Val: "1"})
+	}
+	applyTestKV(t, db, &KVData{Table: "t", Row: "b", Column: "x", Val: "2.5"})
+	run := func(c *SchemaChange) *TableSchema {
+		t.Helper()
+		applyTestKV(t, db, &KVData{Op: OpChangeSchema, Table: "t", SchemaChange: c})
+		for step := uint64(0); ; step++ {
+			s, err := readSchema(db.db, "t")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Change == nil {
+				return s
+			}
+			if step > 10 {
+				t.Fatalf("change stuck at %+v", s.Change)
+			}
+			applyTestKV(t, db, &KVData{Op: OpSchemaStep, Table: "t", Index: step})
+			// a retried step is a no-op.
+			applyTestKV(t, db, &KVData{Op: OpSchemaStep, Table: "t", Index: step})
+		}
+	}
+
+	s := run(&SchemaChange{Kind: SchemaAddColumn, Column: "y", Type: ColumnInt, Default: "7"})
+	if s.column("y") == nil || s.Version != 1 {
+		t.Fatalf("schema after add = %+v", s)
+	}
+	page, err := db.selectRows(SelectQuery{Table: "t", Where: map[string]string{"y": "7"}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := selectKeys(page); len(got) != 3 || page.Index != "by_y" {
+		t.Errorf("rows backfilled = %v through %q, want a, b, c through by_y", got, page.Index)
+	}
+
+	s = run(&SchemaChange{Kind: SchemaAlterType, Column: "x", Type: ColumnInt})
+	if s.column("x").Type != ColumnString || s.Failed == "" {
+		t.Errorf("type change over 2.5 = %+v, want abandoned", s)
+	}
+	s = run(&SchemaChange{Kind: SchemaAlterType, Column: "x", Type: ColumnFloat})
+	if s.column("x").Type != ColumnFloat || s.Failed != "" {
+		t.Errorf("type change to float = %+v", s)
+	}
+
+	s = run(&SchemaChange{Kind: SchemaDropColumn, Column: "y"})
+	if s.column("y") != nil || s.Version != 3 {
+		t.Errorf("schema after drop = %+v", s)
+	}
+	row, _, err := readRow(db.db, "t", "a")
+	if err != nil || row["y"] != "" || row["x"] != "1" {
+		t.Errorf("row a after drop = %v, %v", row, err)
+	}
+}
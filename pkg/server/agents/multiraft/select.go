@@ -0,0 +1,368 @@
+package multiraft
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/epsniff/expodb/pkg/errdefs"
+)
+
+const (
+	// maxSelectExamined bounds the rows or index entries a SelectQuery reads
+	// a page, a page of a query few rows match can come back short.
+	maxSelectExamined = 10000
+	// readCheckEvery is how many rows or index entries a SelectQuery
+	// examines between looking at its Deadline and Done.
+	readCheckEvery = 64
+)
+
+// Why a page stopped short of its limit with more to read, see SelectPage.
+const (
+	PartialExamined = "max_examined"
+	PartialBytes    = "max_bytes"
+	PartialTimeout  = "timeout"
+)
+
+// ErrQueryCanceled is returned by a SelectQuery whose Done was closed.
+var ErrQueryCanceled = errdefs.New(errdefs.ErrTimeout, "query canceled")
+
+// SelectQuery asks for up to Limit rows of Table whose columns equal those of
+// Where, resuming after the position After of a previous page.  The rows are
+// read through Index, or the table scanned with Scan; with neither the index
+// sharing the most leading columns with Where is picked, see PlanSelect.
+// A page stops short once its rows hold MaxBytes of keys and values or past
+// Deadline, when set, and the read fails with ErrQueryCanceled once Done is
+// closed: its client is gone.
+type SelectQuery struct {
+	Table    string
+	Where    map[string]string
+	Index    string
+	Scan     bool
+	After    string
+	Limit    int
+	MaxBytes int
+	Deadline time.Time
+	Done     <-chan struct{}
+}
+
+// SelectPage is the result of a SelectQuery, its rows in the order of the
+// index read or by key when scanned.  Positions holds where each row
+// was read, in order, so pages of several shards can be merged, and Last is
+// the position the read stopped at.  Index is the index read, empty when the
+// table was scanned.  Partial is why a page with More stopped before its
+// limit, one of the Partial constants, empty when it didn't.
+type SelectPage struct {
+	Rows      []ScanRow
+	Positions []string
+	Last      string
+	More      bool
+	Index     string
+	Partial   string
+}
+
+// PlanSelect returns the index a query filtering on where should read, nil
+// when no index has its first column there and the table has to be
+// scanned.  Without statistics of the table it is the one with the longest
+// run of leading columns in where.  With them it is the one whose read is
+// estimated to examine the fewest entries, see TableStats, ties going to
+// the longest run.  Further ties go to the narrower index, then by name.
+// Indexes still Building are skipped.
+func PlanSelect(defs []IndexDef, stats *TableStats, where map[string]string) *IndexDef {
+	var best *IndexDef
+	bestLen := 0
+	bestEst := 0.0
+	for i := range defs {
+		if defs[i].Building {
+			continue
+		}
+		n := 0
+		for _, c := range defs[i].Columns {
+			if _, ok := where[c]; !ok {
+				break
+			}
+			n++
+		}
+		if n == 0 {
+			continue
+		}
+		est := 0.0
+		if stats != nil {
+			est = stats.estimateIndexRead(&defs[i], n)
+		}
+		switch {
+		case best == nil, est < bestEst:
+		case est > bestEst:
+			continue
+		case n > bestLen:
+		case n < bestLen:
+			continue
+		case len(defs[i].Columns) >= len(best.Columns):
+			continue
+		}
+		best, bestLen, bestEst = &defs[i], n, est
+	}
+	return best
+}
+
+func (r *pebbledb) selectRows(q SelectQuery) (*SelectPage, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil, errors.New("db already closed")
+	}
+	// the index and the rows it points at are read at the same point.
+	ss := r.db.NewSnapshot()
+	defer ss.Close()
+	def, err := selectIndexDef(ss, q)
+	if err != nil {
+		return nil, err
+	}
+	if def == nil {
+		return selectScan(ss, q)
+	}
+	return selectIndex(ss, q, def)
+}
+
+// selectIndexDef returns the index a query reads, nil when it scans the
+// table.
+func selectIndexDef(rd pebble.Reader, q SelectQuery) (*IndexDef, error) {
+	defs, err := tableIndexes(rd, q.Table)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case q.Index != "":
+		for i := range defs {
+			if defs[i].Name != q.Index {
+				continue
+			}
+			if defs[i].Building {
+				return nil, ErrIndexBuilding
+			}
+			return &defs[i], nil
+		}
+		return nil, ErrIndexNotFound
+	case !q.Scan:
+		stats, err := readStats(rd, q.Table)
+		if err != nil {
+			return nil, err
+		}
+		return PlanSelect(defs, stats, q.Where), nil
+	}
+	return nil, nil
+}
+
+// stop returns why a page having examined entries, holding size bytes of
+// rows, stops short, empty to read on.  A page examines at least one entry
+// before its deadline stops it, so paging always progresses.
+func (q *SelectQuery) stop(examined, size int) (string, error) {
+	switch {
+	case q.MaxBytes > 0 && size >= q.MaxBytes:
+		return PartialBytes, nil
+	case examined == maxSelectExamined:
+		return PartialExamined, nil
+	case examined == 0 || examined%readCheckEvery != 0:
+		return "", nil
+	}
+	select {
+	case <-q.Done:
+		return "", ErrQueryCanceled
+	default:
+	}
+	if !q.Deadline.IsZero() && time.Now().After(q.Deadline) {
+		return PartialTimeout, nil
+	}
+	return "", nil
+}
+
+// rowSize is the bytes of keys and values of a row.
+func rowSize(row *ScanRow) int {
+	n := len(row.Key)
+	for c, v := range row.Columns {
+		n += len(c) + len(v)
+	}
+	return n
+}
+
+// matchedValues returns the values where holds for the leading columns of
+// an index, those the read through it is narrowed to.
+func matchedValues(def *IndexDef, where map[string]string) []string {
+	var values []string
+	for _, c := range def.Columns {
+		v, ok := where[c]
+		if !ok {
+			break
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+func selectIndex(ss *pebble.Snapshot, q SelectQuery, def *IndexDef) (*SelectPage, error) {
+	prefix := indexValuesPrefix(def.Table, def.Name, matchedValues(def, q.Where))
+	lower := prefix
+	if q.After != "" {
+		// the smallest key past the entry After.
+		if after := append([]byte(q.After), 0); string(after) > string(lower) {
+			lower = after
+		}
+	}
+	iter := ss.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: prefixUpperBound(prefix)})
+	page := &SelectPage{Index: def.Name}
+	examined, size := 0, 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		if len(page.Rows) == q.Limit {
+			page.More = true
+			break
+		}
+		partial, err := q.stop(examined, size)
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		if partial != "" {
+			page.More, page.Partial = true, partial
+			break
+		}
+		examined++
+		page.Last = string(iter.Key())
+		row, ok := decodeIndexRow(iter.Key(), len(def.Columns))
+		if !ok {
+			continue
+		}
+		columns, version, err := readRow(ss, q.Table, row)
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		if len(columns) > 0 && matchesWhere(columns, q.Where) {
+			page.Rows = append(page.Rows, ScanRow{Key: row, Columns: columns, Version: version})
+			page.Positions = append(page.Positions, page.Last)
+			size += rowSize(&page.Rows[len(page.Rows)-1])
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+func selectScan(ss *pebble.Snapshot, q SelectQuery) (*SelectPage, error) {
+	prefix := encodeTablePrefix(q.Table)
+	lower := prefix
+	if q.After != "" {
+		lower = prefixUpperBound(encodeRowPrefix(q.Table, q.After))
+	}
+	iter := ss.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: prefixUpperBound(prefix)})
+	page := &SelectPage{}
+	examined, size := 0, 0
+	// row is the row being read, it is kept once its last column is.  The
+	// version sorts before its columns, as in scanPage.
+	var row *ScanRow
+	var versionRow string
+	var version uint64
+	flush := func() {
+		if row != nil && matchesWhere(row.Columns, q.Where) {
+			page.Rows = append(page.Rows, *row)
+			page.Positions = append(page.Positions, row.Key)
+			size += rowSize(row)
+		}
+	}
+	for iter.First(); iter.Valid(); iter.Next() {
+		_, rowkey, column, ok := decodeKey(iter.Key())
+		if !ok {
+			if r, ok := decodeRowVersionKey(iter.Key()); ok && len(iter.Value()) == 8 {
+				versionRow, version = r, binary.LittleEndian.Uint64(iter.Value())
+			}
+			continue
+		}
+		if row == nil || row.Key != rowkey {
+			flush()
+			row = nil
+			if len(page.Rows) == q.Limit {
+				page.More = true
+				break
+			}
+			partial, err := q.stop(examined, size)
+			if err != nil {
+				iter.Close()
+				return nil, err
+			}
+			if partial != "" {
+				page.More, page.Partial = true, partial
+				break
+			}
+			examined++
+			row = &ScanRow{Key: rowkey, Columns: map[string]string{}}
+			if versionRow == rowkey {
+				row.Version = version
+			}
+			page.Last = rowkey
+		}
+		row.Columns[column] = string(iter.Value())
+	}
+	flush()
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+func matchesWhere(columns, where map[string]string) bool {
+	for c, v := range where {
+		if got, ok := columns[c]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// MergeSelectPages merges the pages of a query read from several shards
+// into the page a single shard holding all their rows would have returned.
+func MergeSelectPages(pages []*SelectPage, limit int) *SelectPage {
+	merged := &SelectPage{}
+	// rows past where a shard with more stopped may come before that shard's
+	// next rows, they are left to the next page.
+	cut, cutSet := "", false
+	for _, p := range pages {
+		if p.More && (!cutSet || p.Last < cut) {
+			cut, cutSet = p.Last, true
+			merged.Partial = p.Partial
+		}
+		if merged.Index == "" {
+			merged.Index = p.Index
+		}
+	}
+	type read struct {
+		row ScanRow
+		pos string
+	}
+	var reads []read
+	for _, p := range pages {
+		for i := range p.Rows {
+			if !cutSet || p.Positions[i] <= cut {
+				reads = append(reads, read{p.Rows[i], p.Positions[i]})
+			}
+		}
+		if !cutSet && p.Last > merged.Last {
+			merged.Last = p.Last
+		}
+	}
+	sort.Slice(reads, func(i, j int) bool { return reads[i].pos < reads[j].pos })
+	merged.More = cutSet
+	if cutSet {
+		merged.Last = cut
+	}
+	if len(reads) > limit {
+		reads, merged.More, merged.Last = reads[:limit], true, reads[limit-1].pos
+		merged.Partial = ""
+	}
+	for _, r := range reads {
+		merged.Rows = append(merged.Rows, r.row)
+		merged.Positions = append(merged.Positions, r.pos)
+	}
+	return merged
+}
@@ -0,0 +1,281 @@
+package multiraft
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/golang/snappy"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// snapshotFormatV2 takes the place of the entry count at the head of
+	// snapshots written as a snappy stream of length prefixed JSON entries,
+	// terminated by a zero length.  Older snapshots start with the count.
+	snapshotFormatV2 uint64 = math.MaxUint64 - 1
+	// snapshotFormatV3 snapshots are a snappy stream of raw length prefixed
+	// key and value pairs, terminated by a key length of snapshotEnd.  JSON
+	// can't carry the binary keys of the current key layout.
+	snapshotFormatV3 uint64 = math.MaxUint64 - 2
+	snapshotEnd      uint64 = math.MaxUint64
+	// restoreWorkers is how many goroutines write restored entries to pebble.
+	restoreWorkers = 4
+	// restoreChunkSize is how many entries each worker batch holds.  Entries
+	// are read in key order so every chunk covers a contiguous key range.
+	restoreChunkSize = 4096
+)
+
+// writeSnapshot streams every key of the pebble snapshot to w.
+func writeSnapshot(db *pebbledb, ss *pebble.Snapshot, w io.Writer) error {
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint64(header, snapshotFormatV3)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	sw := snappy.NewBufferedWriter(w)
+	iter := ss.NewIter(db.ro)
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := writeRecord(sw, iter.Key()); err != nil {
+			return err
+		}
+		if err := writeRecord(sw, iter.Value()); err != nil {
+			return err
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	end := make([]byte, 8)
+	binary.LittleEndian.PutUint64(end, snapshotEnd)
+	if _, err := sw.Write(end); err != nil {
+		return err
+	}
+	return sw.Close()
+}
+
+func writeRecord(w io.Writer, data []byte) error {
+	sz := make([]byte, 8)
+	binary.LittleEndian.PutUint64(sz, uint64(len(data)))
+	if _, err := w.Write(sz); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// restoreSnapshot loads a snapshot written by writeSnapshot, or by older
+// versions, into db.  A single goroutine decodes the stream into chunks that
+// restoreWorkers goroutines write to pebble concurrently.  The writes are
+// made durable with a single WAL sync at the end.
+func restoreSnapshot(db *pebbledb, r io.Reader, done <-chan struct{}) error {
+	sz := make([]byte, 8)
+	if _, err := io.ReadFull(r, sz); err != nil {
+		return err
+	}
+	var next func() (*KVData, error)
+	switch header := binary.LittleEndian.Uint64(sz); header {
+	case snapshotFormatV3:
+		next = rawEntryReader(bufio.NewReader(snappy.NewReader(r)))
+	case snapshotFormatV2:
+		next = entryReader(bufio.NewReader(snappy.NewReader(r)), math.MaxUint64)
+	default:
+		next = entryReader(r, header)
+	}
+
+	chunks := make(chan []*KVData, restoreWorkers)
+	g, ctx := errgroup.WithContext(context.Background())
+	for i := 0; i < restoreWorkers; i++ {
+		g.Go(func() error {
+			for chunk := range chunks {
+				wb := db.db.NewBatch()
+				for _, kv := range chunk {
+					wb.Set([]byte(kv.Key), []byte(kv.Val), db.wo)
+				}
+				err := db.db.Apply(wb, db.wo)
+				wb.Close()
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	readErr := func() error {
+		defer close(chunks)
+		chunk := make([]*KVData, 0, restoreChunkSize)
+		for {
+			kv, err := next()
+			if err != nil {
+				return err
+			}
+			if kv != nil {
+				chunk = append(chunk, kv)
+			}
+			if len(chunk) == restoreChunkSize || (kv == nil && len(chunk) > 0) {
+				select {
+				case chunks <- chunk:
+				case <-done:
+					return sm.ErrSnapshotStopped
+				case <-ctx.Done():
+					return nil // a worker failed, g.Wait returns its error
+				}
+				chunk = make([]*KVData, 0, restoreChunkSize)
+			}
+			if kv == nil {
+				return nil
+			}
+		}
+	}()
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if readErr != nil {
+		return readErr
+	}
+	return db.db.LogData(nil, db.syncwo)
+}
+
+// rawEntryReader returns a function decoding key and value records from r,
+// returning nil once the end marker has been read.
+func rawEntryReader(r io.Reader) func() (*KVData, error) {
+	sz := make([]byte, 8)
+	read := 0
+	record := func(n uint64) (string, error) {
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return "", fmt.Errorf("reading snapshot entry %d: %w", read, err)
+		}
+		return string(data), nil
+	}
+	return func() (*KVData, error) {
+		if _, err := io.ReadFull(r, sz); err != nil {
+			return nil, fmt.Errorf("reading snapshot entry %d: %w", read, err)
+		}
+		keyLen := binary.LittleEndian.Uint64(sz)
+		if keyLen == snapshotEnd {
+			return nil, nil
+		}
+		key, err := record(keyLen)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, sz); err != nil {
+			return nil, fmt.Errorf("reading snapshot entry %d: %w", read, err)
+		}
+		val, err := record(binary.LittleEndian.Uint64(sz))
+		if err != nil {
+			return nil, err
+		}
+		read++
+		return &KVData{Key: key, Val: val}, nil
+	}
+}
+
+// entryReader returns a function decoding up to count length prefixed
+// entries from r, returning nil once count entries or the zero length
+// terminator have been read.
+func entryReader(r io.Reader, count uint64) func() (*KVData, error) {
+	sz := make([]byte, 8)
+	read := uint64(0)
+	return func() (*KVData, error) {
+		if read == count {
+			return nil, nil
+		}
+		if _, err := io.ReadFull(r, sz); err != nil {
+			return nil, fmt.Errorf("reading snapshot entry %d: %w", read, err)
+		}
+		toRead := binary.LittleEndian.Uint64(sz)
+		if toRead == 0 {
+			return nil, nil
+		}
+		data := make([]byte, toRead)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("reading snapshot entry %d: %w", read, err)
+		}
+		read++
+		kv := &KVData{}
+		if err := json.Unmarshal(data, kv); err != nil {
+			return nil, fmt.Errorf("decoding snapshot entry %d: %w", read, err)
+		}
+		return kv, nil
+	}
+}
+
+// SnapshotStats describes the snapshots the local replica took.  Snapshots
+// are written from a pebble snapshot while entries keep being applied, only
+// taking that pebble snapshot (PrepareSnapshot) stalls the apply path.
+type SnapshotStats struct {
+	Count        uint64        `json:"count"`
+	Failures     uint64        `json:"failures"`
+	InProgress   bool          `json:"in_progress"`
+	LastTaken    time.Time     `json:"last_taken,omitempty"`
+	LastDuration time.Duration `json:"last_duration"`
+	MaxDuration  time.Duration `json:"max_duration"`
+	LastBytes    uint64        `json:"last_bytes"`
+	// LastApplyStall and MaxApplyStall are how long preparing a snapshot
+	// held up applying entries.
+	LastApplyStall time.Duration `json:"last_apply_stall"`
+	MaxApplyStall  time.Duration `json:"max_apply_stall"`
+}
+
+// snapshotStats is shared between the agent and the DiskKV it starts.
+type snapshotStats struct {
+	mu    sync.Mutex
+	stats SnapshotStats
+}
+
+func (s *snapshotStats) prepared(stall time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.InProgress = true
+	s.stats.LastApplyStall = stall
+	if stall > s.stats.MaxApplyStall {
+		s.stats.MaxApplyStall = stall
+	}
+}
+
+func (s *snapshotStats) saved(took time.Duration, bytes uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.InProgress = false
+	if err != nil {
+		s.stats.Failures++
+		return
+	}
+	s.stats.Count++
+	s.stats.LastTaken = time.Now()
+	s.stats.LastDuration, s.stats.LastBytes = took, bytes
+	if took > s.stats.MaxDuration {
+		s.stats.MaxDuration = took
+	}
+}
+
+// SnapshotStats reports the snapshots the local replica took.
+func (a *Agent) SnapshotStats() SnapshotStats {
+	a.snapshots.mu.Lock()
+	defer a.snapshots.mu.Unlock()
+	return a.snapshots.stats
+}
+
+// countingWriter counts the bytes of a snapshot.
+type countingWriter struct {
+	w     io.Writer
+	count uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count += uint64(n)
+	return n, err
+}
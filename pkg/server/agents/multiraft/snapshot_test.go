@@ -0,0 +1,152 @@
+package multiraft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"unsafe"
+)
+
+func openTestDB(t *testing.T, name string) *pebbledb {
+	db, err := createDB(filepath.Join(t.TempDir(), name))
+	if err != nil {
+		t.Fatalf("createDB() error = %v", err)
+	}
+	t.Cleanup(db.close)
+	return db
+}
+
+func dumpDB(t *testing.T, db *pebbledb) map[string]string {
+	iter := db.db.NewIter(db.ro)
+	defer iter.Close()
+	kvs := map[string]string{}
+	for iter.First(); iter.Valid(); iter.Next() {
+		kvs[string(iter.Key())] = string(iter.Value())
+	}
+	return kvs
+}
+
+func TestSnapshot_RoundTrip(t *testing.T) {
+	src := openTestDB(t, "src")
+	// more than a few chunks, so every worker gets some.
+	for i := 0; i < restoreChunkSize*restoreWorkers+17; i++ {
+		key := fmt.Sprintf("table:row%06d:col", i)
+		if err := src.db.Set([]byte(key), []byte(fmt.Sprint(i)), src.wo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ss := src.db.NewSnapshot()
+	defer ss.Close()
+	buf := &bytes.Buffer{}
+	if err := writeSnapshot(src, ss, buf); err != nil {
+		t.Fatalf("writeSnapshot() error = %v", err)
+	}
+
+	dst := openTestDB(t, "dst")
+	if err := restoreSnapshot(dst, buf, make(chan struct{})); err != nil {
+		t.Fatalf("restoreSnapshot() error = %v", err)
+	}
+	want, got := dumpDB(t, src), dumpDB(t, dst)
+	if len(got) != len(want) {
+		t.Fatalf("restored %d keys, want %d", len(got), len(want))
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("key %q = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestSnapshot_IgnoresLaterWrites(t *testing.T) {
+	src := openTestDB(t, "src")
+	if err := src.db.Set([]byte("before"), []byte("1"), src.wo); err != nil {
+		t.Fatal(err)
+	}
+	d := &DiskKV{db: unsafe.Pointer(src), snapshots: &snapshotStats{}}
+	ctx, err := d.PrepareSnapshot()
+	if err != nil {
+		t.Fatalf("PrepareSnapshot() error = %v", err)
+	}
+	// entries applied while the snapshot is written aren't in it.
+	if err := src.db.Set([]byte("after"), []byte("2"), src.wo); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := d.SaveSnapshot(ctx, buf, make(chan struct{})); err != nil {
+		t.Fatalf("SaveSnapshot() error = %v", err)
+	}
+
+	dst := openTestDB(t, "dst")
+	if err := restoreSnapshot(dst, buf, make(chan struct{})); err != nil {
+		t.Fatalf("restoreSnapshot() error = %v", err)
+	}
+	if got := dumpDB(t, dst); len(got) != 1 || got["before"] != "1" {
+		t.Errorf("restored %v, want only before", got)
+	}
+	stats := d.snapshots.stats
+	if stats.Count != 1 || stats.InProgress || stats.LastBytes == 0 {
+		t.Errorf("stats = %+v, want one finished snapshot", stats)
+	}
+}
+
+func TestSnapshot_RestoresLegacyFormat(t *testing.T) {
+	entries := []*KVData{{Key: "t:r:a", Val: "1"}, {Key: "t:r:b", Val: "2"}}
+	buf := &bytes.Buffer{}
+	sz := make([]byte, 8)
+	binary.LittleEndian.PutUint64(sz, uint64(len(entries)))
+	buf.Write(sz)
+	for _, kv := range entries {
+		data, _ := json.Marshal(kv)
+		binary.LittleEndian.PutUint64(sz, uint64(len(data)))
+		buf.Write(sz)
+		buf.Write(data)
+	}
+
+	dst := openTestDB(t, "dst")
+	if err := restoreSnapshot(dst, buf, make(chan struct{})); err != nil {
+		t.Fatalf("restoreSnapshot() error = %v", err)
+	}
+	got := dumpDB(t, dst)
+	if len(got) != 2 || got["t:r:a"] != "1" || got["t:r:b"] != "2" {
+		t.Errorf("restored %v", got)
+	}
+}
+
+func TestMigrateKeyLayout(t *testing.T) {
+	db := openTestDB(t, "db")
+	legacy := map[string]string{
+		"users:42:name":                   "bob",
+		tombstonePrefix + "users:41:name": "\x07\x00\x00\x00\x00\x00\x00\x00",
+		appliedIndexKey:                   "\x09\x00\x00\x00\x00\x00\x00\x00",
+	}
+	for k, v := range legacy {
+		if err := db.db.Set([]byte(k), []byte(v), db.wo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := migrateKeyLayout(db); err != nil {
+		t.Fatalf("migrateKeyLayout() error = %v", err)
+	}
+	got := dumpDB(t, db)
+	want := map[string]string{
+		string(encodeKey("users", "42", "name")):               "bob",
+		string(tombstoneKey(encodeKey("users", "41", "name"))): legacy[tombstonePrefix+"users:41:name"],
+		appliedIndexKey: legacy[appliedIndexKey],
+		keyLayoutKey:    currentKeyLayout,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("migrated to %q, want %q", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("key %q = %q, want %q", k, got[k], v)
+		}
+	}
+	row, err := db.lookup("users", "42", nil)
+	if err != nil || row.Columns["name"] != "bob" {
+		t.Errorf("lookup() = %v, %v", row, err)
+	}
+}
@@ -0,0 +1,420 @@
+package multiraft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/snappy"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// Snapshot files are written by dragonboat as
+//
+//	header (1024 bytes) | blocks | total (8 bytes) | magic (8 bytes)
+//
+// The header is a length prefixed raftpb.SnapshotHeader, the blocks are up
+// to snapshotBlockSize bytes of payload each followed by its CRC32, and the
+// header's PayloadChecksum is the CRC32 of the blocks' CRCs.  The payload,
+// snappy compressed or not, holds the client sessions then what the DiskKV
+// wrote with writeSnapshot.
+const (
+	snapshotHeaderSize = 1024
+	snapshotBlockSize  = 2 * 1024 * 1024
+	snapshotTailSize   = 16
+	snapshotBlockCRC   = 4
+	// snapshotFileV2 is the block based version of the file layout.
+	snapshotFileV2 = 2
+)
+
+var snapshotMagic = []byte{0x3F, 0x5B, 0xCB, 0xF1, 0xFA, 0xBA, 0x81, 0x9F}
+
+// ErrSnapshotCorrupt is returned when a snapshot file fails a checksum or
+// doesn't decode.
+var ErrSnapshotCorrupt = errors.New("corrupt snapshot file")
+
+// SnapshotFileInfo describes a snapshot file read by ReadSnapshotFile.
+type SnapshotFileInfo struct {
+	Path       string    `json:"path"`
+	Taken      time.Time `json:"taken"`
+	Compressed bool      `json:"compressed"`
+	Blocks     int       `json:"blocks"`
+	// SessionTable is the size of the replica's client session table,
+	// Sessions how many it held.
+	SessionTable uint64 `json:"session_table"`
+	Sessions     uint64 `json:"sessions"`
+	// Dummy is set for snapshots holding no data.  Those a replica takes of
+	// its own pebble store only record where it is, see ExportSnapshot.
+	Dummy bool `json:"dummy"`
+	// Format is the version of the DiskKV stream: v3, v2 or legacy.
+	Format       string `json:"format,omitempty"`
+	AppliedIndex uint64 `json:"applied_index"`
+	Keys         uint64 `json:"keys"`
+}
+
+// SnapshotEntry is a key of a snapshot file.  Table, Row and Column are set
+// for the keys of rows, Version when the key holds the raft index its row was
+// last modified at.  System keys hold the replica's own state, such as the
+// named state machines.
+type SnapshotEntry struct {
+	Key     []byte
+	Val     []byte
+	Table   string
+	Row     string
+	Column  string
+	Version bool
+	System  bool
+}
+
+// ReadSnapshotFile reads a snapshot file offline, calling fn for each of its
+// keys in order, and verifies every checksum of the file.  path is the
+// .gbsnap file or the snapshot directory holding it.  fn may be nil to only
+// verify the file.
+func ReadSnapshotFile(path string, fn func(SnapshotEntry) error) (*SnapshotFileInfo, error) {
+	path, err := snapshotFilePath(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	header, err := readSnapshotHeader(f)
+	if err != nil {
+		return nil, err
+	}
+	if header.Version != snapshotFileV2 {
+		return nil, fmt.Errorf("unsupported snapshot file version %d", header.Version)
+	}
+	if header.ChecksumType != pb.CRC32IEEE {
+		return nil, fmt.Errorf("unsupported snapshot checksum type %d", header.ChecksumType)
+	}
+	payloadSize := st.Size() - snapshotHeaderSize - snapshotTailSize
+	if payloadSize < 0 {
+		return nil, fmt.Errorf("%w: %d bytes is too short", ErrSnapshotCorrupt, st.Size())
+	}
+	if _, err := f.Seek(snapshotHeaderSize, io.SeekStart); err != nil {
+		return nil, err
+	}
+	info := &SnapshotFileInfo{
+		Path:       path,
+		Taken:      time.Unix(0, int64(header.UnreliableTime)),
+		Compressed: header.CompressionType == pb.Snappy,
+	}
+	blocks := &blockReader{r: bufio.NewReader(io.LimitReader(f, payloadSize)), sums: crc32.NewIEEE()}
+	var payload io.Reader = blocks
+	if info.Compressed {
+		payload = snappy.NewReader(blocks)
+	}
+	if err := readSnapshotPayload(bufio.NewReader(payload), info, fn); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%w: truncated payload: %v", ErrSnapshotCorrupt, err)
+		}
+		return nil, err
+	}
+	// The payload decoders stop at their end marker, the rest of the blocks
+	// still have to be checked.
+	if _, err := io.Copy(io.Discard, blocks); err != nil {
+		return nil, err
+	}
+	info.Blocks = blocks.n
+
+	tail := make([]byte, snapshotTailSize)
+	if _, err := io.ReadFull(f, tail); err != nil {
+		return nil, fmt.Errorf("%w: reading tail: %v", ErrSnapshotCorrupt, err)
+	}
+	if !bytes.Equal(tail[8:], snapshotMagic) {
+		return nil, fmt.Errorf("%w: bad magic number", ErrSnapshotCorrupt)
+	}
+	if total := binary.LittleEndian.Uint64(tail[:8]); total != uint64(payloadSize) {
+		return nil, fmt.Errorf("%w: tail records %d payload bytes, file holds %d", ErrSnapshotCorrupt, total, payloadSize)
+	}
+	if !bytes.Equal(blocks.sums.Sum(nil), header.PayloadChecksum) {
+		return nil, fmt.Errorf("%w: payload checksum mismatch", ErrSnapshotCorrupt)
+	}
+	return info, nil
+}
+
+// snapshotFilePath returns the snapshot file of a snapshot directory, or
+// path itself when it isn't a directory.
+func snapshotFilePath(path string) (string, error) {
+	st, err := os.Stat(path)
+	if err != nil || !st.IsDir() {
+		return path, err
+	}
+	files, err := filepath.Glob(filepath.Join(path, "*.gbsnap"))
+	if err != nil {
+		return "", err
+	}
+	if len(files) != 1 {
+		return "", fmt.Errorf("%s holds %d snapshot files, want one", path, len(files))
+	}
+	return files[0], nil
+}
+
+func readSnapshotHeader(r io.Reader) (pb.SnapshotHeader, error) {
+	header := pb.SnapshotHeader{}
+	sz := make([]byte, 8)
+	if _, err := io.ReadFull(r, sz); err != nil {
+		return header, fmt.Errorf("%w: reading header: %v", ErrSnapshotCorrupt, err)
+	}
+	n := binary.LittleEndian.Uint64(sz)
+	if n > snapshotHeaderSize-8 {
+		return header, fmt.Errorf("%w: header of %d bytes", ErrSnapshotCorrupt, n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return header, fmt.Errorf("%w: reading header: %v", ErrSnapshotCorrupt, err)
+	}
+	if err := header.Unmarshal(data); err != nil {
+		return header, fmt.Errorf("%w: decoding header: %v", ErrSnapshotCorrupt, err)
+	}
+	// The header checksum covers the header marshalled without it.
+	unsummed := header
+	unsummed.HeaderChecksum = nil
+	data, err := unsummed.Marshal()
+	if err != nil {
+		return header, err
+	}
+	sum := crc32.NewIEEE()
+	sum.Write(data)
+	if !bytes.Equal(sum.Sum(nil), header.HeaderChecksum) {
+		return header, fmt.Errorf("%w: header checksum mismatch", ErrSnapshotCorrupt)
+	}
+	return header, nil
+}
+
+// readSnapshotPayload skips the client sessions then decodes the DiskKV
+// stream, if any.
+func readSnapshotPayload(r io.Reader, info *SnapshotFileInfo, fn func(SnapshotEntry) error) error {
+	sz := make([]byte, 8)
+	for _, v := range []*uint64{&info.SessionTable, &info.Sessions} {
+		if _, err := io.ReadFull(r, sz); err != nil {
+			return fmt.Errorf("reading sessions: %w", err)
+		}
+		*v = binary.LittleEndian.Uint64(sz)
+	}
+	for i := uint64(0); i < info.Sessions; i++ {
+		if _, err := io.ReadFull(r, sz); err != nil {
+			return fmt.Errorf("reading session %d: %w", i, err)
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(binary.LittleEndian.Uint64(sz))); err != nil {
+			return fmt.Errorf("reading session %d: %w", i, err)
+		}
+	}
+
+	if _, err := io.ReadFull(r, sz); err == io.EOF {
+		info.Dummy = true
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("reading snapshot format: %w", err)
+	}
+	var next func() (*KVData, error)
+	switch header := binary.LittleEndian.Uint64(sz); header {
+	case snapshotFormatV3:
+		info.Format = "v3"
+		next = rawEntryReader(bufio.NewReader(snappy.NewReader(r)))
+	case snapshotFormatV2:
+		info.Format = "v2"
+		next = entryReader(bufio.NewReader(snappy.NewReader(r)), math.MaxUint64)
+	default:
+		info.Format = "legacy"
+		next = entryReader(r, header)
+	}
+	for {
+		kv, err := next()
+		if err != nil {
+			return err
+		}
+		if kv == nil {
+			return nil
+		}
+		e := snapshotEntry([]byte(kv.Key), []byte(kv.Val))
+		if string(e.Key) == appliedIndexKey && len(e.Val) == 8 {
+			info.AppliedIndex = binary.LittleEndian.Uint64(e.Val)
+		}
+		info.Keys++
+		if fn != nil {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// snapshotEntry decodes a raw key of either layout.
+func snapshotEntry(key, val []byte) SnapshotEntry {
+	e := SnapshotEntry{Key: key, Val: val}
+	switch {
+	case isLegacyDataKey(key):
+		e.Table, e.Row, e.Column = splitLegacyKey(string(key))
+	case len(key) > 0 && key[0] == dataKeyPrefix:
+		if row, ok := decodeRowVersionKey(key); ok {
+			e.Table, _ = decodeTable(key)
+			e.Row, e.Version = row, true
+		} else if table, row, column, ok := decodeKey(key); ok {
+			e.Table, e.Row, e.Column = table, row, column
+		} else {
+			e.System = true
+		}
+	default:
+		e.System = true
+	}
+	return e
+}
+
+// blockReader reads the payload of a snapshot file, checking each block
+// against its CRC and summing the CRCs for the header's payload checksum.
+type blockReader struct {
+	r     io.Reader
+	sums  hash.Hash
+	block []byte
+	n     int
+}
+
+func (br *blockReader) Read(p []byte) (int, error) {
+	if len(br.block) == 0 {
+		if err := br.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, br.block)
+	br.block = br.block[n:]
+	return n, nil
+}
+
+func (br *blockReader) next() error {
+	block := make([]byte, snapshotBlockSize+snapshotBlockCRC)
+	n, err := io.ReadFull(br.r, block)
+	if err == io.EOF {
+		return io.EOF
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if n <= snapshotBlockCRC {
+		return fmt.Errorf("%w: block %d is %d bytes", ErrSnapshotCorrupt, br.n, n)
+	}
+	data, crc := block[:n-snapshotBlockCRC], block[n-snapshotBlockCRC:n]
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.ChecksumIEEE(data))
+	if !bytes.Equal(sum, crc) {
+		return fmt.Errorf("%w: block %d checksum mismatch", ErrSnapshotCorrupt, br.n)
+	}
+	br.sums.Write(crc)
+	br.block = data
+	br.n++
+	return nil
+}
+
+// createSnapshotFile writes a snapshot file the way dragonboat does,
+// uncompressed, with the payload fn writes, and returns its payload checksum
+// and its size.
+func createSnapshotFile(path string, fn func(io.Writer) error) ([]byte, int64, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	// the header goes in last, once the payload checksum is known.
+	if _, err := f.Write(make([]byte, snapshotHeaderSize)); err != nil {
+		return nil, 0, err
+	}
+	bw := &blockWriter{w: bufio.NewWriter(f), sums: crc32.NewIEEE()}
+	if err := fn(bw); err != nil {
+		return nil, 0, err
+	}
+	if err := bw.flush(); err != nil {
+		return nil, 0, err
+	}
+	tail := binary.LittleEndian.AppendUint64(nil, uint64(bw.total))
+	if _, err := bw.w.Write(append(tail, snapshotMagic...)); err != nil {
+		return nil, 0, err
+	}
+	if err := bw.w.Flush(); err != nil {
+		return nil, 0, err
+	}
+
+	header := pb.SnapshotHeader{
+		Version:         snapshotFileV2,
+		ChecksumType:    pb.CRC32IEEE,
+		PayloadChecksum: bw.sums.Sum(nil),
+	}
+	data, err := header.Marshal()
+	if err != nil {
+		return nil, 0, err
+	}
+	sum := crc32.NewIEEE()
+	sum.Write(data)
+	header.HeaderChecksum = sum.Sum(nil)
+	if data, err = header.Marshal(); err != nil {
+		return nil, 0, err
+	}
+	buf := binary.LittleEndian.AppendUint64(nil, uint64(len(data)))
+	if _, err := f.WriteAt(append(buf, data...), 0); err != nil {
+		return nil, 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, 0, err
+	}
+	return header.PayloadChecksum, snapshotHeaderSize + bw.total + snapshotTailSize, f.Close()
+}
+
+// blockWriter cuts what is written to it into blocks, each followed by its
+// CRC32, the reverse of blockReader.
+type blockWriter struct {
+	w     *bufio.Writer
+	sums  hash.Hash
+	block []byte
+	total int64
+}
+
+func (bw *blockWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		room := snapshotBlockSize - len(bw.block)
+		if room > len(p) {
+			room = len(p)
+		}
+		bw.block = append(bw.block, p[:room]...)
+		p = p[room:]
+		if len(bw.block) == snapshotBlockSize {
+			if err := bw.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (bw *blockWriter) flush() error {
+	if len(bw.block) == 0 {
+		return nil
+	}
+	crc := make([]byte, snapshotBlockCRC)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(bw.block))
+	if _, err := bw.w.Write(bw.block); err != nil {
+		return err
+	}
+	if _, err := bw.w.Write(crc); err != nil {
+		return err
+	}
+	bw.sums.Write(crc)
+	bw.total += int64(len(bw.block) + snapshotBlockCRC)
+	bw.block = bw.block[:0]
+	return nil
+}
@@ -0,0 +1,139 @@
+package multiraft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/snappy"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// writeSnapshotFile lays out a payload the way dragonboat writes snapshot
+// files, see snapshotfile.go.
+func writeSnapshotFile(t *testing.T, path string, payload []byte, compressed bool) {
+	t.Helper()
+	header := pb.SnapshotHeader{Version: snapshotFileV2, ChecksumType: pb.CRC32IEEE}
+	if compressed {
+		header.CompressionType = pb.Snappy
+		buf := &bytes.Buffer{}
+		sw := snappy.NewBufferedWriter(buf)
+		sw.Write(payload)
+		sw.Close()
+		payload = buf.Bytes()
+	}
+	body, sums := &bytes.Buffer{}, crc32.NewIEEE()
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > snapshotBlockSize {
+			n = snapshotBlockSize
+		}
+		crc := make([]byte, 4)
+		binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(payload[:n]))
+		body.Write(payload[:n])
+		body.Write(crc)
+		sums.Write(crc)
+		payload = payload[n:]
+	}
+	header.PayloadChecksum = sums.Sum(nil)
+	data, _ := header.Marshal()
+	header.HeaderChecksum = make([]byte, 4)
+	binary.BigEndian.PutUint32(header.HeaderChecksum, crc32.ChecksumIEEE(data))
+	data, _ = header.Marshal()
+
+	file := make([]byte, snapshotHeaderSize)
+	binary.LittleEndian.PutUint64(file, uint64(len(data)))
+	copy(file[8:], data)
+	file = append(file, body.Bytes()...)
+	file = binary.LittleEndian.AppendUint64(file, uint64(body.Len()))
+	file = append(file, snapshotMagic...)
+	if err := os.WriteFile(path, file, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadSnapshotFile(t *testing.T) {
+	db := openTestDB(t, "src")
+	big := make([]byte, snapshotBlockSize+1024)
+	rand.New(rand.NewSource(1)).Read(big)
+	version := make([]byte, 8)
+	binary.LittleEndian.PutUint64(version, 7)
+	applied := make([]byte, 8)
+	binary.LittleEndian.PutUint64(applied, 42)
+	for k, v := range map[string][]byte{
+		string(encodeKey("users", "ann", "name")):  []byte("Ann"),
+		string(encodeKey("users", "ann", "photo")): big,
+		string(rowVersionKey("users", "ann")):      version,
+		string(encodeKey("users", "bob", "name")):  []byte("Bob"),
+		string(encodeKey("orders", "1", "total")):  []byte("10"),
+		keyLayoutKey:    []byte(currentKeyLayout),
+		appliedIndexKey: applied,
+	} {
+		if err := db.db.Set([]byte(k), v, db.wo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ss := db.db.NewSnapshot()
+	defer ss.Close()
+	payload := &bytes.Buffer{}
+	payload.Write(make([]byte, 16)) // no client sessions
+	if err := writeSnapshot(db, ss, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, compressed := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "snapshot.gbsnap")
+		writeSnapshotFile(t, path, payload.Bytes(), compressed)
+		rows := map[string]string{}
+		var system int
+		info, err := ReadSnapshotFile(filepath.Dir(path), func(e SnapshotEntry) error {
+			switch {
+			case e.System:
+				system++
+			case e.Version:
+				rows[e.Table+"/"+e.Row+"@"] = string(e.Val)
+			default:
+				rows[e.Table+"/"+e.Row+"/"+e.Column] = string(e.Val)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("compressed %t: ReadSnapshotFile() error = %v", compressed, err)
+		}
+		if info.Dummy || info.Format != "v3" || info.Keys != 7 || info.AppliedIndex != 42 || info.Compressed != compressed {
+			t.Errorf("compressed %t: info = %+v", compressed, info)
+		}
+		if !compressed && info.Blocks != 2 {
+			t.Errorf("read %d blocks, want 2", info.Blocks)
+		}
+		if system != 2 || len(rows) != 5 || rows["users/bob/name"] != "Bob" || rows["users/ann@"] != string(version) || rows["users/ann/photo"] != string(big) {
+			t.Errorf("compressed %t: read %d system keys and rows %q", compressed, system, rows)
+		}
+	}
+
+	t.Run("dummy", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "snapshot.gbsnap")
+		writeSnapshotFile(t, path, make([]byte, 16), false)
+		info, err := ReadSnapshotFile(path, nil)
+		if err != nil || !info.Dummy || info.Keys != 0 {
+			t.Errorf("ReadSnapshotFile() = %+v, %v, want a dummy snapshot", info, err)
+		}
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "snapshot.gbsnap")
+		writeSnapshotFile(t, path, payload.Bytes(), false)
+		data, _ := os.ReadFile(path)
+		// a byte of the photo, only the block checksum can tell.
+		data[snapshotHeaderSize+snapshotBlockSize-1] ^= 0xff
+		os.WriteFile(path, data, 0o644)
+		if _, err := ReadSnapshotFile(path, nil); !errors.Is(err, ErrSnapshotCorrupt) {
+			t.Errorf("ReadSnapshotFile() error = %v, want ErrSnapshotCorrupt", err)
+		}
+	})
+}
@@ -0,0 +1,236 @@
+package multiraft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// Table statistics summarize the rows of a table for the query planner, see
+// PlanSelect.  The leader computes them with an AnalyzeQuery on its replica
+// and replicates them with OpSetStats, so every replica plans the same.
+const (
+	// statsPrefix keys the statistics, by table.
+	statsPrefix string = "\x00stats:"
+	// maxStatsColumns bounds the columns of a table analyzed, those seen
+	// after are left out.
+	maxStatsColumns = 256
+	// sketchPrecision is the log2 of the registers of a column's sketch,
+	// their estimates are within about 3%.
+	sketchPrecision = 10
+)
+
+// OpSetStats records the statistics Stats of a table, replacing those it
+// had.
+const OpSetStats = "set_stats"
+
+// TableStats are the statistics of a table: the Rows it held and, by column,
+// the rows holding the column and its distinct values, when analyzed as of
+// raft index Index at Analyzed, in unix nanoseconds.
+type TableStats struct {
+	Table    string                 `json:"table"`
+	Rows     uint64                 `json:"rows"`
+	Columns  map[string]ColumnStats `json:"columns"`
+	Index    uint64                 `json:"index"`
+	Analyzed int64                  `json:"analyzed"`
+}
+
+// ColumnStats are the statistics of a column: the Rows holding it and an
+// estimate of its Distinct values.
+type ColumnStats struct {
+	Rows     uint64 `json:"rows"`
+	Distinct uint64 `json:"distinct"`
+}
+
+// AnalyzeQuery computes the statistics of Table on the replica it is read
+// on, reading every row.
+type AnalyzeQuery struct {
+	Table string
+}
+
+// StatsQuery asks for the recorded statistics of every table, by table.
+type StatsQuery struct{}
+
+// selectivity estimates the share of the rows whose column equals a given
+// value, 1 when the column wasn't analyzed.
+func (s *TableStats) selectivity(column string) float64 {
+	c, ok := s.Columns[column]
+	if !ok || s.Rows == 0 {
+		return 1
+	}
+	if c.Distinct == 0 {
+		return 0
+	}
+	return float64(c.Rows) / float64(s.Rows) / float64(c.Distinct)
+}
+
+// estimateIndexRead estimates the index entries a read through def narrowed
+// to the values of its first matched columns examines.
+func (s *TableStats) estimateIndexRead(def *IndexDef, matched int) float64 {
+	est := float64(s.Rows)
+	for _, c := range def.Columns[:matched] {
+		est *= s.selectivity(c)
+	}
+	// only rows holding every indexed column have an entry.
+	for _, c := range def.Columns {
+		if cs, ok := s.Columns[c]; ok && float64(cs.Rows) < est {
+			est = float64(cs.Rows)
+		}
+	}
+	return est
+}
+
+func statsKey(table string) []byte {
+	return append([]byte(statsPrefix), table...)
+}
+
+func readStats(rd pebble.Reader, table string) (*TableStats, error) {
+	val, closer, err := rd.Get(statsKey(table))
+	if err == pebble.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	stats := &TableStats{}
+	if err := json.Unmarshal(val, stats); err != nil {
+		return nil, fmt.Errorf("decoding statistics of %q: %w", table, err)
+	}
+	return stats, nil
+}
+
+func setStats(db *pebbledb, wb *pebble.Batch, stats *TableStats, index uint64) error {
+	updated := *stats
+	updated.Index = index
+	buf, err := json.Marshal(&updated)
+	if err != nil {
+		return err
+	}
+	wb.Set(statsKey(stats.Table), buf, db.wo)
+	return nil
+}
+
+func (r *pebbledb) stats() ([]TableStats, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil, errors.New("db already closed")
+	}
+	prefix := []byte(statsPrefix)
+	iter := r.db.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	var list []TableStats
+	for iter.First(); iter.Valid(); iter.Next() {
+		var stats TableStats
+		if err := json.Unmarshal(iter.Value(), &stats); err != nil {
+			iter.Close()
+			return nil, fmt.Errorf("decoding statistics %q: %w", iter.Key(), err)
+		}
+		list = append(list, stats)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// analyze computes the statistics of a table, its Index is left for
+// OpSetStats to fill in.
+func (r *pebbledb) analyze(table string) (*TableStats, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil, errors.New("db already closed")
+	}
+	ss := r.db.NewSnapshot()
+	defer ss.Close()
+	prefix := encodeTablePrefix(table)
+	iter := ss.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	stats := &TableStats{Table: table, Columns: map[string]ColumnStats{}}
+	sketches := map[string]*sketch{}
+	last := ""
+	for iter.First(); iter.Valid(); iter.Next() {
+		_, row, column, ok := decodeKey(iter.Key())
+		if !ok {
+			continue
+		}
+		if stats.Rows == 0 || row != last {
+			stats.Rows++
+			last = row
+		}
+		sk, ok := sketches[column]
+		if !ok {
+			if len(sketches) == maxStatsColumns {
+				continue
+			}
+			sk = &sketch{}
+			sketches[column] = sk
+		}
+		sk.add(iter.Value())
+		cs := stats.Columns[column]
+		cs.Rows++
+		stats.Columns[column] = cs
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	for column, sk := range sketches {
+		cs := stats.Columns[column]
+		cs.Distinct = sk.estimate()
+		// the estimate is off by a few percent, never by more than the rows.
+		if cs.Distinct > cs.Rows {
+			cs.Distinct = cs.Rows
+		}
+		if cs.Distinct == 0 && cs.Rows > 0 {
+			cs.Distinct = 1
+		}
+		stats.Columns[column] = cs
+	}
+	return stats, nil
+}
+
+// sketch is a HyperLogLog sketch of the distinct values of a column.
+type sketch [1 << sketchPrecision]uint8
+
+func (s *sketch) add(v []byte) {
+	h := fnv.New64a()
+	h.Write(v)
+	x := mix64(h.Sum64())
+	i := x >> (64 - sketchPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<sketchPrecision|1<<(sketchPrecision-1)) + 1)
+	if rank > s[i] {
+		s[i] = rank
+	}
+}
+
+func (s *sketch) estimate() uint64 {
+	m := float64(len(s))
+	sum, zeros := 0.0, 0
+	for _, r := range s {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	est := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		// linear counting is more accurate for few values.
+		est = m * math.Log(m/float64(zeros))
+	}
+	return uint64(est + 0.5)
+}
+
+// mix64 spreads the bits of an FNV hash, whose low bits mix poorly, over the
+// whole word (the splitmix64 finalizer).
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,68 @@
+package multiraft
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSketch(t *testing.T) {
+	for _, n := range []int{0, 1, 100, 5000, 100000} {
+		var s sketch
+		for i := 0; i < n; i++ {
+			s.add([]byte(fmt.Sprintf("value-%d", i)))
+			// duplicates don't count.
+			s.add([]byte(fmt.Sprintf("value-%d", i/2)))
+		}
+		got := float64(s.estimate())
+		if diff := got - float64(n); diff > 0.05*float64(n)+1 || -diff > 0.05*float64(n)+1 {
+			t.Errorf("estimate() of %d values = %v", n, got)
+		}
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	db := openTestDB(t, "analyze")
+	for i := 0; i < 100; i++ {
+		cols := map[string]string{"country": fmt.Sprint(i % 4), "email": fmt.Sprintf("u%d@example.com", i)}
+		if i%10 == 0 {
+			cols["team"] = "core"
+		}
+		applyTestKV(t, db, &KVData{Op: OpSetRow, Table: "users", Row: fmt.Sprintf("u%03d", i), Columns: cols})
+	}
+	applyTestKV(t, db, &KVData{Op: OpSetRow, Table: "other", Row: "x", Columns: map[string]string{"country": "9"}})
+	stats, err := db.analyze("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]ColumnStats{
+		"country": {Rows: 100, Distinct: 4},
+		"email":   {Rows: 100, Distinct: 100},
+		"team":    {Rows: 10, Distinct: 1},
+	}
+	if stats.Rows != 100 || len(stats.Columns) != len(want) {
+		t.Fatalf("analyze() = %+v", stats)
+	}
+	for c, w := range want {
+		got := stats.Columns[c]
+		if got.Rows != w.Rows || got.Distinct < w.Distinct*95/100 || got.Distinct > w.Distinct {
+			t.Errorf("analyze() of %s = %+v, want about %+v", c, got, w)
+		}
+	}
+
+	applyTestKV(t, db, &KVData{Op: OpSetStats, Stats: stats})
+	list, err := db.stats()
+	if err != nil || len(list) != 1 || list[0].Table != "users" || list[0].Rows != 100 || list[0].Index == 0 {
+		t.Errorf("stats() = %+v, %v", list, err)
+	}
+	applyTestKV(t, db,
+		&KVData{Op: OpCreateIndex, IndexDef: &IndexDef{Table: "users", Name: "by_country", Columns: []string{"country"}}},
+		&KVData{Op: OpBackfillIndex, Table: "users", Row: "by_country"},
+	)
+	plan, err := db.explainSelect(SelectQuery{Table: "users", Where: map[string]string{"country": "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Index != "by_country" || plan.Examined != 25 || plan.Estimated == nil || *plan.Estimated < 24 || *plan.Estimated > 26 {
+		t.Errorf("explainSelect() = %+v, want 25 rows estimated through by_country", plan)
+	}
+}
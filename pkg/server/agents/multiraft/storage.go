@@ -0,0 +1,98 @@
+package multiraft
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// StorageStatsQuery asks the local replica for its StorageStats.
+type StorageStatsQuery struct{}
+
+// CompactQuery compacts the local replica's keys of Table, every key when
+// it is empty, so the space of deleted and overwritten rows is reclaimed.
+// It is local to the replica it is read on, not replicated.
+type CompactQuery struct {
+	Table string
+}
+
+// StorageStats are the pebble compaction statistics of a replica.
+type StorageStats struct {
+	Levels []LevelStats `json:"levels"`
+	// Compactions counts the compactions since the store was opened.
+	Compactions           int64 `json:"compactions"`
+	CompactionsInProgress int64 `json:"compactions_in_progress"`
+	// PendingCompactionBytes estimates how much has to be compacted for the
+	// LSM to be stable again.
+	PendingCompactionBytes uint64 `json:"pending_compaction_bytes"`
+	// WriteStalls counts the times writes were stalled waiting for flushes
+	// or compactions to catch up.
+	WriteStalls uint64 `json:"write_stalls"`
+	DiskUsage   uint64 `json:"disk_usage_bytes"`
+}
+
+// LevelStats describes one level of the LSM.
+type LevelStats struct {
+	Level    int     `json:"level"`
+	Files    int64   `json:"files"`
+	Bytes    int64   `json:"bytes"`
+	Score    float64 `json:"score"`
+	Sublevel int32   `json:"sublevels"`
+}
+
+// StorageDir is the directory replicas keep their pebble stores in,
+// relative to the working directory.
+func StorageDir() string {
+	return testDBDirName
+}
+
+// stallCounter returns an event listener counting write stalls.
+func stallCounter(stalls *atomic.Uint64) pebble.EventListener {
+	return pebble.EventListener{
+		WriteStallBegin: func(pebble.WriteStallBeginInfo) { stalls.Add(1) },
+	}
+}
+
+func (r *pebbledb) storageStats() (*StorageStats, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil, errors.New("db already closed")
+	}
+	m := r.db.Metrics()
+	stats := &StorageStats{
+		Compactions:            m.Compact.Count,
+		CompactionsInProgress:  m.Compact.NumInProgress,
+		PendingCompactionBytes: m.Compact.EstimatedDebt,
+		WriteStalls:            r.stalls.Load(),
+		DiskUsage:              m.DiskSpaceUsage(),
+	}
+	for i, l := range m.Levels {
+		stats.Levels = append(stats.Levels, LevelStats{Level: i, Files: l.NumFiles, Bytes: l.Size, Score: l.Score, Sublevel: l.Sublevels})
+	}
+	return stats, nil
+}
+
+// compact compacts the keys of table, or every key, and returns the disk
+// usage after the compaction.  It holds a reference rather than mu, so
+// lookups and snapshots aren't held up behind it.
+func (r *pebbledb) compact(table string) (uint64, error) {
+	r.mu.RLock()
+	if r.closed {
+		r.mu.RUnlock()
+		return 0, errors.New("db already closed")
+	}
+	r.refs.Add(1)
+	r.mu.RUnlock()
+	defer r.refs.Done()
+	start, end := []byte{0}, []byte{0xff}
+	if table != "" {
+		start = encodeTablePrefix(table)
+		end = prefixUpperBound(start)
+	}
+	if err := r.db.Compact(start, end, true); err != nil {
+		return 0, err
+	}
+	return r.db.Metrics().DiskSpaceUsage(), nil
+}
@@ -0,0 +1,62 @@
+package multiraft
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStorage_Compact(t *testing.T) {
+	db := openTestDB(t, "db")
+	for i := 0; i < 1000; i++ {
+		key := encodeKey("logs", fmt.Sprintf("row%04d", i), "msg")
+		if err := db.db.Set(key, []byte("some log line"), db.wo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.db.DeleteRange(encodeTablePrefix("logs"), prefixUpperBound(encodeTablePrefix("logs")), db.wo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.compact("logs"); err != nil {
+		t.Fatalf("compact() error = %v", err)
+	}
+	stats, err := db.storageStats()
+	if err != nil {
+		t.Fatalf("storageStats() error = %v", err)
+	}
+	if len(stats.Levels) != 7 {
+		t.Errorf("stats has %d levels, want 7", len(stats.Levels))
+	}
+	var files int64
+	for _, l := range stats.Levels {
+		files += l.Files
+	}
+	if files != 0 {
+		t.Errorf("%d files left after compacting the deleted table, want 0", files)
+	}
+}
+
+func TestStorage_CompactReference(t *testing.T) {
+	db := openTestDB(t, "db")
+	// a compaction in progress holds a reference, not the lock.
+	db.refs.Add(1)
+	if _, err := db.storageStats(); err != nil {
+		db.refs.Done()
+		t.Fatalf("storageStats() during a compaction error = %v", err)
+	}
+	closed := make(chan struct{})
+	go func() {
+		db.close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Error("close() returned while a compaction held the db")
+	case <-time.After(50 * time.Millisecond):
+	}
+	db.refs.Done()
+	<-closed
+	if _, err := db.compact("logs"); err == nil {
+		t.Error("compact() of a closed db succeeded")
+	}
+}
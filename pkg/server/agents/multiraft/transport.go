@@ -0,0 +1,363 @@
+package multiraft
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	dgConfig "github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+const (
+	// muxPreamble opens every raft connection multiplexed onto another
+	// listener.  It starts with a NUL so no HTTP request can look like it,
+	// and is followed by the kind of connection.
+	muxPreamble = "\x00expodb-raft\x00"
+	muxMessages = 'm'
+	muxSnapshot = 's'
+	// The kinds of connections whose frames may be compressed.
+	muxMessagesZstd = 'M'
+	muxSnapshotZstd = 'S'
+
+	// Every frame of a compressed connection starts with muxRaw or muxZstd.
+	// Frames under minCompressFrame bytes, heartbeats mostly, aren't worth
+	// compressing.
+	muxRaw           = 0
+	muxZstd          = 1
+	minCompressFrame = 512
+
+	// maxMuxFrame bounds a message batch or snapshot chunk read off the wire.
+	maxMuxFrame = 256 << 20
+	// muxSniffTimeout is how long a new connection has to send its first
+	// bytes before it is dropped.
+	muxSniffTimeout = 10 * time.Second
+	muxDialTimeout  = 5 * time.Second
+	muxWriteTimeout = 30 * time.Second
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxMuxFrame))
+)
+
+// MuxTransport carries raft messages and snapshot chunks over connections
+// accepted by another listener, so raft shares the HTTP port.  Set it as the
+// NodeHost's Expert.TransportFactory and serve HTTP from Listener; every
+// node of the cluster has to use it, the default transport can't talk to it.
+type MuxTransport struct {
+	mu           sync.Mutex
+	handler      raftio.MessageHandler
+	chunkHandler raftio.ChunkHandler
+	conns        map[net.Conn]struct{}
+	closed       bool
+	wg           sync.WaitGroup
+	// compress reports whether a target accepts compressed frames.
+	compress func(target string) bool
+}
+
+// NewMuxTransport returns a transport that receives nothing until dragonboat
+// creates it and Listener starts handing it connections.
+func NewMuxTransport() *MuxTransport {
+	return &MuxTransport{conns: map[net.Conn]struct{}{}}
+}
+
+// Create implements config.TransportFactory, there is one transport per
+// NodeHost.
+func (t *MuxTransport) Create(_ dgConfig.NodeHostConfig, handler raftio.MessageHandler, chunkHandler raftio.ChunkHandler) raftio.ITransport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handler, t.chunkHandler = handler, chunkHandler
+	return t
+}
+
+// SetCompression has frames to the targets compress accepts compressed
+// with zstd, targets can always receive uncompressed ones.
+func (t *MuxTransport) SetCompression(compress func(target string) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.compress = compress
+}
+
+func (t *MuxTransport) compressed(target string) bool {
+	t.mu.Lock()
+	compress := t.compress
+	t.mu.Unlock()
+	return compress != nil && compress(target)
+}
+
+// Validate implements config.TransportFactory, raft addresses are host:port.
+func (t *MuxTransport) Validate(addr string) bool {
+	_, _, err := net.SplitHostPort(addr)
+	return err == nil
+}
+
+func (t *MuxTransport) Name() string { return "expodb-mux" }
+
+// Start implements raftio.ITransport, connections come in through Listener.
+func (t *MuxTransport) Start() error { return nil }
+
+func (t *MuxTransport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+	return nil
+}
+
+func (t *MuxTransport) GetConnection(ctx context.Context, target string) (raftio.IConnection, error) {
+	c, err := dialMux(ctx, target, muxMessages, t.compressed(target))
+	if err != nil {
+		return nil, err
+	}
+	return &muxMessageConn{c}, nil
+}
+
+func (t *MuxTransport) GetSnapshotConnection(ctx context.Context, target string) (raftio.ISnapshotConnection, error) {
+	c, err := dialMux(ctx, target, muxSnapshot, t.compressed(target))
+	if err != nil {
+		return nil, err
+	}
+	return &muxSnapshotConn{c}, nil
+}
+
+// Listener returns a listener accepting the connections of l that aren't
+// raft ones, raft connections are served by the transport.
+func (t *MuxTransport) Listener(l net.Listener) net.Listener {
+	ml := &muxListener{Listener: l, t: t, accepted: make(chan net.Conn), done: make(chan struct{})}
+	go ml.run()
+	return ml
+}
+
+// serve reads frames off a raft connection until it fails or is closed.
+func (t *MuxTransport) serve(conn net.Conn, r *bufio.Reader, kind byte) {
+	t.mu.Lock()
+	if t.closed || t.handler == nil {
+		t.mu.Unlock()
+		conn.Close()
+		return
+	}
+	t.conns[conn] = struct{}{}
+	t.wg.Add(1)
+	handler, chunkHandler := t.handler, t.chunkHandler
+	t.mu.Unlock()
+	defer func() {
+		conn.Close()
+		t.mu.Lock()
+		delete(t.conns, conn)
+		t.mu.Unlock()
+		t.wg.Done()
+	}()
+
+	compressed := false
+	switch kind {
+	case muxMessagesZstd:
+		kind, compressed = muxMessages, true
+	case muxSnapshotZstd:
+		kind, compressed = muxSnapshot, true
+	}
+	for {
+		frame, err := readMuxFrame(r, compressed)
+		if err != nil {
+			return
+		}
+		switch kind {
+		case muxMessages:
+			batch := pb.MessageBatch{}
+			if err := batch.Unmarshal(frame); err != nil {
+				return
+			}
+			handler(batch)
+		case muxSnapshot:
+			chunk := pb.Chunk{}
+			if err := chunk.Unmarshal(frame); err != nil {
+				return
+			}
+			if !chunkHandler(chunk) {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// muxListener sniffs every accepted connection for the raft preamble.
+type muxListener struct {
+	net.Listener
+	t        *MuxTransport
+	accepted chan net.Conn
+	done     chan struct{}
+	once     sync.Once
+	err      error
+}
+
+func (l *muxListener) run() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			l.once.Do(func() {
+				l.err = err
+				close(l.done)
+			})
+			return
+		}
+		go l.sniff(conn)
+	}
+}
+
+func (l *muxListener) sniff(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(muxSniffTimeout))
+	head, err := r.Peek(1)
+	if err == nil && head[0] == muxPreamble[0] {
+		var buf []byte
+		if buf, err = r.Peek(len(muxPreamble) + 1); err == nil && string(buf[:len(muxPreamble)]) == muxPreamble {
+			r.Discard(len(buf))
+			conn.SetReadDeadline(time.Time{})
+			l.t.serve(conn, r, buf[len(muxPreamble)])
+			return
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	select {
+	case l.accepted <- &sniffedConn{Conn: conn, r: r}:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *muxListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.done:
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *muxListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// sniffedConn replays the bytes read while sniffing.
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// muxConn is the sending end of a raft connection.
+type muxConn struct {
+	conn       net.Conn
+	w          *bufio.Writer
+	compressed bool
+}
+
+func dialMux(ctx context.Context, target string, kind byte, compressed bool) (*muxConn, error) {
+	d := net.Dialer{Timeout: muxDialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	c := &muxConn{conn: conn, w: bufio.NewWriter(conn), compressed: compressed}
+	if compressed && kind == muxMessages {
+		kind = muxMessagesZstd
+	} else if compressed {
+		kind = muxSnapshotZstd
+	}
+	c.w.WriteString(muxPreamble)
+	c.w.WriteByte(kind)
+	return c, nil
+}
+
+func (c *muxConn) send(m interface{ Marshal() ([]byte, error) }) error {
+	frame, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	if c.compressed {
+		if len(frame) < minCompressFrame {
+			frame = append([]byte{muxRaw}, frame...)
+		} else {
+			frame = zstdEncoder.EncodeAll(frame, []byte{muxZstd})
+		}
+	}
+	if len(frame) > maxMuxFrame {
+		return fmt.Errorf("raft frame of %d bytes is over the %d bytes limit", len(frame), maxMuxFrame)
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(muxWriteTimeout))
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(frame)))
+	c.w.Write(size[:])
+	c.w.Write(frame)
+	return c.w.Flush()
+}
+
+func readMuxFrame(r *bufio.Reader, compressed bool) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxMuxFrame {
+		return nil, fmt.Errorf("raft frame of %d bytes is over the %d bytes limit", n, maxMuxFrame)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	if !compressed {
+		return frame, nil
+	}
+	if len(frame) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	switch frame[0] {
+	case muxRaw:
+		return frame[1:], nil
+	case muxZstd:
+		return zstdDecoder.DecodeAll(frame[1:], nil)
+	}
+	return nil, fmt.Errorf("unknown raft frame encoding %d", frame[0])
+}
+
+type muxMessageConn struct{ *muxConn }
+
+func (c *muxMessageConn) Close() { c.conn.Close() }
+
+func (c *muxMessageConn) SendMessageBatch(batch pb.MessageBatch) error {
+	return c.send(&batch)
+}
+
+type muxSnapshotConn struct{ *muxConn }
+
+func (c *muxSnapshotConn) Close() { c.conn.Close() }
+
+func (c *muxSnapshotConn) SendChunk(chunk pb.Chunk) error {
+	return c.send(&chunk)
+}
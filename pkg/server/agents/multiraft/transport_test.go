@@ -0,0 +1,85 @@
+package multiraft
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	dgConfig "github.com/lni/dragonboat/v4/config"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func TestMuxTransport(t *testing.T) {
+	t.Run("plain", func(t *testing.T) { testMuxTransport(t, false) })
+	t.Run("zstd", func(t *testing.T) { testMuxTransport(t, true) })
+}
+
+func testMuxTransport(t *testing.T, compressed bool) {
+	batches := make(chan pb.MessageBatch, 1)
+	chunks := make(chan pb.Chunk, 1)
+	mux := NewMuxTransport()
+	trans := mux.Create(dgConfig.NodeHostConfig{},
+		func(b pb.MessageBatch) { batches <- b },
+		func(c pb.Chunk) bool { chunks <- c; return true })
+	defer trans.Close()
+	mux.SetCompression(func(string) bool { return compressed })
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") })}
+	go srv.Serve(mux.Listener(ln))
+	defer srv.Close()
+	addr := ln.Addr().String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := trans.GetConnection(ctx, addr)
+	if err != nil {
+		t.Fatalf("GetConnection() error = %v", err)
+	}
+	defer conn.Close()
+	if err := conn.SendMessageBatch(pb.MessageBatch{SourceAddress: "node-1", Requests: []pb.Message{{Term: 3}}}); err != nil {
+		t.Fatalf("SendMessageBatch() error = %v", err)
+	}
+	ss, err := trans.GetSnapshotConnection(ctx, addr)
+	if err != nil {
+		t.Fatalf("GetSnapshotConnection() error = %v", err)
+	}
+	defer ss.Close()
+	if err := ss.SendChunk(pb.Chunk{ShardID: 1, Data: bytes.Repeat([]byte("snapshot"), 1000)}); err != nil {
+		t.Fatalf("SendChunk() error = %v", err)
+	}
+
+	select {
+	case b := <-batches:
+		if b.SourceAddress != "node-1" || len(b.Requests) != 1 || b.Requests[0].Term != 3 {
+			t.Errorf("received batch %+v", b)
+		}
+	case <-ctx.Done():
+		t.Fatal("message batch never arrived")
+	}
+	select {
+	case c := <-chunks:
+		if c.ShardID != 1 || !bytes.Equal(c.Data, bytes.Repeat([]byte("snapshot"), 1000)) {
+			t.Errorf("received chunk of shard %d with %d bytes", c.ShardID, len(c.Data))
+		}
+	case <-ctx.Done():
+		t.Fatal("snapshot chunk never arrived")
+	}
+
+	resp, err := http.Get("http://" + addr + "/status")
+	if err != nil {
+		t.Fatalf("HTTP request on the shared port error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("HTTP response = %q, want ok", body)
+	}
+}
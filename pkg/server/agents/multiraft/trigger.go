@@ -0,0 +1,283 @@
+package multiraft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/epsniff/expodb/pkg/errdefs"
+	"github.com/epsniff/expodb/pkg/loggingutils"
+)
+
+// A trigger is a Go function run in the apply path on the rows written to the
+// tables it is attached to: it can compute columns of the row, by changing
+// the columns written, or reject the entry.  Triggers are compiled into the
+// binary and registered by name with Config.Triggers, a TableTrigger attaches
+// one to a table through raft.  Every replica runs them on every write, so
+// they have to be deterministic and every node has to register the same
+// ones: a replica applying an entry of a table whose trigger it doesn't know
+// fails rather than diverge.
+const (
+	// triggerPrefix keys the triggers attached to the tables, by table and
+	// trigger.
+	triggerPrefix string = "\x00trigger:"
+)
+
+var (
+	ErrTriggerRejected = errdefs.New(errdefs.ErrInvalid, "write rejected by a trigger")
+	// resultTriggerRejected starts the result data of entries a trigger
+	// rejects, see triggerResult.
+	resultTriggerRejected = []byte("trigger_rejected")
+)
+
+// TriggerFunc is a trigger, it returns an error to reject the entry writing
+// w.  It must depend on w alone: not on the clock, randomness or anything
+// outside the entry.
+type TriggerFunc func(w *TriggerWrite) error
+
+// TriggerWrite is a row written by an entry, as a trigger sees it.  Columns
+// are the columns the entry sets, that the trigger may change, Current the
+// row's before the entry (empty for a new row) and Replace is set when the
+// entry replaces the row.  Values of encrypted columns are sealed.
+type TriggerWrite struct {
+	Table   string
+	Row     string
+	Columns map[string]string
+	Current map[string]string
+	Replace bool
+	// Args are those of the TableTrigger.
+	Args map[string]string
+}
+
+// Merged returns the row as it will be after the entry, deleted columns
+// aside.
+func (w *TriggerWrite) Merged() map[string]string {
+	merged := map[string]string{}
+	if !w.Replace {
+		for col, val := range w.Current {
+			merged[col] = val
+		}
+	}
+	for col, val := range w.Columns {
+		merged[col] = val
+	}
+	return merged
+}
+
+// TableTrigger attaches the trigger registered as Name to Table, with Args.
+// A table's triggers run in name order, each seeing the columns the previous
+// one computed.
+type TableTrigger struct {
+	Table string            `json:"table"`
+	Name  string            `json:"name"`
+	Args  map[string]string `json:"args,omitempty"`
+}
+
+// TriggersQuery asks for the triggers of every table, by table and name.
+type TriggersQuery struct{}
+
+// Validate checks a trigger before it is proposed, whether it is registered
+// is checked by the proposer.
+func (t *TableTrigger) Validate() error {
+	if t.Table == "" {
+		return fmt.Errorf("trigger needs a table")
+	}
+	if !validIndexName(t.Name) {
+		return fmt.Errorf("trigger name %q isn't letters, digits, '_' and '-'", t.Name)
+	}
+	return nil
+}
+
+// TriggerError is returned for entries a trigger rejects.  It matches
+// ErrTriggerRejected with errors.Is.
+type TriggerError struct {
+	Table   string
+	Row     string
+	Trigger string
+	Reason  string
+}
+
+func (e *TriggerError) Error() string {
+	return fmt.Sprintf("trigger %s rejected row %s/%s: %s", e.Trigger, e.Table, loggingutils.Redact(e.Table, e.Row), e.Reason)
+}
+
+func (e *TriggerError) Unwrap() error { return ErrTriggerRejected }
+
+func triggerResult(v *TriggerError) []byte {
+	return bytes.Join([][]byte{resultTriggerRejected, []byte(v.Table), []byte(v.Row), []byte(v.Trigger), []byte(v.Reason)}, []byte{0})
+}
+
+func parseTriggerResult(data []byte) (*TriggerError, bool) {
+	parts := bytes.SplitN(data, []byte{0}, 5)
+	if len(parts) != 5 || !bytes.Equal(parts[0], resultTriggerRejected) {
+		return nil, false
+	}
+	return &TriggerError{Table: string(parts[1]), Row: string(parts[2]), Trigger: string(parts[3]), Reason: string(parts[4])}, true
+}
+
+func triggerKey(table, name string) []byte {
+	return appendEscaped(appendComponent([]byte(triggerPrefix), table), name)
+}
+
+func setTrigger(db *pebbledb, wb *pebble.Batch, t *TableTrigger) error {
+	buf, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	wb.Set(triggerKey(t.Table, t.Name), buf, db.wo)
+	return nil
+}
+
+func readTriggers(rd pebble.Reader, prefix []byte) ([]TableTrigger, error) {
+	iter := rd.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	var triggers []TableTrigger
+	for iter.First(); iter.Valid(); iter.Next() {
+		t := TableTrigger{}
+		if err := json.Unmarshal(iter.Value(), &t); err != nil {
+			iter.Close()
+			return nil, fmt.Errorf("decoding trigger %q: %w", iter.Key(), err)
+		}
+		triggers = append(triggers, t)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return triggers, nil
+}
+
+func (r *pebbledb) triggers() ([]TableTrigger, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil, fmt.Errorf("db already closed")
+	}
+	return readTriggers(r.db, []byte(triggerPrefix))
+}
+
+// triggeredRow is a row an entry writes, with the writes to it in entry
+// order.
+type triggeredRow struct {
+	table, row string
+	writes     []TxnWrite
+}
+
+// runTriggers runs the triggers of the rows an entry writes, and rewrites
+// the entry with the columns they leave, or returns the rejection of the
+// first one rejecting it.  Deletes don't run triggers.
+func runTriggers(wb *pebble.Batch, kv *KVData, registered map[string]TriggerFunc) (*TriggerError, error) {
+	var rows []*triggeredRow
+	switch kv.Op {
+	case OpSet, OpSetRow, OpReplaceRow:
+		rows = []*triggeredRow{{table: kv.Table, row: kv.Row, writes: entryWrites(kv)}}
+	case OpBatch, OpTxnPrepare:
+		byRow := map[string]*triggeredRow{}
+		for _, w := range kv.Writes {
+			key := string(encodeRowPrefix(w.Table, w.Row))
+			r, ok := byRow[key]
+			if !ok {
+				r = &triggeredRow{table: w.Table, row: w.Row}
+				byRow[key] = r
+				rows = append(rows, r)
+			}
+			r.writes = append(r.writes, w)
+		}
+	default:
+		return nil, nil
+	}
+
+	tables := map[string][]TableTrigger{}
+	rewritten := false
+	for _, r := range rows {
+		triggers, ok := tables[r.table]
+		if !ok {
+			var err error
+			if triggers, err = readTriggers(wb, appendComponent([]byte(triggerPrefix), r.table)); err != nil {
+				return nil, err
+			}
+			tables[r.table] = triggers
+		}
+		if len(triggers) == 0 {
+			continue
+		}
+		// the columns the writes leave set, and those they leave deleted.
+		columns, deleted := map[string]string{}, map[string]bool{}
+		for _, w := range r.writes {
+			if w.Delete {
+				delete(columns, w.Column)
+				deleted[w.Column] = true
+			} else {
+				columns[w.Column] = w.Val
+				delete(deleted, w.Column)
+			}
+		}
+		if len(columns) == 0 {
+			continue
+		}
+		current, _, err := readRow(wb, r.table, r.row)
+		if err != nil {
+			return nil, err
+		}
+		tw := &TriggerWrite{Table: r.table, Row: r.row, Columns: columns, Current: current, Replace: kv.Op == OpReplaceRow}
+		for _, t := range triggers {
+			fn, ok := registered[t.Name]
+			if !ok {
+				return nil, fmt.Errorf("table %s runs trigger %s, which isn't registered on this node: every node has to register the same triggers", t.Table, t.Name)
+			}
+			tw.Args = t.Args
+			if err := callTrigger(fn, tw); err != nil {
+				return &TriggerError{Table: r.table, Row: r.row, Trigger: t.Name, Reason: err.Error()}, nil
+			}
+		}
+		r.writes = r.writes[:0]
+		for col := range deleted {
+			r.writes = append(r.writes, TxnWrite{Table: r.table, Row: r.row, Column: col, Delete: true})
+		}
+		for col, val := range tw.Columns {
+			r.writes = append(r.writes, TxnWrite{Table: r.table, Row: r.row, Column: col, Val: val})
+		}
+		sort.Slice(r.writes, func(i, j int) bool {
+			if r.writes[i].Delete != r.writes[j].Delete {
+				return r.writes[i].Delete
+			}
+			return r.writes[i].Column < r.writes[j].Column
+		})
+		rewritten = true
+	}
+	if !rewritten {
+		return nil, nil
+	}
+
+	switch kv.Op {
+	case OpSet, OpSetRow, OpReplaceRow:
+		writes := rows[0].writes
+		if kv.Op == OpSet && len(writes) == 1 && writes[0].Column == kv.Column {
+			kv.Val = writes[0].Val
+			return nil, nil
+		}
+		if kv.Op == OpSet {
+			kv.Op, kv.Column, kv.Val = OpSetRow, "", ""
+		}
+		kv.Columns = make(map[string]string, len(writes))
+		for _, w := range writes {
+			kv.Columns[w.Column] = w.Val
+		}
+	default:
+		kv.Writes = kv.Writes[:0]
+		for _, r := range rows {
+			kv.Writes = append(kv.Writes, r.writes...)
+		}
+	}
+	return nil, nil
+}
+
+// callTrigger runs a trigger, a panic rejects the entry like an error.
+func callTrigger(fn TriggerFunc, w *TriggerWrite) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("trigger panicked: %v", r)
+		}
+	}()
+	return fn(w)
+}
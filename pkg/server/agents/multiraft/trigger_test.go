@@ -0,0 +1,109 @@
+package multiraft
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRunTriggers(t *testing.T) {
+	db := openTestDB(t, "triggers")
+	applyTestKV(t, db,
+		&KVData{Table: "users", Row: "a", Column: "first", Val: "ada"},
+		&KVData{Op: OpSetTrigger, Table: "users", Trigger: &TableTrigger{Table: "users", Name: "a-lower"}},
+		&KVData{Op: OpSetTrigger, Table: "users", Trigger: &TableTrigger{Table: "users", Name: "b-full", Args: map[string]string{"sep": " "}}},
+		&KVData{Op: OpSetTrigger, Table: "orders", Trigger: &TableTrigger{Table: "orders", Name: "missing"}},
+	)
+	registered := map[string]TriggerFunc{
+		"a-lower": func(w *TriggerWrite) error {
+			if v, ok := w.Columns["last"]; ok {
+				w.Columns["last"] = strings.ToLower(v)
+			}
+			if w.Columns["last"] == "bad" {
+				return fmt.Errorf("bad name")
+			}
+			if w.Columns["last"] == "panic" {
+				panic("boom")
+			}
+			return nil
+		},
+		// b-full runs after a-lower, on the columns it left.
+		"b-full": func(w *TriggerWrite) error {
+			row := w.Merged()
+			w.Columns["full"] = row["first"] + w.Args["sep"] + row["last"]
+			return nil
+		},
+	}
+	run := func(kv *KVData) (*TriggerError, error) {
+		t.Helper()
+		wb := db.db.NewIndexedBatch()
+		defer wb.Close()
+		return runTriggers(wb, kv, registered)
+	}
+
+	// a set computing another column becomes a row write, seeing the row.
+	kv := &KVData{Table: "users", Row: "a", Column: "last", Val: "LOVELACE"}
+	if rejected, err := run(kv); rejected != nil || err != nil {
+		t.Fatalf("runTriggers() = %v, %v", rejected, err)
+	}
+	if kv.Op != OpSetRow || len(kv.Columns) != 2 || kv.Columns["last"] != "lovelace" || kv.Columns["full"] != "ada lovelace" {
+		t.Errorf("triggered set = %+v, want last and full set", kv)
+	}
+
+	// a replace doesn't see the row it replaces.
+	kv = &KVData{Op: OpReplaceRow, Table: "users", Row: "a", Columns: map[string]string{"last": "Hopper"}}
+	if rejected, err := run(kv); rejected != nil || err != nil {
+		t.Fatalf("runTriggers() = %v, %v", rejected, err)
+	}
+	if kv.Columns["full"] != " hopper" {
+		t.Errorf("triggered replace = %+v, want full without the replaced first", kv.Columns)
+	}
+
+	// a batch keeps the deletes, rows of other tables are left alone.
+	kv = &KVData{Op: OpBatch, Writes: []TxnWrite{
+		{Table: "users", Row: "b", Column: "first", Val: "grace"},
+		{Table: "events", Row: "1", Column: "x", Val: "X"},
+		{Table: "users", Row: "b", Column: "nick", Delete: true},
+		{Table: "users", Row: "b", Column: "last", Val: "HOPPER"},
+	}}
+	if rejected, err := run(kv); rejected != nil || err != nil {
+		t.Fatalf("runTriggers() = %v, %v", rejected, err)
+	}
+	want := []TxnWrite{
+		{Table: "users", Row: "b", Column: "nick", Delete: true},
+		{Table: "users", Row: "b", Column: "first", Val: "grace"},
+		{Table: "users", Row: "b", Column: "full", Val: "grace hopper"},
+		{Table: "users", Row: "b", Column: "last", Val: "hopper"},
+		{Table: "events", Row: "1", Column: "x", Val: "X"},
+	}
+	if fmt.Sprint(kv.Writes) != fmt.Sprint(want) {
+		t.Errorf("triggered batch = %+v, want %+v", kv.Writes, want)
+	}
+
+	// errors and panics reject the entry, untouched.
+	for _, last := range []string{"bad", "panic"} {
+		kv = &KVData{Table: "users", Row: "a", Column: "last", Val: last}
+		rejected, err := run(kv)
+		if err != nil || rejected == nil || rejected.Trigger != "a-lower" || !errors.Is(rejected, ErrTriggerRejected) {
+			t.Errorf("runTriggers() of %s = %v, %v, want rejected by a-lower", last, rejected, err)
+		}
+		if got, ok := parseTriggerResult(triggerResult(rejected)); !ok || *got != *rejected {
+			t.Errorf("parseTriggerResult() = %+v, want %+v", got, rejected)
+		}
+	}
+
+	// deletes don't run triggers, an unregistered one fails the apply.
+	if rejected, err := run(&KVData{Op: OpDeleteRow, Table: "orders", Row: "1"}); rejected != nil || err != nil {
+		t.Errorf("runTriggers() of a delete = %v, %v", rejected, err)
+	}
+	if _, err := run(&KVData{Table: "orders", Row: "1", Column: "x", Val: "1"}); err == nil {
+		t.Error("runTriggers() with an unregistered trigger succeeded")
+	}
+
+	applyTestKV(t, db, &KVData{Op: OpDropTrigger, Table: "orders", Row: "missing"})
+	triggers, err := db.triggers()
+	if err != nil || len(triggers) != 2 || triggers[0].Name != "a-lower" || triggers[1].Args["sep"] != " " {
+		t.Errorf("triggers() = %+v, %v, want those of users", triggers, err)
+	}
+}
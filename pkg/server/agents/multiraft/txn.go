@@ -0,0 +1,219 @@
+package multiraft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/epsniff/expodb/pkg/loggingutils"
+)
+
+const (
+	// txnLockPrefix keys the lock a prepared transaction holds on a row, the
+	// rest of the key is the row's prefix and the value the transaction ID.
+	txnLockPrefix string = "\x00txn_lock:"
+	// txnIntentPrefix keys the writes of a prepared transaction by its ID.
+	txnIntentPrefix string = "\x00txn_intent:"
+)
+
+// TxnWrite is a single write of a transaction: a column set to Val, or
+// deleted when Delete is set.
+type TxnWrite struct {
+	Table  string `json:"table"`
+	Row    string `json:"key"`
+	Column string `json:"column"`
+	Val    string `json:"value,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+}
+
+// RowRead is a row the writes of an OpBatch were computed from, as it was at
+// Version, the raft index it was last modified at.  An absent row, never
+// written or deleted, is at 0: the batch applies if it is still absent.
+type RowRead struct {
+	Table   string `json:"table"`
+	Row     string `json:"key"`
+	Version uint64 `json:"version"`
+}
+
+// TxnIntentsQuery asks a shard for the IDs of the transactions it holds
+// prepared but not yet committed or aborted.
+type TxnIntentsQuery struct{}
+
+// TxnConflictError is returned for entries touching a row locked by a
+// prepared transaction.  It matches ErrTxnConflict with errors.Is.
+type TxnConflictError struct {
+	Table  string
+	Row    string
+	Holder string // the ID of the transaction holding the lock
+}
+
+func (e *TxnConflictError) Error() string {
+	return fmt.Sprintf("row %s/%s is locked by prepared transaction %s", e.Table, loggingutils.Redact(e.Table, e.Row), e.Holder)
+}
+
+func (e *TxnConflictError) Is(target error) bool {
+	return target == ErrTxnConflict
+}
+
+// conflictResult encodes a conflict as the result data of the entry.
+func conflictResult(c *TxnConflictError) []byte {
+	return bytes.Join([][]byte{resultTxnConflict, []byte(c.Table), []byte(c.Row), []byte(c.Holder)}, []byte{0})
+}
+
+// parseConflictResult decodes the result data written by conflictResult.
+func parseConflictResult(data []byte) (*TxnConflictError, bool) {
+	parts := bytes.SplitN(data, []byte{0}, 4)
+	if len(parts) != 4 || !bytes.Equal(parts[0], resultTxnConflict) {
+		return nil, false
+	}
+	return &TxnConflictError{Table: string(parts[1]), Row: string(parts[2]), Holder: string(parts[3])}, true
+}
+
+// prepareTxn locks the rows written by the transaction and stages its
+// writes.  It returns the conflict, leaving nothing behind, when another
+// transaction holds a lock on one of the rows.  Preparing the same
+// transaction twice is a no-op.
+func prepareTxn(db *pebbledb, wb *pebble.Batch, kv *KVData) (*TxnConflictError, error) {
+	intentKey := []byte(txnIntentPrefix + kv.Txn)
+	if _, closer, err := wb.Get(intentKey); err == nil {
+		closer.Close()
+		return nil, nil
+	} else if err != pebble.ErrNotFound {
+		return nil, err
+	}
+	for _, w := range kv.Writes {
+		holder, err := rowLockHolder(wb, w.Table, w.Row)
+		if err != nil {
+			return nil, err
+		}
+		if holder != "" && holder != kv.Txn {
+			return &TxnConflictError{Table: w.Table, Row: w.Row, Holder: holder}, nil
+		}
+	}
+	intent, err := json.Marshal(kv.Writes)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range kv.Writes {
+		wb.Set(txnLockKey(w.Table, w.Row), []byte(kv.Txn), db.wo)
+	}
+	wb.Set(intentKey, intent, db.wo)
+	return nil, reserveUnique(db, wb, kv)
+}
+
+// finishTxn commits (or with abort drops) the staged writes of a prepared
+// transaction and releases its locks.  Finishing a transaction this shard
+// never prepared, or already finished, is a no-op, so the coordinator and
+// recovery can both send it.
+func finishTxn(d *DiskKV, db *pebbledb, wb *pebble.Batch, kv *KVData, index uint64, abort bool) error {
+	intentKey := []byte(txnIntentPrefix + kv.Txn)
+	val, closer, err := wb.Get(intentKey)
+	if err == pebble.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var writes []TxnWrite
+	err = json.Unmarshal(val, &writes)
+	closer.Close()
+	if err != nil {
+		return fmt.Errorf("decoding intent of txn %s: %w", kv.Txn, err)
+	}
+	for _, w := range writes {
+		wb.Delete(txnLockKey(w.Table, w.Row), db.wo)
+	}
+	wb.Delete(intentKey, db.wo)
+	if err := releaseUnique(db, wb, kv.Txn); err != nil {
+		return err
+	}
+	if abort {
+		return nil
+	}
+	for _, w := range writes {
+		if err := d.applyKV(db, wb, w.kvData(), index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kvData returns the plain write entry applying w.
+func (w TxnWrite) kvData() *KVData {
+	kv := &KVData{Table: w.Table, Row: w.Row, Column: w.Column, Val: w.Val}
+	if w.Delete {
+		kv.Op = OpDelete
+	}
+	return kv
+}
+
+// checkTxnLocks returns the conflict when a plain write touches a row locked
+// by a prepared transaction.
+func checkTxnLocks(wb *pebble.Batch, kv *KVData) (*TxnConflictError, error) {
+	switch kv.Op {
+	case OpSet, OpDelete, OpDeleteRow, OpSetRow, OpReplaceRow, OpPurge:
+		holder, err := rowLockHolder(wb, kv.Table, kv.Row)
+		if err != nil || holder == "" {
+			return nil, err
+		}
+		return &TxnConflictError{Table: kv.Table, Row: kv.Row, Holder: holder}, nil
+	case OpBatch:
+		for _, w := range kv.Writes {
+			holder, err := rowLockHolder(wb, w.Table, w.Row)
+			if err != nil {
+				return nil, err
+			} else if holder != "" {
+				return &TxnConflictError{Table: w.Table, Row: w.Row, Holder: holder}, nil
+			}
+		}
+	case OpDeletePrefix, OpDeleteWhere, OpDeleteRange:
+		prefix := append([]byte(txnLockPrefix), encodeRowKeyPrefix(kv.Table, kv.Row)...)
+		bounds := &pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)}
+		if kv.Op == OpDeleteRange {
+			lower, upper := rowRange(kv.Table, kv.Row, kv.Val)
+			bounds.LowerBound = append([]byte(txnLockPrefix), lower...)
+			bounds.UpperBound = append([]byte(txnLockPrefix), upper...)
+		}
+		iter := wb.NewIter(bounds)
+		var conflict *TxnConflictError
+		if iter.First() {
+			// the lock key holds the row prefix, which decodes with an empty column.
+			table, row, _, _ := decodeKey(iter.Key()[len(txnLockPrefix):])
+			conflict = &TxnConflictError{Table: table, Row: row, Holder: string(iter.Value())}
+		}
+		return conflict, iter.Close()
+	}
+	return nil, nil
+}
+
+func txnLockKey(table, row string) []byte {
+	return append([]byte(txnLockPrefix), encodeRowPrefix(table, row)...)
+}
+
+func rowLockHolder(wb *pebble.Batch, table, row string) (string, error) {
+	val, closer, err := wb.Get(txnLockKey(table, row))
+	if err == pebble.ErrNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer closer.Close()
+	return string(val), nil
+}
+
+func (r *pebbledb) txnIntents() ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil, errors.New("db already closed")
+	}
+	prefix := []byte(txnIntentPrefix)
+	iter := r.db.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	var txns []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		txns = append(txns, strings.TrimPrefix(string(iter.Key()), txnIntentPrefix))
+	}
+	return txns, iter.Close()
+}
@@ -0,0 +1,56 @@
+package multiraft
+
+import (
+	"testing"
+)
+
+func TestTxn_PrepareConflictCommit(t *testing.T) {
+	db := openTestDB(t, "txn")
+	d := &DiskKV{}
+	wb := db.db.NewIndexedBatch()
+	defer wb.Close()
+
+	writes := []TxnWrite{
+		{Table: "accounts", Row: "a", Column: "balance", Val: "5"},
+		{Table: "accounts", Row: "b", Column: "balance", Delete: true},
+	}
+	if conflict, err := prepareTxn(db, wb, &KVData{Op: OpTxnPrepare, Txn: "t1", Writes: writes}); err != nil || conflict != nil {
+		t.Fatalf("prepareTxn(t1) = %+v, %v, want accepted", conflict, err)
+	}
+	other := []TxnWrite{{Table: "accounts", Row: "a", Column: "owner", Val: "x"}}
+	conflict, _ := prepareTxn(db, wb, &KVData{Op: OpTxnPrepare, Txn: "t2", Writes: other})
+	if conflict == nil || conflict.Holder != "t1" || conflict.Row != "a" {
+		t.Errorf("prepareTxn(t2) = %+v, want a conflict with t1 on row a", conflict)
+	}
+	if got, ok := parseConflictResult(conflictResult(conflict)); !ok || *got != *conflict {
+		t.Errorf("conflict result round trip = %+v, want %+v", got, conflict)
+	}
+	if conflict, _ := checkTxnLocks(wb, &KVData{Table: "accounts", Row: "a", Column: "balance"}); conflict == nil {
+		t.Errorf("plain write to a locked row was let through")
+	}
+	if conflict, _ := checkTxnLocks(wb, &KVData{Op: OpDeletePrefix, Table: "accounts", Row: ""}); conflict == nil || conflict.Row != "a" {
+		t.Errorf("delete by prefix over a locked row = %+v, want a conflict on row a", conflict)
+	}
+	if _, _, err := wb.Get(encodeKey("accounts", "a", "balance")); err == nil {
+		t.Errorf("prepared write visible before commit")
+	}
+
+	if err := finishTxn(d, db, wb, &KVData{Op: OpTxnCommit, Txn: "t1"}, 10, false); err != nil {
+		t.Fatalf("finishTxn(commit) error = %v", err)
+	}
+	val, closer, err := wb.Get(encodeKey("accounts", "a", "balance"))
+	if err != nil || string(val) != "5" {
+		t.Fatalf("committed write = %q, %v, want 5", val, err)
+	}
+	closer.Close()
+	if version, _ := rowVersion(wb, "accounts", "a"); version != 10 {
+		t.Errorf("row version = %d, want the commit index 10", version)
+	}
+	if conflict, _ := checkTxnLocks(wb, &KVData{Table: "accounts", Row: "a", Column: "balance"}); conflict != nil {
+		t.Errorf("row still locked after commit")
+	}
+	// finishing again, e.g. from recovery, is a no-op.
+	if err := finishTxn(d, db, wb, &KVData{Op: OpTxnAbort, Txn: "t1"}, 11, true); err != nil {
+		t.Errorf("finishTxn(abort) after commit error = %v", err)
+	}
+}
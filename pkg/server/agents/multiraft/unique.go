@@ -0,0 +1,323 @@
+package multiraft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/epsniff/expodb/pkg/errdefs"
+	"github.com/epsniff/expodb/pkg/loggingutils"
+)
+
+// Unique indexes hold a value (the values of their columns) for at most one
+// row.  Entries that would give a value to a second row are rejected before
+// anything of them is applied, like those failing IfMatch.  A prepared
+// transaction reserves the values its writes give rows until it finishes,
+// so the commit can't fail on them.
+const (
+	// txnUniquePrefix keys the unique values reserved by prepared
+	// transactions, the rest of the key is the value's index key prefix and
+	// the value the transaction ID.
+	txnUniquePrefix string = "\x00txn_unique:"
+	// txnUniqueOfPrefix keys the values a transaction reserved, by its ID.
+	txnUniqueOfPrefix string = "\x00txn_unique_of:"
+)
+
+var (
+	ErrUniqueViolation = errdefs.New(errdefs.ErrConflict, "value is held by another row of a unique index")
+	// resultUniqueViolation starts the result data of entries violating a
+	// unique index, see violationResult.
+	resultUniqueViolation = []byte("unique_violation")
+)
+
+// UniqueViolationError is returned for entries giving a row the value
+// another row holds in a unique index.  It matches ErrUniqueViolation with
+// errors.Is.
+type UniqueViolationError struct {
+	Table  string
+	Index  string
+	Row    string
+	Holder string // the row holding the value
+}
+
+func (e *UniqueViolationError) Error() string {
+	return fmt.Sprintf("row %s/%s violates unique index %s: row %s holds the value", e.Table, loggingutils.Redact(e.Table, e.Row), e.Index, loggingutils.Redact(e.Table, e.Holder))
+}
+
+func (e *UniqueViolationError) Unwrap() error { return ErrUniqueViolation }
+
+func violationResult(v *UniqueViolationError) []byte {
+	return bytes.Join([][]byte{resultUniqueViolation, []byte(v.Table), []byte(v.Index), []byte(v.Row), []byte(v.Holder)}, []byte{0})
+}
+
+func parseViolationResult(data []byte) (*UniqueViolationError, bool) {
+	parts := bytes.SplitN(data, []byte{0}, 5)
+	if len(parts) != 5 || !bytes.Equal(parts[0], resultUniqueViolation) {
+		return nil, false
+	}
+	return &UniqueViolationError{Table: string(parts[1]), Index: string(parts[2]), Row: string(parts[3]), Holder: string(parts[4])}, true
+}
+
+// constrainedQuery asks whether one of the tables has a unique index or a
+// schema, the writes to those have to wait for the apply to learn if they
+// were taken.
+type constrainedQuery struct {
+	tables []string
+}
+
+func (r *pebbledb) hasConstraints(tables []string) (bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return false, fmt.Errorf("db already closed")
+	}
+	for _, table := range tables {
+		if schema, err := readSchema(r.db, table); err != nil || schema != nil {
+			return schema != nil, err
+		}
+		defs, err := tableIndexes(r.db, table)
+		if err != nil {
+			return false, err
+		}
+		for _, def := range defs {
+			if def.Unique {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// writtenTables returns the tables an entry writes rows of.
+func writtenTables(kv *KVData) []string {
+	switch kv.Op {
+	case OpSet, OpSetRow, OpReplaceRow:
+		return []string{kv.Table}
+	case OpBatch, OpTxnPrepare:
+		var tables []string
+		seen := map[string]bool{}
+		for _, w := range kv.Writes {
+			if !seen[w.Table] {
+				seen[w.Table] = true
+				tables = append(tables, w.Table)
+			}
+		}
+		return tables
+	}
+	return nil
+}
+
+// entryWrites returns the column writes of an entry giving rows values, in
+// the order it writes them.
+func entryWrites(kv *KVData) []TxnWrite {
+	switch kv.Op {
+	case OpSet:
+		return []TxnWrite{{Table: kv.Table, Row: kv.Row, Column: kv.Column, Val: kv.Val}}
+	case OpSetRow, OpReplaceRow:
+		columns := make([]string, 0, len(kv.Columns))
+		for c := range kv.Columns {
+			columns = append(columns, c)
+		}
+		sort.Strings(columns)
+		writes := make([]TxnWrite, 0, len(columns))
+		for _, c := range columns {
+			writes = append(writes, TxnWrite{Table: kv.Table, Row: kv.Row, Column: c, Val: kv.Columns[c]})
+		}
+		return writes
+	case OpBatch, OpTxnPrepare:
+		return kv.Writes
+	}
+	return nil
+}
+
+// uniqueRow is a row an entry writes, with the columns of its table's
+// unique indexes as they will be after the entry.
+type uniqueRow struct {
+	table, row string
+	defs       []IndexDef
+	columns    map[string]string
+}
+
+// uniqueValue is a value a row will hold in a unique index.
+type uniqueValue struct {
+	def    *IndexDef
+	row    *uniqueRow
+	prefix []byte // the index key prefix of the value
+}
+
+// checkUnique returns the violation when the entry would give a row a value
+// another row holds in a unique index, or one reserved by a transaction.
+// Deletes never violate one.
+func checkUnique(wb *pebble.Batch, kv *KVData) (*UniqueViolationError, *TxnConflictError, error) {
+	if kv.Op == OpCreateIndex {
+		if kv.IndexDef == nil || !kv.IndexDef.Unique {
+			return nil, nil, nil
+		}
+		v, err := duplicateValue(wb, kv.IndexDef)
+		return v, nil, err
+	}
+	values, err := uniqueValues(wb, kv)
+	if err != nil || len(values) == 0 {
+		return nil, nil, err
+	}
+	// the rows the entry writes will hold these values, their current
+	// entries don't count.
+	written := map[string]bool{}
+	for _, v := range values {
+		written[v.row.table+"\x00"+v.row.row] = true
+	}
+	taken := map[string]*uniqueRow{}
+	for _, v := range values {
+		if other, ok := taken[string(v.prefix)]; ok && other != v.row {
+			return &UniqueViolationError{Table: v.row.table, Index: v.def.Name, Row: v.row.row, Holder: other.row}, nil, nil
+		}
+		taken[string(v.prefix)] = v.row
+		if holder, err := reservedBy(wb, v.prefix); err != nil {
+			return nil, nil, err
+		} else if holder != "" && holder != kv.Txn {
+			return nil, &TxnConflictError{Table: v.row.table, Row: v.row.row, Holder: holder}, nil
+		}
+		iter := wb.NewIter(&pebble.IterOptions{LowerBound: v.prefix, UpperBound: prefixUpperBound(v.prefix)})
+		var holder string
+		for iter.First(); iter.Valid() && holder == ""; iter.Next() {
+			row, ok := decodeIndexRow(iter.Key(), len(v.def.Columns))
+			if ok && row != v.row.row && !written[v.row.table+"\x00"+row] {
+				holder = row
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return nil, nil, err
+		}
+		if holder != "" {
+			return &UniqueViolationError{Table: v.row.table, Index: v.def.Name, Row: v.row.row, Holder: holder}, nil, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// uniqueValues returns the values the rows an entry writes will hold in
+// unique indexes, in the order the entry writes them.
+func uniqueValues(wb *pebble.Batch, kv *KVData) ([]uniqueValue, error) {
+	writes := entryWrites(kv)
+	defsOf := map[string][]IndexDef{}
+	rows := map[string]*uniqueRow{}
+	var order []*uniqueRow
+	for _, w := range writes {
+		defs, ok := defsOf[w.Table]
+		if !ok {
+			all, err := tableIndexes(wb, w.Table)
+			if err != nil {
+				return nil, err
+			}
+			for _, def := range all {
+				if def.Unique {
+					defs = append(defs, def)
+				}
+			}
+			defsOf[w.Table] = defs
+		}
+		if len(defs) == 0 {
+			continue
+		}
+		row, ok := rows[w.Table+"\x00"+w.Row]
+		if !ok {
+			row = &uniqueRow{table: w.Table, row: w.Row, defs: defs, columns: map[string]string{}}
+			if kv.Op != OpReplaceRow {
+				columns, err := indexedColumns(wb, w.Table, w.Row, defs)
+				if err != nil {
+					return nil, err
+				}
+				row.columns = columns
+			}
+			rows[w.Table+"\x00"+w.Row] = row
+			order = append(order, row)
+		}
+		if w.Delete {
+			delete(row.columns, w.Column)
+		} else {
+			row.columns[w.Column] = w.Val
+		}
+	}
+	var values []uniqueValue
+	for _, row := range order {
+		for i := range row.defs {
+			if prefix := row.defs[i].valuesPrefix(row.columns); prefix != nil {
+				values = append(values, uniqueValue{def: &row.defs[i], row: row, prefix: prefix})
+			}
+		}
+	}
+	return values, nil
+}
+
+// duplicateValue returns a violation when two rows of the table hold the
+// same value of an index being created unique.
+func duplicateValue(wb *pebble.Batch, def *IndexDef) (*UniqueViolationError, error) {
+	holders := map[string]string{}
+	var violation *UniqueViolationError
+	err := eachRow(wb, def.Table, func(row string, columns map[string]string) {
+		prefix := def.valuesPrefix(columns)
+		if prefix == nil || violation != nil {
+			return
+		}
+		if holder, ok := holders[string(prefix)]; ok {
+			violation = &UniqueViolationError{Table: def.Table, Index: def.Name, Row: row, Holder: holder}
+		}
+		holders[string(prefix)] = row
+	})
+	return violation, err
+}
+
+func reservedBy(wb *pebble.Batch, prefix []byte) (string, error) {
+	val, closer, err := wb.Get(append([]byte(txnUniquePrefix), prefix...))
+	if err == pebble.ErrNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer closer.Close()
+	return string(val), nil
+}
+
+// reserveUnique reserves the unique values of a transaction being prepared.
+func reserveUnique(db *pebbledb, wb *pebble.Batch, kv *KVData) error {
+	values, err := uniqueValues(wb, kv)
+	if err != nil || len(values) == 0 {
+		return err
+	}
+	var reserved [][]byte
+	for _, v := range values {
+		key := append([]byte(txnUniquePrefix), v.prefix...)
+		wb.Set(key, []byte(kv.Txn), db.wo)
+		reserved = append(reserved, key)
+	}
+	buf, err := json.Marshal(reserved)
+	if err != nil {
+		return err
+	}
+	wb.Set([]byte(txnUniqueOfPrefix+kv.Txn), buf, db.wo)
+	return nil
+}
+
+// releaseUnique drops the reservations of a finished transaction.
+func releaseUnique(db *pebbledb, wb *pebble.Batch, txn string) error {
+	key := []byte(txnUniqueOfPrefix + txn)
+	val, closer, err := wb.Get(key)
+	if err == pebble.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var reserved [][]byte
+	err = json.Unmarshal(val, &reserved)
+	closer.Close()
+	if err != nil {
+		return fmt.Errorf("decoding unique reservations of txn %s: %w", txn, err)
+	}
+	for _, k := range reserved {
+		wb.Delete(k, db.wo)
+	}
+	wb.Delete(key, db.wo)
+	return nil
+}
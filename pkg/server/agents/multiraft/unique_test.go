@@ -0,0 +1,80 @@
+package multiraft
+
+import (
+	"testing"
+)
+
+func TestCheckUnique(t *testing.T) {
+	db := openTestDB(t, "unique")
+	applyTestKV(t, db,
+		&KVData{Op: OpSetRow, Table: "users", Row: "a", Columns: map[string]string{"email": "a@x", "name": "ann"}},
+		&KVData{Op: OpCreateIndex, IndexDef: &IndexDef{Table: "users", Name: "by_email", Columns: []string{"email"}, Unique: true}},
+	)
+	wb := db.db.NewIndexedBatch()
+	defer wb.Close()
+
+	tests := []struct {
+		name string
+		kv   *KVData
+		want string // the row holding the value, "" when accepted
+	}{
+		{"taken", &KVData{Table: "users", Row: "b", Column: "email", Val: "a@x"}, "a"},
+		{"free", &KVData{Table: "users", Row: "b", Column: "email", Val: "b@x"}, ""},
+		{"own value", &KVData{Op: OpSetRow, Table: "users", Row: "a", Columns: map[string]string{"email": "a@x", "name": "al"}}, ""},
+		{"other columns", &KVData{Table: "users", Row: "b", Column: "name", Val: "ann"}, ""},
+		{"swapped in one batch", &KVData{Op: OpBatch, Writes: []TxnWrite{
+			{Table: "users", Row: "a", Column: "email", Val: "c@x"},
+			{Table: "users", Row: "b", Column: "email", Val: "a@x"},
+		}}, ""},
+		{"twice in one batch", &KVData{Op: OpBatch, Writes: []TxnWrite{
+			{Table: "users", Row: "b", Column: "email", Val: "c@x"},
+			{Table: "users", Row: "c", Column: "email", Val: "c@x"},
+		}}, "b"},
+		{"unique over distinct values", &KVData{Op: OpCreateIndex, IndexDef: &IndexDef{Table: "users", Name: "by_name", Columns: []string{"name"}, Unique: true}}, ""},
+	}
+	for _, tt := range tests {
+		violation, conflict, err := checkUnique(wb, tt.kv)
+		if err != nil || conflict != nil {
+			t.Fatalf("%s: checkUnique() = %v, %v", tt.name, conflict, err)
+		}
+		got := ""
+		if violation != nil {
+			got = violation.Holder
+		}
+		if got != tt.want {
+			t.Errorf("%s: checkUnique() = %+v, want held by %q", tt.name, violation, tt.want)
+		}
+	}
+
+	applyTestKV(t, db, &KVData{Table: "users", Row: "b", Column: "name", Val: "ann"})
+	if violation, _, _ := checkUnique(wb, &KVData{Op: OpCreateIndex, IndexDef: &IndexDef{Table: "users", Name: "by_name", Columns: []string{"name"}, Unique: true}}); violation == nil {
+		t.Errorf("unique index created over duplicate values")
+	}
+	if got, ok := parseViolationResult(violationResult(&UniqueViolationError{Table: "t", Index: "i", Row: "r", Holder: "h"})); !ok || got.Holder != "h" {
+		t.Errorf("violation result round trip = %+v", got)
+	}
+}
+
+func TestCheckUnique_Txn(t *testing.T) {
+	db := openTestDB(t, "unique-txn")
+	applyTestKV(t, db, &KVData{Op: OpCreateIndex, IndexDef: &IndexDef{Table: "users", Name: "by_email", Columns: []string{"email"}, Unique: true}})
+	d := &DiskKV{}
+	wb := db.db.NewIndexedBatch()
+	defer wb.Close()
+
+	prepare := &KVData{Op: OpTxnPrepare, Txn: "t1", Writes: []TxnWrite{{Table: "users", Row: "a", Column: "email", Val: "a@x"}}}
+	if _, err := prepareTxn(db, wb, prepare); err != nil {
+		t.Fatal(err)
+	}
+	// the value is reserved until the transaction finishes.
+	write := &KVData{Table: "users", Row: "b", Column: "email", Val: "a@x"}
+	if _, conflict, _ := checkUnique(wb, write); conflict == nil || conflict.Holder != "t1" {
+		t.Errorf("write of a reserved value = %+v, want a conflict with t1", conflict)
+	}
+	if err := finishTxn(d, db, wb, &KVData{Op: OpTxnAbort, Txn: "t1"}, 5, true); err != nil {
+		t.Fatal(err)
+	}
+	if violation, conflict, _ := checkUnique(wb, write); violation != nil || conflict != nil {
+		t.Errorf("write after abort = %+v, %+v, want accepted", violation, conflict)
+	}
+}
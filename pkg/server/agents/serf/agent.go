@@ -3,8 +3,10 @@ package serf
 import (
 	"fmt"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/epsniff/expodb/pkg/config"
 	"github.com/hashicorp/serf/serf"
@@ -16,6 +18,9 @@ import (
 // 	serverSerfCheckTimeout  = 3 * time.Second
 // )
 
+// defaultEventQueueDepth is used when the config leaves the depth unset.
+const defaultEventQueueDepth = 64
+
 // EventHandler is a handler that does things when events happen.
 type EventHandler interface {
 	HandleEvent(serf.Event)
@@ -38,6 +43,9 @@ type Agent struct {
 
 	logger *zap.Logger
 
+	// superseded counts the member events dropped by batchEvents.
+	superseded atomic.Uint64
+
 	// This is the underlying Serf we are wrapping
 	serf *serf.Serf
 
@@ -52,7 +60,11 @@ func New(config *config.Config, logger *zap.Logger) (*Agent, error) {
 	snapshotPath := path.Join(config.SerfDataDir, "serf_snapshot.serf")
 
 	// Create a channel to listen for events from Serf
-	eventCh := make(chan serf.Event, 64)
+	depth := config.SerfEventQueueDepth
+	if depth <= 0 {
+		depth = defaultEventQueueDepth
+	}
+	eventCh := make(chan serf.Event, depth)
 	conf, err := createSerfConfig(config, logger, eventCh, snapshotPath)
 	if err != nil {
 		return nil, fmt.Errorf("creating serf config for agent failed: err;%v", err)
@@ -194,6 +206,22 @@ func (a *Agent) Query(name string, payload []byte, params *serf.QueryParam) (*se
 	return resp, err
 }
 
+// SetTags merges tags into the local member's tags and gossips the change.
+func (a *Agent) SetTags(tags map[string]string) error {
+	merged := map[string]string{}
+	for k, v := range a.serf.LocalMember().Tags {
+		merged[k] = v
+	}
+	for k, v := range tags {
+		merged[k] = v
+	}
+	if err := a.serf.SetTags(merged); err != nil {
+		a.logger.Warn("failed to update tags", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
 // RegisterEventHandler adds an event handler to receive event notifications
 func (a *Agent) RegisterEventHandler(eh EventHandler) {
 	a.eventHandlersLock.Lock()
@@ -225,12 +253,31 @@ func (a *Agent) eventLoop() {
 	for {
 		select {
 		case e := <-a.eventCh:
-			a.logger.Info("Received event", zap.String("event", e.String()))
+			// handle what queued up meanwhile in one go, so a flood of
+			// member events doesn't run the handlers once per event.
+			events := []serf.Event{e}
+		drain:
+			for len(events) < cap(a.eventCh) {
+				select {
+				case e := <-a.eventCh:
+					events = append(events, e)
+				default:
+					break drain
+				}
+			}
+			batched, superseded := batchEvents(events)
+			if superseded > 0 {
+				a.superseded.Add(uint64(superseded))
+				a.logger.Info("Batched queued member events", zap.Int("events", len(events)), zap.Int("superseded", superseded))
+			}
 			a.eventHandlersLock.Lock()
 			handlers := a.eventHandlerList
 			a.eventHandlersLock.Unlock()
-			for _, eh := range handlers {
-				eh.HandleEvent(e)
+			for _, e := range batched {
+				a.logger.Info("Received event", zap.String("event", e.String()))
+				for _, eh := range handlers {
+					eh.HandleEvent(e)
+				}
 			}
 
 		case <-serfShutdownCh:
@@ -244,6 +291,45 @@ func (a *Agent) eventLoop() {
 	}
 }
 
+// batchEvents merges consecutive member events of the same type into one.
+// Within a merged event only the latest state of each member is kept, the
+// others are counted as superseded.  Events of different types keep their
+// order.
+func batchEvents(events []serf.Event) ([]serf.Event, int) {
+	var batched []serf.Event
+	superseded := 0
+	for _, e := range events {
+		me, ok := e.(serf.MemberEvent)
+		if !ok {
+			batched = append(batched, e)
+			continue
+		}
+		if n := len(batched); n > 0 {
+			if prev, ok := batched[n-1].(serf.MemberEvent); ok && prev.Type == me.Type {
+				for _, m := range me.Members {
+					replaced := false
+					for i := range prev.Members {
+						if prev.Members[i].Name == m.Name {
+							prev.Members[i] = m
+							replaced = true
+							superseded++
+							break
+						}
+					}
+					if !replaced {
+						prev.Members = append(prev.Members, m)
+					}
+				}
+				batched[n-1] = prev
+				continue
+			}
+		}
+		me.Members = append([]serf.Member(nil), me.Members...)
+		batched = append(batched, me)
+	}
+	return batched, superseded
+}
+
 // Stats is used to get various runtime information and stats
 func (a *Agent) Stats() map[string]map[string]string {
 	local := a.serf.LocalMember()
@@ -253,8 +339,12 @@ func (a *Agent) Stats() map[string]map[string]string {
 		"agent": {
 			"name": local.Name,
 		},
-		"serf":           a.serf.Stats(),
-		"tags":           local.Tags,
+		"serf": a.serf.Stats(),
+		"tags": local.Tags,
+		"events": {
+			"superseded": strconv.FormatUint(a.superseded.Load(), 10),
+			"queued":     strconv.Itoa(len(a.eventCh)),
+		},
 		"event_handlers": event_handlers,
 	}
 	return output
@@ -0,0 +1,38 @@
+package serf
+
+import (
+	"testing"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+func TestBatchEvents(t *testing.T) {
+	member := func(name, ver string) serf.Member {
+		return serf.Member{Name: name, Tags: map[string]string{"ver": ver}}
+	}
+	events := []serf.Event{
+		serf.MemberEvent{Type: serf.EventMemberJoin, Members: []serf.Member{member("node-1", "1")}},
+		serf.MemberEvent{Type: serf.EventMemberJoin, Members: []serf.Member{member("node-2", "1"), member("node-1", "2")}},
+		serf.UserEvent{Name: "expodb-demote"},
+		serf.MemberEvent{Type: serf.EventMemberUpdate, Members: []serf.Member{member("node-2", "2")}},
+		serf.MemberEvent{Type: serf.EventMemberFailed, Members: []serf.Member{member("node-2", "2")}},
+	}
+	batched, superseded := batchEvents(events)
+	if superseded != 1 {
+		t.Errorf("batchEvents() superseded %d, want 1", superseded)
+	}
+	if len(batched) != 4 {
+		t.Fatalf("batchEvents() = %d events, want 4: %v", len(batched), batched)
+	}
+	joins := batched[0].(serf.MemberEvent)
+	if joins.Type != serf.EventMemberJoin || len(joins.Members) != 2 || joins.Members[0].Tags["ver"] != "2" {
+		t.Errorf("merged joins = %+v, want node-1 at ver 2 and node-2", joins)
+	}
+	if _, ok := batched[1].(serf.UserEvent); !ok {
+		t.Errorf("batched[1] = %v, want the user event in order", batched[1])
+	}
+	// the first event's members aren't modified in place.
+	if len(events[0].(serf.MemberEvent).Members) != 1 {
+		t.Errorf("batchEvents() changed the queued event")
+	}
+}
@@ -1,10 +1,12 @@
 package serf
 
 import (
+	"fmt"
 	"strconv"
 	"time"
 
 	"github.com/epsniff/expodb/pkg/config"
+	"github.com/epsniff/expodb/pkg/joinauth"
 	"github.com/epsniff/expodb/pkg/version"
 	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/serf/serf"
@@ -33,6 +35,25 @@ func createSerfConfig(config *config.Config, logger *zap.Logger, ch chan serf.Ev
 	serfConfig.SnapshotPath = snapshotPath
 	serfConfig.CoalescePeriod = 3 * time.Second
 	serfConfig.QuiescentPeriod = time.Second
+	// configs built by hand (embedders, tests) keep the defaults.
+	if config.SerfCoalescePeriod > 0 {
+		serfConfig.CoalescePeriod = config.SerfCoalescePeriod
+	}
+	if config.SerfQuiescentPeriod > 0 {
+		serfConfig.QuiescentPeriod = config.SerfQuiescentPeriod
+	}
+	if config.SerfMaxQueueDepth > 0 {
+		serfConfig.MaxQueueDepth = config.SerfMaxQueueDepth
+	}
+	if config.SerfReapInterval > 0 {
+		serfConfig.ReapInterval = config.SerfReapInterval
+	}
+	if config.SerfReconnectTimeout > 0 {
+		serfConfig.ReconnectTimeout = config.SerfReconnectTimeout
+	}
+	if config.SerfTombstoneTimeout > 0 {
+		serfConfig.TombstoneTimeout = config.SerfTombstoneTimeout
+	}
 	serfConfig.Logger = zap.NewStdLog(logger)
 	serfConfig.MemberlistConfig.LogOutput = nil
 	serfConfig.LogOutput = nil
@@ -54,11 +75,30 @@ func createSerfConfig(config *config.Config, logger *zap.Logger, ch chan serf.Ev
 
 	serfConfig.NodeName = config.NodeName
 	serfConfig.Tags["role"] = "expodb"
+	serfConfig.Tags["node_role"] = "voter"
+	if config.IsWitness() {
+		serfConfig.Tags["node_role"] = "witness"
+	}
+	if config.ClusterID != "" {
+		serfConfig.Tags["cluster_id"] = config.ClusterID
+	}
+	if config.Zone != "" {
+		serfConfig.Tags["zone"] = config.Zone
+	}
+	if config.CompressRPC() {
+		serfConfig.Tags["rpc_compression"] = config.RPCCompression
+	}
+	if config.NoAutopilotDemote {
+		serfConfig.Tags["no_demote"] = "1"
+	}
 	//serfConfig.Tags["region"] = s.config.Region
 	//serfConfig.Tags["dc"] = s.config.Datacenter
-	serfConfig.Tags["ver"] = version.ServerVersion
-	//serfConfig.Tags["build"] = s.config.Build
-	//serfConfig.Tags["raft_vsn"] = fmt.Sprintf("%d", s.config.RaftConfig.ProtocolVersion)
+	build := version.Get()
+	serfConfig.Tags["ver"] = build.Version
+	if build.GitCommit != "" {
+		serfConfig.Tags["build"] = build.GitCommit
+	}
+	serfConfig.Tags["fsm_vsn"] = strconv.Itoa(build.FSMProtocol)
 	serfConfig.Tags["id"] = config.ID()
 	serfConfig.Tags["http_addr"] = config.HTTPBindAddress
 	serfConfig.Tags["http_port"] = strconv.Itoa(config.HTTPBindPort)
@@ -71,6 +111,11 @@ func createSerfConfig(config *config.Config, logger *zap.Logger, ch chan serf.Ev
 	if config.Bootstrap {
 		serfConfig.Tags["bootstrap"] = "1"
 	}
+	if config.JoinToken != "" {
+		raftAddr := fmt.Sprintf("%s:%d", config.RaftBindAddress, config.RaftBindPort)
+		serfConfig.Tags["join_token_id"] = joinauth.TokenID(config.JoinToken)
+		serfConfig.Tags["join_proof"] = joinauth.Proof(config.JoinToken, config.ID(), raftAddr)
+	}
 	// TODO add support so the leader can determine when to add new members to raft as
 	// a voting member.  Currently all new members are added to raft too.
 	// if s.config.NonVoter {
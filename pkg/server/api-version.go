@@ -0,0 +1,29 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/epsniff/expodb/pkg/version"
+	"github.com/justinas/alice"
+)
+
+// apiVersion prefixes the versioned API paths.  Breaking changes to request
+// or response shapes go in a new version, the previous one is served until
+// it is retired.
+const apiVersion = "/" + version.APIVersion
+
+// handleVersioned routes pattern under apiVersion, and unversioned too for the
+// clients from before there were versions.  Those are answered with a
+// Deprecation header and a Link to the versioned path.
+func (rt *router) handleVersioned(method, pattern string, h http.HandlerFunc, middleware ...alice.Constructor) {
+	rt.handle(method, apiVersion+pattern, h, middleware...)
+	rt.handle(method, pattern, h, append([]alice.Constructor{deprecated}, middleware...)...)
+}
+
+func deprecated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Add("Link", "<"+apiVersion+r.URL.EscapedPath()+`>; rel="successor-version"`)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouter_HandleVersioned(t *testing.T) {
+	rt := newRouter()
+	rt.handleVersioned(http.MethodPost, "/txn/*", func(w http.ResponseWriter, r *http.Request) {})
+
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/txn/_begin", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Deprecation") != "" {
+		t.Errorf("versioned path: status %d, Deprecation %q", w.Code, w.Header().Get("Deprecation"))
+	}
+
+	w = httptest.NewRecorder()
+	rt.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/txn/_begin", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Deprecation") != "true" {
+		t.Errorf("unversioned path: status %d, Deprecation %q", w.Code, w.Header().Get("Deprecation"))
+	}
+	if link := w.Header().Get("Link"); link != `</v1/txn/_begin>; rel="successor-version"` {
+		t.Errorf("unversioned path: Link %q", link)
+	}
+}
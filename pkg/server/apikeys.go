@@ -0,0 +1,362 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/errdefs"
+	machines "github.com/epsniff/expodb/pkg/server/state-machines"
+	"github.com/epsniff/expodb/pkg/server/state-machines/apikeys"
+	"go.uber.org/zap"
+)
+
+const (
+	// apiKeyPrefix starts the bearer tokens of API keys, "xk_<name>.<secret>",
+	// so they are told apart from the auth policy's tokens and JWTs.
+	apiKeyPrefix = "xk_"
+	// apiKeyUsageInterval is how often each node replicates the usage of the
+	// keys it served.
+	apiKeyUsageInterval = 10 * time.Second
+)
+
+var errQuotaExceeded = errors.New("api key quota exceeded")
+
+// apiKeyUsage is the usage of the API keys served by this node, not
+// replicated yet, and their rate limits.
+type apiKeyUsage struct {
+	mu      sync.Mutex
+	pending map[string]apikeys.Usage
+	buckets map[string]*tokenBucket
+}
+
+// tokenBucket allows burst requests at once and rate a second on average.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token from the bucket of key, it returns false and how long
+// until the next token when there is none.
+func (u *apiKeyUsage) take(key *apikeys.Key, now time.Time) (bool, time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.pending == nil {
+		u.pending, u.buckets = map[string]apikeys.Usage{}, map[string]*tokenBucket{}
+	}
+	usage := u.pending[key.Name]
+	defer func() { u.pending[key.Name] = usage }()
+	if key.Rate <= 0 {
+		usage.Requests++
+		return true, 0
+	}
+	burst := float64(key.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	b, ok := u.buckets[key.Name]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		u.buckets[key.Name] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * key.Rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / key.Rate * float64(time.Second))
+	}
+	b.tokens--
+	usage.Requests++
+	return true, 0
+}
+
+// overQuota returns errQuotaExceeded once the bytes key wrote, replicated
+// or served by this node since, reach its quota.  Only writes already made
+// count, a write under the quota is let through whatever its size.
+//
+// The quota is soft: every node checks the replicated usage plus its own,
+// not the other nodes' usage it hasn't heard of yet.  A key writing to N
+// nodes can go past its quota by what those nodes let through within an
+// apiKeyUsageInterval, at most N times what was left of it, plus a write.
+func (u *apiKeyUsage) overQuota(key *apikeys.Key) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if key.QuotaBytes > 0 && key.Usage.BytesWritten+u.pending[key.Name].BytesWritten >= key.QuotaBytes {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// wrote counts bytes written by key.
+func (u *apiKeyUsage) wrote(key *apikeys.Key, bytes int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.pending == nil {
+		u.pending, u.buckets = map[string]apikeys.Usage{}, map[string]*tokenBucket{}
+	}
+	usage := u.pending[key.Name]
+	usage.BytesWritten += bytes
+	u.pending[key.Name] = usage
+}
+
+// flush returns the usage not replicated yet and forgets it.
+func (u *apiKeyUsage) flush() map[string]apikeys.Usage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	pending := u.pending
+	u.pending = map[string]apikeys.Usage{}
+	return pending
+}
+
+// restore adds back usage that failed to replicate.
+func (u *apiKeyUsage) restore(usage map[string]apikeys.Usage) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for name, use := range usage {
+		pending := u.pending[name]
+		pending.Requests += use.Requests
+		pending.BytesWritten += use.BytesWritten
+		u.pending[name] = pending
+	}
+}
+
+// apiKeyRequest is the API key a request authenticated with and the body
+// it read, charged once the request wrote.
+type apiKeyRequest struct {
+	key   *apikeys.Key
+	body  *countingBody
+	write atomic.Bool
+}
+
+// countingBody counts the bytes read from a request body, whatever its
+// Content-Length, chunked bodies have none.
+type countingBody struct {
+	io.ReadCloser
+	count atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.count.Add(int64(n))
+	return n, err
+}
+
+// statusWriter records the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController flush streamed responses.
+func (sw *statusWriter) Unwrap() http.ResponseWriter { return sw.ResponseWriter }
+
+type apiKeyRequestKey struct{}
+
+// authenticateAPIKey returns the principal of a request made with an API key,
+// nil when the request carries none.  Keys are read from the local replica,
+// a key just created or dropped may take an apply to work or stop working.
+func (n *server) authenticateAPIKey(r *http.Request) (*Principal, *apikeys.Key, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "+apiKeyPrefix)
+	if !ok {
+		return nil, nil, nil
+	}
+	name, secret, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, nil, ErrUnauthenticated
+	}
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return nil, nil, err
+	}
+	res, err := agent.ReadLocal(machines.NamedQuery{Machine: apikeys.FSMName, Query: apikeys.Query{Name: name}})
+	if err != nil {
+		return nil, nil, err
+	}
+	key, _ := res.(*apikeys.Key)
+	if key == nil || subtle.ConstantTimeCompare([]byte(hashAPIKey(secret)), []byte(key.Hash)) != 1 {
+		return nil, nil, ErrUnauthenticated
+	}
+	return &Principal{Name: apiKeyPrefix + name, Policies: key.Policies, Attributes: key.Attributes, APIKey: name}, key, nil
+}
+
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey creates an API key, or replaces the secret and limits of one
+// keeping its usage, and returns its bearer token.  Only the secret's hash
+// is replicated, the token can't be shown again.
+func (n *server) CreateAPIKey(ctx context.Context, key apikeys.Key) (string, error) {
+	if err := key.Validate(); err != nil {
+		return "", errdefs.New(errdefs.ErrInvalid, err.Error())
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(buf)
+	key.Hash, key.Usage = hashAPIKey(secret), apikeys.Usage{}
+	if _, err := n.raftAgents[shardID1].Apply(ctx, apikeys.Event{Create: &key}); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + key.Name + "." + secret, nil
+}
+
+// DropAPIKey drops an API key, dropping one that doesn't exist is a no-op.
+func (n *server) DropAPIKey(ctx context.Context, name string) error {
+	_, err := n.raftAgents[shardID1].Apply(ctx, apikeys.Event{Drop: name})
+	return err
+}
+
+// APIKeys returns the API keys with their limits and usage, without their
+// hashes.  The usage lags by up to apiKeyUsageInterval.
+func (n *server) APIKeys(ctx context.Context) ([]apikeys.Key, error) {
+	res, err := n.ReadFSM(ctx, apikeys.FSMName, apikeys.ListQuery{})
+	if err != nil {
+		return nil, err
+	}
+	keys, ok := res.([]apikeys.Key)
+	if !ok {
+		return nil, fmt.Errorf("converting result to []apikeys.Key: %T", res)
+	}
+	for i := range keys {
+		keys[i].Hash = ""
+	}
+	return keys, nil
+}
+
+// replicateAPIKeyUsage adds the usage of the keys served by this node to the
+// replicated one every apiKeyUsageInterval, it is run by every node.
+func (n *server) replicateAPIKeyUsage(ctx context.Context) {
+	ticker := time.NewTicker(apiKeyUsageInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		usage := n.apiKeyUsage.flush()
+		if len(usage) == 0 {
+			continue
+		}
+		agent, err := n.shardAgent(shardID1)
+		if err == nil {
+			_, err = agent.Apply(ctx, apikeys.Event{Usage: usage})
+		}
+		if err != nil {
+			n.logger.Warn("failed to replicate api key usage", zap.Error(err))
+			n.apiKeyUsage.restore(usage)
+		}
+	}
+}
+
+// limitAPIKey rate limits the requests made with an API key, answering 429
+// once a key is past its rate, and serves the others charging their writes,
+// see chargeAPIKey.
+func (server *httpServer) limitAPIKey(w http.ResponseWriter, r *http.Request, key *apikeys.Key, next http.Handler) {
+	if ok, wait := server.node.apiKeyUsage.take(key, time.Now()); !ok {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(wait/time.Second)+1))
+		respond(w, http.StatusTooManyRequests, map[string]string{"error": "api key rate limit exceeded"}, server.logger)
+		return
+	}
+	req := &apiKeyRequest{key: key, body: &countingBody{ReadCloser: r.Body}}
+	r.Body = req.body
+	sw := &statusWriter{ResponseWriter: w}
+	next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), apiKeyRequestKey{}, req)))
+	server.chargeAPIKey(r, req, sw.status)
+}
+
+// checkAPIKeyQuota marks a request made with an API key as a write,
+// answering 507 once the key is past its quota.
+func (server *httpServer) checkAPIKeyQuota(w http.ResponseWriter, r *http.Request) bool {
+	req, ok := r.Context().Value(apiKeyRequestKey{}).(*apiKeyRequest)
+	if !ok {
+		return true
+	}
+	req.write.Store(true)
+	if err := server.node.apiKeyUsage.overQuota(req.key); err != nil {
+		server.logger.Info("Rejecting write past quota", zap.String("api_key", req.key.Name))
+		respond(w, http.StatusInsufficientStorage, map[string]string{"error": err.Error()}, server.logger)
+		return false
+	}
+	return true
+}
+
+// chargeAPIKey counts the body a write read against its key's quota once it
+// succeeded, failed writes and dry runs store nothing.
+func (server *httpServer) chargeAPIKey(r *http.Request, req *apiKeyRequest, status int) {
+	if !req.write.Load() || status < 200 || status >= 300 {
+		return
+	}
+	if dry, _ := parseDryRun(r); dry {
+		return
+	}
+	if n := req.body.count.Load(); n > 0 {
+		server.node.apiKeyUsage.wrote(req.key, n)
+	}
+}
+
+func (server *httpServer) handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := server.node.APIKeys(r.Context())
+	if err != nil {
+		server.logger.Error("Failed to list api keys", zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	respond(w, http.StatusOK, map[string][]apikeys.Key{"keys": keys}, server.logger)
+}
+
+func (server *httpServer) handleAPIKeyChange(w http.ResponseWriter, r *http.Request) {
+	req := apikeys.Key{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !strings.HasSuffix(r.URL.Path, "/_create") {
+		if err := server.node.DropAPIKey(r.Context(), req.Name); err != nil {
+			server.logger.Error("Failed to drop api key", zap.String("api_key", req.Name), zap.Error(err))
+			statusError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	token, err := server.node.CreateAPIKey(r.Context(), req)
+	if err != nil {
+		server.logger.Error("Failed to create api key", zap.String("api_key", req.Name), zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	respond(w, http.StatusOK, map[string]string{"token": token}, server.logger)
+}
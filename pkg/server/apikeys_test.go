@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	machines "github.com/epsniff/expodb/pkg/server/state-machines"
+	"github.com/epsniff/expodb/pkg/server/state-machines/apikeys"
+)
+
+func TestAPIKeyUsage(t *testing.T) {
+	var u apiKeyUsage
+	key := &apikeys.Key{Name: "acme", Rate: 2, Burst: 3, QuotaBytes: 100, Usage: apikeys.Usage{BytesWritten: 60}}
+	now := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		if ok, _ := u.take(key, now); !ok {
+			t.Fatalf("request %d of the burst was limited", i)
+		}
+	}
+	ok, wait := u.take(key, now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("take() past the burst = %v, %v, want limited for 500ms", ok, wait)
+	}
+	if ok, _ := u.take(key, now.Add(500*time.Millisecond)); !ok {
+		t.Errorf("take() once a token is back was limited")
+	}
+
+	u.wrote(key, 30)
+	if err := u.overQuota(key); err != nil {
+		t.Errorf("overQuota() within quota = %v", err)
+	}
+	u.wrote(key, 20)
+	if err := u.overQuota(key); err != errQuotaExceeded {
+		t.Errorf("overQuota() past quota = %v, want %v", err, errQuotaExceeded)
+	}
+	usage := u.flush()
+	if got := usage["acme"]; got.Requests != 4 || got.BytesWritten != 50 {
+		t.Errorf("flush() = %+v, want 4 requests and 50 bytes", got)
+	}
+	u.restore(usage)
+	if got := u.flush()["acme"]; got.Requests != 4 {
+		t.Errorf("flush() after restore = %+v, want the usage back", got)
+	}
+
+	unlimited := &apikeys.Key{Name: "free"}
+	for i := 0; i < 100; i++ {
+		if ok, _ := u.take(unlimited, now); !ok {
+			t.Fatalf("key without a rate was limited")
+		}
+	}
+}
+
+// TestAPIKeyUsage_SoftQuota checks the bound on how far past its quota a
+// key writing to every node goes before their usage is replicated.
+func TestAPIKeyUsage_SoftQuota(t *testing.T) {
+	const nodes, quota, replicated, write = 3, 100, 40, 25
+	key := &apikeys.Key{Name: "acme", QuotaBytes: quota, Usage: apikeys.Usage{BytesWritten: replicated}}
+	usages := make([]apiKeyUsage, nodes)
+	written := int64(replicated)
+	for i := range usages {
+		for usages[i].overQuota(key) == nil {
+			usages[i].wrote(key, write)
+			written += write
+		}
+	}
+	if bound := int64(replicated + nodes*(quota-replicated+write)); written > bound {
+		t.Errorf("%d nodes let %d bytes be written, want at most %d", nodes, written, bound)
+	}
+
+	for i := range usages {
+		key.Usage.BytesWritten += usages[i].flush()["acme"].BytesWritten
+	}
+	for i := range usages {
+		if err := usages[i].overQuota(key); err != errQuotaExceeded {
+			t.Errorf("node %d overQuota() once replicated = %v, want %v", i, err, errQuotaExceeded)
+		}
+	}
+}
+
+func TestAPIKeyQuota_Chunked(t *testing.T) {
+	srv, addr := startTestNode(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	token, err := srv.CreateAPIKey(ctx, apikeys.Key{Name: "acme", QuotaBytes: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the key is read from the local replica.
+	for {
+		if res, err := srv.raftAgents[shardID1].ReadLocal(machines.NamedQuery{Machine: apikeys.FSMName, Query: apikeys.Query{Name: "acme"}}); err == nil && res.(*apikeys.Key) != nil {
+			break
+		} else if ctx.Err() != nil {
+			t.Fatal("api key never applied")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	write := `{"table":"t", "key":"k", "column":"c", "value":"v"}`
+	tests := []struct {
+		name, query, body string
+		want              int
+		wantCharged       int64
+	}{
+		{"bad body", "", `{"table":`, http.StatusBadRequest, 0},
+		{"dry run", "?dry_run=true", write, http.StatusOK, 0},
+		{"under quota", "", write, http.StatusOK, int64(len(write))},
+		{"past quota", "", write, http.StatusInsufficientStorage, int64(len(write))},
+	}
+	for _, tt := range tests {
+		// a reader of unknown length is sent chunked, without a Content-Length.
+		body := io.MultiReader(strings.NewReader(tt.body))
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+addr+"/key/_update"+tt.query, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+		srv.apiKeyUsage.mu.Lock()
+		charged := srv.apiKeyUsage.pending["acme"].BytesWritten
+		srv.apiKeyUsage.mu.Unlock()
+		if charged != tt.wantCharged {
+			t.Errorf("%s: %d bytes charged, want %d", tt.name, charged, tt.wantCharged)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/archive"
+	"github.com/epsniff/expodb/pkg/objstore"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+const (
+	// archiveSegmentEntries bounds the entries of a log segment.
+	archiveSegmentEntries = 10000
+	// archiveExportTimeout bounds the export of a snapshot to archive.
+	archiveExportTimeout = 10 * time.Minute
+)
+
+// archiveState tracks the archive shipments of the leader.
+type archiveState struct {
+	mu            sync.Mutex
+	lastSegment   time.Time
+	lastIndex     uint64
+	lastSnapshot  time.Time
+	snapshotIndex uint64
+	lastErr       error
+}
+
+// archiveStatus is reported by /status on the node archiving.
+type archiveStatus struct {
+	URL string `json:"url"`
+	// Offset is the last entry the archive holds, replicated so every
+	// node knows it.
+	Offset        uint64     `json:"offset"`
+	LastSegment   *time.Time `json:"last_segment,omitempty"`
+	LastSnapshot  *time.Time `json:"last_snapshot,omitempty"`
+	SnapshotIndex uint64     `json:"snapshot_index,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// Archive returns the archive the raft log is shipped to, nil when none is.
+func (n *server) Archive(ctx context.Context) (*multiraft.ArchiveState, error) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return nil, err
+	}
+	res, err := agent.Read(ctx, multiraft.ArchiveQuery{})
+	if err != nil {
+		return nil, err
+	}
+	state, ok := res.(*multiraft.ArchiveState)
+	if !ok {
+		return nil, fmt.Errorf("converting result to *multiraft.ArchiveState: %T", res)
+	}
+	return state, nil
+}
+
+// runArchive is run by the leader, see leaderLoop.  Every segment interval
+// it ships the raft log applied since the last segment to the archive, then
+// replicates the new offset, and every snapshot interval it archives an
+// exported snapshot and applies the retention policy.  Entries stay recorded
+// in the FSM until shipped, a failing store holds back nothing but the
+// archive.  Without --archive-url it stops the recording of a previous run.
+func (n *server) runArchive(ctx context.Context) {
+	state, err := n.Archive(ctx)
+	if err != nil {
+		n.logger.Warn("failed to read the archive state", zap.Error(err))
+		return
+	}
+	if n.config.ArchiveURL == "" {
+		if state != nil {
+			if _, err := n.applyWrite(ctx, multiraft.KVData{Op: multiraft.OpDropArchive}); err != nil {
+				n.logger.Warn("failed to stop archiving", zap.Error(err))
+			}
+		}
+		return
+	}
+	store, err := objstore.Open(n.config.ArchiveURL)
+	if err != nil {
+		n.logger.Error("failed to open the archive", zap.Error(err))
+		return
+	}
+	if state == nil || state.URL != n.config.ArchiveURL {
+		if _, err := n.applyWrite(ctx, multiraft.KVData{Op: multiraft.OpSetArchive, Val: n.config.ArchiveURL}); err != nil {
+			n.logger.Warn("failed to start archiving", zap.Error(err))
+			return
+		}
+	}
+
+	ticker := time.NewTicker(n.config.ArchiveSegments)
+	defer ticker.Stop()
+	// a snapshot is due right away unless the archive has one the log
+	// shipped follows.
+	var nextSnapshot time.Time
+	if cat, err := archive.List(ctx, store); err == nil && len(cat.Snapshots) > 0 {
+		last := cat.Snapshots[len(cat.Snapshots)-1]
+		if state != nil && state.URL == n.config.ArchiveURL && last.Index >= state.Since {
+			nextSnapshot = last.Taken.Add(n.config.ArchiveSnapshots)
+		}
+	}
+	var failing bool
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		index, err := n.shipArchiveSegments(ctx, store)
+		if err == nil && !time.Now().Before(nextSnapshot) {
+			var snapshotIndex uint64
+			if snapshotIndex, err = n.shipArchiveSnapshot(ctx, store); err == nil {
+				nextSnapshot = time.Now().Add(n.config.ArchiveSnapshots)
+				n.recordEvent(ctx, eventArchiveSnapshot, n.config.ArchiveURL, fmt.Sprintf("index %d", snapshotIndex))
+				if err := n.expireArchive(ctx, store); err != nil {
+					n.logger.Warn("failed to apply the archive retention", zap.Error(err))
+				}
+			}
+		}
+		n.archive.mu.Lock()
+		n.archive.lastErr = err
+		if err == nil && index != 0 {
+			n.archive.lastSegment = time.Now()
+			n.archive.lastIndex = index
+		}
+		n.archive.mu.Unlock()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			n.logger.Warn("failed to ship to the archive", zap.String("archive", n.config.ArchiveURL), zap.Error(err))
+			if !failing {
+				n.recordEvent(ctx, eventArchiveFailed, n.config.ArchiveURL, err.Error())
+			}
+		}
+		failing = err != nil
+	}
+}
+
+// shipArchiveSegments ships the entries recorded after the archive's offset
+// as segments, acknowledging each, and returns the last index shipped, 0 when
+// there was none to ship.  A segment shipped twice, when the leader fails
+// before its acknowledgement is replicated, is harmless: restores apply the
+// entries once.
+func (n *server) shipArchiveSegments(ctx context.Context, store objstore.Store) (uint64, error) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return 0, err
+	}
+	var shipped uint64
+	for {
+		state, err := n.Archive(ctx)
+		if err != nil {
+			return shipped, err
+		}
+		if state == nil {
+			return shipped, errors.New("archiving was stopped")
+		}
+		res, err := agent.Read(ctx, multiraft.ArchiveLogQuery{After: state.Offset, Limit: archiveSegmentEntries})
+		if err != nil {
+			return shipped, err
+		}
+		entries, ok := res.([]multiraft.ArchivedEntry)
+		if !ok {
+			return shipped, fmt.Errorf("converting result to []multiraft.ArchivedEntry: %T", res)
+		}
+		if len(entries) == 0 {
+			return shipped, nil
+		}
+		buf := &bytes.Buffer{}
+		if err := multiraft.WriteArchiveSegment(buf, entries); err != nil {
+			return shipped, err
+		}
+		first, last := entries[0].Index, entries[len(entries)-1].Index
+		if err := store.Put(ctx, archive.SegmentKey(first, last), buf, int64(buf.Len())); err != nil {
+			return shipped, fmt.Errorf("shipping segment %d-%d: %w", first, last, err)
+		}
+		if _, err := agent.Apply(ctx, multiraft.KVData{Op: multiraft.OpAckArchive, Index: last}); err != nil {
+			return shipped, fmt.Errorf("acknowledging segment %d-%d: %w", first, last, err)
+		}
+		shipped = last
+		if len(entries) < archiveSegmentEntries {
+			return shipped, nil
+		}
+	}
+}
+
+// shipArchiveSnapshot exports a snapshot of the local replica and uploads
+// its files, the metadata last: a snapshot is only listed once complete.
+func (n *server) shipArchiveSnapshot(ctx context.Context, store objstore.Store) (uint64, error) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := os.MkdirTemp(n.config.RaftDataDir, "archive-snapshot-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tmp)
+	exportCtx, cancel := context.WithTimeout(ctx, archiveExportTimeout)
+	defer cancel()
+	dir, err := agent.ExportSnapshot(exportCtx, tmp)
+	if err != nil {
+		return 0, fmt.Errorf("exporting snapshot: %w", err)
+	}
+	var index uint64
+	if _, err := fmt.Sscanf(filepath.Base(dir), "snapshot-%X", &index); err != nil {
+		return 0, fmt.Errorf("exported snapshot %s: %w", dir, err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	upload := func(name string) error {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		return store.Put(ctx, archive.SnapshotKey(index, name), f, st.Size())
+	}
+	for _, file := range files {
+		if file.Name() == multiraft.SnapshotMetadataFile || file.IsDir() {
+			continue
+		}
+		if err := upload(file.Name()); err != nil {
+			return 0, fmt.Errorf("uploading snapshot %d: %w", index, err)
+		}
+	}
+	if err := upload(multiraft.SnapshotMetadataFile); err != nil {
+		return 0, fmt.Errorf("uploading snapshot %d: %w", index, err)
+	}
+	n.archive.mu.Lock()
+	n.archive.lastSnapshot = time.Now()
+	n.archive.snapshotIndex = index
+	n.archive.mu.Unlock()
+	return index, nil
+}
+
+// expireArchive deletes the snapshots older than the retention, but the
+// newest, and the segments no snapshot kept needs.
+func (n *server) expireArchive(ctx context.Context, store objstore.Store) error {
+	cat, err := archive.List(ctx, store)
+	if err != nil {
+		return err
+	}
+	snapshots, segments := cat.Expired(time.Now().Add(-n.config.ArchiveRetention))
+	for _, s := range snapshots {
+		objects, err := store.List(ctx, archive.SnapshotsPrefix+s.Dir+"/")
+		if err != nil {
+			return err
+		}
+		// the metadata first, so a snapshot half deleted isn't listed.
+		for i := len(objects) - 1; i >= 0; i-- {
+			if filepath.Base(objects[i].Key) == multiraft.SnapshotMetadataFile {
+				objects[0], objects[i] = objects[i], objects[0]
+			}
+		}
+		for _, obj := range objects {
+			if err := store.Delete(ctx, obj.Key); err != nil {
+				return err
+			}
+		}
+	}
+	for _, seg := range segments {
+		if err := store.Delete(ctx, seg.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveStatus reports the archiving, nil when the log isn't archived.
+func (n *server) archiveStatus(ctx context.Context) *archiveStatus {
+	if n.config.ArchiveURL == "" {
+		return nil
+	}
+	as := &archiveStatus{URL: n.config.ArchiveURL}
+	if state, err := n.Archive(ctx); err == nil && state != nil {
+		as.Offset = state.Offset
+	}
+	n.archive.mu.Lock()
+	defer n.archive.mu.Unlock()
+	if !n.archive.lastSegment.IsZero() {
+		shipped := n.archive.lastSegment
+		as.LastSegment = &shipped
+	}
+	if !n.archive.lastSnapshot.IsZero() {
+		taken := n.archive.lastSnapshot
+		as.LastSnapshot = &taken
+		as.SnapshotIndex = n.archive.snapshotIndex
+	}
+	if n.archive.lastErr != nil {
+		as.LastError = n.archive.lastErr.Error()
+	}
+	return as
+}
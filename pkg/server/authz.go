@@ -0,0 +1,283 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/epsniff/expodb/pkg/config"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"github.com/epsniff/expodb/pkg/server/state-machines/apikeys"
+	"go.uber.org/zap"
+)
+
+// Actions a principal is authorized for.  Admin covers /admin and the
+// cluster changing /cluster requests, Decrypt reading the values of a
+// table's encrypted columns in the clear.
+const (
+	ActionRead    = "read"
+	ActionWrite   = "write"
+	ActionAdmin   = "admin"
+	ActionDecrypt = "decrypt"
+)
+
+// countersTable is the table counters are authorized as, they don't live in
+// one.
+const countersTable = "_counters"
+
+var (
+	ErrUnauthenticated = errors.New("missing or invalid credentials")
+	ErrForbidden       = errors.New("not authorized")
+)
+
+// Principal is who a request is made by.  Policies name the access policies
+// that apply to it, their meaning is up to the Authorizer.  Attributes, such
+// as the tenant the principal belongs to, are referenced by the row filters
+// of policies, see RowAuthorizer.
+type Principal struct {
+	Name       string
+	Policies   []string
+	Attributes map[string]string
+	// APIKey is the API key the principal authenticated with, see
+	// apikeys.go.
+	APIKey string
+}
+
+// Authenticator maps a request's credentials to a principal.  It returns
+// ErrUnauthenticated when they are missing or wrong.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Authorizer decides whether a principal may perform an action on a table,
+// the empty table for requests that aren't about one.  It returns
+// ErrForbidden, or another error, when it may not.
+type Authorizer interface {
+	Authorize(p *Principal, action, table string) error
+}
+
+// RowAuthorizer is implemented by Authorizers restricting principals to some
+// of the rows of a table.  RowFilters returns the filters a row must match
+// one of for the principal to perform action on it, nil when every row is
+// allowed.
+type RowAuthorizer interface {
+	RowFilters(p *Principal, action, table string) []multiraft.RowFilter
+}
+
+// allowAll lets every request through as an anonymous principal, it is used
+// unless an auth policy is configured.
+type allowAll struct{}
+
+func (allowAll) Authenticate(*http.Request) (*Principal, error) { return &Principal{}, nil }
+func (allowAll) Authorize(*Principal, string, string) error     { return nil }
+
+// authRequired reports whether client requests have to carry credentials,
+// whether an auth policy, OIDC or custom Authenticator is configured.
+func (n *server) authRequired() bool {
+	_, open := n.authn.(allowAll)
+	return !open
+}
+
+// authenticateToken authenticates a bearer token sent outside of an HTTP
+// request, as the Redis protocol's AUTH, as if a request carried it.
+func (n *server) authenticateToken(token string) (*Principal, *apikeys.Key, error) {
+	r, err := http.NewRequest(http.MethodGet, "/", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	principal, key, err := n.authenticateAPIKey(r)
+	if principal == nil && err == nil {
+		principal, err = n.authn.Authenticate(r)
+	}
+	return principal, key, err
+}
+
+// SetAuth replaces the authenticator and authorizer of client requests, so
+// custom ones can be plugged in without forking.
+func (n *server) SetAuth(authn Authenticator, authz Authorizer) {
+	n.authn, n.authz = authn, authz
+}
+
+// tokenPolicy authenticates bearer tokens and authorizes their principals
+// with named policies, both from a JSON file:
+//
+//	{
+//	  "tokens": [{"name": "ingest", "token": "...", "policies": ["metrics"], "attributes": {"tenant": "acme"}}],
+//	  "policies": {"metrics": [{"tables": ["metrics", "metrics_*"], "actions": ["read", "write"]}]},
+//	  "claims": {"platform-eng": ["metrics"]}
+//	}
+//
+// Tokens may be env:, file: or vault: references, see config.ResolveSecret.
+// A table pattern is a table name, a prefix ending with "*", or "*".  Claims
+// map values of a JWT's policy claim to policies, see oidcAuthenticator.  A
+// rule with a "rows" filter only allows the rows matching it, "${name}" in
+// the filter's value stands for the principal's attribute name.
+type tokenPolicy struct {
+	Tokens   []tokenGrant            `json:"tokens"`
+	Policies map[string][]policyRule `json:"policies"`
+	Claims   map[string][]string     `json:"claims"`
+}
+
+type tokenGrant struct {
+	Name       string            `json:"name"`
+	Token      string            `json:"token"`
+	Policies   []string          `json:"policies"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+type policyRule struct {
+	Tables  []string             `json:"tables"`
+	Actions []string             `json:"actions"`
+	Rows    *multiraft.RowFilter `json:"rows"`
+}
+
+func loadTokenPolicy(path string) (*tokenPolicy, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &tokenPolicy{}
+	if err := json.Unmarshal(buf, p); err != nil {
+		return nil, fmt.Errorf("parsing auth policy %s: %w", path, err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("auth policy %s: %w", path, err)
+	}
+	for i := range p.Tokens {
+		if p.Tokens[i].Token, err = config.ResolveSecret(p.Tokens[i].Token); err != nil {
+			return nil, fmt.Errorf("auth policy %s: token %s: %w", path, p.Tokens[i].Name, err)
+		}
+	}
+	return p, nil
+}
+
+func (p *tokenPolicy) validate() error {
+	for _, t := range p.Tokens {
+		if t.Name == "" || t.Token == "" {
+			return fmt.Errorf("every token needs a name and a token")
+		}
+		for _, name := range t.Policies {
+			if _, ok := p.Policies[name]; !ok {
+				return fmt.Errorf("token %s has unknown policy %q", t.Name, name)
+			}
+		}
+	}
+	for value, names := range p.Claims {
+		for _, name := range names {
+			if _, ok := p.Policies[name]; !ok {
+				return fmt.Errorf("claim %s has unknown policy %q", value, name)
+			}
+		}
+	}
+	for name, rules := range p.Policies {
+		for _, rule := range rules {
+			for _, action := range rule.Actions {
+				if action != ActionRead && action != ActionWrite && action != ActionAdmin && action != ActionDecrypt {
+					return fmt.Errorf("policy %s has unknown action %q", name, action)
+				}
+			}
+			if rule.Rows != nil {
+				if err := rule.Rows.Validate(); err != nil {
+					return fmt.Errorf("policy %s: rows: %w", name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (p *tokenPolicy) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	for _, t := range p.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+			return &Principal{Name: t.Name, Policies: t.Policies, Attributes: t.Attributes}, nil
+		}
+	}
+	return nil, ErrUnauthenticated
+}
+
+func (p *tokenPolicy) Authorize(principal *Principal, action, table string) error {
+	for _, name := range principal.Policies {
+		for _, rule := range p.Policies[name] {
+			if rule.allows(action, table) {
+				return nil
+			}
+		}
+	}
+	return ErrForbidden
+}
+
+// RowFilters returns the row filters of the rules allowing the principal
+// action on table, with the principal's attributes filled in.  A rule naming
+// an attribute the principal doesn't have allows no row.
+func (p *tokenPolicy) RowFilters(principal *Principal, action, table string) []multiraft.RowFilter {
+	filters := []multiraft.RowFilter{}
+	for _, name := range principal.Policies {
+		for _, rule := range p.Policies[name] {
+			if !rule.allows(action, table) {
+				continue
+			}
+			if rule.Rows == nil {
+				return nil
+			}
+			if filter, ok := rule.Rows.Resolve(principal.Attributes); ok {
+				filters = append(filters, filter)
+			}
+		}
+	}
+	return filters
+}
+
+func (rule *policyRule) allows(action, table string) bool {
+	actionOK := false
+	for _, a := range rule.Actions {
+		actionOK = actionOK || a == action
+	}
+	if !actionOK {
+		return false
+	}
+	if table == "" {
+		return true
+	}
+	for _, pattern := range rule.Tables {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); (ok && strings.HasPrefix(table, prefix)) || pattern == table {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// principalFromContext returns the principal ServeHTTP authenticated.
+func principalFromContext(ctx context.Context) *Principal {
+	if p, ok := ctx.Value(principalKey{}).(*Principal); ok {
+		return p
+	}
+	return &Principal{}
+}
+
+// authorize answers 403 and returns false when the request's principal may
+// not perform action on table.
+func (server *httpServer) authorize(w http.ResponseWriter, r *http.Request, action, table string) bool {
+	p := principalFromContext(r.Context())
+	if err := server.node.authz.Authorize(p, action, table); err != nil {
+		server.logger.Info("Rejecting unauthorized request",
+			zap.String("principal", p.Name), zap.String("action", action), zap.String("table", table), zap.Error(err))
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	if action == ActionWrite {
+		return server.checkAPIKeyQuota(w, r)
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/epsniff/expodb/pkg/config"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+func TestTokenPolicy(t *testing.T) {
+	p := &tokenPolicy{
+		Tokens: []tokenGrant{{Name: "ingest", Token: "s3cret", Policies: []string{"metrics"}}},
+		Policies: map[string][]policyRule{
+			"metrics": {{Tables: []string{"metrics", "metrics_*"}, Actions: []string{ActionRead, ActionWrite}}},
+			"ops":     {{Actions: []string{ActionAdmin}}},
+		},
+	}
+	if err := p.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest(http.MethodPost, "/key/_update", nil)
+	if _, err := p.Authenticate(r); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("Authenticate() without a token = %v", err)
+	}
+	r.Header.Set("Authorization", "Bearer s3cret")
+	principal, err := p.Authenticate(r)
+	if err != nil || principal.Name != "ingest" {
+		t.Fatalf("Authenticate() = %+v, %v", principal, err)
+	}
+
+	tests := []struct {
+		action, table string
+		allowed       bool
+	}{
+		{ActionWrite, "metrics", true},
+		{ActionRead, "metrics_series", true},
+		{ActionWrite, "users", false},
+		{ActionAdmin, "", false},
+	}
+	for _, tt := range tests {
+		if err := p.Authorize(principal, tt.action, tt.table); (err == nil) != tt.allowed {
+			t.Errorf("Authorize(%s, %q) = %v, want allowed %v", tt.action, tt.table, err, tt.allowed)
+		}
+	}
+}
+
+func TestTokenPolicy_RowFilters(t *testing.T) {
+	p := &tokenPolicy{
+		Policies: map[string][]policyRule{
+			"tenant": {{Tables: []string{"orders"}, Actions: []string{ActionRead, ActionWrite},
+				Rows: &multiraft.RowFilter{Column: "tenant_id", Op: multiraft.FilterEquals, Value: "${tenant}"}}},
+			"admin": {{Tables: []string{"*"}, Actions: []string{ActionRead}}},
+		},
+	}
+	if err := p.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	acme := &Principal{Name: "acme", Policies: []string{"tenant"}, Attributes: map[string]string{"tenant": "acme"}}
+	filters := p.RowFilters(acme, ActionWrite, "orders")
+	if len(filters) != 1 || filters[0].Value != "acme" {
+		t.Fatalf("RowFilters() = %+v, want tenant_id == acme", filters)
+	}
+	guard := rowGuard(filters)
+	if !guard.allows(map[string]string{"tenant_id": "acme"}) || guard.allows(map[string]string{"tenant_id": "globex"}) {
+		t.Errorf("guard %+v doesn't keep acme to its rows", guard)
+	}
+	if cols, added := guard.columns([]string{"total"}); len(cols) != 2 || len(added) != 1 || added[0] != "tenant_id" {
+		t.Errorf("columns() = %v, %v, want tenant_id added", cols, added)
+	}
+
+	if filters := p.RowFilters(&Principal{Policies: []string{"tenant"}}, ActionRead, "orders"); filters == nil || len(filters) != 0 {
+		t.Errorf("RowFilters() without the attribute = %+v, want no rows", filters)
+	}
+	both := &Principal{Policies: []string{"tenant", "admin"}, Attributes: acme.Attributes}
+	if filters := p.RowFilters(both, ActionRead, "orders"); filters != nil {
+		t.Errorf("RowFilters() with an unfiltered rule = %+v, want every row", filters)
+	}
+	if filters := p.RowFilters(both, ActionWrite, "orders"); len(filters) != 1 {
+		t.Errorf("RowFilters() for write = %+v, want the tenant filter", filters)
+	}
+}
+
+// TestClusterTableRefused checks no client request reads _cluster, which
+// holds the cursor key and the join tokens, even with every action allowed.
+func TestClusterTableRefused(t *testing.T) {
+	node := &server{config: &config.Config{NodeName: "node-1"}, metadata: NewMetadata(), authn: allowAll{}, authz: allowAll{}}
+	handler := (&httpServer{logger: zap.NewNop(), node: node}).routes()
+	for _, tt := range []struct{ method, path, body string }{
+		{http.MethodGet, "/v1/tables/_cluster/keys/secrets", ""},
+		{http.MethodGet, "/v1/tables/_cluster/keys", ""},
+		{http.MethodPost, "/v1/key/_fetch", `{"table":"_cluster", "key":"secrets"}`},
+		{http.MethodPost, "/v1/key/_scan", `{"table":"_cluster"}`},
+		{http.MethodPost, "/v1/key/_scan", `{"table":"_cluster", "stream":true}`},
+		{http.MethodPost, "/v1/key/_list", `{"table":"_cluster"}`},
+		{http.MethodPost, "/v1/key/_query", `{"table":"_cluster"}`},
+		{http.MethodPost, "/v1/admin/_export_table", `{"table":"_cluster"}`},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+		if w.Code != http.StatusForbidden && w.Code != http.StatusBadRequest {
+			t.Errorf("%s %s %s: status %d, want the table refused", tt.method, tt.path, tt.body, w.Code)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+)
+
+const (
+	// nonVotingReplicaBit is set in the replica ID of demoted nodes.
+	// dragonboat can't turn a voter into a non-voter and never takes a
+	// removed replica ID back, so a demoted node rejoins under a new ID.
+	nonVotingReplicaBit = 1 << 62
+	// autopilotMinVoters is the fewest voters a demotion leaves the shard
+	// with, fewer can't lose a voter without losing the quorum.
+	autopilotMinVoters = 3
+	// demoteUserEvent tells a demoted node to rejoin as a non-voter, the
+	// payload is a demotion.
+	demoteUserEvent = "expodb-demote"
+	// demotedReplicaFile, in the raft data dir, holds the non-voting replica
+	// ID of a demoted node so it restarts as one.
+	demotedReplicaFile = "demoted-replica"
+)
+
+func nonVotingReplicaID(replicaID uint64) uint64 {
+	return replicaID | nonVotingReplicaBit
+}
+
+func isNonVotingReplica(replicaID uint64) bool {
+	return replicaID&nonVotingReplicaBit != 0
+}
+
+type demotion struct {
+	ID        string `json:"id"`
+	ReplicaID uint64 `json:"replica_id"`
+}
+
+// autopilot is the leader's view of the voters' lag, see runAutopilot.
+type autopilot struct {
+	maxLag time.Duration
+	after  time.Duration
+	// lagging is since when each lagging voter has been, by replica ID.
+	lagging map[uint64]time.Time
+	// pending are the demoted voters not yet added back as non-voters.
+	pending map[uint64]peerStatus
+}
+
+// observe records which voters lag by more than maxLag and returns the one
+// to demote, if any: lagging for at least after, not exempt, and leaving the
+// shard autopilotMinVoters voters.
+func (ap *autopilot) observe(peers []peerStatus, exempt func(id string) bool, now time.Time) (peerStatus, bool) {
+	voters := 1 // the leader
+	for _, p := range peers {
+		if !p.Voter {
+			delete(ap.lagging, p.ReplicaID)
+			continue
+		}
+		voters++
+		if time.Duration(p.LagMs)*time.Millisecond <= ap.maxLag {
+			delete(ap.lagging, p.ReplicaID)
+		} else if _, ok := ap.lagging[p.ReplicaID]; !ok {
+			ap.lagging[p.ReplicaID] = now
+		}
+	}
+	if voters-1 < autopilotMinVoters {
+		return peerStatus{}, false
+	}
+	for _, p := range peers {
+		since, ok := ap.lagging[p.ReplicaID]
+		if ok && now.Sub(since) >= ap.after && !exempt(p.ID) {
+			return p, true
+		}
+	}
+	return peerStatus{}, false
+}
+
+// runAutopilot is run by the leader, see leaderLoop.  It demotes the voters
+// lagging by more than AutopilotDemoteLag for AutopilotDemoteAfter to
+// non-voters, so they stop holding up commits, one at a time.  Demoted nodes
+// keep replicating, they aren't made voters again.
+func (n *server) runAutopilot(ctx context.Context) {
+	ap := &autopilot{
+		maxLag:  n.config.AutopilotDemoteLag,
+		after:   n.config.AutopilotDemoteAfter,
+		lagging: map[uint64]time.Time{},
+		pending: map[uint64]peerStatus{},
+	}
+	ticker := time.NewTicker(appliedIndexGossipInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := n.autopilotStep(ctx, ap); err != nil {
+			n.logger.Warn("autopilot step failed", zap.Error(err))
+		}
+	}
+}
+
+func (n *server) autopilotStep(ctx context.Context, ap *autopilot) error {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return err
+	}
+	for replicaID, p := range ap.pending {
+		if err := agent.AddNonVoter(nonVotingReplicaID(replicaID), p.RaftAddr); err != nil {
+			return fmt.Errorf("adding demoted %s back as a non-voter: %w", p.ID, err)
+		}
+		delete(ap.pending, replicaID)
+		n.announceDemotion(demotion{ID: p.ID, ReplicaID: nonVotingReplicaID(replicaID)})
+	}
+	peers := n.peerStatuses(ctx)
+	// demoted nodes that haven't rejoined may have missed the event.
+	for _, p := range peers {
+		if node, ok := n.metadata.FindByRaftAddr(p.RaftAddr); ok && !p.Voter && node.ReplicaID() != p.ReplicaID {
+			n.announceDemotion(demotion{ID: p.ID, ReplicaID: p.ReplicaID})
+		}
+	}
+	exempt := func(id string) bool {
+		node, ok := n.metadata.FindByID(id)
+		return !ok || node.NoDemote()
+	}
+	if !n.featureEnabled(featureAutopilot) {
+		// lag is tracked afresh once it is back on.
+		ap.lagging = map[uint64]time.Time{}
+		return nil
+	}
+	p, ok := ap.observe(peers, exempt, time.Now())
+	if !ok {
+		return nil
+	}
+	n.logger.Warn("demoting lagging voter", zap.String("peer.id", p.ID), zap.Uint64("lag_ms", p.LagMs), zap.Uint64("lag_entries", p.LagEntries))
+	if err := agent.RemoveReplica(p.ReplicaID); err != nil {
+		return fmt.Errorf("removing voter %s: %w", p.ID, err)
+	}
+	delete(ap.lagging, p.ReplicaID)
+	n.recordEvent(ctx, eventVoterDemoted, p.ID, fmt.Sprintf("lagging %dms, %d entries", p.LagMs, p.LagEntries))
+	nonVoting := nonVotingReplicaID(p.ReplicaID)
+	if err := agent.AddNonVoter(nonVoting, p.RaftAddr); err != nil {
+		ap.pending[p.ReplicaID] = p
+		return fmt.Errorf("adding demoted %s back as a non-voter: %w", p.ID, err)
+	}
+	n.announceDemotion(demotion{ID: p.ID, ReplicaID: nonVoting})
+	return nil
+}
+
+func (n *server) announceDemotion(d demotion) {
+	payload, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+	n.serfAgent.UserEvent(demoteUserEvent, payload, false)
+}
+
+// handleDemotion rejoins the shard as a non-voter when this node is the one
+// demoted.
+func (n *server) handleDemotion(e serf.UserEvent) {
+	var d demotion
+	if err := json.Unmarshal(e.Payload, &d); err != nil {
+		n.logger.Error("Bad demotion event", zap.ByteString("payload", e.Payload), zap.Error(err))
+		return
+	}
+	if d.ID != n.config.ID() || !isNonVotingReplica(d.ReplicaID) {
+		return
+	}
+	go func() {
+		if err := n.rejoinAsNonVoter(d.ReplicaID); err != nil {
+			n.logger.Error("Failed to rejoin as a non-voter", zap.Uint64("replica-id", d.ReplicaID), zap.Error(err))
+		}
+	}()
+}
+
+// rejoinAsNonVoter drops this node's removed voter replica and starts its
+// non-voting one, which the leader has added and catches up.
+func (n *server) rejoinAsNonVoter(replicaID uint64) error {
+	n.rejoinMu.Lock()
+	defer n.rejoinMu.Unlock()
+	if n.replicaID.Load() == replicaID {
+		return nil
+	}
+	if err := writeDemotedReplica(n.config.RaftDataDir, replicaID); err != nil {
+		return err
+	}
+	n.raftAgentsMu.Lock()
+	agent, ok := n.raftAgents[shardID1]
+	delete(n.raftAgents, shardID1)
+	n.raftAgentsMu.Unlock()
+	if ok {
+		if err := agent.Leave(); err != nil {
+			return fmt.Errorf("leaving as a voter: %w", err)
+		}
+	}
+	n.replicaID.Store(replicaID)
+	n.serfAgent.SetTags(map[string]string{"replica_id": strconv.FormatUint(replicaID, 10)})
+	n.logger.Info("rejoining as a non-voter", zap.Uint64("replica-id", replicaID))
+	return n.NewShard(false, shardID1)
+}
+
+// readDemotedReplica returns the replica ID recorded by writeDemotedReplica,
+// 0 if the node hasn't been demoted.
+func readDemotedReplica(dir string) (uint64, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, demotedReplicaFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	replicaID, err := strconv.ParseUint(strings.TrimSpace(string(buf)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing %s: %w", demotedReplicaFile, err)
+	}
+	return replicaID, nil
+}
+
+func writeDemotedReplica(dir string, replicaID uint64) error {
+	tmp := filepath.Join(dir, demotedReplicaFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(replicaID, 10)), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, demotedReplicaFile))
+}
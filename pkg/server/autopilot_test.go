@@ -0,0 +1,56 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAutopilotObserve(t *testing.T) {
+	ap := &autopilot{maxLag: time.Second, after: time.Minute, lagging: map[uint64]time.Time{}}
+	peers := []peerStatus{
+		{ID: "node-2", ReplicaID: 2, Voter: true, LagMs: 10},
+		{ID: "node-3", ReplicaID: 3, Voter: true, LagMs: 5000},
+		{ID: "node-4", ReplicaID: 4, Voter: true},
+		{ID: "node-5", ReplicaID: nonVotingReplicaID(5), LagMs: 9000},
+	}
+	exempt := func(id string) bool { return false }
+	start := time.Unix(1000, 0)
+	if _, ok := ap.observe(peers, exempt, start); ok {
+		t.Errorf("observe() demoted a voter lagging for 0s")
+	}
+	p, ok := ap.observe(peers, exempt, start.Add(time.Minute))
+	if !ok || p.ID != "node-3" {
+		t.Errorf("observe() = %v, %v, want node-3", p.ID, ok)
+	}
+	if _, ok := ap.observe(peers, func(id string) bool { return id == "node-3" }, start.Add(time.Minute)); ok {
+		t.Errorf("observe() demoted an exempt voter")
+	}
+	// three voters, demoting one would leave two.
+	if _, ok := ap.observe(peers[1:], exempt, start.Add(time.Minute)); ok {
+		t.Errorf("observe() demoted a voter of a three voter shard")
+	}
+	// catching up resets the clock.
+	peers[1].LagMs = 0
+	ap.observe(peers, exempt, start.Add(2*time.Minute))
+	peers[1].LagMs = 5000
+	if _, ok := ap.observe(peers, exempt, start.Add(2*time.Minute+time.Second)); ok {
+		t.Errorf("observe() demoted a voter that caught up")
+	}
+}
+
+func TestDemotedReplicaFile(t *testing.T) {
+	dir := t.TempDir()
+	if id, err := readDemotedReplica(dir); err != nil || id != 0 {
+		t.Fatalf("readDemotedReplica() = %d, %v, want 0", id, err)
+	}
+	want := nonVotingReplicaID(3)
+	if err := writeDemotedReplica(dir, want); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := readDemotedReplica(dir); err != nil || id != want {
+		t.Errorf("readDemotedReplica() = %d, %v, want %d", id, err, want)
+	}
+	if !isNonVotingReplica(want) || isNonVotingReplica(3) {
+		t.Errorf("isNonVotingReplica() wrong")
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+// SetCascade adds a rule deleting rows of another table with the rows of a
+// table, see multiraft.CascadeRule.  Setting a rule again replaces it, rows
+// deleted before are left as they are.
+func (n *server) SetCascade(ctx context.Context, rule multiraft.CascadeRule) (uint64, error) {
+	if err := rule.Validate(); err != nil {
+		return 0, err
+	}
+	return n.applyWrite(ctx, multiraft.KVData{Op: multiraft.OpSetCascade, Table: rule.Table, Cascade: &rule})
+}
+
+// DropCascade drops a cascade rule, dropping one that doesn't exist is a
+// no-op.
+func (n *server) DropCascade(ctx context.Context, table, name string) (uint64, error) {
+	return n.applyWrite(ctx, multiraft.KVData{Op: multiraft.OpDropCascade, Table: table, Row: name})
+}
+
+// Cascades returns the cascade rules of every table.
+func (n *server) Cascades(ctx context.Context) ([]multiraft.CascadeRule, error) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return nil, err
+	}
+	res, err := agent.Read(ctx, multiraft.CascadesQuery{})
+	if err != nil {
+		return nil, err
+	}
+	rules, ok := res.([]multiraft.CascadeRule)
+	if !ok {
+		return nil, fmt.Errorf("converting result to []multiraft.CascadeRule: %T", res)
+	}
+	return rules, nil
+}
+
+func (n *server) cascadeRows(ctx context.Context) ([]multiraft.ScanRow, error) {
+	rules, err := n.Cascades(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var rows []multiraft.ScanRow
+	for _, rule := range rules {
+		rows = append(rows, multiraft.ScanRow{Key: rule.Table + "/" + rule.Name, Columns: map[string]string{
+			"table":     rule.Table,
+			"name":      rule.Name,
+			"target":    rule.Target,
+			"separator": rule.Separator,
+		}})
+	}
+	return rows, nil
+}
+
+// handleCascadeChange sets or drops a cascade rule, by path.  Setting one
+// takes admin on both tables.
+func (server *httpServer) handleCascadeChange(w http.ResponseWriter, r *http.Request) {
+	req := multiraft.CascadeRule{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Table == "" || req.Name == "" {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	create := strings.HasSuffix(r.URL.Path, "/_create")
+	if create {
+		if err := req.Validate(); err != nil {
+			server.logger.Error("Bad request, invalid cascade rule", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !server.checkTable(w, r, ActionAdmin, req.Target) {
+			return
+		}
+	}
+	if !server.checkTable(w, r, ActionAdmin, req.Table) {
+		return
+	}
+	if !server.checkWritable(w) {
+		return
+	}
+	var index uint64
+	var err error
+	if create {
+		index, err = server.node.SetCascade(r.Context(), req)
+	} else {
+		index, err = server.node.DropCascade(r.Context(), req.Table, req.Name)
+	}
+	if errors.Is(err, multiraft.ErrWritesFrozen) {
+		server.logger.Info("Rejecting cascade change", zap.Error(err))
+		statusUnavailable(w)
+		return
+	} else if err != nil {
+		server.logger.Error("Failed to change cascade", zap.String("table", req.Table), zap.String("cascade", req.Name), zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	response := struct {
+		Index uint64 `json:"index"`
+	}{
+		Index: index,
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+const (
+	// clusterIDFile, in the raft data dir, holds the ID of the cluster the
+	// node belongs to.
+	clusterIDFile = "cluster-id"
+	// identityRow holds the cluster's ID in the cluster table, the copy the
+	// nodes adopt theirs from.
+	identityRow     = "identity"
+	clusterIDColumn = "cluster_id"
+	clusterIDTag    = "cluster_id"
+	// clusterIDInterval is how often a node without a cluster ID looks for
+	// the replicated one, see adoptClusterID.
+	clusterIDInterval = 5 * time.Second
+)
+
+// loadClusterID returns the cluster ID recorded in the raft data dir.  A node
+// without one records --cluster-id, or a new ID when bootstrapping the
+// cluster; other nodes adopt the cluster's once they replicate it.
+func loadClusterID(dir, flag string, bootstrap bool) (string, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, clusterIDFile))
+	if err == nil {
+		id := strings.TrimSpace(string(buf))
+		if flag != "" && flag != id {
+			return "", fmt.Errorf("data dir %s belongs to cluster %q, not --cluster-id %q", dir, id, flag)
+		}
+		return id, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	id := flag
+	if id == "" && bootstrap {
+		if id, err = newClusterID(); err != nil {
+			return "", err
+		}
+	}
+	if id == "" {
+		return "", nil
+	}
+	return id, writeClusterID(dir, id)
+}
+
+func writeClusterID(dir, id string) error {
+	tmp := filepath.Join(dir, clusterIDFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(id), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, clusterIDFile))
+}
+
+// newClusterID returns a random (version 4) UUID.
+func newClusterID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// ClusterID returns the ID of the cluster this node belongs to, empty until
+// it has adopted one.
+func (n *server) ClusterID() string {
+	n.clusterIDMu.Lock()
+	defer n.clusterIDMu.Unlock()
+	return n.clusterID
+}
+
+// setClusterID records the cluster's ID on a node without one and gossips it.
+func (n *server) setClusterID(id string) error {
+	n.clusterIDMu.Lock()
+	defer n.clusterIDMu.Unlock()
+	if n.clusterID != "" {
+		return nil
+	}
+	if err := writeClusterID(n.config.RaftDataDir, id); err != nil {
+		return fmt.Errorf("recording cluster ID: %w", err)
+	}
+	n.clusterID = id
+	if err := n.serfAgent.SetTags(map[string]string{clusterIDTag: id}); err != nil {
+		return fmt.Errorf("gossiping cluster ID: %w", err)
+	}
+	n.logger.Info("adopted cluster ID", zap.String("cluster_id", id))
+	return nil
+}
+
+// ensureClusterID is run by the leader, see leaderLoop.  It replicates the
+// leader's cluster ID the first time the cluster gets a leader, or a new one
+// if the leader has none, like ensureClusterSecrets.
+func (n *server) ensureClusterID(ctx context.Context) error {
+	replicated, err := n.replicatedClusterID(ctx)
+	if err != nil {
+		return err
+	}
+	if replicated == "" {
+		id := n.ClusterID()
+		if id == "" {
+			if id, err = newClusterID(); err != nil {
+				return err
+			}
+		}
+		cols := map[string]string{clusterIDColumn: id}
+		neverWritten := uint64(0)
+		_, err := n.SetRow(ctx, clusterTable, identityRow, cols, false, &neverWritten)
+		if errors.Is(err, multiraft.ErrVersionMismatch) {
+			// another leader created it meanwhile, adopt that one.
+			if replicated, err = n.replicatedClusterID(ctx); err != nil {
+				return err
+			} else if replicated == "" {
+				return fmt.Errorf("cluster ID row holds no ID")
+			}
+		} else if err != nil {
+			return fmt.Errorf("creating cluster ID: %w", err)
+		} else {
+			replicated = id
+		}
+	}
+	return n.checkReplicatedClusterID(replicated)
+}
+
+// adoptClusterID waits for a node without a cluster ID to replicate the
+// cluster's and adopts it.
+func (n *server) adoptClusterID(ctx context.Context) {
+	ticker := time.NewTicker(clusterIDInterval)
+	defer ticker.Stop()
+	for n.ClusterID() == "" {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := n.shardAgent(shardID1); err != nil {
+			continue
+		}
+		id, err := n.replicatedClusterID(ctx)
+		if err != nil || id == "" {
+			continue
+		}
+		if err := n.checkReplicatedClusterID(id); err != nil {
+			n.logger.Error("failed to adopt cluster ID", zap.Error(err))
+		}
+	}
+}
+
+// checkReplicatedClusterID adopts the replicated cluster ID, or complains if
+// this node recorded another.
+func (n *server) checkReplicatedClusterID(id string) error {
+	if err := n.setClusterID(id); err != nil {
+		return err
+	}
+	if own := n.ClusterID(); own != id {
+		return fmt.Errorf("node belongs to cluster %q but replicates cluster %q", own, id)
+	}
+	return nil
+}
+
+func (n *server) replicatedClusterID(ctx context.Context) (string, error) {
+	row, _, err := n.GetRow(ctx, clusterTable, identityRow, 0, []string{clusterIDColumn})
+	if err != nil {
+		return "", fmt.Errorf("loading cluster ID: %w", err)
+	}
+	return row.Columns[clusterIDColumn], nil
+}
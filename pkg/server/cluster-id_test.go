@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/epsniff/expodb/pkg/config"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	machines "github.com/epsniff/expodb/pkg/server/state-machines"
+	"go.uber.org/zap"
+)
+
+func TestLoadClusterID(t *testing.T) {
+	dir := t.TempDir()
+	if id, err := loadClusterID(dir, "", false); err != nil || id != "" {
+		t.Fatalf("loadClusterID() of a joining node = %q, %v, want none", id, err)
+	}
+	id, err := loadClusterID(dir, "", true)
+	if err != nil || !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Fatalf("loadClusterID() when bootstrapping = %q, %v, want a UUID", id, err)
+	}
+	if again, err := loadClusterID(dir, "", true); err != nil || again != id {
+		t.Errorf("loadClusterID() after restart = %q, %v, want %q", again, err, id)
+	}
+	if _, err := loadClusterID(dir, "other", false); err == nil {
+		t.Errorf("loadClusterID() with another --cluster-id succeeded")
+	}
+
+	dir = t.TempDir()
+	if id, err := loadClusterID(dir, "prod", true); err != nil || id != "prod" {
+		t.Errorf("loadClusterID() with --cluster-id = %q, %v, want prod", id, err)
+	}
+}
+
+// identityAgent answers reads of the identity row with ids in turn, the last
+// one from then on, and rejects every write as already created.
+type identityAgent struct {
+	raftAgent
+	ids     []string
+	reads   int
+	applies int
+}
+
+func (a *identityAgent) Read(ctx context.Context, query interface{}) (interface{}, error) {
+	id := a.ids[len(a.ids)-1]
+	if a.reads < len(a.ids) {
+		id = a.ids[a.reads]
+	}
+	a.reads++
+	return &multiraft.Row{Columns: map[string]string{clusterIDColumn: id}}, nil
+}
+
+func (a *identityAgent) AppliedIndex() (uint64, error) { return 1, nil }
+
+func (a *identityAgent) ReadLocal(query interface{}) (interface{}, error) { return nil, nil }
+
+func (a *identityAgent) Apply(ctx context.Context, entry machines.RaftEntry) (uint64, error) {
+	a.applies++
+	return 0, multiraft.ErrVersionMismatch
+}
+
+func TestEnsureClusterID_CreatedMeanwhile(t *testing.T) {
+	tests := []struct {
+		name    string
+		ids     []string // replicated, before and after the write
+		wantErr bool
+	}{
+		{"same ID", []string{"", "c1"}, false},
+		{"another ID", []string{"", "c2"}, true},
+		{"still none", []string{""}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := &identityAgent{ids: tt.ids}
+			n := &server{raftAgents: map[uint64]raftAgent{shardID1: agent}, config: &config.Config{}, logger: zap.NewNop()}
+			n.clusterID = "c1"
+			err := n.ensureClusterID(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ensureClusterID() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if agent.applies != 1 || agent.reads != 2 {
+				t.Errorf("ensureClusterID() wrote %d times and read %d times, want once and twice", agent.applies, agent.reads)
+			}
+		})
+	}
+}
@@ -2,18 +2,46 @@ package server
 
 import (
 	"fmt"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/epsniff/expodb/pkg/config"
 	"github.com/hashicorp/serf/serf"
 )
 
+// nodeState is where a node is in its lifecycle.
+type nodeState string
+
+const (
+	nodeAlive  nodeState = "alive"
+	nodeFailed nodeState = "failed"
+	nodeLeft   nodeState = "left"
+	// nodeDecommissioned is set by an operator and is sticky: a decommissioned
+	// node that rejoins gossip stays decommissioned and isn't added to raft.
+	nodeDecommissioned nodeState = "decommissioned"
+)
+
+const (
+	// defaultNodeRole is used for members not advertising a role tag.
+	defaultNodeRole = "voter"
+)
+
 // metadata contains the state of cluster, and is used to
 // provide raft address and http address for nodes in the cluster.
+// Nodes are never removed, only moved between states, so it doubles as a
+// catalog of every node the cluster has seen.  The leader persists it to
+// the nodes system table, see node-catalog.go.
+//
+// nodedata values are immutable once stored, updates replace them.
 type metadata struct {
 	mu sync.RWMutex
 
 	nodesById      map[string]*nodedata
 	nodesByRaftAdd map[string]*nodedata
+
+	// leaderRaftAddr is the raft address of the current shard leader.
+	leaderRaftAddr string
 }
 
 func NewMetadata() *metadata {
@@ -23,7 +51,8 @@ func NewMetadata() *metadata {
 	}
 }
 
-// Add adds a node to the metadata.
+// Add adds a node to the metadata, or updates it, marking it alive unless it
+// has been decommissioned.
 func (m *metadata) Add(me serf.Member) (*nodedata, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -31,12 +60,88 @@ func (m *metadata) Add(me serf.Member) (*nodedata, error) {
 	if err != nil {
 		return nil, err
 	}
+	old, ok := m.nodesById[meta.id]
+	if ok && old.state == nodeDecommissioned {
+		meta.state = nodeDecommissioned
+	}
+	if ok && old.appliedIndex == meta.appliedIndex {
+		meta.appliedAt = old.appliedAt
+	} else if meta.appliedIndex != 0 {
+		meta.appliedAt = time.Now()
+	}
+	m.put(meta)
+	return meta, nil
+}
+
+// Restore adds a node loaded from the persisted catalog.  Nodes already known
+// from gossip win, except that a persisted decommission always sticks.
+func (m *metadata) Restore(node *nodedata) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old, ok := m.nodesById[node.id]
+	switch {
+	case !ok:
+		m.put(node)
+	case node.state == nodeDecommissioned && old.state != nodeDecommissioned:
+		updated := *old
+		updated.state = nodeDecommissioned
+		m.put(&updated)
+	}
+}
+
+// SetState moves a known node to a new state.  Leaving a decommissioned
+// state is not allowed, the node is returned unchanged.
+func (m *metadata) SetState(id string, state nodeState) (*nodedata, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old, ok := m.nodesById[id]
+	if !ok {
+		return nil, false
+	}
+	if old.state == nodeDecommissioned {
+		return old, true
+	}
+	updated := *old
+	updated.state = state
+	m.put(&updated)
+	return &updated, true
+}
+
+func (m *metadata) put(meta *nodedata) {
+	if old, ok := m.nodesById[meta.id]; ok && old.raftAddr != meta.raftAddr {
+		delete(m.nodesByRaftAdd, old.raftAddr)
+	}
 	m.nodesById[meta.id] = meta
 	m.nodesByRaftAdd[meta.raftAddr] = meta
-	return meta, nil
 }
 
-// FindByRaftAddr finds a node by its raft address.
+// FindByRole returns every node with the given role.
+func (m *metadata) FindByRole(role string) []*nodedata {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var nodes []*nodedata
+	for _, meta := range m.nodesById {
+		if meta.role == role {
+			nodes = append(nodes, meta)
+		}
+	}
+	return nodes
+}
+
+// Nodes returns every node in the catalog.
+func (m *metadata) Nodes() []*nodedata {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	nodes := make([]*nodedata, 0, len(m.nodesById))
+	for _, meta := range m.nodesById {
+		nodes = append(nodes, meta)
+	}
+	return nodes
+}
+
+// FindByID finds a node by its ID.
 func (m *metadata) FindByID(n string) (*nodedata, bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -54,10 +159,55 @@ func (m *metadata) FindByRaftAddr(n string) (*nodedata, bool) {
 	return meta, ok
 }
 
+// SetLeader records the raft address of the current leader, empty if unknown.
+func (m *metadata) SetLeader(raftAddr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.leaderRaftAddr = raftAddr
+}
+
+// Leader returns the current leader's node data, if known.
+func (m *metadata) Leader() (*nodedata, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	meta, ok := m.nodesByRaftAdd[m.leaderRaftAddr]
+	return meta, ok
+}
+
 type nodedata struct {
 	id       string
 	raftAddr string
 	httpAddr string
+	role     string
+	zone     string
+	state    nodeState
+	// clusterID is the --cluster-id the node gossips, empty if none.
+	clusterID string
+	// maintenance is gossiped by nodes in read-only maintenance mode.
+	maintenance bool
+	// appliedIndex is the last raft index the node gossiped as applied.
+	appliedIndex uint64
+	// appliedAt is when this node first heard of appliedIndex, zero for
+	// nodes restored from the catalog.
+	appliedAt time.Time
+	// joinTokenID and joinProof prove the node holds a join token, see
+	// the joinauth package.
+	joinTokenID string
+	joinProof   string
+	// compression is the raft traffic compression the node accepts, empty
+	// for none.
+	compression string
+	// replicaID is gossiped by demoted nodes, 0 for the others.
+	replicaID uint64
+	// noDemote exempts the node from autopilot demotions.
+	noDemote bool
+	// version and build are the release and git commit the node runs,
+	// fsmProtocol the raft entries it applies, see the version package.
+	// They are empty (0) for nodes restored from the catalog.
+	version     string
+	build       string
+	fsmProtocol int
 }
 
 // nodeDataFromSerf returns a nodedata from a serf member.
@@ -87,10 +237,56 @@ func nodeDataFromSerf(m serf.Member) (*nodedata, error) {
 	}
 	httpAddress := fmt.Sprintf("%s:%s", peerAddr, peerPort)
 
+	var appliedIndex uint64
+	if v, ok := m.Tags["applied_index"]; ok {
+		var err error
+		appliedIndex, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("metadata: invalid `applied_index` tag: %w", err)
+		}
+	}
+
+	var replicaID uint64
+	if v, ok := m.Tags["replica_id"]; ok {
+		var err error
+		replicaID, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("metadata: invalid `replica_id` tag: %w", err)
+		}
+	}
+
+	var fsmProtocol int
+	if v, ok := m.Tags["fsm_vsn"]; ok {
+		var err error
+		fsmProtocol, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("metadata: invalid `fsm_vsn` tag: %w", err)
+		}
+	}
+
+	role, ok := m.Tags["node_role"]
+	if !ok {
+		role = defaultNodeRole
+	}
+
 	return &nodedata{
-		id:       id,
-		raftAddr: raftAddress,
-		httpAddr: httpAddress,
+		id:           id,
+		raftAddr:     raftAddress,
+		httpAddr:     httpAddress,
+		role:         role,
+		zone:         m.Tags["zone"],
+		clusterID:    m.Tags["cluster_id"],
+		state:        nodeAlive,
+		maintenance:  m.Tags["maintenance"] == "1",
+		appliedIndex: appliedIndex,
+		joinTokenID:  m.Tags["join_token_id"],
+		joinProof:    m.Tags["join_proof"],
+		compression:  m.Tags["rpc_compression"],
+		replicaID:    replicaID,
+		noDemote:     m.Tags["no_demote"] == "1",
+		version:      m.Tags["ver"],
+		build:        m.Tags["build"],
+		fsmProtocol:  fsmProtocol,
 	}, nil
 }
 
@@ -108,3 +304,76 @@ func (n *nodedata) RaftAddr() string {
 func (n *nodedata) HttpAddr() string {
 	return n.httpAddr
 }
+
+// AppliedIndex returns the last raft index the node gossiped as applied.
+func (n *nodedata) AppliedIndex() uint64 {
+	return n.appliedIndex
+}
+
+// ReplicaID returns the non-voting replica ID a demoted node runs, 0 for
+// the others.
+func (n *nodedata) ReplicaID() uint64 {
+	return n.replicaID
+}
+
+// NoDemote reports whether the node is exempt from autopilot demotions.
+func (n *nodedata) NoDemote() bool {
+	return n.noDemote
+}
+
+// AppliedAt returns when the node's applied index was first heard of.
+func (n *nodedata) AppliedAt() time.Time {
+	return n.appliedAt
+}
+
+// Zone returns the availability zone the node advertises, empty if none.
+func (n *nodedata) Zone() string {
+	return n.zone
+}
+
+// Version returns the release the node runs, empty if unknown.
+func (n *nodedata) Version() string {
+	return n.version
+}
+
+// Build returns the git commit the node was built from, empty if unknown.
+func (n *nodedata) Build() string {
+	return n.build
+}
+
+// FSMProtocol returns the version of the raft entries the node applies, 0
+// if unknown.
+func (n *nodedata) FSMProtocol() int {
+	return n.fsmProtocol
+}
+
+// ClusterID returns the cluster ID the node gossips, empty if none.
+func (n *nodedata) ClusterID() string {
+	return n.clusterID
+}
+
+// Compression returns the raft traffic compression the node accepts, empty
+// if none.
+func (n *nodedata) Compression() string {
+	return n.compression
+}
+
+// Role returns the role the node advertises, e.g. voter.
+func (n *nodedata) Role() string {
+	return n.role
+}
+
+// IsWitness reports whether the node is a raft witness storing no data.
+func (n *nodedata) IsWitness() bool {
+	return n.role == config.NodeRoleWitness
+}
+
+// State returns the lifecycle state of the node.
+func (n *nodedata) State() nodeState {
+	return n.state
+}
+
+// InMaintenance reports whether the node is in read-only maintenance mode.
+func (n *nodedata) InMaintenance() bool {
+	return n.maintenance
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+const (
+	// clusterTable is the system table holding cluster wide settings.  It
+	// holds secrets too, so no client request reads it, see
+	// checkTableAccess.
+	clusterTable = "_cluster"
+	secretsRow   = "secrets"
+	// cursorKeyColumn holds the hex HMAC key scan cursors are signed with.
+	cursorKeyColumn = "cursor_key"
+)
+
+// ensureClusterSecrets is run by the leader, see leaderLoop.  It creates the
+// cluster's secrets the first time the cluster gets a leader.  The write is
+// conditional on the row never having been written, so two leaders racing
+// can't end up with different keys.
+func (n *server) ensureClusterSecrets(ctx context.Context) error {
+	if _, err := n.cursorKey(ctx); err == nil {
+		return nil
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	cols := map[string]string{cursorKeyColumn: hex.EncodeToString(secret)}
+	neverWritten := uint64(0)
+	_, err := n.SetRow(ctx, clusterTable, secretsRow, cols, false, &neverWritten)
+	if errors.Is(err, multiraft.ErrVersionMismatch) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("creating cluster secrets: %w", err)
+	}
+	n.logger.Info("cluster secrets created")
+	return nil
+}
+
+// cursorKey returns the key scan cursors are signed with.  It never changes
+// once created, so it's cached after the first read.
+func (n *server) cursorKey(ctx context.Context) ([]byte, error) {
+	n.secretsMu.Lock()
+	defer n.secretsMu.Unlock()
+	if n.cursorKeyCache != nil {
+		return n.cursorKeyCache, nil
+	}
+	row, _, err := n.GetRow(ctx, clusterTable, secretsRow, 0, []string{cursorKeyColumn})
+	if err != nil {
+		return nil, err
+	}
+	encoded, ok := row.Columns[cursorKeyColumn]
+	if !ok {
+		return nil, fmt.Errorf("cluster secrets not created yet")
+	}
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		n.logger.Error("corrupt cursor key in cluster secrets", zap.Error(err))
+		return nil, err
+	}
+	n.cursorKeyCache = key
+	return key, nil
+}
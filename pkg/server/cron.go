@@ -0,0 +1,410 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/errdefs"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	machines "github.com/epsniff/expodb/pkg/server/state-machines"
+	"github.com/epsniff/expodb/pkg/server/state-machines/cron"
+	"go.uber.org/zap"
+)
+
+const (
+	// cronInterval is how often the leader looks for jobs due.
+	cronInterval = time.Second
+	// cronSweepPage is the page of rows a ttl_sweep scans at a time.
+	cronSweepPage = 500
+	// cronWebhookTimeout bounds a webhook ping.
+	cronWebhookTimeout = 10 * time.Second
+)
+
+// cronAction is a built-in action jobs run.  check validates a job's args,
+// run runs it for the slot it was due at.
+type cronAction struct {
+	check func(args map[string]string) error
+	run   func(ctx context.Context, n *server, job cron.Job, slot time.Time) error
+}
+
+// cronActions are the actions jobs can run, by name:
+//
+//   - ttl_sweep deletes the rows of table whose column, _expires by default,
+//     holds a unix time in seconds that has passed.
+//   - compact compacts the leader's replica of table, or all of it.
+//   - backup exports a snapshot of the leader's replica under dir, on the
+//     leader, see ExportSnapshot.
+//   - webhook POSTs the job, the slot and the cluster ID as JSON to url.
+var cronActions = map[string]cronAction{
+	"ttl_sweep": {
+		check: func(args map[string]string) error {
+			if args["table"] == "" {
+				return errors.New("ttl_sweep needs a table")
+			}
+			return nil
+		},
+		run: func(ctx context.Context, n *server, job cron.Job, slot time.Time) error {
+			column := job.Args["column"]
+			if column == "" {
+				column = sourceExpiresColumn
+			}
+			_, err := n.sweepExpired(ctx, job.Args["table"], column, time.Now())
+			return err
+		},
+	},
+	"compact": {
+		check: func(args map[string]string) error { return nil },
+		run: func(ctx context.Context, n *server, job cron.Job, slot time.Time) error {
+			_, err := n.Compact(job.Args["table"])
+			return err
+		},
+	},
+	"backup": {
+		check: func(args map[string]string) error {
+			if args["dir"] == "" {
+				return errors.New("backup needs a dir")
+			}
+			return nil
+		},
+		run: func(ctx context.Context, n *server, job cron.Job, slot time.Time) error {
+			dir, err := n.ExportSnapshot(ctx, job.Args["dir"])
+			if err == nil {
+				n.logger.Info("Backed up", zap.String("job", job.Name), zap.String("dir", dir))
+			}
+			return err
+		},
+	},
+	"webhook": {
+		check: func(args map[string]string) error {
+			u, err := url.Parse(args["url"])
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("webhook url %q isn't an http(s) url", args["url"])
+			}
+			return nil
+		},
+		run: func(ctx context.Context, n *server, job cron.Job, slot time.Time) error {
+			return n.pingWebhook(ctx, job, slot)
+		},
+	},
+}
+
+// SetCronJob schedules a job, or changes one.  The job is first due after
+// now; a changed job keeps its last run.
+func (n *server) SetCronJob(ctx context.Context, job cron.Job) (uint64, error) {
+	if err := job.Validate(); err != nil {
+		return 0, errdefs.Wrap(errdefs.ErrInvalid, err)
+	}
+	action, ok := cronActions[job.Action]
+	if !ok {
+		return 0, errdefs.New(errdefs.ErrInvalid, fmt.Sprintf("unknown cron action %q", job.Action))
+	}
+	if err := action.check(job.Args); err != nil {
+		return 0, errdefs.Wrap(errdefs.ErrInvalid, err)
+	}
+	job.Created = time.Now().UnixNano()
+	return n.ApplyFSM(ctx, cron.Event{Job: &job})
+}
+
+// DropCronJob unschedules a job, a run in progress finishes.  Dropping a job
+// that doesn't exist is a no-op.
+func (n *server) DropCronJob(ctx context.Context, name string) (uint64, error) {
+	return n.ApplyFSM(ctx, cron.Event{Drop: name})
+}
+
+// CronJobs returns the jobs and their last runs, sorted by name.
+func (n *server) CronJobs(ctx context.Context) ([]cron.Status, error) {
+	res, err := n.ReadFSM(ctx, cron.FSMName, cron.ListQuery{})
+	if err != nil {
+		return nil, err
+	}
+	list, ok := res.([]cron.Status)
+	if !ok {
+		return nil, fmt.Errorf("converting result to []cron.Status: %T", res)
+	}
+	return list, nil
+}
+
+// runCron runs the jobs due while this node leads.  A run is claimed through
+// raft before it starts and only the leader whose claim the job holds runs
+// it, so a slot runs at most once across leadership changes; slots missed
+// while no leader ran them run once, for the latest.  Runs use ctx, they
+// are canceled when leadership is lost and not retried.
+func (n *server) runCron(ctx context.Context) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		n.logger.Error("failed to run cron jobs", zap.Error(err))
+		return
+	}
+	ticker := time.NewTicker(cronInterval)
+	defer ticker.Stop()
+	running := map[string]bool{}
+	finished := make(chan string)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case name := <-finished:
+			delete(running, name)
+			continue
+		case <-ticker.C:
+		}
+		res, err := agent.ReadLocal(machines.NamedQuery{Machine: cron.FSMName, Query: cron.ListQuery{}})
+		if err != nil {
+			n.logger.Warn("failed to list cron jobs", zap.Error(err))
+			continue
+		}
+		jobs, _ := res.([]cron.Status)
+		now := time.Now()
+		for _, st := range jobs {
+			if running[st.Job.Name] {
+				continue
+			}
+			slot, ok := dueSlot(st, now)
+			if !ok {
+				continue
+			}
+			token, ok := n.claimCronRun(ctx, agent, st.Job.Name, slot)
+			if !ok {
+				continue
+			}
+			running[st.Job.Name] = true
+			go func(job cron.Job) {
+				n.runCronJob(ctx, job, slot, token)
+				select {
+				case finished <- job.Name:
+				case <-ctx.Done():
+				}
+			}(st.Job)
+		}
+	}
+}
+
+// dueSlot returns the latest time a job was due at, at or before now, that
+// it hasn't run for, false when there is none.
+func dueSlot(st cron.Status, now time.Time) (time.Time, bool) {
+	sched, err := cron.ParseSchedule(st.Job.Schedule)
+	if err != nil {
+		return time.Time{}, false
+	}
+	from := st.Job.Created
+	if st.Last != nil && st.Last.Slot > from {
+		from = st.Last.Slot
+	}
+	slot := sched.Next(time.Unix(0, from))
+	if slot.IsZero() || slot.After(now) {
+		return time.Time{}, false
+	}
+	for {
+		next := sched.Next(slot)
+		if next.IsZero() || next.After(now) {
+			return slot, true
+		}
+		slot = next
+	}
+}
+
+// claimCronRun claims the run of a job for slot and reports whether the
+// claim won, with its token.
+func (n *server) claimCronRun(ctx context.Context, agent raftAgent, name string, slot time.Time) (string, bool) {
+	token, err := newTxnID()
+	if err != nil {
+		n.logger.Warn("failed to claim cron run", zap.String("job", name), zap.Error(err))
+		return "", false
+	}
+	claim := &cron.Claim{Name: name, Slot: slot.UnixNano(), Node: n.config.ID(), Token: token, At: time.Now().UnixNano()}
+	if _, err := n.ApplyFSM(ctx, cron.Event{Claim: claim}); err != nil {
+		if ctx.Err() == nil {
+			n.logger.Warn("failed to claim cron run", zap.String("job", name), zap.Error(err))
+		}
+		return "", false
+	}
+	// the claim applied locally, the job holds its token unless an earlier
+	// claim for the slot or a later one won.
+	res, err := agent.ReadLocal(machines.NamedQuery{Machine: cron.FSMName, Query: cron.ListQuery{}})
+	if err != nil {
+		return "", false
+	}
+	jobs, _ := res.([]cron.Status)
+	for _, st := range jobs {
+		if st.Job.Name == name {
+			return token, st.Last != nil && st.Last.Token == token
+		}
+	}
+	return "", false
+}
+
+// runCronJob runs a claimed job and records how the run ended.
+func (n *server) runCronJob(ctx context.Context, job cron.Job, slot time.Time, token string) {
+	start := time.Now()
+	err := errdefs.New(errdefs.ErrInvalid, fmt.Sprintf("unknown cron action %q", job.Action))
+	if action, ok := cronActions[job.Action]; ok {
+		err = action.run(ctx, n, job, slot)
+	}
+	done := &cron.Done{Name: job.Name, Token: token, Duration: time.Since(start)}
+	if err != nil {
+		done.Error = err.Error()
+		n.logger.Warn("cron job failed", zap.String("job", job.Name), zap.Time("slot", slot), zap.Error(err))
+	} else {
+		n.logger.Info("Ran cron job", zap.String("job", job.Name), zap.Time("slot", slot), zap.Duration("duration", done.Duration))
+	}
+	if _, err := n.ApplyFSM(ctx, cron.Event{Done: done}); err != nil && ctx.Err() == nil {
+		n.logger.Warn("failed to record cron run", zap.String("job", job.Name), zap.Error(err))
+	}
+}
+
+// sweepExpired deletes the rows of table whose column holds a unix time in
+// seconds at or before now and returns how many it deleted.  A row written
+// since it was scanned is left alone.
+func (n *server) sweepExpired(ctx context.Context, table, column string, now time.Time) (int, error) {
+	var deleted int
+	after := ""
+	for {
+		page, _, err := n.ScanPage(ctx, table, after, cronSweepPage, ConsistencyGlobal)
+		if err != nil {
+			return deleted, err
+		}
+		for _, row := range page.Rows {
+			expires, err := strconv.ParseInt(row.Columns[column], 10, 64)
+			if err != nil || expires > now.Unix() {
+				continue
+			}
+			version := row.Version
+			_, err = n.applyWrite(ctx, multiraft.KVData{Op: multiraft.OpDeleteRow, Table: table, Row: row.Key, IfMatch: &version})
+			if errors.Is(err, multiraft.ErrVersionMismatch) {
+				continue
+			} else if err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+		if !page.More || len(page.Rows) == 0 {
+			return deleted, nil
+		}
+		after = page.Rows[len(page.Rows)-1].Key
+	}
+}
+
+// pingWebhook POSTs a job's run to its url.
+func (n *server) pingWebhook(ctx context.Context, job cron.Job, slot time.Time) error {
+	body, err := json.Marshal(struct {
+		Job       string `json:"job"`
+		Slot      string `json:"slot"`
+		ClusterID string `json:"cluster_id"`
+	}{
+		Job:       job.Name,
+		Slot:      slot.UTC().Format(time.RFC3339),
+		ClusterID: n.ClusterID(),
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, cronWebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.Args["url"], bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook answered %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+func (server *httpServer) handleCronJobs(w http.ResponseWriter, r *http.Request) {
+	list, err := server.node.CronJobs(r.Context())
+	if err != nil {
+		server.logger.Error("Failed to list cron jobs", zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	type runView struct {
+		Slot     string `json:"slot"`
+		Node     string `json:"node"`
+		Started  string `json:"started"`
+		Finished bool   `json:"finished"`
+		Error    string `json:"error,omitempty"`
+		Duration string `json:"duration,omitempty"`
+	}
+	type jobView struct {
+		Name     string            `json:"name"`
+		Schedule string            `json:"schedule"`
+		Action   string            `json:"action"`
+		Args     map[string]string `json:"args,omitempty"`
+		Next     string            `json:"next,omitempty"`
+		Last     *runView          `json:"last,omitempty"`
+	}
+	formatTime := func(nanos int64) string {
+		return time.Unix(0, nanos).UTC().Format(time.RFC3339)
+	}
+	views := make([]jobView, 0, len(list))
+	now := time.Now()
+	for _, st := range list {
+		view := jobView{Name: st.Job.Name, Schedule: st.Job.Schedule, Action: st.Job.Action, Args: st.Job.Args}
+		if sched, err := cron.ParseSchedule(st.Job.Schedule); err == nil {
+			if next := sched.Next(now); !next.IsZero() {
+				view.Next = next.Format(time.RFC3339)
+			}
+		}
+		if last := st.Last; last != nil {
+			view.Last = &runView{Slot: formatTime(last.Slot), Node: last.Node, Started: formatTime(last.Started),
+				Finished: last.Finished, Error: last.Error}
+			if last.Finished {
+				view.Last.Duration = last.Duration.String()
+			}
+		}
+		views = append(views, view)
+	}
+	respond(w, http.StatusOK, map[string][]jobView{"jobs": views}, server.logger)
+}
+
+func (server *httpServer) handleCronJobChange(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Name     string            `json:"name"`
+		Schedule string            `json:"schedule"`
+		Action   string            `json:"action"`
+		Args     map[string]string `json:"args"`
+	}{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !server.checkWritable(w) {
+		return
+	}
+	var index uint64
+	var err error
+	if strings.HasSuffix(r.URL.Path, "/_create") {
+		index, err = server.node.SetCronJob(r.Context(), cron.Job{Name: req.Name, Schedule: req.Schedule, Action: req.Action, Args: req.Args})
+	} else {
+		index, err = server.node.DropCronJob(r.Context(), req.Name)
+	}
+	if err != nil {
+		server.logger.Error("Failed to change cron job", zap.String("job", req.Name), zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	response := struct {
+		Index uint64 `json:"index"`
+	}{
+		Index: index,
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/server/state-machines/cron"
+)
+
+func TestDueSlot(t *testing.T) {
+	created := time.Date(2024, 1, 1, 0, 0, 30, 0, time.UTC)
+	at := func(min int) int64 {
+		return created.Truncate(time.Minute).Add(time.Duration(min) * time.Minute).UnixNano()
+	}
+	job := cron.Job{Name: "j", Schedule: "*/5 * * * *", Action: "compact", Created: created.UnixNano()}
+	tests := []struct {
+		name string
+		last *cron.Run
+		now  time.Time
+		want int64
+	}{
+		{"not yet due", nil, created.Add(4 * time.Minute), 0},
+		{"first slot", nil, created.Add(5 * time.Minute), at(5)},
+		{"missed slots run once", nil, created.Add(22 * time.Minute), at(20)},
+		{"already ran", &cron.Run{Slot: at(20)}, created.Add(22 * time.Minute), 0},
+		{"after the last run", &cron.Run{Slot: at(5)}, created.Add(11 * time.Minute), at(10)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slot, ok := dueSlot(cron.Status{Job: job, Last: tt.last}, tt.now)
+			if tt.want == 0 {
+				if ok {
+					t.Errorf("dueSlot() = %v, want none", slot)
+				}
+				return
+			}
+			if !ok || slot.UnixNano() != tt.want {
+				t.Errorf("dueSlot() = %v, %v, want %v", slot, ok, time.Unix(0, tt.want).UTC())
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// ConsistencySnapshot reads every shard from its local replica as is.  It
+	// is fast, but shards may lag their leaders by different amounts, so the
+	// result can mix older and newer states.
+	ConsistencySnapshot = "snapshot"
+	// ConsistencyGlobal first coordinates a read index with the leader of
+	// every shard, then reads each shard at its index.  The result observes
+	// every write acked before the query started, on every shard.
+	ConsistencyGlobal = "global"
+)
+
+// queryMeta reports how a query spanning several shards was served.
+type queryMeta struct {
+	Consistency string `json:"consistency"`
+	// Shards maps each shard read to the raft index it was read at.  For
+	// snapshot reads it is a lower bound.
+	Shards map[uint64]uint64 `json:"shards"`
+}
+
+// validConsistency reports whether c names a cross-shard consistency level,
+// the empty string defaults to ConsistencyGlobal.
+func validConsistency(c string) bool {
+	return c == "" || c == ConsistencySnapshot || c == ConsistencyGlobal
+}
+
+// queryShards runs query against every shard hosted by this node.
+func (n *server) queryShards(ctx context.Context, query interface{}, consistency string) (map[uint64]interface{}, *queryMeta, error) {
+	if consistency == "" {
+		consistency = ConsistencyGlobal
+	}
+	if !validConsistency(consistency) {
+		return nil, nil, fmt.Errorf("unknown consistency %q", consistency)
+	}
+	n.raftAgentsMu.Lock()
+	agents := make(map[uint64]raftAgent, len(n.raftAgents))
+	for id, agent := range n.raftAgents {
+		agents[id] = agent
+	}
+	n.raftAgentsMu.Unlock()
+	if len(agents) == 0 {
+		return nil, nil, fmt.Errorf("no shards hosted on this node")
+	}
+
+	meta := &queryMeta{Consistency: consistency, Shards: map[uint64]uint64{}}
+	// coordinate the read indexes of every shard before reading any of them.
+	if consistency == ConsistencyGlobal {
+		var mu sync.Mutex
+		g, gctx := errgroup.WithContext(ctx)
+		for id, agent := range agents {
+			id, agent := id, agent
+			g.Go(func() error {
+				index, err := agent.ReadIndex(gctx)
+				if err != nil {
+					return fmt.Errorf("shard %d read index: %w", id, err)
+				}
+				mu.Lock()
+				meta.Shards[id] = index
+				mu.Unlock()
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	results := make(map[uint64]interface{}, len(agents))
+	var mu sync.Mutex
+	g, gctx := errgroup.WithContext(ctx)
+	for id, agent := range agents {
+		id, agent := id, agent
+		g.Go(func() error {
+			var res interface{}
+			var err error
+			if consistency == ConsistencyGlobal {
+				res, err = agent.ReadAtIndex(gctx, query, meta.Shards[id])
+			} else {
+				var applied uint64
+				if applied, err = agent.AppliedIndex(); err == nil {
+					mu.Lock()
+					meta.Shards[id] = applied
+					mu.Unlock()
+					res, err = agent.ReadLocal(query)
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("shard %d: %w", id, err)
+			}
+			mu.Lock()
+			results[id] = res
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, nil, err
+	}
+	return results, meta, nil
+}
+
+// ScanPage returns up to limit rows of a table, in row key order, starting
+// after the row key after.  Every shard is scanned and the pages merged, see
+// queryShards for the consistency levels.
+func (n *server) ScanPage(ctx context.Context, table, after string, limit int, consistency string) (*multiraft.ScanPage, *queryMeta, error) {
+	return n.scanPage(ctx, multiraft.ScanPageQuery{Table: table, After: after, Limit: limit}, consistency)
+}
+
+// ScanPageReverse is ScanPage in descending row key order, starting below
+// the row key before, from the end when empty.
+func (n *server) ScanPageReverse(ctx context.Context, table, before string, limit int, consistency string) (*multiraft.ScanPage, *queryMeta, error) {
+	return n.scanPage(ctx, multiraft.ScanPageQuery{Table: table, After: before, Limit: limit, Reverse: true}, consistency)
+}
+
+func (n *server) scanPage(ctx context.Context, query multiraft.ScanPageQuery, consistency string) (*multiraft.ScanPage, *queryMeta, error) {
+	results, meta, err := n.queryShards(ctx, query, consistency)
+	if err != nil {
+		return nil, nil, err
+	}
+	merged := &multiraft.ScanPage{}
+	for _, val := range results {
+		page, ok := val.(*multiraft.ScanPage)
+		if !ok {
+			return nil, nil, fmt.Errorf("converting result to *multiraft.ScanPage: %T", val)
+		}
+		merged.Rows = append(merged.Rows, page.Rows...)
+		merged.More = merged.More || page.More
+	}
+	sort.Slice(merged.Rows, func(i, j int) bool { return (merged.Rows[i].Key < merged.Rows[j].Key) != query.Reverse })
+	if len(merged.Rows) > query.Limit {
+		merged.Rows = merged.Rows[:query.Limit]
+		merged.More = true
+	}
+	return merged, meta, nil
+}
+
+// ListKeys lists a table's keys like multiraft.ListKeysQuery, merging the
+// listings of every shard hosted by the node.
+func (n *server) ListKeys(ctx context.Context, query multiraft.ListKeysQuery, consistency string) (*multiraft.KeyListing, *queryMeta, error) {
+	results, meta, err := n.queryShards(ctx, query, consistency)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys, prefixes := map[string]struct{}{}, map[string]struct{}{}
+	more := false
+	for _, val := range results {
+		listing, ok := val.(*multiraft.KeyListing)
+		if !ok {
+			return nil, nil, fmt.Errorf("converting result to *multiraft.KeyListing: %T", val)
+		}
+		for _, k := range listing.Keys {
+			keys[k] = struct{}{}
+		}
+		for _, p := range listing.CommonPrefixes {
+			prefixes[p] = struct{}{}
+		}
+		more = more || listing.More
+	}
+	// the first Limit of them in order, as a single shard would list them.
+	type entry struct {
+		name   string
+		prefix bool
+	}
+	entries := make([]entry, 0, len(keys)+len(prefixes))
+	for k := range keys {
+		entries = append(entries, entry{k, false})
+	}
+	for p := range prefixes {
+		entries = append(entries, entry{p, true})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	if len(entries) > query.Limit {
+		entries, more = entries[:query.Limit], true
+	}
+	merged := &multiraft.KeyListing{Keys: []string{}, CommonPrefixes: []string{}, More: more}
+	for _, e := range entries {
+		if e.prefix {
+			merged.CommonPrefixes = append(merged.CommonPrefixes, e.name)
+		} else {
+			merged.Keys = append(merged.Keys, e.name)
+		}
+	}
+	return merged, meta, nil
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/epsniff/expodb/pkg/config"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+// pageAgent is a shard answering scans with its rows, at readIndex when
+// read through the leader and at applied when read locally.
+type pageAgent struct {
+	raftAgent
+	rows              []multiraft.ScanRow
+	readIndex         uint64
+	applied           uint64
+	readIndexErr      error
+	readAt, readLocal bool
+}
+
+func (a *pageAgent) ReadIndex(ctx context.Context) (uint64, error) {
+	return a.readIndex, a.readIndexErr
+}
+
+func (a *pageAgent) ReadAtIndex(ctx context.Context, query interface{}, minIndex uint64) (interface{}, error) {
+	a.readAt = true
+	return a.page(query.(multiraft.ScanPageQuery)), nil
+}
+
+func (a *pageAgent) AppliedIndex() (uint64, error) { return a.applied, nil }
+
+func (a *pageAgent) ReadLocal(query interface{}) (interface{}, error) {
+	a.readLocal = true
+	return a.page(query.(multiraft.ScanPageQuery)), nil
+}
+
+func (a *pageAgent) page(q multiraft.ScanPageQuery) *multiraft.ScanPage {
+	page := &multiraft.ScanPage{}
+	for _, row := range a.rows {
+		if len(page.Rows) == q.Limit {
+			page.More = true
+			break
+		}
+		page.Rows = append(page.Rows, row)
+	}
+	return page
+}
+
+func TestQueryShards(t *testing.T) {
+	tests := []struct {
+		consistency  string
+		readIndexErr error
+		wantShards   map[uint64]uint64
+		wantLocal    bool
+		wantErr      bool
+	}{
+		{"", nil, map[uint64]uint64{1: 10, 2: 20}, false, false},
+		{ConsistencyGlobal, nil, map[uint64]uint64{1: 10, 2: 20}, false, false},
+		{ConsistencySnapshot, nil, map[uint64]uint64{1: 7, 2: 17}, true, false},
+		{ConsistencySnapshot, errors.New("no leader"), map[uint64]uint64{1: 7, 2: 17}, true, false},
+		{ConsistencyGlobal, errors.New("no leader"), nil, false, true},
+		{"linearizable", nil, nil, false, true},
+	}
+	for _, tt := range tests {
+		a1 := &pageAgent{readIndex: 10, applied: 7, readIndexErr: tt.readIndexErr}
+		a2 := &pageAgent{readIndex: 20, applied: 17}
+		n := &server{raftAgents: map[uint64]raftAgent{1: a1, 2: a2}, config: &config.Config{}, logger: zap.NewNop()}
+		results, meta, err := n.queryShards(context.Background(), multiraft.ScanPageQuery{Table: "t", Limit: 10}, tt.consistency)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("queryShards(%q) with read index error %v: no error", tt.consistency, tt.readIndexErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("queryShards(%q) error = %v", tt.consistency, err)
+		}
+		if len(results) != 2 || !reflect.DeepEqual(meta.Shards, tt.wantShards) {
+			t.Errorf("queryShards(%q) = %d results, shards %v, want 2, %v", tt.consistency, len(results), meta.Shards, tt.wantShards)
+		}
+		if a1.readLocal != tt.wantLocal || a1.readAt == tt.wantLocal {
+			t.Errorf("queryShards(%q) read locally %v, at an index %v, want locally %v", tt.consistency, a1.readLocal, a1.readAt, tt.wantLocal)
+		}
+	}
+}
+
+func TestScanPage_Merge(t *testing.T) {
+	row := func(key string) multiraft.ScanRow { return multiraft.ScanRow{Key: key} }
+	tests := []struct {
+		name     string
+		limit    int
+		reverse  bool
+		want     []string
+		wantMore bool
+	}{
+		{"merged in order", 10, false, []string{"a", "b", "c", "d"}, false},
+		{"merged in reverse", 10, true, []string{"d", "c", "b", "a"}, false},
+		{"cut at the limit", 3, false, []string{"a", "b", "c"}, true},
+		{"more on a shard", 1, false, []string{"a"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a1 := &pageAgent{rows: []multiraft.ScanRow{row("a"), row("c")}}
+			a2 := &pageAgent{rows: []multiraft.ScanRow{row("b"), row("d")}}
+			if tt.reverse {
+				a1.rows[0], a1.rows[1] = a1.rows[1], a1.rows[0]
+				a2.rows[0], a2.rows[1] = a2.rows[1], a2.rows[0]
+			}
+			n := &server{raftAgents: map[uint64]raftAgent{1: a1, 2: a2}, config: &config.Config{}, logger: zap.NewNop()}
+			page, _, err := n.scanPage(context.Background(), multiraft.ScanPageQuery{Table: "t", Limit: tt.limit, Reverse: tt.reverse}, ConsistencySnapshot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, r := range page.Rows {
+				got = append(got, r.Key)
+			}
+			if !reflect.DeepEqual(got, tt.want) || page.More != tt.wantMore {
+				t.Errorf("scanPage() = %v, more %v, want %v, more %v", got, page.More, tt.want, tt.wantMore)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCursor_RoundTrip(t *testing.T) {
+	key := []byte("secret")
+	want := scanCursor{Table: "users", After: "row:42"}
+	token, err := signCursor(key, want)
+	if err != nil {
+		t.Fatalf("signCursor() error = %v", err)
+	}
+	got, err := parseCursor(key, token)
+	if err != nil {
+		t.Fatalf("parseCursor() error = %v", err)
+	}
+	if got != want {
+		t.Errorf("parseCursor() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCursor_RejectsTampering(t *testing.T) {
+	key := []byte("secret")
+	token, _ := signCursor(key, scanCursor{Table: "users", After: "a"})
+	forged, _ := signCursor([]byte("other"), scanCursor{Table: "_nodes", After: "a"})
+	payload, sig, _ := strings.Cut(token, ".")
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+
+	tests := map[string]string{
+		"wrong key":        forged,
+		"swapped payload":  forgedPayload + "." + sig,
+		"truncated sig":    payload + "." + sig[:len(sig)-2],
+		"no signature":     payload,
+		"garbage":          "not a cursor",
+		"empty":            "",
+		"payload not json": cursorEncoding.EncodeToString([]byte("x")) + "." + sig,
+	}
+	for name, tok := range tests {
+		if _, err := parseCursor(key, tok); err != ErrInvalidCursor {
+			t.Errorf("%s: parseCursor() error = %v, want ErrInvalidCursor", name, err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// dataDirLayout is the version of the data dir layout this release writes.
+// Bump it when the layout changes and register the migration from the old
+// layout in layoutMigrations.
+const dataDirLayout = 1
+
+const (
+	layoutFile = "expodb-layout.json"
+	lockFile   = "expodb.lock"
+)
+
+// layoutMigrations upgrade a data dir from the layout they are keyed by to
+// the next one.  A release that can't upgrade a layout leaves it out, nodes
+// then refuse to start on it and have to go through an intermediate release.
+var layoutMigrations = map[int]func(dir string) error{}
+
+// layoutMarker is written into every data dir, it records the layout the
+// dir is in and the node it belongs to.
+type layoutMarker struct {
+	Layout int    `json:"layout"`
+	Node   string `json:"node"`
+}
+
+// openDataDir creates dir if needed, locks it for this process and checks
+// it belongs to node and is in a layout this release reads, upgrading older
+// layouts.  Dirs written before markers existed are adopted.  The lock is
+// held until the returned file is closed or the process exits.
+func openDataDir(dir, node string) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("data dir %s is in use by another process", dir)
+		}
+		return nil, fmt.Errorf("locking data dir %s: %w", dir, err)
+	}
+	if err := checkLayout(dir, node); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// openDataDirs opens each of dirs as openDataDir does, once: nodes may keep
+// their serf and raft data in the same dir.  Nothing is left locked when a
+// dir can't be opened.
+func openDataDirs(node string, dirs ...string) ([]*os.File, error) {
+	var locks []*os.File
+	opened := map[string]bool{}
+	for _, dir := range dirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			closeDataDirs(locks)
+			return nil, err
+		}
+		if opened[abs] {
+			continue
+		}
+		opened[abs] = true
+		lock, err := openDataDir(dir, node)
+		if err != nil {
+			closeDataDirs(locks)
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+	return locks, nil
+}
+
+// closeDataDirs releases the locks openDataDirs took.
+func closeDataDirs(locks []*os.File) {
+	for _, lock := range locks {
+		lock.Close()
+	}
+}
+
+func checkLayout(dir, node string) error {
+	path := filepath.Join(dir, layoutFile)
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return writeLayoutMarker(dir, layoutMarker{Layout: dataDirLayout, Node: node})
+	}
+	if err != nil {
+		return err
+	}
+	var m layoutMarker
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if m.Node != node {
+		return fmt.Errorf("data dir %s belongs to node %q, not %q: start it with --node-name=%s or point this node at its own dir", dir, m.Node, node, m.Node)
+	}
+	if m.Layout > dataDirLayout {
+		return fmt.Errorf("data dir %s is in layout %d, written by a newer release, this one reads up to layout %d", dir, m.Layout, dataDirLayout)
+	}
+	for m.Layout < dataDirLayout {
+		migrate, ok := layoutMigrations[m.Layout]
+		if !ok {
+			return fmt.Errorf("data dir %s is in layout %d, which this release can't upgrade, upgrade through an older release first", dir, m.Layout)
+		}
+		if err := migrate(dir); err != nil {
+			return fmt.Errorf("upgrading data dir %s from layout %d: %w", dir, m.Layout, err)
+		}
+		m.Layout++
+		if err := writeLayoutMarker(dir, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeLayoutMarker replaces the marker atomically, a crash mid-upgrade
+// leaves the previous layout recorded so the migration is run again.
+func writeLayoutMarker(dir string, m layoutMarker) error {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, layoutFile+".tmp")
+	if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, layoutFile))
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOpenDataDir(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := openDataDir(dir, "node-1")
+	if err != nil {
+		t.Fatalf("openDataDir() error = %v", err)
+	}
+	if _, err := openDataDir(dir, "node-1"); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("openDataDir() of a locked dir error = %v, want in use", err)
+	}
+	lock.Close()
+
+	if _, err := openDataDir(dir, "node-2"); err == nil || !strings.Contains(err.Error(), "belongs to node") {
+		t.Errorf("openDataDir() of another node's dir error = %v, want belongs to node", err)
+	}
+
+	if err := writeLayoutMarker(dir, layoutMarker{Layout: dataDirLayout + 1, Node: "node-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openDataDir(dir, "node-1"); err == nil || !strings.Contains(err.Error(), "newer release") {
+		t.Errorf("openDataDir() of a newer layout error = %v, want newer release", err)
+	}
+
+	upgraded := false
+	layoutMigrations[dataDirLayout-1] = func(string) error { upgraded = true; return nil }
+	defer delete(layoutMigrations, dataDirLayout-1)
+	if err := writeLayoutMarker(dir, layoutMarker{Layout: dataDirLayout - 1, Node: "node-1"}); err != nil {
+		t.Fatal(err)
+	}
+	lock, err = openDataDir(dir, "node-1")
+	if err != nil || !upgraded {
+		t.Fatalf("openDataDir() of an older layout error = %v, upgraded = %v", err, upgraded)
+	}
+	lock.Close()
+	if err := checkLayout(dir, "node-1"); err != nil {
+		t.Errorf("checkLayout() after the upgrade error = %v", err)
+	}
+}
+
+func TestOpenDataDirs(t *testing.T) {
+	dir, other := t.TempDir(), t.TempDir()
+	locks, err := openDataDirs("node-1", dir, dir+"/", other)
+	if err != nil {
+		t.Fatalf("openDataDirs() of a dir listed twice error = %v", err)
+	}
+	if len(locks) != 2 {
+		t.Errorf("openDataDirs() took %d locks, want 2", len(locks))
+	}
+	closeDataDirs(locks)
+
+	held, err := openDataDir(other, "node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	if _, err := openDataDirs("node-1", dir, other); err == nil {
+		t.Fatal("openDataDirs() with a dir in use succeeded")
+	}
+	lock, err := openDataDir(dir, "node-1")
+	if err != nil {
+		t.Fatalf("dir still locked after openDataDirs() failed: %v", err)
+	}
+	lock.Close()
+}
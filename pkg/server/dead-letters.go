@@ -0,0 +1,311 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/errdefs"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+// deadLettersTable is the system table the deliveries a sink kept failing
+// are moved to, one row per delivery keyed "<sink>:<index>" with the index
+// zero padded, so a sink's rows scan together in index order.  Only admins
+// can read them, through the dead letter API.
+const deadLettersTable = "_dead_letters"
+
+// errReplayFailed is returned when a sink fails dead-lettered deliveries
+// again, they stay dead-lettered.
+var errReplayFailed = errors.New("sink failed the replayed deliveries")
+
+// deadLetterColumns are the columns of a dead letter's row.
+var deadLetterColumns = []string{"sink", "id", "index", "changes", "error", "attempts", "time"}
+
+// deadLetter is a dead-lettered delivery, with the error of its last
+// attempt and when it was dead-lettered.
+type deadLetter struct {
+	Sink     string       `json:"sink"`
+	Delivery sinkDelivery `json:"delivery"`
+	Error    string       `json:"error"`
+	Attempts int          `json:"attempts"`
+	Time     string       `json:"time"`
+}
+
+func deadLetterKey(sink string, index uint64) string {
+	return fmt.Sprintf("%s:%020d", sink, index)
+}
+
+// deadLetterWrites returns the writes storing a dead letter.
+func deadLetterWrites(dl deadLetter) ([]multiraft.TxnWrite, error) {
+	changes, err := json.Marshal(dl.Delivery.Changes)
+	if err != nil {
+		return nil, err
+	}
+	cols := map[string]string{
+		"sink":     dl.Sink,
+		"id":       dl.Delivery.ID,
+		"index":    strconv.FormatUint(dl.Delivery.Index, 10),
+		"changes":  string(changes),
+		"error":    dl.Error,
+		"attempts": strconv.Itoa(dl.Attempts),
+		"time":     dl.Time,
+	}
+	key := deadLetterKey(dl.Sink, dl.Delivery.Index)
+	writes := make([]multiraft.TxnWrite, 0, len(cols))
+	for col, val := range cols {
+		writes = append(writes, multiraft.TxnWrite{Table: deadLettersTable, Row: key, Column: col, Val: val})
+	}
+	return writes, nil
+}
+
+// parseDeadLetter reads a dead letter back from its row.
+func parseDeadLetter(row multiraft.ScanRow) (deadLetter, error) {
+	dl := deadLetter{
+		Sink:     row.Columns["sink"],
+		Delivery: sinkDelivery{ID: row.Columns["id"]},
+		Error:    row.Columns["error"],
+		Time:     row.Columns["time"],
+	}
+	var err error
+	if dl.Delivery.Index, err = strconv.ParseUint(row.Columns["index"], 10, 64); err != nil {
+		return dl, fmt.Errorf("dead letter %s: bad index: %w", row.Key, err)
+	}
+	if err := json.Unmarshal([]byte(row.Columns["changes"]), &dl.Delivery.Changes); err != nil {
+		return dl, fmt.Errorf("dead letter %s: bad changes: %w", row.Key, err)
+	}
+	dl.Attempts, _ = strconv.Atoi(row.Columns["attempts"])
+	return dl, nil
+}
+
+// deadLetterSink moves the batch of outbox entries a sink keeps failing to
+// deadLettersTable, in a single raft entry, and acknowledges it so the sink
+// moves on.  The batch is read again from the sink's offset, a leader
+// failing in between dead-letters it again under the same keys.
+func (n *server) deadLetterSink(ctx context.Context, sink multiraft.Sink, attempts int, cause error) error {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return err
+	}
+	entries, err := sinkBatchAfter(ctx, agent, sink)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	deliveries := sinkDeliveries(sink, n.ClusterID(), entries)
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	var writes []multiraft.TxnWrite
+	for _, d := range deliveries {
+		w, err := deadLetterWrites(deadLetter{Sink: sink.Name, Delivery: d, Error: cause.Error(), Attempts: attempts, Time: now})
+		if err != nil {
+			return err
+		}
+		writes = append(writes, w...)
+	}
+	if len(writes) > 0 {
+		if _, err := agent.Apply(ctx, multiraft.KVData{Op: multiraft.OpBatch, Writes: writes}); err != nil {
+			return fmt.Errorf("storing dead letters: %w", err)
+		}
+	}
+	last := entries[len(entries)-1].Index
+	if _, err := agent.Apply(ctx, multiraft.KVData{Op: multiraft.OpAckSink, Row: sink.Name, Index: last}); err != nil {
+		return fmt.Errorf("acknowledging dead-lettered delivery: %w", err)
+	}
+	n.recordEvent(ctx, eventDeadLettered, sink.Name, fmt.Sprintf("%d deliveries up to index %d: %v", len(deliveries), last, cause))
+	return nil
+}
+
+// DeadLetters returns up to limit dead letters of sink, of every sink when
+// empty, in key order after the key after, and whether there are more.
+func (n *server) DeadLetters(ctx context.Context, sink, after string, limit int) ([]deadLetter, bool, error) {
+	prefix := ""
+	if sink != "" {
+		prefix = sink + ":"
+		if after < prefix {
+			after = prefix
+		}
+	}
+	var letters []deadLetter
+	for {
+		page, _, err := n.ScanPage(ctx, deadLettersTable, after, limit, ConsistencyGlobal)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, row := range page.Rows {
+			if !strings.HasPrefix(row.Key, prefix) {
+				return letters, false, nil
+			}
+			if len(letters) == limit {
+				return letters, true, nil
+			}
+			dl, err := parseDeadLetter(row)
+			if err != nil {
+				return nil, false, err
+			}
+			letters = append(letters, dl)
+		}
+		if !page.More || len(page.Rows) == 0 {
+			return letters, false, nil
+		}
+		after = page.Rows[len(page.Rows)-1].Key
+	}
+}
+
+// ReplayDeadLetters posts the dead-lettered deliveries of sink at indexes,
+// all of them when empty, to the sink again, a batch at a time in index
+// order and with their original IDs, and drops each batch once the sink
+// answers 2xx.  It returns how many it replayed, the rest stay
+// dead-lettered.
+func (n *server) ReplayDeadLetters(ctx context.Context, sinkName string, indexes []uint64) (int, error) {
+	sinks, err := n.Sinks(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var sink *multiraft.Sink
+	for i := range sinks {
+		if sinks[i].Name == sinkName {
+			sink = &sinks[i]
+		}
+	}
+	if sink == nil {
+		return 0, errdefs.New(errdefs.ErrNotFound, fmt.Sprintf("sink %q not found", sinkName))
+	}
+	return n.eachDeadLetterBatch(ctx, sinkName, indexes, func(letters []deadLetter) error {
+		deliveries := make([]sinkDelivery, len(letters))
+		for i, dl := range letters {
+			deliveries[i] = dl.Delivery
+		}
+		if err := postDeliveries(ctx, *sink, deliveries); err != nil {
+			return fmt.Errorf("%w: %v", errReplayFailed, err)
+		}
+		return nil
+	})
+}
+
+// DiscardDeadLetters drops the dead-lettered deliveries of sink at indexes,
+// all of them when empty, and returns how many it dropped.
+func (n *server) DiscardDeadLetters(ctx context.Context, sink string, indexes []uint64) (int, error) {
+	return n.eachDeadLetterBatch(ctx, sink, indexes, func([]deadLetter) error { return nil })
+}
+
+// eachDeadLetterBatch calls fn with the dead letters of sink at indexes, all
+// of them when empty, up to sinkBatch at a time, and drops each batch fn
+// returns nil for.  It returns how many it dropped.
+func (n *server) eachDeadLetterBatch(ctx context.Context, sink string, indexes []uint64, fn func([]deadLetter) error) (int, error) {
+	wanted := make(map[uint64]bool, len(indexes))
+	for _, index := range indexes {
+		wanted[index] = true
+	}
+	var done int
+	after := ""
+	for {
+		letters, more, err := n.DeadLetters(ctx, sink, after, sinkBatch)
+		if err != nil || len(letters) == 0 {
+			return done, err
+		}
+		after = deadLetterKey(sink, letters[len(letters)-1].Delivery.Index)
+		if len(wanted) > 0 {
+			var picked []deadLetter
+			for _, dl := range letters {
+				if wanted[dl.Delivery.Index] {
+					picked = append(picked, dl)
+				}
+			}
+			letters = picked
+		}
+		if len(letters) > 0 {
+			if err := fn(letters); err != nil {
+				return done, err
+			}
+			if err := n.dropDeadLetters(ctx, letters); err != nil {
+				return done, err
+			}
+			done += len(letters)
+		}
+		if !more {
+			return done, nil
+		}
+	}
+}
+
+// dropDeadLetters deletes dead letters from deadLettersTable in a single raft
+// entry.
+func (n *server) dropDeadLetters(ctx context.Context, letters []deadLetter) error {
+	var writes []multiraft.TxnWrite
+	for _, dl := range letters {
+		key := deadLetterKey(dl.Sink, dl.Delivery.Index)
+		for _, col := range deadLetterColumns {
+			writes = append(writes, multiraft.TxnWrite{Table: deadLettersTable, Row: key, Column: col, Delete: true})
+		}
+	}
+	_, err := n.applyWrite(ctx, multiraft.KVData{Op: multiraft.OpBatch, Writes: writes})
+	return err
+}
+
+func (server *httpServer) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := sinkBatch
+	if v := q.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			server.logger.Error("Bad request, invalid limit", zap.String("limit", v))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	letters, more, err := server.node.DeadLetters(r.Context(), q.Get("sink"), q.Get("after"), limit)
+	if err != nil {
+		server.logger.Error("Failed to list dead letters", zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	if letters == nil {
+		letters = []deadLetter{}
+	}
+	response := struct {
+		DeadLetters []deadLetter `json:"dead_letters"`
+		More        bool         `json:"more"`
+	}{
+		DeadLetters: letters,
+		More:        more,
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
+
+func (server *httpServer) handleDeadLetterChange(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Sink    string   `json:"sink"`
+		Indexes []uint64 `json:"indexes"`
+	}{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Sink == "" {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !server.checkWritable(w) {
+		return
+	}
+	var count int
+	var err error
+	if strings.HasSuffix(r.URL.Path, "/_replay") {
+		count, err = server.node.ReplayDeadLetters(r.Context(), req.Sink, req.Indexes)
+	} else {
+		count, err = server.node.DiscardDeadLetters(r.Context(), req.Sink, req.Indexes)
+	}
+	if errors.Is(err, errReplayFailed) {
+		server.logger.Warn("Failed to replay dead letters", zap.String("sink", req.Sink), zap.Int("replayed", count), zap.Error(err))
+		statusBadGateway(w)
+		return
+	} else if err != nil {
+		server.logger.Error("Failed to change dead letters", zap.String("sink", req.Sink), zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	respond(w, http.StatusOK, map[string]int{"count": count}, server.logger)
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+)
+
+func TestDeadLetterRow(t *testing.T) {
+	dl := deadLetter{
+		Sink: "audit",
+		Delivery: sinkDelivery{
+			ID:      "c1:audit:42",
+			Index:   42,
+			Changes: []multiraft.Change{{Op: "set", Table: "users", Row: "alice", Column: "name", Val: "Alice"}},
+		},
+		Error:    "sink answered 500",
+		Attempts: sinkMaxAttempts,
+		Time:     "2024-01-01T00:00:00Z",
+	}
+	writes, err := deadLetterWrites(dl)
+	if err != nil {
+		t.Fatalf("deadLetterWrites() error = %v", err)
+	}
+	row := multiraft.ScanRow{Key: "audit:00000000000000000042", Columns: map[string]string{}}
+	for _, w := range writes {
+		if w.Table != deadLettersTable || w.Row != row.Key {
+			t.Fatalf("write to %s/%s, want %s/%s", w.Table, w.Row, deadLettersTable, row.Key)
+		}
+		row.Columns[w.Column] = w.Val
+	}
+	if len(row.Columns) != len(deadLetterColumns) {
+		t.Errorf("dead letter columns = %v, want %v", row.Columns, deadLetterColumns)
+	}
+	got, err := parseDeadLetter(row)
+	if err != nil {
+		t.Fatalf("parseDeadLetter() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, dl) {
+		t.Errorf("parseDeadLetter() = %+v, want %+v", got, dl)
+	}
+	row.Columns["index"] = "x"
+	if _, err := parseDeadLetter(row); err == nil {
+		t.Errorf("parseDeadLetter() of a bad index succeeded")
+	}
+}
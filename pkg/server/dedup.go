@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+)
+
+const (
+	// clientIDHeader and sequenceHeader identify a client's write, a client
+	// retrying it sends the same pair and the write is applied only once.
+	// Sequences only need to be unique per client ID.
+	clientIDHeader = "X-Expodb-Client-Id"
+	sequenceHeader = "X-Expodb-Sequence"
+	// dedupWindow is how long applied writes are remembered, retries have to
+	// come in before then.
+	dedupWindow = 10 * time.Minute
+)
+
+// clientWrite is a request's client ID and sequence.  Only the first write a
+// request makes is deduplicated, the single write requests are the ones
+// meant to carry them.
+type clientWrite struct {
+	client  string
+	seq     uint64
+	claimed atomic.Bool
+}
+
+type clientWriteKey struct{}
+
+// parseClientWrite reads the client ID and sequence headers, it returns nil
+// when the request has none.
+func parseClientWrite(r *http.Request) (*clientWrite, error) {
+	client, seq := r.Header.Get(clientIDHeader), r.Header.Get(sequenceHeader)
+	if client == "" && seq == "" {
+		return nil, nil
+	}
+	if client == "" || seq == "" {
+		return nil, fmt.Errorf("%s and %s go together", clientIDHeader, sequenceHeader)
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s %q: %w", sequenceHeader, seq, err)
+	}
+	return &clientWrite{client: client, seq: n}, nil
+}
+
+// applyWrite proposes a client write, stamped with the request's client ID
+// and sequence when it has them.  Values of encrypted columns are sealed
+// first, see sealEntry.
+func (n *server) applyWrite(ctx context.Context, kve multiraft.KVData) (uint64, error) {
+	if err := n.sealEntry(&kve); err != nil {
+		return 0, err
+	}
+	if cw, ok := ctx.Value(clientWriteKey{}).(*clientWrite); ok && cw.claimed.CompareAndSwap(false, true) {
+		kve.Client, kve.Seq, kve.ProposedAt = cw.client, cw.seq, time.Now().UnixNano()
+	}
+	return n.raftAgents[shardID1].Apply(ctx, kve)
+}
+
+// pruneDedup proposes forgetting the client writes older than dedupWindow,
+// it is run by the leader with the tombstone gc.
+func (n *server) pruneDedup(ctx context.Context) error {
+	cutoff := time.Now().Add(-dedupWindow).UnixNano()
+	if _, err := n.raftAgents[shardID1].Apply(ctx, multiraft.KVData{Op: multiraft.OpPruneDedup, Index: uint64(cutoff)}); err != nil {
+		return fmt.Errorf("proposing dedup pruning: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+// diskRecoverMargin is how many percent above DiskMinFreePercent free space
+// has to climb back to before writes are accepted again, so a node hovering
+// around the threshold doesn't flap.
+const diskRecoverMargin = 1.0
+
+// emergencySnapshotTimeout bounds the raft snapshot taken when disk space
+// runs low.
+const emergencySnapshotTimeout = 5 * time.Minute
+
+var ErrDiskFull = errors.New("node is low on disk space, send writes to another node")
+
+// diskUsage is the free space of the filesystem holding a data dir.
+type diskUsage struct {
+	Dir         string
+	FreeBytes   uint64
+	TotalBytes  uint64
+	FreePercent float64
+}
+
+func statDisk(dir string) (diskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return diskUsage{}, err
+	}
+	u := diskUsage{
+		Dir:        dir,
+		FreeBytes:  st.Bavail * uint64(st.Bsize),
+		TotalBytes: st.Blocks * uint64(st.Bsize),
+	}
+	if u.TotalBytes > 0 {
+		u.FreePercent = 100 * float64(u.FreeBytes) / float64(u.TotalBytes)
+	}
+	return u, nil
+}
+
+// watchDisk checks the free space of the raft and storage data dirs every
+// DiskCheckInterval until ctx is done, see checkDisk.
+func (n *server) watchDisk(ctx context.Context) {
+	ticker := time.NewTicker(n.config.DiskCheckInterval)
+	defer ticker.Stop()
+	for {
+		n.checkDisk(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkDisk stops client writes when a data dir's free space drops below
+// DiskMinFreePercent, raising an alert (an error log and an event), and
+// resumes them once it is back above the threshold.  Raft keeps replicating
+// either way, writes sent to other nodes still reach this one, so
+// DiskEmergencyCompact also reclaims what space it can.
+func (n *server) checkDisk(ctx context.Context) {
+	dirs := []string{n.config.RaftDataDir, multiraft.StorageDir()}
+	low := n.diskLow.Load()
+	threshold := n.config.DiskMinFreePercent
+	if low {
+		threshold += diskRecoverMargin
+	}
+	var lowest *diskUsage
+	for _, dir := range dirs {
+		u, err := statDisk(dir)
+		if err != nil {
+			n.logger.Warn("failed to check free disk space", zap.String("dir", dir), zap.Error(err))
+			continue
+		}
+		if lowest == nil || u.FreePercent < lowest.FreePercent {
+			lowest = &u
+		}
+	}
+	if lowest == nil || (lowest.FreePercent < threshold) == low {
+		return
+	}
+	n.diskLow.Store(!low)
+	detail := fmt.Sprintf("%s has %.1f%% (%d bytes) free", lowest.Dir, lowest.FreePercent, lowest.FreeBytes)
+	if low {
+		n.logger.Info("disk space recovered, accepting writes again", zap.String("dir", lowest.Dir), zap.Float64("free_percent", lowest.FreePercent))
+		n.recordEvent(ctx, eventDiskRecovered, n.config.ID(), detail)
+		return
+	}
+	n.logger.Error("disk space low, rejecting writes", zap.String("dir", lowest.Dir),
+		zap.Float64("free_percent", lowest.FreePercent), zap.Uint64("free_bytes", lowest.FreeBytes))
+	n.recordEvent(ctx, eventDiskLow, n.config.ID(), detail)
+	if n.config.DiskEmergencyCompact {
+		n.reclaimDisk(ctx)
+	}
+}
+
+// reclaimDisk snapshots raft, so its log can be truncated, and compacts the
+// store to drop deleted and overwritten rows.
+func (n *server) reclaimDisk(ctx context.Context) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return
+	}
+	sctx, cancel := context.WithTimeout(ctx, emergencySnapshotTimeout)
+	defer cancel()
+	if index, err := agent.RequestSnapshot(sctx); err != nil {
+		n.logger.Warn("emergency raft snapshot failed", zap.Error(err))
+	} else {
+		n.logger.Info("took emergency raft snapshot", zap.Uint64("index", index))
+	}
+	if usage, err := n.Compact(""); err != nil {
+		n.logger.Warn("emergency compaction failed", zap.Error(err))
+	} else {
+		n.logger.Info("compacted store", zap.Uint64("disk_usage_bytes", usage))
+	}
+}
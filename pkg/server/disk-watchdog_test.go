@@ -0,0 +1,16 @@
+package server
+
+import "testing"
+
+func TestStatDisk(t *testing.T) {
+	u, err := statDisk(t.TempDir())
+	if err != nil {
+		t.Fatalf("statDisk() error = %v", err)
+	}
+	if u.TotalBytes == 0 || u.FreeBytes > u.TotalBytes || u.FreePercent < 0 || u.FreePercent > 100 {
+		t.Errorf("statDisk() = %+v, want free space within the disk size", u)
+	}
+	if _, err := statDisk(t.TempDir() + "/missing"); err == nil {
+		t.Error("statDisk() of a missing dir succeeded")
+	}
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// dryRunHeader is set on the responses of dry runs: the request was checked,
+// against the schemas, unique indexes, locks and ACLs, but nothing written.
+// Writes that would be accepted report index 0, queries only plan the index
+// they would read.
+const dryRunHeader = "X-Expodb-Dry-Run"
+
+// parseDryRun reads the dry_run query parameter.
+func parseDryRun(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("dry_run")
+	if v == "" {
+		return false, nil
+	}
+	dry, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("bad dry_run %q: %w", v, err)
+	}
+	return dry, nil
+}
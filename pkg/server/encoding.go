@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gogo/protobuf/types"
+	"github.com/hashicorp/go-msgpack/codec"
+	"go.uber.org/zap"
+)
+
+// The encodings the API speaks besides JSON.  Protobuf bodies are a
+// google.protobuf.Value of the JSON document, numbers are doubles.
+const (
+	mimeJSON     = "application/json"
+	mimeMsgpack  = "application/msgpack"
+	mimeProtobuf = "application/x-protobuf"
+)
+
+var mimeAliases = map[string]string{
+	mimeJSON:                  mimeJSON,
+	mimeMsgpack:               mimeMsgpack,
+	"application/x-msgpack":   mimeMsgpack,
+	"application/vnd.msgpack": mimeMsgpack,
+	mimeProtobuf:              mimeProtobuf,
+	"application/protobuf":    mimeProtobuf,
+}
+
+var msgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+
+func init() {
+	msgpackHandle.RawToString = true
+	msgpackHandle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+}
+
+// negotiate has the handlers, which read JSON, take msgpack and protobuf
+// bodies by Content-Type, transcoding them, and answer in the encoding
+// Accept prefers: respond encodes the handler's value in it, see
+// codecWriter.  Other bodies, as streams, are written as they are.
+func (server *httpServer) negotiate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		binary := server.node.featureEnabled(featureBinaryCodecs)
+		ct := mediaType(r.Header.Get("Content-Type"))
+		if (ct == mimeMsgpack || ct == mimeProtobuf) && !binary {
+			server.logger.Info("Rejecting body, binary codecs are off", zap.String("content_type", ct))
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		if ct == mimeMsgpack || ct == mimeProtobuf {
+			body, err := io.ReadAll(r.Body)
+			r.Body.Close()
+			if err == nil {
+				body, err = toJSON(ct, body)
+			}
+			if err != nil {
+				server.logger.Error("Bad request body", zap.String("content_type", ct), zap.Error(err))
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			r.Body, r.ContentLength = io.NopCloser(bytes.NewReader(body)), int64(len(body))
+			r.Header.Set("Content-Type", mimeJSON)
+		}
+
+		w.Header().Add("Vary", "Accept")
+		accept := acceptedEncoding(r.Header.Get("Accept"))
+		if accept == mimeJSON || !binary {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&codecWriter{ResponseWriter: w, encoding: accept}, r)
+	})
+}
+
+// codecWriter carries the encoding negotiate picked for the response to
+// respond, writes go through untouched.
+type codecWriter struct {
+	http.ResponseWriter
+	encoding string
+}
+
+func (w *codecWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// responseEncoding returns the encoding of the response w writes, JSON
+// unless a codecWriter it wraps says otherwise.
+func responseEncoding(w http.ResponseWriter) string {
+	for {
+		if cw, ok := w.(*codecWriter); ok {
+			return cw.encoding
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return mimeJSON
+		}
+		w = u.Unwrap()
+	}
+}
+
+// encodeResponse encodes v in the encoding of the response w writes, it
+// returns the body and its Content-Type, empty for JSON.  Msgpack encodes v
+// itself, by its json tags; protobuf the google.protobuf.Value of its JSON.
+func encodeResponse(w http.ResponseWriter, v interface{}) ([]byte, string, error) {
+	switch encoding := responseEncoding(w); encoding {
+	case mimeMsgpack:
+		var out []byte
+		err := codec.NewEncoderBytes(&out, msgpackHandle).Encode(v)
+		return out, encoding, err
+	case mimeProtobuf:
+		body, err := json.Marshal(v)
+		if err != nil {
+			return nil, "", err
+		}
+		d := json.NewDecoder(bytes.NewReader(body))
+		d.UseNumber()
+		var doc interface{}
+		if err := d.Decode(&doc); err != nil {
+			return nil, "", err
+		}
+		out, err := toProtoValue(doc).Marshal()
+		return out, encoding, err
+	}
+	body, err := json.Marshal(v)
+	return body, "", err
+}
+
+func mediaType(v string) string {
+	t, _, err := mime.ParseMediaType(v)
+	if err != nil {
+		return ""
+	}
+	return mimeAliases[t]
+}
+
+// acceptedEncoding returns the encoding of the highest quality an Accept
+// header lists, JSON unless it lists another.
+func acceptedEncoding(accept string) string {
+	best, bestQ := mimeJSON, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		t, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mimeAliases[t] == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = mimeAliases[t], q
+		}
+	}
+	return best
+}
+
+func toJSON(contentType string, body []byte) ([]byte, error) {
+	var v interface{}
+	switch contentType {
+	case mimeMsgpack:
+		if err := codec.NewDecoderBytes(body, msgpackHandle).Decode(&v); err != nil {
+			return nil, err
+		}
+	case mimeProtobuf:
+		pv := &types.Value{}
+		if err := pv.Unmarshal(body); err != nil {
+			return nil, err
+		}
+		v = fromProtoValue(pv)
+	}
+	return json.Marshal(v)
+}
+
+func toProtoValue(v interface{}) *types.Value {
+	switch v := v.(type) {
+	case nil:
+		return &types.Value{Kind: &types.Value_NullValue{}}
+	case bool:
+		return &types.Value{Kind: &types.Value_BoolValue{BoolValue: v}}
+	case string:
+		return &types.Value{Kind: &types.Value_StringValue{StringValue: v}}
+	case json.Number:
+		f, _ := v.Float64()
+		return &types.Value{Kind: &types.Value_NumberValue{NumberValue: f}}
+	case map[string]interface{}:
+		s := &types.Struct{Fields: make(map[string]*types.Value, len(v))}
+		for k, e := range v {
+			s.Fields[k] = toProtoValue(e)
+		}
+		return &types.Value{Kind: &types.Value_StructValue{StructValue: s}}
+	case []interface{}:
+		l := &types.ListValue{Values: make([]*types.Value, len(v))}
+		for i, e := range v {
+			l.Values[i] = toProtoValue(e)
+		}
+		return &types.Value{Kind: &types.Value_ListValue{ListValue: l}}
+	}
+	return &types.Value{Kind: &types.Value_NullValue{}}
+}
+
+func fromProtoValue(v *types.Value) interface{} {
+	switch k := v.GetKind().(type) {
+	case *types.Value_BoolValue:
+		return k.BoolValue
+	case *types.Value_StringValue:
+		return k.StringValue
+	case *types.Value_NumberValue:
+		return k.NumberValue
+	case *types.Value_StructValue:
+		m := make(map[string]interface{}, len(k.StructValue.GetFields()))
+		for name, e := range k.StructValue.GetFields() {
+			m[name] = fromProtoValue(e)
+		}
+		return m
+	case *types.Value_ListValue:
+		l := make([]interface{}, len(k.ListValue.GetValues()))
+		for i, e := range k.ListValue.GetValues() {
+			l[i] = fromProtoValue(e)
+		}
+		return l
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gogo/protobuf/types"
+	"github.com/hashicorp/go-msgpack/codec"
+	"go.uber.org/zap"
+)
+
+func TestNegotiate(t *testing.T) {
+	server := &httpServer{logger: zap.NewNop(), node: &server{}}
+	// echo answers with the JSON request body.
+	echo := server.negotiate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v interface{}
+		json.NewDecoder(r.Body).Decode(&v)
+		respond(w, http.StatusCreated, v, zap.NewNop())
+	}))
+	want := map[string]interface{}{"key": "k1", "version": 14.0, "columns": []interface{}{"a", "b"}}
+
+	var msgpack []byte
+	codec.NewEncoderBytes(&msgpack, msgpackHandle).Encode(map[string]interface{}{"key": "k1", "version": 14, "columns": []string{"a", "b"}})
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(msgpack))
+	r.Header.Set("Content-Type", mimeMsgpack)
+	w := httptest.NewRecorder()
+	echo.ServeHTTP(w, r)
+	got := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("msgpack request: got %s (%v), want %v", w.Body, err, want)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(w.Body.Bytes()))
+	r.Header.Set("Accept", "application/json;q=0.5, application/x-msgpack")
+	w = httptest.NewRecorder()
+	echo.ServeHTTP(w, r)
+	var decoded interface{}
+	if w.Code != http.StatusCreated || w.Header().Get("Content-Type") != mimeMsgpack {
+		t.Fatalf("msgpack response: status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if err := codec.NewDecoderBytes(w.Body.Bytes(), msgpackHandle).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	// echo's value has the float64 of a decoded JSON number.
+	if m := decoded.(map[string]interface{}); m["key"] != "k1" || m["version"] != 14.0 {
+		t.Errorf("msgpack response: got %v", decoded)
+	}
+
+	body, _ := json.Marshal(want)
+	r = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r.Header.Set("Accept", mimeProtobuf)
+	w = httptest.NewRecorder()
+	echo.ServeHTTP(w, r)
+	pv := &types.Value{}
+	if err := pv.Unmarshal(w.Body.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if got := fromProtoValue(pv); !reflect.DeepEqual(got, want) {
+		t.Errorf("protobuf response: got %v, want %v", got, want)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte{0xc1}))
+	r.Header.Set("Content-Type", mimeMsgpack)
+	w = httptest.NewRecorder()
+	echo.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad msgpack request: status %d", w.Code)
+	}
+
+	// Values are encoded as the handler has them, not through JSON.
+	index := uint64(1<<60 + 1)
+	typed := server.negotiate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respond(w, http.StatusOK, struct {
+			Index uint64 `json:"index"`
+		}{index}, zap.NewNop())
+	}))
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept", mimeMsgpack)
+	w = httptest.NewRecorder()
+	typed.ServeHTTP(w, r)
+	decoded = nil
+	if err := codec.NewDecoderBytes(w.Body.Bytes(), msgpackHandle).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if m := decoded.(map[string]interface{}); m["index"] != index {
+		t.Errorf("typed msgpack response: got %v (%T), want %d", m["index"], m["index"], index)
+	}
+
+	// And so are the status helpers' answers.
+	missing := server.negotiate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		statusNotFound(w)
+	}))
+	w = httptest.NewRecorder()
+	missing.ServeHTTP(w, r)
+	decoded = nil
+	if err := codec.NewDecoderBytes(w.Body.Bytes(), msgpackHandle).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if m := decoded.(map[string]interface{}); w.Code != http.StatusNotFound || m["status"] != "404 not found" {
+		t.Errorf("not found: status %d, got %v", w.Code, decoded)
+	}
+}
+
+// flagsAgent answers local reads with the feature flags set.
+type flagsAgent struct {
+	raftAgent
+	flags map[string]bool
+}
+
+func (a flagsAgent) ReadLocal(query interface{}) (interface{}, error) {
+	return a.flags, nil
+}
+
+func TestNegotiate_BinaryCodecsOff(t *testing.T) {
+	node := &server{raftAgents: map[uint64]raftAgent{shardID1: flagsAgent{flags: map[string]bool{featureBinaryCodecs: false}}}}
+	server := &httpServer{logger: zap.NewNop(), node: node}
+	echo := server.negotiate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v interface{}
+		json.NewDecoder(r.Body).Decode(&v)
+		respond(w, http.StatusOK, v, zap.NewNop())
+	}))
+
+	var msgpack []byte
+	codec.NewEncoderBytes(&msgpack, msgpackHandle).Encode(map[string]interface{}{"key": "k1"})
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(msgpack))
+	r.Header.Set("Content-Type", mimeMsgpack)
+	w := httptest.NewRecorder()
+	echo.ServeHTTP(w, r)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("msgpack request: status %d, want 415", w.Code)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(`{"key":"k1"}`)))
+	r.Header.Set("Accept", mimeMsgpack)
+	w = httptest.NewRecorder()
+	echo.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != `{"key":"k1"}` {
+		t.Errorf("msgpack response: status %d, body %q, want JSON", w.Code, w.Body)
+	}
+	if node.featureEnabled(featureCDC) != featureDefaults[featureCDC] {
+		t.Errorf("a flag not set isn't at its default")
+	}
+}
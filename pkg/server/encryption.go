@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/epsniff/expodb/pkg/errdefs"
+	"github.com/epsniff/expodb/pkg/fieldcrypt"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+// localSchemas returns the schemas of the tables having one as this node's
+// replica last saw them, by table.  Writes are sealed with them before they
+// are proposed, a column made encrypted since is caught by the FSM, which
+// rejects the plaintext.
+func (n *server) localSchemas() (map[string]*multiraft.TableSchema, error) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return nil, err
+	}
+	res, err := agent.ReadLocal(multiraft.SchemasQuery{})
+	if err != nil {
+		return nil, err
+	}
+	list, _ := res.([]multiraft.TableSchema)
+	schemas := make(map[string]*multiraft.TableSchema, len(list))
+	for i := range list {
+		schemas[list[i].Table] = &list[i]
+	}
+	return schemas, nil
+}
+
+// sealEntry seals the values an entry writes to encrypted columns, see
+// sealWrites.
+func (n *server) sealEntry(kve *multiraft.KVData) error {
+	switch kve.Op {
+	case multiraft.OpSet:
+		writes := []multiraft.TxnWrite{{Table: kve.Table, Row: kve.Row, Column: kve.Column, Val: kve.Val}}
+		if err := n.sealWrites(writes); err != nil {
+			return err
+		}
+		kve.Val = writes[0].Val
+	case multiraft.OpSetRow, multiraft.OpReplaceRow:
+		writes := make([]multiraft.TxnWrite, 0, len(kve.Columns))
+		for col, val := range kve.Columns {
+			writes = append(writes, multiraft.TxnWrite{Table: kve.Table, Row: kve.Row, Column: col, Val: val})
+		}
+		if err := n.sealWrites(writes); err != nil {
+			return err
+		}
+		columns := make(map[string]string, len(writes))
+		for _, w := range writes {
+			columns[w.Column] = w.Val
+		}
+		kve.Columns = columns
+	}
+	return nil
+}
+
+// sealWrites seals, in place, the values written to encrypted columns with
+// the node's active column key, after checking them against the column's
+// type.  Values already sealed, by clients holding the keys, are kept.
+func (n *server) sealWrites(writes []multiraft.TxnWrite) error {
+	var schemas map[string]*multiraft.TableSchema
+	for i := range writes {
+		w := &writes[i]
+		if w.Delete || fieldcrypt.IsEncrypted(w.Val) {
+			continue
+		}
+		if schemas == nil {
+			var err error
+			if schemas, err = n.localSchemas(); err != nil {
+				return err
+			}
+		}
+		s, ok := schemas[w.Table]
+		if !ok || !s.Encrypted(w.Column) {
+			continue
+		}
+		if reason := s.CheckPlaintext(w.Column, w.Val); reason != "" {
+			return &multiraft.SchemaError{Table: w.Table, Row: w.Row, Column: w.Column, Reason: reason}
+		}
+		if n.columnKeys == nil {
+			return errdefs.New(errdefs.ErrInvalid, fmt.Sprintf("column %s of %s is encrypted and this node has no --column-keys", w.Column, w.Table))
+		}
+		sealed, err := n.columnKeys.Encrypt(w.Table, w.Column, w.Val)
+		if err != nil {
+			return err
+		}
+		w.Val = sealed
+	}
+	return nil
+}
+
+func rowColumns(rows []multiraft.ScanRow) []map[string]string {
+	columns := make([]map[string]string, len(rows))
+	for i := range rows {
+		columns[i] = rows[i].Columns
+	}
+	return columns
+}
+
+// openRows decrypts, in place, the values of a table's encrypted columns in
+// rows for principals authorized to decrypt the table.  Others get the
+// sealed values, as do every reader of a node without the key a value was
+// sealed with.
+func (server *httpServer) openRows(r *http.Request, table string, rows ...map[string]string) {
+	if server.node.columnKeys == nil || isVirtualTable(table) {
+		return
+	}
+	schemas, err := server.node.localSchemas()
+	if err != nil {
+		server.logger.Warn("Failed to read schemas, leaving values sealed", zap.Error(err))
+		return
+	}
+	s, ok := schemas[table]
+	if !ok || server.node.authz.Authorize(principalFromContext(r.Context()), ActionDecrypt, table) != nil {
+		return
+	}
+	for _, columns := range rows {
+		for col, val := range columns {
+			if !s.Encrypted(col) || !fieldcrypt.IsEncrypted(val) {
+				continue
+			}
+			plaintext, err := server.node.columnKeys.Decrypt(table, col, val)
+			if err != nil {
+				server.logger.Warn("Failed to decrypt value, leaving it sealed", zap.String("table", table), zap.String("column", col), zap.Error(err))
+				continue
+			}
+			columns[col] = plaintext
+		}
+	}
+}
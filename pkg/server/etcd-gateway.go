@@ -0,0 +1,303 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/epsniff/expodb/pkg/errdefs"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+const (
+	// etcdTable holds the keys written through the etcd API, one row per
+	// key with the value in etcdValueColumn.  etcdVersionColumn and
+	// etcdCreateColumn count the key's puts and hold its create revision
+	// from its second put on, the first one's mod revision stands for both
+	// until then.  etcdLeaseColumn holds the lease the key is attached to.
+	etcdTable         = "etcd"
+	etcdValueColumn   = "value"
+	etcdVersionColumn = "version"
+	etcdCreateColumn  = "create_revision"
+	etcdLeaseColumn   = "lease"
+)
+
+// errEtcdUnsupported is returned for the etcd requests and options the
+// gateway doesn't serve, answered with 501.
+var errEtcdUnsupported = errors.New("not supported by the etcd gateway")
+
+// The etcd v3 JSON gateway encodes bytes as base64 and int64s as strings,
+// []byte and the ",string" option give the same encoding.
+type etcdHeader struct {
+	Revision uint64 `json:"revision,string"`
+}
+
+type etcdKV struct {
+	Key            []byte `json:"key"`
+	Value          []byte `json:"value,omitempty"`
+	CreateRevision uint64 `json:"create_revision,string"`
+	ModRevision    uint64 `json:"mod_revision,string"`
+	Version        uint64 `json:"version,string"`
+	Lease          int64  `json:"lease,string,omitempty"`
+}
+
+type etcdRangeRequest struct {
+	Key       []byte `json:"key"`
+	RangeEnd  []byte `json:"range_end"`
+	Limit     int64  `json:"limit,string"`
+	Revision  int64  `json:"revision,string"`
+	KeysOnly  bool   `json:"keys_only"`
+	CountOnly bool   `json:"count_only"`
+}
+
+type etcdPutRequest struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value"`
+	Lease       int64  `json:"lease,string"`
+	PrevKV      bool   `json:"prev_kv"`
+	IgnoreValue bool   `json:"ignore_value"`
+	IgnoreLease bool   `json:"ignore_lease"`
+}
+
+type etcdDeleteRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end"`
+	PrevKV   bool   `json:"prev_kv"`
+}
+
+// etcdRequestOp is one operation of a txn, only one of its fields is set.
+type etcdRequestOp struct {
+	RequestRange       *etcdRangeRequest       `json:"request_range,omitempty"`
+	RequestPut         *etcdPutRequest         `json:"request_put,omitempty"`
+	RequestDeleteRange *etcdDeleteRangeRequest `json:"request_delete_range,omitempty"`
+}
+
+// etcdCompare compares the Target field of a key, its version by default,
+// with the value of the same name.
+type etcdCompare struct {
+	Result         string `json:"result"`
+	Target         string `json:"target"`
+	Key            []byte `json:"key"`
+	RangeEnd       []byte `json:"range_end"`
+	Version        int64  `json:"version,string"`
+	CreateRevision int64  `json:"create_revision,string"`
+	ModRevision    int64  `json:"mod_revision,string"`
+	Value          []byte `json:"value"`
+	Lease          int64  `json:"lease,string"`
+}
+
+type etcdTxnRequest struct {
+	Compare []etcdCompare   `json:"compare"`
+	Success []etcdRequestOp `json:"success"`
+	Failure []etcdRequestOp `json:"failure"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader `json:"header"`
+	KVs    []etcdKV   `json:"kvs,omitempty"`
+	More   bool       `json:"more,omitempty"`
+	Count  int64      `json:"count,string"`
+}
+
+type etcdPutResponse struct {
+	Header etcdHeader `json:"header"`
+	PrevKV *etcdKV    `json:"prev_kv,omitempty"`
+}
+
+type etcdDeleteRangeResponse struct {
+	Header  etcdHeader `json:"header"`
+	Deleted int64      `json:"deleted,string"`
+	PrevKVs []etcdKV   `json:"prev_kvs,omitempty"`
+}
+
+type etcdResponseOp struct {
+	ResponseRange       *etcdRangeResponse       `json:"response_range,omitempty"`
+	ResponsePut         *etcdPutResponse         `json:"response_put,omitempty"`
+	ResponseDeleteRange *etcdDeleteRangeResponse `json:"response_delete_range,omitempty"`
+}
+
+type etcdTxnResponse struct {
+	Header    etcdHeader       `json:"header"`
+	Succeeded bool             `json:"succeeded,omitempty"`
+	Responses []etcdResponseOp `json:"responses,omitempty"`
+}
+
+// handleEtcdRequest serves a subset of etcd's v3 KV and lease APIs as its
+// JSON gateway does: range, put, deleterange and txn, and the lease
+// requests.  Revisions are raft indexes of the data group.  Requests but
+// deleterange are run as txns, see etcdTxn.  Watches and reads at a past
+// revision aren't supported.
+func (server *httpServer) handleEtcdRequest(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	decode := func(v interface{}) bool {
+		if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+			server.logger.Error("Bad request", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return false
+		}
+		return true
+	}
+
+	action := ActionWrite
+	switch r.URL.Path {
+	case "/v3/kv/range", "/v3/lease/timetolive", "/v3/lease/leases":
+		action = ActionRead
+	}
+	if !server.authorize(w, r, action, etcdTable) {
+		return
+	}
+	if action == ActionWrite && !server.checkWritable(w) {
+		return
+	}
+
+	var response interface{}
+	var err error
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		var req etcdRangeRequest
+		if !decode(&req) {
+			return
+		}
+		var res *etcdTxnResponse
+		res, err = server.node.etcdTxn(r.Context(), &etcdTxnRequest{Success: []etcdRequestOp{{RequestRange: &req}}})
+		if err == nil {
+			response = res.Responses[0].ResponseRange
+		}
+	case "/v3/kv/put":
+		var req etcdPutRequest
+		if !decode(&req) {
+			return
+		}
+		var res *etcdTxnResponse
+		res, err = server.node.etcdTxn(r.Context(), &etcdTxnRequest{Success: []etcdRequestOp{{RequestPut: &req}}})
+		if err == nil {
+			response = res.Responses[0].ResponsePut
+		}
+	case "/v3/kv/deleterange":
+		var req etcdDeleteRangeRequest
+		if !decode(&req) {
+			return
+		}
+		response, err = server.node.etcdDeleteRange(r.Context(), &req)
+	case "/v3/kv/txn":
+		var req etcdTxnRequest
+		if !decode(&req) {
+			return
+		}
+		response, err = server.node.etcdTxn(r.Context(), &req)
+	case "/v3/lease/grant":
+		var req struct {
+			ID  int64 `json:"ID,string"`
+			TTL int64 `json:"TTL,string"`
+		}
+		if !decode(&req) {
+			return
+		}
+		var lease etcdLease
+		lease, err = server.node.etcdLeaseGrant(r.Context(), req.ID, req.TTL)
+		response = struct {
+			Header etcdHeader `json:"header"`
+			ID     int64      `json:"ID,string"`
+			TTL    int64      `json:"TTL,string"`
+		}{etcdHeader{lease.revision}, lease.id, lease.ttl}
+	case "/v3/lease/revoke":
+		var req struct {
+			ID int64 `json:"ID,string"`
+		}
+		if !decode(&req) {
+			return
+		}
+		var index uint64
+		index, err = server.node.etcdLeaseRevoke(r.Context(), req.ID)
+		response = struct {
+			Header etcdHeader `json:"header"`
+		}{etcdHeader{index}}
+	case "/v3/lease/keepalive":
+		var req struct {
+			ID int64 `json:"ID,string"`
+		}
+		if !decode(&req) {
+			return
+		}
+		var lease etcdLease
+		lease, err = server.node.etcdLeaseKeepAlive(r.Context(), req.ID)
+		// the gateway streams the keepalives of a request, one result each.
+		type keepAlive struct {
+			Header etcdHeader `json:"header"`
+			ID     int64      `json:"ID,string"`
+			TTL    int64      `json:"TTL,string"`
+		}
+		response = struct {
+			Result keepAlive `json:"result"`
+		}{keepAlive{etcdHeader{lease.revision}, lease.id, lease.ttl}}
+	case "/v3/lease/timetolive":
+		var req struct {
+			ID   int64 `json:"ID,string"`
+			Keys bool  `json:"keys"`
+		}
+		if !decode(&req) {
+			return
+		}
+		var lease etcdLease
+		var keys [][]byte
+		lease, keys, err = server.node.etcdLeaseTimeToLive(r.Context(), req.ID, req.Keys)
+		response = struct {
+			Header     etcdHeader `json:"header"`
+			ID         int64      `json:"ID,string"`
+			TTL        int64      `json:"TTL,string"`
+			GrantedTTL int64      `json:"grantedTTL,string"`
+			Keys       [][]byte   `json:"keys,omitempty"`
+		}{etcdHeader{lease.revision}, req.ID, lease.remaining, lease.ttl, keys}
+	case "/v3/lease/leases":
+		var ids []int64
+		var index uint64
+		ids, index, err = server.node.etcdLeases(r.Context())
+		type leaseStatus struct {
+			ID int64 `json:"ID,string"`
+		}
+		leases := make([]leaseStatus, len(ids))
+		for i, id := range ids {
+			leases[i].ID = id
+		}
+		response = struct {
+			Header etcdHeader    `json:"header"`
+			Leases []leaseStatus `json:"leases,omitempty"`
+		}{etcdHeader{index}, leases}
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	switch {
+	case errors.Is(err, errEtcdUnsupported):
+		server.logger.Info("Unsupported etcd request", zap.String("path", r.URL.Path), zap.Error(err))
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	case errors.Is(err, multiraft.ErrWritesFrozen):
+		statusUnavailable(w)
+		return
+	case errors.Is(err, multiraft.ErrTxnConflict), errors.Is(err, multiraft.ErrUniqueViolation):
+		server.logger.Info("Rejecting write", zap.Error(err))
+		w.WriteHeader(http.StatusConflict)
+		return
+	case errors.Is(err, multiraft.ErrSchemaViolation), errors.Is(err, multiraft.ErrTriggerRejected):
+		server.logger.Info("Rejecting write", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	case errdefs.Code(err) != "":
+		server.logger.Info("Rejecting etcd request", zap.String("path", r.URL.Path), zap.Error(err))
+		statusError(w, err)
+		return
+	case err != nil:
+		server.logger.Error("Failed etcd request", zap.String("path", r.URL.Path), zap.Error(err))
+		statusInternalError(w)
+		return
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
+
+// isEtcdPath reports whether the request is for the etcd gateway.
+func isEtcdPath(path string) bool {
+	return strings.HasPrefix(path, "/v3/")
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/config"
+)
+
+func TestEtcdGateway(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	// the replicas' stores are relative to the working directory.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	cfg := &config.Config{
+		NodeName:        "node-1",
+		SerfBindAddress: "127.0.0.1",
+		SerfBindPort:    freePort(t),
+		SerfDataDir:     dir + "/serf",
+		IsSerfSeed:      true,
+		HTTPBindAddress: "127.0.0.1",
+		RaftBindAddress: "127.0.0.1",
+		RaftBindPort:    freePort(t),
+		RaftDataDir:     dir + "/raft",
+		Bootstrap:       true,
+	}
+	srv, err := New(cfg, WithListener(ln))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := srv.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop(ctx)
+	for {
+		if _, err := srv.SetKeyVal(ctx, "t1", "k0", "c", "v"); err == nil {
+			break
+		} else if ctx.Err() != nil {
+			t.Fatalf("writing: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	post := func(path, body string, want int, out interface{}) {
+		t.Helper()
+		resp, err := http.Post("http://"+ln.Addr().String()+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("%s %s: status %d, want %d", path, body, resp.StatusCode, want)
+		}
+		if out != nil {
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				t.Fatalf("%s: decoding: %v", path, err)
+			}
+		}
+	}
+	get := func(key string) *etcdRangeResponse {
+		t.Helper()
+		var res etcdRangeResponse
+		post("/v3/kv/range", `{"key":"`+b64(key)+`"}`, http.StatusOK, &res)
+		return &res
+	}
+
+	var put etcdPutResponse
+	post("/v3/kv/put", `{"key":"`+b64("a")+`", "value":"`+b64("1")+`"}`, http.StatusOK, &put)
+	post("/v3/kv/put", `{"key":"`+b64("a")+`", "value":"`+b64("2")+`", "prev_kv":true}`, http.StatusOK, &put)
+	if put.PrevKV == nil || string(put.PrevKV.Value) != "1" {
+		t.Fatalf("prev_kv = %+v, want value 1", put.PrevKV)
+	}
+	kv := get("a").KVs[0]
+	if string(kv.Value) != "2" || kv.Version != 2 || kv.CreateRevision != put.PrevKV.ModRevision || kv.ModRevision != put.Header.Revision {
+		t.Errorf("a = %+v, want value 2, version 2, created at %d and modified at %d", kv, put.PrevKV.ModRevision, put.Header.Revision)
+	}
+
+	txn := func(version int64) etcdTxnResponse {
+		t.Helper()
+		var res etcdTxnResponse
+		post("/v3/kv/txn", `{
+			"compare":[{"target":"VERSION", "result":"EQUAL", "key":"`+b64("a")+`", "version":"`+strconv.FormatInt(version, 10)+`"}],
+			"success":[{"request_put":{"key":"`+b64("b")+`", "value":"`+b64("won")+`"}}, {"request_delete_range":{"key":"`+b64("a")+`"}}],
+			"failure":[{"request_range":{"key":"`+b64("a")+`"}}]}`, http.StatusOK, &res)
+		return res
+	}
+	if res := txn(1); res.Succeeded || len(res.Responses) != 1 || res.Responses[0].ResponseRange == nil {
+		t.Errorf("txn comparing a stale version = %+v, want the failure range", res)
+	}
+	if res := txn(2); !res.Succeeded || len(res.Responses) != 2 || res.Responses[1].ResponseDeleteRange.Deleted != 1 {
+		t.Errorf("txn comparing the version = %+v, want the success ops", res)
+	}
+	if res := get("a"); res.Count != 0 {
+		t.Errorf("a after the txn = %+v, want it deleted", res)
+	}
+	if kv := get("b").KVs[0]; string(kv.Value) != "won" {
+		t.Errorf("b after the txn = %+v, want it put", kv)
+	}
+
+	for _, key := range []string{"p/1", "p/2", "p/3", "q"} {
+		post("/v3/kv/put", `{"key":"`+b64(key)+`", "value":"`+b64("v")+`"}`, http.StatusOK, nil)
+	}
+	var del etcdDeleteRangeResponse
+	post("/v3/kv/deleterange", `{"key":"`+b64("p/")+`", "range_end":"`+b64("p0")+`"}`, http.StatusOK, &del)
+	if del.Deleted != 3 {
+		t.Errorf("deleterange of p/ deleted %d, want 3", del.Deleted)
+	}
+	var rng etcdRangeResponse
+	post("/v3/kv/range", `{"key":"`+b64("\x00")+`", "range_end":"`+b64("\x00")+`", "keys_only":true}`, http.StatusOK, &rng)
+	if rng.Count != 2 || string(rng.KVs[0].Key) != "b" || string(rng.KVs[1].Key) != "q" {
+		t.Errorf("every key after deleterange = %+v, want b and q", rng)
+	}
+
+	var grant struct {
+		ID  int64 `json:"ID,string"`
+		TTL int64 `json:"TTL,string"`
+	}
+	post("/v3/lease/grant", `{"TTL":"60"}`, http.StatusOK, &grant)
+	if grant.ID <= 0 || grant.TTL != 60 {
+		t.Fatalf("grant = %+v, want an ID and a TTL of 60", grant)
+	}
+	lease := `"` + strconv.FormatInt(grant.ID, 10) + `"`
+	post("/v3/kv/put", `{"key":"`+b64("l")+`", "value":"`+b64("v")+`", "lease":`+lease+`}`, http.StatusOK, nil)
+	post("/v3/kv/put", `{"key":"`+b64("m")+`", "value":"`+b64("v")+`", "lease":"12345"}`, http.StatusNotFound, nil)
+	var ttl struct {
+		TTL  int64    `json:"TTL,string"`
+		Keys [][]byte `json:"keys"`
+	}
+	post("/v3/lease/timetolive", `{"ID":`+lease+`, "keys":true}`, http.StatusOK, &ttl)
+	if ttl.TTL <= 0 || len(ttl.Keys) != 1 || string(ttl.Keys[0]) != "l" {
+		t.Errorf("timetolive = %+v, want time left and key l", ttl)
+	}
+	post("/v3/lease/revoke", `{"ID":`+lease+`}`, http.StatusOK, nil)
+	if res := get("l"); res.Count != 0 {
+		t.Errorf("l after revoking its lease = %+v, want it deleted", res)
+	}
+	post("/v3/lease/timetolive", `{"ID":`+lease+`}`, http.StatusOK, &ttl)
+	if ttl.TTL != -1 {
+		t.Errorf("timetolive of a revoked lease = %d, want -1", ttl.TTL)
+	}
+	post("/v3/lease/revoke", `{"ID":`+lease+`}`, http.StatusNotFound, nil)
+
+	post("/v3/watch", `{}`, http.StatusNotImplemented, nil)
+	post("/v3/kv/range", `{"key":"`+b64("b")+`", "revision":"1"}`, http.StatusNotImplemented, nil)
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/errdefs"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+const (
+	// etcdLeasesTable holds the etcd leases, one row per lease ID with its
+	// TTL in seconds and the unix nanosecond time it expires at, moved by
+	// keepalives.  A revoked lease is marked until the keys attached to it
+	// are deleted, puts attaching keys to it then fail.
+	etcdLeasesTable        = "_etcd_leases"
+	etcdLeaseTTLColumn     = "ttl"
+	etcdLeaseExpiresColumn = "expires"
+	etcdLeaseRevokedColumn = "revoked"
+	etcdMinLeaseTTL        = 5
+	etcdMaxLeaseTTL        = 9000000000
+	etcdLeaseCheckInterval = time.Second
+)
+
+type etcdLease struct {
+	id        int64
+	ttl       int64
+	remaining int64
+	revision  uint64
+}
+
+// etcdLeaseGrant grants a lease of ttl seconds, at least etcdMinLeaseTTL.
+// A zero id picks one.
+func (n *server) etcdLeaseGrant(ctx context.Context, id, ttl int64) (etcdLease, error) {
+	if id < 0 || ttl > etcdMaxLeaseTTL {
+		return etcdLease{}, errdefs.New(errdefs.ErrInvalid, "etcd lease ID is negative or its TTL too large")
+	}
+	if id == 0 {
+		id = rand.Int63n(math.MaxInt64-1) + 1
+	}
+	if ttl < etcdMinLeaseTTL {
+		ttl = etcdMinLeaseTTL
+	}
+	expires := time.Now().Add(time.Duration(ttl) * time.Second).UnixNano()
+	index, err := n.etcdLeaseWrite(ctx, id, func(cols map[string]string) ([]multiraft.TxnWrite, error) {
+		if len(cols) > 0 {
+			return nil, errdefs.New(errdefs.ErrConflict, fmt.Sprintf("etcd lease %d already exists", id))
+		}
+		return []multiraft.TxnWrite{
+			{Table: etcdLeasesTable, Row: strconv.FormatInt(id, 10), Column: etcdLeaseTTLColumn, Val: strconv.FormatInt(ttl, 10)},
+			{Table: etcdLeasesTable, Row: strconv.FormatInt(id, 10), Column: etcdLeaseExpiresColumn, Val: strconv.FormatInt(expires, 10)},
+		}, nil
+	})
+	return etcdLease{id: id, ttl: ttl, remaining: ttl, revision: index}, err
+}
+
+// etcdLeaseKeepAlive renews a lease for its TTL.  An unknown lease is
+// reported with a zero TTL, as etcd does.
+func (n *server) etcdLeaseKeepAlive(ctx context.Context, id int64) (etcdLease, error) {
+	lease := etcdLease{id: id}
+	index, err := n.etcdLeaseWrite(ctx, id, func(cols map[string]string) ([]multiraft.TxnWrite, error) {
+		if len(cols) == 0 || cols[etcdLeaseRevokedColumn] != "" {
+			return nil, nil
+		}
+		lease.ttl, _ = strconv.ParseInt(cols[etcdLeaseTTLColumn], 10, 64)
+		expires := time.Now().Add(time.Duration(lease.ttl) * time.Second).UnixNano()
+		return []multiraft.TxnWrite{
+			{Table: etcdLeasesTable, Row: strconv.FormatInt(id, 10), Column: etcdLeaseExpiresColumn, Val: strconv.FormatInt(expires, 10)},
+		}, nil
+	})
+	lease.remaining, lease.revision = lease.ttl, index
+	return lease, err
+}
+
+// etcdLeaseRevoke revokes a lease and deletes the keys attached to it.
+func (n *server) etcdLeaseRevoke(ctx context.Context, id int64) (uint64, error) {
+	_, err := n.etcdLeaseWrite(ctx, id, func(cols map[string]string) ([]multiraft.TxnWrite, error) {
+		if len(cols) == 0 || cols[etcdLeaseRevokedColumn] != "" {
+			return nil, errdefs.New(errdefs.ErrNotFound, fmt.Sprintf("etcd lease %d not found", id))
+		}
+		return []multiraft.TxnWrite{
+			{Table: etcdLeasesTable, Row: strconv.FormatInt(id, 10), Column: etcdLeaseRevokedColumn, Val: "1"},
+		}, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n.etcdDropLease(ctx, id)
+}
+
+// etcdDropLease deletes the keys attached to a revoked lease, then the
+// lease.  The mark keeps puts from attaching keys in between, a node
+// failing before both are done leaves the lease to runEtcdLeaseExpiry.
+func (n *server) etcdDropLease(ctx context.Context, id int64) (uint64, error) {
+	filter := multiraft.RowFilter{Column: etcdLeaseColumn, Op: multiraft.FilterEquals, Value: strconv.FormatInt(id, 10)}
+	if _, err := n.DeleteWhere(ctx, etcdTable, "", filter); err != nil {
+		return 0, fmt.Errorf("deleting the keys of etcd lease %d: %w", id, err)
+	}
+	return n.DeleteKey(ctx, etcdLeasesTable, strconv.FormatInt(id, 10), "")
+}
+
+// etcdLeaseWrite applies the writes fn returns for the row of a lease, as
+// of a linearizable read, guarded by its version.  No writes apply nothing.
+func (n *server) etcdLeaseWrite(ctx context.Context, id int64, fn func(cols map[string]string) ([]multiraft.TxnWrite, error)) (uint64, error) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return 0, err
+	}
+	index, err := agent.ReadIndex(ctx)
+	if err != nil {
+		return 0, err
+	}
+	run := newEtcdRun(ctx, agent, index)
+	cols, _, err := run.row(etcdLeasesTable, strconv.FormatInt(id, 10))
+	if err != nil {
+		return 0, err
+	}
+	writes, err := fn(cols)
+	if err != nil || len(writes) == 0 {
+		return index, err
+	}
+	applied, err := agent.Apply(ctx, multiraft.KVData{Op: multiraft.OpBatch, Writes: writes, Reads: run.reads()})
+	if errors.Is(err, multiraft.ErrVersionMismatch) {
+		return 0, errdefs.New(errdefs.ErrConflict, fmt.Sprintf("etcd lease %d was changed concurrently", id))
+	}
+	return applied, err
+}
+
+// etcdLeaseTimeToLive returns a lease's TTL and the seconds it has left,
+// -1 when it doesn't exist, with the keys attached to it when keys is set.
+func (n *server) etcdLeaseTimeToLive(ctx context.Context, id int64, keys bool) (etcdLease, [][]byte, error) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return etcdLease{}, nil, err
+	}
+	index, err := agent.ReadIndex(ctx)
+	if err != nil {
+		return etcdLease{}, nil, err
+	}
+	run := newEtcdRun(ctx, agent, index)
+	cols, _, err := run.row(etcdLeasesTable, strconv.FormatInt(id, 10))
+	if err != nil {
+		return etcdLease{}, nil, err
+	}
+	lease := etcdLease{id: id, remaining: -1, revision: index}
+	if len(cols) == 0 || cols[etcdLeaseRevokedColumn] != "" {
+		return lease, nil, nil
+	}
+	lease.ttl, _ = strconv.ParseInt(cols[etcdLeaseTTLColumn], 10, 64)
+	expires, _ := strconv.ParseInt(cols[etcdLeaseExpiresColumn], 10, 64)
+	if left := time.Until(time.Unix(0, expires)); left > 0 {
+		lease.remaining = int64(math.Ceil(left.Seconds()))
+	} else {
+		lease.remaining = 0
+	}
+	if !keys {
+		return lease, nil, nil
+	}
+	kvs, err := run.keys("\x00", "\x00")
+	if err != nil {
+		return etcdLease{}, nil, err
+	}
+	var attached [][]byte
+	for _, kv := range kvs {
+		if kv.Lease == id {
+			attached = append(attached, kv.Key)
+		}
+	}
+	return lease, attached, nil
+}
+
+// etcdLeases returns the IDs of the leases granted and not revoked.
+func (n *server) etcdLeases(ctx context.Context) ([]int64, uint64, error) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return nil, 0, err
+	}
+	index, err := agent.ReadIndex(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	var ids []int64
+	err = n.scanEtcdLeases(ctx, func(row multiraft.ScanRow) error {
+		if row.Columns[etcdLeaseRevokedColumn] == "" {
+			id, _ := strconv.ParseInt(row.Key, 10, 64)
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	return ids, index, err
+}
+
+func (n *server) scanEtcdLeases(ctx context.Context, fn func(multiraft.ScanRow) error) error {
+	for after, more := "", true; more; {
+		page, _, err := n.ScanPage(ctx, etcdLeasesTable, after, maxScanLimit, ConsistencyGlobal)
+		if err != nil {
+			return err
+		}
+		for _, row := range page.Rows {
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+		more = page.More
+		if len(page.Rows) > 0 {
+			after = page.Rows[len(page.Rows)-1].Key
+		}
+	}
+	return nil
+}
+
+// runEtcdLeaseExpiry revokes the leases not kept alive, while this node
+// leads.  As etcd does on a new leader, every lease gets its full TTL from
+// the time the node took over: keepalives sent to the old leader's clock
+// aren't held against it.
+func (n *server) runEtcdLeaseExpiry(ctx context.Context) {
+	start := time.Now()
+	ticker := time.NewTicker(etcdLeaseCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		err := n.scanEtcdLeases(ctx, func(row multiraft.ScanRow) error {
+			id, err := strconv.ParseInt(row.Key, 10, 64)
+			if err != nil {
+				return nil
+			}
+			ttl, _ := strconv.ParseInt(row.Columns[etcdLeaseTTLColumn], 10, 64)
+			expires, _ := strconv.ParseInt(row.Columns[etcdLeaseExpiresColumn], 10, 64)
+			revoked := row.Columns[etcdLeaseRevokedColumn] != ""
+			if !revoked && (now.UnixNano() < expires || now.Sub(start) < time.Duration(ttl)*time.Second) {
+				return nil
+			}
+			if !revoked {
+				// guarded by the version scanned, a keepalive since wins.
+				writes := []multiraft.TxnWrite{{Table: etcdLeasesTable, Row: row.Key, Column: etcdLeaseRevokedColumn, Val: "1"}}
+				reads := []multiraft.RowRead{{Table: etcdLeasesTable, Row: row.Key, Version: row.Version}}
+				agent, err := n.shardAgent(shardID1)
+				if err != nil {
+					return err
+				}
+				_, err = agent.Apply(ctx, multiraft.KVData{Op: multiraft.OpBatch, Writes: writes, Reads: reads})
+				if errors.Is(err, multiraft.ErrVersionMismatch) {
+					return nil
+				} else if err != nil {
+					return err
+				}
+			}
+			if _, err := n.etcdDropLease(ctx, id); err != nil {
+				return err
+			}
+			n.logger.Debug("etcd lease expired", zap.Int64("lease", id))
+			return nil
+		})
+		if err != nil && ctx.Err() == nil {
+			n.logger.Warn("failed to expire etcd leases", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,481 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/errdefs"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+// etcdTxnAttempts bounds the runs of an etcd txn whose keys were modified
+// before it applied, see etcdTxn.
+const etcdTxnAttempts = 5
+
+// etcdTxn runs an etcd txn: its compares and operations read the keys at a
+// linearizable read index and its writes are applied as a single OpBatch
+// guarded by the versions of every key read, so it applies as if it ran at
+// that index or not at all.  A txn whose keys were modified in between is
+// run again after a jittered backoff.  Operations see the keys as they were
+// before the txn, as etcd's do but for keys it writes, which it writes
+// once.  The keys of a range aren't guarded against keys created in it.
+func (n *server) etcdTxn(ctx context.Context, req *etcdTxnRequest) (*etcdTxnResponse, error) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return nil, err
+	}
+	backoff := txnRetryMinBackoff
+	for attempt := 1; attempt <= etcdTxnAttempts; attempt++ {
+		if attempt > 1 {
+			// jittered, so the txns that collided don't collide again.
+			timer := time.NewTimer(backoff/2 + time.Duration(rand.Int63n(int64(backoff))))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			case <-timer.C:
+			}
+			backoff *= 2
+		}
+		index, err := agent.ReadIndex(ctx)
+		if err != nil {
+			return nil, err
+		}
+		run := newEtcdRun(ctx, agent, index)
+		res, err := run.txn(req)
+		if err != nil {
+			return nil, err
+		}
+		if len(run.writes) == 0 {
+			unchanged, err := run.unchanged()
+			if err != nil {
+				return nil, err
+			}
+			if unchanged {
+				run.setRevision(index)
+				return res, nil
+			}
+			continue
+		}
+		if err := n.sealWrites(run.writes); err != nil {
+			return nil, err
+		}
+		applied, err := agent.Apply(ctx, multiraft.KVData{Op: multiraft.OpBatch, Writes: run.writes, Reads: run.reads()})
+		if errors.Is(err, multiraft.ErrVersionMismatch) {
+			n.logger.Debug("Keys read by etcd txn were modified, running it again", zap.Int("attempt", attempt))
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		run.setRevision(applied)
+		return res, nil
+	}
+	return nil, errdefs.New(errdefs.ErrConflict, "etcd txn kept conflicting with other writes")
+}
+
+// etcdDeleteRange deletes the keys in [key, rangeEnd) in a single raft
+// entry.  The keys deleted are counted, and returned with prev_kv, as they
+// were just before: keys written in between are deleted but not counted.
+func (n *server) etcdDeleteRange(ctx context.Context, req *etcdDeleteRangeRequest) (*etcdDeleteRangeResponse, error) {
+	if len(req.Key) == 0 {
+		return nil, errdefs.New(errdefs.ErrInvalid, "etcd request without a key")
+	}
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return nil, err
+	}
+	index, err := agent.ReadIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	kvs, err := newEtcdRun(ctx, agent, index).keys(string(req.Key), string(req.RangeEnd))
+	if err != nil {
+		return nil, err
+	}
+	res := &etcdDeleteRangeResponse{Header: etcdHeader{index}, Deleted: int64(len(kvs))}
+	if len(kvs) == 0 {
+		return res, nil
+	}
+	if req.PrevKV {
+		res.PrevKVs = kvs
+	}
+	to := string(req.RangeEnd)
+	switch to {
+	case "":
+		to = string(req.Key) + "\x00" // only the key sorts before it
+	case "\x00":
+		to = "" // every key from Key on
+	}
+	if res.Header.Revision, err = n.DeleteRange(ctx, etcdTable, string(req.Key), to); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// etcdRun is a run of an etcd txn.  Keys are read at index, their columns
+// and versions kept for the writes and their guard.
+type etcdRun struct {
+	ctx      context.Context
+	agent    raftAgent
+	index    uint64
+	rows     map[rowRef]map[string]string
+	versions map[rowRef]uint64
+	// written holds the keys written, a txn writes a key once.
+	written map[string]bool
+	writes  []multiraft.TxnWrite
+	// headers are the headers of the responses, set once the revision is
+	// known.
+	headers []*etcdHeader
+}
+
+func newEtcdRun(ctx context.Context, agent raftAgent, index uint64) *etcdRun {
+	return &etcdRun{ctx: ctx, agent: agent, index: index,
+		rows: map[rowRef]map[string]string{}, versions: map[rowRef]uint64{}, written: map[string]bool{}}
+}
+
+func (r *etcdRun) txn(req *etcdTxnRequest) (*etcdTxnResponse, error) {
+	res := &etcdTxnResponse{Succeeded: true}
+	r.headers = append(r.headers, &res.Header)
+	for _, c := range req.Compare {
+		ok, err := r.compare(c)
+		if err != nil {
+			return nil, err
+		}
+		res.Succeeded = res.Succeeded && ok
+	}
+	ops := req.Success
+	if !res.Succeeded {
+		ops = req.Failure
+	}
+	for _, op := range ops {
+		var resOp etcdResponseOp
+		var err error
+		switch {
+		case op.RequestRange != nil:
+			resOp.ResponseRange, err = r.rangeKeys(op.RequestRange)
+		case op.RequestPut != nil:
+			resOp.ResponsePut, err = r.put(op.RequestPut)
+		case op.RequestDeleteRange != nil:
+			resOp.ResponseDeleteRange, err = r.deleteRange(op.RequestDeleteRange)
+		default:
+			err = fmt.Errorf("%w: txn operation", errEtcdUnsupported)
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.Responses = append(res.Responses, resOp)
+	}
+	if len(r.writes) > maxBatchWrites {
+		return nil, errdefs.New(errdefs.ErrInvalid, fmt.Sprintf("an etcd txn writes at most %d columns", maxBatchWrites))
+	}
+	return res, nil
+}
+
+func (r *etcdRun) setRevision(revision uint64) {
+	for _, h := range r.headers {
+		h.Revision = revision
+	}
+}
+
+// row reads a row at the run's index, once.  A row absent has no columns.
+func (r *etcdRun) row(table, key string) (map[string]string, uint64, error) {
+	ref := rowRef{table: table, key: key}
+	if cols, ok := r.rows[ref]; ok {
+		return cols, r.versions[ref], nil
+	}
+	res, err := r.agent.ReadAtIndex(r.ctx, multiraft.RowQuery{Table: table, Row: key}, r.index)
+	if err != nil {
+		return nil, 0, err
+	}
+	row, ok := res.(*multiraft.Row)
+	if !ok {
+		return nil, 0, fmt.Errorf("converting result to *multiraft.Row: %T", res)
+	}
+	r.remember(ref, row.Columns, row.Version)
+	return row.Columns, row.Version, nil
+}
+
+func (r *etcdRun) remember(ref rowRef, cols map[string]string, version uint64) {
+	r.rows[ref], r.versions[ref] = cols, version
+}
+
+// get returns a key, ok is false when it doesn't exist.
+func (r *etcdRun) get(key string) (etcdKV, bool, error) {
+	cols, version, err := r.row(etcdTable, key)
+	if err != nil || len(cols) == 0 {
+		return etcdKV{}, false, err
+	}
+	return etcdKVOf(key, cols, version), true, nil
+}
+
+// keys returns the keys in [key, rangeEnd), or just key when rangeEnd is
+// empty.  A rangeEnd of "\x00" means every key from key on.
+func (r *etcdRun) keys(key, rangeEnd string) ([]etcdKV, error) {
+	if rangeEnd != "" && rangeEnd != "\x00" && rangeEnd <= key {
+		return nil, nil
+	}
+	var kvs []etcdKV
+	kv, ok, err := r.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		kvs = append(kvs, kv)
+	}
+	if rangeEnd == "" {
+		return kvs, nil
+	}
+	for after, more := key, true; more; {
+		res, err := r.agent.ReadAtIndex(r.ctx, multiraft.ScanPageQuery{Table: etcdTable, After: after, Limit: maxScanLimit}, r.index)
+		if err != nil {
+			return nil, err
+		}
+		page, ok := res.(*multiraft.ScanPage)
+		if !ok {
+			return nil, fmt.Errorf("converting result to *multiraft.ScanPage: %T", res)
+		}
+		more = page.More
+		for _, row := range page.Rows {
+			if rangeEnd != "\x00" && row.Key >= rangeEnd {
+				more = false
+				break
+			}
+			r.remember(rowRef{table: etcdTable, key: row.Key}, row.Columns, row.Version)
+			kvs = append(kvs, etcdKVOf(row.Key, row.Columns, row.Version))
+		}
+		if len(page.Rows) > 0 {
+			after = page.Rows[len(page.Rows)-1].Key
+		}
+	}
+	return kvs, nil
+}
+
+func etcdKVOf(key string, cols map[string]string, version uint64) etcdKV {
+	kv := etcdKV{Key: []byte(key), Value: []byte(cols[etcdValueColumn]), CreateRevision: version, ModRevision: version, Version: 1}
+	if v, err := strconv.ParseUint(cols[etcdVersionColumn], 10, 64); err == nil {
+		kv.Version = v
+	}
+	if c, err := strconv.ParseUint(cols[etcdCreateColumn], 10, 64); err == nil {
+		kv.CreateRevision = c
+	}
+	kv.Lease, _ = strconv.ParseInt(cols[etcdLeaseColumn], 10, 64)
+	return kv
+}
+
+func (r *etcdRun) compare(c etcdCompare) (bool, error) {
+	if len(c.Key) == 0 {
+		return false, errdefs.New(errdefs.ErrInvalid, "etcd compare without a key")
+	}
+	if len(c.RangeEnd) > 0 {
+		return false, fmt.Errorf("%w: compares over a range", errEtcdUnsupported)
+	}
+	kv, ok, err := r.get(string(c.Key))
+	if err != nil {
+		return false, err
+	}
+	var cmp int
+	switch c.Target {
+	case "", "VERSION":
+		// an absent key has a zero version, revisions and lease.
+		cmp = compareInt64(int64(kv.Version), c.Version)
+	case "CREATE":
+		cmp = compareInt64(int64(kv.CreateRevision), c.CreateRevision)
+	case "MOD":
+		cmp = compareInt64(int64(kv.ModRevision), c.ModRevision)
+	case "LEASE":
+		cmp = compareInt64(kv.Lease, c.Lease)
+	case "VALUE":
+		if !ok {
+			return false, nil // etcd fails value compares of keys that don't exist
+		}
+		cmp = bytes.Compare(kv.Value, c.Value)
+	default:
+		return false, errdefs.New(errdefs.ErrInvalid, fmt.Sprintf("unknown etcd compare target %q", c.Target))
+	}
+	switch c.Result {
+	case "", "EQUAL":
+		return cmp == 0, nil
+	case "NOT_EQUAL":
+		return cmp != 0, nil
+	case "GREATER":
+		return cmp > 0, nil
+	case "LESS":
+		return cmp < 0, nil
+	}
+	return false, errdefs.New(errdefs.ErrInvalid, fmt.Sprintf("unknown etcd compare result %q", c.Result))
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func (r *etcdRun) rangeKeys(req *etcdRangeRequest) (*etcdRangeResponse, error) {
+	if len(req.Key) == 0 || req.Limit < 0 {
+		return nil, errdefs.New(errdefs.ErrInvalid, "etcd range without a key or with a negative limit")
+	}
+	if req.Revision != 0 {
+		return nil, fmt.Errorf("%w: reads at a past revision", errEtcdUnsupported)
+	}
+	kvs, err := r.keys(string(req.Key), string(req.RangeEnd))
+	if err != nil {
+		return nil, err
+	}
+	res := &etcdRangeResponse{Count: int64(len(kvs))}
+	r.headers = append(r.headers, &res.Header)
+	if req.CountOnly {
+		return res, nil
+	}
+	if req.Limit > 0 && int64(len(kvs)) > req.Limit {
+		kvs, res.More = kvs[:req.Limit], true
+	}
+	if req.KeysOnly {
+		for i := range kvs {
+			kvs[i].Value = nil
+		}
+	}
+	res.KVs = kvs
+	return res, nil
+}
+
+func (r *etcdRun) put(req *etcdPutRequest) (*etcdPutResponse, error) {
+	key := string(req.Key)
+	if key == "" {
+		return nil, errdefs.New(errdefs.ErrInvalid, "etcd put without a key")
+	}
+	if r.written[key] {
+		return nil, errdefs.New(errdefs.ErrInvalid, "duplicate key given in txn request")
+	}
+	r.written[key] = true
+	prev, exists, err := r.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists && (req.IgnoreValue || req.IgnoreLease) {
+		return nil, errdefs.New(errdefs.ErrNotFound, fmt.Sprintf("etcd key %q not found", key))
+	}
+	value, lease := string(req.Value), req.Lease
+	if req.IgnoreValue {
+		value = string(prev.Value)
+	}
+	if req.IgnoreLease {
+		lease = prev.Lease
+	}
+	if lease != 0 && lease != prev.Lease {
+		if err := r.checkLease(lease); err != nil {
+			return nil, err
+		}
+	}
+
+	write := func(column, value string) {
+		r.writes = append(r.writes, multiraft.TxnWrite{Table: etcdTable, Row: key, Column: column, Val: value})
+	}
+	write(etcdValueColumn, value)
+	if exists {
+		write(etcdVersionColumn, strconv.FormatUint(prev.Version+1, 10))
+		write(etcdCreateColumn, strconv.FormatUint(prev.CreateRevision, 10))
+	}
+	if lease != 0 {
+		write(etcdLeaseColumn, strconv.FormatInt(lease, 10))
+	} else if prev.Lease != 0 {
+		r.writes = append(r.writes, multiraft.TxnWrite{Table: etcdTable, Row: key, Column: etcdLeaseColumn, Delete: true})
+	}
+
+	res := &etcdPutResponse{}
+	r.headers = append(r.headers, &res.Header)
+	if req.PrevKV && exists {
+		res.PrevKV = &prev
+	}
+	return res, nil
+}
+
+// checkLease reads the lease a key is attached to, which must be granted
+// and not revoked.  Its version guards the write: a revoke or a keepalive
+// in between runs the txn again.
+func (r *etcdRun) checkLease(id int64) error {
+	cols, _, err := r.row(etcdLeasesTable, strconv.FormatInt(id, 10))
+	if err != nil {
+		return err
+	}
+	if len(cols) == 0 || cols[etcdLeaseRevokedColumn] != "" {
+		return errdefs.New(errdefs.ErrNotFound, fmt.Sprintf("etcd lease %d not found", id))
+	}
+	return nil
+}
+
+func (r *etcdRun) deleteRange(req *etcdDeleteRangeRequest) (*etcdDeleteRangeResponse, error) {
+	if len(req.Key) == 0 {
+		return nil, errdefs.New(errdefs.ErrInvalid, "etcd delete without a key")
+	}
+	kvs, err := r.keys(string(req.Key), string(req.RangeEnd))
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range kvs {
+		key := string(kv.Key)
+		if r.written[key] {
+			return nil, errdefs.New(errdefs.ErrInvalid, "duplicate key given in txn request")
+		}
+		r.written[key] = true
+		columns := make([]string, 0, len(r.rows[rowRef{table: etcdTable, key: key}]))
+		for column := range r.rows[rowRef{table: etcdTable, key: key}] {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		for _, column := range columns {
+			r.writes = append(r.writes, multiraft.TxnWrite{Table: etcdTable, Row: key, Column: column, Delete: true})
+		}
+	}
+	res := &etcdDeleteRangeResponse{Deleted: int64(len(kvs))}
+	r.headers = append(r.headers, &res.Header)
+	if req.PrevKV {
+		res.PrevKVs = kvs
+	}
+	return res, nil
+}
+
+// reads returns the rows read, for the guard of the writes.
+func (r *etcdRun) reads() []multiraft.RowRead {
+	reads := make([]multiraft.RowRead, 0, len(r.versions))
+	for ref, version := range r.versions {
+		reads = append(reads, multiraft.RowRead{Table: ref.table, Row: ref.key, Version: version})
+	}
+	sort.Slice(reads, func(i, j int) bool {
+		if reads[i].Table != reads[j].Table {
+			return reads[i].Table < reads[j].Table
+		}
+		return reads[i].Row < reads[j].Row
+	})
+	return reads
+}
+
+// unchanged reports whether the rows read are still at the versions they
+// were read at, so the reads saw a consistent view of them.
+func (r *etcdRun) unchanged() (bool, error) {
+	for ref, version := range r.versions {
+		res, err := r.agent.ReadLocal(multiraft.RowQuery{Table: ref.table, Row: ref.key})
+		if err != nil {
+			return false, err
+		}
+		row, ok := res.(*multiraft.Row)
+		if !ok {
+			return false, fmt.Errorf("converting result to *multiraft.Row: %T", res)
+		}
+		if row.Version != version {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// eventsTable is the system table cluster lifecycle events are recorded in,
+// one row per event keyed by its time (zero padded unix nanoseconds) and the
+// recording node so rows scan in time order.  Clients can read it but not
+// write it.
+const eventsTable = "_events"
+
+const (
+	eventLeaderElected   = "leader_elected"
+	eventMemberJoined    = "member_joined"
+	eventMemberLeft      = "member_left"
+	eventMemberFailed    = "member_failed"
+	eventDecommissioned  = "node_decommissioned"
+	eventVoterAdded      = "voter_added"
+	eventVoterDemoted    = "voter_demoted"
+	eventReplicaRemoved  = "replica_removed"
+	eventWitnessAdded    = "witness_added"
+	eventMaintenance     = "maintenance_changed"
+	eventWritesFrozen    = "writes_frozen"
+	eventWritesThawed    = "writes_thawed"
+	eventSnapshotShip    = "snapshot_shipped"
+	eventSnapshotFailed  = "snapshot_ship_failed"
+	eventSnapshotApply   = "snapshot_applied"
+	eventArchiveSnapshot = "snapshot_archived"
+	eventArchiveFailed   = "archive_failed"
+	eventPromoted        = "standby_promoted"
+	eventDiskLow         = "disk_space_low"
+	eventDiskRecovered   = "disk_space_recovered"
+	eventDeadLettered    = "sink_dead_lettered"
+)
+
+const (
+	// eventWriteTimeout bounds recording an event.
+	eventWriteTimeout = 10 * time.Second
+	// eventRetention is how long events are kept, older ones are pruned by
+	// the leader along with tombstones.
+	eventRetention = 90 * 24 * time.Hour
+)
+
+// recordEvent appends an event about subject (usually a node ID) to the
+// event log, waiting at most eventWriteTimeout.  Failing to record one is
+// logged, never returned: the change it describes has already happened.
+func (n *server) recordEvent(ctx context.Context, kind, subject, detail string) {
+	ctx, cancel := context.WithTimeout(ctx, eventWriteTimeout)
+	defer cancel()
+	now := time.Now().UTC()
+	key := fmt.Sprintf("%020d-%s", now.UnixNano(), n.config.ID())
+	cols := map[string]string{
+		"type":    kind,
+		"node":    n.config.ID(),
+		"subject": subject,
+		"time":    now.Format(time.RFC3339Nano),
+	}
+	if detail != "" {
+		cols["detail"] = detail
+	}
+	if _, err := n.SetRow(ctx, eventsTable, key, cols, false, nil); err != nil {
+		n.logger.Warn("failed to record event", zap.String("type", kind), zap.String("subject", subject), zap.Error(err))
+	}
+}
+
+// recordEventIfLeader records an event seen by every node, gossip membership
+// changes, once: on the leader.
+func (n *server) recordEventIfLeader(kind, subject, detail string) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return
+	}
+	if isLeader, err := agent.IsLeader(); err != nil || !isLeader {
+		return
+	}
+	select {
+	case n.memberWrites <- struct{}{}:
+	default:
+		// a flood of member events, the catalog writes matter more.
+		n.logger.Warn("too many member writes in flight, dropping event", zap.String("type", kind), zap.String("subject", subject))
+		return
+	}
+	go func() {
+		defer func() { <-n.memberWrites }()
+		n.recordEvent(context.Background(), kind, subject, detail)
+	}()
+}
+
+// pruneEvents deletes the events older than eventRetention, in one entry:
+// event keys start with their time so the old ones are a range of keys.
+func (n *server) pruneEvents(ctx context.Context) error {
+	cutoff := fmt.Sprintf("%020d", time.Now().Add(-eventRetention).UnixNano())
+	_, err := n.DeleteRange(ctx, eventsTable, "", cutoff)
+	return err
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/config"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	machines "github.com/epsniff/expodb/pkg/server/state-machines"
+	"go.uber.org/zap"
+)
+
+// eventAgent records the entries proposed and the deadlines they were
+// proposed with.
+type eventAgent struct {
+	raftAgent
+	entries   []multiraft.KVData
+	deadlines []bool
+}
+
+func (a *eventAgent) ReadLocal(query interface{}) (interface{}, error) { return nil, nil }
+
+func (a *eventAgent) Apply(ctx context.Context, entry machines.RaftEntry) (uint64, error) {
+	_, ok := ctx.Deadline()
+	a.entries = append(a.entries, entry.(multiraft.KVData))
+	a.deadlines = append(a.deadlines, ok)
+	return uint64(len(a.entries)), nil
+}
+
+func TestEvents(t *testing.T) {
+	agent := &eventAgent{}
+	n := &server{raftAgents: map[uint64]raftAgent{shardID1: agent}, config: &config.Config{NodeName: "node-1"}, logger: zap.NewNop()}
+
+	n.recordEvent(context.Background(), eventLeaderElected, "node-1", "")
+	if len(agent.entries) != 1 || !agent.deadlines[0] {
+		t.Fatalf("recordEvent() proposed %v with deadlines %v, want one entry with a deadline", agent.entries, agent.deadlines)
+	}
+	if e := agent.entries[0]; e.Table != eventsTable || e.Columns["type"] != eventLeaderElected || e.Columns["subject"] != "node-1" {
+		t.Errorf("recordEvent() proposed %+v", e)
+	}
+
+	before := fmt.Sprintf("%020d", time.Now().Add(-eventRetention).UnixNano())
+	if err := n.pruneEvents(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	after := fmt.Sprintf("%020d", time.Now().Add(-eventRetention).UnixNano())
+	if len(agent.entries) != 2 {
+		t.Fatalf("pruneEvents() proposed %d entries, want 1", len(agent.entries)-1)
+	}
+	if e := agent.entries[1]; e.Op != multiraft.OpDeleteRange || e.Table != eventsTable || e.Row != "" || e.Val < before || e.Val > after {
+		t.Errorf("pruneEvents() proposed %+v, want the events before %s deleted", e, before)
+	}
+}
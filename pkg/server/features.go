@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/epsniff/expodb/pkg/errdefs"
+	machines "github.com/epsniff/expodb/pkg/server/state-machines"
+	"github.com/epsniff/expodb/pkg/server/state-machines/featureflags"
+	"go.uber.org/zap"
+)
+
+// The feature flags, set cluster wide through raft so features can be turned
+// on and off without restarting nodes with new flags.
+const (
+	// featureCDC has the leader deliver the outbox to the change sinks.
+	// Off, the changes keep piling up in the outbox until it is back on.
+	featureCDC = "cdc"
+	// featureBinaryCodecs has the API take and answer msgpack and protobuf.
+	// Off, those bodies get a 415 and every answer is JSON.
+	featureBinaryCodecs = "binary_codecs"
+	// featureAutopilot has the leader demote lagging voters, on the nodes
+	// started with --autopilot-demote-lag.
+	featureAutopilot = "autopilot"
+)
+
+// featureDefaults are the flags a cluster knows of, at the value they have
+// until an operator sets them.
+var featureDefaults = map[string]bool{
+	featureCDC:          true,
+	featureBinaryCodecs: true,
+	featureAutopilot:    true,
+}
+
+// featureEnabled reports whether a flag is on as this node's replica last
+// saw it, its default when the replica can't be read.
+func (n *server) featureEnabled(name string) bool {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return featureDefaults[name]
+	}
+	res, err := agent.ReadLocal(machines.NamedQuery{Machine: featureflags.FSMName, Query: featureflags.ListQuery{}})
+	if err != nil {
+		return featureDefaults[name]
+	}
+	flags, _ := res.(map[string]bool)
+	if enabled, ok := flags[name]; ok {
+		return enabled
+	}
+	return featureDefaults[name]
+}
+
+// featureFlag is a flag as listed by /admin/_features, Set when an operator
+// set it rather than it being at its default.
+type featureFlag struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Default bool   `json:"default"`
+	Set     bool   `json:"set"`
+}
+
+// FeatureFlags returns the flags the cluster knows of, by name.
+func (n *server) FeatureFlags(ctx context.Context) (map[string]featureFlag, error) {
+	res, err := n.ReadFSM(ctx, featureflags.FSMName, featureflags.ListQuery{})
+	if err != nil {
+		return nil, err
+	}
+	set, ok := res.(map[string]bool)
+	if !ok {
+		return nil, fmt.Errorf("converting result to map[string]bool: %T", res)
+	}
+	flags := make(map[string]featureFlag, len(featureDefaults))
+	for name, def := range featureDefaults {
+		enabled, ok := set[name]
+		if !ok {
+			enabled = def
+		}
+		flags[name] = featureFlag{Name: name, Enabled: enabled, Default: def, Set: ok}
+	}
+	return flags, nil
+}
+
+// SetFeatureFlag turns a flag on or off cluster wide, or back to its default
+// when enabled is nil.  Nodes act on it once their replica has applied it.
+func (n *server) SetFeatureFlag(ctx context.Context, name string, enabled *bool) (uint64, error) {
+	if _, ok := featureDefaults[name]; !ok {
+		return 0, errdefs.New(errdefs.ErrInvalid, fmt.Sprintf("unknown feature flag %q", name))
+	}
+	return n.ApplyFSM(ctx, featureflags.Event{Name: name, Enabled: enabled})
+}
+
+func (server *httpServer) handleFeatureFlags(w http.ResponseWriter, r *http.Request) {
+	flags, err := server.node.FeatureFlags(r.Context())
+	if err != nil {
+		server.logger.Error("Failed to list feature flags", zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	respond(w, http.StatusOK, map[string]map[string]featureFlag{"flags": flags}, server.logger)
+}
+
+func (server *httpServer) handleFeatureFlagSet(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Name    string `json:"name"`
+		Enabled *bool  `json:"enabled"`
+	}{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	index, err := server.node.SetFeatureFlag(r.Context(), req.Name, req.Enabled)
+	if err != nil {
+		server.logger.Error("Failed to set feature flag", zap.String("flag", req.Name), zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	server.logger.Info("Set feature flag", zap.String("flag", req.Name), zap.Boolp("enabled", req.Enabled))
+	respond(w, http.StatusOK, map[string]uint64{"index": index}, server.logger)
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	grafanaPrefix = "/grafana"
+	// maxGrafanaPoints bounds the samples read per query target, they are
+	// thinned down to the panel's maxDataPoints.
+	maxGrafanaPoints = 100000
+)
+
+// handleGrafanaRequest serves Grafana's simple JSON datasource API over a
+// time-series table.  The datasource URL is /grafana/<table>, /grafana for the
+// metrics table:
+//
+//	GET  /          connection test
+//	POST /search    the series keys containing the target
+//	POST /query     timeserie targets are series keys, table targets name a
+//	                plain table whose rows are returned
+//	POST /annotations  the query names a table of rows with time (unix ms),
+//	                title, text and tags (comma separated) columns
+func (server *httpServer) handleGrafanaRequest(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, grafanaPrefix)
+	table, endpoint := defaultMetricsTable, strings.Trim(rest, "/")
+	if parts := strings.SplitN(endpoint, "/", 2); len(parts) == 2 || (len(parts) == 1 && !isGrafanaEndpoint(parts[0])) {
+		table, endpoint = parts[0], ""
+		if len(parts) == 2 {
+			endpoint = parts[1]
+		}
+	}
+	if !server.checkTable(w, r, ActionRead, table) {
+		return
+	}
+	if endpoint == "" && r.Method == http.MethodGet {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost || !isGrafanaEndpoint(endpoint) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	req := struct {
+		Target string `json:"target"`
+		Range  struct {
+			From time.Time `json:"from"`
+			To   time.Time `json:"to"`
+		} `json:"range"`
+		Targets []struct {
+			Target string `json:"target"`
+			Type   string `json:"type"`
+		} `json:"targets"`
+		MaxDataPoints int `json:"maxDataPoints"`
+		Annotation    struct {
+			Name  string `json:"name"`
+			Query string `json:"query"`
+		} `json:"annotation"`
+	}{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	from, to := req.Range.From.UnixMilli(), req.Range.To.UnixMilli()
+	if req.Range.To.IsZero() {
+		to = time.Now().UnixMilli()
+	}
+
+	var response interface{}
+	var err error
+	switch endpoint {
+	case "search":
+		var series map[string]map[string]string
+		series, err = server.node.ListSeries(r.Context(), table)
+		keys := []string{}
+		for key := range series {
+			if strings.Contains(key, req.Target) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		response = keys
+	case "query":
+		results := []interface{}{}
+		for _, target := range req.Targets {
+			if target.Type == "table" {
+				if !server.checkTable(w, r, ActionRead, target.Target) {
+					return
+				}
+				var result interface{}
+				if result, err = server.grafanaTable(r, target.Target); err != nil {
+					break
+				}
+				results = append(results, result)
+				continue
+			}
+			var points []tsPoint
+			if points, err = server.node.QuerySamples(r.Context(), table, target.Target, from, to, maxGrafanaPoints); err != nil {
+				break
+			}
+			datapoints := [][2]float64{}
+			for _, p := range thinPoints(points, req.MaxDataPoints) {
+				datapoints = append(datapoints, [2]float64{p.Value, float64(p.Timestamp)})
+			}
+			results = append(results, map[string]interface{}{"target": target.Target, "datapoints": datapoints})
+		}
+		response = results
+	case "annotations":
+		if !server.checkTable(w, r, ActionRead, req.Annotation.Query) {
+			return
+		}
+		response, err = server.grafanaAnnotations(r, req.Annotation.Name, req.Annotation.Query, from, to)
+	}
+	if err != nil {
+		server.logger.Error("Failed grafana request", zap.String("endpoint", endpoint), zap.Error(err))
+		statusInternalError(w)
+		return
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
+
+func isGrafanaEndpoint(s string) bool {
+	return s == "search" || s == "query" || s == "annotations" || s == ""
+}
+
+// grafanaTable returns up to maxScanLimit rows of a table as a Grafana table.
+func (server *httpServer) grafanaTable(r *http.Request, table string) (interface{}, error) {
+	page, _, err := server.node.ScanPage(r.Context(), table, "", maxScanLimit, ConsistencyGlobal)
+	if err != nil {
+		return nil, err
+	}
+	columnSet := map[string]bool{}
+	for _, row := range page.Rows {
+		for col := range row.Columns {
+			columnSet[col] = true
+		}
+	}
+	names := make([]string, 0, len(columnSet))
+	for col := range columnSet {
+		names = append(names, col)
+	}
+	sort.Strings(names)
+	columns := []map[string]string{{"text": "key", "type": "string"}}
+	for _, col := range names {
+		columns = append(columns, map[string]string{"text": col, "type": "string"})
+	}
+	rows := [][]string{}
+	for _, row := range page.Rows {
+		values := []string{row.Key}
+		for _, col := range names {
+			values = append(values, row.Columns[col])
+		}
+		rows = append(rows, values)
+	}
+	return map[string]interface{}{"type": "table", "columns": columns, "rows": rows}, nil
+}
+
+// grafanaAnnotations returns the rows of table whose time is in [from, to].
+func (server *httpServer) grafanaAnnotations(r *http.Request, name, table string, from, to int64) (interface{}, error) {
+	annotations := []map[string]interface{}{}
+	for after := ""; ; {
+		page, _, err := server.node.ScanPage(r.Context(), table, after, maxScanLimit, ConsistencyGlobal)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range page.Rows {
+			at, err := strconv.ParseInt(row.Columns["time"], 10, 64)
+			if err != nil || at < from || at > to {
+				continue
+			}
+			tags := []string{}
+			if row.Columns["tags"] != "" {
+				tags = strings.Split(row.Columns["tags"], ",")
+			}
+			annotations = append(annotations, map[string]interface{}{
+				"annotation": name,
+				"time":       at,
+				"title":      row.Columns["title"],
+				"text":       row.Columns["text"],
+				"tags":       tags,
+			})
+		}
+		if !page.More {
+			return annotations, nil
+		}
+		after = page.Rows[len(page.Rows)-1].Key
+	}
+}
+
+// thinPoints keeps every n-th point so at most max are left.
+func thinPoints(points []tsPoint, max int) []tsPoint {
+	if max <= 0 || len(points) <= max {
+		return points
+	}
+	step := (len(points) + max - 1) / max
+	thinned := make([]tsPoint, 0, max)
+	for i := 0; i < len(points); i += step {
+		thinned = append(thinned, points[i])
+	}
+	return thinned
+}
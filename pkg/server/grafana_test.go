@@ -0,0 +1,17 @@
+package server
+
+import "testing"
+
+func TestThinPoints(t *testing.T) {
+	var points []tsPoint
+	for i := 0; i < 10; i++ {
+		points = append(points, tsPoint{Timestamp: int64(i)})
+	}
+	if got := thinPoints(points, 0); len(got) != 10 {
+		t.Errorf("thinPoints(0) kept %d points", len(got))
+	}
+	got := thinPoints(points, 4)
+	if len(got) > 4 || got[0].Timestamp != 0 || got[1].Timestamp != 3 {
+		t.Errorf("thinPoints(4) = %+v", got)
+	}
+}
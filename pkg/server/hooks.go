@@ -0,0 +1,108 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+)
+
+// Member is a cluster member as the membership hooks see it.  State is its
+// node catalog state: alive, failed, left or decommissioned.
+type Member struct {
+	ID       string
+	RaftAddr string
+	HTTPAddr string
+	Role     string
+	Zone     string
+	State    string
+}
+
+func memberOf(node *nodedata) Member {
+	return Member{
+		ID:       node.ID(),
+		RaftAddr: node.RaftAddr(),
+		HTTPAddr: node.HttpAddr(),
+		Role:     node.Role(),
+		Zone:     node.Zone(),
+		State:    string(node.State()),
+	}
+}
+
+// hooks are the callbacks embedders registered, they are called in the order
+// they were registered.
+type hooks struct {
+	mu           sync.Mutex
+	leaderChange []func(multiraft.LeaderInfo)
+	memberJoin   []func(Member)
+	memberLeave  []func(Member)
+	apply        []func(uint64, multiraft.KVData)
+}
+
+// OnLeaderChange calls fn every time the shard's leader changes, with an
+// empty LeaderInfo while there is none.
+func (n *server) OnLeaderChange(fn func(multiraft.LeaderInfo)) {
+	n.hooks.mu.Lock()
+	defer n.hooks.mu.Unlock()
+	n.hooks.leaderChange = append(n.hooks.leaderChange, fn)
+}
+
+// OnMemberJoin calls fn for every node gossip sees joining the cluster.
+func (n *server) OnMemberJoin(fn func(Member)) {
+	n.hooks.mu.Lock()
+	defer n.hooks.mu.Unlock()
+	n.hooks.memberJoin = append(n.hooks.memberJoin, fn)
+}
+
+// OnMemberLeave calls fn for every node that left the cluster or failed, its
+// State says which.
+func (n *server) OnMemberLeave(fn func(Member)) {
+	n.hooks.mu.Lock()
+	defer n.hooks.mu.Unlock()
+	n.hooks.memberLeave = append(n.hooks.memberLeave, fn)
+}
+
+// OnApply calls fn with every KV entry this node's replica applies, system
+// ones included, once it is persisted.  fn runs on the apply path, slow work
+// belongs on another goroutine, and entries replayed after a restart are
+// passed again.
+func (n *server) OnApply(fn func(index uint64, kv multiraft.KVData)) {
+	n.hooks.mu.Lock()
+	defer n.hooks.mu.Unlock()
+	n.hooks.apply = append(n.hooks.apply, fn)
+}
+
+func (h *hooks) leaderChanged(info multiraft.LeaderInfo) {
+	h.mu.Lock()
+	fns := h.leaderChange
+	h.mu.Unlock()
+	for _, fn := range fns {
+		fn(info)
+	}
+}
+
+func (h *hooks) memberJoined(node *nodedata) {
+	h.mu.Lock()
+	fns := h.memberJoin
+	h.mu.Unlock()
+	for _, fn := range fns {
+		fn(memberOf(node))
+	}
+}
+
+func (h *hooks) memberLeft(node *nodedata) {
+	h.mu.Lock()
+	fns := h.memberLeave
+	h.mu.Unlock()
+	for _, fn := range fns {
+		fn(memberOf(node))
+	}
+}
+
+func (h *hooks) applied(index uint64, kv multiraft.KVData) {
+	h.mu.Lock()
+	fns := h.apply
+	h.mu.Unlock()
+	for _, fn := range fns {
+		fn(index, kv)
+	}
+}
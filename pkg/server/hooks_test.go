@@ -0,0 +1,34 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/buraksezer/consistent"
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+)
+
+func TestHooks_Membership(t *testing.T) {
+	n := &server{
+		logger:     zap.NewNop(),
+		metadata:   NewMetadata(),
+		raftAgents: map[uint64]raftAgent{},
+		consistent: consistent.New(nil, consistent.Config{PartitionCount: numShards, ReplicationFactor: 20, Load: 1.25, Hasher: hasher{}}),
+	}
+	var joined, left []Member
+	n.OnMemberJoin(func(m Member) { joined = append(joined, m) })
+	n.OnMemberLeave(func(m Member) { left = append(left, m) })
+
+	member := serf.Member{Name: "node-2", Tags: map[string]string{
+		"id": "node-2", "raft_addr": "10.0.0.2", "raft_port": "5000", "http_addr": "10.0.0.2", "http_port": "8000",
+	}}
+	n.HandleEvent(serf.MemberEvent{Type: serf.EventMemberJoin, Members: []serf.Member{member}})
+	n.HandleEvent(serf.MemberEvent{Type: serf.EventMemberFailed, Members: []serf.Member{member}})
+
+	if len(joined) != 1 || joined[0].ID != "node-2" || joined[0].HTTPAddr != "10.0.0.2:8000" {
+		t.Errorf("joined = %+v, want node-2 at 10.0.0.2:8000", joined)
+	}
+	if len(left) != 1 || left[0].ID != "node-2" || left[0].State != string(nodeFailed) {
+		t.Errorf("left = %+v, want node-2 failed", left)
+	}
+}
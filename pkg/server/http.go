@@ -1,65 +1,361 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/epsniff/expodb/pkg/errdefs"
+	"github.com/epsniff/expodb/pkg/loggingutils"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
 	"github.com/epsniff/expodb/pkg/server/state-machines/simplestore"
+	"github.com/epsniff/expodb/pkg/tracing"
 	"github.com/justinas/alice"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 type httpServer struct {
 	address net.Addr
 	node    *server
 	logger  *zap.Logger
+
+	routesOnce sync.Once
+	router     *router
 }
 
-// Start starts the http server
-func (server *httpServer) Start() {
+// Serve serves the http API on ln until ctx is done.
+func (server *httpServer) Serve(ctx context.Context, ln net.Listener) error {
 	server.logger.Info("Starting http server", zap.String("address", server.address.String()))
-	c := alice.New()
-	handler := c.Then(server)
-
-	if err := http.ListenAndServe(server.address.String(), handler); err != nil {
-		server.logger.Fatal("Error running HTTP server", zap.Error(err))
+	c := alice.New(server.drainRequests, requestIDMiddleware, traceMiddleware)
+	srv := &http.Server{Handler: c.Then(server)}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		server.logger.Error("Error running HTTP server", zap.Error(err))
+		return err
 	}
+	return nil
 }
 
+// leaderHeader is set on every response with the http address of the leader.
+const leaderHeader = "X-Expodb-Leader"
+
 func (server *httpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if strings.HasPrefix(r.URL.Path, "/key") {
-		server.handleKeyRequest(w, r)
-	} else {
-		w.WriteHeader(http.StatusBadRequest)
+	if leader, ok := server.node.metadata.Leader(); ok {
+		w.Header().Set(leaderHeader, leader.HttpAddr())
 	}
+	server.routesOnce.Do(func() { server.router = server.routes() })
+	server.router.ServeHTTP(w, r)
 }
 
-func (server *httpServer) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodPost:
-		switch {
-		case strings.Contains(r.URL.Path, "/_update"):
-			server.handleKeyUpdate(w, r)
-		case strings.Contains(r.URL.Path, "/_fetch"):
-			server.handleKeyFetch(w, r)
+// routes maps the API onto its handlers.  Health checks stay open, and
+// shipments carry the replication token, every other route authenticates.
+// The protocols emulated (etcd, Prometheus, Grafana) keep their own paths.
+func (server *httpServer) routes() *router {
+	rt := newRouter()
+	enc, authn, data, admin := server.negotiate, server.authenticate, server.dataRequest, server.adminOnly
+
+	rt.handle(http.MethodGet, "/v1/tables/{table}/keys", server.handleTableScan, enc, authn, data)
+	rt.handle(http.MethodGet, "/v1/tables/{table}/keys/{key}", server.handleRowGet, enc, authn, data)
+	rt.handle(http.MethodPut, "/v1/tables/{table}/keys/{key}", server.handleRowPut, enc, authn, data)
+	rt.handle(http.MethodDelete, "/v1/tables/{table}/keys/{key}", server.handleRowDelete, enc, authn, data)
+
+	rt.handleVersioned(http.MethodPost, "/key/_update_row", server.handleRowUpdate, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/key/_transact", server.handleTransact, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/key/_eval", server.handleEval, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/key/_update", server.handleKeyUpdate, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/key/_fetch", server.handleKeyFetch, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/key/_scan", server.handleScan, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/key/_list", server.handleListKeys, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/key/_query", server.handleQuery, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/index/_create", server.handleIndexChange, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/index/_drop", server.handleIndexChange, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/cascade/_create", server.handleCascadeChange, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/cascade/_drop", server.handleCascadeChange, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/trigger/_create", server.handleTriggerChange, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/trigger/_drop", server.handleTriggerChange, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/schema/_create", server.handleSchemaChange, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/schema/_change", server.handleSchemaChange, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/schema/_drop", server.handleSchemaChange, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/key/_delete_by_prefix", server.handleBulkDelete, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/key/_delete_by_query", server.handleBulkDelete, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/key/_delete", server.handleKeyDelete, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/key/_purge", server.handlePurge, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/key/_purge_status", server.handlePurgeStatus, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/counter/*", server.handleCounterRequest, enc, authn, data)
+	rt.handleVersioned(http.MethodPost, "/txn/*", server.handleTxnRequest, enc, authn, data)
+	rt.handle(http.MethodPost, "/v3/*", server.handleEtcdRequest, authn, data)
+	rt.handle(http.MethodPost, "/api/v1/write", server.handleRemoteWrite, authn, data)
+	rt.handle(http.MethodGet, grafanaPrefix+"/*", server.handleGrafanaRequest, authn, data)
+	rt.handle(http.MethodPost, grafanaPrefix+"/*", server.handleGrafanaRequest, authn, data)
+
+	rt.handleVersioned(http.MethodGet, "/cluster/shards", server.handleShardMap, enc, authn)
+	rt.handleVersioned(http.MethodGet, "/cluster/nodes", server.handleNodeCatalog, enc, authn)
+	rt.handleVersioned(http.MethodPost, "/cluster/_decommission", server.handleDecommission, enc, authn, admin)
+
+	rt.handleVersioned(http.MethodPost, "/admin/_maintenance", server.handleMaintenance, enc, authn, admin)
+	rt.handleVersioned(http.MethodPost, "/admin/_freeze", server.handleWriteFreeze, enc, authn, admin)
+	rt.handleVersioned(http.MethodPost, "/admin/_join_token", server.handleMintJoinToken, enc, authn, admin)
+	rt.handleVersioned(http.MethodPost, "/admin/_promote_standby", server.handlePromoteStandby, enc, authn, admin)
+	rt.handleVersioned(http.MethodPost, "/admin/_compact", server.handleCompact, enc, authn, admin)
+	rt.handleVersioned(http.MethodPost, "/admin/_export_snapshot", server.handleExportSnapshot, enc, authn, admin)
+	rt.handleVersioned(http.MethodGet, "/admin/_stats", server.handleTableStats, enc, authn, admin)
+	rt.handleVersioned(http.MethodPost, "/admin/_analyze", server.handleAnalyze, enc, authn, admin)
+	rt.handleVersioned(http.MethodPost, "/admin/_export_table", server.handleExportTable, enc, authn, admin)
+	rt.handleVersioned(http.MethodGet, "/admin/_log_levels", server.handleLogLevels, enc, authn, admin)
+	rt.handleVersioned(http.MethodPost, "/admin/_log_levels", server.handleLogLevels, enc, authn, admin)
+	rt.handleVersioned(http.MethodGet, "/admin/_api_keys", server.handleAPIKeys, enc, authn, admin)
+	rt.handleVersioned(http.MethodPost, "/admin/_api_keys/_create", server.handleAPIKeyChange, enc, authn, admin)
+	rt.handleVersioned(http.MethodPost, "/admin/_api_keys/_drop", server.handleAPIKeyChange, enc, authn, admin)
+	rt.handleVersioned(http.MethodGet, "/admin/_sinks", server.handleSinks, enc, authn, admin)
+	rt.handleVersioned(http.MethodPost, "/admin/_sinks/_create", server.handleSinkChange, enc, authn, admin)
+	rt.handleVersioned(http.MethodPost, "/admin/_sinks/_drop", server.handleSinkChange, enc, authn, admin)
+	rt.handleVersioned(http.MethodGet, "/admin/_dead_letters", server.handleDeadLetters, enc, authn, admin)
+	rt.handleVersioned(http.MethodPost, "/admin/_dead_letters/_replay", server.handleDeadLetterChange, enc, authn, admin)
+	rt.handleVersioned(http.MethodPost, "/admin/_dead_letters/_discard", server.handleDeadLetterChange, enc, authn, admin)
+	rt.handleVersioned(http.MethodGet, "/admin/_sources", server.handleSources, enc, authn, admin)
+	rt.handleVersioned(http.MethodPost, "/admin/_sources/_create", server.handleSourceChange, enc, authn, admin)
+	rt.handleVersioned(http.MethodPost, "/admin/_sources/_drop", server.handleSourceChange, enc, authn, admin)
+	rt.handleVersioned(http.MethodGet, "/admin/_cron", server.handleCronJobs, enc, authn, admin)
+	rt.handleVersioned(http.MethodPost, "/admin/_cron/_create", server.handleCronJobChange, enc, authn, admin)
+	rt.handleVersioned(http.MethodPost, "/admin/_cron/_drop", server.handleCronJobChange, enc, authn, admin)
+	rt.handleVersioned(http.MethodGet, "/admin/_features", server.handleFeatureFlags, enc, authn, admin)
+	rt.handleVersioned(http.MethodPost, "/admin/_features/_set", server.handleFeatureFlagSet, enc, authn, admin)
+
+	rt.handle(http.MethodPost, "/replication/_snapshot", server.handleReplicaSnapshot)
+	rt.handle(http.MethodGet, "/status", server.handleStatus)
+	rt.handle(http.MethodGet, "/readyz", server.handleReadyz)
+	rt.handle(http.MethodGet, "/version", server.handleVersion)
+	return rt
+}
+
+// authenticate sets the request's principal, see principalFromContext.
+func (server *httpServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, key, err := server.node.authenticateAPIKey(r)
+		if principal == nil && err == nil {
+			principal, err = server.node.authn.Authenticate(r)
 		}
+		if err != nil {
+			server.logger.Info("Rejecting unauthenticated request", zap.String("path", r.URL.Path), zap.Error(err))
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), principalKey{}, principal))
+		if key != nil {
+			server.limitAPIKey(w, r, key, next)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// dataRequest carries the client's session, write sequence and dry run of
+// requests for data, which witnesses hold none of.
+func (server *httpServer) dataRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := parseSession(r)
+		r = r.WithContext(context.WithValue(r.Context(), sessionKey{}, session))
+		w = &sessionWriter{ResponseWriter: w, node: server.node, session: session}
+		cw, err := parseClientWrite(r)
+		if err != nil {
+			server.logger.Info("Rejecting request with a bad client sequence", zap.String("path", r.URL.Path), zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if cw != nil {
+			r = r.WithContext(context.WithValue(r.Context(), clientWriteKey{}, cw))
+		}
+		dry, err := parseDryRun(r)
+		if err != nil {
+			server.logger.Info("Rejecting request with a bad dry run", zap.String("path", r.URL.Path), zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if dry {
+			// Apply checks the writes of the request instead of proposing them.
+			r = r.WithContext(multiraft.WithDryRun(r.Context()))
+			w.Header().Set(dryRunHeader, "true")
+		}
+		if server.node.config.IsWitness() {
+			server.logger.Info("Rejecting data request on a witness", zap.String("path", r.URL.Path))
+			statusUnavailable(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminOnly lets through the principals authorized for ActionAdmin.
+func (server *httpServer) adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if server.authorize(w, r, ActionAdmin, "") {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func (server *httpServer) handleKeyUpdate(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Table  string `json:"table"`
+		RowKey string `json:"key"`
+		Column string `json:"column"`
+		Value  string `json:"value"`
+		// IfAbsent only writes the column if it doesn't exist yet.
+		IfAbsent bool `json:"if_absent"`
+	}{}
+
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	guard, ok := server.checkRows(w, r, ActionWrite, req.Table)
+	if !ok || !server.checkWritable(w) {
+		return
+	}
+	server.setRouteHint(w, req.Table, req.RowKey)
+	var index uint64
+	var err error
+	var created *bool
+	if guard != nil {
+		var ok bool
+		ok, index, err = server.node.setGuardedColumn(r.Context(), guard, req.Table, req.RowKey, req.Column, req.Value, req.IfAbsent)
+		if server.rejectRowWrite(w, r, req.Table, err) {
+			return
+		}
+		if req.IfAbsent {
+			created = &ok
+		}
+	} else if req.IfAbsent {
+		var ok bool
+		ok, index, err = server.node.PutIfAbsent(r.Context(), req.Table, req.RowKey, req.Column, req.Value)
+		created = &ok
+	} else {
+		index, err = server.node.SetKeyVal(r.Context(), req.Table, req.RowKey, req.Column, req.Value)
+	}
+	if errors.Is(err, multiraft.ErrWritesFrozen) {
+		server.logger.Info("Rejecting write", zap.Error(err))
+		statusUnavailable(w)
+		return
+	} else if rejectedWrite(err) {
+		server.logger.Info("Rejecting write", zap.Error(err))
+		statusError(w, err)
+		return
+	} else if err != nil {
+		server.logger.Error("Failed to set keyvalue", zap.Error(err))
+		statusError(w, err)
 		return
-	case http.MethodGet:
+	}
+
+	response := struct {
+		Index   uint64 `json:"index,omitempty"`
+		Created *bool  `json:"created,omitempty"`
+	}{
+		Index:   index,
+		Created: created,
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
+
+func (server *httpServer) handleRowUpdate(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Table   string            `json:"table"`
+		RowKey  string            `json:"key"`
+		Columns map[string]string `json:"columns"`
+		Replace bool              `json:"replace"`
+		IfMatch *uint64           `json:"if_match"`
+	}{}
+
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Columns) == 0 {
+		server.logger.Error("Bad request", zap.Error(err))
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	w.WriteHeader(http.StatusBadRequest)
+	if etag := r.Header.Get("If-Match"); etag != "" {
+		version, err := parseRowETag(etag)
+		if err != nil {
+			server.logger.Error("Bad request", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		req.IfMatch = &version
+	}
+
+	guard, ok := server.checkRows(w, r, ActionWrite, req.Table)
+	if !ok || !server.checkWritable(w) {
+		return
+	}
+	server.setRouteHint(w, req.Table, req.RowKey)
+	var index uint64
+	var err error
+	if guard != nil {
+		var version uint64
+		version, err = server.node.guardWrite(r.Context(), guard, req.Table, req.RowKey, func(cols map[string]string) map[string]string {
+			if req.Replace {
+				cols = map[string]string{}
+			}
+			for col, val := range req.Columns {
+				cols[col] = val
+			}
+			return cols
+		})
+		if server.rejectRowWrite(w, r, req.Table, err) {
+			return
+		}
+		if err == nil && req.IfMatch != nil && *req.IfMatch != version {
+			err = multiraft.ErrVersionMismatch
+		}
+		req.IfMatch = &version
+	}
+	if err == nil {
+		index, err = server.node.SetRow(r.Context(), req.Table, req.RowKey, req.Columns, req.Replace, req.IfMatch)
+	}
+	if errors.Is(err, multiraft.ErrVersionMismatch) {
+		w.Header().Set(errdefs.Header, errdefs.Code(err))
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	} else if errors.Is(err, multiraft.ErrWritesFrozen) {
+		server.logger.Info("Rejecting write", zap.Error(err))
+		statusUnavailable(w)
+		return
+	} else if rejectedWrite(err) {
+		server.logger.Info("Rejecting write", zap.Error(err))
+		statusError(w, err)
+		return
+	} else if err != nil {
+		server.logger.Error("Failed to set row", zap.Error(err))
+		statusError(w, err)
+		return
+	}
+
+	response := struct {
+		Index uint64 `json:"index"`
+	}{
+		Index: index,
+	}
+	respond(w, http.StatusOK, response, server.logger)
 }
 
-func (server *httpServer) handleKeyUpdate(w http.ResponseWriter, r *http.Request) {
+func (server *httpServer) handleKeyDelete(w http.ResponseWriter, r *http.Request) {
 	req := struct {
 		Table  string `json:"table"`
 		RowKey string `json:"key"`
 		Column string `json:"column"`
-		Value  string `json:"value"`
 	}{}
 
 	defer r.Body.Close()
@@ -69,20 +365,105 @@ func (server *httpServer) handleKeyUpdate(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	if err := server.node.SetKeyVal(req.Table, req.RowKey, req.Column, req.Value); err != nil {
-		server.logger.Error("Failed to set keyvalue", zap.Error(err))
-		statusInternalError(w)
+	guard, ok := server.checkRows(w, r, ActionWrite, req.Table)
+	if !ok || !server.checkWritable(w) {
+		return
+	}
+	server.setRouteHint(w, req.Table, req.RowKey)
+	var index uint64
+	var err error
+	if guard != nil {
+		index, err = server.node.deleteGuardedKey(r.Context(), guard, req.Table, req.RowKey, req.Column)
+		if server.rejectRowWrite(w, r, req.Table, err) {
+			return
+		}
+	} else {
+		index, err = server.node.DeleteKey(r.Context(), req.Table, req.RowKey, req.Column)
+	}
+	if errors.Is(err, multiraft.ErrWritesFrozen) {
+		server.logger.Info("Rejecting write", zap.Error(err))
+		statusUnavailable(w)
+		return
+	} else if rejectedWrite(err) {
+		server.logger.Info("Rejecting write", zap.Error(err))
+		statusError(w, err)
+		return
+	} else if err != nil {
+		server.logger.Error("Failed to delete key", zap.Error(err))
+		statusError(w, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	response := struct {
+		Index uint64 `json:"index"`
+	}{
+		Index: index,
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
+
+func (server *httpServer) handleBulkDelete(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Table  string               `json:"table"`
+		Prefix string               `json:"prefix"`
+		Filter *multiraft.RowFilter `json:"filter"`
+	}{}
+
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Table == "" {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	byQuery := strings.Contains(r.URL.Path, "/_delete_by_query")
+	if byQuery && (req.Filter == nil || req.Filter.Validate() != nil) {
+		server.logger.Error("Bad request, missing or invalid filter")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !server.checkTable(w, r, ActionWrite, req.Table) {
+		return
+	}
+	if !server.checkWritable(w) {
+		return
+	}
+	var index uint64
+	var err error
+	if byQuery {
+		index, err = server.node.DeleteWhere(r.Context(), req.Table, req.Prefix, *req.Filter)
+	} else {
+		index, err = server.node.DeletePrefix(r.Context(), req.Table, req.Prefix)
+	}
+	if errors.Is(err, multiraft.ErrWritesFrozen) {
+		server.logger.Info("Rejecting write", zap.Error(err))
+		statusUnavailable(w)
+		return
+	} else if rejectedWrite(err) {
+		server.logger.Info("Rejecting write", zap.Error(err))
+		statusError(w, err)
+		return
+	} else if err != nil {
+		server.logger.Error("Failed to bulk delete", zap.Error(err))
+		statusError(w, err)
+		return
+	}
+
+	response := struct {
+		Index uint64 `json:"index"`
+	}{
+		Index: index,
+	}
+	respond(w, http.StatusOK, response, server.logger)
 }
 
 func (server *httpServer) handleKeyFetch(w http.ResponseWriter, r *http.Request) {
 
 	req := struct {
-		Table string `json:"table"`
-		Key   string `json:"key"`
+		Table    string   `json:"table"`
+		Key      string   `json:"key"`
+		MinIndex uint64   `json:"min_index"`
+		Columns  []string `json:"columns"`
 	}{}
 	defer r.Body.Close()
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -91,41 +472,887 @@ func (server *httpServer) handleKeyFetch(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	val, err := server.node.GetByRowKey(req.Table, req.Key)
+	guard, ok := server.checkRows(w, r, ActionRead, req.Table)
+	if !ok {
+		return
+	}
+	var added []string
+	req.Columns, added = guard.columns(req.Columns)
+	server.setRouteHint(w, req.Table, req.Key)
+	if session := sessionFromContext(r.Context()); req.MinIndex != 0 && session.Index > req.MinIndex {
+		// never read older than what the client's session has seen.
+		req.MinIndex = session.Index
+	}
+	var row *multiraft.Row
+	var index uint64
+	var err error
+	if isVirtualTable(req.Table) {
+		row, err = server.node.VirtualRow(r.Context(), req.Table, req.Key, req.Columns)
+	} else if source, ok := server.node.tableSource(req.Table); ok && req.MinIndex == 0 {
+		row, index, err = server.node.GetRowThrough(r.Context(), source, req.Key, req.Columns)
+	} else {
+		row, index, err = server.node.GetRow(r.Context(), req.Table, req.Key, req.MinIndex, req.Columns)
+	}
 	if err == simplestore.ErrKeyNotFound {
 		statusNotFound(w)
 		return
+	} else if errors.Is(err, errSourceFailed) {
+		server.logger.Warn("Failed to read row through its source", zap.String("table", req.Table), zap.Error(err))
+		statusBadGateway(w)
+		return
+	} else if errors.Is(err, multiraft.ErrIndexNotReached) {
+		server.logger.Warn("Replica behind requested min_index", zap.Uint64("min_index", req.MinIndex))
+		statusUnavailable(w)
+		return
+	} else if rejectedWrite(err) {
+		server.logger.Info("Rejecting write", zap.Error(err))
+		statusError(w, err)
+		return
 	} else if err != nil {
 		server.logger.Error("Failed to get key from statemachine", zap.Error(err))
-		statusInternalError(w)
+		statusError(w, err)
+		return
+	}
+	if !guard.allows(row.Columns) {
+		// rows outside the principal's aren't told apart from missing ones.
+		statusNotFound(w)
+		return
+	}
+	for _, col := range added {
+		delete(row.Columns, col)
+	}
+	server.openRows(r, req.Table, row.Columns)
+	w.Header().Set("ETag", rowETag(row.Version))
+	if row.Version != 0 && etagMatches(r.Header.Get("If-None-Match"), row.Version) {
+		// the client's copy is current, a polling client pays for headers only.
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 	response := struct {
-		Result map[string]string `json:"result"`
+		Result  map[string]string `json:"result"`
+		Index   uint64            `json:"index"`
+		Version uint64            `json:"version"`
 	}{
-		Result: val,
+		Result:  row.Columns,
+		Index:   index,
+		Version: row.Version,
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
+
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+func (server *httpServer) handleScan(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Table       string `json:"table"`
+		Limit       int    `json:"limit"`
+		Cursor      string `json:"cursor"`
+		Consistency string `json:"consistency"`
+		Stream      bool   `json:"stream"`
+		Order       string `json:"order"`
+	}{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Table == "" || !validConsistency(req.Consistency) || req.Limit < 0 && req.Stream || !validOrder(req.Order, req.Table) {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	guard, ok := server.checkRows(w, r, ActionRead, req.Table)
+	if !ok {
+		return
+	}
+	if guard != nil && req.Stream {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	streamLimit := req.Limit
+	if req.Limit <= 0 {
+		req.Limit = defaultScanLimit
+	}
+	if req.Limit > maxScanLimit {
+		req.Limit = maxScanLimit
+	}
+
+	key, err := server.node.cursorKey(r.Context())
+	if err != nil {
+		server.logger.Warn("Cursor key unavailable", zap.Error(err))
+		statusUnavailable(w)
+		return
+	}
+	query := multiraft.ScanPageQuery{Table: req.Table, Limit: req.Limit, Reverse: req.Order == orderDesc}
+	if req.Cursor != "" {
+		cursor, err := parseCursor(key, req.Cursor)
+		if err != nil || cursor.Table != req.Table || cursor.Reverse != query.Reverse {
+			server.logger.Warn("Rejecting scan cursor", zap.String("table", req.Table), zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		query.After = cursor.After
+	}
+	if req.Stream {
+		query.Limit = streamLimit
+		server.streamScan(w, r, key, query, req.Consistency)
+		return
 	}
 
-	responseBytes, err := json.Marshal(response)
+	var page *multiraft.ScanPage
+	var meta *queryMeta
+	if isVirtualTable(req.Table) {
+		page, err = server.node.VirtualScanPage(r.Context(), req.Table, query.After, req.Limit)
+	} else {
+		page, meta, err = server.node.scanPage(r.Context(), query, req.Consistency)
+	}
 	if err != nil {
-		server.logger.Error("Failed to marshal response", zap.Error(err))
+		server.logger.Error("Failed to scan table", zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	response := struct {
+		Rows   []multiraft.ScanRow `json:"rows"`
+		Cursor string              `json:"cursor,omitempty"`
+		Meta   *queryMeta          `json:"meta"`
+	}{
+		Rows: page.Rows,
+		Meta: meta,
+	}
+	if guard != nil {
+		// a page may come back short, or empty, with a cursor to the next.
+		response.Rows = nil
+		for _, row := range page.Rows {
+			if guard.allows(row.Columns) {
+				response.Rows = append(response.Rows, row)
+			}
+		}
+	}
+	server.openRows(r, req.Table, rowColumns(response.Rows)...)
+	if page.More {
+		last := page.Rows[len(page.Rows)-1].Key
+		if response.Cursor, err = signCursor(key, scanCursor{Table: req.Table, After: last, Reverse: query.Reverse}); err != nil {
+			server.logger.Error("Failed to sign scan cursor", zap.Error(err))
+			statusInternalError(w)
+			return
+		}
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
+
+func (server *httpServer) handleTransact(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Writes []multiraft.TxnWrite `json:"writes"`
+	}{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Writes) == 0 || len(req.Writes) > maxTxnWrites {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, write := range req.Writes {
+		if !server.checkTable(w, r, ActionWrite, write.Table) {
+			return
+		}
+	}
+	if !server.checkWritable(w) {
+		return
+	}
+	id, err := server.node.Transact(r.Context(), req.Writes)
+	switch {
+	case errors.Is(err, ErrTxnAborted):
+		server.logger.Info("Transaction aborted", zap.String("txn", id), zap.Error(err))
+		w.Header().Set(errdefs.Header, errdefs.Code(err))
+		respond(w, http.StatusConflict, map[string]string{"txn_id": id, "error": err.Error()}, server.logger)
+		return
+	case errors.Is(err, multiraft.ErrWritesFrozen):
+		statusUnavailable(w)
+		return
+	case err != nil:
+		server.logger.Error("Failed to run transaction", zap.String("txn", id), zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	response := struct {
+		TxnID string `json:"txn_id"`
+	}{
+		TxnID: id,
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
+
+// handleTxnRequest serves interactive transactions, see BeginTxn.  They live
+// on the node that began them.
+func (server *httpServer) handleTxnRequest(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		TxnID  string               `json:"txn_id"`
+		Table  string               `json:"table"`
+		RowKey string               `json:"key"`
+		Name   string               `json:"name"`
+		Writes []multiraft.TxnWrite `json:"writes"`
+	}{}
+	defer r.Body.Close()
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			server.logger.Error("Bad request", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	if multiraft.IsDryRun(r.Context()) {
+		// the writes are buffered on the node, not checked.
+		server.logger.Info("Rejecting dry run of an interactive transaction", zap.String("path", r.URL.Path))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if session := sessionFromContext(r.Context()); !strings.HasSuffix(r.URL.Path, "/_begin") && server.node.sessionNode(session) != server.node.config.ID() {
+		// the transaction lives on the session's node, send the client there.
+		if node, ok := server.node.metadata.FindByID(session.Node); ok {
+			w.Header().Set(routingHeader, node.HttpAddr())
+		}
+		statusError(w, errdefs.New(errdefs.ErrNotLeader, "the transaction is on node "+session.Node))
+		return
+	}
+	owner := principalFromContext(r.Context()).Name
+	if !strings.HasSuffix(r.URL.Path, "/_begin") {
+		if err := server.node.ownTxn(req.TxnID, owner); err != nil {
+			server.logger.Info("Rejecting request of a transaction not found or begun by another principal", zap.String("path", r.URL.Path))
+			statusNotFound(w)
+			return
+		}
+	}
+
+	var response interface{} = struct{}{}
+	var err error
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/_begin"):
+		var id string
+		id, err = server.node.BeginTxn(owner)
+		response = map[string]string{"txn_id": id}
+		// the transaction lives here, whichever node the session was on.
+		bindSession(w)
+	case strings.HasSuffix(r.URL.Path, "/_read"):
+		if !server.checkTable(w, r, ActionRead, req.Table) {
+			return
+		}
+		var cols map[string]string
+		cols, err = server.node.TxnRead(r.Context(), req.TxnID, req.Table, req.RowKey)
+		server.openRows(r, req.Table, cols)
+		response = map[string]interface{}{"columns": cols}
+	case strings.HasSuffix(r.URL.Path, "/_write"):
+		for _, write := range req.Writes {
+			if !server.checkTable(w, r, ActionWrite, write.Table) {
+				return
+			}
+		}
+		err = server.node.TxnWrite(req.TxnID, req.Writes)
+	case strings.HasSuffix(r.URL.Path, "/_savepoint"):
+		err = server.node.TxnSavepoint(req.TxnID, req.Name)
+	case strings.HasSuffix(r.URL.Path, "/_rollback_to"):
+		err = server.node.TxnRollbackTo(req.TxnID, req.Name)
+	case strings.HasSuffix(r.URL.Path, "/_rollback"):
+		err = server.node.RollbackTxn(req.TxnID)
+	case strings.HasSuffix(r.URL.Path, "/_commit"):
+		if !server.checkWritable(w) {
+			return
+		}
+		var id string
+		id, err = server.node.CommitTxn(r.Context(), req.TxnID)
+		response = map[string]string{"txn_id": id}
+		if errors.Is(err, ErrTxnAborted) {
+			server.logger.Info("Transaction aborted", zap.String("txn", id), zap.Error(err))
+			w.Header().Set(errdefs.Header, errdefs.Code(err))
+			respond(w, http.StatusConflict, map[string]string{"txn_id": id, "error": err.Error()}, server.logger)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	switch {
+	case errors.Is(err, ErrTxnNotFound), errors.Is(err, ErrSavepointNotFound):
+		statusNotFound(w)
+		return
+	case errors.Is(err, ErrTxnTooLarge):
+		server.logger.Info("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	case errors.Is(err, ErrTooManyTxns), errors.Is(err, multiraft.ErrWritesFrozen):
+		statusUnavailable(w)
+		return
+	case err != nil:
+		server.logger.Error("Failed interactive transaction request", zap.String("path", r.URL.Path), zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
+
+func (server *httpServer) handleCounterRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req := struct {
+		Name  string `json:"name"`
+		Delta int64  `json:"delta"`
+	}{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case strings.Contains(r.URL.Path, "/_incr"):
+		if !server.authorize(w, r, ActionWrite, countersTable) || !server.checkWritable(w) {
+			return
+		}
+		index, err := server.node.IncrCounter(r.Context(), req.Name, req.Delta)
+		if errors.Is(err, multiraft.ErrWritesFrozen) {
+			server.logger.Info("Rejecting write", zap.Error(err))
+			statusUnavailable(w)
+			return
+		} else if err != nil {
+			server.logger.Error("Failed to increment counter", zap.Error(err))
+			statusError(w, err)
+			return
+		}
+		response := struct {
+			Index uint64 `json:"index"`
+		}{
+			Index: index,
+		}
+		respond(w, http.StatusOK, response, server.logger)
+	case strings.Contains(r.URL.Path, "/_fetch"):
+		if !server.authorize(w, r, ActionRead, countersTable) {
+			return
+		}
+		count, err := server.node.GetCounter(r.Context(), req.Name)
+		if err != nil {
+			server.logger.Error("Failed to read counter", zap.Error(err))
+			statusError(w, err)
+			return
+		}
+		response := struct {
+			Result int64 `json:"result"`
+		}{
+			Result: count,
+		}
+		respond(w, http.StatusOK, response, server.logger)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (server *httpServer) handleShardMap(w http.ResponseWriter, r *http.Request) {
+	sm, err := server.node.ShardMap()
+	if err != nil {
+		server.logger.Warn("Shard map not available", zap.Error(err))
+		statusUnavailable(w)
+		return
+	}
+	respond(w, http.StatusOK, sm, server.logger)
+}
+
+func (server *httpServer) handleNodeCatalog(w http.ResponseWriter, r *http.Request) {
+	type nodeEntry struct {
+		ID       string `json:"id"`
+		RaftAddr string `json:"raft_addr"`
+		HTTPAddr string `json:"http_addr"`
+		Role     string `json:"role"`
+		Zone     string `json:"zone,omitempty"`
+		State    string `json:"state"`
+		Version  string `json:"version,omitempty"`
+		Build    string `json:"build,omitempty"`
+	}
+	role := r.URL.Query().Get("role")
+	nodes := server.node.metadata.Nodes()
+	if role != "" {
+		nodes = server.node.metadata.FindByRole(role)
+	}
+	response := struct {
+		Nodes []nodeEntry `json:"nodes"`
+		// Zones lists the node IDs in each zone.
+		Zones map[string][]string `json:"zones"`
+	}{
+		Nodes: []nodeEntry{},
+		Zones: map[string][]string{},
+	}
+	for _, n := range nodes {
+		response.Nodes = append(response.Nodes, nodeEntry{
+			ID:       n.ID(),
+			RaftAddr: n.RaftAddr(),
+			HTTPAddr: n.HttpAddr(),
+			Role:     n.Role(),
+			Zone:     n.Zone(),
+			State:    string(n.State()),
+			Version:  n.Version(),
+			Build:    n.Build(),
+		})
+		response.Zones[n.Zone()] = append(response.Zones[n.Zone()], n.ID())
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
+
+func (server *httpServer) handleDecommission(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		ID string `json:"id"`
+	}{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := server.node.Decommission(r.Context(), req.ID); err != nil {
+		server.logger.Error("Failed to decommission node", zap.String("id", req.ID), zap.Error(err))
 		statusInternalError(w)
 		return
 	}
+	w.WriteHeader(http.StatusOK)
+}
 
+func (server *httpServer) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Enabled            bool `json:"enabled"`
+		TransferLeadership bool `json:"transfer_leadership"`
+	}{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := server.node.SetMaintenance(r.Context(), req.Enabled, req.TransferLeadership); err != nil {
+		server.logger.Error("Failed to change maintenance mode", zap.Error(err))
+		statusInternalError(w)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
-	w.Write(responseBytes)
 }
 
+func (server *httpServer) handleWriteFreeze(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Enabled bool   `json:"enabled"`
+		Timeout string `json:"timeout"`
+	}{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var timeout time.Duration
+	if req.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(req.Timeout); err != nil {
+			server.logger.Error("Bad request", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	var index uint64
+	var err error
+	if req.Enabled {
+		index, err = server.node.FreezeWrites(r.Context(), timeout)
+	} else {
+		index, err = server.node.ThawWrites(r.Context())
+	}
+	if err != nil {
+		server.logger.Error("Failed to change write freeze", zap.Error(err))
+		statusInternalError(w)
+		return
+	}
+	response := struct {
+		Index uint64 `json:"index"`
+	}{
+		Index: index,
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
+
+func (server *httpServer) handlePromoteStandby(w http.ResponseWriter, r *http.Request) {
+	index, err := server.node.PromoteStandby(r.Context())
+	if errors.Is(err, ErrNotStandby) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if err != nil {
+		server.logger.Error("Failed to promote standby", zap.Error(err))
+		statusInternalError(w)
+		return
+	}
+	response := struct {
+		Index uint64 `json:"index"`
+	}{
+		Index: index,
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
+
+// handleReplicaSnapshot loads a snapshot shipped by the primary cluster.
+func (server *httpServer) handleReplicaSnapshot(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	index, err := server.node.ApplyReplicaSnapshot(r.Context(), r.Header.Get(replicationTokenHeader), r.Body)
+	switch {
+	case errors.Is(err, ErrReplicationAuth):
+		w.WriteHeader(http.StatusForbidden)
+		return
+	case errors.Is(err, ErrNotStandby), errors.Is(err, ErrStandbyPromoted):
+		server.logger.Warn("Refusing replica snapshot", zap.Error(err))
+		w.WriteHeader(http.StatusConflict)
+		return
+	case err != nil:
+		server.logger.Error("Failed to apply replica snapshot", zap.Error(err))
+		statusInternalError(w)
+		return
+	}
+	response := struct {
+		SourceIndex uint64 `json:"source_index"`
+	}{
+		SourceIndex: index,
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
+
+// handleReadyz answers 200 once the node has replayed its raft log and caught
+// up with the leader, so load balancers don't send traffic to a cold node.
+func (server *httpServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if server.node.draining.Load() {
+		respond(w, http.StatusServiceUnavailable, map[string]string{"status": "shutting down"}, server.logger)
+		return
+	}
+	rs, ok := server.node.replayProgress(r.Context())
+	if !ok || !rs.CaughtUp {
+		respond(w, http.StatusServiceUnavailable, rs, server.logger)
+		return
+	}
+	respond(w, http.StatusOK, rs, server.logger)
+}
+
+func (server *httpServer) handleMintJoinToken(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		TTL string `json:"ttl"`
+	}{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil {
+			server.logger.Error("Bad request", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	token, err := server.node.MintJoinToken(r.Context(), ttl)
+	if err != nil {
+		server.logger.Error("Failed to mint join token", zap.Error(err))
+		statusInternalError(w)
+		return
+	}
+	response := struct {
+		Token string `json:"token"`
+	}{
+		Token: token,
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
+
+// handleLogLevels reports the log levels, sampling and unredacted tables, a
+// POST changes them first: {"levels": {"serf-agent": "warn", "": "info"},
+// "sampling": true, "unredacted": ["users"]} sets the levels of serf-agent
+// and of the modules without one.
+func (server *httpServer) handleLogLevels(w http.ResponseWriter, r *http.Request) {
+	levels := server.node.logLevels
+	if levels == nil {
+		respond(w, http.StatusNotImplemented, map[string]string{"error": "log levels are fixed by the embedding program"}, server.logger)
+		return
+	}
+	if r.Method == http.MethodPost {
+		req := struct {
+			Levels     map[string]string `json:"levels"`
+			Sampling   *bool             `json:"sampling"`
+			Unredacted *[]string         `json:"unredacted"`
+		}{}
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			server.logger.Error("Bad request", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		parsed := map[string]zapcore.Level{}
+		for module, level := range req.Levels {
+			lvl, err := zapcore.ParseLevel(level)
+			if err != nil {
+				respond(w, http.StatusBadRequest, map[string]string{"error": err.Error()}, server.logger)
+				return
+			}
+			parsed[module] = lvl
+		}
+		for module, lvl := range parsed {
+			levels.SetLevel(module, lvl)
+		}
+		if req.Sampling != nil {
+			levels.SetSampling(*req.Sampling)
+		}
+		if req.Unredacted != nil {
+			loggingutils.SetUnredactedTables(*req.Unredacted)
+		}
+		server.logger.Info("Log levels changed", zap.Any("levels", req.Levels), zap.Boolp("sampling", req.Sampling), zap.Strings("unredacted", loggingutils.UnredactedTables()))
+	}
+	response := struct {
+		Levels     map[string]string `json:"levels"`
+		Sampling   bool              `json:"sampling"`
+		Unredacted []string          `json:"unredacted"`
+	}{
+		Levels:     levels.Levels(),
+		Sampling:   levels.Sampling(),
+		Unredacted: loggingutils.UnredactedTables(),
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
+
+func (server *httpServer) handleVersion(w http.ResponseWriter, r *http.Request) {
+	respond(w, http.StatusOK, server.node.Version(), server.logger)
+}
+
+func (server *httpServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	respond(w, http.StatusOK, server.node.Status(r.Context()), server.logger)
+}
+
+// checkTable rejects client requests for the system tables ("_" prefixed),
+// they hold the node catalog and the cluster's secrets, but for reads of the
+// readable ones.  It then checks the request's principal may perform action
+// on the table, on all of its rows: the requests enforcing row filters call
+// checkRows instead.
+func (server *httpServer) checkTable(w http.ResponseWriter, r *http.Request, action, table string) bool {
+	guard, ok := server.checkRows(w, r, action, table)
+	if ok && guard != nil {
+		server.logger.Info("Rejecting request row filters don't cover",
+			zap.String("principal", principalFromContext(r.Context()).Name), zap.String("path", r.URL.Path), zap.String("table", table))
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	return ok
+}
+
+func (server *httpServer) checkTableAccess(w http.ResponseWriter, r *http.Request, action, table string) bool {
+	readable := action == ActionRead && (readableSystemTables[table] || isVirtualTable(table))
+	if strings.HasPrefix(table, "_") && !readable {
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	return server.authorize(w, r, action, table)
+}
+
+// readableSystemTables are the stored system tables clients may read, the
+// virtual ones are readable too.
+var readableSystemTables = map[string]bool{eventsTable: true}
+
+// checkWritable rejects the request when the node isn't accepting writes.
+func (server *httpServer) checkWritable(w http.ResponseWriter) bool {
+	if err := server.node.checkWritable(); err != nil {
+		server.logger.Info("Rejecting write", zap.Error(err))
+		if errors.Is(err, ErrDiskFull) {
+			statusInsufficientStorage(w)
+		} else {
+			statusUnavailable(w)
+		}
+		return false
+	}
+	return true
+}
+
+// Scan orders, by row key.  Queries read rows in the order of an index, see
+// handleQuery.
+const (
+	orderAsc  = "asc"
+	orderDesc = "desc"
+)
+
+// validOrder reports whether order names a scan order, the empty string
+// defaulting to orderAsc.  Virtual tables are only built in ascending order.
+func validOrder(order, table string) bool {
+	return order == "" || order == orderAsc || order == orderDesc && !isVirtualTable(table)
+}
+
+// rowETag formats a row version as an ETag, clients send it back in If-Match.
+func rowETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+func parseRowETag(etag string) (uint64, error) {
+	return strconv.ParseUint(strings.Trim(etag, `"`), 10, 64)
+}
+
+// etagMatches reports whether an If-None-Match header lists the ETag of
+// version, or is "*".  Weak ETags compare as strong ones, rows have no other.
+func etagMatches(header string, version uint64) bool {
+	for _, etag := range strings.Split(header, ",") {
+		etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+		if etag == "*" {
+			return true
+		}
+		if v, err := parseRowETag(etag); err == nil && v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// setRouteHint tells the client which node owns the key's partition.
+func (server *httpServer) setRouteHint(w http.ResponseWriter, table, key string) {
+	if route, ok := server.node.RouteForKey(table, key); ok {
+		w.Header().Set(routingHeader, route.HTTPAddr)
+	}
+}
+
+// ~~~~~~~~~~~ Debug Tracing ~~~~~~~~~~~~~~~~~~~~~
+const (
+	// debugHeader opts a request into tracing when set to "trace".
+	debugHeader = "X-Expodb-Debug"
+	// traceHeader carries the JSON encoded trace steps back to the client.
+	traceHeader = "X-Expodb-Trace"
+	// requestIDHeader carries the request's ID, the client's or one made
+	// up, see requestIDMiddleware.
+	requestIDHeader = "X-Expodb-Request-Id"
+	// traceParentHeader is the W3C trace context header.
+	traceParentHeader = "traceparent"
+)
+
+// requestIDMiddleware gives every request an ID, echoed in the response and
+// carried by the raft entries it proposes: the client's request ID header,
+// else the trace ID of its traceparent, else a random one.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !tracing.ValidRequestID(id) {
+			id = tracing.TraceParentID(r.Header.Get(traceParentHeader))
+		}
+		if id == "" {
+			id = tracing.NewRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(tracing.WithRequestID(r.Context(), id)))
+	})
+}
+
+// traceMiddleware attaches a trace to requests asking for one and returns
+// the recorded steps in the trace header.
+func traceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(debugHeader) != "trace" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tr := tracing.New()
+		tr.Step("received", r.Method+" "+r.URL.Path)
+		next.ServeHTTP(&traceWriter{ResponseWriter: w, trace: tr}, r.WithContext(tracing.NewContext(r.Context(), tr)))
+	})
+}
+
+// traceWriter adds the trace header right before the response is written,
+// by then all the internal steps have been recorded.
+type traceWriter struct {
+	http.ResponseWriter
+	trace       *tracing.Trace
+	wroteHeader bool
+}
+
+func (tw *traceWriter) WriteHeader(status int) {
+	if !tw.wroteHeader {
+		tw.wroteHeader = true
+		tw.trace.Step("responding", strconv.Itoa(status))
+		if buf, err := json.Marshal(tw.trace.Steps()); err == nil {
+			tw.Header().Set(traceHeader, string(buf))
+		}
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *traceWriter) Write(p []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController flush streamed responses.
+func (tw *traceWriter) Unwrap() http.ResponseWriter { return tw.ResponseWriter }
+
 // ~~~~~~~~~~~ Http Utils ~~~~~~~~~~~~~~~~~~~~~
-func statusNotFound(w http.ResponseWriter) {
-	status := http.StatusNotFound
+// respond answers with v, in the encoding negotiate picked.
+func respond(w http.ResponseWriter, status int, v interface{}, logger *zap.Logger) {
+	responseBytes, contentType, err := encodeResponse(w, v)
+	if err != nil {
+		logger.Error("Failed to marshal response", zap.Error(err))
+		statusInternalError(w)
+		return
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
 	w.WriteHeader(status)
-	fmt.Fprint(w, `{"status": "404 not found"}`)
+	w.Write(responseBytes)
 }
 
-func statusInternalError(w http.ResponseWriter) {
-	status := http.StatusInternalServerError
+// respondStatus answers with {"status": text}, for the status helpers.
+func respondStatus(w http.ResponseWriter, status int, text string) {
+	body, contentType, err := encodeResponse(w, map[string]string{"status": text})
+	if err != nil {
+		// a map of strings always encodes.
+		body, contentType = nil, ""
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
 	w.WriteHeader(status)
-	fmt.Fprint(w, `{"status": "internal server error"}`)
+	w.Write(body)
+}
+
+func statusNotFound(w http.ResponseWriter) {
+	w.Header().Set(errdefs.Header, errdefs.Code(errdefs.ErrNotFound))
+	respondStatus(w, http.StatusNotFound, "404 not found")
+}
+
+func statusInternalError(w http.ResponseWriter) {
+	respondStatus(w, http.StatusInternalServerError, "internal server error")
+}
+
+// rejectedWrite reports whether a write was rejected for the data it would
+// write: a locked row, a value held in a unique index, one not fitting the
+// table's schema.
+func rejectedWrite(err error) bool {
+	return errors.Is(err, multiraft.ErrTxnConflict) || errors.Is(err, multiraft.ErrUniqueViolation) || errors.Is(err, multiraft.ErrSchemaViolation) || errors.Is(err, multiraft.ErrTriggerRejected)
+}
+
+// statusError answers with the status of err's errdefs kind, naming the kind
+// in the errdefs.Header header, or 500 for errors of no kind.
+func statusError(w http.ResponseWriter, err error) {
+	code := errdefs.Code(err)
+	if code == "" {
+		statusInternalError(w)
+		return
+	}
+	w.Header().Set(errdefs.Header, code)
+	respondStatus(w, errdefs.HTTPStatus(err), code)
+}
+
+func statusInsufficientStorage(w http.ResponseWriter) {
+	respondStatus(w, http.StatusInsufficientStorage, "insufficient storage")
+}
+
+func statusUnavailable(w http.ResponseWriter) {
+	respondStatus(w, http.StatusServiceUnavailable, "service unavailable")
+}
+
+func statusBadGateway(w http.ResponseWriter) {
+	respondStatus(w, http.StatusBadGateway, "bad gateway")
 }
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/tracing"
+	"go.uber.org/zap"
+)
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{`"14"`, true},
+		{`"3", W/"14"`, true},
+		{`*`, true},
+		{`"15"`, false},
+		{``, false},
+		{`"abc"`, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, 14); got != tt.want {
+			t.Errorf("etagMatches(%q, 14) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   string // "" for a random one
+	}{
+		{"client's", map[string]string{requestIDHeader: "abc-123"}, "abc-123"},
+		{"traceparent", map[string]string{traceParentHeader: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}, "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{"bad traceparent", map[string]string{traceParentHeader: "00-xyz-00f067aa0ba902b7-01"}, ""},
+		{"none", nil, ""},
+	}
+	for _, tt := range tests {
+		var seen string
+		h := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = tracing.RequestID(r.Context())
+		}))
+		r := httptest.NewRequest(http.MethodGet, "/status", nil)
+		for k, v := range tt.header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := w.Header().Get(requestIDHeader); got != seen || seen == "" || tt.want != "" && seen != tt.want {
+			t.Errorf("%s: request ID %q, echoed %q, want %q", tt.name, seen, got, tt.want)
+		}
+	}
+}
+
+func TestDrainRequests(t *testing.T) {
+	node := &server{}
+	hs := &httpServer{node: node, logger: zap.NewNop()}
+	var inFlight int64
+	h := hs.drainRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight = node.inFlight.Load()
+	}))
+	serve := func(path string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, nil))
+		return w.Code
+	}
+	if code := serve("/key/_update"); code != http.StatusOK || inFlight != 1 {
+		t.Errorf("before draining: %d with %d in flight, want 200 with 1", code, inFlight)
+	}
+	node.draining.Store(true)
+	if code := serve("/key/_update"); code != http.StatusServiceUnavailable {
+		t.Errorf("while draining: %d, want 503", code)
+	}
+	if code := serve("/readyz"); code != http.StatusOK {
+		t.Errorf("health check while draining: %d, want it served", code)
+	}
+	if n := node.inFlight.Load(); n != 0 {
+		t.Errorf("%d requests left in flight", n)
+	}
+}
+
+func TestFetchMinIndex(t *testing.T) {
+	srv, addr := startTestNode(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	written, err := srv.SetKeyVal(ctx, "t1", "k1", "c", "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		minIndex uint64
+		session  string
+		want     int
+	}{
+		{"linearizable", 0, "", http.StatusOK},
+		{"written index", written, "", http.StatusOK},
+		{"older index", 1, "", http.StatusOK},
+		{"not reached", written + 1000, "", http.StatusServiceUnavailable},
+		// the session's index is the floor of min_index reads.
+		{"session ahead", 1, fmt.Sprintf("node-2:%d", written+1000), http.StatusServiceUnavailable},
+		{"session ignored without min_index", 0, fmt.Sprintf("node-2:%d", written+1000), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := fmt.Sprintf(`{"table":"t1", "key":"k1", "min_index":%d}`, tt.minIndex)
+			req, err := http.NewRequest(http.MethodPost, "http://"+addr+"/key/_fetch", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.session != "" {
+				req.Header.Set(sessionHeader, tt.session)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("_fetch with min_index %d: status %d, want %d", tt.minIndex, resp.StatusCode, tt.want)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			var out struct {
+				Result map[string]string `json:"result"`
+				Index  uint64            `json:"index"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+				t.Fatal(err)
+			}
+			if out.Result["c"] != "v" || out.Index < written {
+				t.Errorf("_fetch with min_index %d = %v at index %d, want c=v at %d or later", tt.minIndex, out.Result, out.Index, written)
+			}
+		})
+	}
+}
+
+func TestTraceMiddleware(t *testing.T) {
+	tests := []struct {
+		name   string
+		debug  string
+		status int // 0 for a handler only writing a body
+		want   []string
+	}{
+		{"not asked", "", http.StatusOK, nil},
+		{"other debug value", "verbose", http.StatusOK, nil},
+		{"traced", "trace", http.StatusOK, []string{"received", "read index", "responding"}},
+		{"traced error", "trace", http.StatusServiceUnavailable, []string{"received", "read index", "responding"}},
+		{"traced body only", "trace", 0, []string{"received", "read index", "responding"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := traceMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tracing.FromContext(r.Context()).Step("read index", "")
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+				w.Write([]byte("{}"))
+			}))
+			r := httptest.NewRequest(http.MethodPost, "/key/_fetch", nil)
+			if tt.debug != "" {
+				r.Header.Set(debugHeader, tt.debug)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			header := w.Header().Get(traceHeader)
+			if tt.want == nil {
+				if header != "" {
+					t.Errorf("trace header = %s, want none", header)
+				}
+				return
+			}
+			var steps []tracing.Step
+			if err := json.Unmarshal([]byte(header), &steps); err != nil {
+				t.Fatalf("trace header %q: %v", header, err)
+			}
+			var names []string
+			for _, s := range steps {
+				names = append(names, s.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("trace steps = %v, want %v", names, tt.want)
+			}
+			want := tt.status
+			if want == 0 {
+				want = http.StatusOK
+			}
+			if last := steps[len(steps)-1]; last.Detail != fmt.Sprint(want) || w.Code != want {
+				t.Errorf("responded %d, traced %q, want %d", w.Code, last.Detail, want)
+			}
+		})
+	}
+}
+
+func TestRowUpdate(t *testing.T) {
+	srv, addr := startTestNode(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	version, err := srv.SetRow(ctx, "t1", "r1", map[string]string{"a": "1", "b": "1"}, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each request runs against the row the previous ones left.
+	tests := []struct {
+		name    string
+		body    string
+		ifMatch string // If-Match header, "" for none
+		want    int
+		row     map[string]string
+	}{
+		{"no columns", `{"table":"t1", "key":"r1", "columns":{}}`, "", http.StatusBadRequest, map[string]string{"a": "1", "b": "1"}},
+		{"set merges", `{"table":"t1", "key":"r1", "columns":{"b":"2", "c":"2"}}`, "", http.StatusOK, map[string]string{"a": "1", "b": "2", "c": "2"}},
+		{"stale if_match", fmt.Sprintf(`{"table":"t1", "key":"r1", "columns":{"a":"3"}, "if_match":%d}`, version), "", http.StatusPreconditionFailed, map[string]string{"a": "1", "b": "2", "c": "2"}},
+		{"stale If-Match", `{"table":"t1", "key":"r1", "columns":{"a":"3"}}`, rowETag(version), http.StatusPreconditionFailed, map[string]string{"a": "1", "b": "2", "c": "2"}},
+		{"bad If-Match", `{"table":"t1", "key":"r1", "columns":{"a":"3"}}`, `"v1"`, http.StatusBadRequest, map[string]string{"a": "1", "b": "2", "c": "2"}},
+		{"replace", `{"table":"t1", "key":"r1", "columns":{"c":"4", "d":"4"}, "replace":true}`, "", http.StatusOK, map[string]string{"c": "4", "d": "4"}},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodPost, "http://"+addr+"/key/_update_row", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.ifMatch != "" {
+			req.Header.Set("If-Match", tt.ifMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: _update_row = %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+		row, _, err := srv.GetByRowKey(ctx, "t1", "r1", 0)
+		if err != nil || !reflect.DeepEqual(row, tt.row) {
+			t.Errorf("%s: row = %v, %v, want %v", tt.name, row, err, tt.row)
+		}
+	}
+
+	// the row's current version is a match.
+	row, _, err := srv.GetRow(ctx, "t1", "r1", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.SetRow(ctx, "t1", "r1", map[string]string{"e": "5"}, false, &row.Version); err != nil {
+		t.Errorf("SetRow() at the current version error = %v", err)
+	}
+	if _, err := srv.SetRow(ctx, "t1", "r1", nil, false, nil); err == nil {
+		t.Error("SetRow() of no columns succeeded")
+	}
+}
@@ -0,0 +1,519 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+// scanIndex is the cursor's Index of a query scanning its table.
+const scanIndex = "*"
+
+// indexBackfillInterval is how often the leader looks for indexes to
+// backfill.
+const indexBackfillInterval = time.Second
+
+// CreateIndex creates a secondary index over columns of a table.  The rows
+// already there are backfilled by the leader in the background, queries
+// don't read the index until it is done, see indexBuilds.  Unique indexes
+// are built by the entry creating them, over rows sharing a value it fails
+// with multiraft.ErrUniqueViolation.  Recreating an index rebuilds it.
+func (n *server) CreateIndex(ctx context.Context, def multiraft.IndexDef) (uint64, error) {
+	if err := def.Validate(); err != nil {
+		return 0, err
+	}
+	return n.applyWrite(ctx, multiraft.KVData{Op: multiraft.OpCreateIndex, Table: def.Table, IndexDef: &def})
+}
+
+// DropIndex drops a secondary index, dropping one that doesn't exist is a
+// no-op.
+func (n *server) DropIndex(ctx context.Context, table, name string) (uint64, error) {
+	return n.applyWrite(ctx, multiraft.KVData{Op: multiraft.OpDropIndex, Table: table, Row: name})
+}
+
+// Indexes returns the secondary indexes of every table.
+func (n *server) Indexes(ctx context.Context) ([]multiraft.IndexDef, error) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return nil, err
+	}
+	res, err := agent.Read(ctx, multiraft.IndexesQuery{})
+	if err != nil {
+		return nil, err
+	}
+	defs, ok := res.([]multiraft.IndexDef)
+	if !ok {
+		return nil, fmt.Errorf("converting result to []multiraft.IndexDef: %T", res)
+	}
+	return defs, nil
+}
+
+// Select returns the rows of a table matching a multiraft.SelectQuery, read
+// through a secondary index when one covers its leading columns.  Every
+// shard is read and the pages merged, see queryShards for the consistency
+// levels.
+func (n *server) Select(ctx context.Context, query multiraft.SelectQuery, consistency string) (*multiraft.SelectPage, *queryMeta, error) {
+	results, meta, err := n.queryShards(ctx, query, consistency)
+	if err != nil {
+		return nil, nil, err
+	}
+	pages := make([]*multiraft.SelectPage, 0, len(results))
+	for _, val := range results {
+		page, ok := val.(*multiraft.SelectPage)
+		if !ok {
+			return nil, nil, fmt.Errorf("converting result to *multiraft.SelectPage: %T", val)
+		}
+		pages = append(pages, page)
+	}
+	return multiraft.MergeSelectPages(pages, query.Limit), meta, nil
+}
+
+// queryPlan is how a query is read, see ExplainSelect: the plan of the
+// first shard read, examining the rows of every shard, and each shard's plan.
+type queryPlan struct {
+	Table  string `json:"table"`
+	Access string `json:"access"`
+	multiraft.SelectPlan
+	Shards map[uint64]*multiraft.SelectPlan `json:"shards"`
+}
+
+// Query accesses, by what the shards read.
+const (
+	accessIndex = "index"
+	accessScan  = "scan"
+)
+
+// ExplainSelect returns how Select would read the first page of a query,
+// planned by every shard as of the same read as Select, and the rows or
+// index entries each would examine.
+func (n *server) ExplainSelect(ctx context.Context, query multiraft.SelectQuery, consistency string) (*queryPlan, *queryMeta, error) {
+	results, meta, err := n.queryShards(ctx, multiraft.ExplainQuery{Select: query}, consistency)
+	if err != nil {
+		return nil, nil, err
+	}
+	plan := &queryPlan{Table: query.Table, Access: accessScan, Shards: make(map[uint64]*multiraft.SelectPlan, len(results))}
+	ids := make([]uint64, 0, len(results))
+	for id, val := range results {
+		shardPlan, ok := val.(*multiraft.SelectPlan)
+		if !ok {
+			return nil, nil, fmt.Errorf("converting result to *multiraft.SelectPlan: %T", val)
+		}
+		plan.Shards[id] = shardPlan
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var examined, estimated uint64
+	var capped bool
+	for i, id := range ids {
+		shardPlan := plan.Shards[id]
+		if i == 0 {
+			plan.SelectPlan = *shardPlan
+		}
+		examined += shardPlan.Examined
+		capped = capped || shardPlan.Capped
+		if shardPlan.Estimated != nil {
+			estimated += *shardPlan.Estimated
+		}
+	}
+	plan.Examined, plan.Capped = examined, capped
+	if plan.Estimated != nil {
+		plan.Estimated = &estimated
+	}
+	if plan.Index != "" {
+		plan.Access = accessIndex
+	}
+	return plan, meta, nil
+}
+
+// indexBuild is the backfill progress of an index in /status.
+type indexBuild struct {
+	Table      string `json:"table"`
+	Name       string `json:"name"`
+	Backfilled uint64 `json:"backfilled"`
+	Cursor     string `json:"cursor,omitempty"`
+}
+
+// indexBuilds returns the indexes being backfilled as this node's replica
+// last saw them.
+func (n *server) indexBuilds() []indexBuild {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return nil
+	}
+	res, err := agent.ReadLocal(multiraft.IndexesQuery{})
+	if err != nil {
+		return nil
+	}
+	defs, _ := res.([]multiraft.IndexDef)
+	var builds []indexBuild
+	for _, def := range defs {
+		if def.Building {
+			builds = append(builds, indexBuild{Table: def.Table, Name: def.Name, Backfilled: def.Backfilled, Cursor: def.Cursor})
+		}
+	}
+	return builds
+}
+
+// runIndexBackfill is run by the leader, see leaderLoop.
+func (n *server) runIndexBackfill(ctx context.Context) {
+	ticker := time.NewTicker(indexBackfillInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := n.backfillIndexes(ctx); err != nil {
+			n.logger.Warn("index backfill failed", zap.Error(err))
+		}
+	}
+}
+
+// backfillIndexes proposes backfill steps until no index is Building.  Each
+// step resumes from the cursor the last one left, so a new leader picks up
+// where the old one stopped.
+func (n *server) backfillIndexes(ctx context.Context) error {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return err
+	}
+	for ctx.Err() == nil {
+		defs, err := n.Indexes(ctx)
+		if err != nil {
+			return err
+		}
+		building := false
+		for _, def := range defs {
+			if !def.Building {
+				continue
+			}
+			building = true
+			step := multiraft.KVData{Op: multiraft.OpBackfillIndex, Table: def.Table, Row: def.Name, Val: def.Cursor}
+			if _, err := agent.Apply(ctx, step); err != nil {
+				return fmt.Errorf("backfilling index %s of %s: %w", def.Name, def.Table, err)
+			}
+		}
+		if !building {
+			return nil
+		}
+	}
+	return ctx.Err()
+}
+
+func (n *server) indexRows(ctx context.Context) ([]multiraft.ScanRow, error) {
+	defs, err := n.Indexes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var rows []multiraft.ScanRow
+	for _, def := range defs {
+		rows = append(rows, multiraft.ScanRow{Key: def.Table + "/" + def.Name, Columns: map[string]string{
+			"table":   def.Table,
+			"name":    def.Name,
+			"columns": strings.Join(def.Columns, ","),
+			"unique":  strconv.FormatBool(def.Unique),
+			"state":   indexState(def),
+		}})
+	}
+	return rows, nil
+}
+
+func indexState(def multiraft.IndexDef) string {
+	if def.Building {
+		return "building"
+	}
+	return "ready"
+}
+
+// handleIndexChange creates or drops an index, by path.
+func (server *httpServer) handleIndexChange(w http.ResponseWriter, r *http.Request) {
+	req := multiraft.IndexDef{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Table == "" || req.Name == "" {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	create := strings.HasSuffix(r.URL.Path, "/_create")
+	if create {
+		if err := req.Validate(); err != nil {
+			server.logger.Error("Bad request, invalid index", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if !server.checkTable(w, r, ActionAdmin, req.Table) {
+		return
+	}
+	if !server.checkWritable(w) {
+		return
+	}
+	var index uint64
+	var err error
+	if create {
+		index, err = server.node.CreateIndex(r.Context(), req)
+	} else {
+		index, err = server.node.DropIndex(r.Context(), req.Table, req.Name)
+	}
+	if errors.Is(err, multiraft.ErrWritesFrozen) {
+		server.logger.Info("Rejecting index change", zap.Error(err))
+		statusUnavailable(w)
+		return
+	} else if errors.Is(err, multiraft.ErrUniqueViolation) {
+		server.logger.Info("Rejecting unique index over duplicate values", zap.Error(err))
+		statusError(w, err)
+		return
+	} else if err != nil {
+		server.logger.Error("Failed to change index", zap.String("table", req.Table), zap.String("index", req.Name), zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	response := struct {
+		Index uint64 `json:"index"`
+	}{
+		Index: index,
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
+
+// Query bounds of a node whose config leaves them unset, the flags'
+// defaults.
+const (
+	defaultQueryTimeout  = 10 * time.Second
+	defaultQueryMaxBytes = 4 << 20
+)
+
+// queryBounds returns the most rows and bytes of rows a query page returns
+// and the longest it reads for.
+func (n *server) queryBounds() (int, int, time.Duration) {
+	rows, bytes, timeout := n.config.QueryMaxRows, n.config.QueryMaxBytes, n.config.QueryTimeout
+	if rows <= 0 {
+		rows = maxScanLimit
+	}
+	if bytes <= 0 {
+		bytes = defaultQueryMaxBytes
+	}
+	if timeout <= 0 {
+		timeout = defaultQueryTimeout
+	}
+	return rows, bytes, timeout
+}
+
+// handleQuery returns the rows of a table whose columns equal those of
+// where.  The index is picked by the first page, the cursor keeps later
+// pages on it.  A page is bounded by the query flags, or the lower
+// max_bytes and timeout of the request, and stops reading when the client
+// goes away.
+func (server *httpServer) handleQuery(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Table       string            `json:"table"`
+		Where       map[string]string `json:"where"`
+		Index       string            `json:"index"`
+		Scan        bool              `json:"scan"`
+		Limit       int               `json:"limit"`
+		Cursor      string            `json:"cursor"`
+		Consistency string            `json:"consistency"`
+		Explain     bool              `json:"explain"`
+		MaxBytes    int               `json:"max_bytes"`
+		Timeout     string            `json:"timeout"`
+	}{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Table == "" || !validConsistency(req.Consistency) || isVirtualTable(req.Table) || req.MaxBytes < 0 {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	maxRows, maxBytes, timeout := server.node.queryBounds()
+	if req.Timeout != "" {
+		d, err := time.ParseDuration(req.Timeout)
+		if err != nil || d <= 0 {
+			server.logger.Error("Bad request", zap.String("timeout", req.Timeout), zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if d < timeout {
+			timeout = d
+		}
+	}
+	if !server.checkTable(w, r, ActionRead, req.Table) {
+		return
+	}
+	if req.Limit <= 0 {
+		req.Limit = defaultScanLimit
+	}
+	if req.Limit > maxRows {
+		req.Limit = maxRows
+	}
+	if req.MaxBytes == 0 || req.MaxBytes > maxBytes {
+		req.MaxBytes = maxBytes
+	}
+
+	key, err := server.node.cursorKey(r.Context())
+	if err != nil {
+		server.logger.Warn("Cursor key unavailable", zap.Error(err))
+		statusUnavailable(w)
+		return
+	}
+	query := multiraft.SelectQuery{
+		Table:    req.Table,
+		Where:    req.Where,
+		Index:    req.Index,
+		Scan:     req.Scan,
+		Limit:    req.Limit,
+		MaxBytes: req.MaxBytes,
+		Deadline: time.Now().Add(timeout),
+		Done:     r.Context().Done(),
+	}
+	if req.Cursor != "" {
+		cursor, err := parseCursor(key, req.Cursor)
+		if err != nil || cursor.Table != req.Table || cursor.Index == "" {
+			server.logger.Warn("Rejecting query cursor", zap.String("table", req.Table), zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		query.After, query.Index, query.Scan = cursor.After, cursor.Index, cursor.Index == scanIndex
+		if query.Scan {
+			query.Index = ""
+		}
+	}
+
+	if multiraft.IsDryRun(r.Context()) {
+		server.planQuery(w, r, query)
+		return
+	}
+	if req.Explain {
+		server.explainQuery(w, r, query, req.Consistency)
+		return
+	}
+
+	page, meta, err := server.node.Select(r.Context(), query, req.Consistency)
+	if errors.Is(err, multiraft.ErrIndexBuilding) {
+		server.logger.Info("Rejecting query of an index being backfilled", zap.String("table", req.Table), zap.String("index", query.Index))
+		w.Header().Set("Retry-After", "1")
+		statusUnavailable(w)
+		return
+	} else if errors.Is(err, multiraft.ErrQueryCanceled) {
+		server.logger.Info("Query canceled by its client", zap.String("table", req.Table))
+		statusError(w, err)
+		return
+	} else if err != nil {
+		server.logger.Error("Failed to query", zap.String("table", req.Table), zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	response := struct {
+		Rows    []multiraft.ScanRow `json:"rows"`
+		Index   string              `json:"index,omitempty"`
+		Cursor  string              `json:"cursor,omitempty"`
+		Partial string              `json:"partial,omitempty"`
+		Meta    *queryMeta          `json:"meta"`
+	}{
+		Rows:    page.Rows,
+		Index:   page.Index,
+		Partial: page.Partial,
+		Meta:    meta,
+	}
+	if response.Rows == nil {
+		response.Rows = []multiraft.ScanRow{}
+	}
+	if page.More {
+		cursor := scanCursor{Table: req.Table, After: page.Last, Index: page.Index}
+		if cursor.Index == "" {
+			cursor.Index = scanIndex
+		}
+		if response.Cursor, err = signCursor(key, cursor); err != nil {
+			server.logger.Error("Failed to sign query cursor", zap.Error(err))
+			statusInternalError(w)
+			return
+		}
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
+
+// explainQuery answers a query with how it would be read instead of its
+// rows, see ExplainSelect.
+func (server *httpServer) explainQuery(w http.ResponseWriter, r *http.Request, query multiraft.SelectQuery, consistency string) {
+	plan, meta, err := server.node.ExplainSelect(r.Context(), query, consistency)
+	if errors.Is(err, multiraft.ErrIndexBuilding) {
+		w.Header().Set("Retry-After", "1")
+		statusUnavailable(w)
+		return
+	} else if err != nil {
+		server.logger.Error("Failed to explain query", zap.String("table", query.Table), zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	response := struct {
+		Plan *queryPlan `json:"plan"`
+		Meta *queryMeta `json:"meta"`
+	}{
+		Plan: plan,
+		Meta: meta,
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
+
+// planQuery answers a dry run query with the index it would read, "" for a
+// scan.
+func (server *httpServer) planQuery(w http.ResponseWriter, r *http.Request, query multiraft.SelectQuery) {
+	defs, err := server.node.Indexes(r.Context())
+	if err != nil {
+		server.logger.Error("Failed to plan query", zap.String("table", query.Table), zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	var tableDefs []multiraft.IndexDef
+	for _, def := range defs {
+		if def.Table == query.Table {
+			tableDefs = append(tableDefs, def)
+		}
+	}
+	index := ""
+	switch {
+	case query.Scan:
+	case query.Index != "":
+		for _, def := range tableDefs {
+			if def.Name != query.Index {
+				continue
+			}
+			if def.Building {
+				w.Header().Set("Retry-After", "1")
+				statusUnavailable(w)
+				return
+			}
+			index = def.Name
+		}
+		if index == "" {
+			statusError(w, multiraft.ErrIndexNotFound)
+			return
+		}
+	default:
+		stats, err := server.node.tableStats(r.Context(), query.Table)
+		if err != nil {
+			server.logger.Error("Failed to plan query", zap.String("table", query.Table), zap.Error(err))
+			statusError(w, err)
+			return
+		}
+		if def := multiraft.PlanSelect(tableDefs, stats, query.Where); def != nil {
+			index = def.Name
+		}
+	}
+	response := struct {
+		Rows  []multiraft.ScanRow `json:"rows"`
+		Index string              `json:"index,omitempty"`
+	}{
+		Rows:  []multiraft.ScanRow{},
+		Index: index,
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
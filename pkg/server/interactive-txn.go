@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/errdefs"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+const (
+	// txnIdleTimeout is how long an interactive transaction may sit without a
+	// request before it's rolled back.
+	txnIdleTimeout = time.Minute
+	// maxTxnSessions bounds the interactive transactions open on a node.
+	maxTxnSessions = 10000
+)
+
+var (
+	ErrTxnNotFound       = errdefs.New(errdefs.ErrNotFound, "interactive transaction not found or expired")
+	ErrSavepointNotFound = errdefs.New(errdefs.ErrNotFound, "savepoint not found")
+	ErrTooManyTxns       = errors.New("too many interactive transactions open")
+	ErrTxnTooLarge       = errors.New("transaction too large")
+)
+
+// txnSession is an open interactive transaction.  Its writes are buffered on
+// the node that began it and only sent to the shards, as a single 2PC
+// transaction, on commit.  Reads see the buffered writes on top of the
+// committed rows; they aren't validated at commit, so a transaction reading
+// a row another client writes in the meantime commits over it.  Only the
+// principal that began it, its owner, can use it.
+type txnSession struct {
+	mu         sync.Mutex
+	owner      string
+	writes     []multiraft.TxnWrite
+	savepoints []savepoint
+	lastUsed   time.Time
+	done       bool
+}
+
+// savepoint marks how many writes were buffered when it was set.
+type savepoint struct {
+	name   string
+	writes int
+}
+
+type txnSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*txnSession
+}
+
+// BeginTxn opens an interactive transaction on this node for the principal
+// named owner, clients send the rest of its requests to the same node.
+func (n *server) BeginTxn(owner string) (string, error) {
+	id, err := newTxnID()
+	if err != nil {
+		return "", err
+	}
+	n.txnSessions.mu.Lock()
+	defer n.txnSessions.mu.Unlock()
+	if n.txnSessions.sessions == nil {
+		n.txnSessions.sessions = map[string]*txnSession{}
+	}
+	if len(n.txnSessions.sessions) >= maxTxnSessions {
+		return "", ErrTooManyTxns
+	}
+	n.txnSessions.sessions[id] = &txnSession{owner: owner, lastUsed: time.Now()}
+	return id, nil
+}
+
+// ownTxn returns ErrTxnNotFound unless the open transaction id was begun by
+// owner, so the transactions of others are as good as missing.
+func (n *server) ownTxn(id, owner string) error {
+	return n.withTxn(id, func(s *txnSession) error {
+		if s.owner != owner {
+			return ErrTxnNotFound
+		}
+		return nil
+	})
+}
+
+// txnHandle is how an open transaction is shown, in _sessions: its ID is
+// the only credential of its requests, so it is hashed.
+func txnHandle(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+// withTxn runs fn on the open transaction holding its lock.
+func (n *server) withTxn(id string, fn func(s *txnSession) error) error {
+	n.txnSessions.mu.Lock()
+	s, ok := n.txnSessions.sessions[id]
+	n.txnSessions.mu.Unlock()
+	if !ok {
+		return ErrTxnNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return ErrTxnNotFound
+	}
+	s.lastUsed = time.Now()
+	return fn(s)
+}
+
+// endTxn closes the transaction, returning its buffered writes.
+func (n *server) endTxn(id string) ([]multiraft.TxnWrite, error) {
+	var writes []multiraft.TxnWrite
+	err := n.withTxn(id, func(s *txnSession) error {
+		writes, s.done = s.writes, true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	n.txnSessions.mu.Lock()
+	delete(n.txnSessions.sessions, id)
+	n.txnSessions.mu.Unlock()
+	return writes, nil
+}
+
+// TxnRead returns a row as the transaction sees it.
+func (n *server) TxnRead(ctx context.Context, id, table, key string) (map[string]string, error) {
+	if err := n.withTxn(id, func(*txnSession) error { return nil }); err != nil {
+		return nil, err
+	}
+	row, _, err := n.GetByRowKey(ctx, table, key, 0)
+	if err != nil {
+		return nil, err
+	}
+	cols := make(map[string]string, len(row))
+	for col, val := range row {
+		cols[col] = val
+	}
+	err = n.withTxn(id, func(s *txnSession) error {
+		for _, w := range s.writes {
+			if w.Table != table || w.Row != key {
+				continue
+			} else if w.Delete {
+				delete(cols, w.Column)
+			} else {
+				cols[w.Column] = w.Val
+			}
+		}
+		return nil
+	})
+	return cols, err
+}
+
+// TxnWrite buffers writes in the transaction.
+func (n *server) TxnWrite(id string, writes []multiraft.TxnWrite) error {
+	return n.withTxn(id, func(s *txnSession) error {
+		if len(s.writes)+len(writes) > maxTxnWrites {
+			return fmt.Errorf("%w: it holds at most %d writes", ErrTxnTooLarge, maxTxnWrites)
+		}
+		s.writes = append(s.writes, writes...)
+		return nil
+	})
+}
+
+// TxnSavepoint marks the transaction's writes so far, setting a savepoint
+// again moves it.
+func (n *server) TxnSavepoint(id, name string) error {
+	return n.withTxn(id, func(s *txnSession) error {
+		s.savepoints = append(dropSavepoint(s.savepoints, name), savepoint{name: name, writes: len(s.writes)})
+		return nil
+	})
+}
+
+// TxnRollbackTo drops the writes buffered since the savepoint, and the
+// savepoints set after it.  The savepoint itself is kept.
+func (n *server) TxnRollbackTo(id, name string) error {
+	return n.withTxn(id, func(s *txnSession) error {
+		for i := len(s.savepoints) - 1; i >= 0; i-- {
+			if sp := s.savepoints[i]; sp.name == name {
+				s.writes = s.writes[:sp.writes]
+				s.savepoints = s.savepoints[:i+1]
+				return nil
+			}
+		}
+		return ErrSavepointNotFound
+	})
+}
+
+// CommitTxn closes the transaction and applies its writes, see Transact.
+// Committing a transaction without writes is a no-op.
+func (n *server) CommitTxn(ctx context.Context, id string) (string, error) {
+	writes, err := n.endTxn(id)
+	if err != nil || len(writes) == 0 {
+		return "", err
+	}
+	return n.Transact(ctx, writes)
+}
+
+// RollbackTxn closes the transaction dropping its writes.
+func (n *server) RollbackTxn(id string) error {
+	_, err := n.endTxn(id)
+	return err
+}
+
+// reapTxnSessions rolls back interactive transactions idle for over
+// txnIdleTimeout.
+func (n *server) reapTxnSessions(ctx context.Context) {
+	ticker := time.NewTicker(txnIdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n.txnSessions.mu.Lock()
+		for id, s := range n.txnSessions.sessions {
+			s.mu.Lock()
+			if time.Since(s.lastUsed) > txnIdleTimeout {
+				s.done = true
+				delete(n.txnSessions.sessions, id)
+				n.logger.Info("rolled back idle interactive transaction", zap.String("txn", id))
+			}
+			s.mu.Unlock()
+		}
+		n.txnSessions.mu.Unlock()
+	}
+}
+
+func dropSavepoint(savepoints []savepoint, name string) []savepoint {
+	kept := savepoints[:0]
+	for _, sp := range savepoints {
+		if sp.name != name {
+			kept = append(kept, sp)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/config"
+	"github.com/epsniff/expodb/pkg/errdefs"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+)
+
+func TestInteractiveTxn_Savepoints(t *testing.T) {
+	n := &server{}
+	id, err := n.BeginTxn("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(col string) {
+		t.Helper()
+		if err := n.TxnWrite(id, []multiraft.TxnWrite{{Table: "t", Row: "r", Column: col, Val: "v"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	columns := func() (cols []string) {
+		n.withTxn(id, func(s *txnSession) error {
+			for _, w := range s.writes {
+				cols = append(cols, w.Column)
+			}
+			return nil
+		})
+		return cols
+	}
+
+	write("a")
+	n.TxnSavepoint(id, "one")
+	write("b")
+	n.TxnSavepoint(id, "two")
+	write("c")
+	if err := n.TxnRollbackTo(id, "one"); err != nil {
+		t.Fatalf("TxnRollbackTo(one) error = %v", err)
+	}
+	if got := columns(); len(got) != 1 || got[0] != "a" {
+		t.Errorf("writes after rollback to one = %v, want [a]", got)
+	}
+	if err := n.TxnRollbackTo(id, "two"); !errors.Is(err, ErrSavepointNotFound) {
+		t.Errorf("TxnRollbackTo(two) error = %v, want the later savepoint dropped", err)
+	}
+	// the savepoint is kept, rolling back to it again drops the new writes.
+	write("d")
+	if err := n.TxnRollbackTo(id, "one"); err != nil || len(columns()) != 1 {
+		t.Errorf("second rollback to one = %v, writes %v", err, columns())
+	}
+
+	if err := n.RollbackTxn(id); err != nil {
+		t.Fatalf("RollbackTxn() error = %v", err)
+	}
+	if _, err := n.CommitTxn(context.Background(), id); !errors.Is(err, ErrTxnNotFound) {
+		t.Errorf("CommitTxn() after rollback error = %v, want ErrTxnNotFound", err)
+	}
+}
+
+func TestInteractiveTxn_Owner(t *testing.T) {
+	n := &server{}
+	id, err := n.BeginTxn("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.ownTxn(id, "alice"); err != nil {
+		t.Errorf("ownTxn() by its owner error = %v", err)
+	}
+	if err := n.ownTxn(id, "mallory"); !errors.Is(err, ErrTxnNotFound) {
+		t.Errorf("ownTxn() by another principal error = %v, want ErrTxnNotFound", err)
+	}
+	if err := n.ownTxn("missing", "alice"); !errors.Is(err, ErrTxnNotFound) {
+		t.Errorf("ownTxn() of a missing transaction error = %v, want ErrTxnNotFound", err)
+	}
+	if h := txnHandle(id); h == id || len(h) != 16 {
+		t.Errorf("txnHandle() = %q, want a 16 digit hash", h)
+	}
+}
+
+// TestInteractiveTxn_Session begins, writes and commits a transaction with
+// a session bound to another node: the transaction lives on the node that
+// began it, so the session must follow it there.
+func TestInteractiveTxn_Session(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	// the replicas' stores are relative to the working directory.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	cfg := &config.Config{
+		NodeName:        "node-1",
+		SerfBindAddress: "127.0.0.1",
+		SerfBindPort:    freePort(t),
+		SerfDataDir:     dir + "/serf",
+		IsSerfSeed:      true,
+		HTTPBindAddress: "127.0.0.1",
+		RaftBindAddress: "127.0.0.1",
+		RaftBindPort:    freePort(t),
+		RaftDataDir:     dir + "/raft",
+		Bootstrap:       true,
+	}
+	srv, err := New(cfg, WithListener(ln))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := srv.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop(ctx)
+	for {
+		if _, err := srv.SetKeyVal(ctx, "t1", "k0", "c", "v"); err == nil {
+			break
+		} else if ctx.Err() != nil {
+			t.Fatalf("writing: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	srv.metadata.Restore(&nodedata{id: "node-2", httpAddr: "127.0.0.1:1", state: nodeAlive})
+
+	session := "node-2:0"
+	post := func(path, body string) map[string]string {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, "http://"+ln.Addr().String()+path, strings.NewReader(body))
+		req.Header.Set(sessionHeader, session)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d, session %q", path, resp.StatusCode, session)
+		}
+		session = resp.Header.Get(sessionHeader)
+		out := map[string]string{}
+		json.NewDecoder(resp.Body).Decode(&out)
+		return out
+	}
+	id := post("/v1/txn/_begin", "")["txn_id"]
+	if !strings.HasPrefix(session, "node-1:") {
+		t.Fatalf("session after _begin = %q, want it bound to node-1", session)
+	}
+	post("/v1/txn/_write", `{"txn_id":"`+id+`", "writes":[{"table":"t1", "key":"k1", "column":"c", "value":"v1"}]}`)
+
+	// a request bound to another node is sent there.
+	req, _ := http.NewRequest(http.MethodPost, "http://"+ln.Addr().String()+"/v1/txn/_write", strings.NewReader(`{"txn_id":"`+id+`"}`))
+	req.Header.Set(sessionHeader, "node-2:0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMisdirectedRequest || resp.Header.Get(errdefs.Header) != "not_leader" || resp.Header.Get(routingHeader) != "127.0.0.1:1" {
+		t.Errorf("request bound to node-2: status %d, headers %v", resp.StatusCode, resp.Header)
+	}
+	post("/v1/txn/_commit", `{"txn_id":"`+id+`"}`)
+	row, _, err := srv.GetRow(ctx, "t1", "k1", 0, nil)
+	if err != nil || row.Columns["c"] != "v1" {
+		t.Errorf("row after commit = %v, %v", row, err)
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/joinauth"
+)
+
+const (
+	// joinTokensRow holds the one-time join tokens in the cluster table, one
+	// column per token ID, see joinauth.Mint.
+	joinTokensRow       = "join_tokens"
+	defaultJoinTokenTTL = time.Hour
+	maxJoinTokenTTL     = 7 * 24 * time.Hour
+	// joinProbeTimeout bounds dialing a node's raft address, see probeJoin.
+	joinProbeTimeout = 2 * time.Second
+)
+
+// MintJoinToken creates a one-time token a new node can present, with
+// --join-token, to be added to the raft group.  It expires after ttl.
+func (n *server) MintJoinToken(ctx context.Context, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		ttl = defaultJoinTokenTTL
+	}
+	if ttl > maxJoinTokenTTL {
+		return "", fmt.Errorf("join token ttl %v exceeds the maximum of %v", ttl, maxJoinTokenTTL)
+	}
+	token, val, err := joinauth.Mint(ttl, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if _, err := n.SetKeyVal(ctx, clusterTable, joinTokensRow, joinauth.TokenID(token), val); err != nil {
+		return "", fmt.Errorf("storing join token: %w", err)
+	}
+	return token, nil
+}
+
+// authorizeJoin checks a node may be added to the raft group.  Nothing is
+// checked unless this node runs with a join token.  Nodes must then prove
+// they hold either that token or an unexpired one-time token.  The ID of the
+// one-time token is returned, for consumeJoinToken once the node is added.
+func (n *server) authorizeJoin(ctx context.Context, node *nodedata) (string, error) {
+	bootstrap := n.config.JoinToken
+	if bootstrap == "" {
+		return "", nil
+	}
+	if node.joinProof == "" {
+		return "", fmt.Errorf("node %s presented no join token", node.ID())
+	}
+	if node.joinTokenID == joinauth.TokenID(bootstrap) {
+		if !joinauth.Verify(bootstrap, node.ID(), node.RaftAddr(), node.joinProof) {
+			return "", fmt.Errorf("node %s presented an invalid join proof", node.ID())
+		}
+		return "", nil
+	}
+
+	row, _, err := n.GetRow(ctx, clusterTable, joinTokensRow, 0, []string{node.joinTokenID})
+	if err != nil {
+		return "", fmt.Errorf("loading join tokens: %w", err)
+	}
+	if err := joinauth.Check(row.Columns[node.joinTokenID], node.ID(), node.RaftAddr(), node.joinProof, time.Now()); err != nil {
+		return "", fmt.Errorf("node %s: %w", node.ID(), err)
+	}
+	return node.joinTokenID, nil
+}
+
+// consumeJoinToken deletes a one-time token, once the node that presented
+// it has been added: a failed add leaves it for the retries.
+func (n *server) consumeJoinToken(ctx context.Context, id string) error {
+	if id == "" {
+		return nil
+	}
+	if _, err := n.DeleteKey(ctx, clusterTable, joinTokensRow, id); err != nil {
+		return fmt.Errorf("consuming join token: %w", err)
+	}
+	return nil
+}
+
+// checkClusterID refuses nodes gossiping another cluster's ID, which found
+// their way into our gossip pool.  Nodes without one are new and adopt ours
+// once they join, see cluster-id.go.
+func (n *server) checkClusterID(node *nodedata) error {
+	if want := n.ClusterID(); want != "" && node.ClusterID() != "" && node.ClusterID() != want {
+		return fmt.Errorf("node %s is in cluster %q, not %q", node.ID(), node.ClusterID(), want)
+	}
+	return nil
+}
+
+// probeJoin dials a node's raft address before it is added to the raft
+// group, so a node gossiping an address we can't reach isn't counted in
+// the quorum while it never votes.
+func (n *server) probeJoin(ctx context.Context, node *nodedata) error {
+	dialer := net.Dialer{Timeout: joinProbeTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", node.RaftAddr())
+	if err != nil {
+		return fmt.Errorf("raft address of node %s unreachable: %w", node.ID(), err)
+	}
+	return conn.Close()
+}
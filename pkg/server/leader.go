@@ -55,7 +55,38 @@ func (n *server) monitorLeadership(ctx context.Context) error {
 // started ever N mins, this would be a good place to put it.
 func (n *server) leaderLoop(ctx context.Context) error {
 	// We are the leader, do leader stuff here.
-	<-ctx.Done()
+	n.recordEvent(ctx, eventLeaderElected, n.config.ID(), "")
+	if err := n.syncNodeCatalog(ctx); err != nil {
+		n.logger.Error("failed to sync node catalog", zap.Error(err))
+	}
+	if err := n.ensureClusterSecrets(ctx); err != nil {
+		n.logger.Error("failed to create cluster secrets", zap.Error(err))
+	}
+	if err := n.ensureClusterID(ctx); err != nil {
+		n.logger.Error("failed to create cluster ID", zap.Error(err))
+	}
+	if n.config.LegacyDataDir != "" {
+		if err := n.importLegacyData(ctx); err != nil {
+			n.logger.Error("failed to import legacy data", zap.Error(err))
+		}
+	}
+	go n.runWriteFreezeWatchdog(ctx)
+	go n.runTxnRecovery(ctx)
+	go n.runIndexBackfill(ctx)
+	go n.runSchemaChanges(ctx)
+	go n.runVoterJoins(ctx)
+	go n.runSinks(ctx)
+	go n.runArchive(ctx)
+	go n.runCron(ctx)
+	go n.runAnalyzer(ctx)
+	go n.runEtcdLeaseExpiry(ctx)
+	if n.config.AutopilotDemoteLag > 0 {
+		go n.runAutopilot(ctx)
+	}
+	if n.config.ReplicateTo != "" {
+		go n.runReplicationShipper(ctx)
+	}
+	n.runTombstoneGC(ctx)
 	n.logger.Info("leader loop exiting")
 	return nil
 }
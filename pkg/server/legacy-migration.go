@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/epsniff/expodb/pkg/loggingutils"
+	"github.com/epsniff/expodb/pkg/server/state-machines/simplestore"
+	"go.uber.org/zap"
+)
+
+const (
+	// legacySnapshotsDir is where the old single-raft deployment kept its
+	// file snapshots (one directory per snapshot with meta.json + state.bin).
+	legacySnapshotsDir = "snapshots"
+	// legacyMigratedMarker is written into the legacy data dir once its rows
+	// have been imported, so restarts don't import them a second time.
+	legacyMigratedMarker = "migrated-to-multiraft"
+)
+
+// legacySnapshotMeta is the subset of the old raft snapshot meta.json we need
+// to pick the most recent snapshot.
+type legacySnapshotMeta struct {
+	ID    string
+	Index uint64
+	Term  uint64
+}
+
+// findLegacySnapshot returns the path of the newest simplestore state file in
+// the legacy data directory.
+func findLegacySnapshot(dir string) (string, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, legacySnapshotsDir))
+	if err != nil {
+		return "", fmt.Errorf("reading legacy snapshots dir: %w", err)
+	}
+
+	var newest *legacySnapshotMeta
+	var newestPath string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		snapDir := filepath.Join(dir, legacySnapshotsDir, e.Name())
+		buf, err := os.ReadFile(filepath.Join(snapDir, "meta.json"))
+		if err != nil {
+			continue // partially written snapshot, skip it
+		}
+		meta := &legacySnapshotMeta{}
+		if err := json.Unmarshal(buf, meta); err != nil {
+			return "", fmt.Errorf("parsing legacy snapshot meta %s: %w", snapDir, err)
+		}
+		if newest == nil || meta.Term > newest.Term ||
+			(meta.Term == newest.Term && meta.Index > newest.Index) {
+			newest = meta
+			newestPath = filepath.Join(snapDir, "state.bin")
+		}
+	}
+	if newest == nil {
+		return "", fmt.Errorf("no legacy snapshots found in %s", dir)
+	}
+	return newestPath, nil
+}
+
+// loadLegacyStore restores a simplestore state machine from a legacy snapshot.
+func loadLegacyStore(path string) (*simplestore.KeyValStateMachine, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading legacy snapshot: %w", err)
+	}
+	kv := simplestore.New()
+	if err := kv.Restore(data); err != nil {
+		return nil, err
+	}
+	return kv, nil
+}
+
+// importLegacyData copies every row of the legacy single-raft simplestore into
+// the multiraft store.  It must only be run by the leader, and is a no-op once
+// the legacy directory has been marked as migrated.
+func (n *server) importLegacyData(ctx context.Context) error {
+	dir := n.config.LegacyDataDir
+	marker := filepath.Join(dir, legacyMigratedMarker)
+	if _, err := os.Stat(marker); err == nil {
+		n.logger.Info("legacy data already migrated, skipping", zap.String("dir", dir))
+		return nil
+	}
+
+	path, err := findLegacySnapshot(dir)
+	if err != nil {
+		return err
+	}
+	kv, err := loadLegacyStore(path)
+	if err != nil {
+		return err
+	}
+
+	n.logger.Info("importing legacy simplestore data", zap.String("snapshot", path))
+	imported := 0
+	err = kv.Each(func(table, rowkey, column, value string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := n.SetKeyVal(ctx, table, rowkey, column, value); err != nil {
+			return fmt.Errorf("importing %s/%s/%s: %w", table, loggingutils.Redact(table, rowkey), column, err)
+		}
+		imported++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(marker, []byte(path), 0600); err != nil {
+		return fmt.Errorf("writing legacy migration marker: %w", err)
+	}
+	n.logger.Info("legacy simplestore data imported", zap.Int("columns", imported))
+	return nil
+}
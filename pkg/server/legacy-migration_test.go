@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/config"
+)
+
+// writeLegacySnapshots lays out a legacy data dir with a snapshot dir per
+// entry of metas, holding its meta.json (none when it is empty) and a
+// state.bin of its name.
+func writeLegacySnapshots(t *testing.T, metas map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, meta := range metas {
+		snapDir := filepath.Join(dir, legacySnapshotsDir, name)
+		if err := os.MkdirAll(snapDir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if meta != "" {
+			if err := os.WriteFile(filepath.Join(snapDir, "meta.json"), []byte(meta), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(snapDir, "state.bin"), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestFindLegacySnapshot(t *testing.T) {
+	tests := []struct {
+		name    string
+		metas   map[string]string
+		want    string
+		wantErr string
+	}{
+		{
+			name:  "single",
+			metas: map[string]string{"1-10": `{"ID":"1-10","Index":10,"Term":1}`},
+			want:  "1-10",
+		},
+		{
+			name: "highest index of a term",
+			metas: map[string]string{
+				"1-10": `{"Index":10,"Term":1}`,
+				"1-30": `{"Index":30,"Term":1}`,
+				"1-20": `{"Index":20,"Term":1}`,
+			},
+			want: "1-30",
+		},
+		{
+			name: "later term wins over a higher index",
+			metas: map[string]string{
+				"1-30": `{"Index":30,"Term":1}`,
+				"2-25": `{"Index":25,"Term":2}`,
+			},
+			want: "2-25",
+		},
+		{
+			name: "partially written snapshot skipped",
+			metas: map[string]string{
+				"1-10": `{"Index":10,"Term":1}`,
+				"2-40": "",
+			},
+			want: "1-10",
+		},
+		{
+			name:    "bad meta",
+			metas:   map[string]string{"1-10": `{"Index":`},
+			wantErr: "parsing legacy snapshot meta",
+		},
+		{
+			name:    "only partial snapshots",
+			metas:   map[string]string{"1-10": ""},
+			wantErr: "no legacy snapshots",
+		},
+		{
+			name:    "no snapshots dir",
+			wantErr: "reading legacy snapshots dir",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeLegacySnapshots(t, tt.metas)
+			got, err := findLegacySnapshot(dir)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("findLegacySnapshot() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("findLegacySnapshot() error = %v", err)
+			}
+			if want := filepath.Join(dir, legacySnapshotsDir, tt.want, "state.bin"); got != want {
+				t.Errorf("findLegacySnapshot() = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestImportLegacyData(t *testing.T) {
+	legacy := writeLegacySnapshots(t, map[string]string{"1-10": `{"Index":10,"Term":1}`})
+	state := `{"users":{"alice":{"name":"Alice","age":"30"},"bob":{"name":"Bob"}},"orders":{"o1":{"total":"12"}}}`
+	if err := os.WriteFile(filepath.Join(legacy, legacySnapshotsDir, "1-10", "state.bin"), []byte(state), 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv, _ := startTestNode(t, func(cfg *config.Config) { cfg.LegacyDataDir = legacy })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the leader imports the rows once elected, the marker is written last.
+	marker := filepath.Join(legacy, legacyMigratedMarker)
+	for {
+		if _, err := os.Stat(marker); err == nil {
+			break
+		} else if ctx.Err() != nil {
+			t.Fatal("legacy data never marked as migrated")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	tests := []struct {
+		table, key string
+		want       map[string]string
+	}{
+		{"users", "alice", map[string]string{"name": "Alice", "age": "30"}},
+		{"users", "bob", map[string]string{"name": "Bob"}},
+		{"orders", "o1", map[string]string{"total": "12"}},
+	}
+	for _, tt := range tests {
+		row, _, err := srv.GetByRowKey(ctx, tt.table, tt.key, 0)
+		if err != nil {
+			t.Fatalf("GetByRowKey(%s, %s) error = %v", tt.table, tt.key, err)
+		}
+		for col, want := range tt.want {
+			if row[col] != want {
+				t.Errorf("%s/%s %s = %q, want %q", tt.table, tt.key, col, row[col], want)
+			}
+		}
+	}
+
+	// marked as migrated, the legacy data isn't imported again.
+	if _, err := srv.SetKeyVal(ctx, "users", "alice", "name", "Alicia"); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.importLegacyData(ctx); err != nil {
+		t.Fatalf("importLegacyData() again error = %v", err)
+	}
+	if row, _, err := srv.GetByRowKey(ctx, "users", "alice", 0); err != nil || row["name"] != "Alicia" {
+		t.Errorf("users/alice name after a second import = %q (%v), want Alicia", row["name"], err)
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+// handleListKeys lists a table's keys starting with a prefix, rolling up the
+// ones holding the delimiter past it into common prefixes, S3 style.  limit
+// bounds keys and common prefixes together and the cursor resumes the
+// listing like a scan's.
+func (server *httpServer) handleListKeys(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Table       string `json:"table"`
+		Prefix      string `json:"prefix"`
+		Delimiter   string `json:"delimiter"`
+		Limit       int    `json:"limit"`
+		Cursor      string `json:"cursor"`
+		Consistency string `json:"consistency"`
+	}{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Table == "" || !validConsistency(req.Consistency) || isVirtualTable(req.Table) {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !server.checkTable(w, r, ActionRead, req.Table) {
+		return
+	}
+	if req.Limit <= 0 {
+		req.Limit = defaultScanLimit
+	}
+	if req.Limit > maxScanLimit {
+		req.Limit = maxScanLimit
+	}
+
+	key, err := server.node.cursorKey(r.Context())
+	if err != nil {
+		server.logger.Warn("Cursor key unavailable", zap.Error(err))
+		statusUnavailable(w)
+		return
+	}
+	query := multiraft.ListKeysQuery{Table: req.Table, Prefix: req.Prefix, Delimiter: req.Delimiter, Limit: req.Limit}
+	if req.Cursor != "" {
+		cursor, err := parseCursor(key, req.Cursor)
+		if err != nil || cursor.Table != req.Table {
+			server.logger.Warn("Rejecting list cursor", zap.String("table", req.Table), zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		query.After = cursor.After
+	}
+
+	listing, meta, err := server.node.ListKeys(r.Context(), query, req.Consistency)
+	if err != nil {
+		server.logger.Error("Failed to list keys", zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	response := struct {
+		*multiraft.KeyListing
+		Cursor string     `json:"cursor,omitempty"`
+		Meta   *queryMeta `json:"meta"`
+	}{
+		KeyListing: listing,
+		Meta:       meta,
+	}
+	if listing.More {
+		if response.Cursor, err = signCursor(key, scanCursor{Table: req.Table, After: listing.Last()}); err != nil {
+			server.logger.Error("Failed to sign list cursor", zap.Error(err))
+			statusInternalError(w)
+			return
+		}
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
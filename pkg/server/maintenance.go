@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+
+	"go.uber.org/zap"
+)
+
+// maintenanceTag is gossiped while a node is in maintenance mode, clients
+// and routing hints steer around such nodes.
+const maintenanceTag = "maintenance"
+
+var (
+	ErrMaintenance = errors.New("node is in maintenance mode, send writes to another node")
+)
+
+// checkWritable returns an error when this node must not accept client writes.
+func (n *server) checkWritable() error {
+	if n.maintenance.Load() {
+		return ErrMaintenance
+	}
+	if n.diskLow.Load() {
+		return ErrDiskFull
+	}
+	if n.config.Standby && !n.standbyPromoted() {
+		return ErrStandby
+	}
+	until, err := n.writeFrozenUntil()
+	if err != nil {
+		return err
+	}
+	if !until.IsZero() {
+		return fmt.Errorf("%w until %s", multiraft.ErrWritesFrozen, until.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// SetMaintenance puts the node in (or takes it out of) maintenance mode.  In
+// maintenance mode the node rejects client writes and is removed from client
+// routing, but keeps replicating.  When transferLeadership is set and this
+// node leads the shard, leadership is handed to another live replica.
+func (n *server) SetMaintenance(ctx context.Context, enabled, transferLeadership bool) error {
+	n.maintenance.Store(enabled)
+	tag := "0"
+	if enabled {
+		tag = "1"
+	}
+	if err := n.serfAgent.SetTags(map[string]string{maintenanceTag: tag}); err != nil {
+		return fmt.Errorf("gossiping maintenance tag: %w", err)
+	}
+	n.logger.Info("maintenance mode changed", zap.Bool("enabled", enabled))
+	n.recordEvent(ctx, eventMaintenance, n.config.ID(), tag)
+
+	if !enabled || !transferLeadership {
+		return nil
+	}
+	agent := n.raftAgents[shardID1]
+	if isLeader, err := agent.IsLeader(); err != nil || !isLeader {
+		return err
+	}
+	target, err := n.leadershipTransferTarget(ctx)
+	if err != nil {
+		return err
+	}
+	n.logger.Info("transferring leadership for maintenance", zap.Uint64("target", target))
+	return agent.TransferLeadership(target)
+}
+
+// leadershipTransferTarget picks a live replica, not in maintenance, to hand
+// leadership to.
+func (n *server) leadershipTransferTarget(ctx context.Context) (uint64, error) {
+	members, err := n.raftAgents[shardID1].Members(ctx)
+	if err != nil {
+		return 0, err
+	}
+	nonVoters, err := n.raftAgents[shardID1].NonVoters(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for replicaID, raftAddr := range members {
+		if _, ok := nonVoters[replicaID]; ok || replicaID == n.replicaID.Load() {
+			continue
+		}
+		node, ok := n.metadata.FindByRaftAddr(raftAddr)
+		if ok && node.State() == nodeAlive && !node.InMaintenance() {
+			return replicaID, nil
+		}
+	}
+	return 0, fmt.Errorf("no replica available to take over leadership")
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// transferAgent is a shard of the given members and non voters.
+type transferAgent struct {
+	raftAgent
+	members, nonVoters map[uint64]string
+}
+
+func (a *transferAgent) Members(ctx context.Context) (map[uint64]string, error) {
+	return a.members, nil
+}
+
+func (a *transferAgent) NonVoters(ctx context.Context) (map[uint64]string, error) {
+	return a.nonVoters, nil
+}
+
+func TestLeadershipTransferTarget(t *testing.T) {
+	tests := []struct {
+		name      string
+		nodes     []*nodedata // node-N is replica N at nN:7000
+		nonVoters []uint64
+		want      uint64 // 0 for none
+	}{
+		{"live voter", []*nodedata{{id: "node-2", state: nodeAlive}}, nil, 2},
+		{"failed voter skipped", []*nodedata{{id: "node-2", state: nodeFailed}, {id: "node-3", state: nodeAlive}}, nil, 3},
+		{"voter in maintenance skipped", []*nodedata{{id: "node-2", state: nodeAlive, maintenance: true}, {id: "node-3", state: nodeAlive}}, nil, 3},
+		{"non voter skipped", []*nodedata{{id: "node-2", state: nodeAlive}, {id: "node-3", state: nodeAlive}}, []uint64{2}, 3},
+		{"only itself", nil, nil, 0},
+		{"nothing available", []*nodedata{{id: "node-2", state: nodeLeft}, {id: "node-3", state: nodeAlive, maintenance: true}}, []uint64{4}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := &transferAgent{members: map[uint64]string{1: "n1:7000"}, nonVoters: map[uint64]string{}}
+			n := &server{metadata: NewMetadata(), raftAgents: map[uint64]raftAgent{shardID1: agent}, logger: zap.NewNop()}
+			n.replicaID.Store(1)
+			n.metadata.Restore(&nodedata{id: "node-1", raftAddr: "n1:7000", state: nodeAlive})
+			for _, node := range tt.nodes {
+				node.raftAddr = "n" + strings.TrimPrefix(node.id, "node-") + ":7000"
+				replicaID, _ := parseNodeID(node.id)
+				agent.members[replicaID] = node.raftAddr
+				n.metadata.Restore(node)
+			}
+			for _, id := range tt.nonVoters {
+				agent.nonVoters[id] = ""
+			}
+			got, err := n.leadershipTransferTarget(context.Background())
+			if tt.want == 0 {
+				if err == nil {
+					t.Errorf("leadershipTransferTarget() = %d, want no replica available", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("leadershipTransferTarget() = %d, %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	_, addr := startTestNode(t, nil)
+	post := func(path, body string) int {
+		t.Helper()
+		resp, err := http.Post("http://"+addr+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	write := `{"table":"t1", "key":"k1", "column":"c", "value":"v"}`
+	read := `{"table":"t1", "key":"k1"}`
+
+	tests := []struct {
+		name        string
+		maintenance string // the /admin/_maintenance request, "" for none
+		want        int    // of the request itself
+		maintained  bool
+		write, read int
+	}{
+		{"before", "", 0, false, http.StatusOK, http.StatusOK},
+		{"enabled", `{"enabled":true}`, http.StatusOK, true, http.StatusServiceUnavailable, http.StatusOK},
+		// a single node has no one to hand leadership to, it stays in maintenance.
+		{"no transfer target", `{"enabled":true, "transfer_leadership":true}`, http.StatusInternalServerError, true, http.StatusServiceUnavailable, http.StatusOK},
+		{"disabled", `{"enabled":false, "transfer_leadership":true}`, http.StatusOK, false, http.StatusOK, http.StatusOK},
+		{"bad request", `{"enabled":`, http.StatusBadRequest, false, http.StatusOK, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if tt.maintenance != "" {
+			if got := post("/admin/_maintenance", tt.maintenance); got != tt.want {
+				t.Errorf("%s: _maintenance = %d, want %d", tt.name, got, tt.want)
+			}
+		}
+		if got := post("/key/_update", write); got != tt.write {
+			t.Errorf("%s: write = %d, want %d", tt.name, got, tt.write)
+		}
+		if got := post("/key/_fetch", read); got != tt.read {
+			t.Errorf("%s: read = %d, want %d", tt.name, got, tt.read)
+		}
+		resp, err := http.Get("http://" + addr + "/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status nodeStatus
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if err != nil || status.Maintenance != tt.maintained {
+			t.Errorf("%s: /status maintenance = %v (%v), want %v", tt.name, status.Maintenance, err, tt.maintained)
+		}
+	}
+}
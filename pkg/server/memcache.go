@@ -0,0 +1,288 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"github.com/epsniff/expodb/pkg/server/state-machines/simplestore"
+	"github.com/epsniff/expodb/pkg/version"
+	"go.uber.org/zap"
+)
+
+const (
+	// memcache items are rows of the configured table keyed by the item's
+	// key, holding its data, client flags and expiry (unix seconds).
+	memcacheValueColumn   = "value"
+	memcacheFlagsColumn   = "flags"
+	memcacheExpiresColumn = "expires"
+
+	memcacheMaxKeyLen   = 250
+	memcacheMaxItemSize = 1 << 20
+	// memcacheRelativeExpiry is the largest exptime taken as seconds from
+	// now, larger ones are unix times, like memcached does.
+	memcacheRelativeExpiry = 30 * 24 * time.Hour
+)
+
+var errMemcacheClient = errors.New("CLIENT_ERROR")
+
+// memcacheServer speaks the memcached text protocol: get, gets, set, cas,
+// delete, version and quit.  Expired items are misses, they stay stored until
+// overwritten or deleted.  The cas unique of an item is its row version.
+type memcacheServer struct {
+	address net.Addr
+	node    *server
+	logger  *zap.Logger
+}
+
+// Serve serves memcached connections accepted on ln until it is closed.
+func (server *memcacheServer) Serve(ln net.Listener) {
+	server.logger.Info("Starting memcache server", zap.String("address", server.address.String()))
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			server.logger.Error("Error accepting memcache connection", zap.Error(err))
+			continue
+		}
+		go server.serveConn(conn)
+	}
+}
+
+func (server *memcacheServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	for {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), respCommandTimeout)
+		err = server.handleCommand(ctx, r, w, fields)
+		cancel()
+		switch {
+		case err == nil:
+		case errors.Is(err, errMemcacheClient):
+			fmt.Fprintf(w, "%s\r\n", err)
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+			return
+		default:
+			server.logger.Error("Failed memcache command", zap.String("command", fields[0]), zap.Error(err))
+			fmt.Fprintf(w, "SERVER_ERROR %s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error()))
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (server *memcacheServer) handleCommand(ctx context.Context, r *bufio.Reader, w *bufio.Writer, fields []string) error {
+	cmd, args := fields[0], fields[1:]
+	switch cmd {
+	case "get", "gets":
+		if len(args) == 0 {
+			w.WriteString("ERROR\r\n")
+			return nil
+		}
+		return server.get(ctx, w, args, cmd == "gets")
+	case "set", "cas":
+		return server.set(ctx, r, w, cmd, args)
+	case "delete":
+		return server.delete(ctx, w, args)
+	case "version":
+		fmt.Fprintf(w, "VERSION %s\r\n", version.ServerVersion)
+		return nil
+	}
+	w.WriteString("ERROR\r\n")
+	return nil
+}
+
+func (server *memcacheServer) get(ctx context.Context, w *bufio.Writer, keys []string, withCAS bool) error {
+	for _, key := range keys {
+		if err := checkMemcacheKey(key); err != nil {
+			return err
+		}
+		row, _, err := server.node.GetRow(ctx, server.node.config.MemcacheTable, key, 0, nil)
+		if errors.Is(err, simplestore.ErrKeyNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		val, ok := row.Columns[memcacheValueColumn]
+		if !ok || memcacheExpired(row.Columns[memcacheExpiresColumn]) {
+			continue
+		}
+		flags := row.Columns[memcacheFlagsColumn]
+		if flags == "" {
+			flags = "0"
+		}
+		if withCAS {
+			fmt.Fprintf(w, "VALUE %s %s %d %d\r\n%s\r\n", key, flags, len(val), row.Version, val)
+		} else {
+			fmt.Fprintf(w, "VALUE %s %s %d\r\n%s\r\n", key, flags, len(val), val)
+		}
+	}
+	w.WriteString("END\r\n")
+	return nil
+}
+
+// set handles "set <key> <flags> <exptime> <bytes> [noreply]" and
+// "cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]".
+func (server *memcacheServer) set(ctx context.Context, r *bufio.Reader, w *bufio.Writer, cmd string, args []string) error {
+	want := 4
+	if cmd == "cas" {
+		want = 5
+	}
+	noreply := len(args) == want+1 && args[want] == "noreply"
+	if len(args) != want && !noreply {
+		return fmt.Errorf("%w bad command line format", errMemcacheClient)
+	}
+	key := args[0]
+	flags, err1 := strconv.ParseUint(args[1], 10, 32)
+	exptime, err2 := strconv.ParseInt(args[2], 10, 64)
+	size, err3 := strconv.Atoi(args[3])
+	if err1 != nil || err2 != nil || err3 != nil || size < 0 {
+		return fmt.Errorf("%w bad command line format", errMemcacheClient)
+	}
+	var ifMatch *uint64
+	if cmd == "cas" {
+		unique, err := strconv.ParseUint(args[4], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w bad command line format", errMemcacheClient)
+		}
+		ifMatch = &unique
+	}
+
+	// the data block is read even when the item is rejected, so the
+	// connection stays in sync.
+	if size > memcacheMaxItemSize {
+		if _, err := io.CopyN(io.Discard, r, int64(size)+2); err != nil {
+			return err
+		}
+		return fmt.Errorf("object too large for cache")
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if string(data[size:]) != "\r\n" {
+		return fmt.Errorf("%w bad data chunk", errMemcacheClient)
+	}
+	if err := checkMemcacheKey(key); err != nil {
+		return err
+	}
+	if err := server.node.checkWritable(); err != nil {
+		return err
+	}
+
+	cols := map[string]string{
+		memcacheValueColumn: string(data[:size]),
+		memcacheFlagsColumn: strconv.FormatUint(flags, 10),
+	}
+	if exptime != 0 {
+		cols[memcacheExpiresColumn] = strconv.FormatInt(memcacheExpiry(exptime, time.Now()), 10)
+	}
+	reply := "STORED"
+	if ifMatch != nil {
+		// a cas on a missing row is NOT_FOUND rather than a mismatch against
+		// the version 0 of never written rows.
+		if _, _, err := server.node.GetRow(ctx, server.node.config.MemcacheTable, key, 0, []string{memcacheValueColumn}); errors.Is(err, simplestore.ErrKeyNotFound) {
+			reply, ifMatch = "NOT_FOUND", nil
+		} else if err != nil {
+			return err
+		}
+	}
+	if reply == "STORED" {
+		_, err := server.node.SetRow(ctx, server.node.config.MemcacheTable, key, cols, true, ifMatch)
+		if errors.Is(err, multiraft.ErrVersionMismatch) {
+			reply = "EXISTS"
+		} else if err != nil {
+			return err
+		}
+	}
+	if !noreply {
+		fmt.Fprintf(w, "%s\r\n", reply)
+	}
+	return nil
+}
+
+// delete handles "delete <key> [noreply]".
+func (server *memcacheServer) delete(ctx context.Context, w *bufio.Writer, args []string) error {
+	noreply := len(args) == 2 && args[1] == "noreply"
+	if len(args) != 1 && !noreply {
+		return fmt.Errorf("%w bad command line format.  Usage: delete <key> [noreply]", errMemcacheClient)
+	}
+	key := args[0]
+	if err := checkMemcacheKey(key); err != nil {
+		return err
+	}
+	if err := server.node.checkWritable(); err != nil {
+		return err
+	}
+	reply := "DELETED"
+	row, _, err := server.node.GetRow(ctx, server.node.config.MemcacheTable, key, 0, []string{memcacheExpiresColumn})
+	if errors.Is(err, simplestore.ErrKeyNotFound) {
+		reply = "NOT_FOUND"
+	} else if err != nil {
+		return err
+	} else {
+		if memcacheExpired(row.Columns[memcacheExpiresColumn]) {
+			reply = "NOT_FOUND"
+		}
+		if _, err := server.node.DeleteKey(ctx, server.node.config.MemcacheTable, key, ""); err != nil {
+			return err
+		}
+	}
+	if !noreply {
+		fmt.Fprintf(w, "%s\r\n", reply)
+	}
+	return nil
+}
+
+func checkMemcacheKey(key string) error {
+	if len(key) == 0 || len(key) > memcacheMaxKeyLen {
+		return fmt.Errorf("%w key must be 1 to %d bytes", errMemcacheClient, memcacheMaxKeyLen)
+	}
+	for _, c := range []byte(key) {
+		if c <= ' ' || c == 0x7f {
+			return fmt.Errorf("%w key contains control characters or spaces", errMemcacheClient)
+		}
+	}
+	return nil
+}
+
+// memcacheExpiry turns an exptime into a unix time: up to 30 days it counts
+// from now, negative ones have already expired.
+func memcacheExpiry(exptime int64, now time.Time) int64 {
+	switch {
+	case exptime < 0:
+		return now.Unix() - 1
+	case time.Duration(exptime)*time.Second <= memcacheRelativeExpiry:
+		return now.Unix() + exptime
+	}
+	return exptime
+}
+
+func memcacheExpired(expires string) bool {
+	if expires == "" {
+		return false
+	}
+	at, err := strconv.ParseInt(expires, 10, 64)
+	return err == nil && time.Now().Unix() >= at
+}
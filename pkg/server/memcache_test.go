@@ -0,0 +1,27 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemcacheExpiry(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		exptime int64
+		want    int64
+	}{
+		{60, now.Unix() + 60},                     // relative
+		{30 * 24 * 3600, now.Unix() + 30*24*3600}, // still relative at 30 days
+		{1800000000, 1800000000},                  // absolute unix time
+		{-1, now.Unix() - 1},                      // already expired
+	}
+	for _, tt := range tests {
+		if got := memcacheExpiry(tt.exptime, now); got != tt.want {
+			t.Errorf("memcacheExpiry(%d) = %d, want %d", tt.exptime, got, tt.want)
+		}
+	}
+	if memcacheExpired("") || !memcacheExpired("1") {
+		t.Errorf("memcacheExpired: items without expiry never expire, past expiries do")
+	}
+}
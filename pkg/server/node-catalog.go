@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+)
+
+const (
+	// nodesTable is the system table the node catalog is persisted to, one
+	// row per node ID.
+	nodesTable = "_nodes"
+	// decommissionUserEvent tells every node one was decommissioned, the
+	// payload is its ID.
+	decommissionUserEvent = "expodb-decommission"
+)
+
+// persistNode writes a node's catalog entry through raft.
+func (n *server) persistNode(ctx context.Context, node *nodedata) error {
+	cols := map[string]string{
+		"raft_addr": node.RaftAddr(),
+		"http_addr": node.HttpAddr(),
+		"role":      node.Role(),
+		"zone":      node.Zone(),
+		"state":     string(node.State()),
+	}
+	for col, val := range cols {
+		if _, err := n.SetKeyVal(ctx, nodesTable, node.ID(), col, val); err != nil {
+			return fmt.Errorf("persisting node %s: %w", node.ID(), err)
+		}
+	}
+	return nil
+}
+
+// persistNodeIfLeader persists the node's catalog entry when this node is the
+// leader.  Only the leader writes the catalog so replicas don't race.
+func (n *server) persistNodeIfLeader(node *nodedata) {
+	n.raftAgentsMu.Lock()
+	agent, ok := n.raftAgents[shardID1]
+	n.raftAgentsMu.Unlock()
+	if !ok {
+		return
+	}
+	if isLeader, err := agent.IsLeader(); err != nil || !isLeader {
+		return
+	}
+	go func() {
+		n.memberWrites <- struct{}{}
+		defer func() { <-n.memberWrites }()
+		if err := n.persistNode(context.Background(), node); err != nil {
+			n.logger.Warn("failed to persist node catalog entry", zap.String("id", node.ID()), zap.Error(err))
+		}
+	}()
+}
+
+// syncNodeCatalog is run when we take over leadership: it merges the persisted
+// catalog into memory (restoring nodes we haven't heard from via gossip, and
+// decommissions), then writes back everything we learnt while not leader.
+func (n *server) syncNodeCatalog(ctx context.Context) error {
+	rows, err := n.ScanTable(ctx, nodesTable)
+	if err != nil {
+		return fmt.Errorf("loading node catalog: %w", err)
+	}
+	for id, row := range rows {
+		n.metadata.Restore(&nodedata{
+			id:       id,
+			raftAddr: row["raft_addr"],
+			httpAddr: row["http_addr"],
+			role:     row["role"],
+			zone:     row["zone"],
+			state:    nodeState(row["state"]),
+		})
+	}
+	for _, node := range n.metadata.Nodes() {
+		if err := n.persistNode(ctx, node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decommission marks a node as permanently removed from the cluster.  The
+// catalog entry is written through raft, then announced with
+// decommissionUserEvent so every node, the leader that adds voters first,
+// marks it in memory too.
+func (n *server) Decommission(ctx context.Context, id string) error {
+	node, ok := n.metadata.SetState(id, nodeDecommissioned)
+	if !ok {
+		return fmt.Errorf("unknown node %q", id)
+	}
+	if err := n.persistNode(ctx, node); err != nil {
+		return err
+	}
+	n.serfAgent.UserEvent(decommissionUserEvent, []byte(id), false)
+	n.recordEvent(ctx, eventDecommissioned, id, "")
+	return nil
+}
+
+// handleDecommissionEvent is run for decommissionUserEvent, the payload is the
+// node ID.
+func (n *server) handleDecommissionEvent(e serf.UserEvent) {
+	id := string(e.Payload)
+	if _, ok := n.metadata.SetState(id, nodeDecommissioned); ok {
+		n.logger.Info("Node decommissioned", zap.String("id", id))
+	}
+}
+
+// persistedDecommission reports whether the catalog persisted in nodesTable
+// has a node decommissioned, as of a linearizable read.  The leader checks
+// it before adding a voter, a decommission it missed the announcement of
+// still sticks.
+func (n *server) persistedDecommission(ctx context.Context, id string) (bool, error) {
+	row, _, err := n.GetRow(ctx, nodesTable, id, 0, []string{"state"})
+	if err != nil {
+		return false, fmt.Errorf("loading catalog entry of node %s: %w", id, err)
+	}
+	return nodeState(row.Columns["state"]) == nodeDecommissioned, nil
+}
@@ -0,0 +1,353 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// jwksRefreshInterval is how often the issuer's keys are refetched, a
+	// token signed with an unknown key triggers a refetch sooner, at most
+	// every jwksMinRefresh.
+	jwksRefreshInterval = time.Hour
+	jwksMinRefresh      = time.Minute
+	jwksFetchTimeout    = 10 * time.Second
+	// jwtLeeway absorbs clock skew between the issuer and the node.
+	jwtLeeway = time.Minute
+)
+
+var errBadJWT = errors.New("invalid JWT")
+
+// oidcAuthenticator accepts JWTs signed by an OIDC issuer's keys, found
+// through its discovery document.  The principal is named by the sub claim
+// and its policies come from the values of policyClaim (groups, roles, ...)
+// through the auth policy's claim mapping.
+type oidcAuthenticator struct {
+	issuer        string
+	audience      string
+	policyClaim   string
+	claimPolicies map[string][]string
+	client        *http.Client
+
+	// fetches shares a refetch between the requests that need it, none of
+	// them holds mu while it runs.
+	fetches singleflight.Group
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey // by key ID
+	fetched time.Time
+}
+
+func (a *oidcAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || strings.Count(token, ".") != 2 {
+		return nil, ErrUnauthenticated
+	}
+	claims, err := a.verify(r.Context(), token, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+	p := &Principal{Attributes: map[string]string{}}
+	p.Name, _ = claims["sub"].(string)
+	for name, v := range claims {
+		if s, ok := v.(string); ok {
+			p.Attributes[name] = s
+		}
+	}
+	var values []interface{}
+	switch v := claims[a.policyClaim].(type) {
+	case string:
+		values = []interface{}{v}
+	case []interface{}:
+		values = v
+	}
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			p.Policies = append(p.Policies, a.claimPolicies[s]...)
+		}
+	}
+	return p, nil
+}
+
+// verify checks a JWT's signature, issuer, audience and validity period and
+// returns its claims.
+func (a *oidcAuthenticator) verify(ctx context.Context, token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errBadJWT
+	}
+	key, err := a.key(ctx, header.Kid, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != a.issuer {
+		return nil, fmt.Errorf("%w: issuer %q", errBadJWT, iss)
+	}
+	audOK := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audOK = aud == a.audience
+	case []interface{}:
+		for _, v := range aud {
+			audOK = audOK || v == a.audience
+		}
+	}
+	if !audOK {
+		return nil, fmt.Errorf("%w: audience", errBadJWT)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.Add(-jwtLeeway).After(time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("%w: expired", errBadJWT)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("%w: not valid yet", errBadJWT)
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errBadJWT
+	}
+	if err := json.Unmarshal(buf, v); err != nil {
+		return errBadJWT
+	}
+	return nil
+}
+
+// verifyJWTSignature supports the RSA and ECDSA algorithms OIDC issuers
+// sign with, never "none" or the HMAC ones.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	var h hash.Hash
+	var ch crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		h, ch = sha256.New(), crypto.SHA256
+	case "RS384", "ES384":
+		h, ch = sha512.New384(), crypto.SHA384
+	case "RS512", "ES512":
+		h, ch = sha512.New(), crypto.SHA512
+	default:
+		return fmt.Errorf("%w: unsupported algorithm %q", errBadJWT, alg)
+	}
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'R' || rsa.VerifyPKCS1v15(key, ch, digest, sig) != nil {
+			return fmt.Errorf("%w: bad signature", errBadJWT)
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[0] != 'E' || len(sig) != 2*size {
+			return fmt.Errorf("%w: bad signature", errBadJWT)
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return fmt.Errorf("%w: bad signature", errBadJWT)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported key type %T", errBadJWT, key)
+	}
+	return nil
+}
+
+// key returns the issuer's signing key kid, refetching the keys when they
+// are stale or don't have it.
+func (a *oidcAuthenticator) key(ctx context.Context, kid string, now time.Time) (crypto.PublicKey, error) {
+	a.mu.Lock()
+	key, ok := a.keys[kid]
+	stale := now.Sub(a.fetched) > jwksRefreshInterval
+	recent := now.Sub(a.fetched) < jwksMinRefresh
+	a.mu.Unlock()
+	if ok && !stale {
+		return key, nil
+	}
+	if !stale && recent {
+		return nil, fmt.Errorf("%w: unknown key %q", errBadJWT, kid)
+	}
+	// the fetch is shared, it isn't bound to the request that started it.
+	fetched := a.fetches.DoChan("jwks", func() (interface{}, error) {
+		keys, err := a.fetchKeys(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		a.mu.Lock()
+		a.keys, a.fetched = keys, now
+		a.mu.Unlock()
+		return keys, nil
+	})
+	var res singleflight.Result
+	select {
+	case res = <-fetched:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if res.Err != nil {
+		if ok {
+			return key, nil // keep using the keys we have until the issuer is back
+		}
+		return nil, fmt.Errorf("fetching issuer keys: %w", res.Err)
+	}
+	if key, ok = res.Val.(map[string]crypto.PublicKey)[kid]; !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", errBadJWT, kid)
+	}
+	return key, nil
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (a *oidcAuthenticator) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, jwksFetchTimeout)
+	defer cancel()
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := a.getJSON(ctx, strings.TrimSuffix(a.issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	// a discovery document for another issuer would point at its keys.
+	if discovery.Issuer != a.issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q, not %q", discovery.Issuer, a.issuer)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := a.getJSON(ctx, discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// keys we can't use are skipped, the issuer may publish others.
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (a *oidcAuthenticator) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	field := func(s string) (*big.Int, error) {
+		buf, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(buf) == 0 {
+			return nil, fmt.Errorf("bad key %s", k.Kid)
+		}
+		return new(big.Int).SetBytes(buf), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := field(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := field(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("bad key %s", k.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := field(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := field(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("bad key %s", k.Kid)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// firstOf authenticates with the first authenticator accepting the request.
+type firstOf []Authenticator
+
+func (authns firstOf) Authenticate(r *http.Request) (*Principal, error) {
+	err := ErrUnauthenticated
+	for _, authn := range authns {
+		p, aerr := authn.Authenticate(r)
+		if aerr == nil {
+			return p, nil
+		}
+		if aerr != ErrUnauthenticated {
+			err = aerr // the more specific reason
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOIDCAuthenticator(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	var issuer *httptest.Server
+	var fetches atomic.Int32
+	issuer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": issuer.URL, "jwks_uri": issuer.URL + "/keys"})
+		case "/keys":
+			fetches.Add(1)
+			time.Sleep(10 * time.Millisecond)
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jwk{{
+				Kid: "k1", Kty: "EC", Crv: "P-256", X: b64(key.X.FillBytes(make([]byte, 32))), Y: b64(key.Y.FillBytes(make([]byte, 32))),
+			}}})
+		}
+	}))
+	defer issuer.Close()
+
+	sign := func(claims map[string]interface{}) string {
+		header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": "k1"})
+		payload, _ := json.Marshal(claims)
+		signed := b64(header) + "." + b64(payload)
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed + "." + b64(append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...))
+	}
+	a := &oidcAuthenticator{
+		issuer:        issuer.URL,
+		audience:      "expodb",
+		policyClaim:   "groups",
+		claimPolicies: map[string][]string{"eng": {"metrics"}},
+		client:        issuer.Client(),
+	}
+	authenticate := func(token string) (*Principal, error) {
+		r, _ := http.NewRequest(http.MethodPost, "/key/_fetch", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return a.Authenticate(r)
+	}
+
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	// requests arriving together share one fetch of the keys.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := authenticate(sign(map[string]interface{}{"iss": issuer.URL, "aud": "expodb", "exp": exp})); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("keys fetched %d times, want 1", n)
+	}
+	p, err := authenticate(sign(map[string]interface{}{"iss": issuer.URL, "aud": []string{"other", "expodb"}, "exp": exp, "sub": "eric", "groups": []string{"eng", "sales"}, "tenant": "acme"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Principal{Name: "eric", Policies: []string{"metrics"}, Attributes: map[string]string{"iss": issuer.URL, "sub": "eric", "tenant": "acme"}}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("Authenticate() = %+v, want %+v", p, want)
+	}
+
+	for name, claims := range map[string]map[string]interface{}{
+		"wrong audience": {"iss": issuer.URL, "aud": "other", "exp": exp},
+		"wrong issuer":   {"iss": "https://evil", "aud": "expodb", "exp": exp},
+		"expired":        {"iss": issuer.URL, "aud": "expodb", "exp": float64(time.Now().Add(-time.Hour).Unix())},
+	} {
+		if _, err := authenticate(sign(claims)); !errors.Is(err, ErrUnauthenticated) {
+			t.Errorf("%s: Authenticate() = %v, want ErrUnauthenticated", name, err)
+		}
+	}
+	token := sign(map[string]interface{}{"iss": issuer.URL, "aud": "expodb", "exp": exp})
+	if _, err := authenticate(token[:len(token)-4] + "AAAA"); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("Authenticate() of a tampered token = %v", err)
+	}
+}
+
+func TestOIDCAuthenticator_DiscoveryIssuer(t *testing.T) {
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": "https://evil", "jwks_uri": "https://evil/keys"})
+	}))
+	defer issuer.Close()
+	a := &oidcAuthenticator{issuer: issuer.URL, client: issuer.Client()}
+	if _, err := a.fetchKeys(context.Background()); err == nil || !strings.Contains(err.Error(), "https://evil") {
+		t.Errorf("fetchKeys() of another issuer's discovery document error = %v", err)
+	}
+}
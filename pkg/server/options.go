@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net"
+
+	"github.com/epsniff/expodb/pkg/loggingutils"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	machines "github.com/epsniff/expodb/pkg/server/state-machines"
+	"go.uber.org/zap"
+)
+
+// Server is a node embedded in another Go program, see New.  Its data methods
+// (SetKeyVal, GetRow, ...) are the ones the HTTP API is served with.
+type Server struct {
+	*server
+}
+
+// Option customizes a Server created by New.
+type Option func(*options)
+
+type options struct {
+	logger   *zap.Logger
+	listener net.Listener
+	fsms     []machines.Registration
+	triggers map[string]multiraft.TriggerFunc
+	authn    Authenticator
+	authz    Authorizer
+	levels   *loggingutils.Levels
+}
+
+// WithLogger logs to logger instead of discarding the logs.
+func WithLogger(logger *zap.Logger) Option {
+	return func(o *options) { o.logger = logger }
+}
+
+// WithListener serves the HTTP API (and raft with --single-port) on l rather
+// than on a listener bound to the configured HTTP address.
+func WithListener(l net.Listener) Option {
+	return func(o *options) { o.listener = l }
+}
+
+// WithFSM hosts a named state machine next to the KV store, its entries are
+// proposed with ApplyFSM and read with ReadFSM.  Every node of the cluster
+// has to register it.
+func WithFSM(reg machines.Registration) Option {
+	return func(o *options) { o.fsms = append(o.fsms, reg) }
+}
+
+// WithTrigger registers a trigger under name, for /trigger/_create to attach
+// to tables, replacing a built in one of the same name.  It runs in the apply
+// path, see multiraft.TriggerFunc.  Every node of the cluster has to register
+// it.
+func WithTrigger(name string, fn multiraft.TriggerFunc) Option {
+	return func(o *options) {
+		if o.triggers == nil {
+			o.triggers = map[string]multiraft.TriggerFunc{}
+		}
+		o.triggers[name] = fn
+	}
+}
+
+// WithAuthenticator authenticates client requests with authn, overriding the
+// configured auth policy's.
+func WithAuthenticator(authn Authenticator) Option {
+	return func(o *options) { o.authn = authn }
+}
+
+// WithAuthorizer authorizes client requests with authz, overriding the
+// configured auth policy's.
+func WithAuthorizer(authz Authorizer) Option {
+	return func(o *options) { o.authz = authz }
+}
+
+// WithLogLevels lets /admin/_log_levels change levels, the ones the logger
+// given with WithLogger is filtered by.
+func WithLogLevels(levels *loggingutils.Levels) Option {
+	return func(o *options) { o.levels = levels }
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/config"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	machines "github.com/epsniff/expodb/pkg/server/state-machines"
+	"github.com/epsniff/expodb/pkg/server/state-machines/counters"
+)
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startTestNode starts a node bootstrapping a cluster of its own, with edit
+// applied to its config if not nil and opts, and waits until it takes writes.  The
+// working directory moves to a temp dir until the test ends, the replicas'
+// stores are relative to it.  It returns the node and its HTTP address.
+func startTestNode(t *testing.T, edit func(*config.Config), opts ...Option) (*Server, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	cfg := &config.Config{
+		NodeName:        "node-1",
+		SerfBindAddress: "127.0.0.1",
+		SerfBindPort:    freePort(t),
+		SerfDataDir:     dir + "/serf",
+		IsSerfSeed:      true,
+		HTTPBindAddress: "127.0.0.1",
+		RaftBindAddress: "127.0.0.1",
+		RaftBindPort:    freePort(t),
+		RaftDataDir:     dir + "/raft",
+		Bootstrap:       true,
+	}
+	if edit != nil {
+		edit(cfg)
+	}
+	srv, err := New(cfg, append([]Option{WithListener(ln)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := srv.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Stop(ctx)
+	})
+	for {
+		if _, err := srv.SetKeyVal(ctx, "ready", "k", "c", "v"); err == nil {
+			break
+		} else if ctx.Err() != nil {
+			t.Fatalf("writing: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return srv, ln.Addr().String()
+}
+
+func TestServer_StartStop(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	cfg := &config.Config{
+		NodeName:        "node-1",
+		SerfBindAddress: "127.0.0.1",
+		SerfBindPort:    freePort(t),
+		SerfDataDir:     dir + "/serf",
+		IsSerfSeed:      true,
+		HTTPBindAddress: "127.0.0.1",
+		RaftBindAddress: "127.0.0.1",
+		RaftBindPort:    freePort(t),
+		RaftDataDir:     dir + "/raft",
+	}
+	srv, err := New(cfg, WithListener(ln), WithAuthorizer(denyAll{}))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	resp, err := http.Post("http://"+ln.Addr().String()+"/admin/_freeze", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("admin request = %d, want %d from the authorizer option", resp.StatusCode, http.StatusForbidden)
+	}
+	if err := srv.Stop(ctx); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	// the data dirs are free for another node.
+	lock, err := openDataDir(cfg.RaftDataDir, cfg.ID())
+	if err != nil {
+		t.Fatalf("data dir still locked after Stop: %v", err)
+	}
+	lock.Close()
+}
+
+type denyAll struct{}
+
+func (denyAll) Authorize(*Principal, string, string) error { return ErrForbidden }
+
+// logFSM is a state machine keeping the payloads of its entries in order.
+type logFSM struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+type logEntry string
+
+func (e logEntry) Marshal() ([]byte, error) { return machines.EncodeEntry(200, []byte(e)), nil }
+
+func (l *logFSM) Apply(delta []byte) (interface{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, string(delta))
+	return len(l.entries), nil
+}
+
+func (l *logFSM) Lookup(query interface{}) (interface{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.entries, ","), nil
+}
+
+func (l *logFSM) Restore(data []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = nil
+	if len(data) != 0 {
+		l.entries = strings.Split(string(data), ",")
+	}
+	return nil
+}
+
+func (l *logFSM) Persist() ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return []byte(strings.Join(l.entries, ",")), nil
+}
+
+func TestWithFSM(t *testing.T) {
+	reg := machines.Registration{Key: 200, Name: "log", New: func() machines.StateMachine { return &logFSM{} }}
+	srv, _ := startTestNode(t, nil, WithFSM(reg))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// entries of every machine go through the same log, each to its own.
+	entries := []machines.RaftEntry{
+		logEntry("a"),
+		counters.IncrEvent{Name: "hits", Delta: 2},
+		multiraft.KVData{Table: "t1", Row: "k1", Column: "c", Val: "v"},
+		logEntry("b"),
+		counters.IncrEvent{Name: "hits", Delta: 3},
+	}
+	for _, entry := range entries {
+		if _, err := srv.ApplyFSM(ctx, entry); err != nil {
+			t.Fatalf("ApplyFSM(%T) error = %v", entry, err)
+		}
+	}
+	if got, err := srv.ReadFSM(ctx, "log", nil); err != nil || got != "a,b" {
+		t.Errorf("ReadFSM(log) = %v, %v, want a,b", got, err)
+	}
+	if got, err := srv.GetCounter(ctx, "hits"); err != nil || got != 5 {
+		t.Errorf("GetCounter(hits) = %d, %v, want 5", got, err)
+	}
+	if row, _, err := srv.GetByRowKey(ctx, "t1", "k1", 0); err != nil || row["c"] != "v" {
+		t.Errorf("GetByRowKey(t1, k1) = %v, %v, want c=v", row, err)
+	}
+	if _, err := srv.ReadFSM(ctx, "missing", nil); err == nil {
+		t.Error("ReadFSM() of an unregistered machine succeeded")
+	}
+}
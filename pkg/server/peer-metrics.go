@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lni/dragonboat/v4/raftio"
+)
+
+const (
+	// appliedSampleInterval is how often the local applied index is sampled
+	// to time the peers' lag.
+	appliedSampleInterval = 250 * time.Millisecond
+	// maxAppliedSamples bounds the samples kept, only changes of the index
+	// are kept so it covers longer than maxAppliedSamples intervals.  A peer
+	// lagging by more than the samples cover reports the oldest one's age.
+	maxAppliedSamples = 1200
+)
+
+// peerStats tracks what this node knows of its raft peers that isn't
+// gossiped: the snapshots it sent them, the connections that failed, and the
+// samples of its own applied index the peers' lag is timed against.  It is
+// the node host's system event listener.
+type peerStats struct {
+	mu sync.Mutex
+	// sent and aborted count the snapshots sent to replicas, by replica ID.
+	sent    map[uint64]uint64
+	aborted map[uint64]uint64
+	// installed counts the snapshots this node received from the leader.
+	installed uint64
+	// connFailures counts the failed raft connections, by target address.
+	connFailures map[string]uint64
+	samples      []appliedSample
+}
+
+type appliedSample struct {
+	index uint64
+	at    time.Time
+}
+
+// peerStatus is the view of a peer's replication in /status, only reported by
+// the shard's leader.  The lag is as of the peer's last gossiped applied
+// index, or as of now if the peer hasn't gossiped a new one in two gossip
+// intervals.
+type peerStatus struct {
+	ID           string `json:"id"`
+	ReplicaID    uint64 `json:"replica_id"`
+	RaftAddr     string `json:"raft_addr"`
+	AppliedIndex uint64 `json:"applied_index"`
+	// Voter is false for the non-voters, see autopilot.go.
+	Voter bool `json:"voter"`
+	// LagEntries is how many entries the leader had applied past the peer's.
+	LagEntries uint64 `json:"lag_entries"`
+	// LagMs is how long ago the leader applied the first entry the peer hadn't.
+	LagMs uint64 `json:"lag_ms"`
+	// RTTUs is estimated from the gossip network coordinates, 0 when unknown.
+	RTTUs              uint64 `json:"rtt_us"`
+	SnapshotsSent      uint64 `json:"snapshots_sent"`
+	SnapshotsAborted   uint64 `json:"snapshots_aborted"`
+	ConnectionFailures uint64 `json:"connection_failures"`
+}
+
+// sample records the local applied index if it moved.
+func (s *peerStats) sample(index uint64, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := len(s.samples); n > 0 && s.samples[n-1].index >= index {
+		return
+	}
+	if len(s.samples) == maxAppliedSamples {
+		s.samples = append(s.samples[:0], s.samples[1:]...)
+	}
+	s.samples = append(s.samples, appliedSample{index: index, at: at})
+}
+
+// lag returns how far the local applied index was past applied at time at,
+// in entries and in time.
+func (s *peerStats) lag(applied uint64, at time.Time) (uint64, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the local index at the time, the last sample taken by then.
+	i := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].at.After(at) })
+	if i == 0 || s.samples[i-1].index <= applied {
+		return 0, 0
+	}
+	entries := s.samples[i-1].index - applied
+	// when the local index first went past the peer's.
+	j := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].index > applied })
+	return entries, at.Sub(s.samples[j].at)
+}
+
+// runAppliedSampler samples the local applied index every
+// appliedSampleInterval, see peerStats.
+func (n *server) runAppliedSampler(ctx context.Context) {
+	ticker := time.NewTicker(appliedSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			agent, err := n.shardAgent(shardID1)
+			if err != nil {
+				continue
+			}
+			if index, err := agent.AppliedIndex(); err == nil {
+				n.peers.sample(index, now)
+			}
+		}
+	}
+}
+
+// peerStatuses returns the replication status of the shard's voters and
+// non-voters other than this node, nil unless this node leads the shard.
+func (n *server) peerStatuses(ctx context.Context) []peerStatus {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return nil
+	}
+	if leader, err := agent.IsLeader(); err != nil || !leader {
+		return nil
+	}
+	members, err := agent.Members(ctx)
+	if err != nil {
+		return nil
+	}
+	nonVoters, err := agent.NonVoters(ctx)
+	if err != nil {
+		return nil
+	}
+	now := time.Now()
+	var peers []peerStatus
+	for replicaID, raftAddr := range members {
+		if replicaID == n.replicaID.Load() {
+			continue
+		}
+		_, nonVoter := nonVoters[replicaID]
+		p := peerStatus{ReplicaID: replicaID, RaftAddr: raftAddr, Voter: !nonVoter}
+		if node, ok := n.metadata.FindByRaftAddr(raftAddr); ok {
+			p.ID, p.AppliedIndex = node.ID(), node.AppliedIndex()
+			at := node.AppliedAt()
+			if now.Sub(at) > 2*appliedIndexGossipInterval {
+				at = now
+			}
+			var lag time.Duration
+			p.LagEntries, lag = n.peers.lag(p.AppliedIndex, at)
+			p.LagMs = uint64(lag.Milliseconds())
+			p.RTTUs = uint64(n.peerRTT(p.ID).Microseconds())
+		}
+		n.peers.mu.Lock()
+		p.SnapshotsSent = n.peers.sent[replicaID]
+		p.SnapshotsAborted = n.peers.aborted[replicaID]
+		p.ConnectionFailures = n.peers.connFailures[raftAddr]
+		n.peers.mu.Unlock()
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ReplicaID < peers[j].ReplicaID })
+	return peers
+}
+
+// peerRTT estimates the round trip time to a node from the serf network
+// coordinates, 0 when either coordinate is unknown.
+func (n *server) peerRTT(id string) time.Duration {
+	s := n.serfAgent.Serf()
+	if s == nil {
+		return 0
+	}
+	local, err := s.GetCoordinate()
+	if err != nil {
+		return 0
+	}
+	other, ok := s.GetCachedCoordinate(id)
+	if !ok {
+		return 0
+	}
+	return local.DistanceTo(other)
+}
+
+// snapshotsInstalled returns the snapshots this node received.
+func (s *peerStats) snapshotsInstalled() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.installed
+}
+
+func (s *peerStats) count(m *map[uint64]uint64, replicaID uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if *m == nil {
+		*m = map[uint64]uint64{}
+	}
+	(*m)[replicaID]++
+}
+
+func (s *peerStats) SendSnapshotStarted(info raftio.SnapshotInfo) {
+	s.count(&s.sent, info.ReplicaID)
+}
+
+func (s *peerStats) SendSnapshotAborted(info raftio.SnapshotInfo) {
+	s.count(&s.aborted, info.ReplicaID)
+}
+
+func (s *peerStats) SnapshotReceived(info raftio.SnapshotInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.installed++
+}
+
+func (s *peerStats) ConnectionFailed(info raftio.ConnectionInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.connFailures == nil {
+		s.connFailures = map[string]uint64{}
+	}
+	s.connFailures[info.Address]++
+}
+
+func (s *peerStats) NodeHostShuttingDown()                            {}
+func (s *peerStats) NodeUnloaded(info raftio.NodeInfo)                {}
+func (s *peerStats) NodeDeleted(info raftio.NodeInfo)                 {}
+func (s *peerStats) NodeReady(info raftio.NodeInfo)                   {}
+func (s *peerStats) MembershipChanged(info raftio.NodeInfo)           {}
+func (s *peerStats) ConnectionEstablished(info raftio.ConnectionInfo) {}
+func (s *peerStats) SendSnapshotCompleted(info raftio.SnapshotInfo)   {}
+func (s *peerStats) SnapshotRecovered(info raftio.SnapshotInfo)       {}
+func (s *peerStats) SnapshotCreated(info raftio.SnapshotInfo)         {}
+func (s *peerStats) SnapshotCompacted(info raftio.SnapshotInfo)       {}
+func (s *peerStats) LogCompacted(info raftio.EntryInfo)               {}
+func (s *peerStats) LogDBCompacted(info raftio.EntryInfo)             {}
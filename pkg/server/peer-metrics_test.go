@@ -0,0 +1,69 @@
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPeerStatsLag(t *testing.T) {
+	var s peerStats
+	start := time.Unix(1000, 0)
+	for i, index := range []uint64{10, 10, 20, 30, 40} {
+		s.sample(index, start.Add(time.Duration(i)*time.Second))
+	}
+	tests := []struct {
+		applied     uint64
+		at          time.Time
+		wantEntries uint64
+		wantLag     time.Duration
+	}{
+		{applied: 40, at: start.Add(10 * time.Second)},
+		{applied: 25, at: start.Add(10 * time.Second), wantEntries: 15, wantLag: 7 * time.Second},
+		// as of when the peer reported 25, the leader was at 30.
+		{applied: 25, at: start.Add(3500 * time.Millisecond), wantEntries: 5, wantLag: 500 * time.Millisecond},
+		// older than every sample, timed from the oldest.
+		{applied: 5, at: start.Add(4 * time.Second), wantEntries: 35, wantLag: 4 * time.Second},
+		{applied: 5, at: start.Add(-time.Second)},
+	}
+	for _, tt := range tests {
+		entries, lag := s.lag(tt.applied, tt.at)
+		if entries != tt.wantEntries || lag != tt.wantLag {
+			t.Errorf("lag(%d, %v) = %d, %v, want %d, %v", tt.applied, tt.at.Sub(start), entries, lag, tt.wantEntries, tt.wantLag)
+		}
+	}
+}
+
+func TestStatsdPeerLines(t *testing.T) {
+	st := &nodeStatus{
+		ID:           "n1",
+		Peers:        []peerStatus{{ID: "n2", LagEntries: 7, LagMs: 120, RTTUs: 800, SnapshotsSent: 1}},
+		Transactions: &txnStatus{},
+	}
+	want := []string{
+		"raft.peer.lag_entries:7|g|#node:n1,peer:n2",
+		"raft.peer.lag_ms:120|g|#node:n1,peer:n2",
+		"raft.peer.rtt_us:800|g|#node:n1,peer:n2",
+		"raft.peer.snapshots_sent:1|g|#node:n1,peer:n2",
+		"raft.peer.snapshots_aborted:0|g|#node:n1,peer:n2",
+		"raft.peer.connection_failures:0|g|#node:n1,peer:n2",
+	}
+	if got := peerLines(statsdLines("", "|#node:n1", st, &txnStatus{}, 0, 0)); !reflect.DeepEqual(got, want) {
+		t.Errorf("dogstatsd peer lines = %q, want %q", got, want)
+	}
+	got := peerLines(statsdLines("", "", st, &txnStatus{}, 0, 0))
+	if len(got) != len(want) || got[0] != "raft.peer.n2.lag_entries:7|g" {
+		t.Errorf("statsd peer lines = %q", got)
+	}
+}
+
+func peerLines(lines []string) []string {
+	var peers []string
+	for _, l := range lines {
+		if strings.HasPrefix(l, "raft.peer.") {
+			peers = append(peers, l)
+		}
+	}
+	return peers
+}
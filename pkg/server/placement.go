@@ -0,0 +1,56 @@
+package server
+
+import "fmt"
+
+// votersPerShard is how many voters each shard is placed on.
+const votersPerShard = 3
+
+// shardVoters returns the members the shard's voters should be placed on:
+// the closest members on the consistent hashing ring, spread across as many
+// zones as possible.
+func (n *server) shardVoters(shardID uint64) ([]string, error) {
+	candidates, err := n.consistent.GetClosestNForPartition(int(shardID), len(n.consistent.GetMembers()))
+	if err != nil {
+		return nil, fmt.Errorf("getting closest members: %w", err)
+	}
+	ids := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		ids = append(ids, c.String())
+	}
+	zoneOf := func(id string) string {
+		if node, ok := n.metadata.FindByID(id); ok {
+			return node.Zone()
+		}
+		return ""
+	}
+	return spreadAcrossZones(ids, zoneOf, votersPerShard), nil
+}
+
+// spreadAcrossZones picks count of the candidates, in order of preference,
+// taking the most preferred candidate of each zone first and only then
+// doubling up on zones.  Nodes without a zone count as one zone.
+func spreadAcrossZones(candidates []string, zoneOf func(string) string, count int) []string {
+	picked := make([]string, 0, count)
+	taken := map[string]bool{}
+	usedZones := map[string]bool{}
+	for _, id := range candidates {
+		if len(picked) == count {
+			return picked
+		}
+		if zone := zoneOf(id); !usedZones[zone] {
+			usedZones[zone] = true
+			taken[id] = true
+			picked = append(picked, id)
+		}
+	}
+	for _, id := range candidates {
+		if len(picked) == count {
+			break
+		}
+		if !taken[id] {
+			taken[id] = true
+			picked = append(picked, id)
+		}
+	}
+	return picked
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSpreadAcrossZones(t *testing.T) {
+	zones := map[string]string{
+		"node-1": "a", "node-2": "a", "node-3": "a",
+		"node-4": "b", "node-5": "b",
+		"node-6": "c",
+		"node-7": "",
+	}
+	zoneOf := func(id string) string { return zones[id] }
+	tests := []struct {
+		name       string
+		candidates []string
+		count      int
+		want       []string
+	}{
+		{"one per zone", []string{"node-1", "node-2", "node-4", "node-6"}, 3, []string{"node-1", "node-4", "node-6"}},
+		{"doubles up when short of zones", []string{"node-1", "node-2", "node-3", "node-4"}, 3, []string{"node-1", "node-4", "node-2"}},
+		{"single zone keeps ring order", []string{"node-3", "node-1", "node-2"}, 3, []string{"node-3", "node-1", "node-2"}},
+		{"no zone is a zone", []string{"node-7", "node-1", "node-2"}, 2, []string{"node-7", "node-1"}},
+		{"fewer candidates than count", []string{"node-1", "node-4"}, 3, []string{"node-1", "node-4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := spreadAcrossZones(tt.candidates, zoneOf, tt.count); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("spreadAcrossZones() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
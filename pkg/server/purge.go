@@ -0,0 +1,237 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/errdefs"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"github.com/epsniff/expodb/pkg/server/state-machines/simplestore"
+	"go.uber.org/zap"
+)
+
+// purgesTable is the system table replicas confirm purges in, one row per
+// purge keyed by its ID, with a column per replica holding the index of the
+// snapshot it took past the purge.
+const purgesTable = "_purges"
+
+const (
+	// purgeCheckInterval is how often every replica looks for purges it
+	// hasn't confirmed yet.
+	purgeCheckInterval = 10 * time.Second
+	// purgeSnapshotTimeout bounds the snapshot taken to confirm purges.
+	purgeSnapshotTimeout = time.Minute
+)
+
+// Purge removes a row for good: unlike DeleteKey it leaves no tombstone, and
+// drops the row's index entries and its changes not yet delivered to sinks.
+// Every replica then confirms the row is gone from its disk, see runPurges,
+// PurgeStatus reports when all have.
+func (n *server) Purge(ctx context.Context, table, key string) (uint64, error) {
+	kve := multiraft.KVData{Op: multiraft.OpPurge, Table: table, Row: key}
+	return n.applyWrite(ctx, kve)
+}
+
+// runPurges confirms the purges applied by this node's replica every
+// purgeCheckInterval, it is run by every node but witnesses, which keep no
+// rows.
+func (n *server) runPurges(ctx context.Context) {
+	ticker := time.NewTicker(purgeCheckInterval)
+	defer ticker.Stop()
+	confirmed := map[string]bool{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := n.confirmPurges(ctx, confirmed); err != nil {
+			n.logger.Warn("failed to confirm purges", zap.Error(err))
+		}
+	}
+}
+
+// confirmPurges compacts the replica, so the purged rows leave its sstables,
+// then snapshots it, so dragonboat truncates the raft log entries that wrote
+// them, and records the snapshot in purgesTable for the purges it is past.
+// The log keeps multiraft.CompactionOverhead entries below a snapshot, a
+// purge is confirmed once the snapshot is that far past it.
+func (n *server) confirmPurges(ctx context.Context, confirmed map[string]bool) error {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return err
+	}
+	res, err := agent.ReadLocal(multiraft.PurgesQuery{})
+	if err != nil {
+		return err
+	}
+	purges, _ := res.([]multiraft.Purge)
+	replica := strconv.FormatUint(n.replicaID.Load(), 10)
+	var pending []multiraft.Purge
+	for _, p := range purges {
+		if confirmed[p.ID] {
+			continue
+		}
+		res, err := agent.ReadLocal(multiraft.RowQuery{Table: purgesTable, Row: p.ID, Columns: []string{replica}})
+		if err != nil {
+			return err
+		}
+		if row, ok := res.(*multiraft.Row); ok && row.Columns[replica] != "" {
+			confirmed[p.ID] = true
+			continue
+		}
+		pending = append(pending, p)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	if _, err := n.Compact(""); err != nil {
+		return fmt.Errorf("compacting: %w", err)
+	}
+	sctx, cancel := context.WithTimeout(ctx, purgeSnapshotTimeout)
+	index, err := agent.RequestSnapshot(sctx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("snapshotting: %w", err)
+	}
+	for _, p := range pending {
+		if index < p.Index+multiraft.CompactionOverhead {
+			continue
+		}
+		if _, err := n.SetKeyVal(ctx, purgesTable, p.ID, replica, strconv.FormatUint(index, 10)); err != nil {
+			return err
+		}
+		confirmed[p.ID] = true
+		n.logger.Info("confirmed purge", zap.String("purge", p.ID), zap.Uint64("snapshot_index", index))
+	}
+	return nil
+}
+
+// PurgeStatus is the progress of a purge.  Replicas holds, for every data
+// replica of the shard, the index of the snapshot it confirmed the purge
+// with, 0 until it has.
+type PurgeStatus struct {
+	ID       string            `json:"id"`
+	Index    uint64            `json:"index"`
+	Replicas map[uint64]uint64 `json:"replicas"`
+	Verified bool              `json:"verified"`
+}
+
+// PurgeStatus reports the progress of the purge of a row.  A purge is
+// verified once every replica holding rows, voting or not, has confirmed it.
+func (n *server) PurgeStatus(ctx context.Context, table, key string) (*PurgeStatus, error) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return nil, err
+	}
+	res, err := agent.Read(ctx, multiraft.PurgesQuery{})
+	if err != nil {
+		return nil, err
+	}
+	purges, _ := res.([]multiraft.Purge)
+	id := multiraft.PurgeID(table, key)
+	status := &PurgeStatus{ID: id, Replicas: map[uint64]uint64{}}
+	found := false
+	for _, p := range purges {
+		if p.ID == id {
+			status.Index, found = p.Index, true
+		}
+	}
+	if !found {
+		return nil, errdefs.New(errdefs.ErrNotFound, "no purge of this row")
+	}
+	members, err := agent.Members(ctx)
+	if err != nil {
+		return nil, err
+	}
+	row, _, err := n.GetRow(ctx, purgesTable, id, 0, nil)
+	if err == simplestore.ErrKeyNotFound {
+		row, err = &multiraft.Row{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	status.Verified = true
+	for replica := range members {
+		index, _ := strconv.ParseUint(row.Columns[strconv.FormatUint(replica, 10)], 10, 64)
+		status.Replicas[replica] = index
+		if index == 0 {
+			status.Verified = false
+		}
+	}
+	return status, nil
+}
+
+type purgeRequest struct {
+	Table  string `json:"table"`
+	RowKey string `json:"key"`
+}
+
+func (server *httpServer) handlePurge(w http.ResponseWriter, r *http.Request) {
+	req := purgeRequest{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Table == "" || req.RowKey == "" {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// a purge doesn't check the row it removes, principals whose writes
+	// are filtered can't purge.
+	guard, ok := server.checkRows(w, r, ActionWrite, req.Table)
+	if !ok {
+		return
+	} else if guard != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !server.checkWritable(w) {
+		return
+	}
+	index, err := server.node.Purge(r.Context(), req.Table, req.RowKey)
+	if errors.Is(err, multiraft.ErrWritesFrozen) {
+		server.logger.Info("Rejecting purge", zap.Error(err))
+		statusUnavailable(w)
+		return
+	} else if rejectedWrite(err) {
+		server.logger.Info("Rejecting purge", zap.Error(err))
+		statusError(w, err)
+		return
+	} else if err != nil {
+		server.logger.Error("Failed to purge key", zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	response := struct {
+		ID    string `json:"id"`
+		Index uint64 `json:"index"`
+	}{
+		ID:    multiraft.PurgeID(req.Table, req.RowKey),
+		Index: index,
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
+
+func (server *httpServer) handlePurgeStatus(w http.ResponseWriter, r *http.Request) {
+	req := purgeRequest{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Table == "" || req.RowKey == "" {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !server.checkTable(w, r, ActionRead, req.Table) {
+		return
+	}
+	status, err := server.node.PurgeStatus(r.Context(), req.Table, req.RowKey)
+	if err != nil {
+		server.logger.Info("Failed to read purge status", zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	respond(w, http.StatusOK, status, server.logger)
+}
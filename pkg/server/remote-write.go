@@ -0,0 +1,159 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"github.com/golang/snappy"
+	"go.uber.org/zap"
+)
+
+// maxRemoteWriteBytes bounds the compressed body of a remote-write request.
+const maxRemoteWriteBytes = 32 << 20
+
+var errBadProto = errors.New("malformed protobuf")
+
+// handleRemoteWrite accepts Prometheus remote-write (protocol 1.0: a snappy
+// compressed WriteRequest protobuf) and appends the samples to the
+// time-series table named by the table parameter, metrics by default.
+// Exemplars, histograms and metadata are dropped.
+func (server *httpServer) handleRemoteWrite(w http.ResponseWriter, r *http.Request) {
+	table := r.URL.Query().Get("table")
+	if table == "" {
+		table = defaultMetricsTable
+	}
+	if !server.checkTable(w, r, ActionWrite, table) {
+		return
+	}
+	defer r.Body.Close()
+	compressed, err := io.ReadAll(io.LimitReader(r.Body, maxRemoteWriteBytes+1))
+	if err != nil || len(compressed) > maxRemoteWriteBytes {
+		server.logger.Error("Bad remote-write request", zap.Error(err), zap.Int("bytes", len(compressed)))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	buf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		server.logger.Error("Bad remote-write request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	series, err := decodeWriteRequest(buf)
+	if err != nil {
+		server.logger.Error("Bad remote-write request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !server.checkWritable(w) {
+		return
+	}
+	if _, err := server.node.AppendSamples(r.Context(), table, series); errors.Is(err, multiraft.ErrWritesFrozen) {
+		statusUnavailable(w)
+		return
+	} else if err != nil {
+		// a 5xx makes Prometheus retry the batch, rewriting samples is harmless.
+		server.logger.Error("Failed to store remote-write samples", zap.Error(err))
+		statusInternalError(w)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeWriteRequest decodes the series of a remote-write WriteRequest:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func decodeWriteRequest(buf []byte) ([]tsSeries, error) {
+	var series []tsSeries
+	err := decodeProto(buf, func(field int, data []byte, _ uint64) error {
+		if field != 1 {
+			return nil
+		}
+		s := tsSeries{Labels: map[string]string{}}
+		err := decodeProto(data, func(field int, data []byte, _ uint64) error {
+			switch field {
+			case 1:
+				var name, value string
+				err := decodeProto(data, func(field int, data []byte, _ uint64) error {
+					switch field {
+					case 1:
+						name = string(data)
+					case 2:
+						value = string(data)
+					}
+					return nil
+				})
+				s.Labels[name] = value
+				return err
+			case 2:
+				var p tsPoint
+				err := decodeProto(data, func(field int, _ []byte, v uint64) error {
+					switch field {
+					case 1:
+						p.Value = math.Float64frombits(v)
+					case 2:
+						p.Timestamp = int64(v)
+					}
+					return nil
+				})
+				s.Samples = append(s.Samples, p)
+				return err
+			}
+			return nil
+		})
+		series = append(series, s)
+		return err
+	})
+	return series, err
+}
+
+// decodeProto calls fn with every field of a protobuf message: data holds
+// length delimited fields, v varint and fixed size ones.
+func decodeProto(buf []byte, fn func(field int, data []byte, v uint64) error) error {
+	for len(buf) > 0 {
+		tag, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return errBadProto
+		}
+		buf = buf[n:]
+		field := int(tag >> 3)
+		var data []byte
+		var v uint64
+		switch tag & 7 {
+		case 0: // varint
+			if v, n = binary.Uvarint(buf); n <= 0 {
+				return errBadProto
+			}
+			buf = buf[n:]
+		case 1: // fixed64
+			if len(buf) < 8 {
+				return errBadProto
+			}
+			v, buf = binary.LittleEndian.Uint64(buf), buf[8:]
+		case 2: // length delimited
+			size, n := binary.Uvarint(buf)
+			if n <= 0 || size > uint64(len(buf)-n) {
+				return errBadProto
+			}
+			data, buf = buf[n:n+int(size)], buf[n+int(size):]
+		case 5: // fixed32
+			if len(buf) < 4 {
+				return errBadProto
+			}
+			v, buf = uint64(binary.LittleEndian.Uint32(buf)), buf[4:]
+		default:
+			return fmt.Errorf("%w: wire type %d", errBadProto, tag&7)
+		}
+		if err := fn(field, data, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
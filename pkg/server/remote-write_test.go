@@ -0,0 +1,59 @@
+package server
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func protoField(field int, data []byte) []byte {
+	buf := binary.AppendUvarint(nil, uint64(field<<3|2))
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func TestDecodeWriteRequest(t *testing.T) {
+	label := func(name, value string) []byte {
+		return protoField(1, append(protoField(1, []byte(name)), protoField(2, []byte(value))...))
+	}
+	sample := func(v float64, ts int64) []byte {
+		buf := binary.AppendUvarint(nil, 1<<3|1)
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(v))
+		buf = binary.AppendUvarint(buf, 2<<3|0)
+		buf = binary.AppendUvarint(buf, uint64(ts))
+		return protoField(2, buf)
+	}
+	var ts []byte
+	ts = append(ts, label("__name__", "up")...)
+	ts = append(ts, label("job", "node")...)
+	ts = append(ts, sample(1, 1000)...)
+	ts = append(ts, sample(0.5, 2000)...)
+	req := protoField(1, ts)
+
+	series, err := decodeWriteRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []tsSeries{{
+		Labels:  map[string]string{"__name__": "up", "job": "node"},
+		Samples: []tsPoint{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 0.5}},
+	}}
+	if !reflect.DeepEqual(series, want) {
+		t.Errorf("decodeWriteRequest() = %+v, want %+v", series, want)
+	}
+	if _, err := decodeWriteRequest(req[:len(req)-3]); err == nil {
+		t.Errorf("decodeWriteRequest() of a truncated request succeeded")
+	}
+
+	key := seriesKey(series[0].Labels)
+	if key != `up{job="node"}` {
+		t.Errorf("seriesKey() = %q", key)
+	}
+	if s, ts, ok := parseSampleRowKey(sampleRowKey(key, 2000)); !ok || s != key || ts != 2000 {
+		t.Errorf("sample row key round trip = %q, %d, %v", s, ts, ok)
+	}
+	if sampleRowKey(key, 999) >= sampleRowKey(key, 1000) {
+		t.Errorf("sample row keys don't sort in time order")
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+const (
+	replayReportInterval = time.Second
+	replayCheckTimeout   = time.Second
+)
+
+// replayStatus is the raft log replay progress reported by /readyz and
+// /status.
+type replayStatus struct {
+	StartIndex   uint64 `json:"start_index"`
+	TargetIndex  uint64 `json:"target_index"`
+	AppliedIndex uint64 `json:"applied_index"`
+	Remaining    uint64 `json:"remaining"`
+	Elapsed      string `json:"elapsed"`
+	// ETA is a linear estimate based on the replay rate so far.
+	ETA      string `json:"eta,omitempty"`
+	CaughtUp bool   `json:"caught_up"`
+}
+
+// replayProgress returns the local replica's log replay progress, false when
+// the shard hasn't been started yet.
+func (n *server) replayProgress(ctx context.Context) (*replayStatus, bool) {
+	n.raftAgentsMu.Lock()
+	agent, ok := n.raftAgents[shardID1]
+	started := n.shardStarted
+	n.raftAgentsMu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	ctx, cancel := context.WithTimeout(ctx, replayCheckTimeout)
+	defer cancel()
+	p, err := agent.ReplayProgress(ctx)
+	if err != nil {
+		n.logger.Debug("unable to read replay progress", zap.Error(err))
+	}
+	return newReplayStatus(p, time.Since(started)), true
+}
+
+func newReplayStatus(p multiraft.ReplayProgress, elapsed time.Duration) *replayStatus {
+	rs := &replayStatus{
+		StartIndex:   p.StartIndex,
+		TargetIndex:  p.TargetIndex,
+		AppliedIndex: p.AppliedIndex,
+		Elapsed:      elapsed.Round(time.Millisecond).String(),
+		CaughtUp:     p.CaughtUp,
+	}
+	if p.AppliedIndex < p.TargetIndex {
+		rs.Remaining = p.TargetIndex - p.AppliedIndex
+	}
+	if replayed := p.AppliedIndex - p.StartIndex; rs.Remaining > 0 && p.AppliedIndex > p.StartIndex {
+		eta := time.Duration(float64(elapsed) / float64(replayed) * float64(rs.Remaining))
+		rs.ETA = eta.Round(time.Millisecond).String()
+	}
+	return rs
+}
+
+// reportReplay logs the raft log replay progress after boot until the local
+// replica has caught up, after which /readyz starts answering 200.
+func (n *server) reportReplay(ctx context.Context) error {
+	ticker := time.NewTicker(replayReportInterval)
+	defer ticker.Stop()
+	logged := false
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		rs, ok := n.replayProgress(ctx)
+		if !ok {
+			continue
+		}
+		if !logged {
+			n.logger.Info("replaying raft log",
+				zap.Uint64("start_index", rs.StartIndex),
+				zap.Uint64("target_index", rs.TargetIndex))
+			logged = true
+		}
+		if rs.CaughtUp {
+			n.logger.Info("raft log replay complete, node is ready",
+				zap.Uint64("applied_index", rs.AppliedIndex),
+				zap.Uint64("replayed", rs.AppliedIndex-rs.StartIndex),
+				zap.String("elapsed", rs.Elapsed))
+			return nil
+		}
+		n.logger.Info("raft log replay in progress",
+			zap.Uint64("applied_index", rs.AppliedIndex),
+			zap.Uint64("remaining", rs.Remaining),
+			zap.String("elapsed", rs.Elapsed),
+			zap.String("eta", rs.ETA))
+	}
+}
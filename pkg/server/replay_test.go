@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+func TestNewReplayStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		p         multiraft.ReplayProgress
+		elapsed   time.Duration
+		remaining uint64
+		eta       string
+	}{
+		{"nothing to replay", multiraft.ReplayProgress{StartIndex: 10, TargetIndex: 10, AppliedIndex: 10}, time.Second, 0, ""},
+		{"not started", multiraft.ReplayProgress{StartIndex: 10, TargetIndex: 110, AppliedIndex: 10}, time.Second, 100, ""},
+		{"a quarter done", multiraft.ReplayProgress{StartIndex: 0, TargetIndex: 100, AppliedIndex: 25}, time.Second, 75, "3s"},
+		{"halfway", multiraft.ReplayProgress{StartIndex: 100, TargetIndex: 300, AppliedIndex: 200}, 2 * time.Second, 100, "2s"},
+		{"past the target", multiraft.ReplayProgress{StartIndex: 0, TargetIndex: 100, AppliedIndex: 120}, time.Second, 0, ""},
+		{"caught up", multiraft.ReplayProgress{StartIndex: 0, TargetIndex: 100, AppliedIndex: 100, CaughtUp: true}, 1500 * time.Millisecond, 0, ""},
+	}
+	for _, tt := range tests {
+		rs := newReplayStatus(tt.p, tt.elapsed)
+		if rs.Remaining != tt.remaining || rs.ETA != tt.eta {
+			t.Errorf("%s: remaining %d, eta %q, want %d, %q", tt.name, rs.Remaining, rs.ETA, tt.remaining, tt.eta)
+		}
+		if rs.StartIndex != tt.p.StartIndex || rs.TargetIndex != tt.p.TargetIndex || rs.AppliedIndex != tt.p.AppliedIndex ||
+			rs.CaughtUp != tt.p.CaughtUp || rs.Elapsed != tt.elapsed.String() {
+			t.Errorf("%s: status %+v doesn't match %+v after %s", tt.name, rs, tt.p, tt.elapsed)
+		}
+	}
+}
+
+// replayAgent is a shard reporting a fixed replay progress.
+type replayAgent struct {
+	raftAgent
+	p multiraft.ReplayProgress
+}
+
+func (a *replayAgent) ReplayProgress(ctx context.Context) (multiraft.ReplayProgress, error) {
+	return a.p, nil
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name     string
+		agent    raftAgent // nil before the shard is started
+		draining bool
+		want     int
+	}{
+		{"shard not started", nil, false, http.StatusServiceUnavailable},
+		{"replaying", &replayAgent{p: multiraft.ReplayProgress{TargetIndex: 100, AppliedIndex: 40}}, false, http.StatusServiceUnavailable},
+		{"replayed, leader not confirmed", &replayAgent{p: multiraft.ReplayProgress{TargetIndex: 100, AppliedIndex: 100}}, false, http.StatusServiceUnavailable},
+		{"caught up", &replayAgent{p: multiraft.ReplayProgress{TargetIndex: 100, AppliedIndex: 100, CaughtUp: true}}, false, http.StatusOK},
+		{"caught up, draining", &replayAgent{p: multiraft.ReplayProgress{CaughtUp: true}}, true, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		n := &server{raftAgents: map[uint64]raftAgent{}, logger: zap.NewNop()}
+		if tt.agent != nil {
+			n.raftAgents[shardID1] = tt.agent
+		}
+		n.draining.Store(tt.draining)
+		hs := &httpServer{node: n, logger: zap.NewNop()}
+		w := httptest.NewRecorder()
+		hs.handleReadyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if w.Code != tt.want {
+			t.Errorf("%s: /readyz = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+const (
+	// replicationTokenHeader carries the replication token on shipments.
+	replicationTokenHeader = "X-Expodb-Replication-Token"
+	// replicaChunkBytes bounds the size of each OpStageReplica entry.
+	replicaChunkBytes = 1 << 20
+	// defaultReplicationTimeout bounds a shipment when the config doesn't.
+	defaultReplicationTimeout = 10 * time.Minute
+)
+
+// replicationClient ships the snapshots, each bounded by the config's
+// ReplicationTimeout rather than a client timeout.
+var replicationClient = &http.Client{}
+
+var (
+	ErrStandby         = errors.New("cluster is a standby, send writes to the primary or promote it")
+	ErrReplicationAuth = errors.New("invalid replication token")
+	ErrNotStandby      = errors.New("cluster is not a standby")
+	ErrStandbyPromoted = errors.New("standby has been promoted, refusing snapshots from the old primary")
+)
+
+// replicationState tracks the shipments of the primary's leader.
+type replicationState struct {
+	mu          sync.Mutex
+	lastShipped time.Time
+	lastIndex   uint64
+	lastErr     error
+}
+
+// replicationStatus is reported by /status on both sides of replication.
+type replicationStatus struct {
+	Role string `json:"role"`
+	// Target, LastShipped, LastIndex and LastError describe the primary's
+	// shipments, they are only known to the node that ran them.
+	Target      string     `json:"target,omitempty"`
+	LastShipped *time.Time `json:"last_shipped,omitempty"`
+	LastIndex   uint64     `json:"last_index,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	// SourceIndex is the primary's applied index the standby's data is from.
+	SourceIndex uint64 `json:"source_index,omitempty"`
+	Promoted    bool   `json:"promoted,omitempty"`
+}
+
+// runReplicationShipper is run by the primary's leader, see leaderLoop.  It
+// ships a snapshot of the user data to the standby every interval.  The
+// standby lags the primary by up to an interval plus the time a shipment
+// takes, anything written since is lost if the primary cluster is.
+//
+// Every shipment is the whole dataset, which the standby stages through its
+// raft log: it costs what the data weighs, not what changed.  Shipping only
+// what changed since the standby's source index, from the archived raft log
+// (see archive.go) or the sinks' outbox, is the way to cut it down.
+func (n *server) runReplicationShipper(ctx context.Context) {
+	ticker := time.NewTicker(n.config.ReplicationInterval)
+	defer ticker.Stop()
+	// only the first shipment and changes between failing and succeeding
+	// go to the event log, not every interval's.
+	var failing, shipped bool
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		timeout := n.config.ReplicationTimeout
+		if timeout <= 0 {
+			timeout = defaultReplicationTimeout
+		}
+		shipCtx, cancel := context.WithTimeout(ctx, timeout)
+		index, err := n.shipSnapshot(shipCtx)
+		cancel()
+		n.replication.mu.Lock()
+		n.replication.lastErr = err
+		if err == nil {
+			n.replication.lastShipped = time.Now()
+			n.replication.lastIndex = index
+		}
+		n.replication.mu.Unlock()
+		if err != nil {
+			n.logger.Warn("failed to ship snapshot to standby", zap.String("standby", n.config.ReplicateTo), zap.Error(err))
+			if !failing {
+				n.recordEvent(ctx, eventSnapshotFailed, n.config.ReplicateTo, err.Error())
+			}
+			failing = true
+			continue
+		}
+		if failing || !shipped {
+			n.recordEvent(ctx, eventSnapshotShip, n.config.ReplicateTo, fmt.Sprintf("index %d", index))
+		}
+		failing, shipped = false, true
+		n.logger.Debug("shipped snapshot to standby", zap.String("standby", n.config.ReplicateTo), zap.Uint64("index", index))
+	}
+}
+
+// shipSnapshot streams an export of the local replica to the standby and
+// returns the applied index it was taken at.
+func (n *server) shipSnapshot(ctx context.Context) (uint64, error) {
+	pr, pw := io.Pipe()
+	type result struct {
+		index uint64
+		err   error
+	}
+	exported := make(chan result, 1)
+	go func() {
+		res, err := n.raftAgents[shardID1].ReadLocal(multiraft.ExportQuery{W: pw})
+		pw.CloseWithError(err)
+		if err != nil {
+			exported <- result{err: err}
+			return
+		}
+		exported <- result{index: res.(uint64)}
+	}()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, standbyURL(n.config.ReplicateTo)+"/replication/_snapshot", pr)
+	if err != nil {
+		pr.Close()
+		return 0, err
+	}
+	req.Header.Set(replicationTokenHeader, n.config.ReplicationToken)
+	resp, err := replicationClient.Do(req)
+	// unblocks the export if the standby stopped reading early.
+	pr.Close()
+	res := <-exported
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("standby answered %s: %s", resp.Status, msg)
+	}
+	if res.err != nil {
+		return 0, fmt.Errorf("exporting snapshot: %w", res.err)
+	}
+	return res.index, nil
+}
+
+// standbyURL returns the base URL of --replicate-to, a host:port is served
+// over http.
+func standbyURL(target string) string {
+	if strings.Contains(target, "://") {
+		return strings.TrimSuffix(target, "/")
+	}
+	return "http://" + target
+}
+
+// ApplyReplicaSnapshot loads a snapshot shipped by the primary.  It is staged
+// through raft in chunks and swapped in by a single entry, readers of the
+// standby see the previous snapshot until then.
+func (n *server) ApplyReplicaSnapshot(ctx context.Context, token string, r io.Reader) (uint64, error) {
+	if !n.config.Standby {
+		return 0, ErrNotStandby
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(n.config.ReplicationToken)) != 1 {
+		return 0, ErrReplicationAuth
+	}
+	if n.standbyPromoted() {
+		return 0, ErrStandbyPromoted
+	}
+	n.replicaMu.Lock()
+	defer n.replicaMu.Unlock()
+
+	agent := n.raftAgents[shardID1]
+	if _, err := agent.Apply(ctx, multiraft.KVData{Op: multiraft.OpResetReplica}); err != nil {
+		return 0, fmt.Errorf("resetting staged snapshot: %w", err)
+	}
+	var chunk []multiraft.KVPair
+	size := 0
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		if _, err := agent.Apply(ctx, multiraft.KVData{Op: multiraft.OpStageReplica, Pairs: chunk}); err != nil {
+			return fmt.Errorf("staging snapshot: %w", err)
+		}
+		chunk, size = nil, 0
+		return nil
+	}
+	sourceIndex, err := multiraft.ReadExport(r, func(pair multiraft.KVPair) error {
+		chunk = append(chunk, pair)
+		size += len(pair.Key) + len(pair.Val)
+		if size < replicaChunkBytes {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+	// a promotion racing the shipment wins, the commit is then ignored.
+	if _, err := agent.Apply(ctx, multiraft.KVData{Op: multiraft.OpCommitReplica, Index: sourceIndex}); err != nil {
+		return 0, fmt.Errorf("committing staged snapshot: %w", err)
+	}
+	n.logger.Info("standby snapshot applied", zap.Uint64("source_index", sourceIndex))
+	n.recordEvent(ctx, eventSnapshotApply, n.config.ID(), fmt.Sprintf("source index %d", sourceIndex))
+	return sourceIndex, nil
+}
+
+// PromoteStandby turns the standby into a primary for disaster recovery: it
+// accepts client writes from then on and refuses snapshots from the old
+// primary.  Promotion is replicated and can't be undone.
+func (n *server) PromoteStandby(ctx context.Context) (uint64, error) {
+	if !n.config.Standby {
+		return 0, ErrNotStandby
+	}
+	index, err := n.raftAgents[shardID1].Apply(ctx, multiraft.KVData{Op: multiraft.OpPromoteStandby})
+	if err != nil {
+		return 0, fmt.Errorf("promoting standby: %w", err)
+	}
+	n.promoted.Store(true)
+	n.logger.Info("standby promoted to primary", zap.Uint64("index", index))
+	n.recordEvent(ctx, eventPromoted, n.config.ID(), "")
+	return index, nil
+}
+
+// standbyPromoted reports whether the local replica has seen the promotion.
+func (n *server) standbyPromoted() bool {
+	if n.promoted.Load() {
+		return true
+	}
+	n.raftAgentsMu.Lock()
+	agent, ok := n.raftAgents[shardID1]
+	n.raftAgentsMu.Unlock()
+	if !ok {
+		return false
+	}
+	res, err := agent.ReadLocal(multiraft.StandbyQuery{})
+	if err != nil || !res.(*multiraft.StandbyState).Promoted {
+		return false
+	}
+	n.promoted.Store(true)
+	return true
+}
+
+func (n *server) replicationStatus() *replicationStatus {
+	switch {
+	case n.config.Standby:
+		rs := &replicationStatus{Role: "standby", Promoted: n.standbyPromoted()}
+		n.raftAgentsMu.Lock()
+		agent, ok := n.raftAgents[shardID1]
+		n.raftAgentsMu.Unlock()
+		if ok {
+			if res, err := agent.ReadLocal(multiraft.StandbyQuery{}); err == nil {
+				rs.SourceIndex = res.(*multiraft.StandbyState).SourceIndex
+			}
+		}
+		return rs
+	case n.config.ReplicateTo != "":
+		rs := &replicationStatus{Role: "primary", Target: n.config.ReplicateTo}
+		n.replication.mu.Lock()
+		defer n.replication.mu.Unlock()
+		if !n.replication.lastShipped.IsZero() {
+			shipped := n.replication.lastShipped
+			rs.LastShipped = &shipped
+			rs.LastIndex = n.replication.lastIndex
+		}
+		if n.replication.lastErr != nil {
+			rs.LastError = n.replication.lastErr.Error()
+		}
+		return rs
+	}
+	return nil
+}
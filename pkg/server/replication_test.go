@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/config"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+)
+
+// exportAgent exports a snapshot of a few bytes, taken at index 7.
+type exportAgent struct {
+	raftAgent
+}
+
+func (exportAgent) ReadLocal(query interface{}) (interface{}, error) {
+	if _, err := query.(multiraft.ExportQuery).W.Write([]byte("snapshot")); err != nil {
+		return nil, err
+	}
+	return uint64(7), nil
+}
+
+func TestStandbyURL(t *testing.T) {
+	for target, want := range map[string]string{
+		"standby:8000":          "http://standby:8000",
+		"http://standby:8000":   "http://standby:8000",
+		"https://standby:8443/": "https://standby:8443",
+	} {
+		if got := standbyURL(target); got != want {
+			t.Errorf("standbyURL(%q) = %q, want %q", target, got, want)
+		}
+	}
+}
+
+func TestShipSnapshot(t *testing.T) {
+	release := make(chan struct{})
+	var hang atomic.Bool
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(replicationTokenHeader) != "s3cret" || string(body) != "snapshot" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if hang.Load() {
+			<-release
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+	defer func(c *http.Client) { replicationClient = c }(replicationClient)
+	replicationClient = ts.Client()
+
+	n := &server{
+		config:     &config.Config{ReplicateTo: ts.URL, ReplicationToken: "s3cret"},
+		raftAgents: map[uint64]raftAgent{shardID1: exportAgent{}},
+	}
+	if index, err := n.shipSnapshot(context.Background()); err != nil || index != 7 {
+		t.Fatalf("shipSnapshot() over https = %d, %v, want 7", index, err)
+	}
+
+	hang.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := n.shipSnapshot(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("shipSnapshot() to a hung standby error = %v, want the deadline exceeded", err)
+	}
+}
@@ -0,0 +1,496 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"github.com/epsniff/expodb/pkg/server/state-machines/apikeys"
+	"github.com/epsniff/expodb/pkg/server/state-machines/simplestore"
+	"go.uber.org/zap"
+)
+
+const (
+	// respValueColumn holds the value of plain (GET/SET) Redis keys.
+	respValueColumn    = "value"
+	respCommandTimeout = 10 * time.Second
+	respMaxBulkLen     = 64 << 20
+	respMaxArgs        = 1 << 16
+	respDefaultCount   = 10
+)
+
+var (
+	errRESPProtocol = errors.New("protocol error")
+	// errRESPNoPerm is returned for commands the principal may not run.
+	errRESPNoPerm = errors.New("this user has no permissions to access the key")
+)
+
+// respServer speaks a subset of the Redis protocol (RESP2): GET, SET, DEL,
+// HGET, HSET, HDEL, HGETALL and SCAN.  A key "table:row" is that row of
+// table, keys without a ":" are rows of the configured default table.  Plain
+// values are kept in the row's "value" column, hash fields are the row's
+// columns.  When the node authenticates its clients, see authRequired,
+// connections send AUTH with a token first and every command is authorized
+// as the token's principal, like the HTTP requests.
+type respServer struct {
+	address net.Addr
+	node    *server
+	logger  *zap.Logger
+}
+
+// Serve serves RESP connections accepted on ln until it is closed.
+func (server *respServer) Serve(ln net.Listener) {
+	server.logger.Info("Starting RESP server", zap.String("address", server.address.String()))
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			server.logger.Error("Error accepting RESP connection", zap.Error(err))
+			continue
+		}
+		go server.serveConn(conn)
+	}
+}
+
+// respConn is the state of a client connection.  SCAN cursors are numbers
+// standing for the row the scan resumes after, like Redis clients expect.
+// principal is who AUTH authenticated, key the API key it did with.
+type respConn struct {
+	r         *bufio.Reader
+	w         *bufio.Writer
+	cursors   map[uint64]string
+	next      uint64
+	principal *Principal
+	key       *apikeys.Key
+}
+
+func (server *respServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	c := &respConn{r: bufio.NewReader(conn), w: bufio.NewWriter(conn), cursors: map[uint64]string{}}
+	for {
+		args, err := readRESPCommand(c.r)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			writeRESPError(c.w, "ERR "+err.Error())
+			c.w.Flush()
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := strings.EqualFold(args[0], "QUIT")
+		ctx, cancel := context.WithTimeout(context.Background(), respCommandTimeout)
+		server.handleCommand(ctx, c, args)
+		cancel()
+		if err := c.w.Flush(); err != nil || quit {
+			return
+		}
+	}
+}
+
+func (server *respServer) handleCommand(ctx context.Context, c *respConn, args []string) {
+	cmd, args := strings.ToUpper(args[0]), args[1:]
+	arity := map[string]int{"GET": 1, "HGET": 2, "HGETALL": 1}
+	if want, ok := arity[cmd]; ok && len(args) != want {
+		writeRESPError(c.w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+		return
+	}
+	if cmd != "AUTH" && cmd != "QUIT" && server.node.authRequired() && c.principal == nil {
+		writeRESPError(c.w, "NOAUTH Authentication required.")
+		return
+	}
+	if c.key != nil {
+		if ok, _ := server.node.apiKeyUsage.take(c.key, time.Now()); !ok {
+			writeRESPError(c.w, "ERR api key rate limit exceeded")
+			return
+		}
+	}
+	var err error
+	switch cmd {
+	case "AUTH":
+		server.auth(c, args)
+		return
+	case "PING":
+		if len(args) > 0 {
+			writeRESPBulk(c.w, &args[0])
+			return
+		}
+		writeRESPSimple(c.w, "PONG")
+	case "QUIT", "SELECT":
+		writeRESPSimple(c.w, "OK")
+	case "COMMAND":
+		writeRESPArray(c.w, 0)
+	case "GET":
+		err = server.hget(ctx, c, args[0], respValueColumn)
+	case "HGET":
+		err = server.hget(ctx, c, args[0], args[1])
+	case "HGETALL":
+		err = server.hgetall(ctx, c, args[0])
+	case "SET":
+		if len(args) != 2 {
+			writeRESPError(c.w, "ERR syntax error, only SET key value is supported")
+			return
+		}
+		err = server.hset(ctx, c, args[0], []string{respValueColumn, args[1]}, false)
+	case "HSET", "HMSET":
+		if len(args) < 3 || len(args)%2 != 1 {
+			writeRESPError(c.w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+			return
+		}
+		err = server.hset(ctx, c, args[0], args[1:], cmd == "HSET")
+	case "DEL", "HDEL":
+		if len(args) == 0 || (cmd == "HDEL" && len(args) < 2) {
+			writeRESPError(c.w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+			return
+		}
+		err = server.del(ctx, c, cmd, args)
+	case "SCAN":
+		err = server.scan(ctx, c, args)
+	default:
+		writeRESPError(c.w, fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(cmd)))
+		return
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, errRESPProtocol):
+		writeRESPError(c.w, "ERR "+err.Error())
+	case errors.Is(err, errRESPNoPerm):
+		writeRESPError(c.w, "NOPERM "+err.Error())
+	case errors.Is(err, errQuotaExceeded):
+		writeRESPError(c.w, "ERR "+err.Error())
+	case errors.Is(err, multiraft.ErrTxnConflict):
+		writeRESPError(c.w, "ERR key is locked by a transaction, retry")
+	case errors.Is(err, multiraft.ErrUniqueViolation), errors.Is(err, multiraft.ErrSchemaViolation), errors.Is(err, multiraft.ErrTriggerRejected):
+		writeRESPError(c.w, "ERR "+err.Error())
+	case errors.Is(err, multiraft.ErrWritesFrozen), errors.Is(err, ErrMaintenance), errors.Is(err, ErrStandby), errors.Is(err, ErrDiskFull):
+		writeRESPError(c.w, "READONLY "+err.Error())
+	default:
+		server.logger.Error("Failed RESP command", zap.String("command", cmd), zap.Error(err))
+		writeRESPError(c.w, "ERR internal error")
+	}
+}
+
+// auth authenticates the connection with AUTH [username] token, the
+// username is ignored: tokens name their principal.
+func (server *respServer) auth(c *respConn, args []string) {
+	if len(args) != 1 && len(args) != 2 {
+		writeRESPError(c.w, "ERR wrong number of arguments for 'auth' command")
+		return
+	}
+	if !server.node.authRequired() {
+		writeRESPError(c.w, "ERR AUTH called without any password configured for the default user")
+		return
+	}
+	principal, key, err := server.node.authenticateToken(args[len(args)-1])
+	if err != nil {
+		server.logger.Info("Rejecting RESP authentication", zap.Error(err))
+		writeRESPError(c.w, "WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+	c.principal, c.key = principal, key
+	writeRESPSimple(c.w, "OK")
+}
+
+// authorize returns errRESPNoPerm unless the connection's principal may
+// perform action on all the rows of table, row filters aren't enforced over
+// the Redis protocol.  Writes of bytes made with an API key past its quota
+// are refused, see hset for the charge.
+func (server *respServer) authorize(c *respConn, action, table string, bytes int) error {
+	p := c.principal
+	if p == nil {
+		p = &Principal{}
+	}
+	if err := server.node.authz.Authorize(p, action, table); err != nil {
+		server.logger.Info("Rejecting unauthorized RESP command",
+			zap.String("principal", p.Name), zap.String("action", action), zap.String("table", table), zap.Error(err))
+		return errRESPNoPerm
+	}
+	if rows, ok := server.node.authz.(RowAuthorizer); ok && rows.RowFilters(p, action, table) != nil {
+		return errRESPNoPerm
+	}
+	if action == ActionWrite && c.key != nil && bytes > 0 {
+		return server.node.apiKeyUsage.overQuota(c.key)
+	}
+	return nil
+}
+
+// respKey maps a Redis key to its table and row, checking the connection
+// may perform action on the table.
+func (server *respServer) respKey(c *respConn, key, action string, bytes int) (string, string, error) {
+	table, row := server.node.config.RESPTable, key
+	if i := strings.IndexByte(key, ':'); i > 0 {
+		table, row = key[:i], key[i+1:]
+	}
+	if strings.HasPrefix(table, "_") {
+		return "", "", fmt.Errorf("%w: %s is a system table", errRESPProtocol, table)
+	}
+	if err := server.authorize(c, action, table, bytes); err != nil {
+		return "", "", err
+	}
+	return table, row, nil
+}
+
+func (server *respServer) getRow(ctx context.Context, c *respConn, key string) (map[string]string, error) {
+	table, row, err := server.respKey(c, key, ActionRead, 0)
+	if err != nil {
+		return nil, err
+	}
+	r, _, err := server.node.GetRow(ctx, table, row, 0, nil)
+	if errors.Is(err, simplestore.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return r.Columns, nil
+}
+
+func (server *respServer) hget(ctx context.Context, c *respConn, key, field string) error {
+	cols, err := server.getRow(ctx, c, key)
+	if err != nil {
+		return err
+	}
+	if val, ok := cols[field]; ok {
+		writeRESPBulk(c.w, &val)
+	} else {
+		writeRESPBulk(c.w, nil)
+	}
+	return nil
+}
+
+func (server *respServer) hgetall(ctx context.Context, c *respConn, key string) error {
+	cols, err := server.getRow(ctx, c, key)
+	if err != nil {
+		return err
+	}
+	writeRESPArray(c.w, 2*len(cols))
+	for col, val := range cols {
+		col, val := col, val
+		writeRESPBulk(c.w, &col)
+		writeRESPBulk(c.w, &val)
+	}
+	return nil
+}
+
+// hset sets the field/value pairs as a single row write.  With countNew it
+// replies with the number of fields that didn't exist, like HSET.
+func (server *respServer) hset(ctx context.Context, c *respConn, key string, pairs []string, countNew bool) error {
+	bytes := len(key)
+	for _, p := range pairs {
+		bytes += len(p)
+	}
+	table, row, err := server.respKey(c, key, ActionWrite, bytes)
+	if err != nil {
+		return err
+	}
+	if err := server.node.checkWritable(); err != nil {
+		return err
+	}
+	var existing map[string]string
+	if countNew {
+		if existing, err = server.getRow(ctx, c, key); err != nil {
+			return err
+		}
+	}
+	cols := map[string]string{}
+	for i := 0; i < len(pairs); i += 2 {
+		cols[pairs[i]] = pairs[i+1]
+	}
+	if _, err := server.node.SetRow(ctx, table, row, cols, false, nil); err != nil {
+		return err
+	}
+	if c.key != nil {
+		server.node.apiKeyUsage.wrote(c.key, int64(bytes))
+	}
+	if !countNew {
+		writeRESPSimple(c.w, "OK")
+		return nil
+	}
+	added := 0
+	for col := range cols {
+		if _, ok := existing[col]; !ok {
+			added++
+		}
+	}
+	writeRESPInt(c.w, int64(added))
+	return nil
+}
+
+// del deletes whole rows (DEL key...) or columns (HDEL key field...) and
+// replies with how many existed.
+func (server *respServer) del(ctx context.Context, c *respConn, cmd string, args []string) error {
+	if err := server.node.checkWritable(); err != nil {
+		return err
+	}
+	keys, fields := args, []string{""}
+	if cmd == "HDEL" {
+		keys, fields = args[:1], args[1:]
+	}
+	deleted := 0
+	for _, key := range keys {
+		table, row, err := server.respKey(c, key, ActionWrite, 0)
+		if err != nil {
+			return err
+		}
+		cols, err := server.getRow(ctx, c, key)
+		if err != nil {
+			return err
+		}
+		if cols == nil {
+			continue
+		}
+		for _, field := range fields {
+			if _, ok := cols[field]; field != "" && !ok {
+				continue
+			}
+			if _, err := server.node.DeleteKey(ctx, table, row, field); err != nil {
+				return err
+			}
+			deleted++
+		}
+	}
+	writeRESPInt(c.w, int64(deleted))
+	return nil
+}
+
+// scan pages through a table: the default one, or the one named by a MATCH
+// pattern of the form "table:...".
+func (server *respServer) scan(ctx context.Context, c *respConn, args []string) error {
+	if len(args) == 0 || len(args)%2 != 1 {
+		return fmt.Errorf("%w: SCAN cursor [MATCH pattern] [COUNT count]", errRESPProtocol)
+	}
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid cursor", errRESPProtocol)
+	}
+	after, ok := c.cursors[cursor]
+	if cursor != 0 && !ok {
+		return fmt.Errorf("%w: unknown cursor", errRESPProtocol)
+	}
+	delete(c.cursors, cursor)
+	pattern, count := "", respDefaultCount
+	for i := 1; i < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count <= 0 || count > maxScanLimit {
+				return fmt.Errorf("%w: COUNT must be between 1 and %d", errRESPProtocol, maxScanLimit)
+			}
+		default:
+			return fmt.Errorf("%w: unsupported SCAN option %s", errRESPProtocol, args[i])
+		}
+	}
+	table, prefix := server.node.config.RESPTable, ""
+	if i := strings.IndexByte(pattern, ':'); i > 0 && !strings.ContainsAny(pattern[:i], `*?[\`) {
+		table, prefix = pattern[:i], pattern[:i+1]
+		if strings.HasPrefix(table, "_") {
+			return fmt.Errorf("%w: %s is a system table", errRESPProtocol, table)
+		}
+	}
+	if err := server.authorize(c, ActionRead, table, 0); err != nil {
+		return err
+	}
+
+	page, _, err := server.node.ScanPage(ctx, table, after, count, ConsistencyGlobal)
+	if err != nil {
+		return err
+	}
+	keys := []string{}
+	for _, row := range page.Rows {
+		key := prefix + row.Key
+		if ok, _ := path.Match(pattern, key); pattern == "" || ok {
+			keys = append(keys, key)
+		}
+	}
+	next := uint64(0)
+	if page.More {
+		c.next++
+		next = c.next
+		c.cursors[next] = page.Rows[len(page.Rows)-1].Key
+	}
+	writeRESPArray(c.w, 2)
+	nextStr := strconv.FormatUint(next, 10)
+	writeRESPBulk(c.w, &nextStr)
+	writeRESPArray(c.w, len(keys))
+	for i := range keys {
+		writeRESPBulk(c.w, &keys[i])
+	}
+	return nil
+}
+
+// readRESPCommand reads a command sent as an array of bulk strings, or as an
+// inline command (space separated words), as redis-cli and telnet send.
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > respMaxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errRESPProtocol)
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("%w: expected '$', got %q", errRESPProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > respMaxBulkLen {
+			return nil, fmt.Errorf("%w: invalid bulk length", errRESPProtocol)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if string(buf[size:]) != "\r\n" {
+			return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", errRESPProtocol)
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func readRESPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && line != "" {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func writeRESPSimple(w *bufio.Writer, s string) { fmt.Fprintf(w, "+%s\r\n", s) }
+func writeRESPError(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "-%s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(s))
+}
+func writeRESPInt(w *bufio.Writer, i int64) { fmt.Fprintf(w, ":%d\r\n", i) }
+func writeRESPArray(w *bufio.Writer, n int) { fmt.Fprintf(w, "*%d\r\n", n) }
+
+// writeRESPBulk writes a bulk string, or the null bulk string for nil.
+func writeRESPBulk(w *bufio.Writer, s *string) {
+	if s == nil {
+		w.WriteString("$-1\r\n")
+		return
+	}
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(*s), *s)
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/epsniff/expodb/pkg/config"
+	"go.uber.org/zap"
+)
+
+func TestReadRESPCommand(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("*3\r\n$3\r\nSET\r\n$5\r\nk:a b\r\n$0\r\n\r\nHGET users:1 name\r\n*1\r\n$4\r\nPING"))
+	for _, want := range [][]string{{"SET", "k:a b", ""}, {"HGET", "users:1", "name"}} {
+		got, err := readRESPCommand(r)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("readRESPCommand() = %q, %v, want %q", got, err, want)
+		}
+	}
+	if _, err := readRESPCommand(r); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("readRESPCommand() on a truncated command error = %v, want ErrUnexpectedEOF", err)
+	}
+	if _, err := readRESPCommand(bufio.NewReader(strings.NewReader("*1\r\n$3\r\nGETX\r\n"))); !errors.Is(err, errRESPProtocol) {
+		t.Errorf("readRESPCommand() with a bad bulk length error = %v, want a protocol error", err)
+	}
+}
+
+func TestRESPAuth(t *testing.T) {
+	p := &tokenPolicy{
+		Tokens:   []tokenGrant{{Name: "ingest", Token: "s3cret", Policies: []string{"metrics"}}},
+		Policies: map[string][]policyRule{"metrics": {{Tables: []string{"metrics"}, Actions: []string{ActionRead, ActionWrite}}}},
+	}
+	if err := p.validate(); err != nil {
+		t.Fatal(err)
+	}
+	resp := &respServer{node: &server{config: &config.Config{RESPTable: "redis"}, authn: p, authz: p}, logger: zap.NewNop()}
+	var out bytes.Buffer
+	c := &respConn{w: bufio.NewWriter(&out), cursors: map[uint64]string{}}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"GET", "metrics:a"}, "-NOAUTH"},
+		{[]string{"AUTH", "wrong"}, "-WRONGPASS"},
+		{[]string{"PING"}, "-NOAUTH"},
+		{[]string{"AUTH", "default", "s3cret"}, "+OK"},
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"GET", "users:a"}, "-NOPERM"},
+		{[]string{"SET", "a", "1"}, "-NOPERM"},
+		{[]string{"SCAN", "0", "MATCH", "users:*"}, "-NOPERM"},
+	}
+	for _, tt := range tests {
+		out.Reset()
+		resp.handleCommand(context.Background(), c, tt.args)
+		c.w.Flush()
+		if !strings.HasPrefix(out.String(), tt.want) {
+			t.Errorf("%q = %q, want %s", tt.args, out.String(), tt.want)
+		}
+	}
+
+	// without an auth policy AUTH is an error and commands need none.
+	open := &respServer{node: &server{config: &config.Config{RESPTable: "redis"}, authn: allowAll{}, authz: allowAll{}}, logger: zap.NewNop()}
+	c = &respConn{w: bufio.NewWriter(&out), cursors: map[uint64]string{}}
+	out.Reset()
+	open.handleCommand(context.Background(), c, []string{"AUTH", "s3cret"})
+	c.w.Flush()
+	if !strings.HasPrefix(out.String(), "-ERR AUTH") {
+		t.Errorf("AUTH without a policy = %q, want an error", out.String())
+	}
+}
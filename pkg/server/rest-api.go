@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// The /v1 routes address rows by path rather than in the body:
+//
+//	GET    /v1/tables/{table}/keys?limit=&cursor=&consistency=&stream=&order=  scan
+//	GET    /v1/tables/{table}/keys?prefix=&delimiter=&limit=&cursor=           list keys
+//	GET    /v1/tables/{table}/keys/{key}?columns=a,b&min_index=                fetch
+//	PUT    /v1/tables/{table}/keys/{key}?replace=true                          write columns
+//	DELETE /v1/tables/{table}/keys/{key}?column=                               delete
+//
+// They are served by the same handlers as the /key requests, which get the
+// request body those would have.
+
+func (server *httpServer) handleTableScan(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, err := queryInt(q.Get("limit"))
+	if err != nil {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if q.Has("prefix") || q.Has("delimiter") {
+		server.handleListKeys(w, withJSONBody(r, map[string]interface{}{
+			"table":       pathParam(r, "table"),
+			"prefix":      q.Get("prefix"),
+			"delimiter":   q.Get("delimiter"),
+			"limit":       limit,
+			"cursor":      q.Get("cursor"),
+			"consistency": q.Get("consistency"),
+		}))
+		return
+	}
+	server.handleScan(w, withJSONBody(r, map[string]interface{}{
+		"table":       pathParam(r, "table"),
+		"limit":       limit,
+		"cursor":      q.Get("cursor"),
+		"consistency": q.Get("consistency"),
+		"stream":      q.Get("stream") == "true",
+		"order":       q.Get("order"),
+	}))
+}
+
+func (server *httpServer) handleRowGet(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	minIndex, err := queryInt(q.Get("min_index"))
+	if err != nil || minIndex < 0 {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var columns []string
+	if c := q.Get("columns"); c != "" {
+		columns = strings.Split(c, ",")
+	}
+	server.handleKeyFetch(w, withJSONBody(r, map[string]interface{}{
+		"table":     pathParam(r, "table"),
+		"key":       pathParam(r, "key"),
+		"min_index": minIndex,
+		"columns":   columns,
+	}))
+}
+
+// handleRowPut takes the columns to write as the body, a JSON object.
+func (server *httpServer) handleRowPut(w http.ResponseWriter, r *http.Request) {
+	columns := map[string]string{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&columns); err != nil {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	server.handleRowUpdate(w, withJSONBody(r, map[string]interface{}{
+		"table":   pathParam(r, "table"),
+		"key":     pathParam(r, "key"),
+		"columns": columns,
+		"replace": r.URL.Query().Get("replace") == "true",
+	}))
+}
+
+func (server *httpServer) handleRowDelete(w http.ResponseWriter, r *http.Request) {
+	server.handleKeyDelete(w, withJSONBody(r, map[string]interface{}{
+		"table":  pathParam(r, "table"),
+		"key":    pathParam(r, "key"),
+		"column": r.URL.Query().Get("column"),
+	}))
+}
+
+func withJSONBody(r *http.Request, body interface{}) *http.Request {
+	buf, _ := json.Marshal(body)
+	r2 := r.Clone(r.Context())
+	r2.Body = io.NopCloser(bytes.NewReader(buf))
+	r2.ContentLength = int64(len(buf))
+	return r2
+}
+
+func queryInt(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(v)
+}
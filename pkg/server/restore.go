@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	dgConfig "github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/tools"
+	"go.uber.org/zap"
+)
+
+// restoredFile, in the raft data dir, records the snapshot the node seeded
+// its cluster with, see restoreSnapshot.
+const restoredFile = "restored-from"
+
+// restoredTables tie a snapshot to the cluster it was taken on, a cluster
+// restored from it starts without them: it gets its own ID and secrets, and
+// catalogs its own nodes and purges.
+var restoredTables = map[string]bool{
+	clusterTable: true,
+	nodesTable:   true,
+	purgesTable:  true,
+}
+
+// restoreSnapshot seeds the shard of a new cluster's bootstrap node with
+// the exported snapshot --restore-from, before the node host opens its data
+// dir.  The snapshot is cloned without the membership and identity of the
+// cluster it was taken on, then imported as the shard's state with this node
+// as the only member: the other nodes join the new cluster as usual and get
+// the data through raft.  It reports whether the node's shard was restored,
+// by this run or an earlier one, and must then be started as joined rather
+// than bootstrapped.
+func restoreSnapshot(config *dgConfig.NodeHostConfig, dataDir, from string, replicaID uint64, logger *zap.Logger) (bool, error) {
+	if _, err := os.Stat(filepath.Join(dataDir, restoredFile)); err == nil {
+		return true, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	if from == "" {
+		return false, nil
+	}
+	if entries, err := os.ReadDir(config.NodeHostDir); err == nil && len(entries) > 0 {
+		return false, fmt.Errorf("%s already holds a node, --restore-from only seeds a new one", config.NodeHostDir)
+	}
+
+	tmp, err := os.MkdirTemp(dataDir, "restore-")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(tmp)
+	cloned, err := multiraft.CloneSnapshot(tmp, from, func(e multiraft.SnapshotEntry) bool {
+		return !e.System && restoredTables[e.Table]
+	})
+	if err != nil {
+		return false, fmt.Errorf("cloning %s: %w", from, err)
+	}
+	members := map[uint64]string{replicaID: config.RaftAddress}
+	if err := tools.ImportSnapshot(*config, cloned, members, replicaID); err != nil {
+		return false, fmt.Errorf("importing %s: %w", from, err)
+	}
+	tmpFile := filepath.Join(dataDir, restoredFile+".tmp")
+	if err := os.WriteFile(tmpFile, []byte(from), 0600); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmpFile, filepath.Join(dataDir, restoredFile)); err != nil {
+		return false, err
+	}
+	logger.Info("restored the shard from a snapshot", zap.String("snapshot", from), zap.String("clone", filepath.Base(cloned)))
+	return true, nil
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/justinas/alice"
+)
+
+// router dispatches requests by method and path pattern with chi.  Patterns
+// are chi's: "{name}" matches any one segment, see pathParam, and a trailing
+// "*" matches the rest of the path, nothing included.  A path matching a
+// pattern only for other methods is answered with 405 and Allow headers, one
+// matching none with 404.
+type router struct {
+	mux *chi.Mux
+}
+
+func newRouter() *router {
+	mux := chi.NewMux()
+	mux.NotFound(func(w http.ResponseWriter, r *http.Request) { statusNotFound(w) })
+	return &router{mux: mux}
+}
+
+// handle routes method requests matching pattern to h, through middleware
+// in the order given.
+func (rt *router) handle(method, pattern string, h http.HandlerFunc, middleware ...alice.Constructor) {
+	handler := alice.New(middleware...).Then(h)
+	rt.mux.Method(method, pattern, handler)
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		rt.mux.Method(method, prefix, handler)
+	}
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// route the escaped path, so keys may hold an escaped "/", without its
+	// trailing slash.
+	rctx := chi.NewRouteContext()
+	rctx.RoutePath = "/" + strings.Trim(r.URL.EscapedPath(), "/")
+	rt.mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx)))
+}
+
+// pathParam returns the path segment a route's "{name}" matched, unescaped.
+func pathParam(r *http.Request, name string) string {
+	value, err := url.PathUnescape(chi.URLParam(r, name))
+	if err != nil {
+		return ""
+	}
+	return value
+}
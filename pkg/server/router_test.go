@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/justinas/alice"
+)
+
+func TestRouter(t *testing.T) {
+	rt := newRouter()
+	var got []string
+	tag := func(s string) alice.Constructor {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = append(got, s)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	row := func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Method+" "+pathParam(r, "table")+"/"+pathParam(r, "key"))
+	}
+	rt.handle(http.MethodGet, "/v1/tables/{table}/keys/{key}", row, tag("a"), tag("b"))
+	rt.handle(http.MethodPut, "/v1/tables/{table}/keys/{key}", row)
+	rt.handle(http.MethodPost, "/txn/*", func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, "txn "+r.URL.Path)
+	})
+
+	tests := []struct {
+		method, path string
+		code         int
+		want         string
+	}{
+		{http.MethodGet, "/v1/tables/users/keys/u%2F1", 200, "a,b,GET users/u/1"},
+		{http.MethodPut, "/v1/tables/users/keys/u1", 200, "PUT users/u1"},
+		{http.MethodPut, "/v1/tables/users/keys/u%2520/", 200, "PUT users/u%20"},
+		{http.MethodPost, "/txn/_begin", 200, "txn /txn/_begin"},
+		{http.MethodPost, "/txn", 200, "txn /txn"},
+		{http.MethodDelete, "/v1/tables/users/keys/u1", 405, ""},
+		{http.MethodGet, "/v1/tables/users/keys", 404, ""},
+		{http.MethodGet, "/v1/tables/users/keys/u1/extra", 404, ""},
+	}
+	for _, tt := range tests {
+		got = nil
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, w.Code, tt.code)
+		}
+		if s := strings.Join(got, ","); s != tt.want {
+			t.Errorf("%s %s: got %q, want %q", tt.method, tt.path, s, tt.want)
+		}
+		// chi lists the allowed methods in no particular order.
+		allow := append([]string(nil), w.Header().Values("Allow")...)
+		sort.Strings(allow)
+		if tt.code == 405 && strings.Join(allow, ", ") != "GET, PUT" {
+			t.Errorf("%s %s: Allow %q", tt.method, tt.path, allow)
+		}
+	}
+}
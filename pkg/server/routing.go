@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+)
+
+// routingHeader is set on key responses with the http address of the node
+// that owns the key's partition, so clients can go straight there next time.
+const routingHeader = "X-Expodb-Route"
+
+// partitionRoute describes which node owns a consistent hashing partition.
+type partitionRoute struct {
+	Partition int    `json:"partition"`
+	Owner     string `json:"owner"`
+	HTTPAddr  string `json:"http_addr"`
+}
+
+// shardMap is the routing table handed out to clients.  Clients compute the
+// partition of a key as fnv64a(routingKey(table, key)) % PartitionCount.
+type shardMap struct {
+	PartitionCount int              `json:"partition_count"`
+	Hash           string           `json:"hash"`
+	Partitions     []partitionRoute `json:"partitions"`
+}
+
+// routingKey is the byte string hashed onto the consistent hashing ring.
+func routingKey(table, key string) []byte {
+	return []byte(table + ":" + key)
+}
+
+// ShardMap returns the current partition → node ownership.
+func (n *server) ShardMap() (*shardMap, error) {
+	if n.consistent == nil {
+		return nil, fmt.Errorf("consistent hashing ring not initialized yet")
+	}
+	sm := &shardMap{
+		PartitionCount: numShards,
+		Hash:           "fnv64a",
+	}
+	for partID := 0; partID < numShards; partID++ {
+		route, ok := n.partitionRoute(partID)
+		if !ok {
+			continue
+		}
+		sm.Partitions = append(sm.Partitions, route)
+	}
+	return sm, nil
+}
+
+// RouteForKey returns the partition owning the given table/key.
+func (n *server) RouteForKey(table, key string) (partitionRoute, bool) {
+	if n.consistent == nil {
+		return partitionRoute{}, false
+	}
+	return n.partitionRoute(n.consistent.FindPartitionID(routingKey(table, key)))
+}
+
+// partitionRoute returns the partition's owner, or the next closest member
+// when the owner is in maintenance mode.
+func (n *server) partitionRoute(partID int) (partitionRoute, bool) {
+	candidates, err := n.consistent.GetClosestNForPartition(partID, len(n.consistent.GetMembers()))
+	if err != nil {
+		return partitionRoute{}, false
+	}
+	for _, member := range candidates {
+		node, ok := n.metadata.FindByID(member.String())
+		if !ok || node.InMaintenance() {
+			continue
+		}
+		return partitionRoute{
+			Partition: partID,
+			Owner:     node.ID(),
+			HTTPAddr:  node.HttpAddr(),
+		}, true
+	}
+	return partitionRoute{}, false
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"hash/fnv"
+	"testing"
+
+	"github.com/buraksezer/consistent"
+)
+
+func TestRouteForKey(t *testing.T) {
+	n := &server{metadata: NewMetadata()}
+	if _, err := n.ShardMap(); err == nil {
+		t.Error("ShardMap() before the ring is set up succeeded")
+	}
+	if _, ok := n.RouteForKey("t", "k"); ok {
+		t.Error("RouteForKey() before the ring is set up found a route")
+	}
+
+	n.consistent = consistent.New(nil, consistent.Config{PartitionCount: numShards, ReplicationFactor: 20, Load: 1.25, Hasher: hasher{}})
+	addrs := map[string]string{"node-1": "10.0.0.1:8000", "node-2": "10.0.0.2:8000", "node-3": "10.0.0.3:8000"}
+	for id, addr := range addrs {
+		n.metadata.Restore(&nodedata{id: id, httpAddr: addr, state: nodeAlive})
+		n.consistent.Add(myMember(id))
+	}
+	sm, err := n.ShardMap()
+	if err != nil {
+		t.Fatalf("ShardMap() error = %v", err)
+	}
+	if sm.PartitionCount != numShards || sm.Hash != "fnv64a" || len(sm.Partitions) != numShards {
+		t.Fatalf("ShardMap() = %d partitions of %d hashed with %s, want all %d with fnv64a", len(sm.Partitions), sm.PartitionCount, sm.Hash, numShards)
+	}
+	for i, p := range sm.Partitions {
+		if p.Partition != i || addrs[p.Owner] != p.HTTPAddr {
+			t.Errorf("ShardMap() partition %d = %+v, want partition %d owned by a member", i, p, i)
+		}
+	}
+
+	tests := []struct {
+		table, key string
+	}{
+		{"users", "alice"},
+		{"users", "bob"},
+		{"orders", "alice"},
+		{"", ""},
+		{"t:1", "k"},
+		{"t", "1:k"},
+	}
+	for _, tt := range tests {
+		// clients hash the same key, see partitionID in the client package.
+		f := fnv.New64a()
+		f.Write([]byte(tt.table + ":" + tt.key))
+		want := int(f.Sum64() % uint64(numShards))
+
+		route, ok := n.RouteForKey(tt.table, tt.key)
+		if !ok || route.Partition != want || route != sm.Partitions[want] {
+			t.Errorf("RouteForKey(%q, %q) = %+v, %v, want %+v", tt.table, tt.key, route, ok, sm.Partitions[want])
+		}
+
+		// a partition whose owner is in maintenance goes to another member.
+		owner, _ := n.metadata.FindByID(route.Owner)
+		owner.maintenance = true
+		moved, ok := n.RouteForKey(tt.table, tt.key)
+		if !ok || moved.Partition != want || moved.Owner == route.Owner || addrs[moved.Owner] != moved.HTTPAddr {
+			t.Errorf("RouteForKey(%q, %q) with %s in maintenance = %+v, %v, want another member", tt.table, tt.key, route.Owner, moved, ok)
+		}
+		owner.maintenance = false
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"github.com/epsniff/expodb/pkg/server/state-machines/simplestore"
+	"go.uber.org/zap"
+)
+
+// errRowForbidden is returned for writes to rows the principal's row filters
+// don't allow, before or after the write.
+var errRowForbidden = errors.New("row not allowed by the principal's row filters")
+
+// rowGuard holds the row filters restricting a request, a row is allowed
+// when it matches one of them.  A nil guard allows every row.
+type rowGuard []multiraft.RowFilter
+
+func (g rowGuard) allows(columns map[string]string) bool {
+	if g == nil {
+		return true
+	}
+	for i := range g {
+		if g[i].Match(columns) {
+			return true
+		}
+	}
+	return false
+}
+
+// columns adds the columns the filters look at to the columns a read asks
+// for, so they can be checked, and returns those it added.
+func (g rowGuard) columns(asked []string) ([]string, []string) {
+	if g == nil || len(asked) == 0 {
+		return asked, nil
+	}
+	have := map[string]bool{}
+	for _, col := range asked {
+		have[col] = true
+	}
+	var added []string
+	for _, f := range g {
+		if !have[f.Column] {
+			have[f.Column] = true
+			added = append(added, f.Column)
+		}
+	}
+	return append(append([]string(nil), asked...), added...), added
+}
+
+// checkRows is checkTable for the requests enforcing row filters, it returns
+// the request's rowGuard.
+func (server *httpServer) checkRows(w http.ResponseWriter, r *http.Request, action, table string) (rowGuard, bool) {
+	if !server.checkTableAccess(w, r, action, table) {
+		return nil, false
+	}
+	rows, ok := server.node.authz.(RowAuthorizer)
+	if !ok {
+		return nil, true
+	}
+	return rows.RowFilters(principalFromContext(r.Context()), action, table), true
+}
+
+// guardWrite checks a write to a row, whose columns become after(columns),
+// is allowed by guard both before and after it.  It returns the row's
+// version for the write's IfMatch, so the row can't change in between.
+func (n *server) guardWrite(ctx context.Context, guard rowGuard, table, key string, after func(columns map[string]string) map[string]string) (uint64, error) {
+	row, _, err := n.GetRow(ctx, table, key, 0, nil)
+	if err != nil && err != simplestore.ErrKeyNotFound {
+		return 0, err
+	}
+	before := map[string]string{}
+	var version uint64
+	if row != nil {
+		version = row.Version
+		for col, val := range row.Columns {
+			before[col] = val
+		}
+	}
+	if len(before) > 0 && !guard.allows(before) {
+		return 0, errRowForbidden
+	}
+	if cols := after(before); len(cols) > 0 && !guard.allows(cols) {
+		return 0, errRowForbidden
+	}
+	return version, nil
+}
+
+// rejectRowWrite answers a write guardWrite refused, it returns false when
+// err is another error.
+func (server *httpServer) rejectRowWrite(w http.ResponseWriter, r *http.Request, table string, err error) bool {
+	if !errors.Is(err, errRowForbidden) {
+		return false
+	}
+	server.logger.Info("Rejecting write outside the principal's rows",
+		zap.String("principal", principalFromContext(r.Context()).Name), zap.String("table", table))
+	w.WriteHeader(http.StatusForbidden)
+	return true
+}
+
+// setGuardedColumn is SetKeyVal, or PutIfAbsent, for a principal restricted
+// by guard.
+func (n *server) setGuardedColumn(ctx context.Context, guard rowGuard, table, key, col, val string, ifAbsent bool) (bool, uint64, error) {
+	version, err := n.guardWrite(ctx, guard, table, key, func(cols map[string]string) map[string]string {
+		if _, ok := cols[col]; !ok || !ifAbsent {
+			cols[col] = val
+		}
+		return cols
+	})
+	if err != nil {
+		return false, 0, err
+	}
+	kve := multiraft.KVData{Table: table, Row: key, Column: col, Val: val, IfAbsent: ifAbsent, IfMatch: &version}
+	index, err := n.applyWrite(ctx, kve)
+	if errors.Is(err, multiraft.ErrKeyExists) {
+		return false, 0, nil
+	}
+	return err == nil, index, err
+}
+
+// deleteGuardedKey is DeleteKey for a principal restricted by guard.
+func (n *server) deleteGuardedKey(ctx context.Context, guard rowGuard, table, key, col string) (uint64, error) {
+	version, err := n.guardWrite(ctx, guard, table, key, func(cols map[string]string) map[string]string {
+		if col == "" {
+			return nil
+		}
+		delete(cols, col)
+		return cols
+	})
+	if err != nil {
+		return 0, err
+	}
+	kve := multiraft.KVData{Op: multiraft.OpDelete, Table: table, Row: key, Column: col, IfMatch: &version}
+	if col == "" {
+		kve.Op = multiraft.OpDeleteRow
+	}
+	return n.applyWrite(ctx, kve)
+}
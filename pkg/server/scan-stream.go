@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+const mimeNDJSON = "application/x-ndjson"
+
+// streamChunk is how many rows a streamed scan reads and flushes at a time.
+var streamChunk = 1000
+
+// streamLine is the last line of a stream that failed after it started, the
+// scan can be resumed from Cursor, the key of the last row sent.
+type streamLine struct {
+	Error  string `json:"error"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// streamScan writes the rows of a scan as NDJSON, a row a line, streamChunk
+// rows at a time so neither end holds the whole table.  The query's limit
+// bounds the rows written, 0 for all of them.
+func (server *httpServer) streamScan(w http.ResponseWriter, r *http.Request, key []byte, query multiraft.ScanPageQuery, consistency string) {
+	table, after, limit := query.Table, query.After, query.Limit
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	sent := 0
+	for started := false; ; started = true {
+		n := streamChunk
+		if limit > 0 && limit-sent < n {
+			n = limit - sent
+		}
+		var page *multiraft.ScanPage
+		var err error
+		if isVirtualTable(table) {
+			page, err = server.node.VirtualScanPage(r.Context(), table, after, n)
+		} else {
+			page, _, err = server.node.scanPage(r.Context(), multiraft.ScanPageQuery{Table: table, After: after, Limit: n, Reverse: query.Reverse}, consistency)
+		}
+		if err != nil && !started {
+			server.logger.Error("Failed to scan table", zap.Error(err))
+			statusError(w, err)
+			return
+		}
+		if err != nil {
+			server.logger.Error("Failed streaming table scan", zap.String("table", table), zap.Int("rows", sent), zap.Error(err))
+			line := streamLine{Error: err.Error()}
+			if line.Cursor, err = signCursor(key, scanCursor{Table: table, After: after, Reverse: query.Reverse}); err != nil {
+				server.logger.Error("Failed to sign scan cursor", zap.Error(err))
+			}
+			enc.Encode(line)
+			return
+		}
+		if !started {
+			w.Header().Set("Content-Type", mimeNDJSON)
+			w.WriteHeader(http.StatusOK)
+		}
+		server.openRows(r, table, rowColumns(page.Rows)...)
+		for i := range page.Rows {
+			if err := enc.Encode(&page.Rows[i]); err != nil {
+				// the client went away.
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			server.logger.Info("Stopping streamed scan, flushing failed", zap.String("table", table), zap.Int("rows", sent), zap.Error(err))
+			return
+		}
+		sent += len(page.Rows)
+		if !page.More || len(page.Rows) == 0 || (limit > 0 && sent >= limit) {
+			return
+		}
+		after = page.Rows[len(page.Rows)-1].Key
+	}
+}
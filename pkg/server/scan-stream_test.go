@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/config"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+func TestStreamScan(t *testing.T) {
+	defer func(n int) { streamChunk = n }(streamChunk)
+	streamChunk = 2
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	// the replicas' stores are relative to the working directory.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	cfg := &config.Config{
+		NodeName:        "node-1",
+		SerfBindAddress: "127.0.0.1",
+		SerfBindPort:    freePort(t),
+		SerfDataDir:     dir + "/serf",
+		IsSerfSeed:      true,
+		HTTPBindAddress: "127.0.0.1",
+		RaftBindAddress: "127.0.0.1",
+		RaftBindPort:    freePort(t),
+		RaftDataDir:     dir + "/raft",
+		Bootstrap:       true,
+	}
+	srv, err := New(cfg, WithListener(ln))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := srv.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop(ctx)
+	for i := 0; i < 5; i++ {
+		for {
+			_, err := srv.SetKeyVal(ctx, "t1", fmt.Sprintf("k%d", i), "c", "v")
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				t.Fatalf("writing: %v", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	for _, tt := range []struct {
+		limit int
+		order string
+		want  []string
+	}{
+		{0, "", []string{"k0", "k1", "k2", "k3", "k4"}},
+		{3, "", []string{"k0", "k1", "k2"}},
+		{3, "desc", []string{"k4", "k3", "k2"}},
+	} {
+		body := fmt.Sprintf(`{"table":"t1", "stream":true, "limit":%d, "order":%q}`, tt.limit, tt.order)
+		resp, err := http.Post("http://"+ln.Addr().String()+"/v1/key/_scan", mimeJSON, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != mimeNDJSON {
+			t.Fatalf("limit %d: status %d, Content-Type %q", tt.limit, resp.StatusCode, ct)
+		}
+		var keys []string
+		for sc := bufio.NewScanner(resp.Body); sc.Scan(); {
+			row := multiraft.ScanRow{}
+			if err := json.Unmarshal(sc.Bytes(), &row); err != nil {
+				t.Fatalf("limit %d: line %q: %v", tt.limit, sc.Text(), err)
+			}
+			keys = append(keys, row.Key)
+		}
+		resp.Body.Close()
+		if fmt.Sprint(keys) != fmt.Sprint(tt.want) {
+			t.Errorf("limit %d: got rows %v, want %v", tt.limit, keys, tt.want)
+		}
+	}
+}
+
+// TestStreamFlush checks the rows of a stream reach the client chunk by
+// chunk through the wrappers of data requests, whatever the Accept.
+func TestStreamFlush(t *testing.T) {
+	server := &httpServer{logger: zap.NewNop(), node: &server{config: &config.Config{NodeName: "node-1"}}}
+	release := make(chan struct{})
+	flushed := make(chan error, 1)
+	ts := httptest.NewServer(server.negotiate(server.dataRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", mimeNDJSON)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, `{"key":"k0"}`)
+		flushed <- http.NewResponseController(w).Flush()
+		<-release
+		fmt.Fprintln(w, `{"key":"k1"}`)
+	}))))
+	defer ts.Close()
+
+	for _, accept := range []string{mimeJSON, mimeMsgpack} {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL, nil)
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := <-flushed; err != nil {
+			t.Fatalf("Accept %s: Flush() error = %v", accept, err)
+		}
+		line := make(chan string, 1)
+		br := bufio.NewReader(resp.Body)
+		go func() {
+			s, _ := br.ReadString('\n')
+			line <- s
+		}()
+		select {
+		case got := <-line:
+			if got != "{\"key\":\"k0\"}\n" {
+				t.Errorf("Accept %s: first line = %q", accept, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Accept %s: first chunk not received before the handler finished", accept)
+		}
+		release <- struct{}{}
+		rest, _ := io.ReadAll(br)
+		resp.Body.Close()
+		if string(rest) != "{\"key\":\"k1\"}\n" {
+			t.Errorf("Accept %s: rest = %q", accept, rest)
+		}
+	}
+}
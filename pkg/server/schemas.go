@@ -0,0 +1,244 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+// schemaChangeInterval is how often the leader looks for schema changes to
+// move forward.
+const schemaChangeInterval = time.Second
+
+// SetSchema gives a table a schema, see multiraft.TableSchema.  The table's
+// rows have to fit it, and a table with a schema is only changed through
+// ChangeSchema.
+func (n *server) SetSchema(ctx context.Context, schema multiraft.TableSchema) (uint64, error) {
+	if err := schema.Validate(); err != nil {
+		return 0, err
+	}
+	return n.applyWrite(ctx, multiraft.KVData{Op: multiraft.OpSetSchema, Table: schema.Table, Schema: &schema})
+}
+
+// DropSchema makes a table schemaless again, abandoning a change in flight.
+func (n *server) DropSchema(ctx context.Context, table string) (uint64, error) {
+	return n.applyWrite(ctx, multiraft.KVData{Op: multiraft.OpDropSchema, Table: table})
+}
+
+// ChangeSchema puts a column change in flight on a table.  It returns once
+// the change is prepared, the leader backfills the rows and activates it in
+// the background, see schemaChanges.
+func (n *server) ChangeSchema(ctx context.Context, table string, change multiraft.SchemaChange) (uint64, error) {
+	if err := change.Validate(); err != nil {
+		return 0, err
+	}
+	return n.applyWrite(ctx, multiraft.KVData{Op: multiraft.OpChangeSchema, Table: table, SchemaChange: &change})
+}
+
+// Schemas returns the schemas of every table having one.
+func (n *server) Schemas(ctx context.Context) ([]multiraft.TableSchema, error) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return nil, err
+	}
+	res, err := agent.Read(ctx, multiraft.SchemasQuery{})
+	if err != nil {
+		return nil, err
+	}
+	schemas, ok := res.([]multiraft.TableSchema)
+	if !ok {
+		return nil, fmt.Errorf("converting result to []multiraft.TableSchema: %T", res)
+	}
+	return schemas, nil
+}
+
+// schemaChange is the progress of a schema change in /status.
+type schemaChange struct {
+	Table      string `json:"table"`
+	Kind       string `json:"kind"`
+	Column     string `json:"column"`
+	Phase      string `json:"phase"`
+	Backfilled uint64 `json:"backfilled"`
+	Cursor     string `json:"cursor,omitempty"`
+}
+
+// schemaChanges returns the schema changes in flight as this node's replica
+// last saw them.
+func (n *server) schemaChanges() []schemaChange {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return nil
+	}
+	res, err := agent.ReadLocal(multiraft.SchemasQuery{})
+	if err != nil {
+		return nil
+	}
+	schemas, _ := res.([]multiraft.TableSchema)
+	var changes []schemaChange
+	for _, s := range schemas {
+		if c := s.Change; c != nil {
+			changes = append(changes, schemaChange{Table: s.Table, Kind: c.Kind, Column: c.Column, Phase: c.Phase, Backfilled: c.Backfilled, Cursor: c.Cursor})
+		}
+	}
+	return changes
+}
+
+// runSchemaChanges is run by the leader, see leaderLoop.
+func (n *server) runSchemaChanges(ctx context.Context) {
+	ticker := time.NewTicker(schemaChangeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := n.stepSchemaChanges(ctx); err != nil {
+			n.logger.Warn("schema change failed", zap.Error(err))
+		}
+	}
+}
+
+// stepSchemaChanges proposes steps until no change is in flight.  Each step
+// names the one it follows, so a new leader picks up where the old one
+// stopped.
+func (n *server) stepSchemaChanges(ctx context.Context) error {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return err
+	}
+	for ctx.Err() == nil {
+		schemas, err := n.Schemas(ctx)
+		if err != nil {
+			return err
+		}
+		changing := false
+		for _, s := range schemas {
+			if s.Change == nil {
+				continue
+			}
+			changing = true
+			step := multiraft.KVData{Op: multiraft.OpSchemaStep, Table: s.Table, Index: s.Change.Step}
+			if _, err := agent.Apply(ctx, step); err != nil {
+				return fmt.Errorf("changing column %s of %s: %w", s.Change.Column, s.Table, err)
+			}
+		}
+		if !changing {
+			return nil
+		}
+	}
+	return ctx.Err()
+}
+
+func (n *server) schemaRows(ctx context.Context) ([]multiraft.ScanRow, error) {
+	schemas, err := n.Schemas(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var rows []multiraft.ScanRow
+	for _, s := range schemas {
+		for _, col := range s.Columns {
+			state := "active"
+			if c := s.Change; c != nil && c.Column == col.Name {
+				state = c.Kind + " " + c.Phase
+			}
+			rows = append(rows, multiraft.ScanRow{Key: s.Table + "/" + col.Name, Columns: map[string]string{
+				"table":     s.Table,
+				"column":    col.Name,
+				"type":      col.Type,
+				"default":   col.Default,
+				"encrypted": strconv.FormatBool(col.Encrypted),
+				"state":     state,
+				"failed":    s.Failed,
+			}})
+		}
+		if c := s.Change; c != nil && c.Kind == multiraft.SchemaAddColumn {
+			rows = append(rows, multiraft.ScanRow{Key: s.Table + "/" + c.Column, Columns: map[string]string{
+				"table":     s.Table,
+				"column":    c.Column,
+				"type":      c.Type,
+				"default":   c.Default,
+				"encrypted": strconv.FormatBool(c.Encrypted),
+				"state":     c.Kind + " " + c.Phase,
+				"failed":    s.Failed,
+			}})
+		}
+	}
+	return rows, nil
+}
+
+// handleSchemaChange sets, changes or drops a table's schema, by path.
+func (server *httpServer) handleSchemaChange(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Table     string             `json:"table"`
+		Columns   []multiraft.Column `json:"columns"`
+		Kind      string             `json:"kind"`
+		Column    string             `json:"column"`
+		Type      string             `json:"type"`
+		Default   string             `json:"default"`
+		Encrypted bool               `json:"encrypted"`
+	}{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Table == "" {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	schema := multiraft.TableSchema{Table: req.Table, Columns: req.Columns}
+	change := multiraft.SchemaChange{Kind: req.Kind, Column: req.Column, Type: req.Type, Default: req.Default, Encrypted: req.Encrypted}
+	var invalid error
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/_create"):
+		invalid = schema.Validate()
+	case strings.HasSuffix(r.URL.Path, "/_change"):
+		invalid = change.Validate()
+	}
+	if invalid != nil {
+		server.logger.Error("Bad request, invalid schema", zap.Error(invalid))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !server.checkTable(w, r, ActionAdmin, req.Table) {
+		return
+	}
+	if !server.checkWritable(w) {
+		return
+	}
+	var index uint64
+	var err error
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/_create"):
+		index, err = server.node.SetSchema(r.Context(), schema)
+	case strings.HasSuffix(r.URL.Path, "/_change"):
+		index, err = server.node.ChangeSchema(r.Context(), req.Table, change)
+	default:
+		index, err = server.node.DropSchema(r.Context(), req.Table)
+	}
+	if errors.Is(err, multiraft.ErrWritesFrozen) {
+		server.logger.Info("Rejecting schema change", zap.Error(err))
+		statusUnavailable(w)
+		return
+	} else if errors.Is(err, multiraft.ErrSchemaViolation) {
+		server.logger.Info("Rejecting schema change", zap.Error(err))
+		statusError(w, err)
+		return
+	} else if err != nil {
+		server.logger.Error("Failed to change schema", zap.String("table", req.Table), zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	response := struct {
+		Index uint64 `json:"index"`
+	}{
+		Index: index,
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
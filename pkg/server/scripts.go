@@ -0,0 +1,330 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/errdefs"
+	"github.com/epsniff/expodb/pkg/script"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+// scriptAttempts bounds the runs of a script whose reads keep being
+// modified before its writes apply.
+const scriptAttempts = 5
+
+var (
+	ErrScriptConflict = errdefs.New(errdefs.ErrConflict, "rows the script read kept being modified")
+	// errScriptForbidden is returned when a script touches a table the
+	// principal can't read or write.
+	errScriptForbidden = errors.New("script touches a table the principal can't access")
+)
+
+// scriptAccess checks the tables a script touches on behalf of a client and
+// opens the encrypted values of the rows it reads.  A nil authorize allows
+// every user table, a nil open leaves values sealed.
+type scriptAccess struct {
+	authorize func(action, table string) error
+	open      func(table string, columns map[string]string)
+}
+
+// EvalScript runs a script, see package script, against the rows as of a
+// linearizable read and applies the columns it writes as a single OpBatch
+// entry, guarded by the versions of the rows it read: it applies as if the
+// script ran at its index, or not at all.  A script whose reads were
+// modified in between is run again after a jittered backoff, up to
+// scriptAttempts times in all.  Scripts writing nothing aren't proposed,
+// their reads are checked by reading the versions again.  It returns the
+// script's result and the index its writes applied at, or its reads were
+// made at.
+func (n *server) EvalScript(ctx context.Context, src string, keys, args []string, access scriptAccess) (interface{}, uint64, error) {
+	s, err := script.Compile(src)
+	if err != nil {
+		return nil, 0, errdefs.Wrap(errdefs.ErrInvalid, err)
+	}
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return nil, 0, err
+	}
+	backoff := txnRetryMinBackoff
+	for attempt := 1; attempt <= scriptAttempts; attempt++ {
+		if attempt > 1 {
+			// jittered, so the scripts that collided don't collide again.
+			timer := time.NewTimer(backoff/2 + time.Duration(rand.Int63n(int64(backoff))))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, 0, ctx.Err()
+			case <-timer.C:
+			}
+			backoff *= 2
+		}
+		index, err := agent.ReadIndex(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		host := &scriptHost{ctx: ctx, agent: agent, index: index, access: access,
+			rows: map[rowRef]map[string]string{}, versions: map[rowRef]uint64{}}
+		res, err := s.Run(host, keys, args)
+		var se *script.Error
+		if errors.As(err, &se) {
+			return nil, 0, errdefs.Wrap(errdefs.ErrInvalid, err)
+		} else if err != nil {
+			return nil, 0, err
+		}
+		if len(host.writes) == 0 {
+			unchanged, err := host.unchanged()
+			if err != nil {
+				return nil, 0, err
+			}
+			if unchanged {
+				return res, index, nil
+			}
+			continue
+		}
+		if err := n.sealWrites(host.writes); err != nil {
+			return nil, 0, err
+		}
+		applied, err := agent.Apply(ctx, multiraft.KVData{Op: multiraft.OpBatch, Writes: host.writes, Reads: host.reads()})
+		if errors.Is(err, multiraft.ErrVersionMismatch) {
+			n.logger.Debug("Rows read by script were modified, running it again", zap.Int("attempt", attempt))
+			continue
+		} else if err != nil {
+			return nil, 0, err
+		}
+		return res, applied, nil
+	}
+	return nil, 0, ErrScriptConflict
+}
+
+type rowRef struct {
+	table, key string
+}
+
+// scriptHost is the script.Host of a run.  Rows are read once, at index,
+// and the script's writes are buffered on top of them.
+type scriptHost struct {
+	ctx    context.Context
+	agent  raftAgent
+	index  uint64
+	access scriptAccess
+	// rows are the rows read, as the writes left them, versions the
+	// versions they were read at.
+	rows     map[rowRef]map[string]string
+	versions map[rowRef]uint64
+	writes   []multiraft.TxnWrite
+}
+
+func (h *scriptHost) check(action, table, key string) error {
+	if table == "" || key == "" {
+		return errdefs.New(errdefs.ErrInvalid, "script addresses a row without a table or key")
+	}
+	if strings.HasPrefix(table, "_") {
+		return fmt.Errorf("%w: system table %s", errScriptForbidden, table)
+	}
+	if h.access.authorize != nil {
+		if err := h.access.authorize(action, table); err != nil {
+			return fmt.Errorf("%w: %s on %s: %v", errScriptForbidden, action, table, err)
+		}
+	}
+	return nil
+}
+
+func (h *scriptHost) Row(table, key string) (map[string]string, error) {
+	ref := rowRef{table: table, key: key}
+	if cols, ok := h.rows[ref]; ok {
+		return cols, nil
+	}
+	if err := h.check(ActionRead, table, key); err != nil {
+		return nil, err
+	}
+	res, err := h.agent.ReadAtIndex(h.ctx, multiraft.RowQuery{Table: table, Row: key}, h.index)
+	if err != nil {
+		return nil, err
+	}
+	row, ok := res.(*multiraft.Row)
+	if !ok {
+		return nil, fmt.Errorf("converting result to *multiraft.Row: %T", res)
+	}
+	cols := make(map[string]string, len(row.Columns))
+	for col, val := range row.Columns {
+		cols[col] = val
+	}
+	if h.access.open != nil {
+		h.access.open(table, cols)
+	}
+	for _, w := range h.writes {
+		if w.Table == table && w.Row == key {
+			applyScriptWrite(cols, w)
+		}
+	}
+	h.rows[ref], h.versions[ref] = cols, row.Version
+	return cols, nil
+}
+
+func (h *scriptHost) Get(table, key, column string) (string, bool, error) {
+	cols, err := h.Row(table, key)
+	if err != nil {
+		return "", false, err
+	}
+	val, ok := cols[column]
+	return val, ok, nil
+}
+
+func (h *scriptHost) Set(table, key, column, value string) error {
+	return h.write(multiraft.TxnWrite{Table: table, Row: key, Column: column, Val: value})
+}
+
+// Delete deletes a column, or every column of the row, which reads it.
+func (h *scriptHost) Delete(table, key, column string) error {
+	if column != "" {
+		return h.write(multiraft.TxnWrite{Table: table, Row: key, Column: column, Delete: true})
+	}
+	cols, err := h.Row(table, key)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(cols))
+	for col := range cols {
+		names = append(names, col)
+	}
+	sort.Strings(names)
+	for _, col := range names {
+		if err := h.write(multiraft.TxnWrite{Table: table, Row: key, Column: col, Delete: true}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *scriptHost) write(w multiraft.TxnWrite) error {
+	if err := h.check(ActionWrite, w.Table, w.Row); err != nil {
+		return err
+	}
+	if w.Column == "" {
+		return errdefs.New(errdefs.ErrInvalid, "script writes a column without a name")
+	}
+	if len(h.writes) >= maxBatchWrites {
+		return errdefs.New(errdefs.ErrInvalid, fmt.Sprintf("a script writes at most %d columns", maxBatchWrites))
+	}
+	h.writes = append(h.writes, w)
+	if cols, ok := h.rows[rowRef{table: w.Table, key: w.Row}]; ok {
+		applyScriptWrite(cols, w)
+	}
+	return nil
+}
+
+func applyScriptWrite(cols map[string]string, w multiraft.TxnWrite) {
+	if w.Delete {
+		delete(cols, w.Column)
+	} else {
+		cols[w.Column] = w.Val
+	}
+}
+
+// reads returns the rows read, for the guard of the writes.
+func (h *scriptHost) reads() []multiraft.RowRead {
+	reads := make([]multiraft.RowRead, 0, len(h.versions))
+	for ref, version := range h.versions {
+		reads = append(reads, multiraft.RowRead{Table: ref.table, Row: ref.key, Version: version})
+	}
+	sort.Slice(reads, func(i, j int) bool {
+		if reads[i].Table != reads[j].Table {
+			return reads[i].Table < reads[j].Table
+		}
+		return reads[i].Row < reads[j].Row
+	})
+	return reads
+}
+
+// unchanged reports whether the rows read are still at the versions they
+// were read at, so the reads saw a consistent view of them.
+func (h *scriptHost) unchanged() (bool, error) {
+	for ref, version := range h.versions {
+		res, err := h.agent.ReadLocal(multiraft.RowQuery{Table: ref.table, Row: ref.key})
+		if err != nil {
+			return false, err
+		}
+		row, ok := res.(*multiraft.Row)
+		if !ok {
+			return false, fmt.Errorf("converting result to *multiraft.Row: %T", res)
+		}
+		if row.Version != version {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// handleEval runs a script, see EvalScript.  The script needs read on every
+// table it reads and write on every table it writes, without row filters.
+func (server *httpServer) handleEval(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Script string   `json:"script"`
+		Keys   []string `json:"keys"`
+		Args   []string `json:"args"`
+	}{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Script == "" {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !server.checkWritable(w) || !server.checkAPIKeyQuota(w, r) {
+		return
+	}
+	p := principalFromContext(r.Context())
+	access := scriptAccess{
+		authorize: func(action, table string) error {
+			if err := server.node.authz.Authorize(p, action, table); err != nil {
+				return err
+			}
+			if rows, ok := server.node.authz.(RowAuthorizer); ok && rows.RowFilters(p, action, table) != nil {
+				return errRowForbidden
+			}
+			return nil
+		},
+		open: func(table string, columns map[string]string) {
+			server.openRows(r, table, columns)
+		},
+	}
+	result, index, err := server.node.EvalScript(r.Context(), req.Script, req.Keys, req.Args, access)
+	var se *script.Error
+	switch {
+	case errors.As(err, &se):
+		server.logger.Info("Script failed", zap.Error(err))
+		respond(w, http.StatusBadRequest, map[string]string{"error": se.Error()}, server.logger)
+		return
+	case errors.Is(err, errScriptForbidden):
+		server.logger.Info("Rejecting script", zap.String("principal", p.Name), zap.Error(err))
+		w.WriteHeader(http.StatusForbidden)
+		return
+	case rejectedWrite(err):
+		server.logger.Info("Script writes rejected", zap.Error(err))
+		statusError(w, err)
+		return
+	case errors.Is(err, multiraft.ErrWritesFrozen):
+		statusUnavailable(w)
+		return
+	case err != nil:
+		server.logger.Error("Failed to run script", zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	response := struct {
+		Result interface{} `json:"result"`
+		Index  uint64      `json:"index"`
+	}{
+		Result: result,
+		Index:  index,
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
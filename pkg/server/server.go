@@ -2,22 +2,34 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/buraksezer/consistent"
 	"github.com/epsniff/expodb/pkg/config"
+	"github.com/epsniff/expodb/pkg/fieldcrypt"
+	"github.com/epsniff/expodb/pkg/loggingutils"
 	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
 	serfagent "github.com/epsniff/expodb/pkg/server/agents/serf"
 	machines "github.com/epsniff/expodb/pkg/server/state-machines"
+	"github.com/epsniff/expodb/pkg/server/state-machines/apikeys"
+	"github.com/epsniff/expodb/pkg/server/state-machines/counters"
+	"github.com/epsniff/expodb/pkg/server/state-machines/cron"
+	"github.com/epsniff/expodb/pkg/server/state-machines/featureflags"
 	"github.com/epsniff/expodb/pkg/server/state-machines/simplestore"
+	"github.com/epsniff/expodb/pkg/server/state-machines/sources"
+	"github.com/epsniff/expodb/pkg/server/triggers"
 	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/serf/serf"
 	"github.com/lni/dragonboat/v4"
@@ -25,11 +37,16 @@ import (
 	"github.com/lni/dragonboat/v4/raftio"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
 	shardID1  uint64 = 0
 	numShards int    = 5
+	// maxMemberWrites is how many catalog and event writes member events
+	// run at once on the leader.  Past it catalog writes wait and events
+	// are dropped, so a flood of joins can't pile up raft proposals.
+	maxMemberWrites = 32
 )
 
 type server struct {
@@ -46,43 +63,271 @@ type server struct {
 	raftAgentsMu sync.Mutex
 	raftAgents   map[uint64]raftAgent
 
+	// authn and authz check client requests, see SetAuth.
+	authn Authenticator
+	authz Authorizer
+
 	consistent *consistent.Consistent
 
-	replicaID uint64
+	// replicaID is this node's replica, its non-voting one once demoted, see
+	// autopilot.go.
+	replicaID atomic.Uint64
+
+	// maintenance is set while the node is in read-only maintenance mode.
+	maintenance atomic.Bool
+	// draining is set once the node is shutting down, inFlight counts the
+	// HTTP requests being served, see Drain.
+	draining atomic.Bool
+	inFlight atomic.Int64
+	// leaveOnce guards leaving the gossip, see leaveGossip.
+	leaveOnce sync.Once
+	// raftMux carries raft on the HTTP port with --single-port, else nil.
+	raftMux *multiraft.MuxTransport
+	// dataDirLocks hold the data dirs for this process, see openDataDir.
+	dataDirLocks []*os.File
+	// clusterID is the ID of the cluster this node belongs to, empty until
+	// it adopts one, see cluster-id.go.
+	clusterIDMu sync.Mutex
+	clusterID   string
+	// diskLow is set while a data dir is low on free space, see checkDisk.
+	diskLow atomic.Bool
+
+	// shardStarted is when the raft agent was started, guarded by raftAgentsMu.
+	shardStarted time.Time
+
+	secretsMu      sync.Mutex
+	cursorKeyCache []byte
+
+	// replication tracks snapshot shipments to the standby cluster.
+	replication replicationState
+	// archive tracks the shipments to the log archive, see archive.go.
+	archive archiveState
+	// replicaMu serializes snapshots shipped in by the primary.
+	replicaMu sync.Mutex
+	// promoted caches that this standby has been promoted, it is one-way.
+	promoted atomic.Bool
+	// txnStats tracks transaction outcomes and lock contention.
+	txnStats txnStats
+	// txnSessions holds the interactive transactions begun on this node.
+	txnSessions txnSessions
+	// peers tracks the replication of the shard's peers, see peer-metrics.go.
+	peers peerStats
+	// voterJoins queues the voters the leader is adding, see voter-joins.go.
+	voterJoins voterJoins
+	// apiKeyUsage is the usage of the API keys served by this node, see
+	// apikeys.go.
+	apiKeyUsage apiKeyUsage
+	// columnKeys seal the values of encrypted columns, nil without
+	// --column-keys, see encryption.go.
+	columnKeys *fieldcrypt.Keyring
+	// rejoinMu serializes rejoining as a non-voter, see autopilot.go.
+	rejoinMu sync.Mutex
+	// sourceFetches shares the fetches of rows read through, see sources.go.
+	sourceFetches singleflight.Group
+	// memberWrites bounds the writes the leader runs in the background for
+	// member events, see persistNodeIfLeader and recordEventIfLeader.
+	memberWrites chan struct{}
+
+	// hooks are the callbacks registered with OnLeaderChange and the like.
+	hooks hooks
+
+	// listener and fsms are set with WithListener and WithFSM.
+	listener net.Listener
+	fsms     []machines.Registration
+	// triggers are the built in triggers and those set with WithTrigger.
+	triggers map[string]multiraft.TriggerFunc
+	// logLevels are set with WithLogLevels, nil if not.
+	logLevels *loggingutils.Levels
+	// stop ends what Start started, done is closed once it has with the
+	// error it ended with in runErr.
+	stop   context.CancelFunc
+	done   chan struct{}
+	runErr error
 }
 
 type raftAgent interface {
 	AddVoter(replicaID uint64, peerAddress string) error
-	Apply(val machines.RaftEntry) error
-	Read(query interface{}) (interface{}, error)
+	AddWitness(replicaID uint64, peerAddress string) error
+	AddNonVoter(replicaID uint64, peerAddress string) error
+	RemoveReplica(replicaID uint64) error
+	Apply(ctx context.Context, val machines.RaftEntry) (uint64, error)
+	Read(ctx context.Context, query interface{}) (interface{}, error)
+	ReadAtIndex(ctx context.Context, query interface{}, minIndex uint64) (interface{}, error)
+	ReadLocal(query interface{}) (interface{}, error)
+	ReadIndex(ctx context.Context) (uint64, error)
+	AppliedIndex() (uint64, error)
+	Members(ctx context.Context) (map[uint64]string, error)
+	Witnesses(ctx context.Context) (map[uint64]string, error)
+	NonVoters(ctx context.Context) (map[uint64]string, error)
 	IsLeader() (bool, error)
-	//LeaderAddress() string
+	LeaderAddress() string
+	LeaderChanges() <-chan multiraft.LeaderInfo
+	LeaderUpdated(info raftio.LeaderInfo)
+	ReplayProgress(ctx context.Context) (multiraft.ReplayProgress, error)
+	RequestSnapshot(ctx context.Context) (uint64, error)
+	ExportSnapshot(ctx context.Context, dir string) (string, error)
+	SnapshotStats() multiraft.SnapshotStats
+	TransferLeadership(replicaID uint64) error
+	Leave() error
 	Shutdown() error
 }
 
-// GetByRowKey gets a value from the raft key value fsm
-func (n *server) GetByRowKey(table, rowKey string) (map[string]string, error) {
-	query := simplestore.Query{
-		Table:  table,
-		RowKey: rowKey,
+// GetByRowKey gets a row from the raft key value fsm, see GetRow.
+func (n *server) GetByRowKey(ctx context.Context, table, rowKey string, minIndex uint64) (map[string]string, uint64, error) {
+	row, index, err := n.GetRow(ctx, table, rowKey, minIndex, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return row.Columns, index, nil
+}
+
+// GetRow gets a row and its version from the raft key value fsm.  Rows are
+// read from a consistent view of the store, so a row written with SetRow is
+// never seen half applied.  When minIndex is zero the read is linearizable,
+// otherwise it is served locally once this replica has applied at least
+// minIndex.  The returned index is the replica's applied index at (or after)
+// the time of the read.  When columns is set only those are fetched.
+func (n *server) GetRow(ctx context.Context, table, rowKey string, minIndex uint64, columns []string) (*multiraft.Row, uint64, error) {
+	query := multiraft.RowQuery{
+		Table:   table,
+		Row:     rowKey,
+		Columns: columns,
+	}
+	agent := n.raftAgents[shardID1]
+	var val interface{}
+	var err error
+	if minIndex == 0 {
+		val, err = agent.Read(ctx, query)
+	} else {
+		val, err = agent.ReadAtIndex(ctx, query, minIndex)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, ok := val.(*multiraft.Row)
+	if !ok {
+		return nil, 0, fmt.Errorf("converting result to *multiraft.Row: %T", val)
+	}
+	index, err := agent.AppliedIndex()
+	if err != nil {
+		return nil, 0, err
 	}
-	val, err := n.raftAgents[shardID1].Read(query)
+	return resp, index, nil
+}
+
+// ScanTable returns every row of a table using a linearizable read.
+func (n *server) ScanTable(ctx context.Context, table string) (map[string]map[string]string, error) {
+	val, err := n.raftAgents[shardID1].Read(ctx, simplestore.ScanQuery{Table: table})
 	if err != nil {
 		return nil, err
 	}
-	resp, ok := val.(map[string]string)
+	rows, ok := val.(map[string]map[string]string)
 	if !ok {
-		return nil, fmt.Errorf("converting result to map[string]string: %T", val)
+		return nil, fmt.Errorf("converting result to map[string]map[string]string: %T", val)
 	}
-	return resp, err
+	return rows, nil
 }
 
 // SetKeyVal sets a value in the raft key value fsm, if we aren't the
-// current leader then forward the request onto the leader node.
-func (n *server) SetKeyVal(table, key, col, val string) error {
+// current leader then forward the request onto the leader node.  It returns
+// the raft index the write was applied at.
+func (n *server) SetKeyVal(ctx context.Context, table, key, col, val string) (uint64, error) {
 	//kve := simplestore.NewKeyValEvent(simplestore.UpdateRowOp, table, col, key, val)
-	kve := multiraft.KVData{Key: table + ":" + key + ":" + col, Val: val}
-	return n.raftAgents[shardID1].Apply(kve)
+	kve := multiraft.KVData{Table: table, Row: key, Column: col, Val: val}
+	return n.applyWrite(ctx, kve)
+}
+
+// PutIfAbsent sets a column of a row only if it doesn't exist yet, reporting
+// whether it created it.  The check and the write are one raft entry, so of
+// concurrent puts exactly one creates the column.
+func (n *server) PutIfAbsent(ctx context.Context, table, key, col, val string) (bool, uint64, error) {
+	kve := multiraft.KVData{Table: table, Row: key, Column: col, Val: val, IfAbsent: true}
+	index, err := n.applyWrite(ctx, kve)
+	if errors.Is(err, multiraft.ErrKeyExists) {
+		return false, 0, nil
+	}
+	return err == nil, index, err
+}
+
+// SetRow writes the given columns of a row in a single raft entry, so readers
+// see either none or all of them.  When replace is set the row's other
+// columns are deleted in the same entry.  A non nil ifMatch only applies the
+// write if the row's version (the index it was last modified at) is still
+// *ifMatch, failing with multiraft.ErrVersionMismatch otherwise.
+func (n *server) SetRow(ctx context.Context, table, key string, columns map[string]string, replace bool, ifMatch *uint64) (uint64, error) {
+	if len(columns) == 0 {
+		return 0, fmt.Errorf("setting row %s/%s: no columns given", table, loggingutils.Redact(table, key))
+	}
+	kve := multiraft.KVData{Op: multiraft.OpSetRow, Table: table, Row: key, Columns: columns, IfMatch: ifMatch}
+	if replace {
+		kve.Op = multiraft.OpReplaceRow
+	}
+	return n.applyWrite(ctx, kve)
+}
+
+// DeleteKey deletes a column of a row, or the whole row when col is empty.
+// Deleted keys leave tombstones that are garbage collected by the leader.
+func (n *server) DeleteKey(ctx context.Context, table, key, col string) (uint64, error) {
+	kve := multiraft.KVData{Op: multiraft.OpDelete, Table: table, Row: key, Column: col}
+	if col == "" {
+		kve.Op = multiraft.OpDeleteRow
+	}
+	return n.applyWrite(ctx, kve)
+}
+
+// DeletePrefix deletes every row of a table whose key starts with prefix, in a
+// single raft entry.  An empty prefix empties the table.
+func (n *server) DeletePrefix(ctx context.Context, table, prefix string) (uint64, error) {
+	kve := multiraft.KVData{Op: multiraft.OpDeletePrefix, Table: table, Row: prefix}
+	return n.applyWrite(ctx, kve)
+}
+
+// DeleteRange deletes every row of a table whose key sorts at or after from
+// and before to, in a single raft entry.  An empty to deletes up to the end
+// of the table.
+func (n *server) DeleteRange(ctx context.Context, table, from, to string) (uint64, error) {
+	kve := multiraft.KVData{Op: multiraft.OpDeleteRange, Table: table, Row: from, Val: to}
+	return n.applyWrite(ctx, kve)
+}
+
+// DeleteWhere deletes every row of a table whose key starts with prefix and
+// that matches filter, in a single raft entry the FSM expands.
+func (n *server) DeleteWhere(ctx context.Context, table, prefix string, filter multiraft.RowFilter) (uint64, error) {
+	if err := filter.Validate(); err != nil {
+		return 0, err
+	}
+	kve := multiraft.KVData{Op: multiraft.OpDeleteWhere, Table: table, Row: prefix, Filter: &filter}
+	return n.applyWrite(ctx, kve)
+}
+
+// IncrCounter atomically adds delta to a named counter.
+func (n *server) IncrCounter(ctx context.Context, name string, delta int64) (uint64, error) {
+	return n.raftAgents[shardID1].Apply(ctx, counters.IncrEvent{Name: name, Delta: delta})
+}
+
+// GetCounter reads a named counter using a linearizable read.
+func (n *server) GetCounter(ctx context.Context, name string) (int64, error) {
+	query := machines.NamedQuery{Machine: counters.FSMName, Query: counters.Query{Name: name}}
+	val, err := n.raftAgents[shardID1].Read(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	count, ok := val.(int64)
+	if !ok {
+		return 0, fmt.Errorf("converting result to int64: %T", val)
+	}
+	return count, nil
+}
+
+// ApplyFSM proposes an entry to a state machine registered with WithFSM.
+func (n *server) ApplyFSM(ctx context.Context, entry machines.RaftEntry) (uint64, error) {
+	return n.raftAgents[shardID1].Apply(ctx, entry)
+}
+
+// ReadFSM queries a state machine registered with WithFSM, by name, using a
+// linearizable read.
+func (n *server) ReadFSM(ctx context.Context, name string, query interface{}) (interface{}, error) {
+	return n.raftAgents[shardID1].Read(ctx, machines.NamedQuery{Machine: name, Query: query})
 }
 
 func parseNodeID(nodeName string) (uint64, error) {
@@ -95,10 +340,23 @@ func parseNodeID(nodeName string) (uint64, error) {
 	return replicaID, nil
 }
 
-func New(config *config.Config, logger *zap.Logger) (*server, error) {
-	if err := os.MkdirAll(config.SerfDataDir, 0700); err != nil {
-		return nil, fmt.Errorf("making serf data dir: %w", err)
+// New creates a node for config, it does nothing until started.
+func New(config *config.Config, opts ...Option) (*Server, error) {
+	o := &options{logger: zap.NewNop()}
+	for _, opt := range opts {
+		opt(o)
+	}
+	logger := o.logger
+	dataDirLocks, err := openDataDirs(config.ID(), config.SerfDataDir, config.RaftDataDir, multiraft.StorageDir())
+	if err != nil {
+		return nil, fmt.Errorf("opening data dir: %w", err)
+	}
+	// the serf agent gossips config.ClusterID, see cluster-id.go.
+	clusterID, err := loadClusterID(config.RaftDataDir, config.ClusterID, config.Bootstrap)
+	if err != nil {
+		return nil, fmt.Errorf("loading cluster ID: %w", err)
 	}
+	config.ClusterID = clusterID
 	serfAgent, err := serfagent.New(config, logger.Named("serf-agent"))
 	if err != nil {
 		return nil, fmt.Errorf("creating serf agent: %w", err)
@@ -108,6 +366,11 @@ func New(config *config.Config, logger *zap.Logger) (*server, error) {
 	if err != nil {
 		return nil, err
 	}
+	if demoted, err := readDemotedReplica(config.RaftDataDir); err != nil {
+		return nil, err
+	} else if demoted != 0 {
+		replicaID = demoted
+	}
 
 	ser := &server{
 		config: config,
@@ -115,15 +378,57 @@ func New(config *config.Config, logger *zap.Logger) (*server, error) {
 
 		metadata: NewMetadata(),
 
+		dataDirLocks: dataDirLocks,
+		clusterID:    clusterID,
+
 		serfAgent:    serfAgent,
 		raftNotifyCh: make(chan bool, 1),
-		replicaID:    replicaID,
 
-		raftAgents: map[uint64]raftAgent{},
-	}
+		raftAgents:   map[uint64]raftAgent{},
+		memberWrites: make(chan struct{}, maxMemberWrites),
+
+		authn: allowAll{},
+		authz: allowAll{},
 
-	if err := os.MkdirAll(config.RaftDataDir, 0700); err != nil {
-		return nil, fmt.Errorf("making raft data dir: %w", err)
+		listener:  o.listener,
+		fsms:      o.fsms,
+		triggers:  map[string]multiraft.TriggerFunc{},
+		logLevels: o.levels,
+	}
+	for name, fn := range triggers.Builtin {
+		ser.triggers[name] = fn
+	}
+	for name, fn := range o.triggers {
+		ser.triggers[name] = fn
+	}
+	ser.replicaID.Store(replicaID)
+	loggingutils.SetUnredactedTables(config.LogUnredacted)
+	if config.AuthPolicyFile != "" {
+		policy, err := loadTokenPolicy(config.AuthPolicyFile)
+		if err != nil {
+			return nil, err
+		}
+		ser.authn, ser.authz = policy, policy
+		if config.OIDCIssuer != "" {
+			ser.authn = firstOf{policy, &oidcAuthenticator{
+				issuer:        config.OIDCIssuer,
+				audience:      config.OIDCAudience,
+				policyClaim:   config.OIDCPolicyClaim,
+				claimPolicies: policy.Claims,
+				client:        &http.Client{},
+			}}
+		}
+	}
+	if len(config.ColumnKeys) > 0 {
+		if ser.columnKeys, err = fieldcrypt.NewKeyring(config.ColumnKeys); err != nil {
+			return nil, err
+		}
+	}
+	if o.authn != nil {
+		ser.authn = o.authn
+	}
+	if o.authz != nil {
+		ser.authz = o.authz
 	}
 
 	datadir := filepath.Join(config.RaftDataDir, "multigroup-data", config.ID())
@@ -134,11 +439,28 @@ func New(config *config.Config, logger *zap.Logger) (*server, error) {
 	//logger.GetLogger("transport").SetLevel(logger.WARNING)
 	//logger.GetLogger("grpc").SetLevel(logger.WARNING)
 	nhc := dgConfig.NodeHostConfig{
-		WALDir:            datadir,
-		NodeHostDir:       datadir,
-		RTTMillisecond:    200,
-		RaftAddress:       fmt.Sprintf("%s:%d", config.RaftBindAddress, config.RaftBindPort),
-		RaftEventListener: ser,
+		WALDir:              datadir,
+		NodeHostDir:         datadir,
+		RTTMillisecond:      200,
+		RaftAddress:         fmt.Sprintf("%s:%d", config.RaftBindAddress, config.RaftBindPort),
+		RaftEventListener:   ser,
+		SystemEventListener: &ser.peers,
+		NotifyCommit:        config.AckOnCommit(),
+	}
+	if config.SinglePort {
+		ser.raftMux = multiraft.NewMuxTransport()
+		nhc.Expert.TransportFactory = ser.raftMux
+		if config.CompressRPC() {
+			ser.raftMux.SetCompression(func(target string) bool {
+				node, ok := ser.metadata.FindByRaftAddr(target)
+				return ok && node.Compression() == config.RPCCompression
+			})
+		}
+	}
+	// a restored shard was bootstrapped by the import, see restore.go.
+	restored, err := restoreSnapshot(&nhc, config.RaftDataDir, config.RestoreFrom, replicaID, logger)
+	if err != nil {
+		return nil, fmt.Errorf("restoring snapshot: %w", err)
 	}
 	// create a NodeHost instance. it is a facade interface allowing access to
 	// all functionalities provided by dragonboat.
@@ -148,7 +470,7 @@ func New(config *config.Config, logger *zap.Logger) (*server, error) {
 	}
 	ser.nh = nh
 	if config.Bootstrap {
-		if err := ser.NewShard(config.Bootstrap, shardID1); err != nil {
+		if err := ser.NewShard(!restored, shardID1); err != nil {
 			return nil, fmt.Errorf("creating shard: %w", err)
 		}
 	}
@@ -156,15 +478,25 @@ func New(config *config.Config, logger *zap.Logger) (*server, error) {
 	// register ourselfs as a handler for serf events. See (n *server) HandleEvent(e serf.Event)
 	serfAgent.RegisterEventHandler(ser)
 
-	return ser, nil
+	return &Server{ser}, nil
 }
 
 func (n *server) NewShard(bootstrap bool, shardID uint64) error {
 	members := map[uint64]string{}
 	if bootstrap {
-		members[n.replicaID] = n.nh.RaftAddress()
+		members[n.replicaID.Load()] = n.nh.RaftAddress()
+	}
+	agentConfig := multiraft.Config{
+		SyncWrites:    n.config.SyncWrites(),
+		AckOnCommit:   n.config.AckOnCommit(),
+		Witness:       n.config.IsWitness(),
+		NonVoting:     isNonVotingReplica(n.replicaID.Load()),
+		StateMachines: append([]machines.Registration{counters.Registration, apikeys.Registration, featureflags.Registration, sources.Registration, cron.Registration}, n.fsms...),
+		Triggers:      n.triggers,
+		OnApply:       n.hooks.applied,
+		Logger:        n.logger.Named("raft-agent"),
 	}
-	shardAgent, err := multiraft.New(n.nh, n.replicaID, shardID, members)
+	shardAgent, err := multiraft.New(n.nh, n.replicaID.Load(), shardID, members, agentConfig)
 	if err != nil {
 		return fmt.Errorf("creating raft agent: %w", err)
 	}
@@ -174,13 +506,37 @@ func (n *server) NewShard(bootstrap bool, shardID uint64) error {
 	n.raftAgents = map[uint64]raftAgent{
 		shardID1: shardAgent,
 	}
+	n.shardStarted = time.Now()
+	go n.watchLeader(shardAgent)
+	// the replica is started by multiraft.New, a leader elected before it
+	// was registered here wasn't passed on by LeaderUpdated.
+	shardAgent.ReplayLeader()
 	return nil
 }
 
 func (n *server) LeaderUpdated(info raftio.LeaderInfo) {
+	n.raftAgentsMu.Lock()
+	agent, ok := n.raftAgents[info.ShardID]
+	n.raftAgentsMu.Unlock()
+	if ok {
+		agent.LeaderUpdated(info)
+	}
 	// TODO (ajr) When we have actual multiraft!
 	if info.ShardID == shardID1 {
-		n.raftNotifyCh <- info.LeaderID == n.replicaID
+		n.raftNotifyCh <- info.LeaderID == n.replicaID.Load()
+	}
+}
+
+// watchLeader keeps the metadata's view of the leader up to date.
+func (n *server) watchLeader(agent raftAgent) {
+	for info := range agent.LeaderChanges() {
+		n.metadata.SetLeader(info.Address)
+		n.logger.Info("raft leader changed",
+			zap.Uint64("leader.replica-id", info.ReplicaID),
+			zap.Uint64("term", info.Term),
+			zap.String("leader.raft-addr", info.Address),
+		)
+		n.hooks.leaderChanged(info)
 	}
 }
 
@@ -193,12 +549,31 @@ func (n *server) HandleEvent(e serf.Event) {
 		n.logger.Info("Server Serf Handler: Member Join", zap.String("serf-event", fmt.Sprintf("%+v", me.Members)))
 
 		for _, m := range me.Members {
-			n.consistent.Add(myMember(m.Name))
-			_, err := n.metadata.Add(m)
+			node, err := n.metadata.Add(m)
 			if err != nil {
 				n.logger.Error("Error processing metadata",
 					zap.String("serf.Member", fmt.Sprintf("%+v", m)), zap.Error(err),
 				)
+				continue
+			}
+			// witnesses hold no data, so they never own partitions.
+			if !node.IsWitness() {
+				n.consistent.Add(myMember(m.Name))
+			}
+			n.persistNodeIfLeader(node)
+			n.recordEventIfLeader(eventMemberJoined, node.ID(), node.Role())
+			n.hooks.memberJoined(node)
+			if n.isShardVoter(node.ID()) {
+				n.queueVoterJoin(node, true)
+			}
+		}
+	case serf.EventMemberUpdate:
+		me := e.(serf.MemberEvent)
+		for _, m := range me.Members {
+			if _, err := n.metadata.Add(m); err != nil {
+				n.logger.Error("Error processing metadata",
+					zap.String("serf.Member", fmt.Sprintf("%+v", m)), zap.Error(err),
+				)
 			}
 		}
 	case serf.EventMemberReap, serf.EventMemberLeave:
@@ -206,83 +581,145 @@ func (n *server) HandleEvent(e serf.Event) {
 		n.logger.Info("Server Serf Handler: Member Leave/Reap", zap.String("serf-event", fmt.Sprintf("%+v", me)))
 		for _, m := range me.Members {
 			n.consistent.Remove(m.Name)
+			if node, ok := n.metadata.SetState(m.Name, nodeLeft); ok {
+				n.persistNodeIfLeader(node)
+				n.recordEventIfLeader(eventMemberLeft, node.ID(), "")
+				n.hooks.memberLeft(node)
+			}
 		}
 	case serf.EventMemberFailed:
 		me := e.(serf.MemberEvent)
 		n.logger.Info("Server Serf Handler: Member Failed", zap.String("serf-event", fmt.Sprintf("%+v", me)))
+		for _, m := range me.Members {
+			if node, ok := n.metadata.SetState(m.Name, nodeFailed); ok {
+				n.persistNodeIfLeader(node)
+				n.recordEventIfLeader(eventMemberFailed, node.ID(), "")
+				n.hooks.memberLeft(node)
+			}
+		}
+	case serf.EventUser:
+		switch ue := e.(serf.UserEvent); ue.Name {
+		case demoteUserEvent:
+			n.handleDemotion(ue)
+		case leaveUserEvent:
+			n.handleLeaveIntent(ue)
+		case decommissionUserEvent:
+			n.handleDecommissionEvent(ue)
+		}
 	default:
 		n.logger.Info("Server Serf Handler: Unhandled type", zap.String("serf-event", fmt.Sprintf("%+v", e)))
 	}
 }
 
+// scheduleShards starts this node's replica of the shard once it is picked
+// as a voter and, on the leader, queues the other voters to join, see
+// voter-joins.go.  It runs every scheduleInterval, so voters are picked again
+// as the members change.
 func (n *server) scheduleShards(ctx context.Context) error {
 	timer := time.NewTimer(5 * time.Second)
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case <-timer.C:
-		// for i := 1; i < numShards+1; i++ {
-		if len(n.consistent.GetMembers()) < 3 {
-			n.logger.Warn("Not enough members to schedule shards", zap.Int("num_members", len(n.consistent.GetMembers())))
-			return nil
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
 		}
-		members, err := n.consistent.GetClosestNForPartition(int(shardID1), 3)
-		if err != nil {
-			return fmt.Errorf("getting closest members: %w", err)
+		if err := n.scheduleShard(ctx); err != nil {
+			return err
 		}
-		for _, member := range members {
-			// Handle removing ourselves from shards we're not a part of
-			if n.config.ID() == member.String() && n.raftAgents[uint64(shardID1)] == nil {
+		timer.Reset(scheduleInterval)
+	}
+}
+
+func (n *server) scheduleShard(ctx context.Context) error {
+	// for i := 1; i < numShards+1; i++ {
+	if len(n.consistent.GetMembers()) < 3 {
+		n.logger.Warn("Not enough members to schedule shards", zap.Int("num_members", len(n.consistent.GetMembers())))
+		return nil
+	}
+	_, err := n.shardAgent(shardID1)
+	hosted := err == nil
+	if n.config.IsWitness() {
+		// witnesses join every shard, the leader adds them as witnesses.
+		if !hosted {
+			if err := n.NewShard(false, shardID1); err != nil {
+				return fmt.Errorf("creating shard: %w", err)
+			}
+		}
+		return nil
+	}
+	members, err := n.shardVoters(shardID1)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if n.config.ID() == member {
+			if !hosted {
 				// We are the closest member to this shard, so we should schedule it.
-				if err := n.NewShard(false, uint64(shardID1)); err != nil {
+				if err := n.NewShard(false, shardID1); err != nil {
 					return fmt.Errorf("creating shard: %w", err)
 				}
-				break
-			}
-			for _, shardAgent := range n.raftAgents {
-				isLeader, err := shardAgent.IsLeader()
-				if err != nil {
-					return fmt.Errorf("checking if leader: %w", err)
-				}
-				if !isLeader {
-					continue
-				}
-
-				// TODO check bool for error
-				nodedata, _ := n.metadata.FindByID(member.String())
-				// join new peer as a raft voter
-				replicaID, err := parseNodeID(nodedata.ID())
-				if err != nil {
-					n.logger.Error("Error parsing nodedata id",
-						zap.String("peer.id", nodedata.ID()),
-						zap.String("peer.remoteaddr", nodedata.RaftAddr()),
-						zap.Error(err),
-					)
-					continue
-				}
-				err = n.raftAgents[shardID1].AddVoter(replicaID, nodedata.RaftAddr())
-				if err != nil {
-					n.logger.Error("Error joining peer to Raft",
-						zap.String("peer.id", nodedata.ID()),
-						zap.String("peer.remoteaddr", nodedata.RaftAddr()),
-						zap.Error(err),
-					)
-				}
-				n.logger.Info("Peer joined Raft", zap.String("peer.id", nodedata.ID()),
-					zap.String("peer.remoteaddr", nodedata.RaftAddr()))
+				return nil
 			}
+			continue
+		}
+		if node, ok := n.metadata.FindByID(member); ok {
+			n.queueVoterJoin(node, false)
 		}
 	}
-	timer.Reset(30 * time.Second)
+	n.joinWitnesses(ctx)
 	return nil
 }
 
-// Serve runs the server's agents and blocks until one of the following:
-// 1) An agent returns an error
-// 2) A Ctrl-C signal is catch.
-func (n *server) Serve() error {
+// Start runs the server's agents in the background until Stop is called or
+// one of them fails.  ctx only bounds starting them.
+func (n *server) Start(ctx context.Context) error {
+	if n.done != nil {
+		return fmt.Errorf("server already started")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ln := n.listener
+	if ln == nil {
+		var err error
+		httpAddr := &net.TCPAddr{IP: net.ParseIP(n.config.HTTPBindAddress), Port: n.config.HTTPBindPort}
+		if ln, err = net.Listen("tcp", httpAddr.String()); err != nil {
+			return fmt.Errorf("listening for http: %w", err)
+		}
+	}
+	if n.raftMux != nil {
+		ln = n.raftMux.Listener(ln)
+	}
+	listeners := []net.Listener{ln}
+	var respLn, memcacheLn net.Listener
+	var err error
+	if n.config.RESPBindPort != 0 && !n.config.IsWitness() {
+		if respLn, err = net.Listen("tcp", fmt.Sprintf("%s:%d", n.config.HTTPBindAddress, n.config.RESPBindPort)); err != nil {
+			ln.Close()
+			return fmt.Errorf("listening for RESP: %w", err)
+		}
+		listeners = append(listeners, respLn)
+	}
+	if n.config.MemcacheBindPort != 0 && !n.config.IsWitness() {
+		if n.authRequired() {
+			// the text protocol has no authentication, it would bypass the policy.
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("the memcached protocol can't be served with client authentication configured")
+		}
+		if memcacheLn, err = net.Listen("tcp", fmt.Sprintf("%s:%d", n.config.HTTPBindAddress, n.config.MemcacheBindPort)); err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("listening for memcache: %w", err)
+		}
+		listeners = append(listeners, memcacheLn)
+	}
+
 	ctx, can := context.WithCancel(context.Background())
-	defer can()
+	n.stop, n.done = can, make(chan struct{})
 	g, ctx := errgroup.WithContext(ctx)
 
 	// Run monitoring leadership
@@ -292,20 +729,69 @@ func (n *server) Serve() error {
 	g.Go(func() error {
 		return n.scheduleShards(ctx)
 	})
+	g.Go(func() error {
+		return n.gossipAppliedIndex(ctx)
+	})
+	g.Go(func() error {
+		n.adoptClusterID(ctx)
+		return nil
+	})
+	g.Go(func() error {
+		return n.reportReplay(ctx)
+	})
+	g.Go(func() error {
+		n.runAppliedSampler(ctx)
+		return nil
+	})
+	g.Go(func() error {
+		n.reapTxnSessions(ctx)
+		return nil
+	})
+	g.Go(func() error {
+		n.replicateAPIKeyUsage(ctx)
+		return nil
+	})
+	if !n.config.IsWitness() {
+		g.Go(func() error {
+			n.runPurges(ctx)
+			return nil
+		})
+	}
+	if n.config.DiskMinFreePercent > 0 {
+		g.Go(func() error {
+			n.watchDisk(ctx)
+			return nil
+		})
+	}
+	if n.config.StatsdAddr != "" {
+		g.Go(func() error {
+			n.pushStatsd(ctx)
+			return nil
+		})
+	}
 
 	// Run HTTP server
+	httpServer := &httpServer{
+		node:    n,
+		address: ln.Addr(),
+		logger:  n.logger.Named("http"),
+	}
 	g.Go(func() error {
-		// Construct HTTP Address
-		httpAddr := &net.TCPAddr{
-			IP:   net.ParseIP(n.config.HTTPBindAddress),
-			Port: n.config.HTTPBindPort,
-		}
-		httpServer := &httpServer{
-			node:    n,
-			address: httpAddr,
-			logger:  n.logger.Named("http"),
+		return httpServer.Serve(ctx, ln)
+	})
+	if respLn != nil {
+		respServer := &respServer{node: n, address: respLn.Addr(), logger: n.logger.Named("resp")}
+		go respServer.Serve(respLn)
+	}
+	if memcacheLn != nil {
+		memcacheServer := &memcacheServer{node: n, address: memcacheLn.Addr(), logger: n.logger.Named("memcache")}
+		go memcacheServer.Serve(memcacheLn)
+	}
+	g.Go(func() error {
+		<-ctx.Done()
+		for _, l := range listeners[1:] {
+			l.Close()
 		}
-		go httpServer.Start() // there isn't a wait to use a context to cancel an http server?? so just spin it off in a go routine for now.
 		return nil
 	})
 
@@ -333,7 +819,7 @@ func (n *server) Serve() error {
 		serfMembers := n.serfAgent.Serf().Members()
 		peers := []consistent.Member{}
 		for _, member := range serfMembers {
-			if member.Status != serf.StatusAlive {
+			if member.Status != serf.StatusAlive || member.Tags["node_role"] == config.NodeRoleWitness {
 				continue
 			}
 			peers = append(peers, myMember(member.Name))
@@ -348,22 +834,11 @@ func (n *server) Serve() error {
 		return nil
 	})
 
-	// Handler for Ctrl+C and then call n.serfag.Shutdown()
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt)
-	g.Go(func() error {
-		select {
-		case <-ctx.Done():
-		case <-signalChan:
-			can()
-		}
-		return nil
-	})
-
 	// Go routine to cleanup seft agent on shutdown
 	g.Go(func() error {
 		<-ctx.Done()
 		n.logger.Info("Stopping serf agent")
+		n.leaveGossip()
 		return n.serfAgent.Shutdown()
 	})
 
@@ -371,22 +846,80 @@ func (n *server) Serve() error {
 	g.Go(func() error {
 		<-ctx.Done()
 		n.logger.Info("Stopping raft agent")
-		var errors *multierror.Error
+		n.raftAgentsMu.Lock()
+		defer n.raftAgentsMu.Unlock()
+		if len(n.raftAgents) == 0 {
+			n.nh.Close() // the agents close it otherwise
+		}
+		var errs *multierror.Error
 		for _, agent := range n.raftAgents {
 			err := agent.Shutdown()
 			if err != nil {
-				err = multierror.Append(errors, err)
+				errs = multierror.Append(errs, err)
 			}
 		}
-		return errors.ErrorOrNil()
+		return errs.ErrorOrNil()
 	})
 
+	go func() {
+		if err := g.Wait(); !errors.Is(err, context.Canceled) {
+			n.runErr = err // agents stopping with the context isn't a failure
+		}
+		closeDataDirs(n.dataDirLocks)
+		close(n.done)
+	}()
 	n.logger.Info("Server started")
-	if err := g.Wait(); err != nil {
+	return nil
+}
+
+// Stop stops what Start started and waits until it has, or ctx is done.  It
+// returns the error an agent failed with, if one did.
+func (n *server) Stop(ctx context.Context) error {
+	if n.done == nil {
+		return nil
+	}
+	n.stop()
+	select {
+	case <-n.done:
+		return n.runErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Serve runs the server's agents and blocks until one of the following:
+// 1) An agent returns an error
+// 2) A SIGINT or SIGTERM is caught, the node is then drained for up to the
+// shutdown grace period (see Drain) unless a second signal comes first.
+func (n *server) Serve() error {
+	if err := n.Start(context.Background()); err != nil {
+		n.logger.Error("Failed to start", zap.Error(err))
+		return err
+	}
+	signalChan := make(chan os.Signal, 2)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-n.done:
+	case sig := <-signalChan:
+		n.logger.Info("Shutting down", zap.Stringer("signal", sig), zap.Duration("grace_period", n.config.ShutdownGracePeriod))
+		ctx, cancel := context.WithTimeout(context.Background(), n.config.ShutdownGracePeriod)
+		go func() {
+			select {
+			case <-signalChan:
+				n.logger.Warn("Second signal, skipping the rest of the grace period")
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		if err := n.Drain(ctx); err != nil {
+			n.logger.Warn("Drain cut short", zap.Error(err))
+		}
+		cancel()
+	}
+	if err := n.Stop(context.Background()); err != nil {
 		n.logger.Warn("Child workers returned an error", zap.Error(err))
 		return err
-	} else {
-		n.logger.Info("Clean shutdown")
 	}
+	n.logger.Info("Clean shutdown")
 	return nil
 }
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// sessionHeader carries a client's session, "<node id>:<raft index>", on
+	// requests and responses.  It is also set as sessionCookie, so load
+	// balancers can pin clients to the session's node by cookie.
+	sessionHeader = "X-Expodb-Session"
+	sessionCookie = "expodb_session"
+	sessionMaxAge = 24 * time.Hour
+)
+
+// clientSession binds a client to a coordinating node and the highest raft
+// index it has seen.  Reads with a min_index never go below the session's
+// index, so a client hopping between replicas still reads monotonically, and
+// interactive transactions are routed back to the node holding them.
+type clientSession struct {
+	Node  string
+	Index uint64
+}
+
+type sessionKey struct{}
+
+func (s clientSession) String() string {
+	return s.Node + ":" + strconv.FormatUint(s.Index, 10)
+}
+
+// parseSession reads the session from the header, or the cookie for clients
+// that only carry cookies.  A malformed session is ignored.
+func parseSession(r *http.Request) clientSession {
+	value := r.Header.Get(sessionHeader)
+	if value == "" {
+		if c, err := r.Cookie(sessionCookie); err == nil {
+			value = c.Value
+		}
+	}
+	i := strings.LastIndex(value, ":")
+	if i <= 0 {
+		return clientSession{}
+	}
+	index, err := strconv.ParseUint(value[i+1:], 10, 64)
+	if err != nil {
+		return clientSession{}
+	}
+	return clientSession{Node: value[:i], Index: index}
+}
+
+func sessionFromContext(ctx context.Context) clientSession {
+	s, _ := ctx.Value(sessionKey{}).(clientSession)
+	return s
+}
+
+// sessionNode returns the node a session is bound to when it can still
+// coordinate, otherwise the session is rebound to this node.
+func (n *server) sessionNode(s clientSession) string {
+	if s.Node != "" && s.Node != n.config.ID() {
+		if node, ok := n.metadata.FindByID(s.Node); ok && !node.InMaintenance() {
+			return s.Node
+		}
+	}
+	return n.config.ID()
+}
+
+// sessionWriter sets the session on the response once the status is known,
+// advanced to the index applied by this node.
+type sessionWriter struct {
+	http.ResponseWriter
+	node    *server
+	session clientSession
+	bound   bool
+	written bool
+}
+
+// bindSession binds the session of the response w writes to this node, for
+// requests that leave state on it, see handleTxnRequest.
+func bindSession(w http.ResponseWriter) {
+	for {
+		if sw, ok := w.(*sessionWriter); ok {
+			sw.bound = true
+			return
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = u.Unwrap()
+	}
+}
+
+func (w *sessionWriter) WriteHeader(status int) {
+	if !w.written {
+		w.written = true
+		s := clientSession{Node: w.node.sessionNode(w.session), Index: w.session.Index}
+		if w.bound {
+			s.Node = w.node.config.ID()
+		}
+		if agent, err := w.node.shardAgent(shardID1); err == nil {
+			if index, err := agent.AppliedIndex(); err == nil && index > s.Index {
+				s.Index = index
+			}
+		}
+		w.Header().Set(sessionHeader, s.String())
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: s.String(), Path: "/", MaxAge: int(sessionMaxAge.Seconds()), HttpOnly: true})
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *sessionWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// FlushError flushes the response through the writers it wraps, for
+// streamed responses, setting the session first.
+func (w *sessionWriter) FlushError() error {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *sessionWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+)
+
+const (
+	// drainPollInterval is how often Drain checks on the leadership transfer
+	// and the requests in flight.
+	drainPollInterval = 50 * time.Millisecond
+	// leaveUserEvent tells the leader a node is leaving for good, the
+	// payload is a leaveIntent.
+	leaveUserEvent = "expodb-leave"
+)
+
+// leaveIntent is announced by a node started with --leave-removes-replica
+// before it leaves the gossip, see leaveGossip.
+type leaveIntent struct {
+	ID        string `json:"id"`
+	ReplicaID uint64 `json:"replica_id"`
+}
+
+// Drain prepares the node to stop: /readyz turns 503 and new client requests
+// are refused, leadership is handed to another replica, the requests in
+// flight are waited for and the node leaves the gossip gracefully.  It gives
+// up on what's left once ctx is done, Stop is called either way.
+func (n *server) Drain(ctx context.Context) error {
+	n.draining.Store(true)
+	n.logger.Info("draining node")
+	if err := n.transferLeadershipAway(ctx); err != nil {
+		n.logger.Warn("failed to transfer leadership before shutting down", zap.Error(err))
+	}
+	if err := n.waitInFlight(ctx); err != nil {
+		n.logger.Warn("requests still in flight at shutdown", zap.Int64("in_flight", n.inFlight.Load()))
+	}
+	n.leaveGossip()
+	return ctx.Err()
+}
+
+// leaveGossip leaves the serf cluster gracefully, so peers see the node
+// leave rather than fail.  A node started with --leave-removes-replica first
+// asks the leader to remove its replica from the shard.  It is done once,
+// by Drain or on stopping.
+func (n *server) leaveGossip() {
+	n.leaveOnce.Do(func() {
+		if n.serfAgent.Serf() == nil {
+			return
+		}
+		if n.config.LeaveRemovesReplica {
+			payload, err := json.Marshal(leaveIntent{ID: n.config.ID(), ReplicaID: n.replicaID.Load()})
+			if err == nil {
+				n.serfAgent.UserEvent(leaveUserEvent, payload, false)
+			}
+		}
+		if err := n.serfAgent.Leave(); err != nil {
+			n.logger.Warn("failed to leave the serf cluster", zap.Error(err))
+		}
+	})
+}
+
+// handleLeaveIntent is run for leaveUserEvent.  The leader decommissions the
+// node and removes its replica right away, instead of counting it in the
+// quorum until an operator does.
+func (n *server) handleLeaveIntent(e serf.UserEvent) {
+	var intent leaveIntent
+	if err := json.Unmarshal(e.Payload, &intent); err != nil {
+		n.logger.Error("Bad leave event", zap.ByteString("payload", e.Payload), zap.Error(err))
+		return
+	}
+	agent, err := n.shardAgent(shardID1)
+	if err != nil || intent.ID == n.config.ID() {
+		return
+	}
+	if isLeader, err := agent.IsLeader(); err != nil || !isLeader {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), eventWriteTimeout)
+		defer cancel()
+		if err := n.removeLeavingReplica(ctx, agent, intent); err != nil {
+			n.logger.Error("Failed to remove leaving node", zap.String("peer.id", intent.ID), zap.Error(err))
+		}
+	}()
+}
+
+func (n *server) removeLeavingReplica(ctx context.Context, agent raftAgent, intent leaveIntent) error {
+	if err := n.Decommission(ctx, intent.ID); err != nil {
+		return err
+	}
+	members, err := agent.Members(ctx)
+	if err != nil {
+		return err
+	}
+	nonVoters, err := agent.NonVoters(ctx)
+	if err != nil {
+		return err
+	}
+	_, voter := members[intent.ReplicaID]
+	_, nonVoter := nonVoters[intent.ReplicaID]
+	if !voter && !nonVoter {
+		return nil
+	}
+	if err := agent.RemoveReplica(intent.ReplicaID); err != nil {
+		return err
+	}
+	n.logger.Info("Removed leaving node from Raft", zap.String("peer.id", intent.ID), zap.Uint64("replica-id", intent.ReplicaID))
+	n.recordEvent(ctx, eventReplicaRemoved, intent.ID, "left")
+	return nil
+}
+
+// transferLeadershipAway hands leadership of the shard to another replica,
+// when this node leads it, and waits until it has been taken.
+func (n *server) transferLeadershipAway(ctx context.Context) error {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return nil
+	}
+	if isLeader, err := agent.IsLeader(); err != nil || !isLeader {
+		return err
+	}
+	target, err := n.leadershipTransferTarget(ctx)
+	if err != nil {
+		return err
+	}
+	n.logger.Info("transferring leadership before shutting down", zap.Uint64("target", target))
+	if err := agent.TransferLeadership(target); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		if isLeader, err := agent.IsLeader(); err == nil && !isLeader {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitInFlight waits until the HTTP requests in flight are answered.
+func (n *server) waitInFlight(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for n.inFlight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// drainRequests refuses new client requests with a 503 while the node
+// drains and counts the ones in flight.  Health checks still answer.
+func (server *httpServer) drainRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/status" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		server.node.inFlight.Add(1)
+		defer server.node.inFlight.Add(-1)
+		if server.node.draining.Load() {
+			w.Header().Set("Connection", "close")
+			respond(w, http.StatusServiceUnavailable, map[string]string{"error": "node is shutting down"}, server.logger)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/config"
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+)
+
+// removeAgent is a transferAgent that records the replicas removed.
+type removeAgent struct {
+	transferAgent
+	leader  bool
+	removed []uint64
+}
+
+func (a *removeAgent) IsLeader() (bool, error) { return a.leader, nil }
+
+func (a *removeAgent) RemoveReplica(replicaID uint64) error {
+	a.removed = append(a.removed, replicaID)
+	return nil
+}
+
+func TestRemoveLeavingReplica(t *testing.T) {
+	srv, _ := startTestNode(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name        string
+		intent      leaveIntent
+		known       bool
+		wantRemoved []uint64
+		wantErr     bool
+	}{
+		{"voter", leaveIntent{ID: "node-2", ReplicaID: 2}, true, []uint64{2}, false},
+		{"non voter", leaveIntent{ID: "node-3", ReplicaID: 3}, true, []uint64{3}, false},
+		{"already removed", leaveIntent{ID: "node-4", ReplicaID: 4}, true, nil, false},
+		{"unknown node", leaveIntent{ID: "node-5", ReplicaID: 5}, false, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := &removeAgent{transferAgent: transferAgent{
+				members:   map[uint64]string{1: "n1:7000", 2: "n2:7000"},
+				nonVoters: map[uint64]string{3: "n3:7000"},
+			}}
+			if tt.known {
+				srv.metadata.Restore(&nodedata{id: tt.intent.ID, state: nodeAlive})
+			}
+			err := srv.removeLeavingReplica(ctx, agent, tt.intent)
+			if (err != nil) != tt.wantErr || !reflect.DeepEqual(agent.removed, tt.wantRemoved) {
+				t.Fatalf("removeLeavingReplica() = %v, removed %v, want error %v, removed %v", err, agent.removed, tt.wantErr, tt.wantRemoved)
+			}
+			if node, ok := srv.metadata.FindByID(tt.intent.ID); tt.known && (!ok || node.State() != nodeDecommissioned) {
+				t.Errorf("%s not decommissioned", tt.intent.ID)
+			}
+		})
+	}
+}
+
+func TestHandleLeaveIntent_Ignored(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		leader  bool
+	}{
+		{"bad payload", `{"id":`, true},
+		{"itself", `{"id":"node-1","replica_id":1}`, true},
+		{"follower", `{"id":"node-2","replica_id":2}`, false},
+	}
+	for _, tt := range tests {
+		agent := &removeAgent{leader: tt.leader}
+		n := &server{metadata: NewMetadata(), raftAgents: map[uint64]raftAgent{shardID1: agent}, config: &config.Config{NodeName: "node-1"}, logger: zap.NewNop()}
+		n.metadata.Restore(&nodedata{id: "node-2", state: nodeAlive})
+		n.handleLeaveIntent(serf.UserEvent{Name: leaveUserEvent, Payload: []byte(tt.payload)})
+		if node, _ := n.metadata.FindByID("node-2"); node.State() != nodeAlive || agent.removed != nil {
+			t.Errorf("%s: node-2 %s, removed %v, want left alone", tt.name, node.State(), agent.removed)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+const (
+	// sinkInterval is how often the leader delivers the outbox to the sinks.
+	sinkInterval = time.Second
+	// sinkBatch bounds the outbox entries delivered in one request.
+	sinkBatch = 100
+	// sinkTimeout bounds a delivery request, sinkMaxBackoff the wait before
+	// retrying a failing sink.
+	sinkTimeout    = 10 * time.Second
+	sinkMaxBackoff = time.Minute
+	// sinkMaxAttempts is how many times in a row a batch is posted to a
+	// failing sink before it is dead-lettered, see deadLetterSink.
+	sinkMaxAttempts = 10
+	// sinkNameHeader names the sink on delivery requests.
+	sinkNameHeader = "X-Expodb-Sink"
+)
+
+// sinkDelivery is an outbox entry as posted to a sink.  ID is unique across
+// the sink's deliveries: an entry is delivered again when the leader fails
+// before the sink's acknowledgement is replicated, the sink drops the IDs it
+// has already seen.
+type sinkDelivery struct {
+	ID      string             `json:"id"`
+	Index   uint64             `json:"index"`
+	Changes []multiraft.Change `json:"changes"`
+}
+
+// SetSink registers a webhook sink, or changes the url and tables of one.
+// A new sink is delivered the changes applied after it is registered.
+func (n *server) SetSink(ctx context.Context, sink multiraft.Sink) (uint64, error) {
+	if err := sink.Validate(); err != nil {
+		return 0, err
+	}
+	return n.applyWrite(ctx, multiraft.KVData{Op: multiraft.OpSetSink, Sink: &sink})
+}
+
+// DropSink drops a sink, dropping one that doesn't exist is a no-op.
+func (n *server) DropSink(ctx context.Context, name string) (uint64, error) {
+	return n.applyWrite(ctx, multiraft.KVData{Op: multiraft.OpDropSink, Row: name})
+}
+
+// Sinks returns the sinks with their offsets.
+func (n *server) Sinks(ctx context.Context) ([]multiraft.Sink, error) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return nil, err
+	}
+	res, err := agent.Read(ctx, multiraft.SinksQuery{})
+	if err != nil {
+		return nil, err
+	}
+	sinks, ok := res.([]multiraft.Sink)
+	if !ok {
+		return nil, fmt.Errorf("converting result to []multiraft.Sink: %T", res)
+	}
+	return sinks, nil
+}
+
+// runSinks is run by the leader, see leaderLoop.  It posts the outbox
+// entries after each sink's offset to it, in index order, and replicates the
+// new offset once the sink answers 2xx.  A failing sink is retried with
+// backoff and holds back neither the other sinks nor the writes.  A batch
+// failing sinkMaxAttempts times in a row is dead-lettered and the sink moves
+// on to the next one.
+func (n *server) runSinks(ctx context.Context) {
+	ticker := time.NewTicker(sinkInterval)
+	defer ticker.Stop()
+	type backoff struct {
+		failures int
+		next     time.Time
+	}
+	failing := map[string]*backoff{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !n.featureEnabled(featureCDC) {
+			continue
+		}
+		sinks, err := n.Sinks(ctx)
+		if err != nil {
+			n.logger.Warn("failed to list sinks", zap.Error(err))
+			continue
+		}
+		for _, sink := range sinks {
+			b := failing[sink.Name]
+			if b != nil && time.Now().Before(b.next) {
+				continue
+			}
+			err := n.deliverSink(ctx, sink)
+			if err == nil {
+				delete(failing, sink.Name)
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if b == nil {
+				b = &backoff{}
+				failing[sink.Name] = b
+			}
+			b.failures++
+			if b.failures >= sinkMaxAttempts {
+				dlErr := n.deadLetterSink(ctx, sink, b.failures, err)
+				if dlErr == nil {
+					n.logger.Warn("dead-lettered sink deliveries", zap.String("sink", sink.Name), zap.Int("failures", b.failures), zap.Error(err))
+					delete(failing, sink.Name)
+					continue
+				}
+				n.logger.Warn("failed to dead-letter sink deliveries", zap.String("sink", sink.Name), zap.Error(dlErr))
+			}
+			wait := sinkMaxBackoff
+			if b.failures < 6 {
+				wait = sinkInterval << b.failures
+			}
+			b.next = time.Now().Add(wait)
+			n.logger.Warn("failed to deliver to sink", zap.String("sink", sink.Name), zap.Int("failures", b.failures), zap.Error(err))
+		}
+	}
+}
+
+// deliverSink delivers the next batch of outbox entries to a sink.
+func (n *server) deliverSink(ctx context.Context, sink multiraft.Sink) error {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return err
+	}
+	entries, err := sinkBatchAfter(ctx, agent, sink)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	if deliveries := sinkDeliveries(sink, n.ClusterID(), entries); len(deliveries) > 0 {
+		if err := postDeliveries(ctx, sink, deliveries); err != nil {
+			return err
+		}
+	}
+	last := entries[len(entries)-1].Index
+	if _, err := agent.Apply(ctx, multiraft.KVData{Op: multiraft.OpAckSink, Row: sink.Name, Index: last}); err != nil {
+		return fmt.Errorf("acknowledging delivery: %w", err)
+	}
+	return nil
+}
+
+// sinkBatchAfter reads the next batch of outbox entries of a sink, after its
+// offset.
+func sinkBatchAfter(ctx context.Context, agent raftAgent, sink multiraft.Sink) ([]multiraft.OutboxEntry, error) {
+	res, err := agent.Read(ctx, multiraft.OutboxQuery{After: sink.Offset, Limit: sinkBatch})
+	if err != nil {
+		return nil, err
+	}
+	entries, ok := res.([]multiraft.OutboxEntry)
+	if !ok {
+		return nil, fmt.Errorf("converting result to []multiraft.OutboxEntry: %T", res)
+	}
+	return entries, nil
+}
+
+// sinkDeliveries returns the changes of entries the sink is delivered, an
+// entry without any is skipped.
+func sinkDeliveries(sink multiraft.Sink, clusterID string, entries []multiraft.OutboxEntry) []sinkDelivery {
+	var deliveries []sinkDelivery
+	for _, entry := range entries {
+		var changes []multiraft.Change
+		for _, c := range entry.Changes {
+			if sink.Delivers(c.Table) {
+				changes = append(changes, c)
+			}
+		}
+		if len(changes) == 0 {
+			continue
+		}
+		deliveries = append(deliveries, sinkDelivery{
+			ID:      fmt.Sprintf("%s:%s:%d", clusterID, sink.Name, entry.Index),
+			Index:   entry.Index,
+			Changes: changes,
+		})
+	}
+	return deliveries
+}
+
+// postDeliveries posts deliveries to the sink as a JSON array.
+func postDeliveries(ctx context.Context, sink multiraft.Sink, deliveries []sinkDelivery) error {
+	body, err := json.Marshal(deliveries)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, sinkTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sink.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(sinkNameHeader, sink.Name)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("sink answered %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+func (server *httpServer) handleSinks(w http.ResponseWriter, r *http.Request) {
+	sinks, err := server.node.Sinks(r.Context())
+	if err != nil {
+		server.logger.Error("Failed to list sinks", zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	respond(w, http.StatusOK, map[string][]multiraft.Sink{"sinks": sinks}, server.logger)
+}
+
+func (server *httpServer) handleSinkChange(w http.ResponseWriter, r *http.Request) {
+	req := multiraft.Sink{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	create := strings.HasSuffix(r.URL.Path, "/_create")
+	if create {
+		if err := req.Validate(); err != nil {
+			server.logger.Error("Bad request, invalid sink", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if !server.checkWritable(w) {
+		return
+	}
+	var index uint64
+	var err error
+	if create {
+		index, err = server.node.SetSink(r.Context(), req)
+	} else {
+		index, err = server.node.DropSink(r.Context(), req.Name)
+	}
+	if errors.Is(err, multiraft.ErrWritesFrozen) {
+		server.logger.Info("Rejecting sink change", zap.Error(err))
+		statusUnavailable(w)
+		return
+	} else if err != nil {
+		server.logger.Error("Failed to change sink", zap.String("sink", req.Name), zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	response := struct {
+		Index uint64 `json:"index"`
+	}{
+		Index: index,
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
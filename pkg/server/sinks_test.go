@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+)
+
+func TestSinkDeliveries(t *testing.T) {
+	entries := []multiraft.OutboxEntry{
+		{Index: 4, Changes: []multiraft.Change{{Op: "set", Table: "users", Row: "alice"}}},
+		{Index: 5, Changes: []multiraft.Change{{Op: "set", Table: "orders", Row: "1"}}},
+		{Index: 6, Changes: []multiraft.Change{
+			{Op: "set", Table: "orders", Row: "2"},
+			{Op: "delete_row", Table: "users", Row: "bob"},
+		}},
+	}
+	sink := multiraft.Sink{Name: "audit", URL: "http://audit", Tables: []string{"users"}}
+	deliveries := sinkDeliveries(sink, "c1", entries)
+	if len(deliveries) != 2 || deliveries[0].ID != "c1:audit:4" || deliveries[1].ID != "c1:audit:6" {
+		t.Fatalf("sinkDeliveries() = %+v, want entries 4 and 6", deliveries)
+	}
+	if changes := deliveries[1].Changes; len(changes) != 1 || changes[0].Row != "bob" {
+		t.Errorf("changes of entry 6 = %+v, want only the users change", changes)
+	}
+
+	var got []sinkDelivery
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(sinkNameHeader) != "audit" {
+			t.Errorf("%s = %q, want audit", sinkNameHeader, r.Header.Get(sinkNameHeader))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+	sink.URL = ts.URL
+	if err := postDeliveries(context.Background(), sink, deliveries); err != nil {
+		t.Fatalf("postDeliveries() error = %v", err)
+	}
+	if len(got) != 2 || got[1].Index != 6 {
+		t.Errorf("sink received %+v", got)
+	}
+	status = http.StatusServiceUnavailable
+	if err := postDeliveries(context.Background(), sink, deliveries); err == nil {
+		t.Errorf("postDeliveries() to a failing sink succeeded")
+	}
+}
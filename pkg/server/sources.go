@@ -0,0 +1,276 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/errdefs"
+	"github.com/epsniff/expodb/pkg/loggingutils"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	machines "github.com/epsniff/expodb/pkg/server/state-machines"
+	"github.com/epsniff/expodb/pkg/server/state-machines/sources"
+	"go.uber.org/zap"
+)
+
+const (
+	// sourceTimeout bounds a fetch from a table's source, sourceMaxBody the
+	// row it answers.
+	sourceTimeout = 5 * time.Second
+	sourceMaxBody = 1 << 20
+	// sourceExpiresColumn holds when a row fetched from a source expires, in
+	// unix seconds.
+	sourceExpiresColumn = "_expires"
+)
+
+// errSourceFailed is returned when a table's source can't be fetched from
+// and there is no stale row to serve instead.
+var errSourceFailed = errors.New("source fetch failed")
+
+// SetSource makes a table read through to an external source, or changes
+// the source of one.
+func (n *server) SetSource(ctx context.Context, source sources.Source) (uint64, error) {
+	if err := source.Validate(); err != nil {
+		return 0, errdefs.Wrap(errdefs.ErrInvalid, err)
+	}
+	return n.ApplyFSM(ctx, sources.Event{Source: source})
+}
+
+// DropSource stops a table reading through, the rows already fetched stay
+// until they expire.  Dropping a source that doesn't exist is a no-op.
+func (n *server) DropSource(ctx context.Context, table string) (uint64, error) {
+	return n.ApplyFSM(ctx, sources.Event{Source: sources.Source{Table: table}, Drop: true})
+}
+
+// Sources returns the tables' sources, by table.
+func (n *server) Sources(ctx context.Context) (map[string]sources.Source, error) {
+	res, err := n.ReadFSM(ctx, sources.FSMName, sources.ListQuery{})
+	if err != nil {
+		return nil, err
+	}
+	list, ok := res.(map[string]sources.Source)
+	if !ok {
+		return nil, fmt.Errorf("converting result to map[string]sources.Source: %T", res)
+	}
+	return list, nil
+}
+
+// tableSource returns the source of a table as this node's replica last saw
+// it, false when it has none.
+func (n *server) tableSource(table string) (sources.Source, bool) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return sources.Source{}, false
+	}
+	res, err := agent.ReadLocal(machines.NamedQuery{Machine: sources.FSMName, Query: sources.ListQuery{}})
+	if err != nil {
+		return sources.Source{}, false
+	}
+	list, _ := res.(map[string]sources.Source)
+	source, ok := list[table]
+	return source, ok
+}
+
+// GetRowThrough reads a row of a table with a source like GetRow, but a row
+// missing or expired is fetched from the source and written through raft
+// before it is returned.  Concurrent misses of a row on this node share one
+// fetch.  A row the source doesn't have is missing, an expired one the
+// source fails to answer for is served stale.
+func (n *server) GetRowThrough(ctx context.Context, source sources.Source, rowKey string, columns []string) (*multiraft.Row, uint64, error) {
+	row, index, err := n.GetRow(ctx, source.Table, rowKey, 0, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(row.Columns) == 0 || memcacheExpired(row.Columns[sourceExpiresColumn]) {
+		res, ferr, _ := n.sourceFetches.Do(source.Table+"\x00"+rowKey, func() (interface{}, error) {
+			return n.readThrough(ctx, source, rowKey, sourcedRow{row: row, index: index})
+		})
+		if ferr != nil {
+			return nil, 0, ferr
+		}
+		fetched := res.(sourcedRow)
+		row, index = fetched.row, fetched.index
+	}
+	return projectRow(row, columns), index, nil
+}
+
+// sourcedRow is a row as read through, shared by the callers of one fetch.
+type sourcedRow struct {
+	row   *multiraft.Row
+	index uint64
+}
+
+// readThrough fetches a row from its source and writes it through, cached is
+// the row as the table holds it.
+func (n *server) readThrough(ctx context.Context, source sources.Source, rowKey string, cached sourcedRow) (sourcedRow, error) {
+	columns, err := fetchSource(ctx, source, rowKey)
+	if err != nil && len(cached.row.Columns) > 0 {
+		n.logger.Warn("Failed to fetch from source, serving the stale row", zap.String("table", source.Table), zap.String("key", loggingutils.Redact(source.Table, rowKey)), zap.Error(err))
+		return cached, nil
+	} else if err != nil {
+		return sourcedRow{}, err
+	}
+	if columns == nil {
+		// the source doesn't have the row, neither should the table.
+		index := cached.index
+		if len(cached.row.Columns) > 0 {
+			if index, err = n.DeleteKey(ctx, source.Table, rowKey, ""); err != nil {
+				n.logger.Warn("Failed to delete row gone from source", zap.String("table", source.Table), zap.Error(err))
+				index = cached.index
+			}
+		}
+		return sourcedRow{row: &multiraft.Row{Columns: map[string]string{}}, index: index}, nil
+	}
+	if source.TTL > 0 {
+		columns[sourceExpiresColumn] = strconv.FormatInt(time.Now().Add(source.TTL).Unix(), 10)
+	}
+	index, err := n.SetRow(ctx, source.Table, rowKey, columns, true, nil)
+	if err != nil {
+		// the reader still gets the row, the next miss fetches it again.
+		n.logger.Warn("Failed to write through row fetched from source", zap.String("table", source.Table), zap.Error(err))
+		return sourcedRow{row: &multiraft.Row{Columns: columns}, index: cached.index}, nil
+	}
+	// read it back for its version, and its values sealed if encrypted.
+	row, index, err := n.GetRow(ctx, source.Table, rowKey, index, nil)
+	if err != nil {
+		return sourcedRow{}, err
+	}
+	return sourcedRow{row: row, index: index}, nil
+}
+
+// fetchSource gets a row from a source, nil when it answers 404.  The row is
+// a JSON object, its values that aren't strings become their JSON text.
+func fetchSource(ctx context.Context, source sources.Source, rowKey string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, sourceTimeout)
+	defer cancel()
+	u := strings.ReplaceAll(source.URL, sources.KeyPlaceholder, url.PathEscape(rowKey))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errSourceFailed, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errSourceFailed, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%w: source answered %s: %s", errSourceFailed, resp.Status, strings.TrimSpace(string(body)))
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, sourceMaxBody)).Decode(&fields); err != nil {
+		return nil, fmt.Errorf("%w: decoding row: %v", errSourceFailed, err)
+	}
+	columns := make(map[string]string, len(fields)+1)
+	for col, raw := range fields {
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			columns[col] = s
+		} else {
+			columns[col] = string(raw)
+		}
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("%w: source answered a row without columns", errSourceFailed)
+	}
+	return columns, nil
+}
+
+// projectRow keeps the given columns of a row, all of them when none are
+// given.
+func projectRow(row *multiraft.Row, columns []string) *multiraft.Row {
+	if len(columns) == 0 {
+		return row
+	}
+	projected := &multiraft.Row{Columns: make(map[string]string, len(columns)), Version: row.Version}
+	for _, col := range columns {
+		if val, ok := row.Columns[col]; ok {
+			projected.Columns[col] = val
+		}
+	}
+	return projected
+}
+
+func (server *httpServer) handleSources(w http.ResponseWriter, r *http.Request) {
+	list, err := server.node.Sources(r.Context())
+	if err != nil {
+		server.logger.Error("Failed to list sources", zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	type sourceView struct {
+		URL string `json:"url"`
+		TTL string `json:"ttl,omitempty"`
+	}
+	views := make(map[string]sourceView, len(list))
+	for table, source := range list {
+		view := sourceView{URL: source.URL}
+		if source.TTL > 0 {
+			view.TTL = source.TTL.String()
+		}
+		views[table] = view
+	}
+	respond(w, http.StatusOK, map[string]map[string]sourceView{"sources": views}, server.logger)
+}
+
+func (server *httpServer) handleSourceChange(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Table string `json:"table"`
+		URL   string `json:"url"`
+		TTL   string `json:"ttl"`
+	}{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Table == "" {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	source := sources.Source{Table: req.Table, URL: req.URL}
+	create := strings.HasSuffix(r.URL.Path, "/_create")
+	if create {
+		var err error
+		if req.TTL != "" {
+			source.TTL, err = time.ParseDuration(req.TTL)
+		}
+		if err == nil {
+			err = source.Validate()
+		}
+		if err != nil {
+			server.logger.Error("Bad request, invalid source", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if !server.checkWritable(w) {
+		return
+	}
+	var index uint64
+	var err error
+	if create {
+		index, err = server.node.SetSource(r.Context(), source)
+	} else {
+		index, err = server.node.DropSource(r.Context(), req.Table)
+	}
+	if err != nil {
+		server.logger.Error("Failed to change source", zap.String("table", req.Table), zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	response := struct {
+		Index uint64 `json:"index"`
+	}{
+		Index: index,
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"github.com/epsniff/expodb/pkg/server/state-machines/sources"
+)
+
+func TestFetchSource(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/users/a%2Fb":
+			w.Write([]byte(`{"name": "alice", "age": 30, "tags": ["x"]}`))
+		case "/users/gone":
+			w.WriteHeader(http.StatusNotFound)
+		case "/users/empty":
+			w.Write([]byte(`{}`))
+		default:
+			http.Error(w, "boom", http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+	source := sources.Source{Table: "users", URL: ts.URL + "/users/{key}"}
+	if err := source.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	columns, err := fetchSource(context.Background(), source, "a/b")
+	if err != nil {
+		t.Fatalf("fetchSource() error = %v", err)
+	}
+	if len(columns) != 3 || columns["name"] != "alice" || columns["age"] != "30" || columns["tags"] != `["x"]` {
+		t.Errorf("fetchSource() = %v, want strings as is and other values as JSON", columns)
+	}
+	if columns, err := fetchSource(context.Background(), source, "gone"); columns != nil || err != nil {
+		t.Errorf("fetchSource() of a 404 = %v, %v, want a miss", columns, err)
+	}
+	for _, key := range []string{"empty", "other"} {
+		if _, err := fetchSource(context.Background(), source, key); !errors.Is(err, errSourceFailed) {
+			t.Errorf("fetchSource(%q) error = %v, want errSourceFailed", key, err)
+		}
+	}
+}
+
+func TestSourceValidate(t *testing.T) {
+	for _, s := range []sources.Source{
+		{Table: "_schemas", URL: "http://src/{key}"},
+		{Table: "users", URL: "ftp://src/{key}"},
+		{Table: "users", URL: "http://src/users"},
+		{Table: "users", URL: "http://src/{key}", TTL: -1},
+	} {
+		if err := s.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", s)
+		}
+	}
+}
+
+func TestProjectRow(t *testing.T) {
+	row := &multiraft.Row{Columns: map[string]string{"a": "1", "b": "2"}, Version: 3}
+	if got := projectRow(row, nil); got != row {
+		t.Errorf("projectRow() without columns = %+v, want the row", got)
+	}
+	got := projectRow(row, []string{"b", "c"})
+	if len(got.Columns) != 1 || got.Columns["b"] != "2" || got.Version != 3 {
+		t.Errorf("projectRow(b, c) = %+v, want column b at version 3", got)
+	}
+}
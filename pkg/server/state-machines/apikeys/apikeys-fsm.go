@@ -0,0 +1,170 @@
+package apikeys
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	machines "github.com/epsniff/expodb/pkg/server/state-machines"
+)
+
+const (
+	FSMKey  = uint16(12)
+	FSMName = "apikeys"
+)
+
+// Registration registers the API keys state machine with a raft shard.
+var Registration = machines.Registration{
+	Key:  FSMKey,
+	Name: FSMName,
+	New:  func() machines.StateMachine { return New() },
+}
+
+func New() *KeyStateMachine {
+	return &KeyStateMachine{keys: map[string]*Key{}}
+}
+
+// KeyStateMachine keeps the API keys of the cluster's tenants, with their
+// limits and usage.
+type KeyStateMachine struct {
+	mutex sync.RWMutex
+	keys  map[string]*Key
+}
+
+// Key is an API key.  Only the SHA-256 Hash of its secret is kept.
+type Key struct {
+	Name     string   `json:"name"`
+	Hash     string   `json:"hash,omitempty"`
+	Policies []string `json:"policies,omitempty"`
+	// Attributes are those of the key's principal, see server.Principal.
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// Rate is the requests per second the key may make to each node,
+	// averaged over Burst requests.  0 is unlimited.
+	Rate  float64 `json:"rate,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+	// QuotaBytes is the bytes the key may write in total.  0 is unlimited.
+	QuotaBytes int64 `json:"quota_bytes,omitempty"`
+	Usage      Usage `json:"usage"`
+}
+
+// Usage counts what a key has done, cluster wide.
+type Usage struct {
+	Requests     int64 `json:"requests"`
+	BytesWritten int64 `json:"bytes_written"`
+}
+
+// Query reads a key, nil when there is none.
+type Query struct {
+	Name string
+}
+
+// ListQuery reads every key, by name.
+type ListQuery struct{}
+
+// Event is a change to the keys: Create creates or replaces a key, keeping
+// its usage, Drop drops the key named so, Usage adds to the usage of keys.
+type Event struct {
+	Create *Key             `json:",omitempty"`
+	Drop   string           `json:",omitempty"`
+	Usage  map[string]Usage `json:",omitempty"`
+}
+
+// Validate checks a key before it is created.
+func (k *Key) Validate() error {
+	if k.Name == "" {
+		return fmt.Errorf("api key needs a name")
+	}
+	for _, c := range k.Name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return fmt.Errorf("api key name %q isn't letters, digits, '_' and '-'", k.Name)
+		}
+	}
+	if k.Rate < 0 || k.Burst < 0 || k.QuotaBytes < 0 {
+		return fmt.Errorf("api key limits can't be negative")
+	}
+	return nil
+}
+
+// Marshal and encode the raft type
+func (e Event) Marshal() ([]byte, error) {
+	res, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return machines.EncodeEntry(FSMKey, res), nil
+}
+
+func (s *KeyStateMachine) Lookup(e interface{}) (interface{}, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	switch query := e.(type) {
+	case Query:
+		key, ok := s.keys[query.Name]
+		if !ok {
+			return (*Key)(nil), nil
+		}
+		copied := *key
+		return &copied, nil
+	case ListQuery:
+		keys := make([]Key, 0, len(s.keys))
+		for _, key := range s.keys {
+			keys = append(keys, *key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+		return keys, nil
+	}
+	return nil, fmt.Errorf("invalid query %#v", e)
+}
+
+// Apply raft log update.  Usage of keys that were dropped is ignored.
+func (s *KeyStateMachine) Apply(delta []byte) (interface{}, error) {
+	var e Event
+	if err := json.Unmarshal(delta, &e); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal api key event: %w", err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if e.Create != nil {
+		key := *e.Create
+		if old, ok := s.keys[key.Name]; ok {
+			key.Usage = old.Usage
+		} else {
+			key.Usage = Usage{}
+		}
+		s.keys[key.Name] = &key
+	}
+	if e.Drop != "" {
+		delete(s.keys, e.Drop)
+	}
+	for name, usage := range e.Usage {
+		if key, ok := s.keys[name]; ok {
+			key.Usage.Requests += usage.Requests
+			key.Usage.BytesWritten += usage.BytesWritten
+		}
+	}
+	return nil, nil
+}
+
+// Restore from a snapshot
+func (s *KeyStateMachine) Restore(data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keys := map[string]*Key{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("restore error on KeyStateMachine: %w", err)
+	}
+	s.keys = keys
+	return nil
+}
+
+// Save state as bytes for snapshot
+func (s *KeyStateMachine) Persist() ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	data, err := json.Marshal(s.keys)
+	if err != nil {
+		return nil, fmt.Errorf("KeyStateMachine persist error: %v", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,99 @@
+package counters
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	machines "github.com/epsniff/expodb/pkg/server/state-machines"
+)
+
+const (
+	FSMKey  = uint16(11)
+	FSMName = "counters"
+)
+
+// Registration registers the counters state machine with a raft shard.
+var Registration = machines.Registration{
+	Key:  FSMKey,
+	Name: FSMName,
+	New:  func() machines.StateMachine { return New() },
+}
+
+func New() *CounterStateMachine {
+	return &CounterStateMachine{
+		counters: map[string]int64{},
+	}
+}
+
+// CounterStateMachine keeps named int64 counters that are atomically
+// incremented through raft.
+type CounterStateMachine struct {
+	mutex    sync.RWMutex
+	counters map[string]int64
+}
+
+// Query reads a counter, missing counters read as zero.
+type Query struct {
+	Name string
+}
+
+// IncrEvent adds Delta to the named counter.
+type IncrEvent struct {
+	Name  string
+	Delta int64
+}
+
+// Marshal and encode the raft type
+func (e IncrEvent) Marshal() ([]byte, error) {
+	res, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return machines.EncodeEntry(FSMKey, res), nil
+}
+
+func (c *CounterStateMachine) Lookup(e interface{}) (interface{}, error) {
+	query, ok := e.(Query)
+	if !ok {
+		return nil, fmt.Errorf("invalid query %#v", e)
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.counters[query.Name], nil
+}
+
+// Apply raft log update, returns the counter's new value.
+func (c *CounterStateMachine) Apply(delta []byte) (interface{}, error) {
+	var e IncrEvent
+	if err := json.Unmarshal(delta, &e); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal counter event: %w", err)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.counters[e.Name] += e.Delta
+	return c.counters[e.Name], nil
+}
+
+// Restore from a snapshot
+func (c *CounterStateMachine) Restore(data []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	counters := map[string]int64{}
+	if err := json.Unmarshal(data, &counters); err != nil {
+		return fmt.Errorf("restore error on CounterStateMachine: %w", err)
+	}
+	c.counters = counters
+	return nil
+}
+
+// Save state as bytes for snapshot
+func (c *CounterStateMachine) Persist() ([]byte, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	data, err := json.Marshal(c.counters)
+	if err != nil {
+		return nil, fmt.Errorf("CounterStateMachine persist error: %v", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,58 @@
+package counters
+
+import (
+	"testing"
+
+	machines "github.com/epsniff/expodb/pkg/server/state-machines"
+)
+
+func TestCounterStateMachine_Apply(t *testing.T) {
+	tests := []struct {
+		event IncrEvent
+		want  int64
+	}{
+		{IncrEvent{Name: "hits", Delta: 1}, 1},
+		{IncrEvent{Name: "hits", Delta: 41}, 42},
+		{IncrEvent{Name: "misses", Delta: -3}, -3},
+		{IncrEvent{Name: "hits", Delta: -2}, 40},
+		{IncrEvent{Name: "hits", Delta: 0}, 40},
+	}
+	c := New()
+	for _, tt := range tests {
+		buf, err := tt.event.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, payload, ok := machines.DecodeEntry(buf)
+		if !ok || key != FSMKey {
+			t.Fatalf("IncrEvent.Marshal() encoded fsm key %d, %v, want %d", key, ok, FSMKey)
+		}
+		got, err := c.Apply(payload)
+		if err != nil || got != tt.want {
+			t.Errorf("Apply(%+v) = %v, %v, want %d", tt.event, got, err, tt.want)
+		}
+	}
+	if _, err := c.Apply([]byte("{")); err == nil {
+		t.Error("Apply() of a bad event succeeded")
+	}
+
+	data, err := c.Persist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := New()
+	if err := restored.Restore(data); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	for name, want := range map[string]int64{"hits": 40, "misses": -3, "never": 0} {
+		if got, err := restored.Lookup(Query{Name: name}); err != nil || got != want {
+			t.Errorf("Lookup(%s) after restore = %v, %v, want %d", name, got, err, want)
+		}
+	}
+	if _, err := restored.Lookup("hits"); err == nil {
+		t.Error("Lookup() of a query of another type succeeded")
+	}
+	if err := restored.Restore([]byte(`["hits"]`)); err == nil {
+		t.Error("Restore() of a bad snapshot succeeded")
+	}
+}
@@ -0,0 +1,202 @@
+package cron
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	machines "github.com/epsniff/expodb/pkg/server/state-machines"
+)
+
+const (
+	FSMKey  = uint16(15)
+	FSMName = "cron"
+)
+
+// Registration registers the scheduled jobs state machine with a raft shard.
+var Registration = machines.Registration{
+	Key:  FSMKey,
+	Name: FSMName,
+	New:  func() machines.StateMachine { return New() },
+}
+
+func New() *CronStateMachine {
+	return &CronStateMachine{jobs: map[string]*entry{}}
+}
+
+// Job runs Action with Args each time Schedule, see ParseSchedule, is due.
+// Created, in unix nanoseconds, is when it was set: it is first due after.
+type Job struct {
+	Name     string            `json:"name"`
+	Schedule string            `json:"schedule"`
+	Action   string            `json:"action"`
+	Args     map[string]string `json:"args,omitempty"`
+	Created  int64             `json:"created"`
+}
+
+// Validate checks a job can be scheduled, not that its action exists.
+func (j Job) Validate() error {
+	if j.Name == "" {
+		return fmt.Errorf("job has no name")
+	}
+	if j.Action == "" {
+		return fmt.Errorf("job %s has no action", j.Name)
+	}
+	s, err := ParseSchedule(j.Schedule)
+	if err != nil {
+		return err
+	}
+	if s.Next(time.Now()).IsZero() {
+		return fmt.Errorf("schedule %q is never due", j.Schedule)
+	}
+	return nil
+}
+
+// Run is the last run of a job: the slot, the time in unix nanoseconds it
+// was due at, claimed by Node with Token, and how it ended once Finished.
+type Run struct {
+	Slot     int64         `json:"slot"`
+	Node     string        `json:"node"`
+	Token    string        `json:"token"`
+	Started  int64         `json:"started"`
+	Finished bool          `json:"finished,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// Status is a job and its last run, nil until it first ran.
+type Status struct {
+	Job  Job  `json:"job"`
+	Last *Run `json:"last,omitempty"`
+}
+
+type entry struct {
+	Job  Job  `json:"job"`
+	Last *Run `json:"last,omitempty"`
+}
+
+// CronStateMachine keeps the scheduled jobs and their last runs, by name.
+type CronStateMachine struct {
+	mutex sync.RWMutex
+	jobs  map[string]*entry
+}
+
+// ListQuery reads the jobs' statuses, sorted by name.
+type ListQuery struct{}
+
+// Claim claims the run of a job for a slot.  It only applies when the job
+// exists and hasn't run for Slot or a later one, so two leaders can't both
+// run a slot: the one whose token the job holds afterwards runs it.
+type Claim struct {
+	Name  string `json:"name"`
+	Slot  int64  `json:"slot"`
+	Node  string `json:"node"`
+	Token string `json:"token"`
+	At    int64  `json:"at"`
+}
+
+// Done records how the run claimed with Token ended.  It only applies while
+// the job still holds Token.
+type Done struct {
+	Name     string        `json:"name"`
+	Token    string        `json:"token"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Event sets a job, keeping its last run, drops the job named Drop, claims
+// a run or ends one; exactly one is set.
+type Event struct {
+	Job   *Job   `json:"job,omitempty"`
+	Drop  string `json:"drop,omitempty"`
+	Claim *Claim `json:"claim,omitempty"`
+	Done  *Done  `json:"done,omitempty"`
+}
+
+// Marshal and encode the raft type
+func (e Event) Marshal() ([]byte, error) {
+	res, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return machines.EncodeEntry(FSMKey, res), nil
+}
+
+func (s *CronStateMachine) Lookup(e interface{}) (interface{}, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if _, ok := e.(ListQuery); ok {
+		list := make([]Status, 0, len(s.jobs))
+		for _, ent := range s.jobs {
+			st := Status{Job: ent.Job}
+			if ent.Last != nil {
+				last := *ent.Last
+				st.Last = &last
+			}
+			list = append(list, st)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Job.Name < list[j].Job.Name })
+		return list, nil
+	}
+	return nil, fmt.Errorf("invalid query %#v", e)
+}
+
+// Apply raft log update.
+func (s *CronStateMachine) Apply(delta []byte) (interface{}, error) {
+	var e Event
+	if err := json.Unmarshal(delta, &e); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cron event: %w", err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch {
+	case e.Job != nil:
+		if ent, ok := s.jobs[e.Job.Name]; ok {
+			ent.Job = *e.Job
+		} else {
+			s.jobs[e.Job.Name] = &entry{Job: *e.Job}
+		}
+	case e.Drop != "":
+		delete(s.jobs, e.Drop)
+	case e.Claim != nil:
+		ent, ok := s.jobs[e.Claim.Name]
+		if !ok || (ent.Last != nil && ent.Last.Slot >= e.Claim.Slot) {
+			return nil, nil
+		}
+		ent.Last = &Run{Slot: e.Claim.Slot, Node: e.Claim.Node, Token: e.Claim.Token, Started: e.Claim.At}
+	case e.Done != nil:
+		ent, ok := s.jobs[e.Done.Name]
+		if !ok || ent.Last == nil || ent.Last.Token != e.Done.Token {
+			return nil, nil
+		}
+		ent.Last.Finished = true
+		ent.Last.Error = e.Done.Error
+		ent.Last.Duration = e.Done.Duration
+	}
+	return nil, nil
+}
+
+// Restore from a snapshot
+func (s *CronStateMachine) Restore(data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	jobs := map[string]*entry{}
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return fmt.Errorf("restore error on CronStateMachine: %w", err)
+	}
+	s.jobs = jobs
+	return nil
+}
+
+// Save state as bytes for snapshot
+func (s *CronStateMachine) Persist() ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	data, err := json.Marshal(s.jobs)
+	if err != nil {
+		return nil, fmt.Errorf("CronStateMachine persist error: %v", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,153 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule tells when a job is due, in UTC.
+type Schedule interface {
+	// Next returns the first time the job is due after t, the zero time
+	// when it never is.
+	Next(t time.Time) time.Time
+}
+
+// maxScheduleYears bounds how far ahead a cron schedule is searched.
+const maxScheduleYears = 5
+
+var shorthands = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+// ParseSchedule parses a schedule: "@every <duration>" of at least a second,
+// one of @hourly, @daily, @weekly, @monthly and @yearly, or a cron
+// expression of five fields, minute, hour, day of month, month and day of
+// week (0 is Sunday), each "*", a value, a range "a-b" or a list of them,
+// with an optional "/step".
+func ParseSchedule(s string) (Schedule, error) {
+	s = strings.TrimSpace(s)
+	if rest, ok := strings.CutPrefix(s, "@every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", s, err)
+		}
+		if d < time.Second {
+			return nil, fmt.Errorf("schedule %q: interval is under a second", s)
+		}
+		return every(d), nil
+	}
+	if expr, ok := shorthands[s]; ok {
+		s = expr
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q: a cron expression has 5 fields, got %d", s, len(fields))
+	}
+	c := &cronSchedule{}
+	var err error
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+	sets := [5]*uint64{&c.minute, &c.hour, &c.dom, &c.month, &c.dow}
+	for i, f := range fields {
+		if *sets[i], err = parseField(f, bounds[i][0], bounds[i][1]); err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", s, err)
+		}
+	}
+	c.domAny, c.dowAny = fields[2] == "*", fields[4] == "*"
+	return c, nil
+}
+
+// every is due at the multiples of its interval since the unix epoch, so
+// every leader computes the same times.
+type every time.Duration
+
+func (e every) Next(t time.Time) time.Time {
+	d := int64(e)
+	n := t.UnixNano()
+	next := (n/d + 1) * d
+	if n < 0 && n%d != 0 {
+		next = (n / d) * d
+	}
+	return time.Unix(0, next).UTC()
+}
+
+// cronSchedule holds the values each field matches as bit sets.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are set for "*" day fields: cron matches either day
+	// field when both are restricted.
+	domAny, dowAny bool
+}
+
+func (c *cronSchedule) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(maxScheduleYears, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// parseField parses a field of a cron expression into the set of values it
+// matches, within lo and hi.
+func parseField(f string, lo, hi int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(f, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+		}
+		from, to := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("bad value in %q", part)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("bad range in %q", part)
+				}
+			} else if hasStep {
+				to = hi
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return 0, fmt.Errorf("%q is out of %d-%d", part, lo, hi)
+		}
+		for v := from; v <= to; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
@@ -0,0 +1,58 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	// a Wednesday
+	at := time.Date(2024, 1, 31, 10, 17, 30, 0, time.UTC)
+	tests := []struct {
+		schedule string
+		want     time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 31, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 31, 10, 30, 0, 0, time.UTC)},
+		{"5,10-12 3 * * *", time.Date(2024, 2, 1, 3, 5, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 1, 31, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2024, 2, 4, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 * *", time.Date(2024, 3, 30, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// both day fields restricted: either matches.
+		{"0 0 15 * 5", time.Date(2024, 2, 2, 0, 0, 0, 0, time.UTC)},
+		{"0 12 * * 1-5", time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)},
+		{"@every 1h", time.Date(2024, 1, 31, 11, 0, 0, 0, time.UTC)},
+		{"@every 45s", time.Unix((at.Unix()/45+1)*45, 0).UTC()},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.schedule)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q) = %v", tt.schedule, err)
+			continue
+		}
+		if got := s.Next(at); !got.Equal(tt.want) {
+			t.Errorf("%q.Next() = %v, want %v", tt.schedule, got, tt.want)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, s := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "x * * * *", "@every 10ms", "@every soon", "@never"} {
+		if _, err := ParseSchedule(s); err == nil {
+			t.Errorf("ParseSchedule(%q) succeeded", s)
+		}
+	}
+	s, err := ParseSchedule("0 0 31 2 *")
+	if err != nil {
+		t.Fatalf("ParseSchedule() = %v", err)
+	}
+	if next := s.Next(time.Now()); !next.IsZero() {
+		t.Errorf("Next() of February 31st = %v, want never", next)
+	}
+	if err := (Job{Name: "j", Schedule: "0 0 31 2 *", Action: "compact"}).Validate(); err == nil {
+		t.Errorf("Validate() of a job never due succeeded")
+	}
+}
@@ -0,0 +1,102 @@
+package featureflags
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	machines "github.com/epsniff/expodb/pkg/server/state-machines"
+)
+
+const (
+	FSMKey  = uint16(13)
+	FSMName = "featureflags"
+)
+
+// Registration registers the feature flags state machine with a raft shard.
+var Registration = machines.Registration{
+	Key:  FSMKey,
+	Name: FSMName,
+	New:  func() machines.StateMachine { return New() },
+}
+
+func New() *FlagStateMachine {
+	return &FlagStateMachine{flags: map[string]bool{}}
+}
+
+// FlagStateMachine keeps the cluster's feature flags set by operators.
+// Flags not set are at their default, which the server knows.
+type FlagStateMachine struct {
+	mutex sync.RWMutex
+	flags map[string]bool
+}
+
+// ListQuery reads the flags set, by name.
+type ListQuery struct{}
+
+// Event sets the flag Name, or resets it to its default when Enabled is nil.
+type Event struct {
+	Name    string `json:"name"`
+	Enabled *bool  `json:"enabled,omitempty"`
+}
+
+// Marshal and encode the raft type
+func (e Event) Marshal() ([]byte, error) {
+	res, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return machines.EncodeEntry(FSMKey, res), nil
+}
+
+func (s *FlagStateMachine) Lookup(e interface{}) (interface{}, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if _, ok := e.(ListQuery); ok {
+		flags := make(map[string]bool, len(s.flags))
+		for name, enabled := range s.flags {
+			flags[name] = enabled
+		}
+		return flags, nil
+	}
+	return nil, fmt.Errorf("invalid query %#v", e)
+}
+
+// Apply raft log update.
+func (s *FlagStateMachine) Apply(delta []byte) (interface{}, error) {
+	var e Event
+	if err := json.Unmarshal(delta, &e); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal feature flag event: %w", err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if e.Enabled == nil {
+		delete(s.flags, e.Name)
+	} else {
+		s.flags[e.Name] = *e.Enabled
+	}
+	return nil, nil
+}
+
+// Restore from a snapshot
+func (s *FlagStateMachine) Restore(data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	flags := map[string]bool{}
+	if err := json.Unmarshal(data, &flags); err != nil {
+		return fmt.Errorf("restore error on FlagStateMachine: %w", err)
+	}
+	s.flags = flags
+	return nil
+}
+
+// Save state as bytes for snapshot
+func (s *FlagStateMachine) Persist() ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	data, err := json.Marshal(s.flags)
+	if err != nil {
+		return nil, fmt.Errorf("FlagStateMachine persist error: %v", err)
+	}
+	return data, nil
+}
@@ -1,8 +1,13 @@
 package machines
 
+import (
+	"encoding/binary"
+	"fmt"
+)
+
 type RaftEntry interface {
 	// By convention the messages self marshal and encode thier fsm type as the last
-	// 2 bytes of the bytes.
+	// 2 bytes of the bytes.  See EncodeEntry.
 	Marshal() ([]byte, error)
 }
 
@@ -19,3 +24,53 @@ type StateMachine interface {
 	// Save state as bytes for snapshot for this state machine
 	Persist() ([]byte, error)
 }
+
+// Registration describes a named state machine hosted alongside the KV store
+// in a raft shard.  Entries whose fsm type is Key are routed to it.
+type Registration struct {
+	Key  uint16
+	Name string
+	New  func() StateMachine
+}
+
+// Validate checks the registration can be told apart from untyped KV entries.
+func (r Registration) Validate() error {
+	if r.Key == 0 || r.Key > maxFSMKey {
+		return fmt.Errorf("state machine %q: fsm key must be 1-%d, got %d", r.Name, maxFSMKey, r.Key)
+	}
+	if r.Name == "" || r.New == nil {
+		return fmt.Errorf("state machine with key %d: name and constructor are required", r.Key)
+	}
+	return nil
+}
+
+// NamedQuery routes a lookup to the named state machine.
+type NamedQuery struct {
+	Machine string
+	Query   interface{}
+}
+
+// maxFSMKey keeps the high byte of the fsm type at zero.  Untyped KV entries
+// are JSON which never contains a NUL byte, so entries can be told apart.
+const maxFSMKey = 0xff
+
+// EncodeEntry appends the fsm type key to a marshaled entry.
+func EncodeEntry(key uint16, payload []byte) []byte {
+	buf := make([]byte, len(payload)+2)
+	copy(buf, payload)
+	binary.BigEndian.PutUint16(buf[len(payload):], key)
+	return buf
+}
+
+// DecodeEntry splits an entry into its fsm type key and payload.  ok is false
+// for untyped entries, which belong to the KV store.
+func DecodeEntry(buf []byte) (key uint16, payload []byte, ok bool) {
+	if len(buf) < 2 || buf[len(buf)-2] != 0 {
+		return 0, buf, false
+	}
+	key = binary.BigEndian.Uint16(buf[len(buf)-2:])
+	if key == 0 {
+		return 0, buf, false
+	}
+	return key, buf[:len(buf)-2], true
+}
@@ -0,0 +1,53 @@
+package machines
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistration_Validate(t *testing.T) {
+	newSM := func() StateMachine { return nil }
+	tests := []struct {
+		name    string
+		reg     Registration
+		wantErr string
+	}{
+		{"valid", Registration{Key: 11, Name: "counters", New: newSM}, ""},
+		{"highest key", Registration{Key: maxFSMKey, Name: "last", New: newSM}, ""},
+		{"zero key", Registration{Key: 0, Name: "kv", New: newSM}, "fsm key must be"},
+		{"key with a high byte", Registration{Key: 0x100, Name: "wide", New: newSM}, "fsm key must be"},
+		{"no name", Registration{Key: 12, New: newSM}, "name and constructor are required"},
+		{"no constructor", Registration{Key: 12, Name: "nothing"}, "name and constructor are required"},
+	}
+	for _, tt := range tests {
+		err := tt.reg.Validate()
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: Validate() error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDecodeEntry(t *testing.T) {
+	tests := []struct {
+		name    string
+		buf     []byte
+		key     uint16
+		payload []byte
+		ok      bool
+	}{
+		{"typed", EncodeEntry(11, []byte(`{"Name":"hits"}`)), 11, []byte(`{"Name":"hits"}`), true},
+		{"typed empty payload", EncodeEntry(3, nil), 3, []byte{}, true},
+		{"untyped json", []byte(`{"Key":"t:r:c","Val":"v"}`), 0, []byte(`{"Key":"t:r:c","Val":"v"}`), false},
+		{"zero key", EncodeEntry(0, []byte("{}")), 0, EncodeEntry(0, []byte("{}")), false},
+		{"key with a high byte", EncodeEntry(0x100, []byte("{}")), 0, EncodeEntry(0x100, []byte("{}")), false},
+		{"short", []byte{0}, 0, []byte{0}, false},
+		{"empty", nil, 0, nil, false},
+	}
+	for _, tt := range tests {
+		key, payload, ok := DecodeEntry(tt.buf)
+		if key != tt.key || !bytes.Equal(payload, tt.payload) || ok != tt.ok {
+			t.Errorf("%s: DecodeEntry(%q) = %d, %q, %v, want %d, %q, %v", tt.name, tt.buf, key, payload, ok, tt.key, tt.payload, tt.ok)
+		}
+	}
+}
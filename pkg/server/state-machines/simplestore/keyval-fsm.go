@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+
+	"github.com/epsniff/expodb/pkg/errdefs"
 )
 
 const KVFSMKey = uint16(10)
@@ -16,7 +18,7 @@ const (
 )
 
 var (
-	ErrKeyNotFound = fmt.Errorf("key not found")
+	ErrKeyNotFound = errdefs.New(errdefs.ErrNotFound, "key not found")
 )
 
 func New() *KeyValStateMachine {
@@ -36,12 +38,40 @@ type Query struct {
 	RowKey string
 }
 
+// ScanQuery reads every row of a table, results are rowkey -> column -> value.
+type ScanQuery struct {
+	Table string
+}
+
 func (kv *KeyValStateMachine) Lookup(e interface{}) (interface{}, error) {
-	query, ok := e.(Query)
-	if !ok {
+	switch query := e.(type) {
+	case Query:
+		return kv.Get(query.Table, query.RowKey)
+	case ScanQuery:
+		return kv.Scan(query.Table)
+	default:
 		return nil, fmt.Errorf("invalid query %#v", e)
 	}
-	return kv.Get(query.Table, query.RowKey)
+}
+
+// Scan returns a copy of every row in the table.
+func (kv *KeyValStateMachine) Scan(table string) (map[string]map[string]string, error) {
+	kv.mutex.RLock()
+	defer kv.mutex.RUnlock()
+
+	if table == "" {
+		return nil, fmt.Errorf("KeyValStateMachine: no table provided")
+	}
+
+	rows := map[string]map[string]string{}
+	for rowkey, row := range kv.stateValue[table] {
+		cols := make(map[string]string, len(row))
+		for col, val := range row {
+			cols[col] = val
+		}
+		rows[rowkey] = cols
+	}
+	return rows, nil
 }
 
 func (kv *KeyValStateMachine) Get(table, rowkey string) (map[string]string, error) {
@@ -67,6 +97,24 @@ func (kv *KeyValStateMachine) Get(table, rowkey string) (map[string]string, erro
 	return row, nil
 }
 
+// Each calls fn for every column stored in the state machine.  Iteration stops
+// at the first error returned by fn.
+func (kv *KeyValStateMachine) Each(fn func(table, rowkey, column, value string) error) error {
+	kv.mutex.RLock()
+	defer kv.mutex.RUnlock()
+
+	for table, tab := range kv.stateValue {
+		for rowkey, row := range tab {
+			for column, value := range row {
+				if err := fn(table, rowkey, column, value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
 // Apply raft log update
 func (kv *KeyValStateMachine) Apply(delta []byte) (interface{}, error) {
 	e, err := UnmarshalKeyValEvent(delta)
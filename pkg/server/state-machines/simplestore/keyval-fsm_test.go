@@ -1,6 +1,7 @@
 package simplestore
 
 import (
+	"errors"
 	"reflect"
 	"sync"
 	"testing"
@@ -125,3 +126,55 @@ func TestKeyValStateMachine_Apply(t *testing.T) {
 		})
 	}
 }
+
+func TestKeyValStateMachine_Each(t *testing.T) {
+	stop := errors.New("stop")
+	tests := []struct {
+		name       string
+		stateValue map[string]map[string]map[string]string
+		fnErr      error
+		want       int
+		wantErr    error
+	}{
+		{
+			name:       "empty",
+			stateValue: map[string]map[string]map[string]string{},
+		},
+		{
+			name: "every column",
+			stateValue: map[string]map[string]map[string]string{
+				"table1": {"rowkey1": {"col1": "val1", "col2": "val2"}, "rowkey2": {"col1": "val3"}},
+				"table2": {"rowkey1": {"col1": "val4"}},
+			},
+			want: 4,
+		},
+		{
+			name: "stops at the first error",
+			stateValue: map[string]map[string]map[string]string{
+				"table1": {"rowkey1": {"col1": "val1", "col2": "val2"}},
+			},
+			fnErr:   stop,
+			want:    1,
+			wantErr: stop,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kv := &KeyValStateMachine{stateValue: tt.stateValue}
+			seen := 0
+			err := kv.Each(func(table, rowkey, column, value string) error {
+				seen++
+				if got := tt.stateValue[table][rowkey][column]; got != value {
+					t.Errorf("Each() %s/%s/%s = %q, want %q", table, rowkey, column, value, got)
+				}
+				return tt.fnErr
+			})
+			if err != tt.wantErr {
+				t.Errorf("KeyValStateMachine.Each() error = %v, want %v", err, tt.wantErr)
+			}
+			if seen != tt.want {
+				t.Errorf("KeyValStateMachine.Each() visited %d columns, want %d", seen, tt.want)
+			}
+		})
+	}
+}
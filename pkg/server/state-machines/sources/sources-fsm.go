@@ -0,0 +1,136 @@
+package sources
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	machines "github.com/epsniff/expodb/pkg/server/state-machines"
+)
+
+const (
+	FSMKey  = uint16(14)
+	FSMName = "sources"
+
+	// KeyPlaceholder is replaced by the escaped row key in a source's URL.
+	KeyPlaceholder = "{key}"
+)
+
+// Registration registers the read-through sources state machine with a raft
+// shard.
+var Registration = machines.Registration{
+	Key:  FSMKey,
+	Name: FSMName,
+	New:  func() machines.StateMachine { return New() },
+}
+
+func New() *SourceStateMachine {
+	return &SourceStateMachine{sources: map[string]Source{}}
+}
+
+// Source is the external HTTP source a table reads through to: a row missing
+// from the table, or expired, is fetched from URL, its KeyPlaceholder
+// replaced by the row key, and written to the table to expire after TTL,
+// never when 0.
+type Source struct {
+	Table string        `json:"table"`
+	URL   string        `json:"url"`
+	TTL   time.Duration `json:"ttl"`
+}
+
+// Validate checks a source can be read through to.
+func (s Source) Validate() error {
+	if s.Table == "" || strings.HasPrefix(s.Table, "_") {
+		return fmt.Errorf("source table %q isn't a user table", s.Table)
+	}
+	u, err := url.Parse(strings.ReplaceAll(s.URL, KeyPlaceholder, "key"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("source url %q isn't an http(s) url", s.URL)
+	}
+	if !strings.Contains(s.URL, KeyPlaceholder) {
+		return fmt.Errorf("source url %q has no %s", s.URL, KeyPlaceholder)
+	}
+	if s.TTL < 0 {
+		return fmt.Errorf("source ttl %s is negative", s.TTL)
+	}
+	return nil
+}
+
+// SourceStateMachine keeps the tables' read-through sources, by table.
+type SourceStateMachine struct {
+	mutex   sync.RWMutex
+	sources map[string]Source
+}
+
+// ListQuery reads the sources, by table.
+type ListQuery struct{}
+
+// Event sets the source of a table, or drops it when Drop is set.
+type Event struct {
+	Source Source `json:"source"`
+	Drop   bool   `json:"drop,omitempty"`
+}
+
+// Marshal and encode the raft type
+func (e Event) Marshal() ([]byte, error) {
+	res, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return machines.EncodeEntry(FSMKey, res), nil
+}
+
+func (s *SourceStateMachine) Lookup(e interface{}) (interface{}, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if _, ok := e.(ListQuery); ok {
+		sources := make(map[string]Source, len(s.sources))
+		for table, source := range s.sources {
+			sources[table] = source
+		}
+		return sources, nil
+	}
+	return nil, fmt.Errorf("invalid query %#v", e)
+}
+
+// Apply raft log update.
+func (s *SourceStateMachine) Apply(delta []byte) (interface{}, error) {
+	var e Event
+	if err := json.Unmarshal(delta, &e); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal source event: %w", err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if e.Drop {
+		delete(s.sources, e.Source.Table)
+	} else {
+		s.sources[e.Source.Table] = e.Source
+	}
+	return nil, nil
+}
+
+// Restore from a snapshot
+func (s *SourceStateMachine) Restore(data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sources := map[string]Source{}
+	if err := json.Unmarshal(data, &sources); err != nil {
+		return fmt.Errorf("restore error on SourceStateMachine: %w", err)
+	}
+	s.sources = sources
+	return nil
+}
+
+// Save state as bytes for snapshot
+func (s *SourceStateMachine) Persist() ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	data, err := json.Marshal(s.sources)
+	if err != nil {
+		return nil, fmt.Errorf("SourceStateMachine persist error: %v", err)
+	}
+	return data, nil
+}
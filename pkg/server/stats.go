@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+const (
+	// analyzeInterval is how old the statistics of a table get before the
+	// leader analyzes it again, analyzeCheckInterval how often it looks.
+	analyzeInterval      = 10 * time.Minute
+	analyzeCheckInterval = time.Minute
+)
+
+// AnalyzeTable computes the statistics of a table, reading every row of this
+// node's replica as of a linearizable read, and replicates them for the
+// query planner.  It returns them and the index they were recorded at.
+func (n *server) AnalyzeTable(ctx context.Context, table string) (*multiraft.TableStats, uint64, error) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return nil, 0, err
+	}
+	res, err := agent.Read(ctx, multiraft.AnalyzeQuery{Table: table})
+	if err != nil {
+		return nil, 0, err
+	}
+	stats, ok := res.(*multiraft.TableStats)
+	if !ok {
+		return nil, 0, fmt.Errorf("converting result to *multiraft.TableStats: %T", res)
+	}
+	stats.Analyzed = time.Now().UnixNano()
+	index, err := n.applyWrite(ctx, multiraft.KVData{Op: multiraft.OpSetStats, Stats: stats})
+	if err != nil {
+		return nil, 0, err
+	}
+	stats.Index = index
+	return stats, index, nil
+}
+
+// TableStats returns the statistics recorded for every table, by table.
+func (n *server) TableStats(ctx context.Context) ([]multiraft.TableStats, error) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return nil, err
+	}
+	res, err := agent.Read(ctx, multiraft.StatsQuery{})
+	if err != nil {
+		return nil, err
+	}
+	list, ok := res.([]multiraft.TableStats)
+	if !ok {
+		return nil, fmt.Errorf("converting result to []multiraft.TableStats: %T", res)
+	}
+	return list, nil
+}
+
+// tableStats returns the statistics recorded for a table, nil when it
+// hasn't been analyzed.
+func (n *server) tableStats(ctx context.Context, table string) (*multiraft.TableStats, error) {
+	list, err := n.TableStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		if list[i].Table == table {
+			return &list[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// runAnalyzer is run by the leader, see leaderLoop.  It analyzes the user
+// tables never analyzed or last analyzed over analyzeInterval ago, one at a
+// time.
+func (n *server) runAnalyzer(ctx context.Context) {
+	ticker := time.NewTicker(analyzeCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := n.analyzeStale(ctx); err != nil && ctx.Err() == nil {
+			n.logger.Warn("failed to analyze tables", zap.Error(err))
+		}
+	}
+}
+
+func (n *server) analyzeStale(ctx context.Context) error {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return err
+	}
+	res, err := agent.Read(ctx, multiraft.TablesQuery{})
+	if err != nil {
+		return err
+	}
+	tables, ok := res.([]string)
+	if !ok {
+		return fmt.Errorf("converting result to []string: %T", res)
+	}
+	list, err := n.TableStats(ctx)
+	if err != nil {
+		return err
+	}
+	analyzed := make(map[string]time.Time, len(list))
+	for _, stats := range list {
+		analyzed[stats.Table] = time.Unix(0, stats.Analyzed)
+	}
+	for _, table := range tables {
+		if strings.HasPrefix(table, "_") {
+			continue
+		}
+		if at, ok := analyzed[table]; ok && time.Since(at) < analyzeInterval {
+			continue
+		}
+		stats, _, err := n.AnalyzeTable(ctx, table)
+		if err != nil {
+			return fmt.Errorf("analyzing %s: %w", table, err)
+		}
+		n.logger.Debug("Analyzed table", zap.String("table", table), zap.Uint64("rows", stats.Rows))
+	}
+	return nil
+}
+
+func (server *httpServer) handleTableStats(w http.ResponseWriter, r *http.Request) {
+	list, err := server.node.TableStats(r.Context())
+	if err != nil {
+		server.logger.Error("Failed to list table statistics", zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	if list == nil {
+		list = []multiraft.TableStats{}
+	}
+	respond(w, http.StatusOK, map[string][]multiraft.TableStats{"stats": list}, server.logger)
+}
+
+func (server *httpServer) handleAnalyze(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Table string `json:"table"`
+	}{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Table == "" || isVirtualTable(req.Table) {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !server.checkWritable(w) {
+		return
+	}
+	stats, index, err := server.node.AnalyzeTable(r.Context(), req.Table)
+	if errors.Is(err, multiraft.ErrWritesFrozen) {
+		statusUnavailable(w)
+		return
+	} else if err != nil {
+		server.logger.Error("Failed to analyze table", zap.String("table", req.Table), zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	response := struct {
+		Stats *multiraft.TableStats `json:"stats"`
+		Index uint64                `json:"index"`
+	}{
+		Stats: stats,
+		Index: index,
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxStatsdPacket keeps a push's datagrams under the usual ethernet MTU.
+const maxStatsdPacket = 1432
+
+// pushStatsd pushes the node's internal metrics to the configured statsd
+// server every StatsdInterval over UDP.  Transaction counts are sent as
+// counters of what happened since the last push, the rest as gauges.
+func (n *server) pushStatsd(ctx context.Context) {
+	conn, err := net.Dial("udp", n.config.StatsdAddr)
+	if err != nil {
+		n.logger.Error("Unable to reach statsd, not pushing metrics", zap.String("address", n.config.StatsdAddr), zap.Error(err))
+		return
+	}
+	defer conn.Close()
+	ticker := time.NewTicker(n.config.StatsdInterval)
+	defer ticker.Stop()
+	var last txnStatus
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		st := n.Status(ctx)
+		var applied uint64
+		if agent, err := n.shardAgent(shardID1); err == nil {
+			applied, _ = agent.AppliedIndex()
+		}
+		n.txnSessions.mu.Lock()
+		sessions := len(n.txnSessions.sessions)
+		n.txnSessions.mu.Unlock()
+		lines := statsdLines(n.config.StatsdPrefix, n.statsdTags(), st, &last, applied, sessions)
+		last = *st.Transactions
+		for _, packet := range statsdPackets(lines) {
+			// statsd is best effort, a lost push is caught up by the next.
+			if _, err := conn.Write(packet); err != nil {
+				n.logger.Debug("Failed to push metrics to statsd", zap.Error(err))
+				break
+			}
+		}
+	}
+}
+
+// statsdTags are DogStatsD tags identifying the node, empty for plain statsd.
+func (n *server) statsdTags() string {
+	if !n.config.Dogstatsd {
+		return ""
+	}
+	tags := "|#node:" + n.config.ID()
+	if n.config.Zone != "" {
+		tags += ",zone:" + n.config.Zone
+	}
+	return tags
+}
+
+// statsdLines formats a status as statsd metrics, with the transaction
+// counters relative to last.
+func statsdLines(prefix, tags string, st *nodeStatus, last *txnStatus, applied uint64, sessions int) []string {
+	var lines []string
+	gauge := func(name string, v uint64) {
+		lines = append(lines, fmt.Sprintf("%s%s:%d|g%s", prefix, name, v, tags))
+	}
+	counter := func(name string, v, prev uint64) {
+		if v > prev {
+			lines = append(lines, fmt.Sprintf("%s%s:%d|c%s", prefix, name, v-prev, tags))
+		}
+	}
+	flag := func(b bool) uint64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	gauge("raft.applied_index", applied)
+	gauge("raft.leader", flag(st.Leader != nil && st.Leader.ID == st.ID))
+	gauge("maintenance", flag(st.Maintenance))
+	gauge("writes_frozen", flag(st.WritesFrozenUntil != nil))
+	if st.Replay != nil {
+		gauge("raft.replay_remaining", st.Replay.Remaining)
+	}
+	if ss := st.Snapshots; ss != nil {
+		gauge("raft.snapshot.duration_ms", uint64(ss.LastDuration.Milliseconds()))
+		gauge("raft.snapshot.apply_stall_us", uint64(ss.LastApplyStall.Microseconds()))
+		gauge("raft.snapshot.bytes", ss.LastBytes)
+		gauge("raft.snapshot.failures", ss.Failures)
+	}
+	gauge("raft.snapshot.installs", st.SnapshotsInstalled)
+	if st.Leader != nil && st.Leader.ID == st.ID {
+		var pending, failed uint64
+		for _, j := range st.VoterJoins {
+			if j.State == voterJoinFailed {
+				failed++
+			} else {
+				pending++
+			}
+		}
+		gauge("raft.voter_joins.pending", pending)
+		gauge("raft.voter_joins.failed", failed)
+	}
+	for _, p := range st.Peers {
+		// DogStatsD tags the peer, plain statsd names it.
+		name, ptags := "raft.peer."+p.ID+".", tags
+		if tags != "" {
+			name, ptags = "raft.peer.", tags+",peer:"+p.ID
+		}
+		peerGauge := func(metric string, v uint64) {
+			lines = append(lines, fmt.Sprintf("%s%s%s:%d|g%s", prefix, name, metric, v, ptags))
+		}
+		peerGauge("lag_entries", p.LagEntries)
+		peerGauge("lag_ms", p.LagMs)
+		peerGauge("rtt_us", p.RTTUs)
+		peerGauge("snapshots_sent", p.SnapshotsSent)
+		peerGauge("snapshots_aborted", p.SnapshotsAborted)
+		peerGauge("connection_failures", p.ConnectionFailures)
+	}
+	if s := st.Storage; s != nil {
+		gauge("storage.pending_compaction_bytes", s.PendingCompactionBytes)
+		gauge("storage.compactions_in_progress", uint64(s.CompactionsInProgress))
+		gauge("storage.write_stalls", s.WriteStalls)
+		gauge("storage.disk_usage_bytes", s.DiskUsage)
+		if len(s.Levels) > 0 {
+			gauge("storage.l0_files", uint64(s.Levels[0].Files))
+		}
+	}
+	txn := st.Transactions
+	gauge("txn.sessions", uint64(sessions))
+	gauge("txn.waiting", uint64(len(txn.Waiting)))
+	counter("txn.commits", txn.Commits, last.Commits)
+	counter("txn.aborts", txn.Aborts, last.Aborts)
+	counter("txn.retries", txn.Retries, last.Retries)
+	counter("txn.lock_waits", txn.LockWaits, last.LockWaits)
+	counter("txn.lock_wait_timeouts", txn.LockWaitTimeouts, last.LockWaitTimeouts)
+	counter("txn.deadlocks", txn.Deadlocks, last.Deadlocks)
+	tables := make([]string, 0, len(txn.ConflictsByTable))
+	for table := range txn.ConflictsByTable {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		counter("txn.conflicts."+table, txn.ConflictsByTable[table], last.ConflictsByTable[table])
+	}
+	return lines
+}
+
+// statsdPackets packs newline separated lines into datagrams of at most
+// maxStatsdPacket bytes.
+func statsdPackets(lines []string) [][]byte {
+	var packets [][]byte
+	var b strings.Builder
+	for _, line := range lines {
+		if b.Len() > 0 && b.Len()+1+len(line) > maxStatsdPacket {
+			packets = append(packets, []byte(b.String()))
+			b.Reset()
+		}
+		if b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(line)
+	}
+	if b.Len() > 0 {
+		packets = append(packets, []byte(b.String()))
+	}
+	return packets
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStatsdLines(t *testing.T) {
+	st := &nodeStatus{
+		ID:           "n1",
+		Leader:       &leaderStatus{ID: "n1"},
+		Transactions: &txnStatus{Commits: 5, Aborts: 1, ConflictsByTable: map[string]uint64{"users": 2}},
+	}
+	last := &txnStatus{Commits: 3, Aborts: 1}
+	got := statsdLines("expodb.", "|#node:n1", st, last, 42, 1)
+	want := []string{
+		"expodb.raft.applied_index:42|g|#node:n1",
+		"expodb.raft.leader:1|g|#node:n1",
+		"expodb.maintenance:0|g|#node:n1",
+		"expodb.writes_frozen:0|g|#node:n1",
+		"expodb.raft.snapshot.installs:0|g|#node:n1",
+		"expodb.raft.voter_joins.pending:0|g|#node:n1",
+		"expodb.raft.voter_joins.failed:0|g|#node:n1",
+		"expodb.txn.sessions:1|g|#node:n1",
+		"expodb.txn.waiting:0|g|#node:n1",
+		"expodb.txn.commits:2|c|#node:n1",
+		"expodb.txn.conflicts.users:2|c|#node:n1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("statsdLines() = %q, want %q", got, want)
+	}
+
+	lines := make([]string, 100)
+	for i := range lines {
+		lines[i] = strings.Repeat("x", 99)
+	}
+	packets := statsdPackets(lines)
+	for _, p := range packets {
+		if len(p) > maxStatsdPacket {
+			t.Errorf("packet of %d bytes", len(p))
+		}
+	}
+	if len(packets) != 8 {
+		t.Errorf("statsdPackets() made %d packets, want 8", len(packets))
+	}
+}
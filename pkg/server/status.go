@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/config"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+)
+
+// nodeStatus is returned by the /status endpoint.
+type nodeStatus struct {
+	ID          string `json:"id"`
+	ClusterID   string `json:"cluster_id,omitempty"`
+	Zone        string `json:"zone,omitempty"`
+	Maintenance bool   `json:"maintenance"`
+	// WritesFrozenUntil is set while a cluster-wide write freeze is on.
+	WritesFrozenUntil *time.Time    `json:"writes_frozen_until,omitempty"`
+	Leader            *leaderStatus `json:"leader,omitempty"`
+	Replay            *replayStatus `json:"replay,omitempty"`
+	// Snapshots describes the raft snapshots this node took.
+	Snapshots    *multiraft.SnapshotStats `json:"snapshots,omitempty"`
+	Storage      *multiraft.StorageStats  `json:"storage,omitempty"`
+	Replication  *replicationStatus       `json:"replication,omitempty"`
+	Archive      *archiveStatus           `json:"archive,omitempty"`
+	Transactions *txnStatus               `json:"transactions"`
+	// IndexBuilds lists the indexes being backfilled.
+	IndexBuilds []indexBuild `json:"index_builds,omitempty"`
+	// SchemaChanges lists the schema changes in flight.
+	SchemaChanges []schemaChange `json:"schema_changes,omitempty"`
+	// Peers is the replication lag of the other voters, set on the leader.
+	Peers []peerStatus `json:"peers,omitempty"`
+	// VoterJoins are the voters the leader is adding, or failed to add.
+	VoterJoins []voterJoin `json:"voter_joins,omitempty"`
+	// SnapshotsInstalled counts the raft snapshots this node received.
+	SnapshotsInstalled uint64           `json:"snapshots_installed"`
+	Durability         durabilityStatus `json:"durability"`
+}
+
+type leaderStatus struct {
+	ID       string `json:"id"`
+	RaftAddr string `json:"raft_addr"`
+	HTTPAddr string `json:"http_addr"`
+}
+
+// durabilityStatus documents the latency/durability trade-off this node runs
+// with, so operators don't have to go digging through flags.
+type durabilityStatus struct {
+	FSyncPolicy string `json:"fsync_policy"`
+	WriteAck    string `json:"write_ack"`
+	Description string `json:"description"`
+}
+
+// Status returns a snapshot of this node's configuration and state.
+func (n *server) Status(ctx context.Context) *nodeStatus {
+	var leader *leaderStatus
+	if l, ok := n.metadata.Leader(); ok {
+		leader = &leaderStatus{ID: l.ID(), RaftAddr: l.RaftAddr(), HTTPAddr: l.HttpAddr()}
+	}
+	replay, _ := n.replayProgress(ctx)
+	var snapshots *multiraft.SnapshotStats
+	if agent, err := n.shardAgent(shardID1); err == nil {
+		stats := agent.SnapshotStats()
+		snapshots = &stats
+	}
+	storage, _ := n.storageStats()
+	var frozenUntil *time.Time
+	if until, err := n.writeFrozenUntil(); err == nil && !until.IsZero() {
+		frozenUntil = &until
+	}
+	return &nodeStatus{
+		ID:                 n.config.ID(),
+		ClusterID:          n.ClusterID(),
+		Zone:               n.config.Zone,
+		Maintenance:        n.maintenance.Load(),
+		WritesFrozenUntil:  frozenUntil,
+		Leader:             leader,
+		Replay:             replay,
+		Snapshots:          snapshots,
+		Storage:            storage,
+		Replication:        n.replicationStatus(),
+		Archive:            n.archiveStatus(ctx),
+		Transactions:       n.txnStatus(),
+		IndexBuilds:        n.indexBuilds(),
+		SchemaChanges:      n.schemaChanges(),
+		Peers:              n.peerStatuses(ctx),
+		VoterJoins:         n.voterJoins.list(),
+		SnapshotsInstalled: n.peers.snapshotsInstalled(),
+		Durability: durabilityStatus{
+			FSyncPolicy: n.config.FSyncPolicy,
+			WriteAck:    n.config.WriteAck,
+			Description: durabilityDescription(n.config),
+		},
+	}
+}
+
+func durabilityDescription(c *config.Config) string {
+	var desc string
+	if c.AckOnCommit() {
+		desc = "writes are acknowledged once a raft quorum has committed them, before this node applies them; a read right after a write may not observe it"
+	} else {
+		desc = "writes are acknowledged once committed by a raft quorum and applied by this node"
+	}
+	if c.SyncWrites() {
+		desc += "; every applied batch is fsynced"
+	} else {
+		desc += "; the state machine is fsynced periodically and replays the raft log after a crash"
+	}
+	return desc
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/config"
+)
+
+func TestDurabilityDescription(t *testing.T) {
+	tests := []struct {
+		fsync, ack string
+		want       []string
+	}{
+		{config.FSyncAlways, config.WriteAckApplied, []string{"applied by this node", "every applied batch is fsynced"}},
+		{config.FSyncAlways, config.WriteAckCommitted, []string{"before this node applies them", "every applied batch is fsynced"}},
+		{config.FSyncPeriodic, config.WriteAckApplied, []string{"applied by this node", "replays the raft log"}},
+		{config.FSyncPeriodic, config.WriteAckCommitted, []string{"before this node applies them", "replays the raft log"}},
+	}
+	for _, tt := range tests {
+		got := durabilityDescription(&config.Config{FSyncPolicy: tt.fsync, WriteAck: tt.ack})
+		for _, want := range tt.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("durabilityDescription(%s, %s) = %q, want it to mention %q", tt.fsync, tt.ack, got, want)
+			}
+		}
+	}
+}
+
+// TestWriteAckCommitted writes to a node acking writes once committed and
+// syncing its state machine periodically.
+func TestWriteAckCommitted(t *testing.T) {
+	srv, addr := startTestNode(t, func(cfg *config.Config) {
+		cfg.FSyncPolicy = config.FSyncPeriodic
+		cfg.WriteAck = config.WriteAckCommitted
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, val := range []string{"v1", "v2", "v3"} {
+		index, err := srv.SetKeyVal(ctx, "t1", "k1", "c", val)
+		if err != nil || index != 0 {
+			t.Fatalf("SetKeyVal(%s) = %d, %v, want acked at index 0", val, index, err)
+		}
+	}
+	// the writes were committed, a linearizable read waits for them.
+	row, _, err := srv.GetByRowKey(ctx, "t1", "k1", 0)
+	if err != nil || row["c"] != "v3" {
+		t.Fatalf("GetByRowKey() = %v, %v, want c=v3", row, err)
+	}
+
+	resp, err := http.Get("http://" + addr + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var status nodeStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Durability.FSyncPolicy != config.FSyncPeriodic || status.Durability.WriteAck != config.WriteAckCommitted {
+		t.Errorf("/status durability = %+v, want periodic fsyncs and committed acks", status.Durability)
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+// storageStats returns the compaction statistics of this node's replica.
+func (n *server) storageStats() (*multiraft.StorageStats, error) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return nil, err
+	}
+	res, err := agent.ReadLocal(multiraft.StorageStatsQuery{})
+	if err != nil {
+		return nil, err
+	}
+	stats, ok := res.(*multiraft.StorageStats)
+	if !ok {
+		return nil, fmt.Errorf("converting result to *multiraft.StorageStats: %T", res)
+	}
+	return stats, nil
+}
+
+// Compact compacts this node's replica of table, or all of it for the empty
+// table, and returns the replica's disk usage afterwards.  Other nodes
+// compact their replicas on their own.
+func (n *server) Compact(table string) (uint64, error) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return 0, err
+	}
+	res, err := agent.ReadLocal(multiraft.CompactQuery{Table: table})
+	if err != nil {
+		return 0, err
+	}
+	usage, ok := res.(uint64)
+	if !ok {
+		return 0, fmt.Errorf("converting result to uint64: %T", res)
+	}
+	return usage, nil
+}
+
+func (server *httpServer) handleCompact(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Table string `json:"table"`
+	}{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	usage, err := server.node.Compact(req.Table)
+	if err != nil {
+		server.logger.Error("Failed to compact", zap.String("table", req.Table), zap.Error(err))
+		statusInternalError(w)
+		return
+	}
+	res := struct {
+		DiskUsage uint64 `json:"disk_usage_bytes"`
+	}{usage}
+	respond(w, http.StatusOK, res, server.logger)
+}
+
+// ExportSnapshot writes a snapshot of this node's replica holding all of its
+// data to a new directory under dir, on this node, and returns it.  The file
+// in it can be read offline with "expodb snapshot".
+func (n *server) ExportSnapshot(ctx context.Context, dir string) (string, error) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return "", err
+	}
+	return agent.ExportSnapshot(ctx, dir)
+}
+
+func (server *httpServer) handleExportSnapshot(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Dir string `json:"dir"`
+	}{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Dir == "" {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	dir, err := server.node.ExportSnapshot(r.Context(), req.Dir)
+	if err != nil {
+		server.logger.Error("Failed to export snapshot", zap.String("dir", req.Dir), zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	server.logger.Info("Exported snapshot", zap.String("dir", dir))
+	respond(w, http.StatusOK, map[string]string{"dir": dir}, server.logger)
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"github.com/epsniff/expodb/pkg/server/state-machines/simplestore"
+)
+
+// Virtual system tables are read-only views of the node's internal state,
+// built on every read and served by the same _fetch and _scan requests as
+// stored tables:
+//
+//	_nodes     the cluster members as this node sees them, by node ID
+//	_shards    the raft shards this node replicates, by shard ID
+//	_tables    the tables holding data, with whether they are system tables
+//	_indexes   the secondary indexes, by table and name
+//	_cascades  the cascade rules, by table and name
+//	_triggers  the triggers attached to tables, by table and name
+//	_schemas   the columns of the table schemas, by table and column
+//	_sessions  the interactive transactions open on this node, by a hash of
+//	           their ID
+//
+// _nodes shadows the stored node catalog, it adds what gossip knows to it.
+const (
+	shardsTable   = "_shards"
+	tablesTable   = "_tables"
+	indexesTable  = "_indexes"
+	cascadesTable = "_cascades"
+	triggersTable = "_triggers"
+	schemasTable  = "_schemas"
+	sessionsTable = "_sessions"
+)
+
+var virtualTables = map[string]func(n *server, ctx context.Context) ([]multiraft.ScanRow, error){
+	nodesTable:    (*server).nodeRows,
+	shardsTable:   (*server).shardRows,
+	tablesTable:   (*server).tableRows,
+	indexesTable:  (*server).indexRows,
+	cascadesTable: (*server).cascadeRows,
+	triggersTable: (*server).triggerRows,
+	schemasTable:  (*server).schemaRows,
+	sessionsTable: (*server).sessionRows,
+}
+
+func isVirtualTable(table string) bool {
+	_, ok := virtualTables[table]
+	return ok
+}
+
+// VirtualScanPage is ScanPage for a virtual table.
+func (n *server) VirtualScanPage(ctx context.Context, table, after string, limit int) (*multiraft.ScanPage, error) {
+	rows, err := virtualTables[table](n, ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Key < rows[j].Key })
+	i := sort.Search(len(rows), func(i int) bool { return rows[i].Key > after })
+	page := &multiraft.ScanPage{Rows: rows[i:]}
+	if len(page.Rows) > limit {
+		page.Rows, page.More = page.Rows[:limit], true
+	}
+	return page, nil
+}
+
+// VirtualRow is GetRow for a virtual table.
+func (n *server) VirtualRow(ctx context.Context, table, key string, columns []string) (*multiraft.Row, error) {
+	rows, err := virtualTables[table](n, ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		if row.Key != key {
+			continue
+		}
+		if len(columns) > 0 {
+			picked := map[string]string{}
+			for _, col := range columns {
+				if val, ok := row.Columns[col]; ok {
+					picked[col] = val
+				}
+			}
+			row.Columns = picked
+		}
+		return &multiraft.Row{Columns: row.Columns}, nil
+	}
+	return nil, simplestore.ErrKeyNotFound
+}
+
+func (n *server) nodeRows(ctx context.Context) ([]multiraft.ScanRow, error) {
+	leader, _ := n.metadata.Leader()
+	var rows []multiraft.ScanRow
+	for _, node := range n.metadata.Nodes() {
+		rows = append(rows, multiraft.ScanRow{Key: node.ID(), Columns: map[string]string{
+			"raft_addr":     node.RaftAddr(),
+			"http_addr":     node.HttpAddr(),
+			"role":          node.Role(),
+			"zone":          node.Zone(),
+			"state":         string(node.State()),
+			"maintenance":   strconv.FormatBool(node.InMaintenance()),
+			"applied_index": strconv.FormatUint(node.AppliedIndex(), 10),
+			"leader":        strconv.FormatBool(leader != nil && leader.ID() == node.ID()),
+			"version":       node.Version(),
+			"build":         node.Build(),
+			"fsm_protocol":  strconv.Itoa(node.FSMProtocol()),
+		}})
+	}
+	return rows, nil
+}
+
+func (n *server) shardRows(ctx context.Context) ([]multiraft.ScanRow, error) {
+	n.raftAgentsMu.Lock()
+	agents := make(map[uint64]raftAgent, len(n.raftAgents))
+	for id, agent := range n.raftAgents {
+		agents[id] = agent
+	}
+	n.raftAgentsMu.Unlock()
+	var rows []multiraft.ScanRow
+	for id, agent := range agents {
+		cols := map[string]string{"leader_addr": agent.LeaderAddress()}
+		if isLeader, err := agent.IsLeader(); err == nil {
+			cols["is_leader"] = strconv.FormatBool(isLeader)
+		}
+		if index, err := agent.AppliedIndex(); err == nil {
+			cols["applied_index"] = strconv.FormatUint(index, 10)
+		}
+		members, err := agent.Members(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("listing members of shard %d: %w", id, err)
+		}
+		cols["voters"] = replicaList(members)
+		witnesses, err := agent.Witnesses(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("listing witnesses of shard %d: %w", id, err)
+		}
+		cols["witnesses"] = replicaList(witnesses)
+		rows = append(rows, multiraft.ScanRow{Key: strconv.FormatUint(id, 10), Columns: cols})
+	}
+	return rows, nil
+}
+
+// replicaList formats replicas as a sorted "id=address,..." list.
+func replicaList(replicas map[uint64]string) string {
+	list := make([]string, 0, len(replicas))
+	for id, addr := range replicas {
+		list = append(list, fmt.Sprintf("%d=%s", id, addr))
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+func (n *server) tableRows(ctx context.Context) ([]multiraft.ScanRow, error) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return nil, err
+	}
+	res, err := agent.Read(ctx, multiraft.TablesQuery{})
+	if err != nil {
+		return nil, err
+	}
+	tables, ok := res.([]string)
+	if !ok {
+		return nil, fmt.Errorf("converting result to []string: %T", res)
+	}
+	var rows []multiraft.ScanRow
+	for _, table := range tables {
+		rows = append(rows, multiraft.ScanRow{Key: table, Columns: map[string]string{
+			"system": strconv.FormatBool(strings.HasPrefix(table, "_")),
+		}})
+	}
+	return rows, nil
+}
+
+func (n *server) sessionRows(ctx context.Context) ([]multiraft.ScanRow, error) {
+	n.txnSessions.mu.Lock()
+	sessions := make(map[string]*txnSession, len(n.txnSessions.sessions))
+	for id, s := range n.txnSessions.sessions {
+		sessions[id] = s
+	}
+	n.txnSessions.mu.Unlock()
+	var rows []multiraft.ScanRow
+	for id, s := range sessions {
+		s.mu.Lock()
+		cols := map[string]string{
+			"node":       n.config.ID(),
+			"owner":      s.owner,
+			"writes":     strconv.Itoa(len(s.writes)),
+			"savepoints": strconv.Itoa(len(s.savepoints)),
+			"last_used":  s.lastUsed.UTC().Format(time.RFC3339Nano),
+		}
+		s.mu.Unlock()
+		rows = append(rows, multiraft.ScanRow{Key: txnHandle(id), Columns: cols})
+	}
+	return rows, nil
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+// exportLine is a line of a table export: a row, or the last line, which
+// reports the raft index the rows are consistent with or why the export
+// stopped.  An export without a last line was cut short.
+type exportLine struct {
+	Row   *multiraft.ScanRow `json:"row,omitempty"`
+	Done  bool               `json:"done,omitempty"`
+	Index uint64             `json:"index,omitempty"`
+	Error string             `json:"error,omitempty"`
+}
+
+// ExportTable calls fn with the rows of table after the row key after, in
+// key order, all read from one snapshot of the local replica once it has
+// applied every write acked before the call.  It returns the raft index the
+// rows are consistent with.
+func (n *server) ExportTable(ctx context.Context, table, after string, fn func(multiraft.ScanRow) error) (uint64, error) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := agent.ReadIndex(ctx); err != nil {
+		return 0, err
+	}
+	res, err := agent.ReadLocal(multiraft.TableExportQuery{Table: table, After: after, Fn: fn})
+	if err != nil {
+		return 0, err
+	}
+	index, ok := res.(uint64)
+	if !ok {
+		return 0, fmt.Errorf("converting result to uint64: %T", res)
+	}
+	return index, nil
+}
+
+// handleExportTable streams a user table as NDJSON for another cluster to
+// load, see expodb copy-table.  Unlike a streamed scan every row comes from
+// the same snapshot, which the node holds until the client has read them
+// all.
+func (server *httpServer) handleExportTable(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Table string `json:"table"`
+		After string `json:"after"`
+	}{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Table == "" || strings.HasPrefix(req.Table, "_") {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	started := false
+	var chunk []multiraft.ScanRow
+	flush := func() error {
+		if !started {
+			w.Header().Set("Content-Type", mimeNDJSON)
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		server.openRows(r, req.Table, rowColumns(chunk)...)
+		for i := range chunk {
+			if err := enc.Encode(exportLine{Row: &chunk[i]}); err != nil {
+				return err
+			}
+		}
+		chunk = chunk[:0]
+		return rc.Flush()
+	}
+	index, err := server.node.ExportTable(r.Context(), req.Table, req.After, func(row multiraft.ScanRow) error {
+		chunk = append(chunk, row)
+		if len(chunk) < streamChunk {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil && !started {
+		server.logger.Error("Failed to export table", zap.String("table", req.Table), zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	if err != nil {
+		server.logger.Error("Failed streaming table export", zap.String("table", req.Table), zap.Error(err))
+		enc.Encode(exportLine{Error: err.Error()})
+		return
+	}
+	enc.Encode(exportLine{Done: true, Index: index})
+}
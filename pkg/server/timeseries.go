@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+)
+
+// Time-series tables hold one row per sample, keyed by the series and the
+// sample's millisecond timestamp so a series' samples are contiguous and in
+// time order:
+//
+//	<series> 0x00 <timestamp, 20 digit zero padded>  value=<float>
+//
+// where series is the canonical form of its labels, name{k="v",...}.  The
+// labels of every series are kept in a companion table, the table's name
+// with tsSeriesSuffix, to list the series without scanning the samples.
+const (
+	defaultMetricsTable = "metrics"
+	tsSeriesSuffix      = "_series"
+	tsValueColumn       = "value"
+	tsMetricNameLabel   = "__name__"
+	// maxBatchWrites bounds the writes of a single OpBatch entry.
+	maxBatchWrites = 5000
+)
+
+// tsSeries is a series and samples of it to append.
+type tsSeries struct {
+	Labels  map[string]string
+	Samples []tsPoint
+}
+
+// tsPoint is a sample: a millisecond unix timestamp and its value.
+type tsPoint struct {
+	Timestamp int64
+	Value     float64
+}
+
+// seriesKey is the canonical form of a series' labels.
+func seriesKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if name != tsMetricNameLabel {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString(labels[tsMetricNameLabel])
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[name]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func sampleRowKey(series string, ts int64) string {
+	return fmt.Sprintf("%s\x00%020d", series, ts)
+}
+
+func parseSampleRowKey(row string) (string, int64, bool) {
+	i := strings.LastIndexByte(row, 0)
+	if i < 0 {
+		return "", 0, false
+	}
+	ts, err := strconv.ParseInt(row[i+1:], 10, 64)
+	return row[:i], ts, err == nil
+}
+
+// AppendSamples stores samples in a time-series table, in batches of
+// maxBatchWrites writes per raft entry.  Samples before the unix epoch can't
+// be stored and are skipped.  It returns the number of samples stored.
+func (n *server) AppendSamples(ctx context.Context, table string, series []tsSeries) (int, error) {
+	var writes []multiraft.TxnWrite
+	stored := 0
+	flush := func() error {
+		if len(writes) == 0 {
+			return nil
+		}
+		agent, err := n.shardAgent(shardID1)
+		if err != nil {
+			return err
+		}
+		if err := n.sealWrites(writes); err != nil {
+			return err
+		}
+		_, err = agent.Apply(ctx, multiraft.KVData{Op: multiraft.OpBatch, Writes: writes})
+		writes = writes[:0]
+		return err
+	}
+	for _, s := range series {
+		key := seriesKey(s.Labels)
+		for name, val := range s.Labels {
+			writes = append(writes, multiraft.TxnWrite{Table: table + tsSeriesSuffix, Row: key, Column: name, Val: val})
+		}
+		for _, p := range s.Samples {
+			if p.Timestamp < 0 {
+				continue
+			}
+			writes = append(writes, multiraft.TxnWrite{
+				Table:  table,
+				Row:    sampleRowKey(key, p.Timestamp),
+				Column: tsValueColumn,
+				Val:    strconv.FormatFloat(p.Value, 'g', -1, 64),
+			})
+			stored++
+			if len(writes) >= maxBatchWrites {
+				if err := flush(); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+	return stored, nil
+}
+
+// QuerySamples returns up to limit samples of a series with from <= timestamp
+// <= to, in time order.
+func (n *server) QuerySamples(ctx context.Context, table, series string, from, to int64, limit int) ([]tsPoint, error) {
+	if from < 0 {
+		from = 0
+	}
+	end := sampleRowKey(series, to)
+	after := series + "\x00" // sorts before every sample of the series
+	if from > 0 {
+		after = sampleRowKey(series, from-1)
+	}
+	var points []tsPoint
+	for {
+		page, _, err := n.ScanPage(ctx, table, after, maxScanLimit, ConsistencyGlobal)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range page.Rows {
+			s, ts, ok := parseSampleRowKey(row.Key)
+			if row.Key > end || !ok || s != series {
+				return points, nil
+			}
+			v, err := strconv.ParseFloat(row.Columns[tsValueColumn], 64)
+			if err != nil {
+				continue
+			}
+			points = append(points, tsPoint{Timestamp: ts, Value: v})
+			if len(points) == limit {
+				return points, nil
+			}
+		}
+		if !page.More {
+			return points, nil
+		}
+		after = page.Rows[len(page.Rows)-1].Key
+	}
+}
+
+// ListSeries returns the labels of the series of a time-series table, by
+// series key.
+func (n *server) ListSeries(ctx context.Context, table string) (map[string]map[string]string, error) {
+	series := map[string]map[string]string{}
+	for after := ""; ; {
+		page, _, err := n.ScanPage(ctx, table+tsSeriesSuffix, after, maxScanLimit, ConsistencyGlobal)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range page.Rows {
+			series[row.Key] = row.Columns
+		}
+		if !page.More {
+			return series, nil
+		}
+		after = page.Rows[len(page.Rows)-1].Key
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+const (
+	appliedIndexGossipInterval = 10 * time.Second
+	tombstoneGCInterval        = time.Minute
+)
+
+// gossipAppliedIndex periodically publishes this node's applied raft index as
+// a serf tag, which the leader uses to decide which tombstones are safe to drop.
+func (n *server) gossipAppliedIndex(ctx context.Context) error {
+	ticker := time.NewTicker(appliedIndexGossipInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		n.raftAgentsMu.Lock()
+		agent, ok := n.raftAgents[shardID1]
+		n.raftAgentsMu.Unlock()
+		if !ok || n.serfAgent.Serf() == nil {
+			continue
+		}
+		index, err := agent.AppliedIndex()
+		if err != nil {
+			n.logger.Debug("unable to read applied index", zap.Error(err))
+			continue
+		}
+		tags := map[string]string{"applied_index": strconv.FormatUint(index, 10)}
+		if replicaID := n.replicaID.Load(); isNonVotingReplica(replicaID) {
+			tags["replica_id"] = strconv.FormatUint(replicaID, 10)
+		}
+		n.serfAgent.SetTags(tags)
+	}
+}
+
+// runTombstoneGC is run by the leader, see leaderLoop.
+func (n *server) runTombstoneGC(ctx context.Context) {
+	ticker := time.NewTicker(tombstoneGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := n.collectTombstones(ctx); err != nil {
+			n.logger.Warn("tombstone gc skipped", zap.Error(err))
+		}
+		if err := n.pruneEvents(ctx); err != nil {
+			n.logger.Warn("event log pruning skipped", zap.Error(err))
+		}
+		if err := n.pruneDedup(ctx); err != nil {
+			n.logger.Warn("dedup pruning skipped", zap.Error(err))
+		}
+	}
+}
+
+// collectTombstones proposes dropping every tombstone at or below the lowest
+// applied index gossiped by the shard's replicas.  A replica that hasn't
+// gossiped yet blocks collection, otherwise it could miss a delete.
+func (n *server) collectTombstones(ctx context.Context) error {
+	agent := n.raftAgents[shardID1]
+	members, err := agent.Members(ctx)
+	if err != nil {
+		return err
+	}
+	var minIndex uint64
+	for replicaID, raftAddr := range members {
+		node, ok := n.metadata.FindByRaftAddr(raftAddr)
+		if !ok || node.AppliedIndex() == 0 {
+			return fmt.Errorf("no applied index known for replica %d (%s)", replicaID, raftAddr)
+		}
+		if minIndex == 0 || node.AppliedIndex() < minIndex {
+			minIndex = node.AppliedIndex()
+		}
+	}
+	if minIndex == 0 {
+		return nil
+	}
+	if _, err := agent.Apply(ctx, multiraft.KVData{Op: multiraft.OpGCTombstones, Index: minIndex}); err != nil {
+		return fmt.Errorf("proposing tombstone gc: %w", err)
+	}
+	n.logger.Debug("tombstones collected", zap.Uint64("up_to_index", minIndex))
+	return nil
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/serf/serf"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	machines "github.com/epsniff/expodb/pkg/server/state-machines"
+	"go.uber.org/zap"
+)
+
+// gcAgent is a shard of the given members recording the entries applied.
+type gcAgent struct {
+	raftAgent
+	members map[uint64]string
+	applied []multiraft.KVData
+}
+
+func (a *gcAgent) Members(ctx context.Context) (map[uint64]string, error) {
+	return a.members, nil
+}
+
+func (a *gcAgent) Apply(ctx context.Context, entry machines.RaftEntry) (uint64, error) {
+	a.applied = append(a.applied, entry.(multiraft.KVData))
+	return uint64(len(a.applied)), nil
+}
+
+func TestCollectTombstones(t *testing.T) {
+	members := map[uint64]string{1: "n1:7000", 2: "n2:7000", 3: "n3:7000"}
+	tests := []struct {
+		name    string
+		applied map[string]uint64 // raft address -> gossiped applied index
+		want    uint64            // 0 when nothing is collected
+		wantErr bool
+	}{
+		{"lowest applied index", map[string]uint64{"n1:7000": 40, "n2:7000": 25, "n3:7000": 31}, 25, false},
+		{"all caught up", map[string]uint64{"n1:7000": 40, "n2:7000": 40, "n3:7000": 40}, 40, false},
+		{"replica not gossiping yet", map[string]uint64{"n1:7000": 40, "n2:7000": 0, "n3:7000": 31}, 0, true},
+		{"replica unknown to gossip", map[string]uint64{"n1:7000": 40, "n3:7000": 31}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := &gcAgent{members: members}
+			n := &server{metadata: NewMetadata(), raftAgents: map[uint64]raftAgent{shardID1: agent}, logger: zap.NewNop()}
+			for addr, index := range tt.applied {
+				n.metadata.Restore(&nodedata{id: addr, raftAddr: addr, state: nodeAlive, appliedIndex: index})
+			}
+			err := n.collectTombstones(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("collectTombstones() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.want == 0 {
+				if len(agent.applied) != 0 {
+					t.Errorf("collectTombstones() proposed %+v, want nothing", agent.applied)
+				}
+				return
+			}
+			if len(agent.applied) != 1 || agent.applied[0].Op != multiraft.OpGCTombstones || agent.applied[0].Index != tt.want {
+				t.Errorf("collectTombstones() proposed %+v, want tombstones dropped up to %d", agent.applied, tt.want)
+			}
+		})
+	}
+}
+
+func TestNodeDataFromSerf_AppliedIndex(t *testing.T) {
+	tests := []struct {
+		tag     string // "" for none
+		want    uint64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"42", 42, false},
+		{"18446744073709551615", 18446744073709551615, false},
+		{"-1", 0, true},
+		{"forty-two", 0, true},
+	}
+	for _, tt := range tests {
+		tags := map[string]string{"id": "node-2", "raft_addr": "10.0.0.2", "raft_port": "5000", "http_addr": "10.0.0.2", "http_port": "8000"}
+		if tt.tag != "" {
+			tags["applied_index"] = tt.tag
+		}
+		node, err := nodeDataFromSerf(serf.Member{Name: "node-2", Tags: tags})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("nodeDataFromSerf() with applied_index %q error = %v, wantErr %v", tt.tag, err, tt.wantErr)
+			continue
+		}
+		if err == nil && node.AppliedIndex() != tt.want {
+			t.Errorf("nodeDataFromSerf() with applied_index %q = %d, want %d", tt.tag, node.AppliedIndex(), tt.want)
+		}
+	}
+}
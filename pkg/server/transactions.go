@@ -0,0 +1,293 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/errdefs"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+const (
+	// txnTable holds a record per in-flight transaction in the metadata
+	// group (shard 1), keyed by transaction ID.  The record is the source of
+	// truth for the transaction's outcome.
+	txnTable         = "_txns"
+	txnStateColumn   = "state"
+	txnShardsColumn  = "shards"
+	txnStartedColumn = "started"
+
+	txnPending   = "pending"
+	txnCommitted = "committed"
+	txnAborted   = "aborted"
+
+	// maxTxnWrites bounds the writes of a single transaction.
+	maxTxnWrites = 1000
+	// txnTimeout is how long a transaction may stay pending before recovery
+	// aborts it.
+	txnTimeout          = 30 * time.Second
+	txnRecoveryInterval = 10 * time.Second
+)
+
+var (
+	ErrTxnAborted = errdefs.New(errdefs.ErrConflict, "transaction aborted")
+)
+
+// shardForKey returns the raft group owning a row.  Every row lives in shard
+// 1 for now, transactions already go through every group they touch.
+func (n *server) shardForKey(table, key string) uint64 {
+	return shardID1
+}
+
+// transactOnce applies the writes atomically across every shard they touch using
+// two-phase commit: the transaction record is created pending, every shard
+// prepares (locks the rows and stages the writes), the record is flipped to
+// committed and the shards apply their staged writes.  If any shard can't
+// prepare, e.g. a row is locked by another transaction, everything is
+// aborted.  Once the record says committed the transaction is durable, shards
+// that didn't hear so yet are finished by recovery.
+func (n *server) transactOnce(ctx context.Context, writes []multiraft.TxnWrite) (string, error) {
+	if len(writes) == 0 || len(writes) > maxTxnWrites {
+		return "", fmt.Errorf("a transaction needs between 1 and %d writes, got %d", maxTxnWrites, len(writes))
+	}
+	writes = append([]multiraft.TxnWrite(nil), writes...)
+	if err := n.sealWrites(writes); err != nil {
+		return "", err
+	}
+	byShard := map[uint64][]multiraft.TxnWrite{}
+	for _, w := range writes {
+		shard := n.shardForKey(w.Table, w.Row)
+		byShard[shard] = append(byShard[shard], w)
+	}
+	shards := make([]uint64, 0, len(byShard))
+	for shard := range byShard {
+		shards = append(shards, shard)
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i] < shards[j] })
+
+	id, err := newTxnID()
+	if err != nil {
+		return "", err
+	}
+	record := map[string]string{
+		txnStateColumn:   txnPending,
+		txnShardsColumn:  formatShards(shards),
+		txnStartedColumn: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	neverWritten := uint64(0)
+	version, err := n.SetRow(ctx, txnTable, id, record, false, &neverWritten)
+	if err != nil {
+		return "", fmt.Errorf("creating transaction record: %w", err)
+	}
+
+	var prepareErr error
+	for _, shard := range shards {
+		err := n.prepareWithWait(ctx, id, shard, byShard[shard])
+		if err != nil {
+			prepareErr = fmt.Errorf("preparing txn %s on shard %d: %w", id, shard, err)
+			break
+		}
+	}
+
+	outcome := txnCommitted
+	if prepareErr != nil {
+		outcome = txnAborted
+	}
+	decided, err := n.decideTxn(ctx, id, version, outcome)
+	if err != nil {
+		// the record is still pending, recovery aborts it after txnTimeout.
+		return id, fmt.Errorf("deciding txn %s: %w", id, err)
+	}
+	if err := n.finishTxn(ctx, id, shards, decided); err != nil {
+		n.logger.Warn("transaction decided but not finished, leaving it to recovery",
+			zap.String("txn", id), zap.String("outcome", decided), zap.Error(err))
+	}
+	if decided == txnAborted {
+		if prepareErr != nil {
+			return id, fmt.Errorf("%w: %w", ErrTxnAborted, prepareErr)
+		}
+		return id, ErrTxnAborted
+	}
+	n.txnStats.record(func(s *txnStats) { s.commits++ })
+	return id, nil
+}
+
+// decideTxn flips a pending transaction record to outcome.  The write is
+// conditional on the record's version, so when the coordinator and recovery
+// race exactly one decision sticks, which is returned.
+func (n *server) decideTxn(ctx context.Context, id string, version uint64, outcome string) (string, error) {
+	_, err := n.SetRow(ctx, txnTable, id, map[string]string{txnStateColumn: outcome}, false, &version)
+	if errors.Is(err, multiraft.ErrVersionMismatch) {
+		row, _, err := n.GetRow(ctx, txnTable, id, 0, []string{txnStateColumn})
+		if err != nil {
+			return "", err
+		}
+		if state, ok := row.Columns[txnStateColumn]; ok {
+			return state, nil
+		}
+		// already finished and dropped.  Only the coordinator commits, so
+		// the coordinator losing the race means recovery aborted it.
+		return txnAborted, nil
+	} else if err != nil {
+		return "", err
+	}
+	return outcome, nil
+}
+
+// finishTxn sends the decided outcome to every shard of the transaction, then
+// drops its record.
+func (n *server) finishTxn(ctx context.Context, id string, shards []uint64, outcome string) error {
+	op := multiraft.OpTxnCommit
+	if outcome == txnAborted {
+		op = multiraft.OpTxnAbort
+	}
+	for _, shard := range shards {
+		agent, err := n.shardAgent(shard)
+		if err != nil {
+			return err
+		}
+		if _, err := agent.Apply(ctx, multiraft.KVData{Op: op, Txn: id}); err != nil {
+			return fmt.Errorf("finishing txn %s on shard %d: %w", id, shard, err)
+		}
+	}
+	if _, err := n.DeleteKey(ctx, txnTable, id, ""); err != nil {
+		return fmt.Errorf("dropping record of txn %s: %w", id, err)
+	}
+	return nil
+}
+
+// runTxnRecovery is run by the leader, see leaderLoop.
+func (n *server) runTxnRecovery(ctx context.Context) {
+	ticker := time.NewTicker(txnRecoveryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := n.recoverTxns(ctx); err != nil {
+			n.logger.Warn("transaction recovery failed", zap.Error(err))
+		}
+	}
+}
+
+// recoverTxns resolves in-doubt transactions: decided ones are finished,
+// pending ones older than txnTimeout are aborted, and prepared intents whose
+// record is gone are aborted (a record is always created before any shard
+// prepares, so a missing record means the transaction never committed).
+func (n *server) recoverTxns(ctx context.Context) error {
+	// intents are listed before the records, so an intent prepared after the
+	// listing can't be mistaken for an orphan.
+	intents := map[uint64][]string{}
+	n.raftAgentsMu.Lock()
+	agents := make(map[uint64]raftAgent, len(n.raftAgents))
+	for shard, agent := range n.raftAgents {
+		agents[shard] = agent
+	}
+	n.raftAgentsMu.Unlock()
+	for shard, agent := range agents {
+		res, err := agent.Read(ctx, multiraft.TxnIntentsQuery{})
+		if err != nil {
+			return fmt.Errorf("listing intents of shard %d: %w", shard, err)
+		}
+		intents[shard] = res.([]string)
+	}
+
+	records, err := n.ScanTable(ctx, txnTable)
+	if err != nil {
+		return fmt.Errorf("listing transaction records: %w", err)
+	}
+	for id, cols := range records {
+		shards, err := parseShards(cols[txnShardsColumn])
+		if err != nil {
+			n.logger.Error("skipping malformed transaction record", zap.String("txn", id), zap.Error(err))
+			continue
+		}
+		outcome := cols[txnStateColumn]
+		if outcome == txnPending {
+			started, err := time.Parse(time.RFC3339Nano, cols[txnStartedColumn])
+			if err == nil && time.Since(started) < txnTimeout {
+				continue
+			}
+			row, _, err := n.GetRow(ctx, txnTable, id, 0, []string{txnStateColumn})
+			if err != nil {
+				return err
+			}
+			switch state := row.Columns[txnStateColumn]; state {
+			case txnPending:
+				if outcome, err = n.decideTxn(ctx, id, row.Version, txnAborted); err != nil {
+					return err
+				}
+			case "":
+				continue // finished by the coordinator since the scan
+			default:
+				outcome = state // decided by the coordinator since the scan
+			}
+		}
+		if err := n.finishTxn(ctx, id, shards, outcome); err != nil {
+			return err
+		}
+		n.logger.Info("recovered in-doubt transaction", zap.String("txn", id), zap.String("outcome", outcome))
+	}
+
+	for shard, ids := range intents {
+		for _, id := range ids {
+			if _, ok := records[id]; ok {
+				continue
+			}
+			if _, err := agents[shard].Apply(ctx, multiraft.KVData{Op: multiraft.OpTxnAbort, Txn: id}); err != nil {
+				return fmt.Errorf("aborting orphaned txn %s on shard %d: %w", id, shard, err)
+			}
+			n.logger.Info("aborted orphaned transaction intent", zap.String("txn", id), zap.Uint64("shard", shard))
+		}
+	}
+	return nil
+}
+
+// shardAgent returns the local raft agent of a shard.
+func (n *server) shardAgent(shard uint64) (raftAgent, error) {
+	n.raftAgentsMu.Lock()
+	defer n.raftAgentsMu.Unlock()
+	agent, ok := n.raftAgents[shard]
+	if !ok {
+		return nil, fmt.Errorf("shard %d not hosted on this node", shard)
+	}
+	return agent, nil
+}
+
+func newTxnID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func formatShards(shards []uint64) string {
+	parts := make([]string, len(shards))
+	for i, shard := range shards {
+		parts[i] = strconv.FormatUint(shard, 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+func parseShards(s string) ([]uint64, error) {
+	var shards []uint64
+	for _, part := range strings.Split(s, ",") {
+		shard, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing shard %q: %w", part, err)
+		}
+		shards = append(shards, shard)
+	}
+	return shards, nil
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/epsniff/expodb/pkg/errdefs"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+// SetTrigger attaches a trigger registered on this node to a table, see
+// multiraft.TableTrigger, or changes its args.  Rows written before are left
+// as they are.
+func (n *server) SetTrigger(ctx context.Context, trigger multiraft.TableTrigger) (uint64, error) {
+	if err := trigger.Validate(); err != nil {
+		return 0, errdefs.Wrap(errdefs.ErrInvalid, err)
+	}
+	if strings.HasPrefix(trigger.Table, "_") {
+		return 0, errdefs.New(errdefs.ErrInvalid, fmt.Sprintf("triggers can't be attached to system table %s", trigger.Table))
+	}
+	if _, ok := n.triggers[trigger.Name]; !ok {
+		return 0, errdefs.New(errdefs.ErrInvalid, fmt.Sprintf("no trigger %s is registered on this node", trigger.Name))
+	}
+	return n.applyWrite(ctx, multiraft.KVData{Op: multiraft.OpSetTrigger, Table: trigger.Table, Trigger: &trigger})
+}
+
+// DropTrigger detaches a trigger from a table, dropping one that isn't
+// attached is a no-op.
+func (n *server) DropTrigger(ctx context.Context, table, name string) (uint64, error) {
+	return n.applyWrite(ctx, multiraft.KVData{Op: multiraft.OpDropTrigger, Table: table, Row: name})
+}
+
+// Triggers returns the triggers attached to every table.
+func (n *server) Triggers(ctx context.Context) ([]multiraft.TableTrigger, error) {
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return nil, err
+	}
+	res, err := agent.Read(ctx, multiraft.TriggersQuery{})
+	if err != nil {
+		return nil, err
+	}
+	triggers, ok := res.([]multiraft.TableTrigger)
+	if !ok {
+		return nil, fmt.Errorf("converting result to []multiraft.TableTrigger: %T", res)
+	}
+	return triggers, nil
+}
+
+func (n *server) triggerRows(ctx context.Context) ([]multiraft.ScanRow, error) {
+	triggers, err := n.Triggers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var rows []multiraft.ScanRow
+	for _, t := range triggers {
+		args, err := json.Marshal(t.Args)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, multiraft.ScanRow{Key: t.Table + "/" + t.Name, Columns: map[string]string{
+			"table": t.Table,
+			"name":  t.Name,
+			"args":  string(args),
+		}})
+	}
+	return rows, nil
+}
+
+// handleTriggerChange attaches or detaches a trigger, by path.  Either takes
+// admin on the table.
+func (server *httpServer) handleTriggerChange(w http.ResponseWriter, r *http.Request) {
+	req := multiraft.TableTrigger{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Table == "" || req.Name == "" {
+		server.logger.Error("Bad request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !server.checkTable(w, r, ActionAdmin, req.Table) {
+		return
+	}
+	if !server.checkWritable(w) {
+		return
+	}
+	var index uint64
+	var err error
+	if strings.HasSuffix(r.URL.Path, "/_create") {
+		index, err = server.node.SetTrigger(r.Context(), req)
+	} else {
+		index, err = server.node.DropTrigger(r.Context(), req.Table, req.Name)
+	}
+	if errors.Is(err, multiraft.ErrWritesFrozen) {
+		server.logger.Info("Rejecting trigger change", zap.Error(err))
+		statusUnavailable(w)
+		return
+	} else if err != nil {
+		server.logger.Error("Failed to change trigger", zap.String("table", req.Table), zap.String("trigger", req.Name), zap.Error(err))
+		statusError(w, err)
+		return
+	}
+	response := struct {
+		Index uint64 `json:"index"`
+	}{
+		Index: index,
+	}
+	respond(w, http.StatusOK, response, server.logger)
+}
@@ -0,0 +1,69 @@
+// Package triggers holds the triggers every node registers, see
+// multiraft.TriggerFunc.  Programs embedding a node add their own with
+// server.WithTrigger.
+package triggers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+)
+
+// Builtin are the triggers registered on every node, by name:
+//
+//	require  rejects writes leaving the row without one of the comma
+//	         separated "columns" args
+//	concat   computes the "column" arg as the comma separated "from" columns
+//	         joined with the "sep" arg, when the write sets one of them
+var Builtin = map[string]multiraft.TriggerFunc{
+	"require": Require,
+	"concat":  Concat,
+}
+
+// Require rejects writes leaving the row without one of the columns of the
+// "columns" arg.
+func Require(w *multiraft.TriggerWrite) error {
+	row := w.Merged()
+	for _, col := range splitArg(w.Args["columns"]) {
+		if row[col] == "" {
+			return fmt.Errorf("column %s is required", col)
+		}
+	}
+	return nil
+}
+
+// Concat sets the column of the "column" arg to the columns of the "from"
+// arg joined with the "sep" arg, when the write sets one of them.
+func Concat(w *multiraft.TriggerWrite) error {
+	target, from := w.Args["column"], splitArg(w.Args["from"])
+	if target == "" || len(from) == 0 {
+		return fmt.Errorf("concat needs the column and from args")
+	}
+	touched := false
+	for _, col := range from {
+		if _, ok := w.Columns[col]; ok {
+			touched = true
+		}
+	}
+	if !touched {
+		return nil
+	}
+	row := w.Merged()
+	vals := make([]string, 0, len(from))
+	for _, col := range from {
+		vals = append(vals, row[col])
+	}
+	w.Columns[target] = strings.Join(vals, w.Args["sep"])
+	return nil
+}
+
+func splitArg(arg string) []string {
+	var cols []string
+	for _, col := range strings.Split(arg, ",") {
+		if col = strings.TrimSpace(col); col != "" {
+			cols = append(cols, col)
+		}
+	}
+	return cols
+}
@@ -0,0 +1,34 @@
+package triggers
+
+import (
+	"testing"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+)
+
+func TestRequire(t *testing.T) {
+	args := map[string]string{"columns": "name, email"}
+	w := &multiraft.TriggerWrite{Columns: map[string]string{"name": "ada"}, Current: map[string]string{"email": "ada@example.com"}, Args: args}
+	if err := Require(w); err != nil {
+		t.Errorf("Require() of a row keeping both = %v", err)
+	}
+	w.Replace = true
+	if err := Require(w); err == nil {
+		t.Error("Require() of a row replaced without email succeeded")
+	}
+}
+
+func TestConcat(t *testing.T) {
+	args := map[string]string{"column": "full", "from": "first,last", "sep": " "}
+	w := &multiraft.TriggerWrite{Columns: map[string]string{"last": "lovelace"}, Current: map[string]string{"first": "ada"}, Args: args}
+	if err := Concat(w); err != nil || w.Columns["full"] != "ada lovelace" {
+		t.Errorf("Concat() = %v, columns %v, want full computed", err, w.Columns)
+	}
+	w = &multiraft.TriggerWrite{Columns: map[string]string{"age": "36"}, Args: args}
+	if err := Concat(w); err != nil || len(w.Columns) != 1 {
+		t.Errorf("Concat() of other columns = %v, columns %v, want them untouched", err, w.Columns)
+	}
+	if err := Concat(&multiraft.TriggerWrite{Columns: map[string]string{"first": "x"}}); err == nil {
+		t.Error("Concat() without args succeeded")
+	}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/errdefs"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+const (
+	// lockWaitTimeout is how long a prepare waits for a locked row before
+	// the transaction is aborted.  It also breaks deadlocks between
+	// transactions coordinated by different nodes.
+	lockWaitTimeout    = 2 * time.Second
+	lockWaitMinBackoff = 5 * time.Millisecond
+	lockWaitMaxBackoff = 100 * time.Millisecond
+	// maxTxnAttempts is how many times a transaction aborted by a write-write
+	// conflict is run before the conflict is returned to the client.
+	maxTxnAttempts     = 3
+	txnRetryMinBackoff = 20 * time.Millisecond
+)
+
+var (
+	ErrLockWaitTimeout = errdefs.New(errdefs.ErrConflict, "timed out waiting for a locked row")
+	ErrDeadlock        = errdefs.New(errdefs.ErrConflict, "deadlock between transactions")
+)
+
+// lockWait is a transaction coordinated by this node waiting on a row locked
+// by another.
+type lockWait struct {
+	Txn    string    `json:"txn"`
+	Shard  uint64    `json:"shard"`
+	Table  string    `json:"table"`
+	Row    string    `json:"key"`
+	Holder string    `json:"holder"`
+	Since  time.Time `json:"since"`
+}
+
+// txnStats counts transaction outcomes and contention, see /status.
+type txnStats struct {
+	mu               sync.Mutex
+	commits          uint64
+	aborts           uint64
+	retries          uint64
+	lockWaits        uint64
+	lockWaitTimeouts uint64
+	deadlocks        uint64
+	conflictsByTable map[string]uint64
+	waiting          map[string]lockWait
+}
+
+func (s *txnStats) record(fn func(s *txnStats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conflictsByTable == nil {
+		s.conflictsByTable = map[string]uint64{}
+		s.waiting = map[string]lockWait{}
+	}
+	fn(s)
+}
+
+// waitsOn reports whether the transaction from waits, directly or through
+// other waiting transactions, on to.  Only waits coordinated by this node
+// are known, the others are broken by lockWaitTimeout.
+func (s *txnStats) waitsOn(from, to string) bool {
+	seen := map[string]bool{}
+	for cur := from; !seen[cur]; {
+		seen[cur] = true
+		w, ok := s.waiting[cur]
+		if !ok {
+			return false
+		}
+		if w.Holder == to {
+			return true
+		}
+		cur = w.Holder
+	}
+	return false
+}
+
+// txnStatus is the transactions section of /status.
+type txnStatus struct {
+	Commits          uint64            `json:"commits"`
+	Aborts           uint64            `json:"aborts"`
+	Retries          uint64            `json:"retries"`
+	LockWaits        uint64            `json:"lock_waits"`
+	LockWaitTimeouts uint64            `json:"lock_wait_timeouts"`
+	Deadlocks        uint64            `json:"deadlocks"`
+	ConflictsByTable map[string]uint64 `json:"conflicts_by_table,omitempty"`
+	Waiting          []lockWait        `json:"waiting,omitempty"`
+}
+
+func (n *server) txnStatus() *txnStatus {
+	st := &txnStatus{}
+	n.txnStats.record(func(s *txnStats) {
+		st.Commits, st.Aborts, st.Retries = s.commits, s.aborts, s.retries
+		st.LockWaits, st.LockWaitTimeouts, st.Deadlocks = s.lockWaits, s.lockWaitTimeouts, s.deadlocks
+		if len(s.conflictsByTable) > 0 {
+			st.ConflictsByTable = map[string]uint64{}
+			for table, count := range s.conflictsByTable {
+				st.ConflictsByTable[table] = count
+			}
+		}
+		for _, w := range s.waiting {
+			st.Waiting = append(st.Waiting, w)
+		}
+	})
+	sort.Slice(st.Waiting, func(i, j int) bool { return st.Waiting[i].Since.Before(st.Waiting[j].Since) })
+	return st
+}
+
+// Transact runs a transaction, see transactOnce, retrying it when it was
+// aborted by a write-write conflict with another transaction.
+func (n *server) Transact(ctx context.Context, writes []multiraft.TxnWrite) (string, error) {
+	backoff := txnRetryMinBackoff
+	for attempt := 1; ; attempt++ {
+		id, err := n.transactOnce(ctx, writes)
+		if !errors.Is(err, ErrTxnAborted) {
+			return id, err
+		}
+		n.txnStats.record(func(s *txnStats) { s.aborts++ })
+		if !errors.Is(err, multiraft.ErrTxnConflict) || attempt == maxTxnAttempts {
+			return id, err
+		}
+		n.txnStats.record(func(s *txnStats) { s.retries++ })
+		n.logger.Debug("retrying conflicting transaction", zap.String("txn", id), zap.Int("attempt", attempt), zap.Error(err))
+		// jittered, so the transactions that collided don't collide again.
+		timer := time.NewTimer(backoff/2 + time.Duration(rand.Int63n(int64(backoff))))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return id, err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// prepareWithWait prepares the transaction on a shard, waiting for rows
+// locked by other transactions to be released.  It gives up with the
+// conflict once lockWaitTimeout has passed, or right away when waiting would
+// deadlock: the lock holder is itself waiting on this transaction.
+func (n *server) prepareWithWait(ctx context.Context, id string, shard uint64, writes []multiraft.TxnWrite) error {
+	agent, err := n.shardAgent(shard)
+	if err != nil {
+		return err
+	}
+	defer n.txnStats.record(func(s *txnStats) { delete(s.waiting, id) })
+	deadline := time.Now().Add(lockWaitTimeout)
+	backoff := lockWaitMinBackoff
+	for {
+		_, err := agent.Apply(ctx, multiraft.KVData{Op: multiraft.OpTxnPrepare, Txn: id, Writes: writes})
+		var conflict *multiraft.TxnConflictError
+		if !errors.As(err, &conflict) {
+			return err
+		}
+
+		var waitErr error
+		n.txnStats.record(func(s *txnStats) {
+			s.conflictsByTable[conflict.Table]++
+			if s.waitsOn(conflict.Holder, id) {
+				s.deadlocks++
+				waitErr = ErrDeadlock
+				return
+			}
+			if time.Now().After(deadline) {
+				s.lockWaitTimeouts++
+				waitErr = ErrLockWaitTimeout
+				return
+			}
+			if w, ok := s.waiting[id]; !ok || w.Holder != conflict.Holder {
+				s.lockWaits++
+				s.waiting[id] = lockWait{Txn: id, Shard: shard, Table: conflict.Table, Row: conflict.Row, Holder: conflict.Holder, Since: time.Now()}
+			}
+		})
+		if waitErr != nil {
+			return fmt.Errorf("%w: %w", waitErr, conflict)
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w: %w", ctx.Err(), conflict)
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > lockWaitMaxBackoff {
+			backoff = lockWaitMaxBackoff
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package server
+
+import "testing"
+
+func TestTxnStats_WaitsOn(t *testing.T) {
+	s := &txnStats{}
+	s.record(func(s *txnStats) {
+		s.waiting["a"] = lockWait{Txn: "a", Holder: "b"}
+		s.waiting["b"] = lockWait{Txn: "b", Holder: "c"}
+		s.waiting["x"] = lockWait{Txn: "x", Holder: "y"}
+		s.waiting["y"] = lockWait{Txn: "y", Holder: "x"}
+	})
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{"a", "c", true},  // through b
+		{"b", "a", false}, // c isn't waiting
+		{"c", "a", false},
+		{"x", "z", false}, // a cycle not involving z terminates
+		{"y", "y", true},
+	}
+	for _, tt := range tests {
+		if got := s.waitsOn(tt.from, tt.to); got != tt.want {
+			t.Errorf("waitsOn(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"sort"
+
+	"github.com/epsniff/expodb/pkg/version"
+)
+
+// versionStatus is returned by the /version endpoint: the build of the node
+// answering, and the builds the other members gossip.
+type versionStatus struct {
+	version.Info
+	Nodes []nodeVersion `json:"nodes"`
+	// Mixed is set while members run different releases or FSM protocols.
+	Mixed bool `json:"mixed"`
+}
+
+type nodeVersion struct {
+	ID          string `json:"id"`
+	Version     string `json:"version,omitempty"`
+	Build       string `json:"build,omitempty"`
+	FSMProtocol int    `json:"fsm_protocol,omitempty"`
+}
+
+// Version returns this node's build and the builds its members gossip.
+// Members restored from the catalog, not heard from since this node started,
+// have none and don't count towards Mixed.
+func (n *server) Version() *versionStatus {
+	status := &versionStatus{Info: version.Get(), Nodes: []nodeVersion{}}
+	for _, node := range n.metadata.Nodes() {
+		if node.State() == nodeDecommissioned {
+			continue
+		}
+		status.Nodes = append(status.Nodes, nodeVersion{
+			ID:          node.ID(),
+			Version:     node.Version(),
+			Build:       node.Build(),
+			FSMProtocol: node.FSMProtocol(),
+		})
+		if node.Version() != "" && (node.Version() != status.Version || node.FSMProtocol() != status.FSMProtocol) {
+			status.Mixed = true
+		}
+	}
+	sort.Slice(status.Nodes, func(i, j int) bool { return status.Nodes[i].ID < status.Nodes[j].ID })
+	return status
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/epsniff/expodb/pkg/version"
+	"github.com/hashicorp/serf/serf"
+)
+
+func TestVersion_Mixed(t *testing.T) {
+	n := &server{metadata: NewMetadata()}
+	add := func(id, ver, fsm string) {
+		t.Helper()
+		tags := map[string]string{"id": id, "raft_addr": id, "raft_port": "5000", "http_addr": id, "http_port": "8000"}
+		if ver != "" {
+			tags["ver"], tags["build"], tags["fsm_vsn"] = ver, "abc123", fsm
+		}
+		if _, err := n.metadata.Add(serf.Member{Name: id, Tags: tags}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("node-1", version.ServerVersion, "1")
+	add("node-2", "", "")
+	status := n.Version()
+	if status.Mixed || len(status.Nodes) != 2 || status.Nodes[0].Build != "abc123" || status.Nodes[1].Version != "" {
+		t.Errorf("Version() = %+v, want two nodes, not mixed", status)
+	}
+	if status.Version != version.ServerVersion || status.FSMProtocol != version.FSMProtocol || status.GoVersion == "" {
+		t.Errorf("Version() = %+v, want this build", status.Info)
+	}
+
+	add("node-3", version.ServerVersion, "2")
+	if status := n.Version(); !status.Mixed || status.Nodes[2].FSMProtocol != 2 {
+		t.Errorf("Version() = %+v, want a mixed cluster", status)
+	}
+}
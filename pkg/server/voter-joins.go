@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// scheduleInterval is how often the shard's voters are picked again,
+	// see scheduleShards.
+	scheduleInterval = 30 * time.Second
+	// voterJoinInterval is how often the leader looks for voters due to join.
+	voterJoinInterval = time.Second
+	// voterJoinMinBackoff doubles after every failed attempt, up to
+	// voterJoinMaxBackoff.  After voterJoinMaxAttempts a join has failed for
+	// good, until the node gossips a join again.
+	voterJoinMinBackoff  = time.Second
+	voterJoinMaxBackoff  = time.Minute
+	voterJoinMaxAttempts = 10
+)
+
+const (
+	voterJoinPending = "pending"
+	voterJoinFailed  = "failed"
+)
+
+// voterJoin is a node the leader is adding to the shard as a voter, as
+// reported under "voter_joins" in /status.
+type voterJoin struct {
+	ID          string     `json:"id"`
+	RaftAddr    string     `json:"raft_addr"`
+	State       string     `json:"state"`
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error,omitempty"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+}
+
+// voterJoins is the leader's queue of voters to add.  Member events and the
+// scheduler only queue them, joinVoter runs in runVoterJoins, so neither
+// waits on raft.  A node is queued once however often it is asked for.
+type voterJoins struct {
+	mu    sync.Mutex
+	joins map[string]*voterJoin
+}
+
+// add queues a node, unless it already is.  retryFailed queues a node whose
+// join has failed for good again.
+func (q *voterJoins) add(id, raftAddr string, retryFailed bool, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.joins == nil {
+		q.joins = map[string]*voterJoin{}
+	}
+	if j, ok := q.joins[id]; ok && (j.State == voterJoinPending || !retryFailed) {
+		return
+	}
+	q.joins[id] = &voterJoin{ID: id, RaftAddr: raftAddr, State: voterJoinPending, NextAttempt: &now}
+}
+
+// due returns the pending joins whose next attempt is due.
+func (q *voterJoins) due(now time.Time) []voterJoin {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var due []voterJoin
+	for _, j := range q.joins {
+		if j.State == voterJoinPending && !j.NextAttempt.After(now) {
+			due = append(due, *j)
+		}
+	}
+	sort.Slice(due, func(i, k int) bool { return due[i].ID < due[k].ID })
+	return due
+}
+
+// done records an attempt: a nil err drops the join, a terminal one fails it
+// for good, others are retried with a backoff.
+func (q *voterJoins) done(id string, err error, terminal bool, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.joins[id]
+	if !ok {
+		return
+	}
+	if err == nil {
+		delete(q.joins, id)
+		return
+	}
+	j.Attempts++
+	j.LastError = err.Error()
+	if terminal || j.Attempts >= voterJoinMaxAttempts {
+		j.State, j.NextAttempt = voterJoinFailed, nil
+		return
+	}
+	backoff := voterJoinMinBackoff << (j.Attempts - 1)
+	if backoff > voterJoinMaxBackoff {
+		backoff = voterJoinMaxBackoff
+	}
+	next := now.Add(backoff)
+	j.NextAttempt = &next
+}
+
+func (q *voterJoins) reset() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.joins = nil
+}
+
+// list returns the queued joins, failed ones included, by node ID.
+func (q *voterJoins) list() []voterJoin {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	joins := make([]voterJoin, 0, len(q.joins))
+	for _, j := range q.joins {
+		joins = append(joins, *j)
+	}
+	sort.Slice(joins, func(i, k int) bool { return joins[i].ID < joins[k].ID })
+	return joins
+}
+
+// queueVoterJoin queues a node picked as a voter to join the shard, when
+// this node leads it.
+func (n *server) queueVoterJoin(node *nodedata, retryFailed bool) {
+	if node.IsWitness() || node.State() == nodeDecommissioned {
+		return
+	}
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return
+	}
+	if isLeader, err := agent.IsLeader(); err != nil || !isLeader || node.ID() == n.config.ID() {
+		return
+	}
+	n.voterJoins.add(node.ID(), node.RaftAddr(), retryFailed, time.Now())
+}
+
+// isShardVoter reports whether id is one of the voters picked for the shard.
+func (n *server) isShardVoter(id string) bool {
+	voters, err := n.shardVoters(shardID1)
+	if err != nil {
+		return false
+	}
+	for _, v := range voters {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// runVoterJoins is run by the leader, see leaderLoop.
+func (n *server) runVoterJoins(ctx context.Context) {
+	defer n.voterJoins.reset()
+	ticker := time.NewTicker(voterJoinInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, j := range n.voterJoins.due(time.Now()) {
+			terminal, err := n.joinVoter(ctx, j.ID)
+			if err != nil {
+				n.logger.Warn("Error joining peer to Raft",
+					zap.String("peer.id", j.ID),
+					zap.String("peer.remoteaddr", j.RaftAddr),
+					zap.Int("attempt", j.Attempts+1),
+					zap.Bool("terminal", terminal),
+					zap.Error(err),
+				)
+			}
+			n.voterJoins.done(j.ID, err, terminal, time.Now())
+		}
+	}
+}
+
+// joinVoter adds a node to the shard as a voter, doing nothing if it already
+// replicates it.  Failures retrying won't fix are reported as terminal.
+func (n *server) joinVoter(ctx context.Context, id string) (bool, error) {
+	node, ok := n.metadata.FindByID(id)
+	if !ok || node.State() == nodeDecommissioned {
+		return false, nil
+	}
+	replicaID, err := parseNodeID(node.ID())
+	if err != nil {
+		return true, err
+	}
+	agent, err := n.shardAgent(shardID1)
+	if err != nil {
+		return false, err
+	}
+	members, err := agent.Members(ctx)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := members[replicaID]; ok {
+		return false, nil // already replicating
+	}
+	if _, ok := members[nonVotingReplicaID(replicaID)]; ok {
+		return false, nil // demoted, see autopilot.go
+	}
+	if err := n.checkClusterID(node); err != nil {
+		return true, fmt.Errorf("refusing to join: %w", err)
+	}
+	if err := n.probeJoin(ctx, node); err != nil {
+		return false, err
+	}
+	if decommissioned, err := n.persistedDecommission(ctx, node.ID()); err != nil {
+		return false, err
+	} else if decommissioned {
+		n.metadata.SetState(node.ID(), nodeDecommissioned)
+		return true, fmt.Errorf("refusing to join: node %s is decommissioned", node.ID())
+	}
+	tokenID, err := n.authorizeJoin(ctx, node)
+	if err != nil {
+		return true, fmt.Errorf("refusing to join: %w", err)
+	}
+	if err := agent.AddVoter(replicaID, node.RaftAddr()); err != nil {
+		return false, err
+	}
+	if err := n.consumeJoinToken(ctx, tokenID); err != nil {
+		n.logger.Warn("Failed to consume join token", zap.String("peer.id", node.ID()), zap.Error(err))
+	}
+	n.logger.Info("Peer joined Raft", zap.String("peer.id", node.ID()),
+		zap.String("peer.remoteaddr", node.RaftAddr()))
+	n.recordEvent(ctx, eventVoterAdded, node.ID(), node.RaftAddr())
+	return false, nil
+}
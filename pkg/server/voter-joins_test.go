@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/config"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	machines "github.com/epsniff/expodb/pkg/server/state-machines"
+	"go.uber.org/zap"
+)
+
+func TestVoterJoins(t *testing.T) {
+	var q voterJoins
+	start := time.Unix(1000, 0)
+	q.add("node-2", "n2:7000", false, start)
+	q.add("node-2", "n2:7000", true, start.Add(time.Second))
+	if due := q.due(start); len(due) != 1 || due[0].ID != "node-2" {
+		t.Fatalf("due() = %v, want node-2 once", due)
+	}
+
+	q.done("node-2", errors.New("timeout"), false, start)
+	if due := q.due(start.Add(time.Second / 2)); len(due) != 0 {
+		t.Errorf("due() = %v before the backoff", due)
+	}
+	q.done("node-2", errors.New("timeout"), false, start)
+	if j := q.list()[0]; j.Attempts != 2 || !j.NextAttempt.Equal(start.Add(2*time.Second)) {
+		t.Errorf("after 2 attempts = %+v, want next attempt in 2s", j)
+	}
+
+	q.done("node-2", errors.New("bad id"), true, start)
+	if j := q.list()[0]; j.State != voterJoinFailed || j.NextAttempt != nil {
+		t.Errorf("after a terminal error = %+v, want failed", j)
+	}
+	q.add("node-2", "n2:7000", false, start)
+	if due := q.due(start); len(due) != 0 {
+		t.Errorf("due() = %v, a failed join was queued again", due)
+	}
+	q.add("node-2", "n2:7000", true, start)
+	if due := q.due(start); len(due) != 1 || due[0].Attempts != 0 {
+		t.Errorf("due() = %v, want node-2 retried afresh", due)
+	}
+
+	q.done("node-2", nil, false, start)
+	if joins := q.list(); len(joins) != 0 {
+		t.Errorf("list() = %v after joining", joins)
+	}
+
+	q.add("node-3", "n3:7000", false, start)
+	for i := 0; i < voterJoinMaxAttempts; i++ {
+		q.done("node-3", errors.New("timeout"), false, start)
+	}
+	if j := q.list()[0]; j.State != voterJoinFailed {
+		t.Errorf("after %d attempts = %+v, want failed", voterJoinMaxAttempts, j)
+	}
+}
+
+// joinAgent is a shard with no members, whose reads answer the catalog
+// entry row and which takes any write.
+type joinAgent struct {
+	raftAgent
+	row    *multiraft.Row
+	voters []uint64
+}
+
+func (a *joinAgent) Members(ctx context.Context) (map[uint64]string, error) {
+	return map[uint64]string{}, nil
+}
+
+func (a *joinAgent) Read(ctx context.Context, query interface{}) (interface{}, error) {
+	return a.row, nil
+}
+
+func (a *joinAgent) AppliedIndex() (uint64, error) { return 1, nil }
+
+func (a *joinAgent) ReadLocal(query interface{}) (interface{}, error) { return nil, nil }
+
+func (a *joinAgent) Apply(ctx context.Context, entry machines.RaftEntry) (uint64, error) {
+	return 1, nil
+}
+
+func (a *joinAgent) AddVoter(replicaID uint64, peerAddress string) error {
+	a.voters = append(a.voters, replicaID)
+	return nil
+}
+
+func TestJoinVoter_PersistedDecommission(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	for _, state := range []nodeState{nodeAlive, nodeDecommissioned} {
+		agent := &joinAgent{row: &multiraft.Row{Columns: map[string]string{"state": string(state)}}}
+		n := &server{metadata: NewMetadata(), raftAgents: map[uint64]raftAgent{shardID1: agent}, config: &config.Config{}, logger: zap.NewNop()}
+		n.metadata.Restore(&nodedata{id: "node-2", raftAddr: l.Addr().String(), state: nodeAlive})
+		terminal, err := n.joinVoter(context.Background(), "node-2")
+		node, _ := n.metadata.FindByID("node-2")
+		if state == nodeDecommissioned {
+			if err == nil || !terminal || len(agent.voters) != 0 || node.State() != nodeDecommissioned {
+				t.Errorf("persisted decommission: terminal %v, err %v, voters %v, state %s", terminal, err, agent.voters, node.State())
+			}
+		} else if err != nil || len(agent.voters) != 1 {
+			t.Errorf("alive node: err %v, voters %v", err, agent.voters)
+		}
+	}
+}
+
+func TestJoinVoter_ClusterIDAndProbe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := closed.Addr().String()
+	closed.Close()
+
+	tests := []struct {
+		name         string
+		ours, theirs string
+		raftAddr     string
+		wantJoined   bool
+		wantTerminal bool
+	}{
+		{"same cluster", "c1", "c1", "", true, false},
+		{"new node", "c1", "", "", true, false},
+		{"no cluster id of ours", "", "c2", "", true, false},
+		{"another cluster", "c1", "c2", "", false, true},
+		{"unreachable", "c1", "c1", unreachable, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := &joinAgent{row: &multiraft.Row{Columns: map[string]string{"state": string(nodeAlive)}}}
+			n := &server{metadata: NewMetadata(), raftAgents: map[uint64]raftAgent{shardID1: agent}, config: &config.Config{}, logger: zap.NewNop()}
+			n.clusterID = tt.ours
+			raftAddr := tt.raftAddr
+			if raftAddr == "" {
+				raftAddr = l.Addr().String()
+			}
+			n.metadata.Restore(&nodedata{id: "node-2", raftAddr: raftAddr, state: nodeAlive, clusterID: tt.theirs})
+			terminal, err := n.joinVoter(context.Background(), "node-2")
+			if joined := len(agent.voters) == 1; joined != tt.wantJoined || terminal != tt.wantTerminal || (err == nil) != tt.wantJoined {
+				t.Errorf("joinVoter() = %v, %v, voters %v, want joined %v, terminal %v", terminal, err, agent.voters, tt.wantJoined, tt.wantTerminal)
+			}
+		})
+	}
+}
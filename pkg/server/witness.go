@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+
+	"github.com/epsniff/expodb/pkg/config"
+	"go.uber.org/zap"
+)
+
+// joinWitnesses adds every alive witness node to the shards this node leads.
+// Witnesses vote in elections, so a two-datacenter deployment can keep a
+// quorum with a cheap third tiebreaker, but they never apply entries.
+func (n *server) joinWitnesses(ctx context.Context) {
+	n.raftAgentsMu.Lock()
+	agent, ok := n.raftAgents[shardID1]
+	n.raftAgentsMu.Unlock()
+	if !ok {
+		return
+	}
+	if isLeader, err := agent.IsLeader(); err != nil || !isLeader {
+		return
+	}
+	witnesses, err := agent.Witnesses(ctx)
+	if err != nil {
+		n.logger.Error("Error listing raft witnesses", zap.Error(err))
+		return
+	}
+	for _, node := range n.metadata.FindByRole(config.NodeRoleWitness) {
+		if node.State() != nodeAlive {
+			continue
+		}
+		replicaID, err := parseNodeID(node.ID())
+		if err != nil {
+			n.logger.Error("Error parsing nodedata id", zap.String("peer.id", node.ID()), zap.Error(err))
+			continue
+		}
+		if _, ok := witnesses[replicaID]; ok {
+			continue
+		}
+		if err := n.checkClusterID(node); err != nil {
+			n.logger.Warn("Refusing to join witness to Raft",
+				zap.String("peer.id", node.ID()),
+				zap.String("peer.remoteaddr", node.RaftAddr()),
+				zap.Error(err),
+			)
+			continue
+		}
+		if err := n.probeJoin(ctx, node); err != nil {
+			n.logger.Warn("Error joining witness to Raft",
+				zap.String("peer.id", node.ID()),
+				zap.String("peer.remoteaddr", node.RaftAddr()),
+				zap.Error(err),
+			)
+			continue
+		}
+		tokenID, err := n.authorizeJoin(ctx, node)
+		if err != nil {
+			n.logger.Warn("Refusing to join witness to Raft",
+				zap.String("peer.id", node.ID()),
+				zap.String("peer.remoteaddr", node.RaftAddr()),
+				zap.Error(err),
+			)
+			continue
+		}
+		if err := agent.AddWitness(replicaID, node.RaftAddr()); err != nil {
+			n.logger.Error("Error joining witness to Raft",
+				zap.String("peer.id", node.ID()),
+				zap.String("peer.remoteaddr", node.RaftAddr()),
+				zap.Error(err),
+			)
+			continue
+		}
+		if err := n.consumeJoinToken(ctx, tokenID); err != nil {
+			n.logger.Warn("Failed to consume join token", zap.String("peer.id", node.ID()), zap.Error(err))
+		}
+		n.logger.Info("Witness joined Raft", zap.String("peer.id", node.ID()),
+			zap.String("peer.remoteaddr", node.RaftAddr()))
+		n.recordEvent(ctx, eventWitnessAdded, node.ID(), node.RaftAddr())
+	}
+}
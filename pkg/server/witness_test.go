@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/epsniff/expodb/pkg/config"
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+// witnessAgent is a joinAgent that lists and adds witnesses.
+type witnessAgent struct {
+	joinAgent
+	leader    bool
+	witnesses map[uint64]string
+	added     []uint64
+}
+
+func (a *witnessAgent) IsLeader() (bool, error) { return a.leader, nil }
+
+func (a *witnessAgent) Witnesses(ctx context.Context) (map[uint64]string, error) {
+	return a.witnesses, nil
+}
+
+func (a *witnessAgent) AddWitness(replicaID uint64, peerAddress string) error {
+	a.added = append(a.added, replicaID)
+	return nil
+}
+
+func TestJoinWitnesses(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := closed.Addr().String()
+	closed.Close()
+
+	tests := []struct {
+		name      string
+		leader    bool
+		node      *nodedata
+		witnesses map[uint64]string
+		want      []uint64
+	}{
+		{"alive witness", true, &nodedata{id: "node-2", role: config.NodeRoleWitness, state: nodeAlive}, nil, []uint64{2}},
+		{"follower", false, &nodedata{id: "node-2", role: config.NodeRoleWitness, state: nodeAlive}, nil, nil},
+		{"voter", true, &nodedata{id: "node-2", role: config.NodeRoleVoter, state: nodeAlive}, nil, nil},
+		{"failed witness", true, &nodedata{id: "node-2", role: config.NodeRoleWitness, state: nodeFailed}, nil, nil},
+		{"already a witness", true, &nodedata{id: "node-2", role: config.NodeRoleWitness, state: nodeAlive}, map[uint64]string{2: "n2"}, nil},
+		{"another cluster", true, &nodedata{id: "node-2", role: config.NodeRoleWitness, state: nodeAlive, clusterID: "other"}, nil, nil},
+		{"unreachable", true, &nodedata{id: "node-2", raftAddr: unreachable, role: config.NodeRoleWitness, state: nodeAlive}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := &witnessAgent{leader: tt.leader, witnesses: tt.witnesses}
+			n := &server{metadata: NewMetadata(), raftAgents: map[uint64]raftAgent{shardID1: agent}, config: &config.Config{}, logger: zap.NewNop()}
+			n.clusterID = "ours"
+			if tt.node.raftAddr == "" {
+				tt.node.raftAddr = l.Addr().String()
+			}
+			n.metadata.Restore(tt.node)
+			n.joinWitnesses(context.Background())
+			if !reflect.DeepEqual(agent.added, tt.want) {
+				t.Errorf("witnesses added = %v, want %v", agent.added, tt.want)
+			}
+		})
+	}
+}
+
+func TestWitness_RejectsData(t *testing.T) {
+	tests := []struct {
+		role, method, path string
+		want               int
+	}{
+		{config.NodeRoleWitness, http.MethodGet, "/v1/tables/t/keys/r", http.StatusServiceUnavailable},
+		{config.NodeRoleWitness, http.MethodPost, "/counter/c", http.StatusServiceUnavailable},
+		{config.NodeRoleVoter, http.MethodGet, "/v1/tables/t/keys/r", http.StatusOK},
+	}
+	for _, tt := range tests {
+		agent := &witnessAgent{joinAgent: joinAgent{row: &multiraft.Row{Columns: map[string]string{"c": "v"}}}}
+		n := &server{metadata: NewMetadata(), raftAgents: map[uint64]raftAgent{shardID1: agent}, config: &config.Config{NodeRole: tt.role}, logger: zap.NewNop(), authn: allowAll{}, authz: allowAll{}}
+		hs := &httpServer{node: n, logger: zap.NewNop()}
+		w := httptest.NewRecorder()
+		hs.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s %s %s = %d, want %d", tt.role, tt.method, tt.path, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/epsniff/expodb/pkg/server/agents/multiraft"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultWriteFreezeTimeout = 5 * time.Minute
+	maxWriteFreezeTimeout     = time.Hour
+	writeFreezeCheckInterval  = 5 * time.Second
+)
+
+// FreezeWrites rejects client writes on every node until ThawWrites is
+// called or timeout has passed.  The freeze goes through raft, so every write
+// applied after the returned index is rejected: once a replica has applied
+// that index its data is a consistent backup.
+func (n *server) FreezeWrites(ctx context.Context, timeout time.Duration) (uint64, error) {
+	if timeout <= 0 {
+		timeout = defaultWriteFreezeTimeout
+	}
+	if timeout > maxWriteFreezeTimeout {
+		return 0, fmt.Errorf("write freeze timeout %v exceeds the maximum of %v", timeout, maxWriteFreezeTimeout)
+	}
+	deadline := time.Now().Add(timeout).UTC().Format(time.RFC3339Nano)
+	index, err := n.raftAgents[shardID1].Apply(ctx, multiraft.KVData{Op: multiraft.OpFreezeWrites, Val: deadline})
+	if err != nil {
+		return 0, fmt.Errorf("proposing write freeze: %w", err)
+	}
+	n.logger.Info("writes frozen cluster-wide", zap.String("until", deadline), zap.Uint64("index", index))
+	n.recordEvent(ctx, eventWritesFrozen, n.config.ID(), "until "+deadline)
+	return index, nil
+}
+
+// ThawWrites lifts a write freeze.
+func (n *server) ThawWrites(ctx context.Context) (uint64, error) {
+	index, err := n.raftAgents[shardID1].Apply(ctx, multiraft.KVData{Op: multiraft.OpFreezeWrites})
+	if err != nil {
+		return 0, fmt.Errorf("proposing write thaw: %w", err)
+	}
+	n.logger.Info("writes thawed cluster-wide", zap.Uint64("index", index))
+	n.recordEvent(ctx, eventWritesThawed, n.config.ID(), "")
+	return index, nil
+}
+
+// writeFrozenUntil returns the deadline of the write freeze as seen by the
+// local replica, the zero time when writes aren't frozen.
+func (n *server) writeFrozenUntil() (time.Time, error) {
+	n.raftAgentsMu.Lock()
+	agent, ok := n.raftAgents[shardID1]
+	n.raftAgentsMu.Unlock()
+	if !ok {
+		return time.Time{}, nil
+	}
+	res, err := agent.ReadLocal(multiraft.WriteFreezeQuery{})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return res.(time.Time), nil
+}
+
+// runWriteFreezeWatchdog is run by the leader, see leaderLoop.  It lifts a
+// freeze once its deadline has passed, so a forgotten freeze, or one whose
+// operator went away, doesn't block writes forever.
+func (n *server) runWriteFreezeWatchdog(ctx context.Context) {
+	ticker := time.NewTicker(writeFreezeCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		until, err := n.writeFrozenUntil()
+		if err != nil {
+			n.logger.Warn("unable to read write freeze", zap.Error(err))
+			continue
+		}
+		if until.IsZero() || time.Now().Before(until) {
+			continue
+		}
+		n.logger.Warn("write freeze timed out, lifting it", zap.Time("until", until))
+		if _, err := n.ThawWrites(ctx); err != nil {
+			n.logger.Error("failed to lift timed out write freeze", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+type requestIDKey struct{}
+
+// maxRequestIDLen bounds the request IDs taken from clients, they end up in
+// every raft entry the request proposes.
+const maxRequestIDLen = 128
+
+// WithRequestID returns a copy of ctx carrying the request ID id.  The raft
+// entries proposed with it carry it too, so the logs of their apply on every
+// replica can be told apart by request.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, "" when it has none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID returns a random request ID, formatted like a W3C trace ID.
+func NewRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// ValidRequestID reports whether a client supplied ID can be used as is:
+// not too long, printable ASCII.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// TraceParentID returns the trace ID of a W3C traceparent header,
+// "00-<trace id>-<parent id>-<flags>", "" when it isn't one.
+func TraceParentID(header string) string {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || strings.Trim(parts[1], "0") == "" {
+		return ""
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil {
+		return ""
+	}
+	return parts[1]
+}
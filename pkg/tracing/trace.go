@@ -0,0 +1,65 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type traceKey struct{}
+
+// Trace records the internal steps taken to serve a single request, so slow
+// requests can be diagnosed without full tracing infrastructure.  A nil *Trace
+// is valid and records nothing, callers don't need to check FromContext.
+type Trace struct {
+	mu    sync.Mutex
+	start time.Time
+	steps []Step
+}
+
+// Step is one recorded point in a request's life.
+type Step struct {
+	Name      string  `json:"step"`
+	ElapsedMs float64 `json:"elapsed_ms"`
+	Detail    string  `json:"detail,omitempty"`
+}
+
+// New starts a trace, elapsed times are relative to now.
+func New() *Trace {
+	return &Trace{start: time.Now()}
+}
+
+// NewContext returns a copy of ctx carrying t.
+func NewContext(ctx context.Context, t *Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// FromContext returns the trace carried by ctx, or nil.
+func FromContext(ctx context.Context) *Trace {
+	t, _ := ctx.Value(traceKey{}).(*Trace)
+	return t
+}
+
+// Step records that name happened now.
+func (t *Trace) Step(name, detail string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.steps = append(t.steps, Step{
+		Name:      name,
+		ElapsedMs: float64(time.Since(t.start).Microseconds()) / 1000,
+		Detail:    detail,
+	})
+}
+
+// Steps returns a copy of the recorded steps.
+func (t *Trace) Steps() []Step {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Step(nil), t.steps...)
+}
@@ -0,0 +1,45 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTrace(t *testing.T) {
+	var none *Trace
+	none.Step("ignored", "")
+	if steps := none.Steps(); steps != nil {
+		t.Errorf("nil trace recorded %v", steps)
+	}
+	if tr := FromContext(context.Background()); tr != nil {
+		t.Errorf("FromContext() without a trace = %v, want nil", tr)
+	}
+
+	tr := New()
+	ctx := NewContext(context.Background(), tr)
+	tests := []struct{ name, detail string }{
+		{"received", "POST /key/_fetch"},
+		{"read index", ""},
+		{"local lookup done", "applied index 12"},
+	}
+	for _, tt := range tests {
+		FromContext(ctx).Step(tt.name, tt.detail)
+	}
+	steps := tr.Steps()
+	if len(steps) != len(tests) {
+		t.Fatalf("Steps() = %v, want %d steps", steps, len(tests))
+	}
+	for i, tt := range tests {
+		if steps[i].Name != tt.name || steps[i].Detail != tt.detail {
+			t.Errorf("step %d = %+v, want %s (%s)", i, steps[i], tt.name, tt.detail)
+		}
+		if i > 0 && steps[i].ElapsedMs < steps[i-1].ElapsedMs {
+			t.Errorf("step %d at %vms, before step %d at %vms", i, steps[i].ElapsedMs, i-1, steps[i-1].ElapsedMs)
+		}
+	}
+	// the steps returned are a copy.
+	steps[0].Name = "changed"
+	if tr.Steps()[0].Name != "received" {
+		t.Error("Steps() returned the trace's own slice")
+	}
+}
@@ -1,3 +1,72 @@
+// Package version describes the build of the running binary and the
+// protocols it speaks, so clusters mixing releases can be told apart.
 package version
 
-var ServerVersion string = "0.1"
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// ServerVersion is the release's semantic version.  GitCommit and BuildDate
+// (RFC 3339) are set at build time, e.g.
+//
+//	go build -ldflags "-X github.com/epsniff/expodb/pkg/version.GitCommit=$(git rev-parse HEAD)"
+//
+// when left empty Get takes them from the VCS stamp go build embeds.
+var (
+	ServerVersion string = "0.1.0"
+	GitCommit     string
+	BuildDate     string
+)
+
+const (
+	// APIVersion is the REST API version served, the /v1 path prefix.
+	APIVersion = "v1"
+	// FSMProtocol is the version of the raft entries the FSM applies.  It
+	// is bumped by releases adding entries older replicas can't apply, so
+	// a cluster is upgraded all the way before those are proposed.
+	FSMProtocol = 1
+)
+
+// Info is the build and protocols of a binary.
+type Info struct {
+	Version     string   `json:"version"`
+	GitCommit   string   `json:"git_commit,omitempty"`
+	BuildDate   string   `json:"build_date,omitempty"`
+	GoVersion   string   `json:"go_version"`
+	APIVersions []string `json:"api_versions"`
+	FSMProtocol int      `json:"fsm_protocol"`
+}
+
+// Get returns the running binary's Info.
+func Get() Info {
+	info := Info{
+		Version:     ServerVersion,
+		GitCommit:   GitCommit,
+		BuildDate:   BuildDate,
+		GoVersion:   runtime.Version(),
+		APIVersions: []string{APIVersion},
+		FSMProtocol: FSMProtocol,
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		modified := false
+		for _, s := range build.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.GitCommit == "" {
+					info.GitCommit = s.Value
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = s.Value
+				}
+			case "vcs.modified":
+				modified = s.Value == "true"
+			}
+		}
+		if modified && GitCommit == "" && info.GitCommit != "" {
+			info.GitCommit += "-dirty"
+		}
+	}
+	return info
+}